@@ -0,0 +1,65 @@
+package gkvlite
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// The most bytes of alignment of SetAlignment().
+const MaxAlignment = 1 << 20
+
+// Sets the alignment of the records that a Flush() appends, such as the
+// node, item and roots records, to n bytes, a power of 2, so that each
+// record starts at an offset that's a multiple of n, such as the page
+// or block size of the StoreFile's device, where the bytes before an
+// aligned record are zero padding.  An alignment of 0 or 1 (the
+// default) appends records without padding.  The alignment is
+// persisted in the roots record, so that the writes after reopening the
+// file stay aligned.  The records that were written before the
+// alignment was set aren't moved, and reused free space (see
+// SetReuseFreeSpace()) is only reused at aligned offsets.
+func (s *Store) SetAlignment(n int) error {
+	if s.file == nil {
+		return errors.New("no file / in-memory only, so no records to align")
+	}
+	if s.readOnly {
+		return fmt.Errorf("%w, so cannot SetAlignment()", ErrReadOnly)
+	}
+	if n < 0 || n > MaxAlignment || n&(n-1) != 0 {
+		return fmt.Errorf("alignment must be a power of 2 up to %v, got: %v",
+			MaxAlignment, n)
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.isClosed() {
+		return ErrStoreClosed
+	}
+	s.alignment = int64(n)
+	return nil
+}
+
+// Returns the alignment of the records, see SetAlignment().
+func (s *Store) Alignment() int {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.alignment <= 1 {
+		return 1
+	}
+	return int(s.alignment)
+}
+
+// Rounds the offset or length up to the alignment.  Invoked while the
+// writeLock is held.
+func (s *Store) alignUp(n int64) int64 {
+	if a := s.alignment; a > 1 {
+		return (n + a - 1) &^ (a - 1)
+	}
+	return n
+}
+
+// Returns the offset of a record that's appended to the file.  Invoked
+// while the writeLock is held.
+func (s *Store) appendOffset() int64 {
+	return s.alignUp(atomic.LoadInt64(&s.size))
+}
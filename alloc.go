@@ -7,41 +7,167 @@ import (
 	"unsafe"
 )
 
-var freeNodeLock sync.Mutex
-var freeNodes *node
+// The free lists of a collection's nodes, nodeLocs and rootNodeLocs.
+// They're shared with the snapshots of the collection and with the
+// Collections that SetCollection() returns for its name, which share
+// its rootLock and nodes, but not with other collections, so that
+// writers of different collections don't contend on them.
+type freeLists struct {
+	// Atomic counters must be at the top for 32-bit compatibility.
 
-var freeNodeLocLock sync.Mutex
-var freeNodeLocs *nodeLoc
+	// Number of rootNodeLoc's that were replaced as the collection's
+	// root but whose nodes aren't reclaimed yet, as readers still
+	// reference them.
+	reclaimPending int64
 
-var freeRootNodeLocLock sync.Mutex
-var freeRootNodeLocs *rootNodeLoc
+	nodeLock sync.Mutex
+	nodes    *node
+	numNodes int64 // Current length of nodes.
 
-var allocStats AllocStats
+	nodeLocLock sync.Mutex
+	nodeLocs    *nodeLoc
+	numNodeLocs int64 // Current length of nodeLocs.
+
+	rootNodeLocLock sync.Mutex
+	rootNodeLocs    *rootNodeLoc
+	numRootNodeLocs int64 // Current length of rootNodeLocs.
+}
+
+// The ends of non-empty free lists, so that every free entry has a
+// non-nil next, which detects double frees.
+var freeNodesEnd = &node{}
+var freeNodeLocsEnd = &nodeLoc{}
+var freeRootNodeLocsEnd = &rootNodeLoc{}
 
 type AllocStats struct {
 	MkNodes      int64
 	FreeNodes    int64 // Number of invocations of the freeNode() API.
 	AllocNodes   int64
-	CurFreeNodes int64 // Current length of freeNodes list.
+	CurFreeNodes int64 // Current length of the node free list.
 
 	MkNodeLocs      int64
 	FreeNodeLocs    int64 // Number of invocations of the freeNodeLoc() API.
 	AllocNodeLocs   int64
-	CurFreeNodeLocs int64 // Current length of freeNodeLocs list.
+	CurFreeNodeLocs int64 // Current length of the nodeLoc free list.
 
 	MkRootNodeLocs      int64
 	FreeRootNodeLocs    int64 // Number of invocations of the freeRootNodeLoc() API.
 	AllocRootNodeLocs   int64
-	CurFreeRootNodeLocs int64 // Current length of freeRootNodeLocs list.
+	CurFreeRootNodeLocs int64 // Current length of the rootNodeLoc free list.
+}
+
+// Allocation statistics of a Store, see Store.AllocStats().  The free
+// lists are per collection (and shared with its snapshots), so the
+// Free and ReclaimPending counts are the sums over the Store's current
+// collections.
+type StoreAllocStats struct {
+	NodeAllocs       uint64 `json:"nodeAllocs"`       // Nodes not reused from the free list or NodePool.
+	NodePoolGets     uint64 `json:"nodePoolGets"`     // Nodes reused from the NodePool.
+	FreeNodes        int64  `json:"freeNodes"`        // Current length of the node free list.
+	FreeNodeLocs     int64  `json:"freeNodeLocs"`     // Current length of the nodeLoc free list.
+	FreeRootNodeLocs int64  `json:"freeRootNodeLocs"` // Current length of the rootNodeLoc free list.
+	ItemAddRefs      uint64 `json:"itemAddRefs"`      // Invocations of ItemAddRef().
+	ItemDecRefs      uint64 `json:"itemDecRefs"`      // Invocations of ItemDecRef().
+
+	// Replaced roots whose nodes are reclaimed once their readers
+	// (such as snapshots and visitors) are done.
+	ReclaimPending int64 `json:"reclaimPending"`
+}
+
+// Returns the allocation statistics of the Store.
+func (s *Store) AllocStats() (res StoreAllocStats) {
+	for _, f := range s.freeLists() {
+		f.withLocks(func() {
+			res.FreeNodes += f.numNodes
+			res.FreeNodeLocs += f.numNodeLocs
+			res.FreeRootNodeLocs += f.numRootNodeLocs
+		})
+		res.ReclaimPending += atomic.LoadInt64(&f.reclaimPending)
+	}
+	res.NodeAllocs = atomic.LoadUint64(&s.nodeAllocs)
+	res.NodePoolGets = atomic.LoadUint64(&s.nodePoolGets)
+	res.ItemAddRefs = atomic.LoadUint64(&s.itemAddRefs)
+	res.ItemDecRefs = atomic.LoadUint64(&s.itemDecRefs)
+	return res
+}
+
+// Shortens each of the free lists of the Store's collections to at most
+// keep entries, so that the Go GC can collect the rest, such as after a
+// burst of deletes.  The snapshots of the collections share their free
+// lists.  Returns the number of released entries.
+func (s *Store) TrimFreeLists(keep int) (released int64) {
+	if keep < 0 {
+		keep = 0
+	}
+	for _, f := range s.freeLists() {
+		f.withLocks(func() { released += f.trim(int64(keep)) })
+	}
+	return released
+}
+
+// Returns the distinct free lists of the current collections.
+func (s *Store) freeLists() []*freeLists {
+	var res []*freeLists
+	seen := map[*freeLists]bool{}
+	for _, c := range s.collections() {
+		if c.frees != nil && !seen[c.frees] {
+			seen[c.frees] = true
+			res = append(res, c.frees)
+		}
+	}
+	return res
+}
+
+func (f *freeLists) trim(keep int64) (released int64) {
+	if f.numNodes > keep {
+		if keep == 0 {
+			f.nodes = nil
+		} else {
+			n := f.nodes
+			for i := int64(1); i < keep; i++ {
+				n = n.next
+			}
+			n.next = freeNodesEnd
+		}
+		released += f.numNodes - keep
+		f.numNodes = keep
+	}
+	if f.numNodeLocs > keep {
+		if keep == 0 {
+			f.nodeLocs = nil
+		} else {
+			nloc := f.nodeLocs
+			for i := int64(1); i < keep; i++ {
+				nloc = nloc.next
+			}
+			nloc.next = freeNodeLocsEnd
+		}
+		released += f.numNodeLocs - keep
+		f.numNodeLocs = keep
+	}
+	if f.numRootNodeLocs > keep {
+		if keep == 0 {
+			f.rootNodeLocs = nil
+		} else {
+			rnl := f.rootNodeLocs
+			for i := int64(1); i < keep; i++ {
+				rnl = rnl.next
+			}
+			rnl.next = freeRootNodeLocsEnd
+		}
+		released += f.numRootNodeLocs - keep
+		f.numRootNodeLocs = keep
+	}
+	return released
 }
 
-func withAllocLocks(cb func()) {
-	freeNodeLock.Lock()
-	freeNodeLocLock.Lock()
-	freeRootNodeLocLock.Lock()
-	defer freeNodeLock.Unlock()
-	defer freeNodeLocLock.Unlock()
-	defer freeRootNodeLocLock.Unlock()
+func (f *freeLists) withLocks(cb func()) {
+	f.nodeLock.Lock()
+	f.nodeLocLock.Lock()
+	f.rootNodeLocLock.Lock()
+	defer f.nodeLock.Unlock()
+	defer f.nodeLocLock.Unlock()
+	defer f.rootNodeLocLock.Unlock()
 	cb()
 }
 
@@ -72,8 +198,8 @@ func (t *Collection) reclaimMarkUpdate(nloc *nodeLoc,
 	return n
 }
 
-func (t *Collection) reclaimNodes_unlocked(n *node,
-	reclaimLater *[3]*node, reclaimMark *node) int64 {
+func (t *Collection) reclaimNodes_unlocked(n *node, loc *ploc,
+	reclaimLater *[3]*node, reclaimMark *node, deadLocs *[]ploc) int64 {
 	if n == nil {
 		return 0
 	}
@@ -87,8 +213,13 @@ func (t *Collection) reclaimNodes_unlocked(n *node,
 	if n.next != reclaimMark {
 		return 0
 	}
+	if deadLocs != nil && !loc.isEmpty() {
+		*deadLocs = append(*deadLocs, *loc)
+	}
 	var left *node
 	var right *node
+	leftLoc := n.left.Loc()
+	rightLoc := n.right.Loc()
 	if !n.left.isEmpty() {
 		left = n.left.Node()
 	}
@@ -96,28 +227,79 @@ func (t *Collection) reclaimNodes_unlocked(n *node,
 		right = n.right.Node()
 	}
 	t.freeNode_unlocked(n, reclaimMark)
-	numLeft := t.reclaimNodes_unlocked(left, reclaimLater, reclaimMark)
-	numRight := t.reclaimNodes_unlocked(right, reclaimLater, reclaimMark)
+	numLeft := t.reclaimNodes_unlocked(left, leftLoc,
+		reclaimLater, reclaimMark, deadLocs)
+	numRight := t.reclaimNodes_unlocked(right, rightLoc,
+		reclaimLater, reclaimMark, deadLocs)
 	return 1 + numLeft + numRight
 }
 
+// Frees the nodes that a mutation marked reclaimable but that aren't
+// reachable from the mutation's original root, as the mutation itself
+// created and then replaced them, so they were never visible to
+// readers.  They're searched for from the given tops.
+func (t *Collection) reclaimUnpublished(root *nodeLoc, tops []*node,
+	reclaimMark *node) (numReclaimed int64) {
+	t.rootLock.Lock()
+	t.frees.nodeLock.Lock()
+	defer t.rootLock.Unlock()
+	defer t.frees.nodeLock.Unlock()
+	seen := map[*node]bool{}
+	var markSeen func(nloc *nodeLoc)
+	markSeen = func(nloc *nodeLoc) {
+		if nloc.isEmpty() {
+			return
+		}
+		n := nloc.Node()
+		if n == nil || n.next != reclaimMark || seen[n] {
+			return
+		}
+		seen[n] = true
+		markSeen(&n.left)
+		markSeen(&n.right)
+	}
+	markSeen(root)
+	var reclaim func(n *node)
+	reclaim = func(n *node) {
+		if n == nil || n.next != reclaimMark || seen[n] {
+			return
+		}
+		seen[n] = true
+		var left, right *node
+		if !n.left.isEmpty() {
+			left = n.left.Node()
+		}
+		if !n.right.isEmpty() {
+			right = n.right.Node()
+		}
+		t.freeNode_unlocked(n, reclaimMark)
+		numReclaimed++
+		reclaim(left)
+		reclaim(right)
+	}
+	for _, n := range tops {
+		reclaim(n)
+	}
+	return numReclaimed
+}
+
 // Assumes that the caller serializes invocations.
 func (t *Collection) mkNode(itemIn *itemLoc, leftIn *nodeLoc, rightIn *nodeLoc,
 	numNodesIn uint64, numBytesIn uint64) *node {
-	freeNodeLock.Lock()
-	allocStats.MkNodes++
+	f := t.frees
+	f.nodeLock.Lock()
 	t.allocStats.MkNodes++
-	n := freeNodes
+	n := f.nodes
 	if n == nil {
-		allocStats.AllocNodes++
 		t.allocStats.AllocNodes++
-		freeNodeLock.Unlock()
-		atomic.AddUint64(&t.store.nodeAllocs, 1)
-		n = &node{}
+		f.nodeLock.Unlock()
+		n = t.store.allocNode()
 	} else {
-		freeNodes = n.next
-		allocStats.CurFreeNodes--
-		freeNodeLock.Unlock()
+		if f.nodes = n.next; f.nodes == freeNodesEnd {
+			f.nodes = nil
+		}
+		f.numNodes--
+		f.nodeLock.Unlock()
 	}
 	if itemIn != nil {
 		i := itemIn.Item()
@@ -131,6 +313,9 @@ func (t *Collection) mkNode(itemIn *itemLoc, leftIn *nodeLoc, rightIn *nodeLoc,
 	n.numNodes = numNodesIn
 	n.numBytes = numBytesIn
 	n.next = nil
+	if t.created != nil {
+		*t.created = append(*t.created, n)
+	}
 	return n
 }
 
@@ -150,28 +335,35 @@ func (t *Collection) freeNode_unlocked(n *node, reclaimMark *node) {
 	n.right = *empty_nodeLoc
 	n.numNodes = 0
 	n.numBytes = 0
-	n.next = freeNodes
-	freeNodes = n
-	allocStats.CurFreeNodes++
-	allocStats.FreeNodes++
 	t.allocStats.FreeNodes++
+	if p := t.store.callbacks.NodePool; p != nil {
+		n.next = freeNodesEnd // Until reused, for the double free check.
+		p.Put(n)
+		return
+	}
+	if n.next = t.frees.nodes; n.next == nil {
+		n.next = freeNodesEnd
+	}
+	t.frees.nodes = n
+	t.frees.numNodes++
 }
 
 // Assumes that the caller serializes invocations.
 func (t *Collection) mkNodeLoc(n *node) *nodeLoc {
-	freeNodeLocLock.Lock()
-	allocStats.MkNodeLocs++
+	f := t.frees
+	f.nodeLocLock.Lock()
 	t.allocStats.MkNodeLocs++
-	nloc := freeNodeLocs
+	nloc := f.nodeLocs
 	if nloc == nil {
-		allocStats.AllocNodeLocs++
 		t.allocStats.AllocNodeLocs++
-		freeNodeLocLock.Unlock()
+		f.nodeLocLock.Unlock()
 		nloc = &nodeLoc{}
 	} else {
-		freeNodeLocs = nloc.next
-		allocStats.CurFreeNodeLocs--
-		freeNodeLocLock.Unlock()
+		if f.nodeLocs = nloc.next; f.nodeLocs == freeNodeLocsEnd {
+			f.nodeLocs = nil
+		}
+		f.numNodeLocs--
+		f.nodeLocLock.Unlock()
 	}
 	nloc.loc = unsafe.Pointer(nil)
 	nloc.node = unsafe.Pointer(n)
@@ -190,29 +382,32 @@ func (t *Collection) freeNodeLoc(nloc *nodeLoc) {
 	nloc.loc = unsafe.Pointer(nil)
 	nloc.node = unsafe.Pointer(nil)
 
-	freeNodeLocLock.Lock()
-	nloc.next = freeNodeLocs
-	freeNodeLocs = nloc
-	allocStats.CurFreeNodeLocs++
-	allocStats.FreeNodeLocs++
+	f := t.frees
+	f.nodeLocLock.Lock()
+	if nloc.next = f.nodeLocs; nloc.next == nil {
+		nloc.next = freeNodeLocsEnd
+	}
+	f.nodeLocs = nloc
+	f.numNodeLocs++
 	t.allocStats.FreeNodeLocs++
-	freeNodeLocLock.Unlock()
+	f.nodeLocLock.Unlock()
 }
 
 func (t *Collection) mkRootNodeLoc(root *nodeLoc) *rootNodeLoc {
-	freeRootNodeLocLock.Lock()
-	allocStats.MkRootNodeLocs++
+	f := t.frees
+	f.rootNodeLocLock.Lock()
 	t.allocStats.MkRootNodeLocs++
-	rnl := freeRootNodeLocs
+	rnl := f.rootNodeLocs
 	if rnl == nil {
-		allocStats.AllocRootNodeLocs++
 		t.allocStats.AllocRootNodeLocs++
-		freeRootNodeLocLock.Unlock()
+		f.rootNodeLocLock.Unlock()
 		rnl = &rootNodeLoc{}
 	} else {
-		freeRootNodeLocs = rnl.next
-		allocStats.CurFreeRootNodeLocs--
-		freeRootNodeLocLock.Unlock()
+		if f.rootNodeLocs = rnl.next; f.rootNodeLocs == freeRootNodeLocsEnd {
+			f.rootNodeLocs = nil
+		}
+		f.numRootNodeLocs--
+		f.rootNodeLocLock.Unlock()
 	}
 	rnl.refs = 1
 	rnl.root = root
@@ -221,7 +416,11 @@ func (t *Collection) mkRootNodeLoc(root *nodeLoc) *rootNodeLoc {
 	rnl.chainedRootNodeLoc = nil
 	for i := 0; i < len(rnl.reclaimLater); i++ {
 		rnl.reclaimLater[i] = nil
+		rnl.reclaimLaterLocs[i] = nil
 	}
+	rnl.deadLocs = nil
+	rnl.closed = false
+	rnl.superseded = false
 	return rnl
 }
 
@@ -242,11 +441,13 @@ func (t *Collection) freeRootNodeLoc(rnl *rootNodeLoc) {
 				i, rnl.reclaimLater[i]))
 		}
 	}
-	freeRootNodeLocLock.Lock()
-	rnl.next = freeRootNodeLocs
-	freeRootNodeLocs = rnl
-	allocStats.CurFreeRootNodeLocs++
-	allocStats.FreeRootNodeLocs++
+	f := t.frees
+	f.rootNodeLocLock.Lock()
+	if rnl.next = f.rootNodeLocs; rnl.next == nil {
+		rnl.next = freeRootNodeLocsEnd
+	}
+	f.rootNodeLocs = rnl
+	f.numRootNodeLocs++
 	t.allocStats.FreeRootNodeLocs++
-	freeRootNodeLocLock.Unlock()
+	f.rootNodeLocLock.Unlock()
 }
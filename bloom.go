@@ -0,0 +1,360 @@
+package gkvlite
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Filters are never sized for fewer keys than this.
+const bloomMinKeys = 1024
+
+// A bloom filter of the keys that were set in a collection, see
+// EnableBloomFilter().  Its bits are set while the Collection's writeLock
+// is held and read by readers without locks, so they're accessed
+// atomically.  A filter is never shrunk or cleared in place; it's
+// replaced by a rebuilt one instead.
+type bloomFilter struct {
+	bits       []uint64
+	k          uint32 // Number of probes per key.
+	bitsPerKey int
+
+	// The following are protected by the Collection's writeLock.
+	added    uint64 // Number of keys that set bits.
+	capacity uint64 // Number of keys the filter was sized for.
+	loc      *ploc  // The persisted record of the filter, if any.
+	dirty    bool   // Whether the filter changed since it was persisted.
+}
+
+// The JSON of a persisted bloom filter in a roots record, whose
+// record holds the bits as big-endian uint64's.
+type bloomJSON struct {
+	ploc
+	BitsPerKey int    `json:"b"`
+	K          uint32 `json:"p"`
+	Added      uint64 `json:"n"`
+	Capacity   uint64 `json:"m"`
+	Checksum   uint32 `json:"k"`
+}
+
+// Enables a bloom filter of the collection's keys, with bitsPerKey bits
+// per key (10 gives about a 1% false positive rate), which GetItem(),
+// Get() and friends consult before walking the tree, so that most
+// lookups of absent keys return without any node or item reads.  The
+// filter is built from a traversal of the collection, so this reads
+// every key, and it's then maintained by SetItem(), while deletes
+// just leave false positives behind.  As the filter fills up, SetItem()
+// rebuilds it with room for twice the number of items, which is again
+// a traversal; RebuildBloomFilter() also drops the deleted keys.  A
+// bitsPerKey of 0 disables the filter.
+//
+// The filter is persisted by Flush() (only when it changed) and
+// noted in the roots record, so that it's loaded when the file is
+// reopened, and such files can't be read by older versions of
+// gkvlite.  Snapshots don't use the filter.  As the filter hashes the
+// key bytes, it must not be used with a KeyCompare under which unequal
+// byte strings may be equal keys.  The filter carries over to the
+// Collection that SetCollection() returns for an existing name.
+func (t *Collection) EnableBloomFilter(bitsPerKey int) error {
+	if bitsPerKey < 0 {
+		return errors.New("bitsPerKey must be non-negative")
+	}
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	if t.store.isClosed() {
+		return ErrStoreClosed
+	}
+	if bitsPerKey == 0 {
+		t.dropBloomFilter()
+		return nil
+	}
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return err
+	}
+	defer t.openRootDecRef(rnl)
+	return t.rebuildBloomFilter(rnl.root, bitsPerKey)
+}
+
+// Rebuilds the bloom filter from a traversal of the collection, which
+// drops the deleted keys and resizes the filter for the current number
+// of items.
+func (t *Collection) RebuildBloomFilter() error {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	if t.store.isClosed() {
+		return ErrStoreClosed
+	}
+	f := t.bloomFilter()
+	if f == nil {
+		return errors.New("no bloom filter, see EnableBloomFilter()")
+	}
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return err
+	}
+	defer t.openRootDecRef(rnl)
+	return t.rebuildBloomFilter(rnl.root, f.bitsPerKey)
+}
+
+func (t *Collection) bloomFilter() *bloomFilter {
+	return (*bloomFilter)(atomic.LoadPointer(&t.bloom))
+}
+
+// Replaces the bloom filter with one of the keys under root.  Invoked
+// while the writeLock is held.
+func (t *Collection) rebuildBloomFilter(root *nodeLoc, bitsPerKey int) error {
+	var numItems uint64
+	nNode, err := root.read(t.store)
+	if err != nil {
+		return err
+	}
+	if nNode != nil && !root.isEmpty() {
+		numItems = nNode.numNodes
+	}
+	f := newBloomFilter(bitsPerKey, 2*numItems)
+	_, err = t.store.visitNodes(t, root, nil, false,
+		func(i *Item, depth uint64) bool {
+			f.add(i.Key)
+			return true
+		}, 0, ascendAllChoice)
+	if err != nil {
+		return err
+	}
+	t.dropBloomFilter()
+	atomic.StorePointer(&t.bloom, unsafe.Pointer(f))
+	return nil
+}
+
+// Disables the bloom filter, whose persisted record is then dead.
+func (t *Collection) dropBloomFilter() {
+	if f := t.bloomFilter(); f != nil {
+		atomic.StorePointer(&t.bloom, nil)
+		if f.loc != nil {
+			t.store.freeList.addPending([]ploc{*f.loc})
+		}
+	}
+}
+
+func newBloomFilter(bitsPerKey int, capacity uint64) *bloomFilter {
+	if capacity < bloomMinKeys {
+		capacity = bloomMinKeys
+	}
+	k := uint32(math.Round(float64(bitsPerKey) * math.Ln2))
+	if k < 1 {
+		k = 1
+	} else if k > 30 {
+		k = 30
+	}
+	return &bloomFilter{
+		bits:       make([]uint64, (capacity*uint64(bitsPerKey)+63)/64),
+		k:          k,
+		bitsPerKey: bitsPerKey,
+		capacity:   capacity,
+		dirty:      true,
+	}
+}
+
+// 64-bit FNV-1a, inlined to not allocate a hash.Hash64 per key.
+func bloomHash(key []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return h
+}
+
+// Calls probe with the bit positions of the key, by double hashing,
+// until probe returns false.
+func (f *bloomFilter) probes(key []byte, probe func(word int, mask uint64) bool) {
+	h := bloomHash(key)
+	delta := h>>33 | h<<31
+	n := uint64(len(f.bits)) * 64
+	for i := uint32(0); i < f.k; i++ {
+		bit := h % n
+		if !probe(int(bit/64), uint64(1)<<(bit%64)) {
+			return
+		}
+		h += delta
+	}
+}
+
+func (f *bloomFilter) mayContain(key []byte) bool {
+	res := true
+	f.probes(key, func(word int, mask uint64) bool {
+		res = atomic.LoadUint64(&f.bits[word])&mask != 0
+		return res
+	})
+	return res
+}
+
+// Adds the key, counting it only if it wasn't apparently added before,
+// so that updates of existing keys don't count towards the capacity.
+func (f *bloomFilter) add(key []byte) {
+	added := false
+	f.probes(key, func(word int, mask uint64) bool {
+		if atomic.OrUint64(&f.bits[word], mask)&mask == 0 {
+			added = true
+		}
+		return true
+	})
+	if added {
+		f.added++
+		f.dirty = true
+	}
+}
+
+// Adds the key of an item that's about to be set under the new root,
+// and replaces a full filter with one rebuilt from root.  Invoked while
+// the writeLock is held and before the new root is published, so that
+// readers never see a key that the filter doesn't have.
+func (t *Collection) bloomAdd(key []byte, root *nodeLoc) {
+	f := t.bloomFilter()
+	if f == nil {
+		return
+	}
+	f.add(key)
+	if f.added > f.capacity {
+		if err := t.rebuildBloomFilter(root, f.bitsPerKey); err != nil {
+			t.store.logf("bloom filter rebuild failed, coll: %v, err: %v",
+				t.name, err)
+			f.capacity *= 2 // Keep the full filter for a while.
+		}
+	}
+}
+
+// Returns whether the key may be in the collection, which is true when
+// the collection has no bloom filter.
+func (t *Collection) bloomMayContain(key []byte) bool {
+	f := t.bloomFilter()
+	if f == nil || f.mayContain(key) {
+		return true
+	}
+	t.store.metricsCounter("bloomFilterNegatives", 1)
+	return false
+}
+
+// Writes the bloom filter, when it changed since it was last written.
+// Invoked by Flush() while the writeLock is held.
+func (t *Collection) writeBloomFilter() error {
+	f := t.bloomFilter()
+	if f == nil || !f.dirty {
+		return nil
+	}
+	b := make([]byte, len(f.bits)*8)
+	for i := range f.bits {
+		binary.BigEndian.PutUint64(b[i*8:], atomic.LoadUint64(&f.bits[i]))
+	}
+	o := t.store
+	length := len(b)
+	offset, appended := o.appendOffset(), true
+	if o.encrypted {
+		var err error
+		if b, err = o.callbacks.Encrypt(b, offset); err != nil {
+			return err
+		}
+		length = len(b)
+	} else {
+		offset, appended = o.allocRecord(length)
+	}
+	if err := o.writeAt(b, offset); err != nil {
+		return err
+	}
+	if appended {
+		atomic.StoreInt64(&o.size, offset+int64(length))
+	}
+	o.flushLogBloom(f)
+	if f.loc != nil {
+		o.freeList.addPending([]ploc{*f.loc})
+	}
+	f.loc = &ploc{Offset: offset, Length: uint32(length)}
+	f.dirty = false
+	return nil
+}
+
+// Invoked when the Store switched to another file, such as by
+// auto-compaction, so that the bloom filter is written again.
+func (t *Collection) bloomFileChanged() {
+	if f := t.bloomFilter(); f != nil {
+		f.loc = nil
+		f.dirty = true
+	}
+}
+
+// Returns the roots record JSON of the persisted bloom filter, if any.
+func (t *Collection) bloomFilterJSON() *bloomJSON {
+	f := t.bloomFilter()
+	if f == nil || f.loc == nil {
+		return nil
+	}
+	return &bloomJSON{
+		ploc:       *f.loc,
+		BitsPerKey: f.bitsPerKey,
+		K:          f.k,
+		Added:      f.added,
+		Capacity:   f.capacity,
+		Checksum:   f.checksum(),
+	}
+}
+
+func (f *bloomFilter) checksum() uint32 {
+	b := make([]byte, 8)
+	h := crc32.NewIEEE()
+	for i := range f.bits {
+		binary.BigEndian.PutUint64(b, atomic.LoadUint64(&f.bits[i]))
+		h.Write(b)
+	}
+	return h.Sum32()
+}
+
+// Loads the persisted bloom filter that was noted by UnmarshalJSON().
+// A filter that can't be read is dropped, as the collection works
+// without it.
+func (t *Collection) loadBloomFilter() {
+	bj := t.bloomPersisted
+	t.bloomPersisted = nil
+	if bj == nil {
+		return
+	}
+	f, err := t.store.readBloomFilter(bj)
+	if err != nil {
+		t.store.logf("bloom filter dropped, coll: %v, err: %v", t.name, err)
+		return
+	}
+	atomic.StorePointer(&t.bloom, unsafe.Pointer(f))
+}
+
+func (o *Store) readBloomFilter(bj *bloomJSON) (*bloomFilter, error) {
+	b := make([]byte, bj.Length)
+	if _, err := readFull(o.file, b, bj.Offset); err != nil {
+		return nil, err
+	}
+	if o.encrypted {
+		var err error
+		if b, err = o.callbacks.Decrypt(b, bj.Offset); err != nil {
+			return nil, err
+		}
+	}
+	if len(b) == 0 || len(b)%8 != 0 || bj.K == 0 || bj.BitsPerKey <= 0 {
+		return nil, errors.New("unexpected bloom filter record")
+	}
+	f := &bloomFilter{
+		bits:       make([]uint64, len(b)/8),
+		k:          bj.K,
+		bitsPerKey: bj.BitsPerKey,
+		added:      bj.Added,
+		capacity:   bj.Capacity,
+		loc:        &ploc{Offset: bj.Offset, Length: bj.Length},
+	}
+	for i := range f.bits {
+		f.bits[i] = binary.BigEndian.Uint64(b[i*8:])
+	}
+	if f.checksum() != bj.Checksum {
+		return nil, errors.New("bloom filter checksum mismatch")
+	}
+	return f, nil
+}
@@ -0,0 +1,293 @@
+package gkvlite
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"unsafe"
+)
+
+// When chunked, the value of an item is stored as a list of chunk
+// records, which are just value bytes, written before the item record.
+// The item record has the high bit of its priority set, like a prefix
+// compressed one, but its base offset is itemLoc_chunksBase, which is
+// -1 as an int64, and its shared length is 0, and after its whole key
+// it has a uint32 number of chunks and their ploc's, in value order.
+// As with prefix compression, the ploc.Length of the item and the
+// record's own length field are still those of the whole value, so that
+// NumBytes() stays meaningful, and a chunked record is never the base
+// of prefix compressed ones.  The chunk records and the item record's
+// real length are read back when the item dies, so that free space
+// reuse frees them all.
+const itemLoc_chunksBase = ^uint64(0)
+
+// The smallest chunk size of SetValueChunking(), where shorter chunks
+// aren't worth their ploc's.
+const MinValueChunkSize = 512
+
+// Enables the chunking of the values longer than threshold bytes that
+// items written by a Flush() have, into chunk records of chunkSize
+// bytes, except for a shorter last chunk, where a threshold of 0 (the
+// default) disables it.  This bounds the contiguous writes and reads of
+// very large values, and lets free space reuse (see
+// SetReuseFreeSpace()) place the chunks of a value in smaller dead
+// regions.  Item records that are already written aren't chunked or
+// unchunked, and the chunked values of a file are read whether or not
+// chunking is enabled, so reads see whole values either way.  For a
+// chunked value, an ItemValRead() callback gets a reader of the value
+// from offset 0, rather than of the file, and an ItemValWrite() callback
+// a writer of the value.  The setting isn't persisted.  The chunkSize
+// must be at least MinValueChunkSize and at most the threshold, and
+// chunking is not allowed with encryption, as the offsets of the chunks,
+// and so their nonces, aren't those of their item records.
+func (s *Store) SetValueChunking(threshold, chunkSize int) error {
+	if s.file == nil {
+		return errors.New("no file / in-memory only, so no values to chunk")
+	}
+	if s.readOnly {
+		return fmt.Errorf("%w, so cannot SetValueChunking()", ErrReadOnly)
+	}
+	if threshold != 0 && s.encrypted {
+		return errors.New("cannot chunk values with encryption")
+	}
+	if threshold < 0 || (threshold > 0 && (chunkSize < MinValueChunkSize ||
+		chunkSize > threshold)) {
+		return fmt.Errorf("value chunk size must be from %v to the threshold,"+
+			" threshold: %v, chunk size: %v", MinValueChunkSize, threshold, chunkSize)
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.isClosed() {
+		return ErrStoreClosed
+	}
+	s.chunkThreshold, s.chunkSize = threshold, chunkSize
+	return nil
+}
+
+// Whether the collection may have chunked item records.
+func (t *Collection) hasValueChunks() bool {
+	return atomic.LoadInt32(&t.valueChunksUsed) != 0
+}
+
+// Returns the number of chunks of a value of vlength bytes that's about
+// to be written, or 0 if it's not chunked.
+func (s *Store) valueChunks(vlength int) int {
+	if s.chunkThreshold <= 0 || vlength <= s.chunkThreshold {
+		return 0
+	}
+	return (vlength + s.chunkSize - 1) / s.chunkSize
+}
+
+// Writes the chunks of the value of an item and then its chunked item
+// record.
+func (i *itemLoc) writeChunked(c *Collection, iItem *Item, hdr []byte,
+	numChunks int, vlength int, ilength int) error {
+	s := c.store
+	chunks := make([]ploc, numChunks)
+	for k := range chunks {
+		length := vlength - k*s.chunkSize
+		if length > s.chunkSize {
+			length = s.chunkSize
+		}
+		offset, appended := s.allocRecord(length)
+		if appended {
+			atomic.StoreInt64(&s.size, offset+int64(length))
+		}
+		chunks[k] = ploc{Offset: offset, Length: uint32(length)}
+	}
+	w := chunkWriterAt{w: s.recordWriter(), chunks: chunks, chunkSize: s.chunkSize}
+	if err := s.ItemValWrite(c, iItem, w, 0); err != nil {
+		return err
+	}
+	b := make([]byte, chunkedRecordLength(len(iItem.Key), numChunks))
+	pos := copy(b, hdr[:itemLoc_hdrLength])
+	priority := binary.BigEndian.Uint32(b[pos-4 : pos])
+	binary.BigEndian.PutUint32(b[pos-4:pos], priority|itemLoc_prefixFlag)
+	binary.BigEndian.PutUint64(b[pos:pos+8], itemLoc_chunksBase)
+	pos += 8
+	binary.BigEndian.PutUint16(b[pos:pos+2], 0)
+	pos += 2
+	pos += copy(b[pos:], iItem.Key)
+	binary.BigEndian.PutUint32(b[pos:pos+4], uint32(numChunks))
+	pos += 4
+	for k := range chunks {
+		pos = chunks[k].write(b, pos)
+	}
+	offset, appended := s.allocRecord(len(b))
+	if err := s.writeAt(b, offset); err != nil {
+		return err
+	}
+	if appended {
+		atomic.StoreInt64(&s.size, offset+int64(len(b)))
+	}
+	atomic.StoreInt32(&c.valueChunksUsed, 1)
+	s.metricsCounter("valueChunks", int64(numChunks))
+	s.flushLogItem(i)
+	atomic.StorePointer(&i.loc,
+		unsafe.Pointer(&ploc{Offset: offset, Length: uint32(ilength)}))
+	return nil
+}
+
+// The length on disk of a chunked item record.
+func chunkedRecordLength(keyLength int, numChunks int) int {
+	return itemLoc_prefixHdrLength + keyLength + 4 + numChunks*ploc_length
+}
+
+// Reads the whole key of a chunked item record at loc from r into key,
+// returning the offset of its chunk list.
+func readChunkedKey(r io.ReaderAt, loc *ploc, key []byte) (int64, error) {
+	koffset := loc.Offset + int64(itemLoc_prefixHdrLength)
+	if _, err := readFull(r, key, koffset); err != nil {
+		return 0, err
+	}
+	return koffset + int64(len(key)), nil
+}
+
+// Reads the chunk list at offset from r, which must add up to
+// valLength, and returns a reader of the value from offset 0.
+func readValueChunks(r io.ReaderAt, offset int64,
+	valLength uint32) (*chunkReaderAt, error) {
+	chunks, err := readChunkList(r, offset)
+	if err != nil {
+		return nil, err
+	}
+	var total uint64
+	for k := range chunks {
+		if chunks[k].isEmpty() {
+			return nil, fmt.Errorf("empty value chunk: %v", k)
+		}
+		if k < len(chunks)-1 && chunks[k].Length != chunks[0].Length {
+			return nil, fmt.Errorf("unexpected value chunk length: %v != %v,"+
+				" chunk: %v", chunks[k].Length, chunks[0].Length, k)
+		}
+		total += uint64(chunks[k].Length)
+	}
+	if total != uint64(valLength) {
+		return nil, fmt.Errorf("mismatched value chunk lengths: %v != %v",
+			total, valLength)
+	}
+	chunkSize := 0
+	if len(chunks) > 0 {
+		chunkSize = int(chunks[0].Length)
+	}
+	return &chunkReaderAt{r: r, chunks: chunks, chunkSize: chunkSize}, nil
+}
+
+func readChunkList(r io.ReaderAt, offset int64) ([]ploc, error) {
+	b := make([]byte, 4)
+	if _, err := readFull(r, b, offset); err != nil {
+		return nil, err
+	}
+	numChunks := binary.BigEndian.Uint32(b)
+	if uint64(numChunks)*uint64(ploc_length) > uint64(MaxValLen) {
+		return nil, fmt.Errorf("unexpected number of value chunks: %v", numChunks)
+	}
+	b = make([]byte, int(numChunks)*ploc_length)
+	if _, err := readFull(r, b, offset+4); err != nil {
+		return nil, err
+	}
+	chunks := make([]ploc, numChunks)
+	for k, pos := 0, 0; k < len(chunks); k++ {
+		_, pos = chunks[k].read(b, pos)
+	}
+	return chunks, nil
+}
+
+// Returns the regions of the chunked item record at loc and of its
+// chunks, or just loc if the record isn't chunked.
+func (t *Collection) itemRegions(loc *ploc) ([]ploc, error) {
+	if !t.hasValueChunks() ||
+		loc.Length <= uint32(itemLoc_hdrLength+MinValueChunkSize) {
+		return []ploc{*loc}, nil
+	}
+	b := make([]byte, itemLoc_prefixHdrLength)
+	if _, err := readFull(t.store.file, b, loc.Offset); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(b[10:14])&itemLoc_prefixFlag == 0 ||
+		binary.BigEndian.Uint64(b[14:22]) != itemLoc_chunksBase {
+		return []ploc{*loc}, nil
+	}
+	keyLength := int(binary.BigEndian.Uint16(b[4:6]))
+	chunks, err := readChunkList(t.store.file,
+		loc.Offset+int64(itemLoc_prefixHdrLength+keyLength))
+	if err != nil {
+		return nil, err
+	}
+	return append(chunks, ploc{Offset: loc.Offset,
+		Length: uint32(chunkedRecordLength(keyLength, len(chunks)))}), nil
+}
+
+// An io.WriterAt of a value from offset 0, which writes through w into
+// the value's chunk records.
+type chunkWriterAt struct {
+	w         io.WriterAt
+	chunks    []ploc
+	chunkSize int
+}
+
+func (c chunkWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		k, within, m, err := chunkAt(c.chunks, c.chunkSize, off+int64(n), len(p)-n)
+		if err == io.EOF {
+			return n, fmt.Errorf("value chunk write out of range,"+
+				" off: %v, len: %v", off, len(p))
+		}
+		if err != nil {
+			return n, err
+		}
+		if _, err := writeFull(c.w, p[n:n+m], c.chunks[k].Offset+within); err != nil {
+			return n, err
+		}
+		n += m
+	}
+	return n, nil
+}
+
+// An io.ReaderAt of a value from offset 0, which reads through r from
+// the value's chunk records.
+type chunkReaderAt struct {
+	r         io.ReaderAt
+	chunks    []ploc
+	chunkSize int
+}
+
+func (c *chunkReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		k, within, m, err := chunkAt(c.chunks, c.chunkSize, off+int64(n), len(p)-n)
+		if err != nil {
+			return n, err
+		}
+		if _, err := readFull(c.r, p[n:n+m], c.chunks[k].Offset+within); err != nil {
+			return n, err
+		}
+		n += m
+	}
+	return n, nil
+}
+
+// Returns the chunk of the value offset off, the offset within the
+// chunk, and how many of the next want bytes are in the chunk.
+func chunkAt(chunks []ploc, chunkSize int, off int64,
+	want int) (k int, within int64, m int, err error) {
+	if off < 0 {
+		return 0, 0, 0, fmt.Errorf("negative value chunk offset: %v", off)
+	}
+	if chunkSize <= 0 || off/int64(chunkSize) >= int64(len(chunks)) {
+		return 0, 0, 0, io.EOF
+	}
+	k = int(off / int64(chunkSize))
+	within = off - int64(k)*int64(chunkSize)
+	if within >= int64(chunks[k].Length) {
+		return 0, 0, 0, io.EOF
+	}
+	m = want
+	if rest := int64(chunks[k].Length) - within; int64(m) > rest {
+		m = int(rest)
+	}
+	return k, within, m, nil
+}
@@ -1,10 +1,12 @@
 package gkvlite
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
+	"math"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"unsafe"
@@ -16,16 +18,55 @@ type KeyCompare func(a, b []byte) int
 
 // A persistable collection of ordered key-values (Item's).
 type Collection struct {
+	// Atomic counters must be at the top for 32-bit compatibility.
+	numGets, numSets, numDeletes, numEvictions uint64
+	numSetRetries, numSetsContended            uint64
+	numCompactions, compactedBytes             uint64
+
 	name    string // May be "" for a private collection.
+	seq     uint64 // Creation order, see ListCollections(); 0 when read from the file.
 	store   *Store
 	compare KeyCompare
 
+	compareName string // See SetCollectionNamedCompare(); "" when unnamed.
+	multi       bool   // See SetCollectionMulti(); persisted with the roots.
+
 	rootLock *sync.Mutex
 	root     *rootNodeLoc // Protected by rootLock.
 
-	allocStats AllocStats // User must serialize access (e.g., see locks in alloc.go).
+	// Serializes the mutations of the collection, see mutationLock().
+	// Shared, like rootLock, with the Collections that SetCollection()
+	// returns for the name.
+	writeLock *sync.Mutex
+
+	frees      *freeLists // Shared by the collections that share rootLock.
+	allocStats AllocStats // Protected by the locks of frees, see alloc.go.
 
 	AppData unsafe.Pointer // For app-specific data; atomic CAS recommended.
+
+	onMutation unsafe.Pointer // *MutationCallback, see OnMutation().
+	interning  unsafe.Pointer // *keyInterning, see SetKeyInterning().
+	bloom      unsafe.Pointer // *bloomFilter, see EnableBloomFilter().
+	lookups    unsafe.Pointer // *lookupCache, see SetLookupCache().
+	writer     unsafe.Pointer // *collWriter, see StartWriter().
+	setRetries unsafe.Pointer // *setRetryConfig, see SetMaxSetRetries().
+	meta       unsafe.Pointer // *map[string][]byte, see SetMeta().
+	rebalance  unsafe.Pointer // *rebalanceConfig, see SetAutoRebalance().
+	subs       unsafe.Pointer // *[]*Subscription, see Subscribe().
+
+	created *[]*node // The nodes made by the current write batch, see writer.go.
+
+	bloomPersisted *bloomJSON // From UnmarshalJSON(), until loaded.
+
+	keyPrefixes     int32          // Atomic protected; see SetKeyPrefixCompression().
+	keyPrefixesUsed int32          // Atomic protected; persisted with the roots.
+	prefixBase      *keyPrefixBase // Of the current write(), for writers only.
+	prefixCache     unsafe.Pointer // *keyPrefixCache, for readers.
+
+	valueChunksUsed int32 // Atomic protected; persisted with the roots.
+
+	keepVersions int32 // Atomic protected; see SetKeepVersions().
+	versionsUsed int32 // Atomic protected; persisted with the roots.
 }
 
 type rootNodeLoc struct {
@@ -45,6 +86,14 @@ type rootNodeLoc struct {
 	// More nodes to maybe reclaim when our reference count goes to 0.
 	// But they might be repeated, so we scan for them during reclaimation.
 	reclaimLater [3]*node
+
+	// Persisted regions that are dead once our reference count goes to
+	// 0, when free space reuse is enabled.  When closed, our nodes are
+	// reclaimed even though they're still live on disk.
+	deadLocs         []ploc
+	closed           bool
+	superseded       bool     // Replaced as the root, see freeLists.reclaimPending.
+	reclaimLaterLocs [3]*ploc // Persisted locations of the reclaimLater nodes.
 }
 
 func (t *Collection) Name() string {
@@ -52,14 +101,41 @@ func (t *Collection) Name() string {
 }
 
 func (t *Collection) closeCollection() { // Just "close" is a keyword.
+	t.closeCollectionEx(true)
+}
+
+// Closes a Collection whose root lives on in the Collection that
+// replaced it, such as by SetCollection(), so its nodes aren't marked
+// reclaimable, which would reclaim them once the replacement's first
+// mutation released the shared root.
+func (t *Collection) closeReplaced() {
+	t.closeCollectionEx(false)
+}
+
+func (t *Collection) closeCollectionEx(reclaim bool) {
 	if t == nil {
 		return
 	}
 	t.rootLock.Lock()
 	r := t.root
 	t.root = nil
+	if r != nil {
+		r.closed = true
+	}
 	t.rootLock.Unlock()
-	t.reclaimMarkUpdate(r.root, nil, &r.reclaimMark)
+	if w := (*collWriter)(atomic.SwapPointer(&t.writer, nil)); w != nil {
+		w.stop() // The queued writes fail, as the collection is closed.
+	}
+	if reclaim {
+		// The caches aren't shared with a replacement, so they're released.
+		lc := (*lookupCache)(atomic.SwapPointer(&t.lookups, nil))
+		if lc != nil {
+			lc.clear(t, true)
+		}
+		atomic.StorePointer(&t.interning, nil)
+		t.closeSubscriptions()
+		t.reclaimMarkUpdate(r.root, nil, &r.reclaimMark)
+	}
 	if r != nil {
 		t.rootDecRef(r)
 	}
@@ -70,21 +146,76 @@ func (t *Collection) closeCollection() { // Just "close" is a keyword.
 // to save on I/O and memory resources, especially for large values.
 // The returned Item should be treated as immutable.
 func (t *Collection) GetItem(key []byte, withValue bool) (i *Item, err error) {
-	rnl := t.rootAddRef()
-	defer t.rootDecRef(rnl)
-	n := rnl.root
+	atomic.AddUint64(&t.numGets, 1)
+	return t.getItem(key, withValue)
+}
+
+func (t *Collection) getItem(key []byte, withValue bool) (i *Item, err error) {
+	lc := t.lookupCache()
+	var gen uint64
+	if lc != nil {
+		if i, ok := lc.get(t, key, withValue); ok {
+			return i, nil
+		}
+		gen = atomic.LoadUint64(&lc.gen) // Before the root, see lookupCache.
+	}
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return nil, err
+	}
+	defer t.openRootDecRef(rnl)
+	iloc, iItem, err := t.lookup(rnl.root, key)
+	if err != nil {
+		return nil, err
+	}
+	if iItem != nil && withValue {
+		iItem, err = iloc.read(t, withValue)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if lc != nil {
+		lc.put(t, key, iItem, gen)
+	}
+	if iItem == nil {
+		return nil, nil
+	}
+	t.store.ItemAddRef(t, iItem)
+	return iItem, nil
+}
+
+// Returns whether the key is in the collection, from a walk down the
+// tree that doesn't read values nor return an Item, so it's cheaper
+// than a GetItem() without the value.
+func (t *Collection) Exists(key []byte) (bool, error) {
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return false, err
+	}
+	defer t.openRootDecRef(rnl)
+	_, i, err := t.lookup(rnl.root, key)
+	return i != nil, err
+}
+
+// Returns the itemLoc of the key and its item, read without its value,
+// or a nil item if the key is not under n.  The caller must hold a
+// reference on the root, taken before the bloom filter is consulted.
+func (t *Collection) lookup(n *nodeLoc, key []byte) (*itemLoc, *Item, error) {
+	if !t.bloomMayContain(key) {
+		return nil, nil, nil
+	}
 	for {
 		nNode, err := n.read(t.store)
 		if err != nil || n.isEmpty() || nNode == nil {
-			return nil, err
+			return nil, nil, err
 		}
 		i := &nNode.item
 		iItem, err := i.read(t, false)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if iItem == nil || iItem.Key == nil {
-			return nil, errors.New("missing item after item.read() in GetItem()")
+			return nil, nil, errors.New("missing item after item.read() in GetItem()")
 		}
 		c := t.compare(key, iItem.Key)
 		if c < 0 {
@@ -92,16 +223,162 @@ func (t *Collection) GetItem(key []byte, withValue bool) (i *Item, err error) {
 		} else if c > 0 {
 			n = &nNode.right
 		} else {
-			if withValue {
-				iItem, err = i.read(t, withValue)
-				if err != nil {
-					return nil, err
-				}
+			return i, iItem, nil
+		}
+	}
+}
+
+// Retrieve an item and its value by its key without copying: the
+// returned Item is the collection's own, so its Val aliases the
+// collection's buffer, which for an item that was set and not evicted
+// is the very slice that was passed to SetItem().  The Item and its Val
+// are read-only, and are only guaranteed to stay valid until the next
+// mutation of the key, as a later eviction or mutation may let the
+// collection drop or (with value buffer callbacks) recycle them.  A
+// value that's not in memory is read from the file first, after which
+// it's cached like for GetItem().  As a guard, for Stores with the
+// ItemValRead or ItemDecRef callbacks, which may manage the value
+// buffers, the returned Item is instead a copy from ItemAlloc().
+// Either way, like for GetItem(), the caller owns a reference on the
+// returned Item, to release with Store.ItemDecRef() when the Store
+// ref-counts its items.  Returns nil if the item is not in the
+// collection.
+func (t *Collection) GetItemRef(key []byte) (*Item, error) {
+	i, err := t.GetItem(key, true)
+	if err != nil || i == nil {
+		return i, err
+	}
+	if t.store.callbacks.ItemValRead == nil && t.store.callbacks.ItemDecRef == nil {
+		return i, nil
+	}
+	res := t.store.ItemAlloc(t, uint16(len(i.Key)))
+	copy(res.Key, i.Key)
+	res.Val = append(res.Val[:0], i.Val...)
+	res.Priority = i.Priority
+	t.store.ItemDecRef(t, i)
+	return res, nil
+}
+
+// Retrieve a value by its key, appending it to valBuf, which is grown
+// as needed, so that reads into a reused buffer don't allocate.  When
+// the value isn't in memory, it's read from the file straight into
+// valBuf, without allocating or caching an Item for it, unless the
+// Store is encrypted or has the ItemValRead or AfterItemRead callbacks,
+// which need an Item.  The returned val is owned by the caller and
+// never aliases the collection's buffers; it's valBuf[:len(valBuf)] if
+// the key is not found.
+func (t *Collection) GetInto(key []byte, valBuf []byte) (
+	val []byte, found bool, err error) {
+	atomic.AddUint64(&t.numGets, 1)
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return valBuf, false, err
+	}
+	defer t.openRootDecRef(rnl)
+	_, val, found, err = t.getInto(rnl.root, key, valBuf)
+	return val, found, err
+}
+
+// Retrieve an item by its key into a caller-owned Item, reusing the
+// capacity of its Key and Val, like GetInto().  The collection keeps
+// no reference to the Item, so it's not ItemAddRef()'ed and the caller
+// may reuse it for further reads.  The Item's Transient is cleared.
+func (t *Collection) GetItemInto(key []byte, item *Item) (found bool, err error) {
+	atomic.AddUint64(&t.numGets, 1)
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return false, err
+	}
+	defer t.openRootDecRef(rnl)
+	var valBuf []byte
+	if item.Val != nil {
+		valBuf = item.Val[:0]
+	}
+	iItem, val, found, err := t.getInto(rnl.root, key, valBuf)
+	if err != nil || !found {
+		return false, err
+	}
+	item.Key = append(item.Key[:0], iItem.Key...)
+	item.Val = val
+	item.Priority = iItem.Priority
+	item.Transient = nil
+	return true, nil
+}
+
+// Returns the length of the value of a key, as stored in its item
+// record, or as of its SetItem() when it's not persisted yet, which is
+// what the ItemValLength() callback returned then, if any.  The value
+// bytes are never read, only the item's record header and key on the
+// way down, like for GetItem() without the value, so it's much cheaper
+// than Get() for size accounting.  Returns false if the key is not in
+// the collection.
+func (t *Collection) ValueLen(key []byte) (n int, found bool, err error) {
+	atomic.AddUint64(&t.numGets, 1)
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return 0, false, err
+	}
+	defer t.openRootDecRef(rnl)
+	iloc, iItem, err := t.lookup(rnl.root, key)
+	if err != nil || iItem == nil {
+		return 0, false, err
+	}
+	return iloc.NumBytes(t) - len(iItem.Key), true, nil
+}
+
+// Returns the collection's item of the key, read without its value,
+// and its value appended to valBuf.  The caller must hold a reference
+// on the root.
+func (t *Collection) getInto(root *nodeLoc, key []byte, valBuf []byte) (
+	iItem *Item, val []byte, found bool, err error) {
+	iloc, iItem, err := t.lookup(root, key)
+	if err != nil || iItem == nil {
+		return nil, valBuf, false, err
+	}
+	if iItem.Val == nil {
+		cb := t.store.callbacks
+		if !t.store.encrypted && cb.ItemValRead == nil && cb.AfterItemRead == nil &&
+			!t.hasKeyPrefixes() && !t.hasValueChunks() && !t.hasVersions() {
+			val, err = t.readValInto(iloc.Loc(), len(iItem.Key), valBuf)
+			if err != nil {
+				return nil, valBuf, false, err
 			}
-			t.store.ItemAddRef(t, iItem)
-			return iItem, nil
+			return iItem, val, true, nil
 		}
+		if iItem, err = iloc.read(t, true); err != nil {
+			return nil, valBuf, false, err
+		}
+	}
+	val = append(valBuf, iItem.Val...)
+	if val == nil {
+		val = []byte{} // Empty values are non-nil, like from Get().
 	}
+	return iItem, val, true, nil
+}
+
+// Appends the value of the unencrypted item record at loc to valBuf.
+func (t *Collection) readValInto(loc *ploc, keyLength int, valBuf []byte) (
+	val []byte, err error) {
+	hdrLength := itemLoc_hdrLength + keyLength
+	if loc.isEmpty() || loc.Length < uint32(hdrLength) {
+		return nil, corruptError(loc, "item read",
+			fmt.Errorf("unexpected item loc: %v", loc))
+	}
+	valLength := int(loc.Length) - hdrLength
+	n := len(valBuf)
+	if cap(valBuf)-n < valLength {
+		val = make([]byte, n, n+valLength)
+		copy(val, valBuf)
+	} else if valBuf == nil {
+		val = []byte{}
+	} else {
+		val = valBuf
+	}
+	val = val[:n+valLength]
+	if valLength > 0 {
+		_, err = readFull(t.store.file, val[n:], loc.Offset+int64(hdrLength))
+	}
+	return val, corruptError(loc, "item read", err)
 }
 
 // Retrieve a value by its key.  Returns nil if the item is not in the
@@ -117,62 +394,279 @@ func (t *Collection) Get(key []byte) (val []byte, err error) {
 	return nil, nil
 }
 
+// Returned by SetItem() for an Item with a nil or empty Key.
+var ErrNilKey = errors.New("Item.Key is nil or empty")
+
 // Replace or insert an item of a given key.
 // A random item Priority (e.g., rand.Int31()) will usually work well,
 // but advanced users may consider using non-random item priorities
 // at the risk of unbalancing the lookup tree.  The input Item instance
-// should be considered immutable and owned by the Collection.
-func (t *Collection) SetItem(item *Item) (err error) {
+// should be considered immutable and owned by the Collection.  The
+// Item.Val must be non-nil, but may be empty; an empty Val is returned
+// as an empty, non-nil slice by reads, including after a Flush(),
+// eviction or reopening of the Store.
+func (t *Collection) SetItem(item *Item) error {
+	if err := t.checkItem(item); err != nil {
+		return err
+	}
+	if w := (*collWriter)(atomic.LoadPointer(&t.writer)); w != nil {
+		if ok, err := w.submit(&writeOp{item: item}); ok {
+			return err
+		}
+	}
+	return t.setItem(item)
+}
+
+// Returns why SetItem() rejects the item, if so.
+func (t *Collection) checkItem(item *Item) error {
 	if t.store.readOnly {
-		return errors.New("store is read only")
+		return ErrReadOnly
 	}
-	if item.Key == nil || len(item.Key) > 0xffff || len(item.Key) == 0 ||
-		item.Val == nil {
-		return errors.New("Item.Key/Val missing or too long")
+	if len(item.Key) == 0 {
+		return ErrNilKey
+	}
+	maxKeyLen, maxValLen := t.store.limits()
+	if uint64(len(item.Key)) > maxKeyLen {
+		return &LimitError{ErrKeyTooLarge, maxKeyLen, uint64(len(item.Key))}
+	}
+	if item.Val == nil {
+		return errors.New("Item.Val missing")
 	}
 	if item.Priority < 0 {
 		return errors.New("Item.Priority must be non-negative")
 	}
-	rnl := t.rootAddRef()
-	defer t.rootDecRef(rnl)
+	numBytes := item.NumBytes(t)
+	if numBytes < len(item.Key) {
+		return &AggregateError{Key: item.Key, ItemBytes: int64(numBytes)}
+	}
+	if valBytes := uint64(numBytes - len(item.Key)); valBytes > maxValLen {
+		return &LimitError{ErrValTooLarge, maxValLen, valBytes}
+	}
+	return nil
+}
+
+// Inserts an item of a key that's not in the collection yet, or fails
+// with ErrKeyExists, leaving the collection as it is.  The lookup of
+// the key and the insert happen under the lock that serializes the
+// mutations of the collection, so of concurrent Insert()'s of a key
+// exactly one succeeds.  Like Set() and SetItem() when the collection
+// has a writer goroutine (see StartWriter()), an Insert() isn't ordered
+// with the writes still queued for the writer.
+func (t *Collection) Insert(key []byte, val []byte, priority int32) error {
+	item := &Item{Key: key, Val: val, Priority: priority}
+	if err := t.checkItem(item); err != nil {
+		return err
+	}
+	return t.setItemEx(item, true, nil)
+}
+
+// Adds delta to the int64 value of the key, which is stored as 8
+// little-endian bytes, or sets the value to delta if the key is not in
+// the collection, and returns the new total, such as for running
+// totals.  Like for Insert(), the lookup of the current value and the
+// set happen under the lock that serializes the mutations of the
+// collection, so concurrent Add()'s of a key are never lost, and an
+// Add() isn't ordered with the writes still queued for a writer
+// goroutine.  The item keeps the priority of the item that it
+// replaces, and a new one gets a random priority.  Fails with
+// ErrAddOverflow, leaving the value as it is, if the total would
+// overflow an int64, and fails if the current value isn't 8 bytes.
+func (t *Collection) Add(key []byte, delta int64) (newTotal int64, err error) {
+	item := &Item{Key: key, Val: make([]byte, 8), Priority: t.store.randInt31()}
+	if err := t.checkItem(item); err != nil {
+		return 0, err
+	}
+	err = t.setItemEx(item, false, func(cur *Item) error {
+		newTotal = delta
+		if cur != nil {
+			if len(cur.Val) != 8 {
+				return fmt.Errorf("value is not an int64, length: %v, key: %q",
+					len(cur.Val), key)
+			}
+			total := int64(binary.LittleEndian.Uint64(cur.Val))
+			if (delta > 0 && total > math.MaxInt64-delta) ||
+				(delta < 0 && total < math.MinInt64-delta) {
+				return fmt.Errorf("%w, total: %v, delta: %v, key: %q",
+					ErrAddOverflow, total, delta, key)
+			}
+			newTotal = total + delta
+			item.Priority = cur.Priority
+		}
+		binary.LittleEndian.PutUint64(item.Val, uint64(newTotal))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return newTotal, nil
+}
+
+func (t *Collection) setItem(item *Item) error {
+	return t.setItemEx(item, false, nil)
+}
+
+// Sets the item, or when insert is true, fails with ErrKeyExists if
+// the key is in the collection.  A non-nil update is invoked with the
+// current item of the key and its value, or nil, before the item is
+// set, so that it can derive the item from it, or fail the set.
+func (t *Collection) setItemEx(item *Item, insert bool,
+	update func(cur *Item) error) (err error) {
+	numBytes := item.NumBytes(t)
+	notify, err := t.setMutationLock()
+	if err != nil {
+		return err
+	}
+	defer t.mutationUnlock(notify)
+	if t.store.isClosed() {
+		return ErrStoreClosed
+	}
+	t.internKey(item)
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return err
+	}
+	defer t.openRootDecRef(rnl)
 	root := rnl.root
-	n := t.mkNode(nil, nil, nil, 1, uint64(len(item.Key))+uint64(item.NumValBytes(t)))
+	if err = t.checkPathDepth(root, item.Key); err != nil {
+		return err
+	}
+	var deadLoc *ploc
+	if insert {
+		_, iItem, err := t.lookup(root, item.Key)
+		if err != nil {
+			return err
+		}
+		if iItem != nil {
+			return fmt.Errorf("%w, key: %q", ErrKeyExists, item.Key)
+		}
+	} else if update != nil {
+		iloc, iItem, err := t.lookup(root, item.Key)
+		if err != nil {
+			return err
+		}
+		if iItem != nil {
+			if iItem, err = iloc.read(t, true); err != nil {
+				return err
+			}
+		}
+		if err = update(iItem); err != nil {
+			return err
+		}
+		numBytes = item.NumBytes(t)
+	}
+	if !insert && t.store.freeList.tracking() {
+		if deadLoc, err = t.itemLocOf(root, item.Key); err != nil {
+			return err
+		}
+	}
+	var versions *itemVersions
+	subs, oldPresent := t.subscriptions(), false
+	if keep := t.KeepVersions(); (keep > 0 || subs != nil) && !insert {
+		cur, curItem, err := t.lookup(root, item.Key)
+		if err != nil {
+			return err
+		}
+		if oldPresent = curItem != nil; oldPresent && keep > 0 {
+			versions = t.replacedVersions(cur, keep)
+		}
+	}
+	var indexDels []indexChange
+	if indexes := t.indexes(); indexes != nil {
+		prev, err := t.indexedItem(root, item.Key)
+		if err != nil {
+			return err
+		}
+		changes, err := t.indexChanges(indexes, prev, item)
+		if err != nil {
+			return err
+		}
+		var indexSets []indexChange
+		indexSets, indexDels = splitIndexChanges(changes)
+		if err = t.applyIndexChanges(indexSets); err != nil {
+			return err
+		}
+	}
+	n := t.mkNode(nil, nil, nil, 1, uint64(numBytes))
+	t.store.debugRefs.begin(item, false)
 	t.store.ItemAddRef(t, item)
 	n.item.item = unsafe.Pointer(item) // Avoid garbage via separate init.
+	n.item.numBytes = numBytes
+	n.item.versions = unsafe.Pointer(versions)
 	nloc := t.mkNodeLoc(n)
 	defer t.freeNodeLoc(nloc)
 	r, err := t.store.union(t, root, nloc, &rnl.reclaimMark)
 	if err != nil {
 		return err
 	}
+	if t.store.debugLevel > 0 {
+		t.debugValidate(r, item.Key)
+	}
+	t.bloomAdd(item.Key, r)
 	rnlNew := t.mkRootNodeLoc(r)
 	// Can't reclaim n right now because r might point to n.
 	rnlNew.reclaimLater[0] = t.reclaimMarkUpdate(nloc,
 		&rnl.reclaimMark, &rnlNew.reclaimMark)
+	rnlNew.reclaimLaterLocs[0] = nloc.Loc()
 	if !t.rootCAS(rnl, rnlNew) {
+		t.store.metricsCounter("rootCASFailures", 1)
 		return errors.New("concurrent mutation attempted")
 	}
+	t.lookupCacheInvalidate(item.Key)
+	t.addDeadLoc(rnl, deadLoc)
 	t.rootDecRef(rnl)
+	atomic.AddUint64(&t.numSets, 1)
+	t.notifyMutation(MutationSet, item.Key, item.persistedVal(), item.Priority)
+	t.publishChange(subs, ChangeSet, item.Key, item.Key, oldPresent)
+	if err = t.applyIndexChanges(indexDels); err != nil {
+		return err
+	}
+	t.maybeRebalance(r)
 	return nil
 }
 
-// Replace or insert an item of a given key.
+// Replace or insert an item of a given key, with a random priority
+// from the Store's random source, see SetRand().
 func (t *Collection) Set(key []byte, val []byte) error {
-	return t.SetItem(&Item{Key: key, Val: val, Priority: rand.Int31()})
+	return t.SetItem(&Item{Key: key, Val: val, Priority: t.store.randInt31()})
 }
 
 // Deletes an item of a given key.
 func (t *Collection) Delete(key []byte) (wasDeleted bool, err error) {
 	if t.store.readOnly {
-		return false, errors.New("store is read only")
+		return false, ErrReadOnly
 	}
-	rnl := t.rootAddRef()
-	defer t.rootDecRef(rnl)
+	if w := (*collWriter)(atomic.LoadPointer(&t.writer)); w != nil {
+		op := &writeOp{key: key}
+		if ok, err := w.submit(op); ok {
+			return op.deleted, err
+		}
+	}
+	defer t.mutationUnlock(t.mutationLock())
+	if t.store.isClosed() {
+		return false, ErrStoreClosed
+	}
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return false, err
+	}
+	defer t.openRootDecRef(rnl)
 	root := rnl.root
-	i, err := t.GetItem(key, false)
+	if err = t.checkPathDepth(root, key); err != nil {
+		return false, err
+	}
+	indexes := t.indexes()
+	i, err := t.getItem(key, indexes != nil)
 	if err != nil || i == nil {
 		return false, err
 	}
+	var indexDels []indexChange
+	if indexes != nil {
+		indexDels, err = t.indexChanges(indexes, i, nil)
+		if err != nil {
+			t.store.ItemDecRef(t, i)
+			return false, err
+		}
+	}
 	t.store.ItemDecRef(t, i)
 	left, middle, right, err := t.store.split(t, root, key, &rnl.reclaimMark)
 	if err != nil {
@@ -188,6 +682,9 @@ func (t *Collection) Delete(key []byte) (wasDeleted bool, err error) {
 	if err != nil {
 		return false, err
 	}
+	if t.store.debugLevel > 0 {
+		t.debugValidate(r, key)
+	}
 	rnlNew := t.mkRootNodeLoc(r)
 	// Can't reclaim immediately due to readers.
 	rnlNew.reclaimLater[0] = t.reclaimMarkUpdate(left,
@@ -196,12 +693,146 @@ func (t *Collection) Delete(key []byte) (wasDeleted bool, err error) {
 		&rnl.reclaimMark, &rnlNew.reclaimMark)
 	rnlNew.reclaimLater[2] = t.reclaimMarkUpdate(middle,
 		&rnl.reclaimMark, &rnlNew.reclaimMark)
+	rnlNew.reclaimLaterLocs[0] = left.Loc()
+	rnlNew.reclaimLaterLocs[1] = right.Loc()
+	rnlNew.reclaimLaterLocs[2] = middle.Loc()
 	t.markReclaimable(rnlNew.reclaimLater[2], &rnlNew.reclaimMark)
 	if !t.rootCAS(rnl, rnlNew) {
+		t.store.metricsCounter("rootCASFailures", 1)
 		return false, errors.New("concurrent mutation attempted")
 	}
+	t.lookupCacheInvalidate(key)
+	if t.store.freeList.tracking() {
+		t.addDeadLoc(rnl, middle.Node().item.Loc())
+	}
 	t.rootDecRef(rnl)
-	return true, nil
+	atomic.AddUint64(&t.numDeletes, 1)
+	t.notifyMutation(MutationDelete, key, nil, 0)
+	t.publishChange(t.subscriptions(), ChangeDelete, key, key, true)
+	return true, t.applyIndexChanges(indexDels)
+}
+
+// Deletes the items of the given keys in a single pass over the tree,
+// which is cheaper than a Delete() per key when there are many keys.
+// Missing and repeated keys are skipped, and the deletes become
+// visible to readers all at once.  Returns the number of deleted items.
+func (t *Collection) DeleteMulti(keys [][]byte) (deleted uint64, err error) {
+	if t.store.readOnly {
+		return 0, ErrReadOnly
+	}
+	distinct := t.distinctKeys(keys)
+	defer t.mutationUnlock(t.mutationLock())
+	if t.store.isClosed() {
+		return 0, ErrStoreClosed
+	}
+	var indexDels []indexChange
+	if indexes := t.indexes(); indexes != nil {
+		rnl, err := t.openRootAddRef()
+		if err != nil {
+			return 0, err
+		}
+		indexDels, err = t.indexDeletes(indexes, rnl.root, distinct)
+		t.openRootDecRef(rnl)
+		if err != nil {
+			return 0, err
+		}
+	}
+	deleted, err = t.deleteDistinct(distinct, func(deletedNodes []*node) {
+		if t.observed() {
+			sort.Sort(nodesByKey{deletedNodes, t.compare})
+			for _, n := range deletedNodes {
+				t.notifyMutation(MutationDelete, n.item.Item().Key, nil, 0)
+			}
+		}
+		if subs := t.subscriptions(); subs != nil {
+			keys := make([][]byte, len(deletedNodes))
+			for i, n := range deletedNodes {
+				keys[i] = n.item.Item().Key
+			}
+			t.publishRange(subs, keys)
+		}
+	})
+	if err != nil {
+		return deleted, err
+	}
+	return deleted, t.applyIndexChanges(indexDels)
+}
+
+// Returns the keys sorted, without repeated keys.
+func (t *Collection) distinctKeys(keys [][]byte) [][]byte {
+	sorted := make([][]byte, len(keys))
+	copy(sorted, keys)
+	sort.Sort(&keysSorter{sorted, t.compare})
+	distinct := sorted[:0]
+	for _, key := range sorted {
+		if len(distinct) == 0 || t.compare(distinct[len(distinct)-1], key) != 0 {
+			distinct = append(distinct, key)
+		}
+	}
+	return distinct
+}
+
+// Deletes the items of the sorted, distinct keys with a single root
+// swap, and then passes the deleted nodes, which stay intact until
+// deleted returns, to deleted.  Invoked while the mutationLock() is held.
+func (t *Collection) deleteDistinct(distinct [][]byte,
+	deleted func(deletedNodes []*node)) (uint64, error) {
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return 0, err
+	}
+	defer t.openRootDecRef(rnl)
+	var deletedNodes, joined []*node
+	r, err := t.store.deleteKeys(t, rnl.root, distinct,
+		&rnl.reclaimMark, &deletedNodes, &joined)
+	if err != nil {
+		return 0, err
+	}
+	if len(deletedNodes) == 0 {
+		t.freeNodeLoc(r)
+		return 0, nil
+	}
+	if t.store.debugLevel > 0 {
+		for _, key := range distinct {
+			t.debugValidate(r, key)
+		}
+	}
+	t.reclaimUnpublished(rnl.root, joined, &rnl.reclaimMark)
+	rnlNew := t.mkRootNodeLoc(r)
+	if !t.rootCAS(rnl, rnlNew) {
+		t.store.metricsCounter("rootCASFailures", 1)
+		return 0, errors.New("concurrent mutation attempted")
+	}
+	t.lookupCacheInvalidate(distinct...)
+	if t.store.freeList.tracking() {
+		for _, n := range deletedNodes {
+			t.addDeadLoc(rnl, n.item.Loc())
+		}
+	}
+	atomic.AddUint64(&t.numDeletes, uint64(len(deletedNodes)))
+	deleted(deletedNodes)
+	t.rootDecRef(rnl) // The deleted nodes are reclaimable after this.
+	return uint64(len(deletedNodes)), nil
+}
+
+type keysSorter struct {
+	keys    [][]byte
+	compare KeyCompare
+}
+
+func (s *keysSorter) Len() int           { return len(s.keys) }
+func (s *keysSorter) Swap(i, j int)      { s.keys[i], s.keys[j] = s.keys[j], s.keys[i] }
+func (s *keysSorter) Less(i, j int) bool { return s.compare(s.keys[i], s.keys[j]) < 0 }
+
+type nodesByKey struct {
+	nodes   []*node
+	compare KeyCompare
+}
+
+func (s nodesByKey) Len() int      { return len(s.nodes) }
+func (s nodesByKey) Swap(i, j int) { s.nodes[i], s.nodes[j] = s.nodes[j], s.nodes[i] }
+func (s nodesByKey) Less(i, j int) bool {
+	return s.compare(s.nodes[i].item.Item().Key, s.nodes[j].item.Item().Key) < 0
 }
 
 // Retrieves the item with the "smallest" key.
@@ -218,24 +849,44 @@ func (t *Collection) MaxItem(withValue bool) (*Item, error) {
 		func(n *node) (*nodeLoc, bool) { return &n.right, true })
 }
 
+// The outcome of an EvictSomeItems().
+type EvictResult struct {
+	NumEvicted   uint64 // Items whose memory was released.
+	EvictedBytes uint64 // Key and value bytes of the evicted items.
+
+	// Key and value bytes of the items on the walked branch that were
+	// kept as they're not persisted yet, as they would be lost, such as
+	// before the first Flush() of the items.
+	SkippedDirtyBytes uint64
+}
+
 // Evict some clean items found by randomly walking a tree branch.
-// For concurrent users, only the single mutator thread should call
-// EvictSomeItems(), making it serialized with mutations.
-func (t *Collection) EvictSomeItems() (numEvicted uint64) {
+// Only items that are persisted are evicted, so that they are read
+// again from the file when needed; the dirty items on the branch are
+// skipped, and reported by the result, which tells why an eviction
+// released less than expected.  For concurrent users, only the single
+// mutator thread should call EvictSomeItems(), making it serialized
+// with mutations.
+func (t *Collection) EvictSomeItems() (res EvictResult) {
 	if t.store.readOnly {
-		return 0
+		return res
 	}
 	i, err := t.store.walk(t, false, func(n *node) (*nodeLoc, bool) {
-		if !n.item.Loc().isEmpty() {
+		if loc := n.item.Loc(); !loc.isEmpty() && !t.store.isBuffered(loc) &&
+			!t.store.isFlushing(&n.item) {
 			i := n.item.Item()
 			if i != nil && atomic.CompareAndSwapPointer(&n.item.item,
 				unsafe.Pointer(i), unsafe.Pointer(nil)) {
-				t.store.ItemDecRef(t, i)
-				numEvicted++
+				res.NumEvicted++
+				res.EvictedBytes += uint64(i.NumBytes(t))
+				t.store.itemDecRefVisible(t, i)
 			}
+		} else if i := n.item.Item(); i != nil {
+			res.SkippedDirtyBytes += uint64(i.NumBytes(t))
+			t.store.logf("EvictSomeItems: skipped dirty item, coll: %v", t.name)
 		}
 		next := &n.left
-		if (rand.Int() & 0x01) == 0x01 {
+		if (t.store.randInt31() & 0x01) == 0x01 {
 			next = &n.right
 		}
 		if next.isEmpty() {
@@ -246,29 +897,46 @@ func (t *Collection) EvictSomeItems() (numEvicted uint64) {
 	if i != nil && err != nil {
 		t.store.ItemDecRef(t, i)
 	}
-	return numEvicted
+	atomic.AddUint64(&t.numEvictions, res.NumEvicted)
+	t.store.metricsCounter("evictions", int64(res.NumEvicted))
+	return res
 }
 
 type ItemVisitor func(i *Item) bool
 type ItemVisitorEx func(i *Item, depth uint64) bool
 
-// Visit items greater-than-or-equal to the target key in ascending order.
+// Visits an item that was read without its value, along with a
+// loadVal func that returns the item's value, reading it on demand
+// through the ItemValRead() path.  The loadVal func is only valid
+// during the visitor invocation.
+type ItemVisitorLazy func(i *Item, loadVal func() ([]byte, error)) bool
+
+// Visit items greater-than-or-equal to the target key in ascending order,
+// which is the order of the collection's KeyCompare, where a nil target
+// is before every key, so it visits all the items.
 func (t *Collection) VisitItemsAscend(target []byte, withValue bool, v ItemVisitor) error {
 	return t.VisitItemsAscendEx(target, withValue,
 		func(i *Item, depth uint64) bool { return v(i) })
 }
 
-// Visit items less-than the target key in descending order.
+// Visit items less-than the target key in descending order, where a nil
+// target is before every key, as for VisitItemsAscend(), so it visits
+// none, see MaxItem().
 func (t *Collection) VisitItemsDescend(target []byte, withValue bool, v ItemVisitor) error {
 	return t.VisitItemsDescendEx(target, withValue,
 		func(i *Item, depth uint64) bool { return v(i) })
 }
 
-// Visit items greater-than-or-equal to the target key in ascending order; with depth info.
+// Visit items greater-than-or-equal to the target key in ascending
+// order; with depth info, where the root node is at depth 0 and its
+// children are at depth 1.
 func (t *Collection) VisitItemsAscendEx(target []byte, withValue bool,
 	visitor ItemVisitorEx) error {
-	rnl := t.rootAddRef()
-	defer t.rootDecRef(rnl)
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return err
+	}
+	defer t.openRootDecRef(rnl)
 
 	var prevVisitItem *Item
 	var errCheckedVisitor error
@@ -284,7 +952,7 @@ func (t *Collection) VisitItemsAscendEx(target []byte, withValue bool,
 		return visitor(i, depth)
 	}
 
-	_, err := t.store.visitNodes(t, rnl.root,
+	_, err = t.store.visitNodes(t, rnl.root,
 		target, withValue, checkedVisitor, 0, ascendChoice)
 	if errCheckedVisitor != nil {
 		return errCheckedVisitor
@@ -292,46 +960,729 @@ func (t *Collection) VisitItemsAscendEx(target []byte, withValue bool,
 	return err
 }
 
-// Visit items less-than the target key in descending order; with depth info.
+// Visit items less-than the target key in descending order; with depth info,
+// as in VisitItemsAscendEx().
 func (t *Collection) VisitItemsDescendEx(target []byte, withValue bool,
 	visitor ItemVisitorEx) error {
-	rnl := t.rootAddRef()
-	defer t.rootDecRef(rnl)
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return err
+	}
+	defer t.openRootDecRef(rnl)
 
-	_, err := t.store.visitNodes(t, rnl.root,
+	_, err = t.store.visitNodes(t, rnl.root,
 		target, withValue, visitor, 0, descendChoice)
 	return err
 }
 
-func ascendChoice(cmp int, n *node) (bool, *nodeLoc, *nodeLoc) {
-	return cmp <= 0, &n.left, &n.right
+// Like VisitItemsAscend() without values, but the visitor can load the
+// value of each item that it needs, so that a scan that only needs a few
+// of the values doesn't read the others.
+func (t *Collection) VisitItemsAscendLazy(target []byte, visitor ItemVisitorLazy) error {
+	return t.visitItemsLazy(target, visitor, ascendChoice)
 }
 
-func descendChoice(cmp int, n *node) (bool, *nodeLoc, *nodeLoc) {
-	return cmp > 0, &n.right, &n.left
+// Like VisitItemsDescend() without values, but with on-demand values, as
+// in VisitItemsAscendLazy().
+func (t *Collection) VisitItemsDescendLazy(target []byte, visitor ItemVisitorLazy) error {
+	return t.visitItemsLazy(target, visitor, descendChoice)
 }
 
-// Returns total number of items and total key bytes plus value bytes.
-func (t *Collection) GetTotals() (numItems uint64, numBytes uint64, err error) {
-	rnl := t.rootAddRef()
-	defer t.rootDecRef(rnl)
-	n := rnl.root
-	nNode, err := n.read(t.store)
-	if err != nil || n.isEmpty() || nNode == nil {
-		return 0, 0, err
+func (t *Collection) visitItemsLazy(target []byte, visitor ItemVisitorLazy,
+	choiceFunc func(int, *node) (bool, *nodeLoc, *nodeLoc)) error {
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return err
 	}
-	return nNode.numNodes, nNode.numBytes, nil
-}
+	defer t.openRootDecRef(rnl)
 
-// Returns JSON representation of root node file location.
-func (t *Collection) MarshalJSON() ([]byte, error) {
-	rnl := t.rootAddRef()
-	defer t.rootDecRef(rnl)
-	return rnl.MarshalJSON()
+	var cur *itemLoc
+	loadVal := func() ([]byte, error) {
+		if cur == nil {
+			return nil, errors.New("loadVal invoked after its visitor returned")
+		}
+		i, err := cur.read(t, true)
+		if err != nil || i == nil {
+			return nil, err
+		}
+		return i.Val, nil
+	}
+	var errRead error
+	_, err = t.store.visitItemLocs(t, rnl.root, target,
+		func(iloc *itemLoc, depth uint64) bool {
+			i, err := iloc.read(t, false)
+			if err != nil {
+				errRead = err
+				return false
+			}
+			cur = iloc
+			keepGoing := visitor(i, loadVal)
+			cur = nil
+			return keepGoing
+		}, 0, choiceFunc)
+	if errRead != nil {
+		return errRead
+	}
+	return err
 }
 
-// Returns JSON representation of root node file location.
-func (rnl *rootNodeLoc) MarshalJSON() ([]byte, error) {
+// Visit items greater-than-or-equal to the startKey in ascending order,
+// passing what decode makes of each key and value to the visitor, for
+// collections of serialized values.  The first decode error stops the
+// visit, and is returned wrapped with the key of the item.
+func (t *Collection) VisitDecoded(startKey []byte,
+	decode func(key, val []byte) (interface{}, error),
+	visit func(interface{}) bool) error {
+	var errDecode error
+	err := t.VisitItemsAscend(startKey, true, func(i *Item) bool {
+		v, err := decode(i.Key, i.Val)
+		if err != nil {
+			errDecode = fmt.Errorf("decode failed, key: %q: %w", i.Key, err)
+			return false
+		}
+		return visit(v)
+	})
+	if errDecode != nil {
+		return errDecode
+	}
+	return err
+}
+
+// Visit items greater-than-or-equal to the startKey in ascending order,
+// passing them to the visitor in batches of batchSize items, except for
+// a shorter last batch, so that the visitor can process them in bulk
+// and a large scan has fewer visitor invocations.  The visit stops
+// when the visitor returns false.  The items slice is reused for the
+// next batch, so it's only valid during the visitor invocation, but
+// its items stay valid.
+func (t *Collection) VisitBatch(startKey []byte, withValue bool,
+	batchSize int, visit func(items []*Item) bool) error {
+	if batchSize < 1 {
+		return errors.New("batch size must be positive")
+	}
+	batch := make([]*Item, 0, batchSize)
+	stopped := false
+	err := t.VisitItemsAscend(startKey, withValue, func(i *Item) bool {
+		if batch = append(batch, i); len(batch) < batchSize {
+			return true
+		}
+		stopped = !visit(batch)
+		batch = batch[:0]
+		return !stopped
+	})
+	if err != nil || stopped || len(batch) == 0 {
+		return err
+	}
+	visit(batch)
+	return nil
+}
+
+// Visit items less-than-or-equal to the startKey and greater-than-or-equal
+// to the endKey in descending order, such as for "most recent first"
+// pages over time-ordered keys.  A nil endKey visits down to the
+// smallest item.  The visit stops at the first item below endKey.
+func (t *Collection) VisitItemsDescendRange(startKey, endKey []byte,
+	withValue bool, visitor ItemVisitor) error {
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return err
+	}
+	defer t.openRootDecRef(rnl)
+
+	_, err = t.store.visitNodes(t, rnl.root, startKey, withValue,
+		func(i *Item, depth uint64) bool {
+			if endKey != nil && t.compare(i.Key, endKey) < 0 {
+				return false
+			}
+			return visitor(i)
+		}, 0, descendRangeChoice)
+	return err
+}
+
+// Returns a page of up to limit items with keys greater-than the
+// afterKey in ascending order, and the afterKey of the next page, for
+// cursor pagination.  A nil afterKey starts at the smallest item.  The
+// visit stops at the limit'th item, so the nextAfterKey is the key of
+// the last item of a full page, even if no items follow it, and nil
+// only after a page with fewer than limit items.  As with GetItem(),
+// the returned items are ItemAddRef()'ed.
+func (t *Collection) Page(afterKey []byte, limit int, withValue bool) (
+	items []*Item, nextAfterKey []byte, err error) {
+	if limit <= 0 {
+		return nil, nil, errors.New("limit must be positive")
+	}
+	choice := ascendAfterChoice
+	if afterKey == nil {
+		choice = ascendAllChoice
+	}
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer t.openRootDecRef(rnl)
+
+	_, err = t.store.visitNodes(t, rnl.root, afterKey, withValue,
+		func(i *Item, depth uint64) bool {
+			t.store.ItemAddRef(t, i)
+			items = append(items, i)
+			return len(items) < limit
+		}, 0, choice)
+	if err != nil {
+		for _, i := range items {
+			t.store.ItemDecRef(t, i)
+		}
+		return nil, nil, err
+	}
+	if len(items) == limit {
+		nextAfterKey = items[limit-1].Key
+	}
+	return items, nextAfterKey, nil
+}
+
+// Returns up to n items with the smallest keys, in ascending order,
+// such as for "bottom N" displays, where n 0 returns none.  The visit
+// stops at the n'th item.  As with GetItem(), the returned items are
+// ItemAddRef()'ed.
+func (t *Collection) FirstN(n int, withValue bool) ([]*Item, error) {
+	return t.visitN(n, withValue, ascendAllChoice)
+}
+
+// Like FirstN(), but returns up to n items with the largest keys, in
+// descending order, so the item with the largest key comes first.
+func (t *Collection) LastN(n int, withValue bool) ([]*Item, error) {
+	return t.visitN(n, withValue, descendAllChoice)
+}
+
+func (t *Collection) visitN(n int, withValue bool,
+	choice func(int, *node) (bool, *nodeLoc, *nodeLoc)) ([]*Item, error) {
+	if n < 0 {
+		return nil, errors.New("number of items must be non-negative")
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return nil, err
+	}
+	defer t.openRootDecRef(rnl)
+
+	var items []*Item
+	_, err = t.store.visitNodes(t, rnl.root, nil, withValue,
+		func(i *Item, depth uint64) bool {
+			t.store.ItemAddRef(t, i)
+			items = append(items, i)
+			return len(items) < n
+		}, 0, choice)
+	if err != nil {
+		for _, i := range items {
+			t.store.ItemDecRef(t, i)
+		}
+		return nil, err
+	}
+	return items, nil
+}
+
+// Visits the items under root with keys in the range in ascending
+// order, until the visitor returns false.
+func (t *Collection) visitRange(root *nodeLoc, startKey, endKey []byte,
+	withValue bool, visitor ItemVisitor) error {
+	choice := ascendChoice
+	if startKey == nil {
+		choice = ascendAllChoice
+	}
+	_, err := t.store.visitNodes(t, root, startKey, withValue,
+		func(i *Item, depth uint64) bool {
+			if endKey != nil && t.compare(i.Key, endKey) >= 0 {
+				return false
+			}
+			return visitor(i)
+		}, 0, choice)
+	return err
+}
+
+// Reads the nodes and items, with their values, of the range from
+// startKey (inclusive) to endKey (exclusive) from the file, so that a
+// later visit or lookup of the range, such as a latency-sensitive
+// scan, finds them in memory.  A nil startKey or endKey leaves the
+// range unbounded on that side.  Like after a visit, the nodes stay in
+// memory for as long as they're in the tree, and the values until
+// they're evicted, see EvictSomeItems().
+func (t *Collection) Prefetch(startKey, endKey []byte) error {
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return err
+	}
+	defer t.openRootDecRef(rnl)
+	return t.visitRange(rnl.root, startKey, endKey, true,
+		func(i *Item) bool { return true })
+}
+
+// Visits items in the range from startKey (inclusive) to endKey
+// (exclusive) in ascending order on concurrent goroutines, such as for
+// scans whose visitor is CPU-bound.  A nil startKey or endKey leaves
+// the range unbounded on that side.  The range is split into up to
+// workers sub-ranges of near-equal numbers of items, as found from the
+// item counts of the nodes, and each sub-range is visited by its own
+// goroutine from the same root, so all workers see the same items.
+// The visitor is invoked concurrently, and the items are in ascending
+// order within each sub-range only, not across the workers.  Once a
+// visitor returns false or a worker fails, the other workers stop
+// before their next item, and the first error is returned.
+func (t *Collection) VisitItemsParallel(startKey, endKey []byte,
+	withValue bool, workers int, visitor ItemVisitor) error {
+	if workers <= 0 {
+		return errors.New("workers must be positive")
+	}
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return err
+	}
+	defer t.openRootDecRef(rnl)
+	splits, err := t.splitRange(rnl.root, startKey, endKey, workers)
+	if err != nil {
+		return err
+	}
+	var stopped int32
+	errs := make([]error, len(splits)+1)
+	var wg sync.WaitGroup
+	for w := 0; w <= len(splits); w++ {
+		beg, end := startKey, endKey
+		if w > 0 {
+			beg = splits[w-1]
+		}
+		if w < len(splits) {
+			end = splits[w]
+		}
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			errs[w] = t.visitRange(rnl.root, beg, end, withValue,
+				func(i *Item) bool {
+					if atomic.LoadInt32(&stopped) != 0 {
+						return false
+					}
+					if !visitor(i) {
+						atomic.StoreInt32(&stopped, 1)
+						return false
+					}
+					return true
+				})
+			if errs[w] != nil {
+				atomic.StoreInt32(&stopped, 1)
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns up to n-1 ascending keys that split the range under root
+// into n sub-ranges of near-equal numbers of items.
+func (t *Collection) splitRange(root *nodeLoc, startKey, endKey []byte,
+	n int) (splits [][]byte, err error) {
+	var lo, hi uint64
+	if startKey != nil {
+		if lo, err = t.rankOf(root, startKey); err != nil {
+			return nil, err
+		}
+	}
+	if endKey != nil {
+		hi, err = t.rankOf(root, endKey)
+	} else {
+		hi, err = t.numNodes(root)
+	}
+	if err != nil || hi <= lo {
+		return nil, err
+	}
+	prev := lo
+	for w := 1; w < n; w++ {
+		rank := lo + (hi-lo)*uint64(w)/uint64(n)
+		if rank == prev {
+			continue
+		}
+		key, err := t.keyAtRank(root, rank)
+		if err != nil {
+			return nil, err
+		}
+		splits = append(splits, key)
+		prev = rank
+	}
+	return splits, nil
+}
+
+func (t *Collection) numNodes(n *nodeLoc) (uint64, error) {
+	nNode, err := n.read(t.store)
+	if err != nil || n.isEmpty() || nNode == nil {
+		return 0, err
+	}
+	return nNode.numNodes, nil
+}
+
+// Returns the number of items under n with keys less than the key.
+func (t *Collection) rankOf(n *nodeLoc, key []byte) (rank uint64, err error) {
+	for {
+		nNode, err := n.read(t.store)
+		if err != nil || n.isEmpty() || nNode == nil {
+			return rank, err
+		}
+		nItem, err := nNode.item.read(t, false)
+		if err != nil {
+			return 0, err
+		}
+		left, err := t.numNodes(&nNode.left)
+		if err != nil {
+			return 0, err
+		}
+		c := t.compare(key, nItem.Key)
+		if c < 0 {
+			n = &nNode.left
+		} else if c > 0 {
+			rank += left + 1
+			n = &nNode.right
+		} else {
+			return rank + left, nil
+		}
+	}
+}
+
+// Returns a copy of the key of the item of the given rank (from 0)
+// under n, or nil if there are not that many items.
+func (t *Collection) keyAtRank(n *nodeLoc, rank uint64) ([]byte, error) {
+	for {
+		nNode, err := n.read(t.store)
+		if err != nil || n.isEmpty() || nNode == nil {
+			return nil, err
+		}
+		left, err := t.numNodes(&nNode.left)
+		if err != nil {
+			return nil, err
+		}
+		if rank < left {
+			n = &nNode.left
+		} else if rank > left {
+			rank -= left + 1
+			n = &nNode.right
+		} else {
+			nItem, err := nNode.item.read(t, false)
+			if err != nil {
+				return nil, err
+			}
+			return append([]byte{}, nItem.Key...), nil
+		}
+	}
+}
+
+// Compares the target of a visit with a key, where a nil target is
+// before every key, whatever the KeyCompare, such as of CompareReverse(),
+// so that an ascending visit of nil starts with the first item.
+func (t *Collection) compareTarget(target, key []byte) int {
+	if target == nil {
+		return -1
+	}
+	return t.compare(target, key)
+}
+
+func ascendChoice(cmp int, n *node) (bool, *nodeLoc, *nodeLoc) {
+	return cmp <= 0, &n.left, &n.right
+}
+
+func descendChoice(cmp int, n *node) (bool, *nodeLoc, *nodeLoc) {
+	return cmp > 0, &n.right, &n.left
+}
+
+func descendRangeChoice(cmp int, n *node) (bool, *nodeLoc, *nodeLoc) {
+	return cmp >= 0, &n.right, &n.left
+}
+
+func ascendAfterChoice(cmp int, n *node) (bool, *nodeLoc, *nodeLoc) {
+	return cmp < 0, &n.left, &n.right
+}
+
+func ascendAllChoice(cmp int, n *node) (bool, *nodeLoc, *nodeLoc) {
+	return true, &n.left, &n.right
+}
+
+func descendAllChoice(cmp int, n *node) (bool, *nodeLoc, *nodeLoc) {
+	return true, &n.right, &n.left
+}
+
+// Returns total number of items and total key bytes plus value bytes.
+func (t *Collection) GetTotals() (numItems uint64, numBytes uint64, err error) {
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer t.openRootDecRef(rnl)
+	n := rnl.root
+	nNode, err := n.read(t.store)
+	if err != nil || n.isEmpty() || nNode == nil {
+		return 0, 0, err
+	}
+	return nNode.numNodes, nNode.numBytes, nil
+}
+
+// Returns the number of items, from the item count of the root node,
+// so it's at most one node read, and 0 for an empty collection.
+func (t *Collection) Count() (uint64, error) {
+	numItems, _, err := t.GetTotals()
+	return numItems, err
+}
+
+// Rebuilds the numNodes and numBytes aggregates of all nodes by a
+// traversal, to repair a collection whose aggregates drifted.  The
+// bytes of dirty items are recomputed, including through any
+// ItemValLength() callback.  Only the nodes whose aggregates change,
+// and their ancestors, are rewritten, but the whole tree is read.
+func (t *Collection) RecomputeAggregates() error {
+	if t.store.readOnly {
+		return ErrReadOnly
+	}
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return err
+	}
+	defer t.openRootDecRef(rnl)
+	r, changed, err := t.recomputeAggregates(rnl.root, &rnl.reclaimMark)
+	if err != nil || !changed {
+		return err
+	}
+	if t.store.debugLevel > 0 {
+		t.debugValidate(r, nil)
+	}
+	if !t.rootCAS(rnl, t.mkRootNodeLoc(r)) {
+		t.store.metricsCounter("rootCASFailures", 1)
+		return errors.New("concurrent mutation attempted")
+	}
+	t.lookupCacheClear()
+	t.rootDecRef(rnl)
+	return nil
+}
+
+// Returns n itself when its subtree's aggregates are already right.
+func (t *Collection) recomputeAggregates(n *nodeLoc, reclaimMark *node) (
+	res *nodeLoc, changed bool, err error) {
+	if n.isEmpty() {
+		return n, false, nil
+	}
+	nNode, err := n.read(t.store)
+	if err != nil || nNode == nil {
+		return n, false, err
+	}
+	left, leftChanged, err := t.recomputeAggregates(&nNode.left, reclaimMark)
+	if err != nil {
+		return n, false, err
+	}
+	right, rightChanged, err := t.recomputeAggregates(&nNode.right, reclaimMark)
+	if err != nil {
+		return n, false, err
+	}
+	var item itemLoc
+	item.Copy(&nNode.item)
+	if i := item.Item(); i != nil && item.Loc().isEmpty() {
+		item.numBytes = i.NumBytes(t)
+	}
+	numNodes, numBytes, err := t.aggregates(left, right, &item)
+	if err != nil {
+		return n, false, err
+	}
+	if !leftChanged && !rightChanged && item.numBytes == nNode.item.numBytes &&
+		numNodes == nNode.numNodes && numBytes == nNode.numBytes {
+		return n, false, nil
+	}
+	res = t.mkNodeLoc(t.mkNode(&item, left, right, numNodes, numBytes))
+	if leftChanged {
+		t.freeNodeLoc(left)
+	}
+	if rightChanged {
+		t.freeNodeLoc(right)
+	}
+	t.markReclaimable(nNode, reclaimMark)
+	return res, true, nil
+}
+
+// Operational statistics of a collection, from Collection.Stats().
+type CollectionStats struct {
+	NumItems uint64 `json:"numItems"`
+	NumBytes uint64 `json:"numBytes"` // Total key bytes plus value bytes.
+
+	NumDirtyNodes         uint64 `json:"numDirtyNodes"` // Not yet persisted.
+	NumResidentNodes      uint64 `json:"numResidentNodes"`
+	NumPersistedOnlyNodes uint64 `json:"numPersistedOnlyNodes"` // Not in memory.
+
+	// Maximum depth of the in-memory part of the tree, so it's an
+	// underestimate when nodes are not all resident.
+	ApproxDepth uint64 `json:"approxDepth"`
+
+	// Operation counts since the Collection was opened.
+	NumGets      uint64 `json:"numGets"`
+	NumSets      uint64 `json:"numSets"`
+	NumDeletes   uint64 `json:"numDeletes"`
+	NumEvictions uint64 `json:"numEvictions"`
+
+	// Hits and misses of the lookup cache, see SetLookupCache().
+	LookupCacheHits   uint64 `json:"lookupCacheHits"`
+	LookupCacheMisses uint64 `json:"lookupCacheMisses"`
+
+	// Failed tries of SetItem() to take the collection's lock, and the
+	// SetItem() calls that failed with ErrContended, see
+	// SetMaxSetRetries().
+	SetRetries    uint64 `json:"setRetries"`
+	SetsContended uint64 `json:"setsContended"`
+
+	// The Compact() runs, and the bytes of the persisted records that
+	// they made dead, to be reclaimed, see Compact().
+	NumCompactions        uint64 `json:"numCompactions"`
+	CompactReclaimedBytes uint64 `json:"compactReclaimedBytes"`
+}
+
+// Returns the JSON of the statistics, with the field names of their
+// json tags, for dumping into monitoring.
+func (st CollectionStats) MarshalJSON() ([]byte, error) {
+	type collectionStatsJSON CollectionStats // Sheds the method.
+	return json.Marshal(collectionStatsJSON(st))
+}
+
+// Returns operational statistics of the collection.  The item and
+// byte counts come from the root node's aggregates, and the node
+// counts come from a walk of the in-memory nodes only, so this never
+// reads nodes from file other than the root.
+func (t *Collection) Stats() (res CollectionStats, err error) {
+	res.NumGets = atomic.LoadUint64(&t.numGets)
+	res.NumSets = atomic.LoadUint64(&t.numSets)
+	res.NumDeletes = atomic.LoadUint64(&t.numDeletes)
+	res.NumEvictions = atomic.LoadUint64(&t.numEvictions)
+	res.SetRetries = atomic.LoadUint64(&t.numSetRetries)
+	res.SetsContended = atomic.LoadUint64(&t.numSetsContended)
+	res.NumCompactions = atomic.LoadUint64(&t.numCompactions)
+	res.CompactReclaimedBytes = atomic.LoadUint64(&t.compactedBytes)
+	res.LookupCacheHits, res.LookupCacheMisses = t.lookupCacheStats()
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return res, err
+	}
+	defer t.openRootDecRef(rnl)
+	nNode, err := rnl.root.read(t.store)
+	if err != nil || rnl.root.isEmpty() || nNode == nil {
+		return res, err
+	}
+	res.NumItems = nNode.numNodes
+	res.NumBytes = nNode.numBytes
+	var walk func(nloc *nodeLoc, depth uint64)
+	walk = func(nloc *nodeLoc, depth uint64) {
+		n := nloc.Node()
+		if n == nil {
+			return
+		}
+		res.NumResidentNodes++
+		if nloc.Loc().isEmpty() {
+			res.NumDirtyNodes++
+		}
+		if res.ApproxDepth < depth {
+			res.ApproxDepth = depth
+		}
+		walk(&n.left, depth+1)
+		walk(&n.right, depth+1)
+	}
+	walk(rnl.root, 1)
+	if res.NumItems > res.NumResidentNodes {
+		res.NumPersistedOnlyNodes = res.NumItems - res.NumResidentNodes
+	}
+	return res, nil
+}
+
+// Visits the nodes of the collection's tree, each node before its left
+// and then its right subtree, with the key and priority of the node's
+// item, the numbers of items in its left and right subtrees, and its
+// depth, where the root is at depth 0, until the visitor returns false.
+// This lets tools check the balance of the tree or build external
+// indexes, such as of ranks.  Like the visits, the walk is over the
+// root when it starts, so mutations meanwhile don't change it, and the
+// items are read without their values.  The visitor must not modify
+// the key.
+func (t *Collection) WalkNodes(visitor func(key []byte, priority int,
+	leftCount, rightCount uint64, depth uint64) bool) error {
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return err
+	}
+	defer t.openRootDecRef(rnl)
+	_, err = t.walkNodes(rnl.root, 0, visitor)
+	return err
+}
+
+func (t *Collection) walkNodes(nloc *nodeLoc, depth uint64,
+	visitor func(key []byte, priority int,
+		leftCount, rightCount uint64, depth uint64) bool) (bool, error) {
+	n, err := nloc.read(t.store)
+	if err != nil || nloc.isEmpty() || n == nil {
+		return true, err
+	}
+	i, err := n.item.read(t, false)
+	if err != nil {
+		return false, err
+	}
+	leftNum, _, rightNum, _, err := numInfo(t.store, &n.left, &n.right)
+	if err != nil {
+		return false, err
+	}
+	if !visitor(i.Key, int(i.Priority), leftNum, rightNum, depth) {
+		return false, nil
+	}
+	if keepGoing, err := t.walkNodes(&n.left, depth+1, visitor); !keepGoing {
+		return false, err
+	}
+	return t.walkNodes(&n.right, depth+1, visitor)
+}
+
+// The JSON of a collection in a roots record.
+type collectionJSON struct {
+	ploc
+	KeyPrefixes bool       `json:"kp,omitempty"` // See SetKeyPrefixCompression().
+	ValueChunks bool       `json:"vc,omitempty"` // See SetValueChunking().
+	Keep        int        `json:"kv,omitempty"` // See SetKeepVersions().
+	Versions    bool       `json:"vu,omitempty"` // See SetKeepVersions().
+	Bloom       *bloomJSON `json:"bf,omitempty"` // See EnableBloomFilter().
+	Compare     string     `json:"kc,omitempty"` // See SetCollectionNamedCompare().
+	Multi       bool       `json:"mm,omitempty"` // See SetCollectionMulti().
+
+	Meta map[string][]byte `json:"md,omitempty"` // See SetMeta().
+}
+
+// Returns JSON representation of root node file location.
+func (t *Collection) MarshalJSON() ([]byte, error) {
+	rnl := t.rootAddRef()
+	defer t.rootDecRef(rnl)
+	return t.marshalRootJSON(rnl)
+}
+
+// Returns the roots record JSON of the collection with the given root.
+func (t *Collection) marshalRootJSON(rnl *rootNodeLoc) ([]byte, error) {
+	bj := t.bloomFilterJSON()
+	meta := t.metaMap()
+	if !t.hasKeyPrefixes() && !t.hasValueChunks() && !t.hasVersions() &&
+		t.KeepVersions() == 0 && bj == nil && meta == nil && t.compareName == "" && !t.multi {
+		return rnl.MarshalJSON()
+	}
+	cj := collectionJSON{KeyPrefixes: t.hasKeyPrefixes(),
+		ValueChunks: t.hasValueChunks(), Keep: t.KeepVersions(),
+		Versions: t.hasVersions(), Bloom: bj, Compare: t.compareName, Multi: t.multi,
+		Meta: meta}
+	if loc := rnl.root.Loc(); !loc.isEmpty() {
+		cj.ploc = *loc
+	}
+	return json.Marshal(&cj)
+}
+
+// Returns JSON representation of root node file location.
+func (rnl *rootNodeLoc) MarshalJSON() ([]byte, error) {
 	loc := rnl.root.Loc()
 	if loc.isEmpty() {
 		return json.Marshal(ploc_empty)
@@ -341,12 +1692,32 @@ func (rnl *rootNodeLoc) MarshalJSON() ([]byte, error) {
 
 // Unmarshals JSON representation of root node file location.
 func (t *Collection) UnmarshalJSON(d []byte) error {
-	p := ploc{}
-	if err := json.Unmarshal(d, &p); err != nil {
+	cj := collectionJSON{}
+	if err := json.Unmarshal(d, &cj); err != nil {
 		return err
 	}
+	p := cj.ploc
+	if cj.KeyPrefixes {
+		t.keyPrefixesUsed = 1
+	}
+	if cj.ValueChunks {
+		t.valueChunksUsed = 1
+	}
+	if cj.Keep < 0 || cj.Keep > MaxKeepVersions {
+		return fmt.Errorf("unexpected kept versions: %v", cj.Keep)
+	}
+	t.keepVersions = int32(cj.Keep)
+	if cj.Versions {
+		t.versionsUsed = 1
+	}
+	t.bloomPersisted = cj.Bloom
+	t.compareName = cj.Compare
+	t.multi = cj.Multi
+	t.storeMeta(cj.Meta)
 	if t.rootLock == nil {
 		t.rootLock = &sync.Mutex{}
+		t.writeLock = &sync.Mutex{}
+		t.frees = &freeLists{}
 	}
 	nloc := t.mkNodeLoc(nil)
 	nloc.loc = unsafe.Pointer(&p)
@@ -356,8 +1727,81 @@ func (t *Collection) UnmarshalJSON(d []byte) error {
 	return nil
 }
 
+// Returns the persisted location of the item with the given key, if any.
+func (t *Collection) itemLocOf(n *nodeLoc, key []byte) (*ploc, error) {
+	for {
+		nNode, err := n.read(t.store)
+		if err != nil || n.isEmpty() || nNode == nil {
+			return nil, err
+		}
+		nItem, err := nNode.item.read(t, false)
+		if err != nil {
+			return nil, err
+		}
+		c := t.compare(key, nItem.Key)
+		if c < 0 {
+			n = &nNode.left
+		} else if c > 0 {
+			n = &nNode.right
+		} else {
+			return nNode.item.Loc(), nil
+		}
+	}
+}
+
+// Records a persisted item record that's dead once rnl is released,
+// along with its value chunks, if any.
+func (t *Collection) addDeadLoc(rnl *rootNodeLoc, loc *ploc) {
+	if loc.isEmpty() {
+		return
+	}
+	locs, err := t.itemRegions(loc)
+	if err != nil {
+		// Its space is left dead, for CopyTo() to compact away.
+		t.store.logf("item regions read failed, coll: %v, loc: %v, err: %v",
+			t.name, loc, err)
+		return
+	}
+	t.rootLock.Lock()
+	rnl.deadLocs = append(rnl.deadLocs, locs...)
+	t.rootLock.Unlock()
+}
+
+// Replaces the root of the collection with the persisted node at the
+// given location, where a nil location means an empty collection.
+func (t *Collection) setRootLoc(p *ploc) error {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	return t.setRootLoc_unlocked(p)
+}
+
+// Like setRootLoc(), but the caller holds the collection's writeLock.
+func (t *Collection) setRootLoc_unlocked(p *ploc) error {
+	nloc := t.mkNodeLoc(nil)
+	nloc.loc = unsafe.Pointer(p)
+	if f := t.bloomFilter(); f != nil {
+		if err := t.rebuildBloomFilter(nloc, f.bitsPerKey); err != nil {
+			t.store.logf("bloom filter dropped, coll: %v, err: %v", t.name, err)
+			t.dropBloomFilter()
+		}
+	}
+	rnl := t.rootAddRef()
+	defer t.rootDecRef(rnl)
+	if !t.rootCAS(rnl, t.mkRootNodeLoc(nloc)) {
+		return errors.New("concurrent mutation attempted")
+	}
+	t.lookupCacheClear()
+	t.rootDecRef(rnl)
+	return nil
+}
+
 func (t *Collection) AllocStats() (res AllocStats) {
-	withAllocLocks(func() { res = t.allocStats })
+	t.frees.withLocks(func() {
+		res = t.allocStats
+		res.CurFreeNodes = t.frees.numNodes
+		res.CurFreeNodeLocs = t.frees.numNodeLocs
+		res.CurFreeRootNodeLocs = t.frees.numRootNodeLocs
+	})
 	return res
 }
 
@@ -366,65 +1810,61 @@ func (t *Collection) AllocStats() (res AllocStats) {
 // make these writes visible to the next file re-opening/re-loading.
 func (t *Collection) Write() error {
 	if t.store.readOnly {
-		return errors.New("store is read only")
+		return ErrReadOnly
 	}
-	rnl := t.rootAddRef()
-	defer t.rootDecRef(rnl)
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return err
+	}
+	defer t.openRootDecRef(rnl)
 	return t.write(rnl.root)
 }
 
 func (t *Collection) write(nloc *nodeLoc) error {
-	if err := t.writeItems(nloc); err != nil {
-		return err
-	}
-	if err := t.writeNodes(nloc); err != nil {
-		return err
-	}
-	return nil
+	t.prefixBase = nil
+	return t.writeRecords(nloc)
 }
 
-func (t *Collection) writeItems(nloc *nodeLoc) (err error) {
+// Writes the unpersisted items of a subtree in key order, where each
+// node follows the records of its subtree, as a node record needs the
+// locations of its children.  So the records of a subtree that's
+// written at once are a contiguous range of the file, which ends with
+// its root node, and an ascending scan reads its items in file order.
+func (t *Collection) writeRecords(nloc *nodeLoc) (err error) {
 	if nloc == nil || !nloc.Loc().isEmpty() {
-		return nil // Write only unpersisted items of non-empty, unpersisted nodes.
+		return nil // Write only non-empty, unpersisted nodes.
 	}
 	node := nloc.Node()
 	if node == nil {
 		return nil
 	}
-	if err = t.writeItems(&node.left); err != nil {
+	if err = t.writeRecords(&node.left); err != nil {
 		return err
 	}
-	if err = node.item.write(t); err != nil { // Write items in key order.
-		return err
-	}
-	return t.writeItems(&node.right)
-}
-
-func (t *Collection) writeNodes(nloc *nodeLoc) (err error) {
-	if nloc == nil || !nloc.Loc().isEmpty() {
-		return nil // Write only non-empty, unpersisted nodes.
-	}
-	node := nloc.Node()
-	if node == nil {
-		return nil
-	}
-	if err = t.writeNodes(&node.left); err != nil {
+	if err = node.item.write(t); err != nil {
 		return err
 	}
-	if err = t.writeNodes(&node.right); err != nil {
+	if err = t.writeRecords(&node.right); err != nil {
 		return err
 	}
-	return nloc.write(t.store) // Write nodes in children-first order.
+	return nloc.write(t.store)
 }
 
 func (t *Collection) rootCAS(prev, next *rootNodeLoc) bool {
 	t.rootLock.Lock()
 	defer t.rootLock.Unlock()
+	return t.rootCAS_unlocked(prev, next)
+}
 
+func (t *Collection) rootCAS_unlocked(prev, next *rootNodeLoc) bool {
 	if t.root != prev {
 		return false // TODO: Callers need to release resources.
 	}
 	t.root = next
+	if prev != nil && !prev.superseded {
+		prev.superseded = true
+		atomic.AddInt64(&t.frees.reclaimPending, 1)
+	}
 
 	if prev != nil && prev.refs > 2 {
 		// Since the prev is in-use, hook up its chain to disallow
@@ -441,6 +1881,30 @@ func (t *Collection) rootCAS(prev, next *rootNodeLoc) bool {
 	return true
 }
 
+// Like rootAddRef(), but fails with ErrStoreClosed or
+// ErrCollectionMissing once the collection was closed, as the Store
+// was closed or the collection was removed or replaced.
+func (t *Collection) openRootAddRef() (*rootNodeLoc, error) {
+	t.rootLock.Lock()
+	defer t.rootLock.Unlock()
+	if t.root == nil {
+		if t.store.isClosed() {
+			return nil, ErrStoreClosed
+		}
+		return nil, fmt.Errorf("%w, it was removed or replaced", ErrCollectionMissing)
+	}
+	t.root.refs++
+	atomic.AddInt64(&t.store.reads, 1)
+	return t.root, nil
+}
+
+// Releases a root of openRootAddRef(), which ends an in-flight read or
+// mutation of the Store, see CloseWait().
+func (t *Collection) openRootDecRef(r *rootNodeLoc) {
+	t.rootDecRef(r)
+	atomic.AddInt64(&t.store.reads, -1)
+}
+
 func (t *Collection) rootAddRef() *rootNodeLoc {
 	t.rootLock.Lock()
 	defer t.rootLock.Unlock()
@@ -450,9 +1914,9 @@ func (t *Collection) rootAddRef() *rootNodeLoc {
 
 func (t *Collection) rootDecRef(r *rootNodeLoc) {
 	t.rootLock.Lock()
-	freeNodeLock.Lock()
+	t.frees.nodeLock.Lock()
 	t.rootDecRef_unlocked(r)
-	freeNodeLock.Unlock()
+	t.frees.nodeLock.Unlock()
 	t.rootLock.Unlock()
 }
 
@@ -461,16 +1925,30 @@ func (t *Collection) rootDecRef_unlocked(r *rootNodeLoc) {
 	if r.refs > 0 {
 		return
 	}
+	if r.superseded {
+		atomic.AddInt64(&t.frees.reclaimPending, -1)
+	}
 	if r.chainedCollection != nil && r.chainedRootNodeLoc != nil {
 		r.chainedCollection.rootDecRef_unlocked(r.chainedRootNodeLoc)
 	}
-	t.reclaimNodes_unlocked(r.root.Node(), &r.reclaimLater, &r.reclaimMark)
+	var deadLocs *[]ploc
+	if !r.closed && t.store.freeList.tracking() {
+		deadLocs = &r.deadLocs
+	}
+	numReclaimed := t.reclaimNodes_unlocked(r.root.Node(), r.root.Loc(),
+		&r.reclaimLater, &r.reclaimMark, deadLocs)
 	for i := 0; i < len(r.reclaimLater); i++ {
 		if r.reclaimLater[i] != nil {
-			t.reclaimNodes_unlocked(r.reclaimLater[i], nil, &r.reclaimMark)
+			numReclaimed += t.reclaimNodes_unlocked(r.reclaimLater[i],
+				r.reclaimLaterLocs[i], nil, &r.reclaimMark, deadLocs)
 			r.reclaimLater[i] = nil
 		}
 	}
+	if numReclaimed > 0 {
+		t.store.metricsCounter("nodesReclaimed", numReclaimed)
+	}
+	t.store.freeList.addPending(r.deadLocs)
+	r.deadLocs = nil
 	t.freeNodeLoc(r.root)
 	t.freeRootNodeLoc(r)
 }
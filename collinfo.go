@@ -0,0 +1,171 @@
+package gkvlite
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"unsafe"
+)
+
+// A summary of a collection, see ListCollections().
+type CollectionInfo struct {
+	Name     string `json:"name"`
+	NumItems uint64 `json:"numItems"`
+	NumBytes uint64 `json:"numBytes"`
+
+	// Whether the tree of the collection has changes that aren't
+	// persisted yet, which the next Flush() writes.  A new or emptied
+	// collection without items isn't dirty, though the next Flush()
+	// persists that, too.
+	Dirty bool `json:"dirty"`
+
+	// Whether the collection has a KeyCompare other than bytes.Compare.
+	CustomCompare bool `json:"customCompare"`
+
+	// The Priority of the item of the root node, which is the largest
+	// of the collection, or 0 for an empty collection.
+	RootPriority int32 `json:"rootPriority"`
+}
+
+// Returns a CollectionInfo of every collection, without the hidden
+// collections of the secondary indexes, in the order of their creation,
+// where the collections that were read from the file, such as on open
+// or by FlushRevert(), come first, by name.  The totals are from the
+// aggregates of the root nodes, so it's at most one node and one item
+// read per collection, and each collection's info is of a single root,
+// so it's never torn by a concurrent mutation, but the collections
+// aren't taken at the same time, so for the infos of one moment, use
+// ListCollections() of a Snapshot().
+func (s *Store) ListCollections() ([]CollectionInfo, error) {
+	coll := s.collections()
+	if coll == nil {
+		return nil, ErrStoreClosed
+	}
+	cs := make([]*Collection, 0, len(coll))
+	for name, c := range coll {
+		if !isIndexCollName(name) {
+			cs = append(cs, c)
+		}
+	}
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].seq != cs[j].seq {
+			return cs[i].seq < cs[j].seq
+		}
+		return cs[i].name < cs[j].name
+	})
+	res := make([]CollectionInfo, 0, len(cs))
+	for _, c := range cs {
+		info, err := c.info()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, info)
+	}
+	return res, nil
+}
+
+// Like ListCollections(), but sorted by name, and of a Snapshot() of
+// the store, so the infos of all the collections are of one moment,
+// such as for an overview of the store on a dashboard.
+func (s *Store) CollectionsInfo() ([]CollectionInfo, error) {
+	if s.isClosed() {
+		return nil, ErrStoreClosed
+	}
+	snapshot := s.Snapshot()
+	defer snapshot.Close()
+	res, err := snapshot.ListCollections()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+var bytesComparePtr = reflect.ValueOf(bytes.Compare).Pointer()
+
+func (t *Collection) info() (CollectionInfo, error) {
+	info := CollectionInfo{Name: t.name,
+		CustomCompare: reflect.ValueOf(t.compare).Pointer() != bytesComparePtr}
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return info, err
+	}
+	defer t.openRootDecRef(rnl)
+	n, err := rnl.root.read(t.store)
+	if err != nil || n == nil {
+		return info, err
+	}
+	info.NumItems, info.NumBytes = n.numNodes, n.numBytes
+	info.Dirty = rnl.root.Loc().isEmpty()
+	i, err := n.item.read(t, false)
+	if err != nil || i == nil {
+		return info, err
+	}
+	info.RootPriority = i.Priority
+	return info, nil
+}
+
+// Registers a callback that's invoked with the sorted names of the
+// collections that were added and removed, once their change is
+// visible to readers, such as to keep an admin endpoint current.  A
+// SetCollection() of a new name adds it, a RemoveCollection() removes
+// it, RenameCollection() removes the old name and adds the new one,
+// where a forced rename that displaces a collection removes that name
+// and adds it again, and FlushRevert() adds and removes the names that
+// differ afterwards.  The hidden collections of the secondary indexes
+// aren't reported, nor are SwapCollections(), which keeps the names.
+// A nil callback unregisters the current one.
+//
+// The callback is invoked by the goroutine of the change, which may be
+// holding the Store's writeLock, such as in FlushRevertCollection(), so
+// the callback must not Flush() the Store or change its collections.
+// Concurrent changes may be reported concurrently and in either order,
+// so an app that needs the current collections should then
+// ListCollections().
+func (s *Store) OnCollectionsChanged(cb func(added, removed []string)) {
+	if cb == nil {
+		atomic.StorePointer(&s.collsChanged, nil)
+		return
+	}
+	atomic.StorePointer(&s.collsChanged, unsafe.Pointer(&cb))
+}
+
+func (s *Store) notifyCollectionsChanged(added, removed []string) {
+	p := (*func(added, removed []string))(atomic.LoadPointer(&s.collsChanged))
+	if p == nil {
+		return
+	}
+	added, removed = visibleCollNames(added), visibleCollNames(removed)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	(*p)(added, removed)
+}
+
+// Returns the sorted names without the hidden ones of indexes.
+func visibleCollNames(names []string) []string {
+	var res []string
+	for _, name := range names {
+		if !isIndexCollName(name) {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Returns the names that are only in after and only in before.
+func diffCollNames(before, after map[string]*Collection) (added, removed []string) {
+	for name := range after {
+		if before[name] == nil {
+			added = append(added, name)
+		}
+	}
+	for name := range before {
+		if after[name] == nil {
+			removed = append(removed, name)
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,350 @@
+package gkvlite
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Files smaller than this are never auto-compacted, as a fresh or small
+// store has a low live ratio from its roots records alone.
+var autoCompactMinSize int64 = 64 * 1024
+
+// Configuration and state of auto-compaction, see SetAutoCompact().
+type autoCompact struct {
+	m              sync.Mutex
+	minLiveRatio   float64
+	background     bool
+	path           string      // The store file's path, as renames keep it.
+	bg             *compaction // The running background compaction, if any.
+	file           *os.File    // The compacted file the Store switched to.
+	orig           StoreFile   // The Store's file before the first switch.
+	numCompactions uint64
+}
+
+// A compaction copies the live collections into a new file next to
+// the store file, which then replaces the store file.
+type compaction struct {
+	ic   *IncrementalCopy
+	file *os.File
+	done chan struct{} // Closed when a background copy finishes.
+	err  error
+}
+
+// Enables auto-compaction, where a Flush() that leaves the ratio of
+// live bytes to file size below minLiveRatio compacts the store file;
+// a minLiveRatio of 0 disables auto-compaction.  Live bytes are
+// estimated from the item and node counts of the collections.  The
+// compacted file is written as path + ".compact" and then renamed over
+// the store file, so the StoreFile must be an *os.File.  Afterwards the
+// Store owns the new file, which is closed by Close(); the original
+// *os.File remains the application's to close, unless closed by
+// CloseEx().
+//
+// Switching to the compacted file happens within Flush(), once no reads
+// of the Store are in flight, while the reads that start meanwhile
+// wait.  A compaction is dropped, and left to a later Flush(), when the
+// reads in flight don't end soon enough, such as a visit whose
+// callback waits for the Flush().  As nodes are addressed by file
+// offset, neither free space reuse nor tags can be combined with
+// auto-compaction.
+func (s *Store) SetAutoCompact(minLiveRatio float64) error {
+	if s.file == nil {
+		return errors.New("no file / in-memory only, so cannot auto-compact")
+	}
+	if s.readOnly {
+		return fmt.Errorf("%w, so cannot auto-compact", ErrReadOnly)
+	}
+	if _, ok := s.file.(*os.File); !ok {
+		return errors.New("auto-compaction needs an *os.File StoreFile")
+	}
+	if minLiveRatio < 0 || minLiveRatio >= 1 {
+		return errors.New("minLiveRatio must be >= 0 and < 1")
+	}
+	if minLiveRatio > 0 && s.freeList.tracking() {
+		return errors.New("free space reuse is enabled, so cannot auto-compact")
+	}
+	if minLiveRatio > 0 && s.hasTags() {
+		return errors.New("the store has tags, so cannot auto-compact")
+	}
+	if minLiveRatio > 0 && s.hasHistory() {
+		return errors.New("the store has a history, so cannot auto-compact")
+	}
+	if s.autoCompact == nil {
+		s.autoCompact = &autoCompact{}
+	}
+	s.autoCompact.m.Lock()
+	s.autoCompact.minLiveRatio = minLiveRatio
+	if s.autoCompact.path == "" {
+		s.autoCompact.path = s.file.(*os.File).Name()
+	}
+	s.autoCompact.m.Unlock()
+	return nil
+}
+
+// Chooses whether auto-compaction copies in-line, within the Flush()
+// that triggered it, or in a background goroutine from a snapshot.  A
+// background compaction is finished by the first Flush() after the
+// copy is done, which then copies only what changed in the meantime.
+// Errors from a background compaction are logged and the compaction is
+// dropped.  The default is in-line.
+func (s *Store) SetAutoCompactBackground(background bool) {
+	if s.autoCompact == nil {
+		s.autoCompact = &autoCompact{}
+	}
+	s.autoCompact.m.Lock()
+	s.autoCompact.background = background
+	s.autoCompact.m.Unlock()
+}
+
+func (a *autoCompact) enabled() bool {
+	if a == nil {
+		return false
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.minLiveRatio > 0
+}
+
+// Invoked at the end of a successful Flush() with the roots it wrote.
+func (s *Store) maybeAutoCompact(rnls map[string]*rootNodeLoc) error {
+	a := s.autoCompact
+	if a == nil {
+		return nil
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.bg != nil {
+		select {
+		case <-a.bg.done:
+		default:
+			return nil // Still copying.
+		}
+		c := a.bg
+		a.bg = nil
+		if c.err != nil {
+			s.logf("background compaction failed: %v", c.err)
+			c.abort()
+			return nil
+		}
+		return s.finishCompaction(a, c)
+	}
+	if a.minLiveRatio <= 0 || s.liveRatio(rnls) >= a.minLiveRatio {
+		return nil
+	}
+	c, err := s.newCompaction(a.path)
+	if err != nil {
+		return err
+	}
+	if a.background {
+		a.bg = c
+		snapshot := s.Snapshot()
+		go func() {
+			_, c.err = snapshot.CopyToIncremental(c.ic)
+			close(c.done)
+		}()
+		return nil
+	}
+	return s.finishCompaction(a, c)
+}
+
+// Returns the estimated ratio of live bytes to file size.
+func (s *Store) liveRatio(rnls map[string]*rootNodeLoc) float64 {
+	size := atomic.LoadInt64(&s.size)
+	if size < autoCompactMinSize {
+		return 1
+	}
+	perItem := uint64(ploc_length + ploc_length + ploc_length + 8 + 8 +
+		itemLoc_hdrLength)
+	var live uint64
+	for _, rnl := range rnls {
+		n, err := rnl.root.read(s)
+		if err != nil || n == nil {
+			continue
+		}
+		live += n.numBytes + n.numNodes*perItem
+	}
+	return float64(live) / float64(size)
+}
+
+func (s *Store) newCompaction(path string) (*compaction, error) {
+	perm := os.FileMode(0666)
+	if fi, err := s.file.Stat(); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	f, err := os.OpenFile(path+".compact", os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := NewStoreEx(f, s.callbacks)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &compaction{
+		ic:   newIncrementalCopy(dst),
+		file: f,
+		done: make(chan struct{}),
+	}, nil
+}
+
+func (c *compaction) abort() {
+	c.file.Close()
+	os.Remove(c.file.Name())
+}
+
+// Copies whatever the compaction doesn't have yet and then switches
+// the Store and its collections over to the compacted file.
+func (s *Store) finishCompaction(a *autoCompact, c *compaction) error {
+	collPtr := atomic.LoadPointer(&s.coll)
+	coll := *(*map[string]*Collection)(collPtr)
+	rnls, _, err := s.copyToIncremental(c.ic, coll)
+	defer func() {
+		for name, rnl := range rnls {
+			coll[name].rootDecRef(rnl)
+		}
+	}()
+	if err == nil {
+		err = c.file.Sync()
+	}
+	if err == nil && atomic.LoadPointer(&s.coll) != collPtr {
+		err = errors.New("concurrent collection change during compaction")
+	}
+	for name, rnl := range rnls {
+		if err != nil {
+			break
+		}
+		cur := coll[name].rootAddRef()
+		if cur != rnl {
+			err = errors.New("concurrent mutation during compaction")
+		}
+		coll[name].rootDecRef(cur)
+	}
+	if err != nil {
+		c.abort()
+		return err
+	}
+	dst := c.ic.dst
+	next := map[string]*rootNodeLoc{}
+	for name := range rnls {
+		dstColl := dst.GetCollection(name)
+		dstRnl := dstColl.rootAddRef()
+		nloc := coll[name].mkNodeLoc(nil)
+		nloc.loc = unsafe.Pointer(dstRnl.root.Loc())
+		dstColl.rootDecRef(dstRnl)
+		next[name] = coll[name].mkRootNodeLoc(nloc)
+	}
+	switched, err := s.switchFile(coll, func() error {
+		for name, rnl := range rnls {
+			if coll[name].root != rnl {
+				return errors.New("concurrent mutation during compaction switch")
+			}
+		}
+		if err := os.Rename(c.file.Name(), a.path); err != nil {
+			return err
+		}
+		// The original file isn't closed, as snapshots may still read it.
+		if a.orig == nil {
+			a.orig = s.file
+		}
+		s.file = c.file
+		atomic.StoreInt64(&s.size, atomic.LoadInt64(&dst.size))
+		atomic.AddUint64(&s.rewrites, 1)
+		for name, rnl := range rnls {
+			coll[name].rootCAS_unlocked(rnl, next[name])
+		}
+		return nil
+	})
+	if !switched || err != nil {
+		for name, rnl := range next {
+			coll[name].freeNodeLoc(rnl.root)
+			coll[name].freeRootNodeLoc(rnl)
+		}
+		c.abort()
+		if err == nil {
+			s.logf("compaction dropped, as reads stayed in flight")
+		}
+		return err
+	}
+	s.discarded = 0
+	s.freeList.load(nil, dst.freeList.rootsLoc)
+	for name, rnl := range rnls {
+		coll[name].bloomFileChanged()
+		coll[name].lookupCacheClear()
+		coll[name].rootDecRef(rnl)
+	}
+	a.file = c.file
+	a.numCompactions++
+	if s.metrics != nil {
+		s.metrics.Counter("autoCompactions", 1)
+	}
+	return nil
+}
+
+// How long the switch to a compacted file waits for the reads that are
+// in flight before the compaction is dropped.
+var autoCompactSwitchWait = 100 * time.Millisecond
+
+// Invokes swap with the roots of all the collections locked and with
+// no reads in flight, so that a read never pairs a root with the file
+// of another, and with the fileLock held for the same of Snapshot().
+// Reads that start meanwhile wait for the roots; the reads that are in
+// flight are waited for up to autoCompactSwitchWait, as they might also
+// wait for the Flush() of the switch, in which case the swap isn't
+// invoked.  Returns whether swap was invoked, and its error.
+func (s *Store) switchFile(coll map[string]*Collection,
+	swap func() error) (bool, error) {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	names := collNames(coll)
+	deadline := time.Now().Add(autoCompactSwitchWait)
+	for {
+		for _, name := range names {
+			coll[name].rootLock.Lock()
+		}
+		idle := atomic.LoadInt64(&s.reads) == 0
+		var err error
+		if idle {
+			err = swap()
+		}
+		for _, name := range names {
+			coll[name].rootLock.Unlock()
+		}
+		if idle || time.Now().After(deadline) {
+			return idle, err
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Waits for any background compaction and drops it, and closes the
+// compacted file that the Store owns.  Returns the Store's original
+// file, if the Store switched away from it.
+func (a *autoCompact) close() (orig StoreFile) {
+	if a == nil {
+		return nil
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.bg != nil {
+		<-a.bg.done
+		a.bg.abort()
+		a.bg = nil
+	}
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	return a.orig
+}
+
+func (a *autoCompact) stats(out map[string]uint64) {
+	a.m.Lock()
+	out["autoCompactions"] = a.numCompactions
+	a.m.Unlock()
+}
@@ -0,0 +1,128 @@
+package gkvlite
+
+import (
+	"errors"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Returned by SetItem() and Set() when the collection's lock stayed
+// held by other mutations for more tries than SetMaxSetRetries() allows.
+var ErrContended = errors.New("collection contended")
+
+// How SetItem() takes the mutationLock(), see SetMaxSetRetries().
+type setRetryConfig struct {
+	maxRetries int           // 0 means no limit.
+	threshold  int           // Failed tries before backing off.
+	maxDelay   time.Duration // Of a backoff.
+}
+
+const (
+	defaultSetRetryThreshold = 4
+	defaultSetRetryMaxDelay  = 10 * time.Millisecond
+	setRetryBaseDelay        = 10 * time.Microsecond
+)
+
+// Bounds how long SetItem() and Set() wait for the lock that serializes
+// the mutations of the collection, so that callers may shed load rather
+// than queue up behind other writers.  With n above 0, a SetItem() tries
+// to take the lock, yielding the processor after a failed try and,
+// after the backoff threshold of SetSetRetryBackoff(), sleeping for an
+// exponentially growing, jittered delay, and fails with ErrContended
+// after n failed tries.  An n of 0 (the default) waits however long it
+// takes.  The failed tries are counted by the SetRetries of Stats() and
+// the "setRetries" metric, and the failures by SetsContended and the
+// "setsContended" metric.  The setting carries over to the Collection
+// that SetCollection() returns for an existing name.  The writes that
+// go through the writer goroutine of StartWriter() are not bounded.
+func (t *Collection) SetMaxSetRetries(n int) error {
+	if n < 0 {
+		return errors.New("max set retries must be non-negative")
+	}
+	c := t.setRetryConfig()
+	c.maxRetries = n
+	t.storeSetRetryConfig(c)
+	return nil
+}
+
+// Sets after how many failed tries of the lock a SetItem() that's
+// bounded by SetMaxSetRetries() backs off between its tries, and the
+// longest delay of a backoff, which doubles from 10 microseconds.  The
+// defaults are a threshold of 4 tries and a maxDelay of 10 milliseconds.
+func (t *Collection) SetSetRetryBackoff(threshold int, maxDelay time.Duration) error {
+	if threshold < 0 || maxDelay < 0 {
+		return errors.New("backoff threshold and delay must be non-negative")
+	}
+	c := t.setRetryConfig()
+	c.threshold, c.maxDelay = threshold, maxDelay
+	t.storeSetRetryConfig(c)
+	return nil
+}
+
+func (t *Collection) setRetryConfig() setRetryConfig {
+	if p := atomic.LoadPointer(&t.setRetries); p != nil {
+		return *(*setRetryConfig)(p)
+	}
+	return setRetryConfig{
+		threshold: defaultSetRetryThreshold,
+		maxDelay:  defaultSetRetryMaxDelay,
+	}
+}
+
+func (t *Collection) storeSetRetryConfig(c setRetryConfig) {
+	atomic.StorePointer(&t.setRetries, unsafe.Pointer(&c))
+}
+
+// Like mutationLock(), but gives up with ErrContended after the tries
+// that SetMaxSetRetries() allows.
+func (t *Collection) setMutationLock() (notify bool, err error) {
+	p := atomic.LoadPointer(&t.setRetries)
+	if p == nil || (*setRetryConfig)(p).maxRetries <= 0 {
+		return t.mutationLock(), nil
+	}
+	c := (*setRetryConfig)(p)
+	retries := 0
+	if !t.tryLock(t.writeLock, c, &retries) {
+		return false, ErrContended
+	}
+	if t.observed() {
+		if !t.tryLock(&t.store.notifyLock, c, &retries) {
+			t.writeLock.Unlock()
+			return false, ErrContended
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func (t *Collection) tryLock(m *sync.Mutex, c *setRetryConfig, retries *int) bool {
+	for !m.TryLock() {
+		*retries++
+		atomic.AddUint64(&t.numSetRetries, 1)
+		t.store.metricsCounter("setRetries", 1)
+		if *retries >= c.maxRetries {
+			atomic.AddUint64(&t.numSetsContended, 1)
+			t.store.metricsCounter("setsContended", 1)
+			return false
+		}
+		if *retries <= c.threshold {
+			runtime.Gosched()
+			continue
+		}
+		delay := c.maxDelay
+		if shift := uint(*retries - c.threshold - 1); shift < 32 {
+			if d := setRetryBaseDelay << shift; d < delay {
+				delay = d
+			}
+		}
+		if delay > 0 {
+			jitter := float64(t.store.randInt31()) / math.MaxInt32
+			time.Sleep(delay/2 + time.Duration(jitter*float64(delay/2)))
+		}
+	}
+	return true
+}
@@ -0,0 +1,234 @@
+package gkvlite
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Options of ImportCSV().
+type CSVImportOptions struct {
+	// The field delimiter, such as '\t' for TSV, where 0 means ','.
+	Comma rune
+
+	// Whether the first row is a header of column names, which is then
+	// not imported, and which the column names below refer to.
+	Header bool
+
+	// The column of the key, by index, or by name when KeyColumnName
+	// is set, which requires a Header.
+	KeyColumn     int
+	KeyColumnName string
+
+	// Whether the key column holds int64's, which are then encoded by
+	// AppendInt64(), so that the keys sort numerically.
+	NumericKey bool
+
+	// The column of the value, by index, or by name when ValColumnName
+	// is set, which requires a Header.
+	ValColumn     int
+	ValColumnName string
+
+	// Composes the value of a row instead of the value column, such as
+	// from several columns.  The row must not be retained.
+	Value func(row []string) ([]byte, error)
+
+	// The number of rows that are set with one root swap, where 0
+	// means 1000.
+	BatchSize int
+
+	// Whether the Store is flushed after every batch, so that an
+	// interrupted import keeps the rows of the flushed batches.
+	FlushBatches bool
+
+	// The most malformed rows that the CSVImportError reports, where 0
+	// means 100.  The malformed rows are skipped and counted, unless
+	// StopOnError is set, which aborts the import at the first one.
+	MaxErrors   int
+	StopOnError bool
+}
+
+// A malformed row of ImportCSV().
+type CSVRowError struct {
+	Line int // Of the start of the row in the input.
+	Err  error
+}
+
+func (e *CSVRowError) Error() string {
+	return fmt.Sprintf("csv line %v: %v", e.Line, e.Err)
+}
+
+func (e *CSVRowError) Unwrap() error {
+	return e.Err
+}
+
+// The error of ImportCSV() when it skipped malformed rows, after it
+// imported the other rows.
+type CSVImportError struct {
+	Rows         []*CSVRowError // The first MaxErrors malformed rows.
+	NumMalformed uint64
+}
+
+func (e *CSVImportError) Error() string {
+	return fmt.Sprintf("csv import skipped %v malformed rows, first: %v",
+		e.NumMalformed, e.Rows[0])
+}
+
+// Imports the rows of CSV or TSV data from r into the collection c of
+// the Store, as items of a key column and a value column, or a value
+// composed by opts.Value, with random priorities like Set().  The rows
+// are set in batches with a root swap per batch, like ReadJSON(), and
+// so a later row of a key replaces an earlier one.  Returns the number
+// of imported rows, and a *CSVImportError when malformed rows, such as
+// of too few columns, a bad numeric key or a bad quote, were skipped.
+func (s *Store) ImportCSV(c *Collection, r io.Reader,
+	opts CSVImportOptions) (uint64, error) {
+	if s.readOnly {
+		return 0, fmt.Errorf("%w, so cannot ImportCSV()", ErrReadOnly)
+	}
+	if c.store != s {
+		return 0, errors.New("collection of another store")
+	}
+	if opts.Value == nil && opts.ValColumnName == "" &&
+		opts.ValColumn == opts.KeyColumn && opts.KeyColumnName == "" {
+		return 0, errors.New("csv key and value columns must differ")
+	}
+	if !opts.Header && (opts.KeyColumnName != "" || opts.ValColumnName != "") {
+		return 0, errors.New("csv column names require a header")
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	maxErrors := opts.MaxErrors
+	if maxErrors <= 0 {
+		maxErrors = 100
+	}
+	cr := csv.NewReader(r)
+	if opts.Comma != 0 {
+		cr.Comma = opts.Comma
+	}
+	cr.FieldsPerRecord = -1 // The columns are checked per row.
+	cr.ReuseRecord = true
+	keyCol, valCol := opts.KeyColumn, opts.ValColumn
+	if opts.Header {
+		header, err := cr.Read()
+		if err != nil {
+			return 0, fmt.Errorf("csv header: %w", err)
+		}
+		if keyCol, err = csvColumn(header, opts.KeyColumnName, keyCol); err != nil {
+			return 0, err
+		}
+		if valCol, err = csvColumn(header, opts.ValColumnName, valCol); err != nil {
+			return 0, err
+		}
+	}
+	var numLoaded uint64
+	var report CSVImportError
+	batch := make([]*Item, 0, batchSize)
+	flush := func() error {
+		if err := c.setItemsBatch(batch); err != nil {
+			return err
+		}
+		numLoaded += uint64(len(batch))
+		batch = batch[:0]
+		if opts.FlushBatches && s.file != nil {
+			return s.Flush()
+		}
+		return nil
+	}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		var pe *csv.ParseError
+		if err != nil && !errors.As(err, &pe) {
+			return numLoaded, err // Not a malformed row, but of r.
+		}
+		var item *Item
+		line := 0
+		if err == nil {
+			line, _ = cr.FieldPos(0)
+			item, err = csvItem(c, row, keyCol, valCol, &opts)
+		} else {
+			line = pe.StartLine
+		}
+		if err != nil {
+			rowErr := &CSVRowError{Line: line, Err: err}
+			if opts.StopOnError {
+				return numLoaded, rowErr
+			}
+			if len(report.Rows) < maxErrors {
+				report.Rows = append(report.Rows, rowErr)
+			}
+			report.NumMalformed++
+			continue
+		}
+		batch = append(batch, item)
+		if len(batch) >= batchSize {
+			if err = flush(); err != nil {
+				return numLoaded, err
+			}
+		}
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return numLoaded, err
+		}
+	}
+	if report.NumMalformed > 0 {
+		return numLoaded, &report
+	}
+	return numLoaded, nil
+}
+
+// Returns the index of the named column of the header, or col when
+// name is "".
+func csvColumn(header []string, name string, col int) (int, error) {
+	if name == "" {
+		return col, nil
+	}
+	for i, h := range header {
+		if h == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("csv column missing: %s", name)
+}
+
+// Returns the item of a row, which is reused by the next row, so the
+// item copies the fields.
+func csvItem(c *Collection, row []string, keyCol, valCol int,
+	opts *CSVImportOptions) (*Item, error) {
+	if keyCol < 0 || keyCol >= len(row) {
+		return nil, fmt.Errorf("key column %v missing, columns: %v", keyCol, len(row))
+	}
+	item := &Item{Priority: c.store.randInt31()}
+	if opts.NumericKey {
+		n, err := strconv.ParseInt(row[keyCol], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		item.Key = AppendInt64(nil, n)
+	} else {
+		item.Key = []byte(row[keyCol])
+	}
+	if opts.Value != nil {
+		val, err := opts.Value(row)
+		if err != nil {
+			return nil, err
+		}
+		item.Val = append([]byte{}, val...)
+	} else if valCol < 0 || valCol >= len(row) {
+		return nil, fmt.Errorf("value column %v missing, columns: %v", valCol, len(row))
+	} else {
+		item.Val = []byte(row[valCol])
+	}
+	if err := c.checkItem(item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
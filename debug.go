@@ -0,0 +1,243 @@
+package gkvlite
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Item ref-counts as tracked by debug validation, to check that every
+// ItemDecRef() has a matching ItemAddRef() or ItemAlloc().  Only items
+// allocated or first set after validation was enabled are tracked.
+// Released items keep their entry, to catch a later use.
+type debugRefs struct {
+	m      sync.Mutex
+	counts map[*Item]*debugRef
+}
+
+type debugRef struct {
+	count    int64
+	released bool // When the count dropped back to 0.
+}
+
+// Sets the debug validation level of the Store, which is meant for
+// tests and fuzzing.  At level 0 (the default), there's no validation.
+// At level 1, after every SetItem() and Delete(), the numNodes and
+// numBytes aggregates of the nodes on the path to the mutated key are
+// re-derived from their children and compared.  At level 2, the whole
+// new tree is validated for key order, priority heap order and
+// aggregates.  At any level above 0, item ref-counts are also checked
+// for ItemAddRef() / ItemDecRef() symmetry.  Violations panic with a
+// description of the node path or the item.  This should be called
+// before the Store is used concurrently.
+func (s *Store) SetDebugValidation(level int) {
+	s.debugLevel = level
+	if level > 0 && s.debugRefs == nil {
+		s.debugRefs = &debugRefs{counts: map[*Item]*debugRef{}}
+	} else if level <= 0 {
+		s.debugRefs = nil
+	}
+}
+
+// Returned by mutations when SetCompareAssertions() is enabled and the
+// KeyCompare of a collection is inconsistent, see CompareError.
+var ErrInconsistentCompare = errors.New("inconsistent KeyCompare")
+
+// A CompareError describes the results of a KeyCompare that are not
+// antisymmetric, where A and B are the compared keys and AB and BA the
+// results of compare(A, B) and compare(B, A); for a KeyCompare that
+// doesn't find a key equal to itself, A and B are the same key.
+type CompareError struct {
+	Collection string
+	A, B       []byte
+	AB, BA     int
+}
+
+func (e *CompareError) Error() string {
+	return fmt.Sprintf("%v, coll: %q, compare(%q, %q): %d, compare(%q, %q): %d",
+		ErrInconsistentCompare, e.Collection, e.A, e.B, e.AB, e.B, e.A, e.BA)
+}
+
+func (e *CompareError) Unwrap() error {
+	return ErrInconsistentCompare
+}
+
+// Enables or disables the checking of the KeyCompare results that
+// SetItem(), Delete() and friends rely on to place keys, which is meant
+// for the development of custom KeyCompare funcs.  When enabled, every
+// compare of a split of the tree is checked by also comparing the keys
+// in reverse order, and the key against itself, and results that are
+// not antisymmetric fail the mutation with a *CompareError, before the
+// tree is built from them, whereas a broken KeyCompare otherwise
+// silently misplaces keys.  This doubles the cost of the compares.
+// When disabled (the default), the check is a single flag test.  This
+// should be called before the Store is used concurrently.
+func (s *Store) SetCompareAssertions(enabled bool) {
+	s.compareCheck = enabled
+}
+
+// Compares the keys for a mutation, checking the result when
+// SetCompareAssertions() is enabled.
+func (t *Collection) compareChecked(a, b []byte) (int, error) {
+	c := t.compare(a, b)
+	if !t.store.compareCheck {
+		return c, nil
+	}
+	if r := t.compare(b, a); sign(c) != -sign(r) {
+		return c, &CompareError{t.name, a, b, c, r}
+	}
+	if r := t.compare(a, a); r != 0 {
+		return c, &CompareError{t.name, a, a, r, r}
+	}
+	return c, nil
+}
+
+func sign(c int) int {
+	if c < 0 {
+		return -1
+	} else if c > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Starts tracking an item's ref-count, at 1 for a new allocation or,
+// for an item that's being set, at 0 unless it's already tracked.
+func (d *debugRefs) begin(i *Item, allocated bool) {
+	if d == nil || i == nil {
+		return
+	}
+	d.m.Lock()
+	if allocated {
+		d.counts[i] = &debugRef{count: 1}
+	} else if d.counts[i] == nil {
+		d.counts[i] = &debugRef{}
+	}
+	d.m.Unlock()
+}
+
+func (d *debugRefs) update(o *Store, c *Collection, i *Item, delta int64) {
+	if d == nil || i == nil {
+		return
+	}
+	d.m.Lock()
+	r := d.counts[i]
+	if r == nil {
+		d.m.Unlock()
+		return
+	}
+	count := r.count
+	var msg string
+	if delta > 0 && r.released {
+		msg = "ItemAddRef() after the last ItemDecRef()"
+	} else if delta < 0 && count <= 0 {
+		msg = "ItemDecRef() without a matching ItemAddRef()"
+	}
+	r.count += delta
+	if r.count == 0 && delta < 0 {
+		r.released = true
+	}
+	d.m.Unlock()
+	if msg != "" {
+		name := ""
+		if c != nil {
+			name = c.name
+		}
+		desc := fmt.Sprintf("debug validation, coll: %v, %s, item: {key: %q,"+
+			" priority: %v}, ref-count: %v", name, msg, i.Key, i.Priority, count)
+		o.logf("%s", desc)
+		panic(desc)
+	}
+}
+
+// Validates the new tree of a mutation before it becomes the root.
+func (t *Collection) debugValidate(root *nodeLoc, key []byte) {
+	if t.store.debugLevel >= 2 {
+		t.debugValidateTree(root, nil, nil, nil, nil)
+	} else {
+		t.debugValidatePath(root, key)
+	}
+}
+
+func (t *Collection) debugValidatePath(n *nodeLoc, key []byte) {
+	var path []string
+	for !n.isEmpty() {
+		nNode, nItem := t.debugRead(n, path)
+		path = append(path, debugNodeString(nNode, nItem))
+		leftNum, leftBytes, rightNum, rightBytes, err :=
+			numInfo(t.store, &nNode.left, &nNode.right)
+		if err != nil {
+			t.debugFail(path, fmt.Sprintf("numInfo error: %v", err))
+		}
+		t.debugCheckAggregates(path, nNode, leftNum+rightNum+1,
+			leftBytes+rightBytes+uint64(nNode.item.NumBytes(t)))
+		c := t.compare(key, nItem.Key)
+		if c < 0 {
+			n = &nNode.left
+		} else if c > 0 {
+			n = &nNode.right
+		} else {
+			return
+		}
+	}
+}
+
+// Returns the re-derived numNodes and numBytes of the subtree, whose
+// keys must be within (lo, hi) and priorities at most maxPriority.
+func (t *Collection) debugValidateTree(n *nodeLoc, lo, hi []byte,
+	maxPriority *int32, path []string) (numNodes, numBytes uint64) {
+	if n.isEmpty() {
+		return 0, 0
+	}
+	nNode, nItem := t.debugRead(n, path)
+	path = append(path, debugNodeString(nNode, nItem))
+	if (lo != nil && t.compare(lo, nItem.Key) >= 0) ||
+		(hi != nil && t.compare(nItem.Key, hi) >= 0) {
+		t.debugFail(path, "key out of order")
+	}
+	if maxPriority != nil && nItem.Priority > *maxPriority {
+		t.debugFail(path, fmt.Sprintf("priority above parent's: %v",
+			*maxPriority))
+	}
+	leftNum, leftBytes :=
+		t.debugValidateTree(&nNode.left, lo, nItem.Key, &nItem.Priority, path)
+	rightNum, rightBytes :=
+		t.debugValidateTree(&nNode.right, nItem.Key, hi, &nItem.Priority, path)
+	numNodes = leftNum + rightNum + 1
+	numBytes = leftBytes + rightBytes + uint64(nNode.item.NumBytes(t))
+	t.debugCheckAggregates(path, nNode, numNodes, numBytes)
+	return numNodes, numBytes
+}
+
+func (t *Collection) debugRead(n *nodeLoc, path []string) (*node, *Item) {
+	nNode, err := n.read(t.store)
+	if err != nil || nNode == nil {
+		t.debugFail(path, fmt.Sprintf("node read, err: %v", err))
+	}
+	nItem, err := nNode.item.read(t, false)
+	if err != nil || nItem == nil {
+		t.debugFail(path, fmt.Sprintf("item read, err: %v", err))
+	}
+	return nNode, nItem
+}
+
+func (t *Collection) debugCheckAggregates(path []string, nNode *node,
+	numNodes, numBytes uint64) {
+	if nNode.numNodes != numNodes || nNode.numBytes != numBytes {
+		t.debugFail(path, fmt.Sprintf("aggregates mismatch,"+
+			" expected numNodes: %v, numBytes: %v", numNodes, numBytes))
+	}
+}
+
+func (t *Collection) debugFail(path []string, msg string) {
+	desc := fmt.Sprintf("debug validation, coll: %v, %s, path: %s",
+		t.name, msg, strings.Join(path, " -> "))
+	t.store.logf("%s", desc)
+	panic(desc)
+}
+
+func debugNodeString(nNode *node, nItem *Item) string {
+	return fmt.Sprintf("{key: %q, priority: %v, numNodes: %v, numBytes: %v}",
+		nItem.Key, nItem.Priority, nNode.numNodes, nNode.numBytes)
+}
@@ -0,0 +1,68 @@
+package gkvlite
+
+import "errors"
+
+// Limits the depth of the trees of the Store's collections, where the
+// root node is at depth 0, as the treap operations and the visits
+// recurse once per level, so their goroutine stack grows with the
+// depth, which is logarithmic in the number of items for random
+// priorities, but may be linear for the priorities of untrusted
+// SetItem()'s, and unbounded for a corrupted file, whose nodes may
+// even form a cycle.  A SetItem() or Delete() whose key's path is
+// deeper than maxDepth fails with a *LimitError of ErrTreeTooDeep
+// before anything is changed, and so does a visit, such as by
+// VisitItemsAscend(), Page() or CopyTo(), when it reaches a node deeper
+// than maxDepth, after having visited the items before it.  The bulk
+// mutations, such as the batches of StartWriter(), DeleteMulti() and
+// ImportCSV(), aren't checked, nor are Flush() and Rebalance(), which
+// rebuilds a deep tree with random priorities.  A maxDepth of 0 (the
+// default) means no limit, and costs nothing, while a limit costs a
+// walk of the key's path per mutation.  This should be called before
+// the Store is used concurrently.
+func (s *Store) SetMaxTreeDepth(maxDepth int) error {
+	if maxDepth < 0 {
+		return errors.New("max tree depth must be non-negative")
+	}
+	s.maxDepth = maxDepth
+	return nil
+}
+
+// Returns a *LimitError of ErrTreeTooDeep if the depth is beyond the
+// limit of SetMaxTreeDepth().
+func (o *Store) checkDepth(depth uint64) error {
+	if o.maxDepth <= 0 || depth <= uint64(o.maxDepth) {
+		return nil
+	}
+	return &LimitError{Err: ErrTreeTooDeep, Limit: uint64(o.maxDepth), Size: depth}
+}
+
+// Checks the depth of the path of the key from the root, down to the
+// node of the key, or to where it would be inserted, as union(),
+// split() and join() recurse along it.
+func (t *Collection) checkPathDepth(root *nodeLoc, key []byte) error {
+	if t.store.maxDepth <= 0 {
+		return nil
+	}
+	n := root
+	for depth := uint64(0); ; depth++ {
+		if err := t.store.checkDepth(depth); err != nil {
+			return err
+		}
+		nNode, err := n.read(t.store)
+		if err != nil || n.isEmpty() || nNode == nil {
+			return err
+		}
+		nItem, err := nNode.item.read(t, false)
+		if err != nil {
+			return err
+		}
+		c := t.compare(key, nItem.Key)
+		if c < 0 {
+			n = &nNode.left
+		} else if c > 0 {
+			n = &nNode.right
+		} else {
+			return nil
+		}
+	}
+}
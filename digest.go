@@ -0,0 +1,250 @@
+package gkvlite
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"sort"
+)
+
+// A range of keys, from the StartKey (inclusive) to the EndKey
+// (exclusive), where a nil StartKey or EndKey leaves the range
+// unbounded on that side.
+type KeyRange struct {
+	StartKey, EndKey []byte
+}
+
+// Returns a SHA-256 fingerprint of the collection's items, hashed in
+// ascending key order with the length-prefixed key and value and the
+// priority of each item, so that collections with the same items have
+// the same fingerprint regardless of their tree shapes or files, such
+// as to compare replicas.  The items are streamed through the hash by
+// a visit, which reads every value.
+func (t *Collection) Fingerprint() ([]byte, error) {
+	return t.SubtreeDigest(nil, nil)
+}
+
+// Returns the SHA-256 digest of the items with keys in the range from
+// startKey (inclusive) to endKey (exclusive), hashed like for
+// Fingerprint(), where a nil startKey or endKey leaves the range
+// unbounded on that side.  As the tree shapes of replicas with the same
+// items differ, the digest is a re-hash of the items of the range
+// rather than a digest of nodes, so it reads every item of the range.
+// See DiffRanges() for how digests of ranges locate the differences.
+func (t *Collection) SubtreeDigest(startKey, endKey []byte) ([]byte, error) {
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return nil, err
+	}
+	defer t.openRootDecRef(rnl)
+	digest, _, err := t.digestRange(rnl.root, startKey, endKey)
+	return digest, err
+}
+
+func (t *Collection) digestRange(root *nodeLoc, startKey, endKey []byte) (
+	digest []byte, numItems uint64, err error) {
+	h := sha256.New()
+	err = t.visitRange(root, startKey, endKey, true, func(i *Item) bool {
+		digestItem(h, i)
+		numItems++
+		return true
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return h.Sum(nil), numItems, nil
+}
+
+func digestItem(h hash.Hash, i *Item) {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(i.Key)))
+	h.Write(hdr[:])
+	h.Write(i.Key)
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(i.Val)))
+	h.Write(hdr[:])
+	h.Write(i.Val)
+	binary.BigEndian.PutUint32(hdr[:], uint32(i.Priority))
+	h.Write(hdr[:])
+}
+
+// Returns a copy of the key of the n'th (from 0) item in the range.
+func (t *Collection) nthKey(root *nodeLoc, startKey, endKey []byte,
+	n uint64) (key []byte, err error) {
+	err = t.visitRange(root, startKey, endKey, false, func(i *Item) bool {
+		if n > 0 {
+			n--
+			return true
+		}
+		key = append([]byte{}, i.Key...)
+		return false
+	})
+	return key, err
+}
+
+// Returns the key ranges, in ascending order, where the items of the
+// collections a and b differ, each with at most maxItems items in a
+// and in b, by comparing range digests from the whole key space down,
+// as two replicas would over the network: when the SubtreeDigest() of
+// a range differs, and a or b has more than maxItems items in it, the
+// range is split at the median key of the side with more items in the
+// range into [startKey, median) and [median, endKey), and both halves
+// are compared in turn, so that the ranges of equal items are skipped
+// with a single digest each.  Syncing just the returned ranges makes
+// the collections equal.  Each level of the recursion re-hashes the
+// differing ranges, so the cost is O(n log(n)) item reads in the worst
+// case.  Both collections must use the same KeyCompare.
+func DiffRanges(a, b *Collection, maxItems int) ([]KeyRange, error) {
+	if maxItems <= 0 {
+		return nil, errors.New("maxItems must be positive")
+	}
+	rnlA, err := a.openRootAddRef()
+	if err != nil {
+		return nil, err
+	}
+	defer a.openRootDecRef(rnlA)
+	rnlB, err := b.openRootAddRef()
+	if err != nil {
+		return nil, err
+	}
+	defer b.openRootDecRef(rnlB)
+	var res []KeyRange
+	var diff func(startKey, endKey []byte) error
+	diff = func(startKey, endKey []byte) error {
+		digestA, numA, err := a.digestRange(rnlA.root, startKey, endKey)
+		if err != nil {
+			return err
+		}
+		digestB, numB, err := b.digestRange(rnlB.root, startKey, endKey)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(digestA, digestB) {
+			return nil
+		}
+		if numA <= uint64(maxItems) && numB <= uint64(maxItems) {
+			res = append(res, KeyRange{startKey, endKey})
+			return nil
+		}
+		c, root, n := a, rnlA.root, numA
+		if numB > numA {
+			c, root, n = b, rnlB.root, numB
+		}
+		median, err := c.nthKey(root, startKey, endKey, n/2)
+		if err != nil {
+			return err
+		}
+		if err = diff(startKey, median); err != nil {
+			return err
+		}
+		return diff(median, endKey)
+	}
+	if err := diff(nil, nil); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Returns whether the Store and other have the same collections with
+// the same items, by key, value and priority, and otherwise a
+// description of the first difference, such as of the first collection
+// that only one Store has, or of the first key, in the collections in
+// name order and the keys in ascending order, whose item differs.  The
+// Stores are compared as of a Snapshot() of each, so they may be live,
+// and the collections of the same name are streamed side by side, so
+// they must use the same KeyCompare.  The collections of secondary
+// indexes and the metadata aren't compared.
+func (s *Store) Equal(other *Store) (equal bool, diff string, err error) {
+	if s.isClosed() || other.isClosed() {
+		return false, "", ErrStoreClosed
+	}
+	a, b := s.Snapshot(), other.Snapshot()
+	defer a.Close()
+	defer b.Close()
+	names := a.GetCollectionNames()
+	for _, name := range b.GetCollectionNames() {
+		if a.GetCollection(name) == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ca, cb := a.GetCollection(name), b.GetCollection(name)
+		if ca == nil {
+			return false, fmt.Sprintf("collection %s: missing in store", name), nil
+		}
+		if cb == nil {
+			return false, fmt.Sprintf("collection %s: missing in other", name), nil
+		}
+		if diff, err = diffItems(ca, cb); err != nil || diff != "" {
+			return false, fmt.Sprintf("collection %s, %s", name, diff), err
+		}
+	}
+	return true, "", nil
+}
+
+// Returns the first difference of the items of a and b, or "".
+func diffItems(a, b *Collection) (string, error) {
+	minA, err := a.MinItem(false)
+	if err != nil {
+		return "", err
+	}
+	minB, err := b.MinItem(false)
+	if err != nil {
+		return "", err
+	}
+	if minA == nil || minB == nil {
+		if minA != nil {
+			defer a.store.ItemDecRef(a, minA)
+			return fmt.Sprintf("key: %q: missing in other", minA.Key), nil
+		}
+		if minB != nil {
+			defer b.store.ItemDecRef(b, minB)
+			return fmt.Sprintf("key: %q: missing in store", minB.Key), nil
+		}
+		return "", nil
+	}
+	defer a.store.ItemDecRef(a, minA)
+	defer b.store.ItemDecRef(b, minB)
+	done := make(chan struct{}) // Closed to stop the visit of b.
+	st := startShardStream(b, minB.Key, true, false, done)
+	defer func() {
+		close(done)
+		st.drain()
+	}()
+	var diff string
+	more := st.next()
+	err = a.VisitItemsAscend(minA.Key, true, func(i *Item) bool {
+		if !more {
+			diff = fmt.Sprintf("key: %q: missing in other", i.Key)
+			return false
+		}
+		c := a.compare(i.Key, st.head.Key)
+		switch {
+		case c < 0:
+			diff = fmt.Sprintf("key: %q: missing in other", i.Key)
+		case c > 0:
+			diff = fmt.Sprintf("key: %q: missing in store", st.head.Key)
+		case !bytes.Equal(i.Val, st.head.Val):
+			diff = fmt.Sprintf("key: %q: value differs, len: %v vs %v",
+				i.Key, len(i.Val), len(st.head.Val))
+		case i.Priority != st.head.Priority:
+			diff = fmt.Sprintf("key: %q: priority differs, %v vs %v",
+				i.Key, i.Priority, st.head.Priority)
+		default:
+			b.store.ItemDecRef(b, st.head)
+			more = st.next()
+			return true
+		}
+		return false
+	})
+	if err != nil || diff != "" {
+		return diff, err
+	}
+	if more {
+		return fmt.Sprintf("key: %q: missing in store", st.head.Key), nil
+	}
+	return "", st.err
+}
@@ -0,0 +1,97 @@
+package gkvlite
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The errors of the public API wrap the following sentinels, and
+// ErrStoreClosed, ErrNilKey, ErrKeyTooLarge and ErrValTooLarge, with
+// %w or an error type that unwraps to them, so callers can tell the
+// failure modes apart with errors.Is() and errors.As().
+
+// Returned by mutations and other writes of a read-only Store, such as
+// a snapshot.
+var ErrReadOnly = errors.New("store is read only")
+
+// Returned for a named collection that doesn't exist, and by the
+// operations of a Collection that was removed, or replaced by a later
+// SetCollection() of its name.
+var ErrCollectionMissing = errors.New("collection is missing")
+
+// Returned by the operations that need an existing key, when it's not
+// in the collection.  Lookups like Get() report a missing key with a
+// nil result instead.
+var ErrKeyMissing = errors.New("key is missing")
+
+// Returned by RenameCollection() onto the name of an existing collection.
+var ErrCollectionExists = errors.New("collection already exists")
+
+// Returned by Insert() for a key that's already in the collection.
+var ErrKeyExists = errors.New("key exists")
+
+// Returned by Add() when the total would overflow an int64.
+var ErrAddOverflow = errors.New("add overflows int64")
+
+// Returned for a KeyCompare name that's not registered, such as when
+// opening a store file with a collection of that name, see
+// RegisterKeyCompare().
+var ErrUnknownComparator = errors.New("key compare is not registered")
+
+// Returned, wrapped in a *LimitError, for a tree that's deeper than the
+// limit of SetMaxTreeDepth().
+var ErrTreeTooDeep = errors.New("tree too deep")
+
+// Returned when opening a store file whose format version, see
+// FormatVersion(), is newer than VERSION, or older than any that
+// gkvlite reads.
+var ErrUnsupportedVersion = errors.New("unsupported store file version")
+
+// Matched by errors.Is() for a *CorruptError.
+var ErrCorrupt = errors.New("store file is corrupt")
+
+// A CorruptError is returned when a record of the store file can't be
+// read or doesn't decode, where Offset is the file offset of the
+// record, Length, if known, is its expected length, and Err, if any,
+// is the underlying error, such as of the StoreFile's ReadAt(), which
+// is io.EOF or io.ErrUnexpectedEOF for a record that's cut off by the
+// end of the file.  It matches ErrCorrupt with errors.Is().
+type CorruptError struct {
+	Offset int64
+	Length uint32
+	Detail string
+	Err    error
+}
+
+func (e *CorruptError) Error() string {
+	where := fmt.Sprintf("offset: %v", e.Offset)
+	if e.Length > 0 {
+		where += fmt.Sprintf(", length: %v", e.Length)
+	}
+	if e.Err == nil {
+		return fmt.Sprintf("%v, %s, %s", ErrCorrupt, where, e.Detail)
+	}
+	return fmt.Sprintf("%v, %s, %s: %v", ErrCorrupt, where, e.Detail, e.Err)
+}
+
+func (e *CorruptError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+func (e *CorruptError) Unwrap() error {
+	return e.Err
+}
+
+// Wraps a failure to read the record at loc into a *CorruptError,
+// unless it's one already or the Store was closed.
+func corruptError(loc *ploc, detail string, err error) error {
+	var ce *CorruptError
+	if err == nil || errors.As(err, &ce) || errors.Is(err, ErrStoreClosed) {
+		return err
+	}
+	e := &CorruptError{Detail: detail, Err: err}
+	if loc != nil {
+		e.Offset, e.Length = loc.Offset, loc.Length
+	}
+	return e
+}
@@ -0,0 +1,391 @@
+package gkvlite
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// The export stream format is independent of the store file format:
+// a header of EXPORT_MAGIC and a uint32 EXPORT_VERSION, followed by
+// items in ascending key order, each as a uint32 key length, a uint32
+// value length, a uint32 priority, then the key and value bytes.  The
+// stream is terminated by a record with a zero key length, which lets
+// Import() detect a truncated stream.  All integers are big-endian.
+const EXPORT_VERSION = uint32(1)
+
+var EXPORT_MAGIC []byte = []byte("0g1x2p")
+
+const export_recHdrLength int = 4 + 4 + 4
+
+// Writes all items of the collection to w in the export stream format.
+func (t *Collection) Export(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.Write(EXPORT_MAGIC)
+	binary.Write(bw, binary.BigEndian, EXPORT_VERSION)
+	hdr := make([]byte, export_recHdrLength)
+	minItem, err := t.MinItem(false)
+	if err != nil {
+		return err
+	}
+	if minItem != nil {
+		defer t.store.ItemDecRef(t, minItem)
+		var errWrite error
+		err = t.VisitItemsAscend(minItem.Key, true, func(i *Item) bool {
+			binary.BigEndian.PutUint32(hdr[0:4], uint32(len(i.Key)))
+			binary.BigEndian.PutUint32(hdr[4:8], uint32(len(i.Val)))
+			binary.BigEndian.PutUint32(hdr[8:12], uint32(i.Priority))
+			if _, errWrite = bw.Write(hdr); errWrite != nil {
+				return false
+			}
+			if _, errWrite = bw.Write(i.Key); errWrite != nil {
+				return false
+			}
+			_, errWrite = bw.Write(i.Val)
+			return errWrite == nil
+		})
+		if err != nil {
+			return err
+		}
+		if errWrite != nil {
+			return errWrite
+		}
+	}
+	for i := range hdr {
+		hdr[i] = 0
+	}
+	bw.Write(hdr)
+	return bw.Flush()
+}
+
+// Reads items from an export stream, as written by Export(), and sets
+// them into the collection, in batches with a root swap per batch,
+// like ReadJSON().  The items of earlier batches are kept even when a
+// later item fails.
+func (t *Collection) Import(r io.Reader) (err error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(EXPORT_MAGIC))
+	if _, err = io.ReadFull(br, magic); err != nil {
+		return err
+	}
+	if string(magic) != string(EXPORT_MAGIC) {
+		return errors.New("not an export stream, bad magic")
+	}
+	var version uint32
+	if err = binary.Read(br, binary.BigEndian, &version); err != nil {
+		return err
+	}
+	if version != EXPORT_VERSION {
+		return fmt.Errorf("export version mismatch: "+
+			"current version: %v != found version: %v", EXPORT_VERSION, version)
+	}
+	hdr := make([]byte, export_recHdrLength)
+	var prevKey []byte
+	var batch []*Item
+	batchBytes := 0
+	for {
+		if _, err = io.ReadFull(br, hdr); err != nil {
+			return err
+		}
+		keyLength := binary.BigEndian.Uint32(hdr[0:4])
+		valLength := binary.BigEndian.Uint32(hdr[4:8])
+		priority := int32(binary.BigEndian.Uint32(hdr[8:12]))
+		if keyLength == 0 {
+			if len(batch) > 0 {
+				return t.setItemsBatch(batch)
+			}
+			return nil
+		}
+		if keyLength > MaxKeyLen {
+			return fmt.Errorf("export key length too long: %v", keyLength)
+		}
+		i := &Item{
+			Key:      make([]byte, keyLength),
+			Val:      make([]byte, valLength),
+			Priority: priority,
+		}
+		if _, err = io.ReadFull(br, i.Key); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(br, i.Val); err != nil {
+			return err
+		}
+		if prevKey != nil && t.compare(prevKey, i.Key) >= 0 {
+			return fmt.Errorf("export stream out of order, key: %q", i.Key)
+		}
+		if err = t.checkItem(i); err != nil {
+			return fmt.Errorf("export item, key: %q: %w", i.Key, err)
+		}
+		batch = append(batch, i)
+		batchBytes += len(i.Key) + len(i.Val)
+		if len(batch) >= jsonReadBatchItems || batchBytes >= jsonReadBatchBytes {
+			if err = t.setItemsBatch(batch); err != nil {
+				return err
+			}
+			batch, batchBytes = nil, 0
+		}
+		prevKey = i.Key
+	}
+}
+
+type jsonlRecord struct {
+	Key []byte      `json:"key"`
+	Val interface{} `json:"val"`
+}
+
+type jsonlRecordIn struct {
+	Key []byte          `json:"key"`
+	Val json.RawMessage `json:"val"`
+}
+
+// Writes all items of the collection to w as JSON Lines, one
+// {"key":...,"val":...} object per line in ascending key order.  Keys
+// are base64 encoded.  The optional encodeVal func controls how value
+// bytes are represented, such as by returning a json.RawMessage for
+// values that are JSON documents; the default is base64.  Items are
+// streamed rather than buffered.
+func (t *Collection) ExportJSONL(w io.Writer,
+	encodeVal func([]byte) interface{}) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	minItem, err := t.MinItem(false)
+	if err != nil || minItem == nil {
+		return err
+	}
+	defer t.store.ItemDecRef(t, minItem)
+	var errEncode error
+	err = t.VisitItemsAscend(minItem.Key, true, func(i *Item) bool {
+		rec := jsonlRecord{Key: i.Key, Val: i.Val}
+		if encodeVal != nil {
+			rec.Val = encodeVal(i.Val)
+		}
+		errEncode = enc.Encode(&rec)
+		return errEncode == nil
+	})
+	if err != nil {
+		return err
+	}
+	if errEncode != nil {
+		return errEncode
+	}
+	return bw.Flush()
+}
+
+// Reads JSON Lines, as written by ExportJSONL(), and sets each item
+// into the collection.  The optional decodeVal func is the inverse of
+// the encodeVal func used during export; the default expects base64.
+func (t *Collection) ImportJSONL(r io.Reader,
+	decodeVal func(json.RawMessage) ([]byte, error)) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for line := 1; ; line++ {
+		var rec jsonlRecordIn
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("jsonl line %v: %v", line, err)
+		}
+		var val []byte
+		var err error
+		if decodeVal != nil {
+			val, err = decodeVal(rec.Val)
+		} else {
+			err = json.Unmarshal(rec.Val, &val)
+		}
+		if err != nil {
+			return fmt.Errorf("jsonl line %v, key: %q: %v", line, rec.Key, err)
+		}
+		if val == nil {
+			val = []byte{}
+		}
+		if err = t.Set(rec.Key, val); err != nil {
+			return err
+		}
+	}
+}
+
+// Options of WriteJSONEx().
+type JSONOptions struct {
+	// Whether the values are written, or only the keys and priorities.
+	WithValue bool
+
+	// Whether a key that's valid UTF-8 is written as a "keyStr" string,
+	// instead of a base64 "key", for readability.
+	KeyStrings bool
+
+	// Whether a value that's valid UTF-8 is written as a "valStr"
+	// string, instead of a base64 "val".
+	ValStrings bool
+}
+
+// An item of the JSON array of WriteJSON(), where either Key or KeyStr,
+// and either Val or ValStr, if any, are present.
+type jsonItem struct {
+	Key      []byte  `json:"key,omitempty"`
+	KeyStr   *string `json:"keyStr,omitempty"`
+	Val      *[]byte `json:"val,omitempty"`
+	ValStr   *string `json:"valStr,omitempty"`
+	Priority int32   `json:"priority"`
+}
+
+// Writes all items of the collection to w as a JSON array of
+// {"key":...,"val":...,"priority":...} objects, one per line in
+// ascending key order, where keys and values are base64 encoded.  The
+// items are streamed rather than buffered.
+func (t *Collection) WriteJSON(w io.Writer, withValue bool) error {
+	return t.WriteJSONEx(w, JSONOptions{WithValue: withValue})
+}
+
+// Like WriteJSON(), with options.
+func (t *Collection) WriteJSONEx(w io.Writer, opts JSONOptions) error {
+	bw := bufio.NewWriter(w)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	minItem, err := t.MinItem(false)
+	if err != nil {
+		return err
+	}
+	bw.WriteString("[")
+	if minItem != nil {
+		defer t.store.ItemDecRef(t, minItem)
+		sep := "\n"
+		var errEncode error
+		err = t.VisitItemsAscend(minItem.Key, opts.WithValue, func(i *Item) bool {
+			rec := jsonItem{Priority: i.Priority}
+			if opts.KeyStrings && utf8.Valid(i.Key) {
+				s := string(i.Key)
+				rec.KeyStr = &s
+			} else {
+				rec.Key = i.Key
+			}
+			if opts.WithValue && opts.ValStrings && utf8.Valid(i.Val) {
+				s := string(i.Val)
+				rec.ValStr = &s
+			} else if opts.WithValue {
+				rec.Val = &i.Val
+			}
+			buf.Reset()
+			if errEncode = enc.Encode(&rec); errEncode != nil {
+				return false
+			}
+			bw.WriteString(sep)
+			bw.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+			sep = ",\n"
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if errEncode != nil {
+			return errEncode
+		}
+		bw.WriteString("\n")
+	}
+	bw.WriteString("]\n")
+	return bw.Flush()
+}
+
+// The most items, and about the most bytes, that ReadJSON() and
+// Import() set with a single root swap.
+const (
+	jsonReadBatchItems = 1000
+	jsonReadBatchBytes = 4 * 1024 * 1024
+)
+
+// Reads a JSON array of items, as written by WriteJSON() or
+// WriteJSONEx(), and sets the items into the collection, in batches
+// with a root swap per batch, like the batches of StartWriter().  An
+// item without a value, as written without WithValue, gets an empty
+// value.  Returns the number of items that were set, which are kept
+// even when a later item fails.
+func (t *Collection) ReadJSON(r io.Reader) (numLoaded uint64, err error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	if tok, err := dec.Token(); err != nil {
+		return 0, fmt.Errorf("json items: %v", err)
+	} else if tok != json.Delim('[') {
+		return 0, fmt.Errorf("json items must be an array, found: %v", tok)
+	}
+	var batch []*Item
+	batchBytes := 0
+	flush := func() error {
+		err := t.setItemsBatch(batch)
+		if err == nil {
+			numLoaded += uint64(len(batch))
+		}
+		batch, batchBytes = nil, 0
+		return err
+	}
+	for n := 0; dec.More(); n++ {
+		var rec jsonItem
+		if err = dec.Decode(&rec); err != nil {
+			return numLoaded, fmt.Errorf("json item %v: %v", n, err)
+		}
+		i := &Item{Key: rec.Key, Val: []byte{}, Priority: rec.Priority}
+		if rec.KeyStr != nil {
+			i.Key = []byte(*rec.KeyStr)
+		}
+		if rec.ValStr != nil {
+			i.Val = []byte(*rec.ValStr)
+		} else if rec.Val != nil && *rec.Val != nil {
+			i.Val = *rec.Val
+		}
+		if err = t.checkItem(i); err != nil {
+			return numLoaded, fmt.Errorf("json item %v, key: %q: %w", n, i.Key, err)
+		}
+		batch = append(batch, i)
+		batchBytes += len(i.Key) + len(i.Val)
+		if len(batch) >= jsonReadBatchItems || batchBytes >= jsonReadBatchBytes {
+			if err = flush(); err != nil {
+				return numLoaded, err
+			}
+		}
+	}
+	if _, err = dec.Token(); err != nil {
+		return numLoaded, fmt.Errorf("json items: %v", err)
+	}
+	if len(batch) > 0 {
+		err = flush()
+	}
+	return numLoaded, err
+}
+
+// Sets the checked items with a single root swap, and then notifies
+// them in their order.  The items of an indexed collection, or of one
+// that keeps versions, are set one by one instead, so that its indexes
+// and versions are maintained.
+func (t *Collection) setItemsBatch(items []*Item) error {
+	notify := t.mutationLock()
+	if t.indexes() != nil || t.KeepVersions() > 0 {
+		t.mutationUnlock(notify)
+		for _, item := range items {
+			if err := t.setItem(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	defer t.mutationUnlock(notify)
+	if err := t.writableErr(); err != nil {
+		return err
+	}
+	run := make([]*writeOp, len(items))
+	for i, item := range items {
+		run[i] = &writeOp{item: item}
+	}
+	if err := t.setItems(run); err != nil {
+		return err
+	}
+	keys := make([][]byte, len(items))
+	for i, item := range items {
+		t.notifyMutation(MutationSet, item.Key, item.persistedVal(), item.Priority)
+		keys[i] = item.Key
+	}
+	t.publishRange(t.subscriptions(), keys)
+	return nil
+}
@@ -0,0 +1,94 @@
+package gkvlite
+
+import (
+	"io"
+)
+
+// Some StoreFiles, such as network-backed ones, or an os.File whose
+// read or write is interrupted by a signal, transfer fewer bytes than
+// asked for without an error, so all the record I/O goes through
+// readFull() and writeFull(), which loop until all the bytes are
+// transferred or a real error occurs.
+
+// The most consecutive ReadAt() or WriteAt() calls that transfer no
+// bytes without an error, before readFull() or writeFull() give up,
+// like the limit of bufio on empty reads.
+const maxEmptyTransfers = 100
+
+// Reads len(b) bytes at the offset of r.  A read that reaches the end
+// of r returns io.EOF, or io.ErrUnexpectedEOF if some bytes were read.
+func readFull(r io.ReaderAt, b []byte, offset int64) (n int, err error) {
+	for empty := 0; n < len(b); {
+		m, err := r.ReadAt(b[n:], offset+int64(n))
+		n += m
+		if n >= len(b) {
+			return len(b), nil // Even with an io.EOF at the end.
+		}
+		if err != nil {
+			if err == io.EOF && n > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		if m > 0 {
+			empty = 0
+		} else if empty++; empty >= maxEmptyTransfers {
+			return n, io.ErrNoProgress
+		}
+	}
+	return n, nil
+}
+
+// Writes b at the offset of w.
+func writeFull(w io.WriterAt, b []byte, offset int64) (n int, err error) {
+	for empty := 0; n < len(b); {
+		m, err := w.WriteAt(b[n:], offset+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m > 0 {
+			empty = 0
+		} else if empty++; empty >= maxEmptyTransfers {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
+// An io.ReaderAt whose reads are full, see readFull().
+type fullReaderAt struct {
+	r io.ReaderAt
+}
+
+func (f fullReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return readFull(f.r, p, off)
+}
+
+// Writes b to the file, looping over short writes, see writeFull().
+// During a Flush(), the write may be buffered, see
+// SetFlushBufferSize().
+func (s *Store) writeAt(b []byte, offset int64) error {
+	if fb := s.flushBuf; fb != nil {
+		if fb.active {
+			return s.writeBuffered(b, offset)
+		}
+		if err := s.flushBufferWrite(); err != nil {
+			return err
+		}
+	}
+	return s.writeAtFile(b, offset)
+}
+
+func (s *Store) writeAtFile(b []byte, offset int64) error {
+	if offset < 0 || offset > MaxFileSize-int64(len(b)) {
+		return &LimitError{Err: ErrFileTooLarge,
+			Limit: MaxFileSize, Size: uint64(offset) + uint64(len(b))}
+	}
+	n, err := writeFull(s.file, b, offset)
+	if err == io.ErrShortWrite {
+		s.logf("short WriteAt, offset: %v, wrote: %v, wanted: %v",
+			offset, n, len(b))
+	}
+	return err
+}
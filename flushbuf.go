@@ -0,0 +1,180 @@
+package gkvlite
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// A flushBuffer coalesces the contiguous record writes of a Flush()
+// into larger WriteAt() calls, see SetFlushBufferSize().  It's only
+// used by the writer that holds the Store's writeLock.
+type flushBuffer struct {
+	active bool // Whether a Flush() is writing records.
+	size   int  // The most bytes that buf grows to.
+	buf    []byte
+	offset int64 // The file offset of buf[0].
+}
+
+// The size of the flush buffer of a new Store, see SetFlushBufferSize().
+const DefaultFlushBufferSize = 4 << 20
+
+// An optional interface of a StoreFile, which os.File implements, see
+// SetFlushSync().
+type syncer interface {
+	Sync() error
+}
+
+// Sets the size of the buffer that a Flush() writes its item and node
+// records through, so that contiguous records are written with fewer,
+// larger WriteAt() calls, which helps with slow or remote StoreFiles.
+// Records that aren't contiguous, such as when free space is reused,
+// and records that are larger than the buffer are written as before.
+// The buffer is written before the roots record, so the roots record
+// is still written last.  The buffer grows as needed up to the size,
+// which defaults to DefaultFlushBufferSize, so a Flush() of a few
+// records doesn't allocate all of it, and a size of 0 disables the
+// buffer.  Items whose records are still buffered are not evicted by
+// EvictSomeItems(), so that readers never read unwritten records.
+func (s *Store) SetFlushBufferSize(n int) error {
+	if n < 0 {
+		return errors.New("flush buffer size must be non-negative")
+	}
+	s.writeLock.Lock()
+	s.flushBufSize = n
+	s.writeLock.Unlock()
+	return nil
+}
+
+// Chooses whether Flush() syncs the StoreFile, when it has a Sync()
+// method like os.File, after writing the records and before writing the
+// roots record, so that a roots record never reaches the disk before
+// the records it references.  The default is to not sync.
+func (s *Store) SetFlushSync(sync bool) {
+	s.writeLock.Lock()
+	s.flushSync = sync
+	s.writeLock.Unlock()
+}
+
+// Starts buffering the record writes of a Flush().  Invoked while the
+// writeLock is held.
+func (s *Store) flushBufferBeg() {
+	if s.flushBufSize <= 0 {
+		return
+	}
+	if s.flushBuf == nil {
+		s.flushBuf = &flushBuffer{}
+	}
+	if s.flushBuf.size != s.flushBufSize {
+		if err := s.flushBufferWrite(); err != nil {
+			return // Left for the next write.
+		}
+		s.flushBuf.size = s.flushBufSize
+		if cap(s.flushBuf.buf) > s.flushBufSize {
+			s.flushBuf.buf = nil
+		}
+	}
+	s.flushBuf.active = true
+}
+
+// Writes any buffered records, and syncs the file if so configured,
+// before the roots record is written.  Invoked while the writeLock is
+// held.  A buffer that failed to be written is discarded by the
+// rollback of the failed Flush(), see flushRollback().
+func (s *Store) flushBufferEnd() error {
+	s.flushBufferStop()
+	if err := s.flushBufferWrite(); err != nil {
+		return err
+	}
+	if s.flushBufSize <= 0 {
+		s.flushBuf = nil
+	}
+	if f, ok := s.file.(syncer); ok && s.flushSync {
+		return f.Sync()
+	}
+	return nil
+}
+
+// Stops buffering, leaving any buffered records for the next write.
+func (s *Store) flushBufferStop() {
+	if s.flushBuf != nil {
+		s.flushBuf.active = false
+	}
+}
+
+// Writes b at the offset via the flush buffer.
+func (s *Store) writeBuffered(b []byte, offset int64) error {
+	fb := s.flushBuf
+	if n := len(fb.buf); n > 0 {
+		// An aligned record is contiguous after its zero padding.
+		pad := offset - fb.offset - int64(n)
+		if (pad == 0 || (pad > 0 && pad < s.alignment)) &&
+			n+int(pad)+len(b) <= fb.size {
+			fb.buf = append(fb.buf, make([]byte, pad)...)
+			fb.buf = append(fb.buf, b...)
+			return nil
+		}
+	}
+	if err := s.flushBufferWrite(); err != nil {
+		return err
+	}
+	if len(b) >= fb.size {
+		return s.writeAtFile(b, offset)
+	}
+	fb.offset = offset
+	atomic.StoreInt64(&s.bufferedFrom, offset+1)
+	fb.buf = append(fb.buf, b...)
+	return nil
+}
+
+func (s *Store) flushBufferWrite() error {
+	fb := s.flushBuf
+	if fb == nil || len(fb.buf) == 0 {
+		return nil
+	}
+	if err := s.writeAtFile(fb.buf, fb.offset); err != nil {
+		return err
+	}
+	fb.buf = fb.buf[:0]
+	atomic.StoreInt64(&s.bufferedFrom, 0)
+	if s.metrics != nil {
+		s.metrics.Counter("flushBufferWrites", 1)
+	}
+	return nil
+}
+
+// Returns whether the record at loc may not be written to the file yet.
+func (s *Store) isBuffered(loc *ploc) bool {
+	from := atomic.LoadInt64(&s.bufferedFrom)
+	return from > 0 && loc.Offset >= from-1
+}
+
+// Returns the io.WriterAt for the values of item records.
+func (s *Store) recordWriter() io.WriterAt {
+	if s.flushBuf == nil || !s.flushBuf.active {
+		return fileWriterAt{s}
+	}
+	return bufferedWriterAt{s}
+}
+
+type fileWriterAt struct {
+	s *Store
+}
+
+func (w fileWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if err := w.s.writeAtFile(p, off); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type bufferedWriterAt struct {
+	s *Store
+}
+
+func (w bufferedWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if err := w.s.writeAt(p, off); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
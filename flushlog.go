@@ -0,0 +1,117 @@
+package gkvlite
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// A flushLog records the item, node and bloom filter records that a
+// Flush() writes, whose locations are only valid once its roots record
+// is written.  When the Flush() fails before that, the locations are
+// rolled back, so that the items and nodes are unpersisted again and
+// the next Flush() writes them again, over the file space of the
+// failed Flush().  Until then, the logged items are not evicted by
+// EvictSomeItems(), as they could not be read back after a rollback.
+type flushLog struct {
+	m      sync.Mutex // Protects items, which evictors check.
+	items  map[*itemLoc]struct{}
+	nodes  []*nodeLoc
+	blooms []*bloomFilter
+
+	sizeBeg int64 // The Store's size when the Flush() began.
+}
+
+// Invoked at the start of a Flush(), while the writeLock is held.
+func (s *Store) flushLogBeg() {
+	fl := &flushLog{
+		items:   map[*itemLoc]struct{}{},
+		sizeBeg: atomic.LoadInt64(&s.size),
+	}
+	atomic.StorePointer(&s.flushing, unsafe.Pointer(fl))
+}
+
+// Invoked once the roots record of a Flush() is written, which makes
+// its record locations valid.
+func (s *Store) flushLogEnd() {
+	atomic.StorePointer(&s.flushing, nil)
+}
+
+func (s *Store) flushLog() *flushLog {
+	return (*flushLog)(atomic.LoadPointer(&s.flushing))
+}
+
+// Invoked before the location of a written item record is set, so that
+// an evictor that sees the location also sees it logged.
+func (s *Store) flushLogItem(i *itemLoc) {
+	if fl := s.flushLog(); fl != nil {
+		fl.m.Lock()
+		fl.items[i] = struct{}{}
+		fl.m.Unlock()
+	}
+}
+
+func (s *Store) flushLogNode(nloc *nodeLoc) {
+	if fl := s.flushLog(); fl != nil {
+		fl.nodes = append(fl.nodes, nloc)
+	}
+}
+
+func (s *Store) flushLogBloom(f *bloomFilter) {
+	if fl := s.flushLog(); fl != nil {
+		fl.blooms = append(fl.blooms, f)
+	}
+}
+
+// Returns whether the item's record was written by the current Flush(),
+// which may still be rolled back.
+func (s *Store) isFlushing(i *itemLoc) bool {
+	fl := s.flushLog()
+	if fl == nil {
+		return false
+	}
+	fl.m.Lock()
+	_, ok := fl.items[i]
+	fl.m.Unlock()
+	return ok
+}
+
+// Rolls back a Flush() that failed before its roots record was written,
+// so that the Store is as it was before the Flush(), while the
+// writeLock and the collections' writeLocks are still held.
+func (s *Store) flushRollback() {
+	fl := s.flushLog()
+	for i := range fl.items {
+		atomic.StorePointer(&i.loc, unsafe.Pointer(nil))
+	}
+	for _, nloc := range fl.nodes {
+		atomic.StorePointer(&nloc.loc, unsafe.Pointer(nil))
+	}
+	for _, f := range fl.blooms {
+		// The previous record of the filter is already pending, so
+		// it's freed after the next Flush().
+		f.loc = nil
+		f.dirty = true
+	}
+	if s.flushBuf != nil {
+		s.flushBuf.buf = s.flushBuf.buf[:0]
+	}
+	atomic.StoreInt64(&s.bufferedFrom, 0)
+	s.freeList.flushFailed()
+	// The failed writes may have reached the file, partially, which the
+	// next Flush() overwrites and truncates away, except when encrypted,
+	// as offsets (and so nonces) must not repeat.
+	size := fl.sizeBeg
+	if s.encrypted {
+		size = atomic.LoadInt64(&s.size)
+	}
+	if finfo, err := s.file.Stat(); err == nil && finfo.Size() > size {
+		if s.encrypted {
+			size = finfo.Size()
+		} else {
+			s.discarded = finfo.Size() - size
+		}
+	}
+	atomic.StoreInt64(&s.size, size)
+	s.flushLogEnd()
+}
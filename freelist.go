@@ -0,0 +1,290 @@
+package gkvlite
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// A freeList tracks dead regions of the store file so that later node
+// and item writes can reuse them instead of appending.  A region goes
+// through three stages: it's pending when it's no longer reachable from
+// any in-memory root, but may still be referenced by the last roots
+// record on disk; it's dying while a Flush() that no longer references
+// it is in progress; and it's free (reusable) once that Flush() has
+// written its roots record.  The free regions (including the dying
+// ones) are persisted in each roots record.
+type freeList struct {
+	m        sync.Mutex
+	reuse    bool   // When false, only the loaded free regions are kept.
+	free     []ploc // Reusable regions.
+	dying    []ploc // Regions that become free after the current Flush().
+	pending  []ploc // Regions that become dying at the next Flush().
+	freeBeg  []ploc // The free regions when the current Flush() began.
+	rootsLoc *ploc  // Location of the last roots record.
+
+	numReused   uint64
+	bytesReused uint64
+	bytesAlloc  uint64
+}
+
+// Enables or disables the reuse of dead file space, which is tracked
+// by a free list that's persisted in the roots record of every Flush().
+// Reuse is disabled by default, as it has tradeoffs: FlushRevert() is
+// not allowed while reuse is enabled, as older roots records reference
+// space that may have been reused; and it cannot be enabled for
+// encrypted stores, as offsets (and so nonces) would repeat, nor for
+// stores with tags (see TagSnapshot()), with a history (see
+// SetHistoryDepth()), with prefix compressed keys (see
+// SetKeyPrefixCompression()) or with kept item versions (see
+// SetKeepVersions()).  Space is
+// only tracked as dead while reuse is enabled, and regions that die
+// before a crash, Close() or RemoveCollection() are not tracked, so
+// CopyTo() is still useful for a full compaction.
+func (s *Store) SetReuseFreeSpace(reuse bool) error {
+	if s.file == nil {
+		return errors.New("no file / in-memory only, so no free space to reuse")
+	}
+	if s.readOnly {
+		return fmt.Errorf("%w, so cannot reuse free space", ErrReadOnly)
+	}
+	if reuse && s.encrypted {
+		return errors.New("cannot reuse free space with encryption")
+	}
+	if reuse && s.autoCompact.enabled() {
+		return errors.New("auto-compaction is enabled, so cannot reuse free space")
+	}
+	if reuse && s.hasTags() {
+		return errors.New("the store has tags, so cannot reuse free space")
+	}
+	if reuse && s.hasHistory() {
+		return errors.New("the store has a history, so cannot reuse free space")
+	}
+	if reuse && s.hasKeyPrefixes() {
+		return errors.New("key prefix compression is used, so cannot reuse free space")
+	}
+	if reuse && s.hasVersions() {
+		return errors.New("item versions are kept, so cannot reuse free space")
+	}
+	s.freeList.m.Lock()
+	s.freeList.reuse = reuse
+	s.freeList.m.Unlock()
+	return nil
+}
+
+func (f *freeList) tracking() bool {
+	if f == nil {
+		return false
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.reuse
+}
+
+// Records dead regions, which become reusable after the next Flush().
+func (f *freeList) addPending(locs []ploc) {
+	if f == nil || len(locs) == 0 {
+		return
+	}
+	f.m.Lock()
+	if f.reuse {
+		f.pending = append(f.pending, locs...)
+	}
+	f.m.Unlock()
+}
+
+// Returns the offset for a new record of the given length, reusing
+// free space when possible, and whether the record is appended.
+func (o *Store) allocRecord(length int) (offset int64, appended bool) {
+	f := o.freeList
+	if f != nil {
+		f.m.Lock()
+		defer f.m.Unlock()
+		f.bytesAlloc += uint64(length)
+		if f.reuse {
+			for i := range f.free {
+				p := &f.free[i]
+				if p.Length >= uint32(length) && o.alignUp(p.Offset) == p.Offset {
+					// The rest of the region stays aligned.
+					used := uint32(o.alignUp(int64(length)))
+					if used > p.Length {
+						used = p.Length
+					}
+					offset = p.Offset
+					p.Offset += int64(used)
+					p.Length -= used
+					if p.Length == 0 {
+						f.free = append(f.free[:i], f.free[i+1:]...)
+					}
+					f.numReused++
+					f.bytesReused += uint64(length)
+					atomic.AddUint64(&o.rewrites, 1)
+					return offset, false
+				}
+			}
+		}
+	}
+	return o.appendOffset(), true
+}
+
+// Invoked at the start of a Flush(), so that the pending regions are
+// not referenced by the roots to be written.
+func (f *freeList) flushBeg() {
+	if f == nil {
+		return
+	}
+	f.m.Lock()
+	f.dying = append(f.dying, f.pending...)
+	f.pending = nil
+	f.freeBeg = append([]ploc(nil), f.free...)
+	f.m.Unlock()
+}
+
+// Returns the start of the free region that directly precedes the
+// last roots record, when the roots record is at the end of the file.
+// A new roots record can be written there instead of being appended,
+// with the file then truncated after it, which bounds file growth.
+func (f *freeList) tail(size int64) (offset int64, ok bool) {
+	if f == nil {
+		return 0, false
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	if !f.reuse || f.rootsLoc == nil ||
+		f.rootsLoc.Offset+int64(f.rootsLoc.Length) != size {
+		return 0, false
+	}
+	for _, p := range f.free {
+		if p.Length > 0 && p.Offset+int64(p.Length) == f.rootsLoc.Offset {
+			return p.Offset, true
+		}
+	}
+	return 0, false
+}
+
+// Returns the regions before the limit offset to persist in the roots
+// record of a Flush().
+func (f *freeList) persisted(limit int64) []ploc {
+	if f == nil {
+		return nil
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	res := make([]ploc, 0, len(f.free)+len(f.dying))
+	for _, p := range f.free {
+		if p.Length > 0 && p.Offset < limit {
+			res = append(res, p)
+		}
+	}
+	for _, p := range f.dying {
+		if p.Offset < limit {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// Invoked after a Flush() wrote its roots record at rootsLoc.  As
+// FlushRevert() isn't allowed with reuse, the old roots record is
+// immediately free.  When truncated, the file ends at the new roots
+// record, so the old roots record is already gone.
+func (f *freeList) flushEnd(rootsLoc *ploc, truncated bool) {
+	if f == nil {
+		return
+	}
+	f.m.Lock()
+	f.free = append(f.free, f.dying...)
+	f.dying = nil
+	f.freeBeg = nil
+	if truncated {
+		f.free = plocsBefore(f.free, rootsLoc.Offset)
+		f.pending = plocsBefore(f.pending, rootsLoc.Offset)
+	} else if f.reuse && f.rootsLoc != nil {
+		f.free = append(f.free, *f.rootsLoc)
+	}
+	f.free = coalesce(f.free)
+	f.rootsLoc = rootsLoc
+	f.m.Unlock()
+}
+
+func plocsBefore(locs []ploc, limit int64) []ploc {
+	res := locs[:0]
+	for _, p := range locs {
+		if p.Offset < limit {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// Sorts the regions by offset and merges adjacent regions.
+func coalesce(locs []ploc) []ploc {
+	sort.Sort(plocsByOffset(locs))
+	res := locs[:0]
+	for _, p := range locs {
+		if p.Length == 0 {
+			continue
+		}
+		if n := len(res); n > 0 &&
+			res[n-1].Offset+int64(res[n-1].Length) == p.Offset {
+			res[n-1].Length += p.Length
+			continue
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
+type plocsByOffset []ploc
+
+func (a plocsByOffset) Len() int           { return len(a) }
+func (a plocsByOffset) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a plocsByOffset) Less(i, j int) bool { return a[i].Offset < a[j].Offset }
+
+// Invoked when a Flush() failed before writing its roots record.  The
+// free regions that its records reused are free again, as the records
+// are rolled back.
+func (f *freeList) flushFailed() {
+	if f == nil {
+		return
+	}
+	f.m.Lock()
+	f.pending = append(f.pending, f.dying...)
+	f.dying = nil
+	f.free = f.freeBeg
+	f.freeBeg = nil
+	f.m.Unlock()
+}
+
+// Resets the free list to the one in a roots record that was read.
+func (f *freeList) load(free []ploc, rootsLoc *ploc) {
+	f.m.Lock()
+	f.free = free
+	f.dying = nil
+	f.pending = nil
+	f.rootsLoc = rootsLoc
+	f.m.Unlock()
+}
+
+func (f *freeList) stats(out map[string]uint64) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	var freeBytes, pendingBytes uint64
+	for _, p := range f.free {
+		freeBytes += uint64(p.Length)
+	}
+	for _, p := range f.dying {
+		pendingBytes += uint64(p.Length)
+	}
+	for _, p := range f.pending {
+		pendingBytes += uint64(p.Length)
+	}
+	out["freeListRegions"] = uint64(len(f.free))
+	out["freeListBytes"] = freeBytes
+	out["freeListPendingBytes"] = pendingBytes
+	out["freeListReuses"] = f.numReused
+	out["freeListReusedBytes"] = f.bytesReused
+	out["freeListAllocBytes"] = f.bytesAlloc
+}
@@ -0,0 +1,372 @@
+package gkvlite
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An in-memory StoreFile, so fuzzing doesn't touch the filesystem.
+type memFile struct {
+	m sync.Mutex
+	b []byte
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if off < 0 || off >= int64(len(f.b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.b)) {
+		f.b = append(f.b, make([]byte, end-int64(len(f.b)))...)
+	}
+	return copy(f.b[off:], p), nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return memFileInfo(len(f.b)), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if size < int64(len(f.b)) {
+		f.b = f.b[:size]
+	}
+	return nil
+}
+
+// A memFile whose ReadAt() and WriteAt() often transfer a random,
+// shorter prefix of the buffer, possibly empty, without an error, like
+// some network-backed StoreFiles do.
+type shortFile struct {
+	memFile
+	rm       sync.Mutex
+	rand     *rand.Rand
+	numShort int
+}
+
+func newShortFile(seed int64) *shortFile {
+	return &shortFile{rand: rand.New(rand.NewSource(seed))}
+}
+
+func (f *shortFile) short(n int) int {
+	f.rm.Lock()
+	defer f.rm.Unlock()
+	if n == 0 || f.rand.Intn(2) == 0 {
+		return n
+	}
+	f.numShort++
+	return f.rand.Intn(n)
+}
+
+func (f *shortFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.memFile.ReadAt(p[:f.short(len(p))], off)
+}
+
+func (f *shortFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.memFile.WriteAt(p[:f.short(len(p))], off)
+}
+
+type memFileInfo int64
+
+func (fi memFileInfo) Name() string       { return "memFile" }
+func (fi memFileInfo) Size() int64        { return int64(fi) }
+func (fi memFileInfo) Mode() os.FileMode  { return 0666 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+// The oracle for a collection: key to value and priority.
+type oracle map[string]oracleItem
+
+type oracleItem struct {
+	val      string
+	priority int32
+}
+
+func (o oracle) clone() oracle {
+	res := oracle{}
+	for k, v := range o {
+		res[k] = v
+	}
+	return res
+}
+
+func (o oracle) keys() []string {
+	res := make([]string, 0, len(o))
+	for k := range o {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+type oracleSnapshot struct {
+	s    *Store
+	coll map[string]oracle
+}
+
+func cloneOracles(coll map[string]oracle) map[string]oracle {
+	res := map[string]oracle{}
+	for name, o := range coll {
+		res[name] = o.clone()
+	}
+	return res
+}
+
+// Checks that a collection has exactly the oracle's items, in order.
+func checkOracle(c *Collection, o oracle) error {
+	if c == nil {
+		if len(o) > 0 {
+			return fmt.Errorf("missing collection, expected %v items", len(o))
+		}
+		return nil
+	}
+	keys := o.keys()
+	var numBytes uint64
+	for _, k := range keys {
+		numBytes += uint64(len(k) + len(o[k].val))
+	}
+	numItems, gotBytes, err := c.GetTotals()
+	if err != nil || numItems != uint64(len(keys)) || gotBytes != numBytes {
+		return fmt.Errorf("expected totals %v, %v, got: %v, %v, %v",
+			len(keys), numBytes, numItems, gotBytes, err)
+	}
+	n := 0
+	var errVisit error
+	err = c.VisitItemsAscend([]byte{0}, true, func(i *Item) bool {
+		if n >= len(keys) {
+			errVisit = fmt.Errorf("unexpected extra item: %q", i.Key)
+			return false
+		}
+		exp := o[keys[n]]
+		if string(i.Key) != keys[n] || string(i.Val) != exp.val ||
+			i.Priority != exp.priority {
+			errVisit = fmt.Errorf("expected item %q = %q (%v), got: %q = %q (%v)",
+				keys[n], exp.val, exp.priority, i.Key, i.Val, i.Priority)
+			return false
+		}
+		n++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if errVisit != nil {
+		return errVisit
+	}
+	if n != len(keys) {
+		return fmt.Errorf("expected %v visited items, got: %v", len(keys), n)
+	}
+	return nil
+}
+
+// Interprets data as a sequence of operations applied to both a Store
+// and the oracle, checking that they agree after every operation.
+// Keys come from a small space and priorities from a narrower one, so
+// that overwrites, deletes of present keys and priority ties are
+// common.  Debug validation checks the tree invariants on mutations.
+func runOracleOps(f StoreFile, data []byte) error {
+	s, err := NewStore(f)
+	if err != nil {
+		return err
+	}
+	s.SetDebugValidation(2)
+	names := []string{"x", "y"}
+	colls := map[string]oracle{}
+	flushed := []map[string]oracle{} // The oracles as of each Flush().
+	var snapshots []oracleSnapshot
+	next := func() byte {
+		if len(data) == 0 {
+			return 0
+		}
+		b := data[0]
+		data = data[1:]
+		return b
+	}
+	coll := func(name string) *Collection {
+		if c := s.GetCollection(name); c != nil {
+			return c
+		}
+		colls[name] = oracle{}
+		return s.SetCollection(name, nil)
+	}
+	for step := 0; len(data) > 0; step++ {
+		op := next()
+		name := names[int(op>>7)]
+		key := fmt.Sprintf("k%02d", next()%32)
+		var desc string
+		switch op & 0x7f % 10 {
+		case 0, 1: // Set.
+			val := fmt.Sprintf("%s-%d-%s", key, step,
+				bytes.Repeat([]byte("v"), int(next()%16)))
+			priority := int32(next() % 8)
+			desc = fmt.Sprintf("set %s %s %v", name, key, priority)
+			err = coll(name).SetItem(&Item{
+				Key: []byte(key), Val: []byte(val), Priority: priority,
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %v", desc, err)
+			}
+			colls[name][key] = oracleItem{val, priority}
+		case 2: // Delete.
+			desc = fmt.Sprintf("delete %s %s", name, key)
+			wasDeleted, err := coll(name).Delete([]byte(key))
+			_, present := colls[name][key]
+			if err != nil || wasDeleted != present {
+				return fmt.Errorf("%s: expected %v, got: %v, %v",
+					desc, present, wasDeleted, err)
+			}
+			delete(colls[name], key)
+		case 3: // Get.
+			desc = fmt.Sprintf("get %s %s", name, key)
+			v, err := coll(name).Get([]byte(key))
+			exp, present := colls[name][key]
+			if err != nil || (v != nil) != present ||
+				(present && string(v) != exp.val) {
+				return fmt.Errorf("%s: expected %q, %v, got: %q, %v",
+					desc, exp.val, present, v, err)
+			}
+		case 4: // Visit a range.
+			limit := int(next() % 8)
+			desc = fmt.Sprintf("visit %s %s %v", name, key, limit)
+			var exp, got []string
+			for _, k := range colls[name].keys() {
+				if k >= key && len(exp) < limit {
+					exp = append(exp, k)
+				}
+			}
+			err = coll(name).VisitItemsAscend([]byte(key), false,
+				func(i *Item) bool {
+					if len(got) >= limit {
+						return false
+					}
+					got = append(got, string(i.Key))
+					return len(got) < limit
+				})
+			if err != nil || fmt.Sprint(exp) != fmt.Sprint(got) {
+				return fmt.Errorf("%s: expected %v, got: %v, %v",
+					desc, exp, got, err)
+			}
+		case 5: // Flush.
+			desc = "flush"
+			if err = s.Flush(); err != nil {
+				return fmt.Errorf("%s: %v", desc, err)
+			}
+			flushed = append(flushed, cloneOracles(colls))
+		case 6: // FlushRevert.
+			desc = "flush revert"
+			if err = s.FlushRevert(); err != nil {
+				return fmt.Errorf("%s: %v", desc, err)
+			}
+			if len(flushed) > 0 {
+				flushed = flushed[:len(flushed)-1]
+			}
+			colls = map[string]oracle{}
+			if len(flushed) > 0 {
+				colls = cloneOracles(flushed[len(flushed)-1])
+			}
+			snapshots = nil // The file was truncated under them.
+		case 7: // Evict.
+			desc = fmt.Sprintf("evict %s", name)
+			coll(name).EvictSomeItems()
+		case 8: // Snapshot, and verify the held snapshots.
+			desc = "snapshot"
+			if len(snapshots) >= 3 {
+				snapshots = snapshots[1:]
+			}
+			snapshots = append(snapshots,
+				oracleSnapshot{s.Snapshot(), cloneOracles(colls)})
+			for i, ss := range snapshots {
+				for _, n := range names {
+					if err = checkOracle(ss.s.GetCollection(n), ss.coll[n]); err != nil {
+						return fmt.Errorf("%s %v, collection %s: %v", desc, i, n, err)
+					}
+				}
+			}
+		case 9: // Union the other collection into this one.
+			from := names[1-int(op>>7)]
+			desc = fmt.Sprintf("union %s into %s", from, name)
+			src, dst := coll(from), coll(name)
+			var items []*Item
+			err = src.VisitItemsAscend([]byte{0}, true, func(i *Item) bool {
+				items = append(items, i)
+				return true
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %v", desc, err)
+			}
+			for _, i := range items {
+				err = dst.SetItem(&Item{Key: i.Key, Val: i.Val, Priority: i.Priority})
+				if err != nil {
+					return fmt.Errorf("%s: %v", desc, err)
+				}
+				colls[name][string(i.Key)] = colls[from][string(i.Key)]
+			}
+		}
+		for _, n := range names {
+			if err = checkOracle(s.GetCollection(n), colls[n]); err != nil {
+				return fmt.Errorf("step %v, after %s, collection %s: %v",
+					step, desc, n, err)
+			}
+		}
+	}
+	return nil
+}
+
+var oracleSeeds = [][]byte{
+	{},
+	{0, 1, 4, 3, 3, 1},
+	{0, 1, 4, 1, 0, 2, 4, 1, 5, 0, 2, 1, 8, 0, 3, 2},
+	{0, 5, 4, 1, 0, 5, 4, 1, 0, 6, 4, 1, 5, 0, 7, 0, 4, 5, 7, 2, 6, 0},
+	{128, 3, 3, 3, 128, 4, 2, 7, 0, 4, 9, 9, 9, 137, 0, 8, 0, 9, 3},
+	{0, 1, 1, 1, 0, 2, 1, 1, 5, 0, 8, 0, 0, 1, 2, 7, 2, 1, 6, 0, 8, 0},
+}
+
+func TestOracleOps(t *testing.T) {
+	for i, seed := range oracleSeeds {
+		if err := runOracleOps(&memFile{}, seed); err != nil {
+			t.Errorf("seed %v: %v", i, err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		data := make([]byte, 400)
+		for j := range data {
+			data[j] = byte(rand.Intn(256))
+		}
+		if err := runOracleOps(&memFile{}, data); err != nil {
+			t.Errorf("random ops %x: %v", data, err)
+		}
+	}
+}
+
+func FuzzOracleOps(f *testing.F) {
+	for _, seed := range oracleSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := runOracleOps(&memFile{}, data); err != nil {
+			t.Error(err)
+		}
+	})
+}
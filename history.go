@@ -0,0 +1,148 @@
+package gkvlite
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+// The history keeps the roots of the last Flush()'es readable, so that
+// SnapshotAt() opens the Store as of an earlier Flush(), such as to
+// see what it looked like yesterday.  Every Flush() advances the
+// generation of the Store, and its roots record keeps the collections
+// JSON of up to SetHistoryDepth() prior generations, oldest first.  A
+// Flush() prunes the generations beyond the depth, whose nodes and
+// items that no later generation references are then dead space, for
+// CopyTo() to compact away.  Like tags, the history keeps old nodes
+// and items alive by their file offsets, so it cannot be combined with
+// free space reuse or with auto-compaction.  CopyTo() doesn't copy the
+// history.
+
+// A generation of the history in a roots record.
+type historyJSON struct {
+	Generation  uint64          `json:"g"`
+	Collections json.RawMessage `json:"c"`
+}
+
+// The history is never modified once it's stored, only replaced.
+type storeHistory struct {
+	depth int             // See SetHistoryDepth().
+	gen   uint64          // Of the last roots record.
+	cur   json.RawMessage // The collections JSON of the last roots record.
+	prior []historyJSON
+}
+
+// Sets the number of prior generations whose roots are kept readable
+// by SnapshotAt(), besides the last Flush(), where 0 (the default)
+// keeps none.  The depth applies from the next Flush(), which prunes
+// any generations beyond it, and it isn't persisted, so a reopened
+// Store's next Flush() prunes the history unless the depth is set
+// again.  As every roots record carries the kept generations, a large
+// depth makes each Flush() write larger roots records.
+func (s *Store) SetHistoryDepth(n int) error {
+	if n < 0 {
+		return errors.New("history depth must be non-negative")
+	}
+	if s.file == nil {
+		return errors.New("no file / in-memory only, so no history")
+	}
+	if s.readOnly {
+		return fmt.Errorf("%w, so cannot keep a history", ErrReadOnly)
+	}
+	if n > 0 && s.freeList.tracking() {
+		return errors.New("free space reuse is enabled, so cannot keep a history")
+	}
+	if n > 0 && s.autoCompact.enabled() {
+		return errors.New("auto-compaction is enabled, so cannot keep a history")
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	h := *s.historyOf()
+	h.depth = n
+	atomic.StorePointer(&s.history, unsafe.Pointer(&h))
+	return nil
+}
+
+// Returns the generation of the last Flush(), which counts the flushes
+// of the Store file, or 0 if there was none.
+func (s *Store) Generation() uint64 {
+	return s.historyOf().gen
+}
+
+// Returns the generations that SnapshotAt() can open, oldest first,
+// which end with the last Flush(), if any.
+func (s *Store) Generations() []uint64 {
+	h := s.historyOf()
+	res := make([]uint64, 0, len(h.prior)+1)
+	for _, g := range h.prior {
+		res = append(res, g.Generation)
+	}
+	if h.cur != nil {
+		res = append(res, h.gen)
+	}
+	return res
+}
+
+// Returns a read-only Store of the collections as of the Flush() of
+// the given generation, which is one of the Generations().  Like
+// OpenTag(), the returned Store shares the StoreFile of this Store, so
+// it's invalid once the StoreFile is closed.
+func (s *Store) SnapshotAt(gen uint64) (*Store, error) {
+	h := s.historyOf()
+	if gen == h.gen && h.cur != nil {
+		return s.openRoots(h.cur)
+	}
+	for _, g := range h.prior {
+		if g.Generation == gen {
+			return s.openRoots(g.Collections)
+		}
+	}
+	return nil, fmt.Errorf("no generation: %v, generations: %v",
+		gen, s.Generations())
+}
+
+func (s *Store) historyOf() *storeHistory {
+	p := atomic.LoadPointer(&s.history)
+	if p == nil {
+		return &storeHistory{}
+	}
+	return (*storeHistory)(p)
+}
+
+func (s *Store) hasHistory() bool {
+	h := s.historyOf()
+	return h.depth > 0 || len(h.prior) > 0
+}
+
+// Advances the history to the generation of a Flush() whose roots
+// record has the collections JSON cJSON, pruning it to the depth.
+func (s *Store) pushHistory(cJSON []byte) {
+	h := s.historyOf()
+	prior := h.prior
+	if h.cur != nil && h.depth > 0 {
+		prior = append(prior[:len(prior):len(prior)],
+			historyJSON{Generation: h.gen, Collections: h.cur})
+	}
+	if len(prior) > h.depth {
+		prior = prior[len(prior)-h.depth:]
+	}
+	atomic.StorePointer(&s.history, unsafe.Pointer(&storeHistory{
+		depth: h.depth,
+		gen:   h.gen + 1,
+		cur:   cJSON,
+		prior: prior,
+	}))
+}
+
+// Resets the history to the one of a roots record that was read.
+func (s *Store) loadHistory(rr *rootsRecord) {
+	h := &storeHistory{
+		depth: s.historyOf().depth,
+		gen:   rr.Generation,
+		cur:   rr.Collections,
+		prior: rr.History,
+	}
+	atomic.StorePointer(&s.history, unsafe.Pointer(h))
+}
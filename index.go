@@ -0,0 +1,411 @@
+package gkvlite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+)
+
+// A secondary index of a primary collection is a hidden collection of
+// the Store, whose keys are an index key, as encoded by AppendBytes(),
+// followed by the key of the primary item, so that VisitIndex() finds
+// the primary items by their index keys in index key order.  The index
+// is maintained by the mutations of the primary collection: while a
+// mutation holds the lock of the primary collection, it also updates
+// the index collection, whose name sorts after the name of the primary
+// collection, so it's locked after it like by Flush(), and then Flush()
+// always persists the index along with the primary items it indexes.
+// The new entries of a mutation are set before the primary item, and
+// the old entries are deleted after it, so that readers may find an
+// entry of an item that's not set yet, or of an old value of the item,
+// which VisitIndex() skips, but never miss the entry of an item's
+// current value.  The key functions of the indexes aren't persisted, so after
+// opening a file the indexes must be added again.
+
+// Returns the index keys of a primary item, which has its value.  The
+// function is invoked while the primary collection is locked, so it
+// must not access the Store.
+type IndexKeyFunc func(item *Item) ([][]byte, error)
+
+type collIndex struct {
+	name    string // Of the index.
+	primary string // Name of the primary collection.
+	keyFn   IndexKeyFunc
+}
+
+// The name of the index collection, which sorts after the name of the
+// primary collection, and is hidden by GetCollectionNames().
+func (idx *collIndex) collName() string {
+	return idx.primary + indexCollInfix + idx.name
+}
+
+const indexCollInfix = "\x00index\x00"
+
+func isIndexCollName(name string) bool {
+	return strings.Contains(name, indexCollInfix)
+}
+
+// Adds a secondary index of the primary collection, whose name must be
+// unique in the Store, with the index keys of keyFn, and maintains it
+// while SetItem(), Insert(), Delete() and DeleteMulti() mutate the
+// primary collection; the writer goroutine of StartWriter() can't be
+// used with an indexed collection.  When there's no index collection of
+// the name yet, such as in a new file, it's created empty, and
+// RebuildIndex() then indexes the existing items.  Replacing the
+// primary collection, by SetCollection() of its name, keeps the index,
+// but RemoveCollection() and FlushRevertCollection() of the primary
+// collection aren't reflected in the index, which RebuildIndex() then
+// repairs.  The entries of the index aren't mutations of the Store, so
+// they're not reported to OnMutation() callbacks nor replicated.
+func (s *Store) AddIndex(primary *Collection, indexName string,
+	keyFn IndexKeyFunc) error {
+	if s.readOnly {
+		return fmt.Errorf("%w, so cannot AddIndex()", ErrReadOnly)
+	}
+	if indexName == "" || keyFn == nil {
+		return errors.New("index name and key func must be given")
+	}
+	if primary.name == "" || isIndexCollName(primary.name) ||
+		s.GetCollection(primary.name) != primary {
+		return errors.New("primary must be a collection of the store")
+	}
+	primary.writeLock.Lock()
+	defer primary.writeLock.Unlock()
+	if s.isClosed() {
+		return ErrStoreClosed
+	}
+	if atomic.LoadPointer(&primary.writer) != nil {
+		return errors.New("primary has a writer, so cannot AddIndex()")
+	}
+	idx := &collIndex{name: indexName, primary: primary.name, keyFn: keyFn}
+	if s.GetCollection(idx.collName()) == nil {
+		s.SetCollection(idx.collName(), nil)
+	}
+	for {
+		orig := atomic.LoadPointer(&s.indexes)
+		indexes := map[string]*collIndex{}
+		if orig != nil {
+			for name, idx := range *(*map[string]*collIndex)(orig) {
+				indexes[name] = idx
+			}
+		}
+		if indexes[indexName] != nil {
+			return fmt.Errorf("index exists: %s", indexName)
+		}
+		indexes[indexName] = idx
+		if atomic.CompareAndSwapPointer(&s.indexes, orig, unsafe.Pointer(&indexes)) {
+			return nil
+		}
+	}
+}
+
+// Removes the secondary index and its index collection.
+func (s *Store) RemoveIndex(indexName string) error {
+	idx := s.index(indexName)
+	if idx == nil {
+		return fmt.Errorf("no index: %s", indexName)
+	}
+	if primary := s.GetCollection(idx.primary); primary != nil {
+		primary.writeLock.Lock()
+		defer primary.writeLock.Unlock()
+	}
+	for {
+		orig := atomic.LoadPointer(&s.indexes)
+		indexes := map[string]*collIndex{}
+		for name, idx := range *(*map[string]*collIndex)(orig) {
+			indexes[name] = idx
+		}
+		delete(indexes, indexName)
+		if atomic.CompareAndSwapPointer(&s.indexes, orig, unsafe.Pointer(&indexes)) {
+			break
+		}
+	}
+	s.RemoveCollection(idx.collName())
+	return nil
+}
+
+// Rebuilds the secondary index from a traversal of its primary
+// collection, whose mutations wait for the rebuild, so that the index
+// has exactly the entries of the primary items.  Only the entries that
+// differ are changed.
+func (s *Store) RebuildIndex(indexName string) error {
+	if s.readOnly {
+		return fmt.Errorf("%w, so cannot RebuildIndex()", ErrReadOnly)
+	}
+	idx := s.index(indexName)
+	if idx == nil {
+		return fmt.Errorf("no index: %s", indexName)
+	}
+	primary := s.GetCollection(idx.primary)
+	if primary == nil {
+		return fmt.Errorf("%w: %s", ErrCollectionMissing, idx.primary)
+	}
+	primary.writeLock.Lock()
+	defer primary.writeLock.Unlock()
+	ic := s.GetCollection(idx.collName())
+	if ic == nil {
+		return fmt.Errorf("%w: index %s", ErrCollectionMissing, indexName)
+	}
+	want := map[string]bool{}
+	var errKeyFn error
+	err := primary.VisitItemsAscend(nil, true, func(i *Item) bool {
+		keys, err := idx.entryKeys(i)
+		if err != nil {
+			errKeyFn = err
+			return false
+		}
+		for _, k := range keys {
+			want[string(k)] = true
+		}
+		return true
+	})
+	if errKeyFn != nil {
+		return errKeyFn
+	}
+	if err != nil {
+		return err
+	}
+	c := indexChange{idx: idx}
+	err = ic.VisitItemsAscend(nil, false, func(i *Item) bool {
+		if want[string(i.Key)] {
+			delete(want, string(i.Key))
+		} else {
+			c.del = append(c.del, i.Key)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for k := range want {
+		c.set = append(c.set, []byte(k))
+	}
+	return primary.applyIndexChanges([]indexChange{c})
+}
+
+// Visits an item of an index key, see VisitIndex().
+type IndexVisitor func(indexKey []byte, i *Item) bool
+
+// Visits the items of the collection by their keys of the named
+// secondary index, in ascending order of the index keys and then of
+// the item keys, starting from the index key start, until the visitor
+// returns false.  An item with several index keys is visited once for
+// each of them.  The items are looked up as they're visited, and an
+// entry of the index is skipped when the item no longer has the index
+// key.
+func (t *Collection) VisitIndex(indexName string, start []byte,
+	visitor IndexVisitor) error {
+	idx := t.store.index(indexName)
+	if idx == nil || idx.primary != t.name {
+		return fmt.Errorf("no index: %s", indexName)
+	}
+	ic := t.store.GetCollection(idx.collName())
+	if ic == nil {
+		return fmt.Errorf("%w: index %s", ErrCollectionMissing, indexName)
+	}
+	var target []byte
+	if start != nil {
+		target = AppendBytes(nil, start)
+	}
+	var errVisit error
+	err := ic.VisitItemsAscend(target, false, func(e *Item) bool {
+		indexKey, key, err := DecodeBytes(e.Key)
+		if err != nil {
+			errVisit = fmt.Errorf("index %s entry: %w", indexName, err)
+			return false
+		}
+		i, err := t.GetItem(key, true)
+		if err != nil {
+			errVisit = err
+			return false
+		}
+		if i == nil {
+			return true
+		}
+		defer t.store.ItemDecRef(t, i)
+		keys, err := idx.keyFn(i)
+		if err != nil {
+			errVisit = err
+			return false
+		}
+		for _, k := range keys {
+			if bytes.Equal(k, indexKey) {
+				return visitor(indexKey, i)
+			}
+		}
+		return true
+	})
+	if errVisit != nil {
+		return errVisit
+	}
+	return err
+}
+
+func (s *Store) index(indexName string) *collIndex {
+	p := atomic.LoadPointer(&s.indexes)
+	if p == nil {
+		return nil
+	}
+	return (*(*map[string]*collIndex)(p))[indexName]
+}
+
+// Returns the indexes of the collection.
+func (t *Collection) indexes() (res []*collIndex) {
+	p := atomic.LoadPointer(&t.store.indexes)
+	if p == nil || t.name == "" {
+		return nil
+	}
+	for _, idx := range *(*map[string]*collIndex)(p) {
+		if idx.primary == t.name {
+			res = append(res, idx)
+		}
+	}
+	return res
+}
+
+// Returns the keys of the index entries of the item, or none for nil.
+func (idx *collIndex) entryKeys(i *Item) ([][]byte, error) {
+	if i == nil {
+		return nil, nil
+	}
+	keys, err := idx.keyFn(i)
+	if err != nil {
+		return nil, fmt.Errorf("index %s key func: %w", idx.name, err)
+	}
+	res := make([][]byte, len(keys))
+	for j, k := range keys {
+		res[j] = append(AppendBytes(nil, k), i.Key...)
+	}
+	return res, nil
+}
+
+// The index entries to delete and to set for mutations of the primary.
+type indexChange struct {
+	idx *collIndex
+	del [][]byte
+	set [][]byte
+}
+
+// Returns the index changes of replacing the item prev, if any, with
+// next, if any, where prev has its value.  Invoked while the
+// collection's writeLock is held.
+func (t *Collection) indexChanges(indexes []*collIndex, prev, next *Item) (
+	res []indexChange, err error) {
+	for _, idx := range indexes {
+		prevKeys, err := idx.entryKeys(prev)
+		if err != nil {
+			return nil, err
+		}
+		nextKeys, err := idx.entryKeys(next)
+		if err != nil {
+			return nil, err
+		}
+		c := indexChange{idx: idx}
+		seen := make(map[string]bool, len(nextKeys))
+		for _, k := range nextKeys {
+			seen[string(k)] = true
+		}
+		for _, k := range prevKeys {
+			if !seen[string(k)] {
+				c.del = append(c.del, k)
+			}
+		}
+		seen = make(map[string]bool, len(prevKeys))
+		for _, k := range prevKeys {
+			seen[string(k)] = true
+		}
+		for _, k := range nextKeys {
+			if !seen[string(k)] {
+				c.set = append(c.set, k)
+				seen[string(k)] = true
+			}
+		}
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+// Returns the index changes of deleting the items of the keys that are
+// under root.  Invoked while the collection's writeLock is held.
+func (t *Collection) indexDeletes(indexes []*collIndex, root *nodeLoc,
+	keys [][]byte) (res []indexChange, err error) {
+	for _, key := range keys {
+		prev, err := t.indexedItem(root, key)
+		if err != nil {
+			return nil, err
+		}
+		if prev == nil {
+			continue
+		}
+		changes, err := t.indexChanges(indexes, prev, nil)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, changes...)
+	}
+	return res, nil
+}
+
+// Returns the item of the key under root, with its value, or nil.
+func (t *Collection) indexedItem(root *nodeLoc, key []byte) (*Item, error) {
+	iloc, i, err := t.lookup(root, key)
+	if err != nil || i == nil {
+		return nil, err
+	}
+	return iloc.read(t, true)
+}
+
+// Splits the changes into the sets of new entries, which are applied
+// before the mutation of the primary item, and the deletes of old
+// entries, which are applied after it.
+func splitIndexChanges(changes []indexChange) (sets, dels []indexChange) {
+	for _, c := range changes {
+		sets = append(sets, indexChange{idx: c.idx, set: c.set})
+		dels = append(dels, indexChange{idx: c.idx, del: c.del})
+	}
+	return sets, dels
+}
+
+// Applies the index changes to the index collections, locking each
+// after the collection's writeLock, which is held.
+func (t *Collection) applyIndexChanges(changes []indexChange) error {
+	for _, c := range changes {
+		if len(c.del) == 0 && len(c.set) == 0 {
+			continue
+		}
+		ic := t.store.GetCollection(c.idx.collName())
+		if ic == nil {
+			return fmt.Errorf("%w: index %s", ErrCollectionMissing, c.idx.name)
+		}
+		if err := ic.applyIndexChange(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ic *Collection) applyIndexChange(c indexChange) error {
+	ic.writeLock.Lock()
+	defer ic.writeLock.Unlock()
+	if err := ic.writableErr(); err != nil {
+		return err
+	}
+	if len(c.del) > 0 {
+		_, err := ic.deleteDistinct(ic.distinctKeys(c.del), func([]*node) {})
+		if err != nil {
+			return err
+		}
+	}
+	if len(c.set) > 0 {
+		run := make([]*writeOp, len(c.set))
+		for i, k := range c.set {
+			run[i] = &writeOp{item: &Item{Key: k, Val: []byte{},
+				Priority: ic.store.randInt31()}}
+		}
+		return ic.setItems(run)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package gkvlite
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+// A bounded table of recently set keys, least recently set first out.
+// Protected by the Collection's writeLock.
+type keyInterning struct {
+	maxKeys int
+	keys    map[string]*list.Element // The string is a private copy.
+	lru     *list.List               // Of *internedKey, most recent at front.
+}
+
+type internedKey struct {
+	name string // Same as the map key, to detect mutations of key.
+	key  []byte // The backing slice that's shared by items.
+}
+
+// Enables key interning for SetItem(), where the collection remembers
+// the keys of up to maxKeys recently set items, and an item that's set
+// with a key that's equal to a remembered one gets its Item.Key
+// replaced with the remembered slice before it's stored, so repeated
+// updates of a hot key share one key slice instead of retaining a copy
+// per item.  A maxKeys of 0 disables (and drops) the table.  Items read
+// with UsePooledItems() aren't interned, as their keys are recycled.
+// The table has its own copy of every key, so misses cost an
+// allocation.
+//
+// Interned keys are shared, so a key slice, once passed to SetItem(),
+// must not be modified by the caller, which is already the case for
+// keys of the items that are stored without interning.  When debug
+// validation is enabled (see SetDebugValidation()), a remembered key
+// that was modified panics when it's looked up or dropped; otherwise,
+// it's silently dropped from the table.  The table carries over to the
+// Collection that SetCollection() returns for an existing name.
+func (t *Collection) SetKeyInterning(maxKeys int) error {
+	if maxKeys < 0 {
+		return errors.New("maxKeys must be non-negative")
+	}
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	if maxKeys == 0 {
+		atomic.StorePointer(&t.interning, nil)
+		return nil
+	}
+	ki := &keyInterning{
+		maxKeys: maxKeys,
+		keys:    map[string]*list.Element{},
+		lru:     list.New(),
+	}
+	atomic.StorePointer(&t.interning, unsafe.Pointer(ki))
+	return nil
+}
+
+// Replaces the key of the item with an equal interned key, or interns
+// the item's key.  Invoked while the writeLock is held.
+func (t *Collection) internKey(item *Item) {
+	p := atomic.LoadPointer(&t.interning)
+	if p == nil || item.pooled != nil {
+		return
+	}
+	ki := (*keyInterning)(p)
+	if e, ok := ki.keys[string(item.Key)]; ok {
+		ik := e.Value.(*internedKey)
+		if t.checkInterned(ik, "lookup") {
+			item.Key = ik.key
+			ki.lru.MoveToFront(e)
+			t.store.metricsCounter("keyInternHits", 1)
+			return
+		}
+		delete(ki.keys, ik.name)
+		ki.lru.Remove(e)
+	}
+	var e *list.Element
+	if ki.lru.Len() >= ki.maxKeys {
+		e = ki.lru.Back()
+		ik := e.Value.(*internedKey)
+		t.checkInterned(ik, "drop")
+		delete(ki.keys, ik.name)
+		ik.name, ik.key = string(item.Key), item.Key
+		ki.lru.MoveToFront(e)
+	} else {
+		e = ki.lru.PushFront(&internedKey{string(item.Key), item.Key})
+	}
+	ki.keys[e.Value.(*internedKey).name] = e
+	t.store.metricsCounter("keyInternMisses", 1)
+}
+
+// Returns whether the interned key wasn't modified since it was
+// interned, panicking if it was and debug validation is enabled.
+func (t *Collection) checkInterned(ik *internedKey, during string) bool {
+	if string(ik.key) == ik.name {
+		return true
+	}
+	if t.store.debugLevel > 0 {
+		t.debugFail(nil, fmt.Sprintf("interned key modified after Set,"+
+			" during %s, expected key: %q, got: %q", during, ik.name, ik.key))
+	}
+	return false
+}
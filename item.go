@@ -1,24 +1,55 @@
 package gkvlite
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"sync/atomic"
 	"unsafe"
 )
 
 // A persistable item.
+//
+// The Transient field holds in-memory data of the application, such as
+// a cached value derived from Val.  It is never written by Flush(), nor
+// counted by NumBytes() or GetTotals(), so it only lives as long as its
+// Item is in memory: Flush() keeps the Item and so its Transient data,
+// but EvictSomeItems() drops clean Items like any other, and reads
+// after an eviction or reopening return Items with a nil Transient.
+// The Transient data never keeps an Item or node in memory by itself.
+//
+// When TransientVal is set, the Val itself is such in-memory data, such
+// as a value computed from other items, which is kept in memory but
+// not persisted: Flush(), CopyTo() and the other copies write the item
+// with its key and priority and an empty Val, as do the WAL, the
+// replication log and OnMutation(), and the Val isn't counted
+// by NumBytes() or GetTotals(), which estimate the bytes on disk.  So
+// a key with a transient Val keeps its node across Flush() like any
+// other, and the reads after an eviction or reopening return the item
+// with an empty Val.  A prior version that SetKeepVersions() keeps of
+// such an item is persisted with an empty Val, too.
 type Item struct {
 	Transient unsafe.Pointer // For any ephemeral data; atomic CAS recommended.
 	Key, Val  []byte         // Val may be nil if not fetched into memory yet.
 	Priority  int32          // Use rand.Int31() for probabilistic balancing.
+
+	TransientVal bool // When true, Val is never persisted, see above.
+
+	pooled *pooledItem // Non-nil when allocated from the pool of UsePooledItems().
 }
 
 // A persistable item and its persistence location.
 type itemLoc struct {
 	loc  unsafe.Pointer // *ploc - can be nil if item is dirty (not yet persisted).
 	item unsafe.Pointer // *Item - can be nil if item is not fetched into memory yet.
+
+	// Cached Item.NumBytes() of a dirty item, as of SetItem(), so that
+	// tree rebuilds don't depend on what ItemValLength() returns later.
+	numBytes int
+
+	versions unsafe.Pointer // *itemVersions, see SetKeepVersions().
 }
 
 var empty_itemLoc = &itemLoc{}
@@ -29,12 +60,24 @@ func (i *Item) NumBytes(c *Collection) int {
 }
 
 func (i *Item) NumValBytes(c *Collection) int {
+	if i.TransientVal {
+		return 0
+	}
 	if c.store.callbacks.ItemValLength != nil {
 		return c.store.callbacks.ItemValLength(c, i)
 	}
 	return len(i.Val)
 }
 
+// Returns the Val as it's persisted, which is empty for a TransientVal,
+// such as for the WAL and the replication log, and for OnMutation().
+func (i *Item) persistedVal() []byte {
+	if i.TransientVal {
+		return []byte{}
+	}
+	return i.Val
+}
+
 // The returned Item will not have been allocated through the optional
 // StoreCallbacks.ItemAlloc() callback.
 func (i *Item) Copy() *Item {
@@ -43,6 +86,8 @@ func (i *Item) Copy() *Item {
 		Val:       i.Val,
 		Priority:  i.Priority,
 		Transient: i.Transient,
+
+		TransientVal: i.TransientVal,
 	}
 }
 
@@ -61,10 +106,69 @@ func (i *itemLoc) Copy(src *itemLoc) {
 	}
 	atomic.StorePointer(&i.loc, unsafe.Pointer(src.Loc()))
 	atomic.StorePointer(&i.item, unsafe.Pointer(src.Item()))
+	i.numBytes = src.numBytes
+	atomic.StorePointer(&i.versions, atomic.LoadPointer(&src.versions))
 }
 
 const itemLoc_hdrLength int = 4 + 2 + 4 + 4
 
+// The largest key and value lengths that the item encoding can hold,
+// as the key length is a uint16 and the whole record's length, from
+// its itemLoc_hdrLength of 14 bytes onwards, is a uint32.
+const (
+	MaxKeyLen = 0xffff
+	MaxValLen = 0xffffffff - 14 - MaxKeyLen
+)
+
+var ErrKeyTooLarge = errors.New("key too large")
+var ErrValTooLarge = errors.New("value too large")
+
+// A LimitError is returned by SetItem() for a key or value that's
+// longer than MaxKeyLen or MaxValLen, or than the limits of
+// Store.SetLimits(), where Err is ErrKeyTooLarge or ErrValTooLarge, for
+// use with errors.Is(), by SetMeta(), with ErrMetaTooLarge, by
+// Flush(), with ErrFileTooLarge, and for trees deeper than the limit of
+// SetMaxTreeDepth(), with ErrTreeTooDeep.
+type LimitError struct {
+	Err   error
+	Limit uint64
+	Size  uint64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%v, size: %v, limit: %v", e.Err, e.Size, e.Limit)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// Limits the key and value lengths that SetItem() and Set() accept to
+// below the encoding's MaxKeyLen and MaxValLen, such as for a service
+// that stores untrusted input, where longer keys and values are
+// rejected with a *LimitError before anything is allocated for them.
+// A limit of 0 (the default) means the encoding's limit.  This should
+// be called before the Store is used concurrently.
+func (s *Store) SetLimits(maxKeyBytes, maxValBytes int) error {
+	if maxKeyBytes < 0 || maxValBytes < 0 {
+		return errors.New("limits must be non-negative")
+	}
+	s.maxKeyLen, s.maxValLen = maxKeyBytes, maxValBytes
+	return nil
+}
+
+// Returns the key and value length limits of the Store.
+func (s *Store) limits() (maxKeyLen, maxValLen uint64) {
+	maxKeyLen, maxValLen = MaxKeyLen, MaxValLen
+	if s.maxKeyLen > 0 && uint64(s.maxKeyLen) < maxKeyLen {
+		maxKeyLen = uint64(s.maxKeyLen)
+	}
+	if s.maxValLen > 0 && uint64(s.maxValLen) < maxValLen {
+		maxValLen = uint64(s.maxValLen)
+	}
+	return maxKeyLen, maxValLen
+}
+
 func (i *itemLoc) write(c *Collection) (err error) {
 	if i.Loc().isEmpty() {
 		iItem := i.Item()
@@ -77,7 +181,10 @@ func (i *itemLoc) write(c *Collection) (err error) {
 				return err
 			}
 		}
-		offset := atomic.LoadInt64(&c.store.size)
+		if iItem.TransientVal {
+			// Written without the Val, which stays with the Item in memory.
+			iItem = &Item{Key: iItem.Key, Val: []byte{}, Priority: iItem.Priority}
+		}
 		hlength := itemLoc_hdrLength + len(iItem.Key)
 		vlength := iItem.NumValBytes(c)
 		ilength := hlength + vlength
@@ -96,21 +203,120 @@ func (i *itemLoc) write(c *Collection) (err error) {
 			return fmt.Errorf("itemLoc.write() pos: %v didn't match hlength: %v",
 				pos, hlength)
 		}
-		if _, err := c.store.file.WriteAt(b, offset); err != nil {
+		if c.store.encrypted {
+			return i.writeEncrypted(c, iItem, b,
+				c.store.appendOffset(), vlength, ilength)
+		}
+		if vs := i.versionsOf(); len(vs) > 0 {
+			return i.writeVersioned(c, iItem, b, vs, vlength, ilength)
+		}
+		if n := c.store.valueChunks(vlength); n > 0 {
+			return i.writeChunked(c, iItem, b, n, vlength, ilength)
+		}
+		if atomic.LoadInt32(&c.keyPrefixes) != 0 {
+			if base, shared, ok := c.keyPrefixFor(iItem.Key); ok {
+				return i.writePrefixed(c, iItem, b, base, shared, vlength, ilength)
+			}
+		}
+		offset, appended := c.store.allocRecord(ilength)
+		if err := c.store.writeAt(b, offset); err != nil {
 			return err
 		}
-		err := c.store.ItemValWrite(c, iItem, c.store.file, offset+int64(pos))
+		err := c.store.ItemValWrite(c, iItem, c.store.recordWriter(), offset+int64(pos))
 		if err != nil {
 			return err
 		}
-		atomic.StoreInt64(&c.store.size, offset+int64(ilength))
+		if appended {
+			atomic.StoreInt64(&c.store.size, offset+int64(ilength))
+		}
+		c.store.flushLogItem(i)
 		atomic.StorePointer(&i.loc,
 			unsafe.Pointer(&ploc{Offset: offset, Length: uint32(ilength)}))
+		c.keyPrefixWritten(iItem.Key, offset, false)
 	}
 	return nil
 }
 
+// When encrypted, an item record has an extra uint32 ciphertext length
+// after the priority, and the value bytes are stored as ciphertext.
+// The ploc.Length of the item and the record's own length field are
+// still the plaintext length, so that NumBytes() stays meaningful.
+const itemLoc_encHdrLength int = itemLoc_hdrLength + 4
+
+func (i *itemLoc) writeEncrypted(c *Collection, iItem *Item, hdr []byte,
+	offset int64, vlength int, ilength int) error {
+	val := iItem.Val
+	if c.store.callbacks.ItemValWrite != nil {
+		val = make([]byte, vlength)
+		if err := c.store.ItemValWrite(c, iItem, bufWriterAt(val), 0); err != nil {
+			return err
+		}
+	}
+	voffset := offset + int64(itemLoc_encHdrLength+len(iItem.Key))
+	cval, err := c.store.callbacks.Encrypt(val, voffset)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, itemLoc_encHdrLength+len(iItem.Key)+len(cval))
+	pos := copy(b, hdr[:itemLoc_hdrLength])
+	binary.BigEndian.PutUint32(b[pos:pos+4], uint32(len(cval)))
+	pos += 4
+	pos += copy(b[pos:], iItem.Key)
+	copy(b[pos:], cval)
+	if err := c.store.writeAt(b, offset); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&c.store.size, offset+int64(len(b)))
+	c.store.flushLogItem(i)
+	atomic.StorePointer(&i.loc,
+		unsafe.Pointer(&ploc{Offset: offset, Length: uint32(ilength)}))
+	return nil
+}
+
+func (iloc *itemLoc) readEncryptedVal(c *Collection, r io.ReaderAt, i *Item,
+	loc *ploc, valLength uint32) error {
+	b := make([]byte, 4)
+	if _, err := readFull(r, b, loc.Offset+int64(itemLoc_hdrLength)); err != nil {
+		return err
+	}
+	voffset := loc.Offset + int64(itemLoc_encHdrLength+len(i.Key))
+	cval := make([]byte, binary.BigEndian.Uint32(b))
+	if _, err := readFull(r, cval, voffset); err != nil {
+		return err
+	}
+	val, err := c.store.callbacks.Decrypt(cval, voffset)
+	if err != nil {
+		return err
+	}
+	if uint32(len(val)) != valLength {
+		return fmt.Errorf("unexpected decrypted value length: %v != %v",
+			len(val), valLength)
+	}
+	return c.store.ItemValRead(c, i, bytes.NewReader(val), 0, valLength)
+}
+
+// An io.WriterAt over a fixed-size byte slice.
+type bufWriterAt []byte
+
+func (b bufWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(b)) {
+		return 0, fmt.Errorf("bufWriterAt.WriteAt() out of range,"+
+			" off: %v, len: %v", off, len(p))
+	}
+	return copy(b[off:], p), nil
+}
+
 func (iloc *itemLoc) read(c *Collection, withValue bool) (icur *Item, err error) {
+	if iloc == nil {
+		return nil, nil
+	}
+	return iloc.readFrom(c, withValue, c.store.file)
+}
+
+// Like read(), but an item that's not in memory is read from r, which
+// reads the store file, such as through a readahead.
+func (iloc *itemLoc) readFrom(c *Collection, withValue bool,
+	r io.ReaderAt) (icur *Item, err error) {
 	if iloc == nil {
 		return nil, nil
 	}
@@ -120,12 +326,15 @@ func (iloc *itemLoc) read(c *Collection, withValue bool) (icur *Item, err error)
 		if loc.isEmpty() {
 			return nil, nil
 		}
+		defer func() {
+			err = corruptError(loc, "item read", err)
+		}()
 		if loc.Length < uint32(itemLoc_hdrLength) {
 			return nil, fmt.Errorf("unexpected item loc.Length: %v < %v",
 				loc.Length, itemLoc_hdrLength)
 		}
 		b := make([]byte, itemLoc_hdrLength)
-		if _, err := c.store.file.ReadAt(b, loc.Offset); err != nil {
+		if _, err := readFull(r, b, loc.Offset); err != nil {
 			return nil, err
 		}
 		pos := 0
@@ -139,7 +348,8 @@ func (iloc *itemLoc) read(c *Collection, withValue bool) (icur *Item, err error)
 		if i == nil {
 			return nil, errors.New("ItemAlloc() failed")
 		}
-		i.Priority = int32(binary.BigEndian.Uint32(b[pos : pos+4]))
+		priority := binary.BigEndian.Uint32(b[pos : pos+4])
+		i.Priority = int32(priority &^ itemLoc_prefixFlag)
 		pos += 4
 		if length != uint32(itemLoc_hdrLength)+uint32(keyLength)+valLength {
 			c.store.ItemDecRef(c, i)
@@ -150,14 +360,41 @@ func (iloc *itemLoc) read(c *Collection, withValue bool) (icur *Item, err error)
 			return nil, fmt.Errorf("read pos != itemLoc_hdrLength, %v != %v",
 				pos, itemLoc_hdrLength)
 		}
-		if _, err := c.store.file.ReadAt(i.Key,
-			loc.Offset+int64(itemLoc_hdrLength)); err != nil {
+		hdrLength := itemLoc_hdrLength
+		if c.store.encrypted {
+			hdrLength = itemLoc_encHdrLength
+		}
+		voffset := loc.Offset + int64(itemLoc_hdrLength) + int64(keyLength)
+		var ext itemExt
+		if priority&itemLoc_prefixFlag != 0 {
+			if voffset, ext, err = c.readExtendedKey(r, loc, i.Key); err != nil {
+				c.store.ItemDecRef(c, i)
+				return nil, err
+			}
+			if ext.versions != nil {
+				iloc.loadVersions(ext.versions)
+			}
+		} else if _, err := readFull(r, i.Key,
+			loc.Offset+int64(hdrLength)); err != nil {
 			c.store.ItemDecRef(c, i)
 			return nil, err
 		}
-		if withValue {
-			err := c.store.ItemValRead(c, i, c.store.file,
-				loc.Offset+int64(itemLoc_hdrLength)+int64(keyLength), valLength)
+		if withValue && c.store.encrypted {
+			if err := iloc.readEncryptedVal(c, r, i, loc, valLength); err != nil {
+				c.store.ItemDecRef(c, i)
+				return nil, err
+			}
+		} else if withValue && ext.chunked {
+			chunks, err := readValueChunks(r, voffset, valLength)
+			if err == nil {
+				err = c.store.ItemValRead(c, i, chunks, 0, valLength)
+			}
+			if err != nil {
+				c.store.ItemDecRef(c, i)
+				return nil, err
+			}
+		} else if withValue {
+			err := c.store.ItemValRead(c, i, fullReaderAt{r}, voffset, valLength)
 			if err != nil {
 				c.store.ItemDecRef(c, i)
 				return nil, err
@@ -173,10 +410,10 @@ func (iloc *itemLoc) read(c *Collection, withValue bool) (icur *Item, err error)
 		if !atomic.CompareAndSwapPointer(&iloc.item,
 			unsafe.Pointer(icur), unsafe.Pointer(i)) {
 			c.store.ItemDecRef(c, i)
-			return iloc.read(c, withValue)
+			return iloc.readFrom(c, withValue, r)
 		}
 		if icur != nil {
-			c.store.ItemDecRef(c, icur)
+			c.store.itemDecRefVisible(c, icur)
 		}
 		icur = i
 	}
@@ -186,6 +423,9 @@ func (iloc *itemLoc) read(c *Collection, withValue bool) (icur *Item, err error)
 func (iloc *itemLoc) NumBytes(c *Collection) int {
 	loc := iloc.Loc()
 	if loc.isEmpty() {
+		if iloc.numBytes > 0 {
+			return iloc.numBytes
+		}
 		i := iloc.Item()
 		if i == nil {
 			return 0
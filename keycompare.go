@@ -0,0 +1,180 @@
+package gkvlite
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var keyComparesLock sync.RWMutex
+var keyCompares = map[string]KeyCompare{} // Protected by keyComparesLock.
+
+// Registers a KeyCompare under a name, such as "caseInsensitive", for
+// the collections of SetCollectionNamedCompare(), whose roots records
+// persist the name, so that NewStoreEx() and the other readers of the
+// roots, such as FlushRevert() and OpenTag(), attach the KeyCompare to
+// them again, which spares the app from re-attaching the right
+// KeyCompare to every collection after a reopen.  The registry is of
+// the process, like that of database/sql, so the KeyCompares are
+// usually registered from init() funcs, before any Store is opened,
+// and a name can't be registered twice, where the names starting with
+// "gkvlite." are of the built-in KeyCompares, such as CompareIgnoreCase().
+// Opening a file that has a collection of an unregistered name fails
+// with ErrUnknownComparator.
+func RegisterKeyCompare(name string, compare KeyCompare) error {
+	if name == "" {
+		return errors.New("key compare name missing")
+	}
+	if compare == nil {
+		return errors.New("key compare missing")
+	}
+	keyComparesLock.Lock()
+	defer keyComparesLock.Unlock()
+	if keyCompares[name] != nil {
+		return fmt.Errorf("key compare already registered: %s", name)
+	}
+	keyCompares[name] = compare
+	return nil
+}
+
+func registeredKeyCompare(name string) KeyCompare {
+	keyComparesLock.RLock()
+	defer keyComparesLock.RUnlock()
+	return keyCompares[name]
+}
+
+// Like SetCollection(), but with the KeyCompare that was registered
+// under compareName, see RegisterKeyCompare(), whose name is persisted
+// with the collection by the next Flush(), so a reopened file has the
+// collection with the same KeyCompare, regardless of the
+// KeyCompareForCollection callback.  A later SetCollection() of the
+// name with a KeyCompare of its own drops the compareName.  The
+// compareName is persisted in a field of the roots records that older
+// versions of gkvlite ignore, so they open such a collection with their
+// default of bytes.Compare.  An unregistered compareName fails with
+// ErrUnknownComparator.
+func (s *Store) SetCollectionNamedCompare(name,
+	compareName string) (*Collection, error) {
+	compare := registeredKeyCompare(compareName)
+	if compare == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownComparator, compareName)
+	}
+	c := s.setCollection(name, compare, compareName, false)
+	if c == nil {
+		return nil, ErrStoreClosed
+	}
+	return c, nil
+}
+
+// Returns the name of the registered KeyCompare of the collection, see
+// SetCollectionNamedCompare(), or "" if it has none.
+func (t *Collection) CompareName() string {
+	return t.compareName
+}
+
+// Attaches the KeyCompare to a collection that was read from a roots
+// record: the registered one of its persisted compare name, if any,
+// or else the one of the KeyCompareForCollection callback, or
+// bytes.Compare, which orders the keys without their sequence suffixes
+// for a multi collection, see SetCollectionMulti().
+func (o *Store) loadCompare(t *Collection) error {
+	if t.compareName != "" {
+		if t.compare = registeredKeyCompare(t.compareName); t.compare == nil {
+			return fmt.Errorf("%w: %s, collection: %s",
+				ErrUnknownComparator, t.compareName, t.name)
+		}
+	} else if o.callbacks.KeyCompareForCollection != nil {
+		t.compare = o.callbacks.KeyCompareForCollection(t.name)
+	}
+	if t.compare == nil {
+		t.compare = bytes.Compare
+	}
+	if t.multi {
+		t.compare = multiKeyCompare(t.compare)
+	}
+	return nil
+}
+
+// Sets a collection of the name with the KeyCompare that it has in the
+// roots record, as if it was read from it.
+func (s *Store) setLoadedCollection(rr *rootsRecord,
+	name string) (*Collection, error) {
+	var m map[string]collectionJSON
+	if err := json.Unmarshal(rr.Collections, &m); err != nil {
+		return nil, err
+	}
+	t := &Collection{name: name, compareName: m[name].Compare}
+	if err := s.loadCompare(t); err != nil {
+		return nil, err
+	}
+	return s.setCollection(name, t.compare, t.compareName, m[name].Multi), nil
+}
+
+// Returns a KeyCompare of the reverse order of compare, where a nil
+// compare means bytes.Compare, so that ascending visits, MinItem() and
+// the other order-based operations of a collection follow the reverse
+// order.  The nil target of a visit stays before every key, see
+// VisitItemsAscend().
+func CompareReverse(compare KeyCompare) KeyCompare {
+	if compare == nil {
+		compare = bytes.Compare
+	}
+	return func(a, b []byte) int { return compare(b, a) }
+}
+
+// A KeyCompare like bytes.Compare of the keys with their ASCII letters
+// folded to lower case, so keys that differ only in the case of their
+// ASCII letters are the same key, whose item keeps the case of the key
+// that first set it.  Other bytes, including those of non-ASCII UTF-8,
+// compare as they are.  It's registered as "gkvlite.ignoreCase", see
+// RegisterKeyCompare().
+func CompareIgnoreCase(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ca, cb := lowerASCII(a[i]), lowerASCII(b[i])
+		if ca != cb {
+			if ca < cb {
+				return -1
+			}
+			return 1
+		}
+	}
+	return compareInts(len(a), len(b))
+}
+
+func lowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
+
+// A KeyCompare of the keys as unsigned big-endian integers, such as the
+// 8 bytes of a uint64 from binary.BigEndian, where the leading zero
+// bytes don't count, so shorter encodings, such as of varying lengths,
+// order by their numeric values too, and keys of the same value, such
+// as []byte{1} and []byte{0, 1}, are the same key.  For keys of 8
+// bytes, it's the order of bytes.Compare.  It's registered as
+// "gkvlite.uint64BE", see RegisterKeyCompare().
+func CompareUint64BE(a, b []byte) int {
+	a, b = bytes.TrimLeft(a, "\x00"), bytes.TrimLeft(b, "\x00")
+	if c := compareInts(len(a), len(b)); c != 0 {
+		return c
+	}
+	return bytes.Compare(a, b)
+}
+
+func compareInts(a, b int) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func init() {
+	RegisterKeyCompare("gkvlite.ignoreCase", CompareIgnoreCase)
+	RegisterKeyCompare("gkvlite.uint64BE", CompareUint64BE)
+}
@@ -0,0 +1,184 @@
+package gkvlite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Order-preserving key encodings, so that multi-part keys, such as of a
+// tenant ID, a timestamp and a sequence number, sort under
+// bytes.Compare like their parts do, one part after the other.  The
+// Append functions append the encoding of a part to a key, and the
+// Decode functions decode the part at the start of a key and return
+// the rest of the key.  Strings and byte slices are terminated by a
+// 0x00 byte, where their own 0x00 bytes are escaped as 0x00 0xff, so a
+// string sorts before the longer strings that it's a prefix of, such
+// as "a" before "a\x00b", even when more parts follow it.
+
+var errKeyEncTruncated = errors.New("truncated key part")
+
+// Appends v as 8 big-endian bytes.
+func AppendUint64(b []byte, v uint64) []byte {
+	return binary.BigEndian.AppendUint64(b, v)
+}
+
+// Appends v as 8 big-endian bytes with the sign bit flipped, so that
+// negative numbers sort before positive ones.
+func AppendInt64(b []byte, v int64) []byte {
+	return binary.BigEndian.AppendUint64(b, uint64(v)^(1<<63))
+}
+
+// Appends the bytes of s, escaped and terminated.
+func AppendString(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == 0x00 {
+			b = append(b, 0x00, 0xff)
+		} else {
+			b = append(b, s[i])
+		}
+	}
+	return append(b, 0x00)
+}
+
+// Appends v, escaped and terminated, like AppendString().
+func AppendBytes(b []byte, v []byte) []byte {
+	for _, c := range v {
+		if c == 0x00 {
+			b = append(b, 0x00, 0xff)
+		} else {
+			b = append(b, c)
+		}
+	}
+	return append(b, 0x00)
+}
+
+func DecodeUint64(b []byte) (v uint64, rest []byte, err error) {
+	if len(b) < 8 {
+		return 0, b, errKeyEncTruncated
+	}
+	return binary.BigEndian.Uint64(b), b[8:], nil
+}
+
+func DecodeInt64(b []byte) (v int64, rest []byte, err error) {
+	if len(b) < 8 {
+		return 0, b, errKeyEncTruncated
+	}
+	return int64(binary.BigEndian.Uint64(b) ^ (1 << 63)), b[8:], nil
+}
+
+func DecodeString(b []byte) (s string, rest []byte, err error) {
+	v, rest, err := DecodeBytes(b)
+	return string(v), rest, err
+}
+
+func DecodeBytes(b []byte) (v []byte, rest []byte, err error) {
+	v = []byte{}
+	for i := 0; i < len(b); i++ {
+		if b[i] != 0x00 {
+			v = append(v, b[i])
+		} else if i+1 < len(b) && b[i+1] == 0xff {
+			v = append(v, 0x00)
+			i++
+		} else {
+			return v, b[i+1:], nil
+		}
+	}
+	return nil, b, errKeyEncTruncated
+}
+
+// The type tags of the parts of an encoded Tuple, in the order that
+// parts of different types sort in.
+const (
+	tupleBytes  = 0x01
+	tupleString = 0x02
+	tupleInt    = 0x03
+	tupleUint   = 0x04
+)
+
+// A Tuple is a multi-part key, whose parts are int64, uint64, string or
+// []byte values; an int or uint part is encoded like an int64 or
+// uint64.  An encoded Tuple is a type tag and the encoding of each
+// part, so the encoded tuples sort like the tuples, part by part,
+// where a tuple sorts before any longer tuple that it's a prefix of,
+// and parts of different types sort by their type, with []byte first,
+// then string, int64 and uint64.
+type Tuple []interface{}
+
+// Returns the key of the tuple.
+func (t Tuple) Encode() ([]byte, error) {
+	return t.Append(nil)
+}
+
+// Appends the key of the tuple to b.
+func (t Tuple) Append(b []byte) ([]byte, error) {
+	for i, p := range t {
+		switch v := p.(type) {
+		case []byte:
+			b = AppendBytes(append(b, tupleBytes), v)
+		case string:
+			b = AppendString(append(b, tupleString), v)
+		case int64:
+			b = AppendInt64(append(b, tupleInt), v)
+		case int:
+			b = AppendInt64(append(b, tupleInt), int64(v))
+		case uint64:
+			b = AppendUint64(append(b, tupleUint), v)
+		case uint:
+			b = AppendUint64(append(b, tupleUint), uint64(v))
+		default:
+			return nil, fmt.Errorf("unsupported tuple part %v, type: %T", i, p)
+		}
+	}
+	return b, nil
+}
+
+// Decodes a key of Tuple.Encode(), whose parts are then of the types
+// []byte, string, int64 and uint64.
+func DecodeTuple(b []byte) (Tuple, error) {
+	var t Tuple
+	for len(b) > 0 {
+		var p interface{}
+		var err error
+		switch tag := b[0]; tag {
+		case tupleBytes:
+			p, b, err = DecodeBytes(b[1:])
+		case tupleString:
+			p, b, err = DecodeString(b[1:])
+		case tupleInt:
+			p, b, err = DecodeInt64(b[1:])
+		case tupleUint:
+			p, b, err = DecodeUint64(b[1:])
+		default:
+			return nil, fmt.Errorf("unknown tuple part %v, tag: %#x", len(t), tag)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tuple part %v: %w", len(t), err)
+		}
+		t = append(t, p)
+	}
+	return t, nil
+}
+
+// Visits the items whose keys are encoded Tuple's that start with the
+// given parts, in ascending order, until the visitor returns false.
+// The keys are found as a range of the encoded parts, so the collection
+// must have a KeyCompare that orders keys like bytes.Compare.
+func (t *Collection) VisitTuplePrefix(withValue bool, visitor ItemVisitor,
+	prefixParts ...interface{}) error {
+	prefix, err := Tuple(prefixParts).Encode()
+	if err != nil {
+		return err
+	}
+	return t.VisitItemsAscend(prefix, withValue, func(i *Item) bool {
+		// After the parts, a longer key has the tag of its next part,
+		// unless the last string or []byte part has an escaped 0x00 in
+		// the key, whose 0xff sorts after the tags.
+		if !bytes.HasPrefix(i.Key, prefix) ||
+			(len(i.Key) > len(prefix) && i.Key[len(prefix)] == 0xff) {
+			return false
+		}
+		return visitor(i)
+	})
+}
@@ -0,0 +1,92 @@
+//go:build largefile
+
+package gkvlite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+// Flushes records at offsets beyond 4GB and beyond 2^47 of a sparse
+// file, where the offsets are reached by starting the Store's appends
+// there, so the test needs little disk space, but a filesystem with
+// sparse files.  Run it with: go test -tags largefile -run TestLargeFile
+func TestLargeFile(t *testing.T) {
+	for _, base := range []int64{5 << 30, 1<<47 + 12345} {
+		f, err := ioutil.TempFile("", "gkvlite-largefile")
+		if err != nil {
+			t.Fatalf("expected a temp file, got: %v", err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		s, _ := NewStore(f)
+		x := s.SetCollection("x", nil)
+		atomic.StoreInt64(&s.size, base)
+		val := func(i int) []byte {
+			return bytes.Repeat([]byte{byte(i)}, 1000+i)
+		}
+		for i := 0; i < 100; i++ {
+			x.Set([]byte(fmt.Sprintf("%03d", i)), val(i))
+		}
+		x.Set([]byte("big"), bytes.Repeat([]byte("b"), 5<<20))
+		if err = s.Flush(); errors.Is(err, syscall.EFBIG) {
+			t.Logf("skipped offset %v, as the filesystem's files are smaller: %v",
+				base, err)
+			continue
+		} else if err != nil {
+			t.Errorf("expected Flush at offset %v to work, got: %v", base, err)
+			continue
+		}
+		rnl := x.rootAddRef()
+		if loc := rnl.root.Loc(); loc.Offset <= base {
+			t.Errorf("expected the root beyond %v, got: %+v", base, loc)
+		}
+		x.rootDecRef(rnl)
+		x.Set([]byte("050"), []byte("updated"))
+		if err = s.Flush(); err != nil {
+			t.Errorf("expected another Flush to work, got: %v", err)
+		}
+		s2, err := NewStore(f)
+		if err != nil {
+			t.Errorf("expected reopen to work, got: %v", err)
+			continue
+		}
+		x2 := s2.GetCollection("x")
+		for i := 0; i < 100; i++ {
+			exp := val(i)
+			if i == 50 {
+				exp = []byte("updated")
+			}
+			if v, err := x2.Get([]byte(fmt.Sprintf("%03d", i))); !bytes.Equal(v, exp) || err != nil {
+				t.Errorf("expected item %v at offset %v, got: %v bytes, %v", i, base, len(v), err)
+				break
+			}
+		}
+		if v, _ := x2.Get([]byte("big")); len(v) != 5<<20 {
+			t.Errorf("expected the big value, got: %v bytes", len(v))
+		}
+		// All the records were read back from the base on.
+		var check func(nloc *nodeLoc)
+		check = func(nloc *nodeLoc) {
+			n, err := nloc.read(s2)
+			if err != nil || n == nil || nloc.isEmpty() {
+				return
+			}
+			if nloc.Loc().Offset < base || n.item.Loc().Offset < base {
+				t.Errorf("expected records from %v, got: %+v, %+v",
+					base, nloc.Loc(), n.item.Loc())
+			}
+			check(&n.left)
+			check(&n.right)
+		}
+		rnl = x2.rootAddRef()
+		check(rnl.root)
+		x2.rootDecRef(rnl)
+	}
+}
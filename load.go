@@ -0,0 +1,178 @@
+package gkvlite
+
+import (
+	"errors"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Options of NewStoreOpts().
+type OpenOptions struct {
+	// Whether any anomaly of the file fails the open, including the
+	// bytes after the last valid roots record that NewStoreEx()
+	// recovers from with a RecoveredError, such as for the primary copy
+	// of the data.
+	Strict bool
+
+	// Whether the unreadable nodes and items are skipped, along with
+	// the subtrees of the nodes, so that the readable items of a damaged
+	// file are opened, such as for forensics.  A collection with skipped
+	// records is rebuilt in memory from its readable items, like by
+	// Rebalance() but keeping their priorities, so the next Flush()
+	// writes it afresh.
+	Salvage bool
+}
+
+// What NewStoreOpts() found in the file.
+type LoadReport struct {
+	Collections map[string]LoadedCollection
+	Anomalies   []LoadAnomaly
+}
+
+// A collection that NewStoreOpts() found, with the totals of its
+// reachable items.
+type LoadedCollection struct {
+	NumItems, NumBytes uint64
+}
+
+// The location of an anomaly of the file, such as of a node or item
+// record that couldn't be read or of the discarded bytes of a
+// RecoveredError, and its error.  The Collection is empty for an anomaly
+// of the file as a whole.  For a skipped node, the range is of the
+// node's own record, as the records of its subtree aren't known.
+type LoadAnomaly struct {
+	Collection string
+	Offset     int64
+	Length     uint32
+	Err        error
+}
+
+// Like NewStoreEx(), but also reads every node and item of the file,
+// with their values, and returns a LoadReport of the collections found,
+// their reachable items and the anomalies, according to opts.  By
+// default, an unreadable node or item fails the open, while the bytes
+// after the last valid roots record are recovered from as by
+// NewStoreEx(), which returns a RecoveredError along with the Store and
+// the report, see OpenOptions for the Strict and Salvage modes.  The
+// report is returned even when the open fails, for the anomalies found
+// until then.  The records are read without caching them in memory,
+// except for the collections that Salvage rebuilds.
+func NewStoreOpts(file StoreFile, callbacks StoreCallbacks,
+	opts OpenOptions) (*Store, *LoadReport, error) {
+	if opts.Strict && opts.Salvage {
+		return nil, nil, errors.New("open options cannot be both strict and salvage")
+	}
+	report := &LoadReport{Collections: map[string]LoadedCollection{}}
+	s, err := NewStoreEx(file, callbacks)
+	if err != nil {
+		re, ok := err.(*RecoveredError)
+		if !ok {
+			return nil, report, err
+		}
+		report.Anomalies = append(report.Anomalies, LoadAnomaly{
+			Offset: atomic.LoadInt64(&s.size),
+			Length: uint32(re.DiscardedBytes),
+			Err:    err,
+		})
+		if opts.Strict {
+			s.Close()
+			return nil, report, err
+		}
+	}
+	for _, name := range collNames(s.collections()) {
+		if lerr := s.GetCollection(name).load(opts.Salvage, report); lerr != nil {
+			s.Close()
+			return nil, report, lerr
+		}
+	}
+	return s, report, err
+}
+
+// Reads the persisted tree of the collection into the report, and
+// rebuilds it with the readable items if salvage skipped any records.
+func (t *Collection) load(salvage bool, report *LoadReport) error {
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return err
+	}
+	defer t.openRootDecRef(rnl)
+	var lc LoadedCollection
+	numAnomalies := len(report.Anomalies)
+	err = t.loadWalk(rnl.root, salvage, report, func(i *Item, vs *itemVersions) {
+		lc.NumItems++
+		lc.NumBytes += uint64(i.NumBytes(t))
+	})
+	report.Collections[t.name] = lc
+	if err != nil || len(report.Anomalies) == numAnomalies {
+		return err
+	}
+	var items []*Item
+	var versions []*itemVersions
+	if err = t.loadWalk(rnl.root, true, nil, func(i *Item, vs *itemVersions) {
+		items = append(items, i)
+		versions = append(versions, vs)
+	}); err != nil {
+		return err
+	}
+	var r *nodeLoc
+	if len(items) == 0 {
+		r = t.mkNodeLoc(nil)
+	} else if r, err = t.mkTreap(items, versions); err != nil {
+		return err
+	}
+	if !t.rootCAS(rnl, t.mkRootNodeLoc(r)) {
+		return errors.New("concurrent mutation attempted")
+	}
+	t.lookupCacheClear()
+	t.rootDecRef(rnl)
+	return nil
+}
+
+// Visits the items of the persisted tree at nloc in ascending order,
+// with their values and prior versions, reading them through temporary
+// copies of their locs, so that they're not cached in the tree.  When
+// salvage, an unreadable node or item is appended to the report's
+// anomalies, if any, and skipped, along with the subtree of the node.
+func (t *Collection) loadWalk(nloc *nodeLoc, salvage bool, report *LoadReport,
+	visit func(i *Item, vs *itemVersions)) error {
+	loc := nloc.Loc()
+	if loc.isEmpty() {
+		return nil
+	}
+	skip := func(loc *ploc, err error) error {
+		if !salvage {
+			return err
+		}
+		if report != nil {
+			report.Anomalies = append(report.Anomalies, LoadAnomaly{
+				Collection: t.name,
+				Offset:     loc.Offset,
+				Length:     loc.Length,
+				Err:        err,
+			})
+		}
+		return nil
+	}
+	n, err := (&nodeLoc{loc: unsafe.Pointer(loc)}).read(t.store)
+	if err != nil {
+		return skip(loc, err)
+	}
+	if n == nil {
+		return nil
+	}
+	if err = t.loadWalk(&n.left, salvage, report, visit); err != nil {
+		return err
+	}
+	iloc := &itemLoc{loc: unsafe.Pointer(n.item.Loc())}
+	if i, err := iloc.read(t, true); err != nil || i == nil {
+		if err == nil {
+			err = errors.New("missing item")
+		}
+		if err = skip(n.item.Loc(), err); err != nil {
+			return err
+		}
+	} else {
+		visit(i, (*itemVersions)(atomic.LoadPointer(&iloc.versions)))
+	}
+	return t.loadWalk(&n.right, salvage, report, visit)
+}
@@ -0,0 +1,22 @@
+package gkvlite
+
+// A Logger receives warnings about internal anomalies from a Store.
+// A *log.Logger satisfies this interface.  Implementations must be
+// concurrent safe when the Store is used concurrently, and must not
+// invoke Store or Collection methods.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Sets the optional Logger of the Store, where a nil logger (the
+// default) disables logging.  This should be called before the Store
+// is used concurrently.
+func (s *Store) SetLogger(l Logger) {
+	s.logger = l
+}
+
+func (s *Store) logf(format string, v ...interface{}) {
+	if s.logger != nil {
+		s.logger.Printf("gkvlite: "+format, v...)
+	}
+}
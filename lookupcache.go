@@ -0,0 +1,182 @@
+package gkvlite
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+const lookupCacheShards = 16
+
+// A cache of the results of recent GetItem() lookups, see
+// SetLookupCache().  It caches the Items, rather than their itemLocs,
+// as the itemLocs live in nodes that are recycled once a mutation
+// replaced them, whereas an Item that the cache holds a reference on
+// stays intact.  A nil Item marks a key that's not in the collection.
+//
+// Writers invalidate the keys they mutated after they published the
+// new root, and readers only add the result of a lookup if no writer
+// published a root since they started it, which they detect with the
+// generation that writers advance before invalidating, so that readers
+// never add results of a superseded root that writers already
+// invalidated.
+type lookupCache struct {
+	// Atomic counters must be at the top for 32-bit compatibility.
+	gen, hits, misses uint64
+
+	shards [lookupCacheShards]lookupCacheShard
+}
+
+type lookupCacheShard struct {
+	m       sync.Mutex
+	entries map[string]*Item // Nil once the cache is dropped.
+	max     int
+}
+
+// Enables a cache of up to entries recent GetItem() (and Get()) results
+// for the collection, including for keys that are not found, so that
+// repeated lookups of hot keys skip the tree walk.  An entries of 0
+// disables the cache.  SetItem() and the deletes invalidate the keys
+// they mutate, and replacements of the whole root, such as by
+// FlushRevertCollection() or auto-compaction, clear the cache.  The
+// cache keeps the Items it has ItemAddRef()'ed, so its Items are not
+// released by EvictSomeItems() until the cache drops them, and a cached
+// Item whose value was evicted is looked up again for a GetItem() with
+// value.  Hits and misses are counted in Stats().  The cache carries
+// over to the Collection that SetCollection() returns for an existing
+// name.
+func (t *Collection) SetLookupCache(entries int) error {
+	if entries < 0 {
+		return errors.New("entries must be non-negative")
+	}
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	var lc *lookupCache
+	if entries > 0 {
+		lc = &lookupCache{}
+		for i := range lc.shards {
+			lc.shards[i].entries = map[string]*Item{}
+			lc.shards[i].max = (entries + lookupCacheShards - 1) / lookupCacheShards
+		}
+	}
+	if old := (*lookupCache)(atomic.SwapPointer(&t.lookups, unsafe.Pointer(lc))); old != nil {
+		old.clear(t, true)
+	}
+	return nil
+}
+
+func (t *Collection) lookupCache() *lookupCache {
+	return (*lookupCache)(atomic.LoadPointer(&t.lookups))
+}
+
+func (lc *lookupCache) shard(key []byte) *lookupCacheShard {
+	return &lc.shards[bloomHash(key)%lookupCacheShards]
+}
+
+// Returns the cached Item of the key, ItemAddRef()'ed, and whether the
+// key was cached, where a nil Item means the key is not in the
+// collection.  An Item without a value isn't a hit when withValue.
+func (lc *lookupCache) get(t *Collection, key []byte, withValue bool) (
+	i *Item, ok bool) {
+	s := lc.shard(key)
+	s.m.Lock()
+	i, ok = s.entries[string(key)]
+	if ok && i != nil {
+		if withValue && i.Val == nil {
+			i, ok = nil, false
+		} else {
+			t.store.ItemAddRef(t, i)
+		}
+	}
+	s.m.Unlock()
+	if ok {
+		atomic.AddUint64(&lc.hits, 1)
+	} else {
+		atomic.AddUint64(&lc.misses, 1)
+	}
+	return i, ok
+}
+
+// Adds the result of a lookup that started at the generation gen.
+func (lc *lookupCache) put(t *Collection, key []byte, i *Item, gen uint64) {
+	s := lc.shard(key)
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.entries == nil || atomic.LoadUint64(&lc.gen) != gen {
+		return
+	}
+	if prev, ok := s.entries[string(key)]; ok {
+		if prev != nil {
+			t.store.ItemDecRef(t, prev)
+		}
+	} else if len(s.entries) >= s.max {
+		for k, prev := range s.entries { // Drop an arbitrary entry.
+			if prev != nil {
+				t.store.ItemDecRef(t, prev)
+			}
+			delete(s.entries, k)
+			break
+		}
+	}
+	if i != nil {
+		t.store.ItemAddRef(t, i)
+	}
+	s.entries[string(key)] = i
+}
+
+// Invalidates the keys after a writer published a new root.  Invoked
+// while the writeLock is held.
+func (t *Collection) lookupCacheInvalidate(keys ...[]byte) {
+	lc := t.lookupCache()
+	if lc == nil {
+		return
+	}
+	atomic.AddUint64(&lc.gen, 1)
+	for _, key := range keys {
+		s := lc.shard(key)
+		s.m.Lock()
+		if i, ok := s.entries[string(key)]; ok {
+			if i != nil {
+				t.store.ItemDecRef(t, i)
+			}
+			delete(s.entries, string(key))
+		}
+		s.m.Unlock()
+	}
+}
+
+// Clears the cache after the root was replaced as a whole.  Invoked
+// while the writeLock is held.
+func (t *Collection) lookupCacheClear() {
+	if lc := t.lookupCache(); lc != nil {
+		lc.clear(t, false)
+	}
+}
+
+func (lc *lookupCache) clear(t *Collection, drop bool) {
+	atomic.AddUint64(&lc.gen, 1)
+	for j := range lc.shards {
+		s := &lc.shards[j]
+		s.m.Lock()
+		for _, i := range s.entries {
+			if i != nil {
+				t.store.ItemDecRef(t, i)
+			}
+		}
+		if drop {
+			s.entries = nil
+		} else if s.entries != nil {
+			s.entries = map[string]*Item{}
+		}
+		s.m.Unlock()
+	}
+}
+
+// Returns the hit and miss counts of the lookup cache.
+func (t *Collection) lookupCacheStats() (hits, misses uint64) {
+	if lc := t.lookupCache(); lc != nil {
+		return atomic.LoadUint64(&lc.hits), atomic.LoadUint64(&lc.misses)
+	}
+	return 0, 0
+}
@@ -0,0 +1,125 @@
+package gkvlite
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// A MemStoreFile is a StoreFile over a growable byte slice, for tests
+// and for ephemeral stores that keep the file format, such as to be
+// written out later with Bytes().  It's safe for the concurrent use of
+// the Store, where a writer writes while readers read.
+type MemStoreFile struct {
+	m       sync.RWMutex
+	b       []byte
+	modTime time.Time
+}
+
+// Returns an empty MemStoreFile.
+func NewMemStoreFile() *MemStoreFile {
+	return &MemStoreFile{modTime: time.Now()}
+}
+
+// Returns a MemStoreFile of a copy of b, such as of the Bytes() of
+// another MemStoreFile, or of a store file that was read into memory.
+func NewMemStoreFileBytes(b []byte) *MemStoreFile {
+	return &MemStoreFile{b: append([]byte(nil), b...), modTime: time.Now()}
+}
+
+var errMemStoreFileOffset = errors.New("MemStoreFile: negative offset")
+
+func (f *MemStoreFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errMemStoreFileOffset
+	}
+	f.m.RLock()
+	defer f.m.RUnlock()
+	if off >= int64(len(f.b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Writes p at the offset, growing the file as needed, where a gap
+// between the end of the file and the offset reads as zeros.
+func (f *MemStoreFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errMemStoreFileOffset
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.resize(off + int64(len(p)))
+	f.modTime = time.Now()
+	return copy(f.b[off:], p), nil
+}
+
+func (f *MemStoreFile) Stat() (os.FileInfo, error) {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	return memStoreFileInfo{size: int64(len(f.b)), modTime: f.modTime}, nil
+}
+
+// Shrinks the file to the size, or grows it with zeros, like the
+// Truncate() of an os.File.
+func (f *MemStoreFile) Truncate(size int64) error {
+	if size < 0 {
+		return errors.New("MemStoreFile: negative size")
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	if size < int64(len(f.b)) {
+		// Cleared, so that a later growth reads as zeros.
+		clearBytes(f.b[size:])
+		f.b = f.b[:size]
+	} else {
+		f.resize(size)
+	}
+	f.modTime = time.Now()
+	return nil
+}
+
+// Returns a copy of the bytes of the file.
+func (f *MemStoreFile) Bytes() []byte {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	return append([]byte(nil), f.b...)
+}
+
+// Grows the file to at least the size.  Invoked while the lock is held.
+func (f *MemStoreFile) resize(size int64) {
+	if size <= int64(len(f.b)) {
+		return
+	}
+	if size <= int64(cap(f.b)) {
+		f.b = f.b[:size] // The bytes past len(f.b) are zeros.
+		return
+	}
+	b := make([]byte, size, size+size/4)
+	copy(b, f.b)
+	f.b = b
+}
+
+func clearBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+type memStoreFileInfo struct {
+	size    int64
+	modTime time.Time
+}
+
+func (fi memStoreFileInfo) Name() string       { return "MemStoreFile" }
+func (fi memStoreFileInfo) Size() int64        { return fi.size }
+func (fi memStoreFileInfo) Mode() os.FileMode  { return 0666 }
+func (fi memStoreFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memStoreFileInfo) IsDir() bool        { return false }
+func (fi memStoreFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,128 @@
+package gkvlite
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Metadata are small, named properties of a collection, such as a
+// schema version, that aren't items, so they're not visited by range
+// scans nor counted by the totals.  They're kept in the collection's
+// JSON of the roots record, so, like item mutations, changes of the
+// metadata are persisted by the next Flush(), reverted by FlushRevert()
+// and copied by CopyTo() and friends.
+
+// The most bytes of metadata, keys and values together, per collection.
+const MaxMetaBytes = 64 * 1024
+
+// The Err of the LimitError that SetMeta() returns when the metadata
+// of the collection would exceed MaxMetaBytes.
+var ErrMetaTooLarge = errors.New("collection metadata too large")
+
+// Sets the named metadata property of the collection to a copy of val,
+// or removes the property when val is nil.  The change is visible at
+// once, and persisted by the next Flush().  The setting carries over to
+// the Collection that SetCollection() returns for an existing name.
+func (t *Collection) SetMeta(key string, val []byte) error {
+	if key == "" {
+		return errors.New("metadata key missing")
+	}
+	return t.setMeta(key, val)
+}
+
+// Sets the metadata blob of the collection, such as a JSON document of
+// its schema, to a copy of b, or removes it when b is nil.  The blob is
+// kept and limited with the metadata properties of SetMeta(), though
+// it's not one of them.
+func (t *Collection) SetMetaBlob(b []byte) error {
+	return t.setMeta(metaBlobKey, b)
+}
+
+// Returns the metadata blob of SetMetaBlob(), or nil if there's none.
+// The caller must not modify the result.
+func (t *Collection) GetMetaBlob() ([]byte, error) {
+	if t.store.isClosed() {
+		return nil, ErrStoreClosed
+	}
+	return t.metaMap()[metaBlobKey], nil
+}
+
+// The blob of SetMetaBlob() is the property without a key.
+const metaBlobKey = ""
+
+func (t *Collection) setMeta(key string, val []byte) error {
+	if t.store.readOnly {
+		return fmt.Errorf("%w, so cannot SetMeta()", ErrReadOnly)
+	}
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return err
+	}
+	t.openRootDecRef(rnl)
+	cur := t.metaMap()
+	meta := make(map[string][]byte, len(cur)+1)
+	size := 0
+	for k, v := range cur {
+		if k != key {
+			meta[k] = v
+			size += len(k) + len(v)
+		}
+	}
+	if val != nil {
+		meta[key] = append([]byte{}, val...)
+		size += len(key) + len(val)
+		if size > MaxMetaBytes {
+			return &LimitError{Err: ErrMetaTooLarge,
+				Limit: MaxMetaBytes, Size: uint64(size)}
+		}
+	}
+	t.storeMeta(meta)
+	return nil
+}
+
+// Returns the named metadata property of the collection, or nil if
+// there's no such property.  The caller must not modify the result.
+func (t *Collection) GetMeta(key string) ([]byte, error) {
+	if t.store.isClosed() {
+		return nil, ErrStoreClosed
+	}
+	return t.metaMap()[key], nil
+}
+
+// Returns the sorted keys of the metadata of the collection.
+func (t *Collection) ListMeta() ([]string, error) {
+	if t.store.isClosed() {
+		return nil, ErrStoreClosed
+	}
+	meta := t.metaMap()
+	res := make([]string, 0, len(meta))
+	for k := range meta {
+		if k != metaBlobKey {
+			res = append(res, k)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// The metadata map is never modified once it's stored, only replaced.
+func (t *Collection) metaMap() map[string][]byte {
+	p := atomic.LoadPointer(&t.meta)
+	if p == nil {
+		return nil
+	}
+	return *(*map[string][]byte)(p)
+}
+
+func (t *Collection) storeMeta(meta map[string][]byte) {
+	if len(meta) == 0 {
+		atomic.StorePointer(&t.meta, nil)
+		return
+	}
+	atomic.StorePointer(&t.meta, unsafe.Pointer(&meta))
+}
@@ -0,0 +1,67 @@
+package gkvlite
+
+import (
+	"expvar"
+)
+
+// A MetricsSink receives counters and gauges from a Store.  See
+// Store.SetMetricsSink() for the metric names.  Implementations must
+// be concurrent safe when the Store is used concurrently, and must
+// not invoke Store or Collection methods, as they may be called while
+// internal locks are held.
+type MetricsSink interface {
+	Counter(name string, delta int64)
+	Gauge(name string, val int64)
+}
+
+// The names of the counters that a Store reports to its MetricsSink.
+var MetricsCounters = []string{
+	"autoCompactions", "bloomFilterNegatives", "compactedBytes",
+	"compactions", "evictions", "flushBufferWrites", "flushBytes",
+	"flushes", "keyInternHits", "keyInternMisses", "nodeCacheHits",
+	"nodeCacheMisses", "nodeReads", "nodesReclaimed", "readaheads",
+	"rebalances", "rootCASFailures", "setRetries", "setsContended",
+	"valueChunks", "walCheckpoints", "walDiscardedBytes",
+}
+
+// The names of the gauges that a Store reports to its MetricsSink,
+// where flushDurationNanos is of the last Flush().
+var MetricsGauges = []string{"flushDurationNanos"}
+
+// Sets the optional MetricsSink of the Store, where a nil sink (the
+// default) disables metrics.  This should be called before the Store
+// is used concurrently.  The reported metrics are named by
+// MetricsCounters and MetricsGauges.
+func (s *Store) SetMetricsSink(sink MetricsSink) {
+	s.metrics = sink
+}
+
+// An ExpvarMetricsSink publishes Store metrics into an expvar.Map.
+type ExpvarMetricsSink struct {
+	Map *expvar.Map
+}
+
+// Returns an ExpvarMetricsSink that's published under the given
+// expvar name, which must be unique within the process.
+func NewExpvarMetricsSink(name string) *ExpvarMetricsSink {
+	return &ExpvarMetricsSink{Map: expvar.NewMap(name)}
+}
+
+func (e *ExpvarMetricsSink) Counter(name string, delta int64) {
+	e.Map.Add(name, delta)
+}
+
+func (e *ExpvarMetricsSink) Gauge(name string, val int64) {
+	v, ok := e.Map.Get(name).(*expvar.Int)
+	if !ok {
+		v = new(expvar.Int)
+		e.Map.Set(name, v)
+	}
+	v.Set(val)
+}
+
+func (s *Store) metricsCounter(name string, delta int64) {
+	if s.metrics != nil {
+		s.metrics.Counter(name, delta)
+	}
+}
@@ -0,0 +1,281 @@
+package gkvlite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// The length of the hidden sequence suffix of the stored keys of a
+// multi collection, see SetCollectionMulti().
+const multiSeqLength = 8
+
+// A MultiCollection is a view of a Collection where a key may have many
+// items, kept in their insertion order, such as for the postings of an
+// inverted index or an event log per key.  Each item is stored under
+// its key suffixed with a hidden 8-byte big-endian sequence number,
+// which orders the items of a key after the last one of the key, and
+// the methods of the view present the keys without it.  The underlying
+// Collection() holds the stored keys, which its own methods, and the
+// exports of the collection such as WriteJSON(), see as they are.
+type MultiCollection struct {
+	c *Collection
+}
+
+// Like SetCollection(), but for a multi collection, where the SetItem()
+// of the view of a key that's already in the collection appends an item
+// to those of the key, rather than replacing it, and where compare
+// orders the keys without their sequence suffixes.  Returns a view of
+// the Collection, or nil when the Store is closed.  The mode is
+// persisted with the roots, so the collection is a multi collection
+// when the file is reopened, in a field of the roots records that older
+// versions of gkvlite ignore, and a later SetCollection() of the name
+// keeps it.  CopyTo() and the backups of the store copy a multi
+// collection as one, with the stored keys, so the suffixes never show
+// up as keys of a collection that isn't.
+func (s *Store) SetCollectionMulti(name string, compare KeyCompare) *MultiCollection {
+	c := s.setCollection(name, compare, "", true)
+	if c == nil {
+		return nil
+	}
+	return &MultiCollection{c: c}
+}
+
+// Returns a view of the multi collection of the name, or nil if there's
+// no collection of the name or if it isn't a multi collection, see
+// SetCollectionMulti().
+func (s *Store) GetCollectionMulti(name string) *MultiCollection {
+	c := s.GetCollection(name)
+	if c == nil || !c.multi {
+		return nil
+	}
+	return &MultiCollection{c: c}
+}
+
+// Whether the collection is a multi collection, see SetCollectionMulti().
+func (t *Collection) IsMulti() bool {
+	return t.multi
+}
+
+// Returns the KeyCompare of the stored keys of a multi collection, which
+// orders them by their keys according to compare, and then by their
+// sequence suffixes.  A key shorter than the suffix has none, as for the
+// keys of a collection that's read as a multi collection.
+func multiKeyCompare(compare KeyCompare) KeyCompare {
+	return func(a, b []byte) int {
+		la, lb := multiKeyLength(a), multiKeyLength(b)
+		if c := compare(a[:la], b[:lb]); c != 0 {
+			return c
+		}
+		return bytes.Compare(a[la:], b[lb:])
+	}
+}
+
+// Returns the length of a stored key without its sequence suffix.
+func multiKeyLength(stored []byte) int {
+	if len(stored) < multiSeqLength {
+		return len(stored)
+	}
+	return len(stored) - multiSeqLength
+}
+
+// Returns the stored key of the key with the sequence number.
+func multiKey(key []byte, seq uint64) []byte {
+	b := make([]byte, len(key)+multiSeqLength)
+	binary.BigEndian.PutUint64(b[copy(b, key):], seq)
+	return b
+}
+
+// Returns the underlying Collection, which holds the stored keys.
+func (mc *MultiCollection) Collection() *Collection {
+	return mc.c
+}
+
+// Returns a copy of a stored item as presented by the view, whose key
+// is the stored key without its sequence suffix.
+func (mc *MultiCollection) present(i *Item) *Item {
+	if i == nil {
+		return nil
+	}
+	return &Item{Transient: i.Transient, Key: i.Key[:multiKeyLength(i.Key)],
+		Val: i.Val, Priority: i.Priority}
+}
+
+// Appends an item of the key, after the items that the key already
+// has, so that a key may have many items, see SetCollectionMulti().
+// The Item.Key is the key without a sequence suffix, and the item is
+// stored as a copy, so it's not owned by the collection.  The lookup of
+// the last item of the key and the insert aren't atomic, so an insert
+// that loses a race with a concurrent append of the key fails like
+// Insert() and is retried with the next sequence number.
+func (mc *MultiCollection) SetItem(item *Item) error {
+	if len(item.Key) == 0 {
+		return ErrNilKey
+	}
+	for {
+		seq, found, err := mc.lastSeq(item.Key)
+		if err != nil {
+			return err
+		}
+		if found {
+			seq++
+		}
+		si := &Item{Transient: item.Transient, Key: multiKey(item.Key, seq),
+			Val: item.Val, Priority: item.Priority}
+		if err = mc.c.checkItem(si); err != nil {
+			return err
+		}
+		if err = mc.c.setItemEx(si, true, nil); !errors.Is(err, ErrKeyExists) {
+			return err
+		}
+	}
+}
+
+// Returns the sequence number of the last item of the key, and whether
+// the key has any.
+func (mc *MultiCollection) lastSeq(key []byte) (seq uint64, found bool, err error) {
+	lo := multiKey(key, 0)
+	err = mc.c.VisitItemsDescend(multiKey(key, ^uint64(0)), false, func(i *Item) bool {
+		if mc.c.compare(i.Key, lo) >= 0 {
+			seq, found = binary.BigEndian.Uint64(i.Key[len(i.Key)-multiSeqLength:]), true
+		}
+		return false
+	})
+	return seq, found, err
+}
+
+// Appends the value of the key, see SetItem().
+func (mc *MultiCollection) Set(key []byte, val []byte) error {
+	return mc.SetItem(&Item{Key: key, Val: val, Priority: mc.c.store.randInt31()})
+}
+
+// Returns the value of the first item of the key in insertion order,
+// or nil if the key is not in the collection.
+func (mc *MultiCollection) Get(key []byte) (val []byte, err error) {
+	err = mc.visitKey(key, true, func(i *Item) bool {
+		val = i.Val
+		return false
+	})
+	return val, err
+}
+
+// Returns the values of the items of the key in insertion order, or
+// nil if the key is not in the collection.
+func (mc *MultiCollection) GetAll(key []byte) (vals [][]byte, err error) {
+	err = mc.visitKey(key, true, func(i *Item) bool {
+		vals = append(vals, i.Val)
+		return true
+	})
+	return vals, err
+}
+
+// Visits the items of the key in insertion order, with their stored
+// keys, until the visitor returns false.
+func (mc *MultiCollection) visitKey(key []byte, withValue bool, v ItemVisitor) error {
+	if len(key) == 0 {
+		return ErrNilKey
+	}
+	hi := multiKey(key, ^uint64(0))
+	return mc.c.VisitItemsAscend(multiKey(key, 0), withValue, func(i *Item) bool {
+		return mc.c.compare(i.Key, hi) <= 0 && v(i)
+	})
+}
+
+// Deletes all the items of the key in a single root swap, like
+// DeleteMulti(), and returns their number.  The items are looked up
+// before they're deleted, so an item that a concurrent SetItem() of the
+// key appends meanwhile may be kept.
+func (mc *MultiCollection) Delete(key []byte) (deleted uint64, err error) {
+	var keys [][]byte
+	if err = mc.visitKey(key, false, func(i *Item) bool {
+		keys = append(keys, append([]byte(nil), i.Key...))
+		return true
+	}); err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	return mc.c.DeleteMulti(keys)
+}
+
+// Deletes the item of the key that's the occurrence'th in insertion
+// order, counting from 0, and returns whether there was one.  Like for
+// Delete(), the lookup and the delete aren't atomic with respect to
+// concurrent mutations of the key.
+func (mc *MultiCollection) DeleteOne(key []byte, occurrence int) (wasDeleted bool, err error) {
+	if occurrence < 0 {
+		return false, errors.New("occurrence must be non-negative")
+	}
+	var stored []byte
+	if err = mc.visitKey(key, false, func(i *Item) bool {
+		if occurrence > 0 {
+			occurrence--
+			return true
+		}
+		stored = append([]byte(nil), i.Key...)
+		return false
+	}); err != nil || stored == nil {
+		return false, err
+	}
+	return mc.c.Delete(stored)
+}
+
+// Visits the items with keys greater-than-or-equal to the target key in
+// ascending order, where the items of a key are in insertion order,
+// until the visitor returns false.  A nil target is before every key, as
+// for Collection.VisitItemsAscend().  The visited Items are copies with
+// the keys without their sequence suffixes.
+func (mc *MultiCollection) VisitItemsAscend(target []byte, withValue bool,
+	v ItemVisitor) error {
+	if target != nil {
+		target = multiKey(target, 0)
+	}
+	return mc.c.VisitItemsAscend(target, withValue, func(i *Item) bool {
+		return v(mc.present(i))
+	})
+}
+
+// Visits the items with keys less-than the target key in descending
+// order, where the items of a key are in reverse insertion order, until
+// the visitor returns false, like VisitItemsAscend().
+func (mc *MultiCollection) VisitItemsDescend(target []byte, withValue bool,
+	v ItemVisitor) error {
+	if target != nil {
+		target = multiKey(target, 0)
+	}
+	return mc.c.VisitItemsDescend(target, withValue, func(i *Item) bool {
+		return v(mc.present(i))
+	})
+}
+
+// Returns the first item of the smallest key, or nil if the collection
+// is empty.
+func (mc *MultiCollection) MinItem(withValue bool) (*Item, error) {
+	return mc.presentWalked(mc.c.MinItem(withValue))
+}
+
+// Returns the last item of the largest key, or nil if the collection is
+// empty.
+func (mc *MultiCollection) MaxItem(withValue bool) (*Item, error) {
+	return mc.presentWalked(mc.c.MaxItem(withValue))
+}
+
+// Returns the copy of an item of MinItem() or MaxItem(), releasing the
+// reference of the walk to the item, so the copy has its own bytes, as
+// the collection may recycle the buffers of an item it no longer holds.
+func (mc *MultiCollection) presentWalked(i *Item, err error) (*Item, error) {
+	if err != nil || i == nil {
+		return nil, err
+	}
+	res := mc.present(i)
+	res.Key = append([]byte(nil), res.Key...)
+	if res.Val != nil {
+		res.Val = append([]byte{}, res.Val...)
+	}
+	mc.c.store.ItemDecRef(mc.c, i)
+	return res, nil
+}
+
+// Returns the number of items of the collection, counting every item of
+// a key.
+func (mc *MultiCollection) Count() (uint64, error) {
+	return mc.c.Count()
+}
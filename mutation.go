@@ -0,0 +1,94 @@
+package gkvlite
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// The kinds of mutations that are reported to a MutationCallback.
+type MutationOp int
+
+const (
+	MutationSet    MutationOp = iota // An item was set; val is its Val.
+	MutationDelete                   // An item was deleted; val is nil.
+	MutationFlush                    // The earlier mutations were persisted.
+)
+
+func (op MutationOp) String() string {
+	switch op {
+	case MutationSet:
+		return "set"
+	case MutationDelete:
+		return "delete"
+	case MutationFlush:
+		return "flush"
+	}
+	return "unknown"
+}
+
+// Invoked for the mutations of a Collection, see OnMutation().  The
+// key and val belong to the Collection, so they must not be modified.
+type MutationCallback func(op MutationOp, key, val []byte)
+
+// Registers a callback that's invoked after every SetItem() or
+// Delete() (including each deleted item of a DeleteMulti()) has been
+// applied to the collection, and with MutationFlush and nil key and
+// val after each Flush() that persisted the collection.  A nil
+// callback unregisters the current one.  Replacing roots, such as by
+// FlushRevert() or RemoveCollection(), isn't reported.
+//
+// The mutations of a collection with a callback are serialized with
+// the other observed mutations of the Store, see mutationLock(), so
+// the callbacks of all the collections of a Store are invoked one at a
+// time, in the order that the mutations took effect.  As a result, the
+// callback must not mutate or Flush() the same Store, which would
+// deadlock, and a slow callback slows down every observed writer.
+// Readers, and writers of collections without callbacks while there's
+// no replication log or WAL, are not blocked.  The registration carries
+// over to the Collection that SetCollection() returns for an existing
+// name.
+func (t *Collection) OnMutation(cb MutationCallback) {
+	if cb == nil {
+		atomic.StorePointer(&t.onMutation, nil)
+		return
+	}
+	atomic.StorePointer(&t.onMutation, unsafe.Pointer(&cb))
+}
+
+// Takes the locks of a mutation of the collection: its writeLock and,
+// when the mutation is observed, also the Store's notifyLock, so that
+// observed mutations of all the collections take effect and are
+// notified one at a time, while the other collections are written in
+// parallel.  Returns whether the notifyLock was taken.
+func (t *Collection) mutationLock() (notify bool) {
+	t.writeLock.Lock()
+	if t.observed() {
+		t.store.notifyLock.Lock()
+		return true
+	}
+	return false
+}
+
+func (t *Collection) mutationUnlock(notify bool) {
+	if notify {
+		t.store.notifyLock.Unlock()
+	}
+	t.writeLock.Unlock()
+}
+
+// Invoked while the mutationLock() is held.
+func (t *Collection) notifyMutation(op MutationOp, key, val []byte,
+	priority int32) {
+	if p := atomic.LoadPointer(&t.onMutation); p != nil {
+		(*(*MutationCallback)(p))(op, key, val)
+	}
+	t.store.logReplication(t.name, op, key, val, priority)
+	t.store.logWAL(t.name, op, key, val, priority)
+}
+
+// Whether notifyMutation() has anything to do.
+func (t *Collection) observed() bool {
+	return atomic.LoadPointer(&t.onMutation) != nil ||
+		(t.name != "" && (atomic.LoadInt32(&t.store.repl.active) != 0 ||
+			atomic.LoadInt32(&t.store.wal.active) != 0))
+}
@@ -3,6 +3,7 @@ package gkvlite
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"sync/atomic"
 	"unsafe"
 )
@@ -51,7 +52,6 @@ func (nloc *nodeLoc) write(o *Store) error {
 		if node == nil {
 			return nil
 		}
-		offset := atomic.LoadInt64(&o.size)
 		length := ploc_length + ploc_length + ploc_length + 8 + 8
 		b := make([]byte, length)
 		pos := 0
@@ -66,10 +66,23 @@ func (nloc *nodeLoc) write(o *Store) error {
 			return fmt.Errorf("nodeLoc.write() pos: %v didn't match length: %v",
 				pos, length)
 		}
-		if _, err := o.file.WriteAt(b, offset); err != nil {
+		offset, appended := o.appendOffset(), true
+		if o.encrypted {
+			var err error
+			if b, err = o.callbacks.Encrypt(b, offset); err != nil {
+				return err
+			}
+			length = len(b)
+		} else {
+			offset, appended = o.allocRecord(length)
+		}
+		if err := o.writeAt(b, offset); err != nil {
 			return err
 		}
-		atomic.StoreInt64(&o.size, offset+int64(length))
+		if appended {
+			atomic.StoreInt64(&o.size, offset+int64(length))
+		}
+		o.flushLogNode(nloc)
 		atomic.StorePointer(&nloc.loc,
 			unsafe.Pointer(&ploc{Offset: offset, Length: uint32(length)}))
 	}
@@ -77,28 +90,58 @@ func (nloc *nodeLoc) write(o *Store) error {
 }
 
 func (nloc *nodeLoc) read(o *Store) (n *node, err error) {
+	if nloc == nil {
+		return nil, nil
+	}
+	return nloc.readFrom(o, o.file)
+}
+
+// Like read(), but a node that's not in memory is read from r, which
+// reads the store file, such as through a readahead.
+func (nloc *nodeLoc) readFrom(o *Store, r io.ReaderAt) (n *node, err error) {
 	if nloc == nil {
 		return nil, nil
 	}
 	n = nloc.Node()
 	if n != nil {
+		if o.metrics != nil {
+			o.metrics.Counter("nodeCacheHits", 1)
+		}
 		return n, nil
 	}
 	loc := nloc.Loc()
 	if loc.isEmpty() {
 		return nil, nil
 	}
-	if loc.Length != uint32(ploc_length+ploc_length+ploc_length+8+8) {
+	defer func() {
+		err = corruptError(loc, "node read", err)
+	}()
+	if o.metrics != nil {
+		o.metrics.Counter("nodeCacheMisses", 1)
+	}
+	if loc.Length != uint32(ploc_length+ploc_length+ploc_length+8+8) &&
+		!o.encrypted {
 		return nil, fmt.Errorf("unexpected node loc.Length: %v != %v",
 			loc.Length, ploc_length+ploc_length+ploc_length+8+8)
 	}
 	b := make([]byte, loc.Length)
-	if _, err := o.file.ReadAt(b, loc.Offset); err != nil {
+	if _, err := readFull(r, b, loc.Offset); err != nil {
 		return nil, err
 	}
+	if o.metrics != nil {
+		o.metrics.Counter("nodeReads", 1)
+	}
+	if o.encrypted {
+		if b, err = o.callbacks.Decrypt(b, loc.Offset); err != nil {
+			return nil, err
+		}
+		if len(b) != ploc_length+ploc_length+ploc_length+8+8 {
+			return nil, fmt.Errorf("unexpected decrypted node length: %v != %v",
+				len(b), ploc_length+ploc_length+ploc_length+8+8)
+		}
+	}
 	pos := 0
-	atomic.AddUint64(&o.nodeAllocs, 1)
-	n = &node{}
+	n = o.allocNode()
 	var p *ploc
 	p = &ploc{}
 	p, pos = p.read(b, pos)
@@ -131,6 +174,12 @@ func numInfo(o *Store, left *nodeLoc, right *nodeLoc) (
 	if err != nil {
 		return 0, 0, 0, 0, err
 	}
+	if leftNode == nil {
+		o.warnNilNode("numInfo", left)
+	}
+	if rightNode == nil {
+		o.warnNilNode("numInfo", right)
+	}
 	if !left.isEmpty() && leftNode != nil {
 		leftNum = leftNode.numNodes
 		leftBytes = leftNode.numBytes
@@ -142,6 +191,44 @@ func numInfo(o *Store, left *nodeLoc, right *nodeLoc) (
 	return leftNum, leftBytes, rightNum, rightBytes, nil
 }
 
+// An AggregateError is returned when the numBytes aggregate of a
+// node would wrap around, such as from an ItemValLength() callback
+// that returns a negative or huge length.
+type AggregateError struct {
+	Key        []byte // Key of the node's item, if it's in memory.
+	ItemBytes  int64
+	LeftBytes  uint64
+	RightBytes uint64
+}
+
+func (e *AggregateError) Error() string {
+	return fmt.Sprintf("numBytes aggregate would wrap, key: %q,"+
+		" item bytes: %v, left bytes: %v, right bytes: %v",
+		e.Key, e.ItemBytes, e.LeftBytes, e.RightBytes)
+}
+
+// Returns the numNodes and numBytes aggregates of a node with the given
+// children and item.
+func (t *Collection) aggregates(left, right *nodeLoc, iloc *itemLoc) (
+	numNodes, numBytes uint64, err error) {
+	leftNum, leftBytes, rightNum, rightBytes, err := numInfo(t.store, left, right)
+	if err != nil {
+		return 0, 0, err
+	}
+	itemBytes := iloc.NumBytes(t)
+	childBytes := leftBytes + rightBytes
+	numBytes = childBytes + uint64(itemBytes)
+	if itemBytes < 0 || childBytes < leftBytes || numBytes < childBytes {
+		e := &AggregateError{ItemBytes: int64(itemBytes),
+			LeftBytes: leftBytes, RightBytes: rightBytes}
+		if i := iloc.Item(); i != nil {
+			e.Key = i.Key
+		}
+		return 0, 0, e
+	}
+	return leftNum + rightNum + 1, numBytes, nil
+}
+
 func dump(o *Store, n *nodeLoc, level int) {
 	if n.isEmpty() {
 		return
@@ -162,3 +249,10 @@ func dumpIndent(level int) {
 		fmt.Print(" ")
 	}
 }
+
+func (s *Store) warnNilNode(where string, n *nodeLoc) {
+	if s.logger != nil && !n.isEmpty() {
+		s.logf("%s: nil node from non-empty nodeLoc, loc: %+v",
+			where, n.Loc())
+	}
+}
@@ -2,8 +2,20 @@ package gkvlite
 
 import (
 	"encoding/binary"
+	"errors"
 )
 
+// The file offsets of the records are int64's, both in the ploc's of
+// the nodeLoc's and itemLoc's and in the records on disk, so the file
+// isn't limited to 4GB or any other packed width.  The record lengths
+// are uint32's, which bound the records rather than the file, where
+// MaxKeyLen and MaxValLen keep an item record within its length.  A
+// Flush() that would write past MaxFileSize fails with a *LimitError
+// of ErrFileTooLarge, and is rolled back, instead of wrapping around.
+const MaxFileSize = 1 << 62
+
+var ErrFileTooLarge = errors.New("store file too large")
+
 // Offset/location of a persisted range of bytes.
 type ploc struct {
 	Offset int64  `json:"o"` // Usable for os.ReadAt/WriteAt() at file offset 0.
@@ -0,0 +1,136 @@
+package gkvlite
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Values up to this length keep their buffers when their Item is
+// recycled, see UsePooledItems().
+const pooledValLenMax = 4096
+
+// A pool of Items that were allocated by ItemAlloc() and then released
+// by their last ItemDecRef(), see UsePooledItems().
+type itemPool struct {
+	items sync.Pool // Of *pooledItem.
+}
+
+type pooledItem struct {
+	item    Item // The Item.pooled of item points back here.
+	pool    *itemPool
+	refs    int32 // Atomic protected.
+	visible int32 // Atomic protected; non-zero once readers may see item unreferenced.
+	keyBuf  []byte
+	valBuf  []byte
+}
+
+// Enables or disables the recycling of the Items that the Store
+// allocates for items read from the file, together with their key and
+// small value buffers, through a sync.Pool, which reduces garbage
+// during scans of large, disk-backed collections.  This must be called
+// before the Store is used, and is not allowed with the ItemAlloc,
+// ItemAddRef, ItemDecRef or ItemValRead callbacks, which manage Items
+// themselves.
+//
+// A pooled Item is recycled when its ref-count drops back to 0, so
+// the usual ref-counting rules become binding: an Item handed to a
+// visitor is only guaranteed to stay intact until the visitor returns,
+// so a visitor that retains an Item (or its Key or Val) must
+// ItemAddRef() it and later ItemDecRef() it.  Items returned by
+// GetItem() (and Get()) are already ItemAddRef()'ed, and are recycled
+// only if the application ItemDecRef()'s them; otherwise they're left to
+// the GC like Items dropped by EvictSomeItems(), which concurrent
+// readers may still be using.
+func (s *Store) UsePooledItems(use bool) error {
+	cb := s.callbacks
+	if use && (cb.ItemAlloc != nil || cb.ItemAddRef != nil ||
+		cb.ItemDecRef != nil || cb.ItemValRead != nil) {
+		return errors.New("pooled items are not allowed with the" +
+			" ItemAlloc, ItemAddRef, ItemDecRef or ItemValRead callbacks")
+	}
+	if !use {
+		s.itemPool = nil
+	} else if s.itemPool == nil {
+		s.itemPool = &itemPool{}
+	}
+	return nil
+}
+
+// A pool of tree nodes, such as a *sync.Pool, for StoreCallbacks.NodePool,
+// which cuts the garbage of high-churn workloads, such as of servers that
+// open many short-lived Stores.  The Store gets a node from the pool
+// when its collection's free list is empty, and puts a node into the
+// pool in place of the free list once it's reclaimed, that is, when no
+// root, snapshot or visitor can reach it anymore, so the nodes are
+// shared by the Stores of the pool and may be collected by the GC if
+// it's a sync.Pool.  The pooled values are opaque, so the app must not
+// use them, and a value that's not one of the nodes, such as from the
+// New func of a sync.Pool, is dropped.  The
+// Items of the nodes aren't pooled, see UsePooledItems() and the
+// ItemAlloc and ItemDecRef callbacks.
+type NodePool interface {
+	Get() interface{}
+	Put(x interface{})
+}
+
+// Returns an empty node, from the NodePool if there's one.
+func (o *Store) allocNode() *node {
+	if p := o.callbacks.NodePool; p != nil {
+		if n, _ := p.Get().(*node); n != nil {
+			atomic.AddUint64(&o.nodePoolGets, 1)
+			*n = node{}
+			return n
+		}
+	}
+	atomic.AddUint64(&o.nodeAllocs, 1)
+	return &node{}
+}
+
+// Returns an Item with a ref-count of 1 and a Key of keyLength.
+func (p *itemPool) alloc(keyLength uint16) *Item {
+	pi, _ := p.items.Get().(*pooledItem)
+	if pi == nil {
+		pi = &pooledItem{pool: p}
+	}
+	pi.refs = 1
+	pi.visible = 0
+	if cap(pi.keyBuf) < int(keyLength) {
+		pi.keyBuf = make([]byte, keyLength)
+	}
+	pi.item = Item{Key: pi.keyBuf[:keyLength], pooled: pi}
+	return &pi.item
+}
+
+// Returns a value buffer of valLength for the pooled Item.
+func (pi *pooledItem) val(valLength uint32) []byte {
+	if cap(pi.valBuf) < int(valLength) || pi.valBuf == nil {
+		if valLength > pooledValLenMax {
+			return make([]byte, valLength)
+		}
+		pi.valBuf = make([]byte, valLength)
+	}
+	return pi.valBuf[:valLength]
+}
+
+func (pi *pooledItem) addRef() {
+	atomic.AddInt32(&pi.refs, 1)
+}
+
+func (pi *pooledItem) decRef() {
+	if atomic.AddInt32(&pi.refs, -1) != 0 || atomic.LoadInt32(&pi.visible) != 0 {
+		return
+	}
+	pi.item = Item{}
+	pi.pool.items.Put(pi)
+}
+
+// Releases a reference on an item that concurrent readers may still be
+// using without a reference of their own, such as one that's evicted
+// from its node, so a pooled item is then left to the GC.
+func (o *Store) itemDecRefVisible(c *Collection, i *Item) {
+	if i != nil && i.pooled != nil {
+		atomic.StoreInt32(&i.pooled.visible, 1)
+	}
+	o.ItemDecRef(c, i)
+}
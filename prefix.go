@@ -0,0 +1,209 @@
+package gkvlite
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"unsafe"
+)
+
+// When prefix compressed, an item record has the high bit of its
+// priority set, and an extra int64 offset of a base item record and a
+// uint16 length of the key prefix that's shared with the base after
+// the priority, and then only the rest of the key.  As with encryption,
+// the ploc.Length of the item and the record's own length field are
+// still the uncompressed length, so that NumBytes() stays meaningful.
+// A base record always has its whole key.
+const itemLoc_prefixHdrLength int = itemLoc_hdrLength + 8 + 2
+
+const itemLoc_prefixFlag = uint32(0x80000000)
+
+// Every so many prefix compressed item records, another item record
+// with its whole key becomes the base.
+const keyPrefixRestartInterval = 16
+
+// Shorter shared prefixes aren't worth the record's extra length.
+const keyPrefixMinShared = itemLoc_prefixHdrLength - itemLoc_hdrLength + 1
+
+// The state of the prefix compression of a Collection.write().
+type keyPrefixBase struct {
+	offset int64
+	key    []byte
+	n      int // Number of records that used the base.
+}
+
+// Enables or disables key prefix compression of the collection's item
+// records, which stores the key of an item that Flush() writes as the
+// length of the prefix that it shares with a recently written item
+// record of the same Flush() and the rest of the key.  As items are
+// written in key order, this saves most of the key bytes of keys with
+// long common prefixes, like paths.  Keys are reconstructed on reads,
+// so Get(), visitors, compare funcs, CopyTo() and the like always see
+// whole keys, and the item totals count whole keys.  Disabling it only
+// affects later writes.  A collection with prefix compressed records
+// notes that in the roots records, and such files can't be read by
+// older versions of gkvlite.  Not allowed with encryption or with free
+// space reuse, as the record lengths of compressed records, like those
+// of encrypted ones, aren't their lengths on disk.
+func (t *Collection) SetKeyPrefixCompression(enabled bool) error {
+	if enabled {
+		if t.store.encrypted {
+			return errors.New("cannot compress key prefixes with encryption")
+		}
+		if t.store.freeList.tracking() {
+			return errors.New("free space reuse is enabled, so cannot compress key prefixes")
+		}
+		atomic.StoreInt32(&t.keyPrefixesUsed, 1)
+		atomic.StoreInt32(&t.keyPrefixes, 1)
+	} else {
+		atomic.StoreInt32(&t.keyPrefixes, 0)
+	}
+	return nil
+}
+
+// Whether the collection may have prefix compressed item records.
+func (t *Collection) hasKeyPrefixes() bool {
+	return atomic.LoadInt32(&t.keyPrefixesUsed) != 0
+}
+
+// Whether any collection may have prefix compressed item records.
+func (s *Store) hasKeyPrefixes() bool {
+	for _, c := range s.collections() {
+		if c.hasKeyPrefixes() {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the base record offset and the shared prefix length for the
+// prefix compression of a key that's about to be written, if any.
+func (t *Collection) keyPrefixFor(key []byte) (base int64, shared int, ok bool) {
+	b := t.prefixBase
+	if b == nil || b.n >= keyPrefixRestartInterval {
+		return 0, 0, false
+	}
+	for shared < len(key) && shared < len(b.key) && key[shared] == b.key[shared] {
+		shared++
+	}
+	return b.offset, shared, shared >= keyPrefixMinShared
+}
+
+// Notes an item record that was written at offset, which becomes the
+// base of the next records unless it was prefix compressed.
+func (t *Collection) keyPrefixWritten(key []byte, offset int64, compressed bool) {
+	if compressed {
+		t.prefixBase.n++
+	} else if atomic.LoadInt32(&t.keyPrefixes) != 0 {
+		t.prefixBase = &keyPrefixBase{offset: offset, key: key}
+	}
+}
+
+// Writes a prefix compressed item record.
+func (i *itemLoc) writePrefixed(c *Collection, iItem *Item, hdr []byte,
+	base int64, shared int, vlength int, ilength int) error {
+	suffix := iItem.Key[shared:]
+	b := make([]byte, itemLoc_prefixHdrLength+len(suffix))
+	pos := copy(b, hdr[:itemLoc_hdrLength])
+	priority := binary.BigEndian.Uint32(b[pos-4 : pos])
+	binary.BigEndian.PutUint32(b[pos-4:pos], priority|itemLoc_prefixFlag)
+	binary.BigEndian.PutUint64(b[pos:pos+8], uint64(base))
+	pos += 8
+	binary.BigEndian.PutUint16(b[pos:pos+2], uint16(shared))
+	pos += 2
+	pos += copy(b[pos:], suffix)
+	offset := c.store.appendOffset()
+	if err := c.store.writeAt(b, offset); err != nil {
+		return err
+	}
+	if err := c.store.ItemValWrite(c, iItem, c.store.recordWriter(),
+		offset+int64(pos)); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&c.store.size, offset+int64(pos+vlength))
+	c.store.flushLogItem(i)
+	atomic.StorePointer(&i.loc,
+		unsafe.Pointer(&ploc{Offset: offset, Length: uint32(ilength)}))
+	c.keyPrefixWritten(iItem.Key, offset, true)
+	return nil
+}
+
+// What the extended header of an item record says besides its key.
+type itemExt struct {
+	chunked  bool   // See SetValueChunking().
+	versions []ploc // See SetKeepVersions().
+}
+
+// Reads the key of an item record at loc with an extended header, which
+// is prefix compressed, chunked or versioned, from r into key, returning
+// the offset of the value, or of the chunk list, when chunked.
+func (c *Collection) readExtendedKey(r io.ReaderAt, loc *ploc,
+	key []byte) (voffset int64, ext itemExt, err error) {
+	b := make([]byte, itemLoc_prefixHdrLength-itemLoc_hdrLength)
+	if _, err := readFull(r, b, loc.Offset+int64(itemLoc_hdrLength)); err != nil {
+		return 0, ext, err
+	}
+	base := int64(binary.BigEndian.Uint64(b[0:8]))
+	shared := int(binary.BigEndian.Uint16(b[8:10]))
+	if uint64(base) == itemLoc_chunksBase && shared == 0 {
+		voffset, err = readChunkedKey(r, loc, key)
+		return voffset, itemExt{chunked: true}, err
+	}
+	if uint64(base) == itemLoc_versionsBase {
+		voffset, ext.versions, err = readVersionedKey(r, loc, shared, key)
+		return voffset, ext, err
+	}
+	if shared > len(key) || base < 0 || base >= loc.Offset {
+		return 0, ext, fmt.Errorf("unexpected key prefix, base: %v, shared: %v,"+
+			" item loc: %v", base, shared, loc)
+	}
+	prefix, err := c.readBaseKey(r, base)
+	if err != nil {
+		return 0, ext, err
+	}
+	if len(prefix) < shared {
+		return 0, ext, fmt.Errorf("key prefix base too short: %v < %v, base: %v",
+			len(prefix), shared, base)
+	}
+	copy(key, prefix[:shared])
+	voffset = loc.Offset + int64(itemLoc_prefixHdrLength+len(key)-shared)
+	if shared < len(key) {
+		if _, err := readFull(r, key[shared:],
+			voffset-int64(len(key)-shared)); err != nil {
+			return 0, ext, err
+		}
+	}
+	return voffset, ext, nil
+}
+
+// The last base record key that was read, as the records of a scan
+// mostly share their base.
+type keyPrefixCache struct {
+	offset int64
+	key    []byte
+}
+
+// Returns the whole key of the base item record at offset, read from r.
+func (c *Collection) readBaseKey(r io.ReaderAt, offset int64) ([]byte, error) {
+	if p := (*keyPrefixCache)(atomic.LoadPointer(&c.prefixCache)); p != nil &&
+		p.offset == offset {
+		return p.key, nil
+	}
+	b := make([]byte, itemLoc_hdrLength)
+	if _, err := readFull(r, b, offset); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(b[10:14])&itemLoc_prefixFlag != 0 {
+		return nil, fmt.Errorf("key prefix base is prefix compressed, base: %v",
+			offset)
+	}
+	key := make([]byte, binary.BigEndian.Uint16(b[4:6]))
+	if _, err := readFull(r, key, offset+int64(itemLoc_hdrLength)); err != nil {
+		return nil, err
+	}
+	atomic.StorePointer(&c.prefixCache,
+		unsafe.Pointer(&keyPrefixCache{offset: offset, key: key}))
+	return key, nil
+}
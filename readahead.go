@@ -0,0 +1,194 @@
+package gkvlite
+
+import (
+	"io"
+)
+
+// A scan of a cold store reads its nodes and items one small ReadAt()
+// at a time, in tree order, so slow or remote StoreFiles make it slow.
+// But a Flush() writes the records of a subtree as a contiguous range
+// of the file, from the item of its leftmost node to its root node, see
+// writeRecords().  A readahead scan reads the range of a subtree that
+// fits the readahead size with one ReadAt(), and serves the reads of
+// the subtree's records from it.  As a Flush() writes the children of a
+// node before the node, all the nodes and items of a persisted subtree
+// are persisted, and the root of the visit keeps their records live, so
+// they're never written over meanwhile, even with free space reuse.
+// Dirty nodes and items, which are only in memory, are not in such
+// subtrees, and are served from memory.  The records of a subtree that
+// span several Flush()'es may not all be in its range, and are read
+// from the file.
+
+// Options of VisitItemsAscendOpts() and VisitItemsDescendOpts().
+type VisitorOptions struct {
+	// Whether the records of the visited subtrees are read ahead.
+	Readahead bool
+
+	// The most bytes of the range of a subtree that are read ahead,
+	// where 0 means DefaultReadaheadBytes.
+	ReadaheadBytes int
+}
+
+// The default of VisitorOptions.ReadaheadBytes.
+const DefaultReadaheadBytes = 1 << 20
+
+// Like VisitItemsAscend(), with the given options.
+func (t *Collection) VisitItemsAscendOpts(target []byte, withValue bool,
+	opts VisitorOptions, visitor ItemVisitor) error {
+	if !opts.Readahead || t.store.file == nil {
+		return t.VisitItemsAscend(target, withValue, visitor)
+	}
+	return t.visitReadahead(target, withValue, opts, visitor, ascendChoice)
+}
+
+// Like VisitItemsDescend(), with the given options.
+func (t *Collection) VisitItemsDescendOpts(target []byte, withValue bool,
+	opts VisitorOptions, visitor ItemVisitor) error {
+	if !opts.Readahead || t.store.file == nil {
+		return t.VisitItemsDescend(target, withValue, visitor)
+	}
+	return t.visitReadahead(target, withValue, opts, visitor, descendChoice)
+}
+
+func (t *Collection) visitReadahead(target []byte, withValue bool,
+	opts VisitorOptions, visitor ItemVisitor,
+	choiceFunc func(int, *node) (bool, *nodeLoc, *nodeLoc)) error {
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return err
+	}
+	defer t.openRootDecRef(rnl)
+	ra := &readahead{s: t.store, max: int64(opts.ReadaheadBytes)}
+	if ra.max <= 0 {
+		ra.max = DefaultReadaheadBytes
+	}
+	_, err = ra.visit(t, rnl.root, target, withValue, visitor, 0, choiceFunc)
+	return err
+}
+
+// The state of a readahead scan, which is used by one goroutine.
+type readahead struct {
+	s   *Store
+	max int64
+	ext raExtent
+}
+
+// An extent of the file that's read ahead on its first read.
+type raExtent struct {
+	active   bool // Whether it's of a subtree being visited.
+	beg, end int64
+	buf      []byte // Once read, of the extent from beg.
+	read     bool
+}
+
+// Like visitItemLocs(), but the records are read through the extent of
+// the outermost subtree whose range fits.
+func (ra *readahead) visit(t *Collection, n *nodeLoc, target []byte,
+	withValue bool, visitor ItemVisitor, depth uint64,
+	choiceFunc func(int, *node) (bool, *nodeLoc, *nodeLoc)) (bool, error) {
+	r := raReader{ra}
+	nNode, err := n.readFrom(t.store, r)
+	if err != nil {
+		return false, err
+	}
+	if n.isEmpty() || nNode == nil {
+		return true, nil
+	}
+	if err = t.store.checkDepth(depth); err != nil {
+		return false, err
+	}
+	if !ra.ext.active {
+		entered, err := ra.enter(t, n, nNode)
+		if err != nil {
+			return false, err
+		}
+		if entered {
+			defer func() { ra.ext.active = false }()
+		}
+	}
+	nItem, err := nNode.item.readFrom(t, false, r)
+	if err != nil {
+		return false, err
+	}
+	choice, choiceT, choiceF := choiceFunc(t.compareTarget(target, nItem.Key), nNode)
+	if choice {
+		keepGoing, err := ra.visit(t, choiceT, target, withValue, visitor,
+			depth+1, choiceFunc)
+		if err != nil || !keepGoing {
+			return false, err
+		}
+		if withValue {
+			if nItem, err = nNode.item.readFrom(t, true, r); err != nil {
+				return false, err
+			}
+		}
+		if !visitor(nItem) {
+			return false, nil
+		}
+	}
+	return ra.visit(t, choiceF, target, withValue, visitor, depth+1, choiceFunc)
+}
+
+// Sets the extent to the range of the subtree at n, if it fits, and
+// returns whether it did.  The range ends with the root node of the
+// subtree, and starts with the first record along its left spine,
+// which is the item of its leftmost node when it was written at once.
+func (ra *readahead) enter(t *Collection, n *nodeLoc,
+	nNode *node) (bool, error) {
+	loc := n.Loc()
+	if loc.isEmpty() {
+		return false, nil // Dirty, so its children may still fit.
+	}
+	beg, end := loc.Offset, loc.Offset+int64(loc.Length)
+	for s, sNode := n, nNode; sNode != nil && !s.isEmpty(); {
+		if l := s.Loc(); !l.isEmpty() && l.Offset < beg {
+			beg = l.Offset
+		}
+		if l := sNode.item.Loc(); !l.isEmpty() && l.Offset < beg {
+			beg = l.Offset
+		}
+		if end-beg > ra.max {
+			return false, nil
+		}
+		s = &sNode.left
+		var err error
+		if sNode, err = s.readFrom(t.store, raReader{ra}); err != nil {
+			return false, err
+		}
+	}
+	ra.ext = raExtent{active: true, beg: beg, end: end, buf: ra.ext.buf[:0]}
+	return true, nil
+}
+
+// Reads the file through the extent of a readahead.
+type raReader struct {
+	ra *readahead
+}
+
+func (r raReader) ReadAt(p []byte, off int64) (int, error) {
+	ra, e := r.ra, &r.ra.ext
+	end := off + int64(len(p))
+	if e.active && off >= e.beg && end <= e.end {
+		if !e.read {
+			e.buf = growBuf(e.buf, int(e.end-e.beg))
+			n, err := readFull(ra.s.file, e.buf, e.beg)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return 0, err
+			}
+			e.buf, e.read = e.buf[:n], true
+			ra.s.metricsCounter("readaheads", 1)
+		}
+		if end-e.beg <= int64(len(e.buf)) {
+			return copy(p, e.buf[off-e.beg:]), nil
+		}
+	}
+	return ra.s.file.ReadAt(p, off)
+}
+
+// Returns b resized to n bytes, reusing its capacity.
+func growBuf(b []byte, n int) []byte {
+	if cap(b) >= n {
+		return b[:n]
+	}
+	return make([]byte, n)
+}
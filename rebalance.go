@@ -0,0 +1,225 @@
+package gkvlite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"unsafe"
+)
+
+// A treap is only as balanced as its priorities are random, so items
+// set with skewed priorities, such as from a buggy or adversarial
+// source, can make the tree tall and its operations slow.  Rebalance()
+// is the safety net, which rebuilds the tree with fresh priorities.
+// Compact() rebuilds the tree with the same priorities, for the next
+// Flush() to rewrite it.
+
+// Configuration of the auto-rebalancing, see SetAutoRebalance().
+type rebalanceConfig struct {
+	depthFactor float64
+
+	// The numSets of the next depth check, protected by the writeLock.
+	nextCheck uint64
+}
+
+// Rebuilds the tree of the collection with fresh random priorities from
+// the Store's random source, see SetRand(), so that its depth is again
+// logarithmic in its number of items.  The items keep their keys and
+// values, and the new tree replaces the root with a single root swap,
+// so that readers and snapshots see either the old or the new tree.
+// All the items are read with their values into memory, and all of
+// them are dirty afterwards, so the next Flush() rewrites the whole
+// collection, where the items keep their prior versions, see
+// SetKeepVersions().  The rebuild isn't a mutation of the items, so it's not
+// notified to OnMutation() callbacks nor replicated, and so the trees
+// of replicas keep their own priorities.
+func (t *Collection) Rebalance() error {
+	if t.store.readOnly {
+		return fmt.Errorf("%w, so cannot Rebalance()", ErrReadOnly)
+	}
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	if t.store.isClosed() {
+		return ErrStoreClosed
+	}
+	return t.rebalance_unlocked()
+}
+
+// Rewrites the live nodes and items of the collection, and only of the
+// collection, such as of one that churns while the others are static,
+// whereas CopyTo() rewrites the whole Store.  Like Rebalance(), but
+// keeping the priorities and so the shape of the tree, it replaces the
+// tree with dirty copies of its nodes and items with a single root
+// swap, so that readers and snapshots see either the old or the new
+// tree, and the next Flush() writes the collection afresh as one
+// contiguous range of the file, see writeRecords().  The persisted
+// records of the old tree are then dead, and their bytes, as counted by
+// the CompactReclaimedBytes of Stats(), are reclaimed by free space
+// reuse, see SetReuseFreeSpace(), which Compact() needs, as otherwise
+// they'd stay dead until a CopyTo().  The prior versions of the items,
+// see SetKeepVersions(), aren't rewritten.
+func (t *Collection) Compact() error {
+	if t.store.readOnly {
+		return fmt.Errorf("%w, so cannot Compact()", ErrReadOnly)
+	}
+	if !t.store.freeList.tracking() {
+		return errors.New("free space reuse is not enabled, so cannot Compact()")
+	}
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	if t.store.isClosed() {
+		return ErrStoreClosed
+	}
+	deadBytes, err := t.rebuild_unlocked(false)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&t.numCompactions, 1)
+	atomic.AddUint64(&t.compactedBytes, deadBytes)
+	t.store.metricsCounter("compactions", 1)
+	t.store.metricsCounter("compactedBytes", int64(deadBytes))
+	return nil
+}
+
+// Like Rebalance(), but the caller holds the collection's writeLock.
+func (t *Collection) rebalance_unlocked() error {
+	if _, err := t.rebuild_unlocked(true); err != nil {
+		return err
+	}
+	t.store.metricsCounter("rebalances", 1)
+	return nil
+}
+
+// Rebuilds the tree with dirty copies of its items, with fresh
+// priorities unless not fresh, and returns the bytes of the persisted
+// records of the old tree.  The caller holds the collection's
+// writeLock.
+func (t *Collection) rebuild_unlocked(fresh bool) (deadBytes uint64, err error) {
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return 0, err
+	}
+	defer t.openRootDecRef(rnl)
+	var items []*Item
+	var versions []*itemVersions
+	var deadLocs []*ploc
+	tracking := t.store.freeList.tracking()
+	var collect func(nloc *nodeLoc) error
+	collect = func(nloc *nodeLoc) error {
+		n, err := nloc.read(t.store)
+		if err != nil || nloc.isEmpty() || n == nil {
+			return err
+		}
+		if err = collect(&n.left); err != nil {
+			return err
+		}
+		i, err := n.item.read(t, true)
+		if err != nil {
+			return err
+		}
+		priority := i.Priority
+		if fresh {
+			priority = t.store.randInt31()
+		}
+		items = append(items, &Item{Key: i.Key, Val: i.Val, Priority: priority})
+		if loc := nloc.Loc(); !loc.isEmpty() {
+			deadBytes += uint64(loc.Length)
+		}
+		if loc := n.item.Loc(); !loc.isEmpty() {
+			deadBytes += uint64(loc.Length)
+		}
+		versions = append(versions,
+			(*itemVersions)(atomic.LoadPointer(&n.item.versions)))
+		if tracking {
+			deadLocs = append(deadLocs, n.item.Loc())
+		}
+		return collect(&n.right)
+	}
+	if err = collect(rnl.root); err != nil || len(items) == 0 {
+		return 0, err
+	}
+	r, err := t.mkTreap(items, versions)
+	if err != nil {
+		return 0, err
+	}
+	if t.store.debugLevel > 0 {
+		t.debugValidate(r, nil)
+	}
+	if !t.rootCAS(rnl, t.mkRootNodeLoc(r)) {
+		t.store.metricsCounter("rootCASFailures", 1)
+		return 0, errors.New("concurrent mutation attempted")
+	}
+	t.lookupCacheClear()
+	for _, deadLoc := range deadLocs {
+		t.addDeadLoc(rnl, deadLoc)
+	}
+	// Every node of the old tree is replaced, so all are reclaimed once
+	// the readers of the old root are done.
+	t.reclaimMarkUpdate(rnl.root, nil, &rnl.reclaimMark)
+	t.rootDecRef(rnl)
+	return deadBytes, nil
+}
+
+// Enables the auto-rebalancing of the collection, where a SetItem()
+// that finds the tree deeper than depthFactor times the base 2 log of
+// its number of items invokes Rebalance(); a depthFactor of 0 disables
+// it.  As the expected depth of a treap of random priorities is below
+// 3 times that log, depthFactor must be at least 3.  The depth is
+// checked once per as many sets as there are items, by a walk of the
+// in-memory nodes only, like the ApproxDepth of Stats(), so that the
+// check's cost is amortized.  A failed rebuild is logged, and doesn't
+// fail the SetItem(), whose item is set either way.  The setting
+// carries over to the Collection that SetCollection() returns for an
+// existing name.
+func (t *Collection) SetAutoRebalance(depthFactor float64) error {
+	if depthFactor != 0 && !(depthFactor >= 3) {
+		return errors.New("rebalance depth factor must be 0 or at least 3")
+	}
+	if depthFactor == 0 {
+		atomic.StorePointer(&t.rebalance, nil)
+		return nil
+	}
+	atomic.StorePointer(&t.rebalance,
+		unsafe.Pointer(&rebalanceConfig{depthFactor: depthFactor}))
+	return nil
+}
+
+// Invoked by a SetItem() while the mutationLock() is held, with the
+// new root.
+func (t *Collection) maybeRebalance(root *nodeLoc) {
+	c := (*rebalanceConfig)(atomic.LoadPointer(&t.rebalance))
+	if c == nil {
+		return
+	}
+	numSets := atomic.LoadUint64(&t.numSets)
+	if numSets < c.nextCheck {
+		return
+	}
+	n := root.Node()
+	if n == nil || root.isEmpty() {
+		return
+	}
+	c.nextCheck = numSets + n.numNodes
+	if float64(residentDepth(root)) <=
+		c.depthFactor*math.Log2(float64(n.numNodes)+1) {
+		return
+	}
+	if err := t.rebalance_unlocked(); err != nil {
+		t.store.logf("auto-rebalance failed, coll: %v, err: %v", t.name, err)
+	}
+}
+
+// Returns the depth of the in-memory part of a tree, where a root
+// alone is of depth 1.
+func residentDepth(nloc *nodeLoc) uint64 {
+	n := nloc.Node()
+	if n == nil || nloc.isEmpty() {
+		return 0
+	}
+	left, right := residentDepth(&n.left), residentDepth(&n.right)
+	if left > right {
+		return 1 + left
+	}
+	return 1 + right
+}
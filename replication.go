@@ -0,0 +1,212 @@
+package gkvlite
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// The replication log format: a header of REPLICATION_MAGIC and a
+// uint32 REPLICATION_VERSION, followed by one entry per mutation, each
+// as a uint64 sequence number, a uint8 MutationOp, a uint32 priority, a
+// uint32 collection name length, a uint32 key length and a uint32 value
+// length, then the collection name, key and value bytes.  Sequence
+// numbers increase by one per entry.  All integers are big-endian.
+const REPLICATION_VERSION = uint32(1)
+
+var REPLICATION_MAGIC []byte = []byte("0g1r2l")
+
+const replication_entryHdrLength int = 8 + 1 + 4 + 4 + 4 + 4
+
+// Replication state of a Store, see StartReplicationLog() and
+// ApplyReplicationLog().
+type replication struct {
+	log    *replicationLog // Protected by Store.notifyLock.
+	seq    uint64          // Last logged sequence number; protected by Store.notifyLock.
+	active int32           // Atomic protected; non-zero while log is non-nil.
+
+	applyLock sync.Mutex // Serializes ApplyReplicationLog().
+	applied   uint64     // Last applied sequence number; protected by applyLock.
+}
+
+type replicationLog struct {
+	w   io.Writer
+	hdr []byte
+	err error // The first write error, which stops the log.
+}
+
+// Starts recording every SetItem() and Delete() (including each
+// deleted item of a DeleteMulti()) of the named collections of the
+// Store to w, in the order that they take effect, for replay by
+// ApplyReplicationLog() on another Store.  While the log is started,
+// the mutations of the named collections are serialized, as they're
+// observed (see OnMutation()), and entries are written to w while they
+// are, so a slow w slows down every writer; w may be wrapped in a
+// bufio.Writer, which then must be flushed after StopReplicationLog().
+// Creating a collection, an empty SetCollection(), RemoveCollection()
+// and FlushRevert() are not recorded.  Sequence numbers continue across
+// logs of the same Store, starting at 1 for a newly opened Store.
+func (s *Store) StartReplicationLog(w io.Writer) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.lockCollections(s.collections())()
+	s.notifyLock.Lock()
+	defer s.notifyLock.Unlock()
+	if s.isClosed() {
+		return ErrStoreClosed
+	}
+	if s.repl.log != nil {
+		return errors.New("replication log already started")
+	}
+	hdr := make([]byte, len(REPLICATION_MAGIC)+4)
+	copy(hdr, REPLICATION_MAGIC)
+	binary.BigEndian.PutUint32(hdr[len(REPLICATION_MAGIC):], REPLICATION_VERSION)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	s.repl.log = &replicationLog{w: w, hdr: make([]byte, replication_entryHdrLength)}
+	atomic.StoreInt32(&s.repl.active, 1)
+	return nil
+}
+
+// Stops the replication log of StartReplicationLog().  Returns the
+// error of a failed write to the log, after which no further entries
+// were written, as mutations never fail due to the log.
+func (s *Store) StopReplicationLog() error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.lockCollections(s.collections())()
+	s.notifyLock.Lock()
+	defer s.notifyLock.Unlock()
+	l := s.repl.log
+	if l == nil {
+		return errors.New("no replication log started")
+	}
+	s.repl.log = nil
+	atomic.StoreInt32(&s.repl.active, 0)
+	return l.err
+}
+
+// Invoked for every mutation, while the notifyLock is held when the
+// log is started.
+func (s *Store) logReplication(name string, op MutationOp,
+	key, val []byte, priority int32) {
+	if name == "" || op == MutationFlush || atomic.LoadInt32(&s.repl.active) == 0 {
+		return
+	}
+	l := s.repl.log
+	if l == nil {
+		return
+	}
+	s.repl.seq++
+	if l.err != nil {
+		return
+	}
+	binary.BigEndian.PutUint64(l.hdr[0:8], s.repl.seq)
+	l.hdr[8] = byte(op)
+	binary.BigEndian.PutUint32(l.hdr[9:13], uint32(priority))
+	binary.BigEndian.PutUint32(l.hdr[13:17], uint32(len(name)))
+	binary.BigEndian.PutUint32(l.hdr[17:21], uint32(len(key)))
+	binary.BigEndian.PutUint32(l.hdr[21:25], uint32(len(val)))
+	b := make([]byte, 0, len(l.hdr)+len(name)+len(key)+len(val))
+	b = append(append(append(append(b, l.hdr...), name...), key...), val...)
+	_, l.err = l.w.Write(b) // A single Write() per entry.
+}
+
+// Replays a replication log, as written by StartReplicationLog(), onto
+// the Store, creating missing collections with the default compare
+// func.  Entries whose sequence number is not above the last applied
+// one, such as when the same log is applied again, are skipped, so a
+// log can be re-applied from its start after a failure.  A log that
+// ends within an entry returns io.ErrUnexpectedEOF, with the entries
+// before it applied.  The applied position is not persisted, see
+// ReplicationApplied().  The replayed mutations go through SetItem()
+// and Delete(), so they are logged again by the Store's own
+// replication log, if any.
+func (s *Store) ApplyReplicationLog(r io.Reader) (err error) {
+	s.repl.applyLock.Lock()
+	defer s.repl.applyLock.Unlock()
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(REPLICATION_MAGIC))
+	if _, err = io.ReadFull(br, magic); err != nil {
+		return err
+	}
+	if string(magic) != string(REPLICATION_MAGIC) {
+		return errors.New("not a replication log, bad magic")
+	}
+	var version uint32
+	if err = binary.Read(br, binary.BigEndian, &version); err != nil {
+		return err
+	}
+	if version != REPLICATION_VERSION {
+		return fmt.Errorf("replication log version mismatch: "+
+			"current version: %v != found version: %v",
+			REPLICATION_VERSION, version)
+	}
+	hdr := make([]byte, replication_entryHdrLength)
+	for {
+		if _, err = io.ReadFull(br, hdr); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		seq := binary.BigEndian.Uint64(hdr[0:8])
+		op := MutationOp(hdr[8])
+		priority := int32(binary.BigEndian.Uint32(hdr[9:13]))
+		nameLength := binary.BigEndian.Uint32(hdr[13:17])
+		keyLength := binary.BigEndian.Uint32(hdr[17:21])
+		valLength := binary.BigEndian.Uint32(hdr[21:25])
+		if keyLength > MaxKeyLen {
+			return fmt.Errorf("replication log key length too long: %v, seq: %v",
+				keyLength, seq)
+		}
+		b := make([]byte, int(nameLength)+int(keyLength)+int(valLength))
+		if _, err = io.ReadFull(br, b); err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if seq <= s.repl.applied {
+			continue
+		}
+		name := string(b[:nameLength])
+		key := b[nameLength : nameLength+keyLength]
+		c := s.GetCollection(name)
+		if c == nil {
+			c = s.SetCollection(name, nil)
+		}
+		switch op {
+		case MutationSet:
+			err = c.SetItem(&Item{
+				Key:      key,
+				Val:      b[nameLength+keyLength:],
+				Priority: priority,
+			})
+		case MutationDelete:
+			_, err = c.Delete(key)
+		default:
+			err = fmt.Errorf("unknown replication log op: %v", op)
+		}
+		if err != nil {
+			return fmt.Errorf("replication log seq: %v: %v", seq, err)
+		}
+		s.repl.applied = seq
+	}
+}
+
+// Returns the sequence number of the last entry that
+// ApplyReplicationLog() applied to the Store, or 0.
+func (s *Store) ReplicationApplied() uint64 {
+	s.repl.applyLock.Lock()
+	defer s.repl.applyLock.Unlock()
+	return s.repl.applied
+}
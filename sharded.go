@@ -0,0 +1,415 @@
+package gkvlite
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// A ShardedStore hash-partitions the keys of its collections across a
+// fixed number of Stores, one per StoreFile, so that writes of keys in
+// different shards proceed in parallel, as every shard has its own
+// writeLock.  The price is that an ordered visit of a collection is a
+// k-way merge of the ascending (or descending) streams of the shards.
+//
+// The shard count and the index of every shard are persisted in a
+// reserved collection of each shard, so a ShardedStore must be
+// reopened with the same files in the same order.  As keys are routed
+// by a hash of their bytes, a collection's KeyCompare must not treat
+// unequal byte strings as equal keys.
+type ShardedStore struct {
+	shards []*Store
+}
+
+// A ShardedCollection is a collection of a ShardedStore, made of one
+// Collection per shard.
+type ShardedCollection struct {
+	ss      *ShardedStore
+	colls   []*Collection
+	compare KeyCompare
+}
+
+// The reserved collection of every shard that records the shard count
+// and the shard's index.
+const shardsCollName = "gkvlite.shards"
+
+var shardInfoKey = []byte("info")
+
+type shardInfo struct {
+	NumShards int `json:"n"`
+	Shard     int `json:"i"`
+}
+
+// Creates or reopens a ShardedStore with one shard per file.  A new
+// ShardedStore, where no file has any collections, gets its shard
+// count recorded and flushed right away.
+func NewShardedStore(files []StoreFile) (*ShardedStore, error) {
+	return NewShardedStoreEx(files, StoreCallbacks{})
+}
+
+// Like NewShardedStore(), but with callbacks for all the shards.
+func NewShardedStoreEx(files []StoreFile,
+	callbacks StoreCallbacks) (res *ShardedStore, err error) {
+	if len(files) == 0 {
+		return nil, errors.New("no files for the shards")
+	}
+	ss := &ShardedStore{shards: make([]*Store, 0, len(files))}
+	defer func() {
+		if err != nil {
+			for _, s := range ss.shards {
+				s.Close()
+			}
+		}
+	}()
+	known := 0
+	for i, f := range files {
+		s, err := NewStoreEx(f, callbacks)
+		if err != nil {
+			return nil, err
+		}
+		ss.shards = append(ss.shards, s)
+		si, err := readShardInfo(s)
+		if err != nil {
+			return nil, err
+		}
+		if si == nil {
+			if len(s.GetCollectionNames()) > 0 {
+				return nil, fmt.Errorf("file %d has collections but is not a shard", i)
+			}
+			continue
+		}
+		if si.NumShards != len(files) {
+			return nil, fmt.Errorf("shard count mismatch, persisted: %d, files: %d",
+				si.NumShards, len(files))
+		}
+		if si.Shard != i {
+			return nil, fmt.Errorf("file %d is persisted as shard %d", i, si.Shard)
+		}
+		known++
+	}
+	if known == len(files) {
+		return ss, nil
+	}
+	if known > 0 {
+		return nil, fmt.Errorf("only %d of %d files are shards", known, len(files))
+	}
+	for i, s := range ss.shards {
+		b, err := json.Marshal(shardInfo{NumShards: len(files), Shard: i})
+		if err != nil {
+			return nil, err
+		}
+		if err = s.SetCollection(shardsCollName, nil).Set(shardInfoKey, b); err != nil {
+			return nil, err
+		}
+		if s.file != nil {
+			if err = s.Flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ss, nil
+}
+
+func readShardInfo(s *Store) (*shardInfo, error) {
+	c := s.GetCollection(shardsCollName)
+	if c == nil {
+		return nil, nil
+	}
+	b, err := c.Get(shardInfoKey)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	si := &shardInfo{}
+	if err = json.Unmarshal(b, si); err != nil {
+		return nil, err
+	}
+	return si, nil
+}
+
+// Returns the number of shards.
+func (ss *ShardedStore) NumShards() int {
+	return len(ss.shards)
+}
+
+// Returns the Store of the i'th shard, such as to flush or compact it
+// separately.
+func (ss *ShardedStore) Shard(i int) *Store {
+	return ss.shards[i]
+}
+
+// Returns the index of the shard that holds the key.
+func (ss *ShardedStore) ShardOf(key []byte) int {
+	return int(bloomHash(key) % uint64(len(ss.shards)))
+}
+
+// Like Store.SetCollection(), for every shard.
+func (ss *ShardedStore) SetCollection(name string,
+	compare KeyCompare) *ShardedCollection {
+	sc := &ShardedCollection{ss: ss, colls: make([]*Collection, len(ss.shards))}
+	for i, s := range ss.shards {
+		sc.colls[i] = s.SetCollection(name, compare)
+	}
+	sc.compare = sc.colls[0].compare
+	return sc
+}
+
+// Returns the named collection, or nil if the first shard doesn't have
+// it.
+func (ss *ShardedStore) GetCollection(name string) *ShardedCollection {
+	if name == shardsCollName {
+		return nil
+	}
+	sc := &ShardedCollection{ss: ss, colls: make([]*Collection, len(ss.shards))}
+	for i, s := range ss.shards {
+		if sc.colls[i] = s.GetCollection(name); sc.colls[i] == nil {
+			if i == 0 {
+				return nil
+			}
+			sc.colls[i] = s.SetCollection(name, sc.compare)
+		}
+		sc.compare = sc.colls[0].compare
+	}
+	return sc
+}
+
+// Returns the sorted collection names, as of the first shard.
+func (ss *ShardedStore) GetCollectionNames() []string {
+	names := ss.shards[0].GetCollectionNames()
+	res := names[:0]
+	for _, name := range names {
+		if name != shardsCollName {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// Removes the named collection from every shard.
+func (ss *ShardedStore) RemoveCollection(name string) {
+	if name == shardsCollName {
+		return
+	}
+	for _, s := range ss.shards {
+		s.RemoveCollection(name)
+	}
+}
+
+// Flushes the shards in parallel, returning the first error.  Each
+// shard has its own roots record, so a failed Flush() may leave some
+// shards flushed and others not.
+func (ss *ShardedStore) Flush() error {
+	errs := make([]error, len(ss.shards))
+	var wg sync.WaitGroup
+	for i, s := range ss.shards {
+		wg.Add(1)
+		go func(i int, s *Store) {
+			defer wg.Done()
+			errs[i] = s.Flush()
+		}(i, s)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("shard %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Closes every shard, returning the first error.
+func (ss *ShardedStore) Close() (err error) {
+	for _, s := range ss.shards {
+		if cerr := s.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Returns the Collection of the i'th shard.
+func (sc *ShardedCollection) Shard(i int) *Collection {
+	return sc.colls[i]
+}
+
+func (sc *ShardedCollection) coll(key []byte) *Collection {
+	return sc.colls[sc.ss.ShardOf(key)]
+}
+
+// Like Collection.GetItem(), on the key's shard.
+func (sc *ShardedCollection) GetItem(key []byte, withValue bool) (*Item, error) {
+	return sc.coll(key).GetItem(key, withValue)
+}
+
+// Like Collection.Get(), on the key's shard.
+func (sc *ShardedCollection) Get(key []byte) ([]byte, error) {
+	return sc.coll(key).Get(key)
+}
+
+// Like Collection.SetItem(), on the key's shard.
+func (sc *ShardedCollection) SetItem(item *Item) error {
+	return sc.coll(item.Key).SetItem(item)
+}
+
+// Like Collection.Set(), on the key's shard.
+func (sc *ShardedCollection) Set(key []byte, val []byte) error {
+	return sc.coll(key).Set(key, val)
+}
+
+// Like Collection.Delete(), on the key's shard.
+func (sc *ShardedCollection) Delete(key []byte) (bool, error) {
+	return sc.coll(key).Delete(key)
+}
+
+// Returns the totals of all the shards.
+func (sc *ShardedCollection) GetTotals() (numItems uint64, numBytes uint64, err error) {
+	for _, c := range sc.colls {
+		n, b, err := c.GetTotals()
+		if err != nil {
+			return 0, 0, err
+		}
+		numItems, numBytes = numItems+n, numBytes+b
+	}
+	return numItems, numBytes, nil
+}
+
+// Like Collection.VisitItemsAscend(), in ascending key order across
+// the shards, which are visited concurrently and merged.
+func (sc *ShardedCollection) VisitItemsAscend(target []byte, withValue bool,
+	visitor ItemVisitor) error {
+	return sc.visitMerged(target, withValue, false, visitor)
+}
+
+// Like Collection.VisitItemsDescend(), in descending key order across
+// the shards, which are visited concurrently and merged.
+func (sc *ShardedCollection) VisitItemsDescend(target []byte, withValue bool,
+	visitor ItemVisitor) error {
+	return sc.visitMerged(target, withValue, true, visitor)
+}
+
+// The items of a shard's visit, ItemAddRef()'ed, and its error, which is
+// set before items is closed.
+type shardStream struct {
+	c     *Collection
+	items chan *Item
+	head  *Item
+	err   error
+}
+
+// Starts a visit of the collection on a goroutine that streams the
+// items, until done is closed.
+func startShardStream(c *Collection, target []byte, withValue, descend bool,
+	done <-chan struct{}) *shardStream {
+	st := &shardStream{c: c, items: make(chan *Item, 64)}
+	go func() {
+		defer close(st.items)
+		visit := st.c.VisitItemsAscend
+		if descend {
+			visit = st.c.VisitItemsDescend
+		}
+		st.err = visit(target, withValue, func(i *Item) bool {
+			st.c.store.ItemAddRef(st.c, i)
+			select {
+			case st.items <- i:
+				return true
+			case <-done:
+				st.c.store.ItemDecRef(st.c, i)
+				return false
+			}
+		})
+	}()
+	return st
+}
+
+// Releases the head and the streamed items, once done is closed, which
+// waits for the visit to end.
+func (st *shardStream) drain() {
+	if st.head != nil {
+		st.c.store.ItemDecRef(st.c, st.head)
+	}
+	for i := range st.items {
+		st.c.store.ItemDecRef(st.c, i)
+	}
+}
+
+func (st *shardStream) next() bool {
+	i, ok := <-st.items
+	st.head = i
+	return ok
+}
+
+// A heap of the shard streams by their head items.
+type shardHeap struct {
+	streams []*shardStream
+	compare KeyCompare
+	descend bool
+}
+
+func (h *shardHeap) Len() int { return len(h.streams) }
+
+func (h *shardHeap) Less(a, b int) bool {
+	c := h.compare(h.streams[a].head.Key, h.streams[b].head.Key)
+	if h.descend {
+		return c > 0
+	}
+	return c < 0
+}
+
+func (h *shardHeap) Swap(a, b int) {
+	h.streams[a], h.streams[b] = h.streams[b], h.streams[a]
+}
+
+func (h *shardHeap) Push(x interface{}) {
+	h.streams = append(h.streams, x.(*shardStream))
+}
+
+func (h *shardHeap) Pop() interface{} {
+	n := len(h.streams)
+	st := h.streams[n-1]
+	h.streams = h.streams[:n-1]
+	return st
+}
+
+func (sc *ShardedCollection) visitMerged(target []byte, withValue, descend bool,
+	visitor ItemVisitor) error {
+	done := make(chan struct{}) // Closed to stop the shard visits.
+	streams := make([]*shardStream, len(sc.colls))
+	for i, c := range sc.colls {
+		streams[i] = startShardStream(c, target, withValue, descend, done)
+	}
+	defer func() {
+		close(done)
+		for _, st := range streams { // Waits for the shard visits.
+			st.drain()
+		}
+	}()
+	h := &shardHeap{compare: sc.compare, descend: descend}
+	for _, st := range streams {
+		if st.next() {
+			h.streams = append(h.streams, st)
+		} else if st.err != nil {
+			return st.err
+		}
+	}
+	heap.Init(h)
+	for h.Len() > 0 {
+		st := h.streams[0]
+		i := st.head
+		st.head = nil
+		ok := visitor(i)
+		st.c.store.ItemDecRef(st.c, i)
+		if !ok {
+			return nil
+		}
+		if st.next() {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+			if st.err != nil {
+				return st.err
+			}
+		}
+	}
+	return nil
+}
@@ -9,24 +9,87 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math/rand"
 	"os"
 	"reflect"
+	"runtime"
 	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
 // A persistable store holding collections of ordered keys & values.
 type Store struct {
 	// Atomic CAS'ed int64/uint64's must be at the top for 32-bit compatibility.
-	size       int64          // Atomic protected; file size or next write position.
-	nodeAllocs uint64         // Atomic protected; total node allocation stats.
-	coll       unsafe.Pointer // Copy-on-write map[string]*Collection.
-	file       StoreFile      // When nil, we're memory-only or no persistence.
-	callbacks  StoreCallbacks // Optional / may be nil.
-	readOnly   bool           // When true, Flush()'ing is disallowed.
+	size         int64          // Atomic protected; file size or next write position.
+	nodeAllocs   uint64         // Atomic protected; total node allocation stats.
+	nodePoolGets uint64         // Atomic protected; see AllocStats().
+	itemAddRefs  uint64         // Atomic protected; see AllocStats().
+	itemDecRefs  uint64         // Atomic protected; see AllocStats().
+	collSeq      uint64         // Atomic protected; see ListCollections().
+	rewrites     uint64         // Atomic protected; see IncrementalCopy.
+	bufferedFrom int64          // Atomic protected; 1 + offset of buffered records, or 0.
+	flushing     unsafe.Pointer // Atomic protected; *flushLog of the current Flush(), or nil.
+	reads        int64          // Atomic protected; in-flight operations, see CloseWait().
+	coll         unsafe.Pointer // Copy-on-write map[string]*Collection.
+	tags         unsafe.Pointer // Copy-on-write map[string]json.RawMessage.
+	history      unsafe.Pointer // Copy-on-write *storeHistory, see SetHistoryDepth().
+	indexes      unsafe.Pointer // Copy-on-write map[string]*collIndex, see AddIndex().
+	collsChanged unsafe.Pointer // *func(added, removed []string), see OnCollectionsChanged().
+	file         StoreFile      // When nil, we're memory-only or no persistence.
+	callbacks    StoreCallbacks // Optional / may be nil.
+	readOnly     bool           // When true, Flush()'ing is disallowed.
+	metrics      MetricsSink    // Optional / may be nil.
+	logger       Logger         // Optional / may be nil.
+	debugLevel   int            // See SetDebugValidation().
+	compareCheck bool           // See SetCompareAssertions().
+	maxKeyLen    int            // See SetLimits(); 0 means MaxKeyLen.
+	maxValLen    int            // See SetLimits(); 0 means MaxValLen.
+	maxDepth     int            // See SetMaxTreeDepth(); 0 means no limit.
+	debugRefs    *debugRefs     // Non-nil when debugLevel > 0.
+	freeList     *freeList      // Nil for memory-only and snapshot stores.
+	encrypted    bool           // When true, node & value records are encrypted.
+	discarded    int64          // Bytes after the last valid roots, on open.
+	closed       int32          // Atomic protected; non-zero once Close()'ed.
+
+	formatVersion uint32 // Atomic protected; see FormatVersion(), or 0.
+
+	autoCompact *autoCompact // Optional / may be nil; see SetAutoCompact().
+	repl        replication  // See StartReplicationLog().
+	wal         walState     // See EnableWAL().
+
+	randLock sync.Mutex
+	rand     *rand.Rand // Optional / may be nil; see SetRand().
+
+	itemPool *itemPool // Optional / may be nil; see UsePooledItems().
+
+	flushBufSize int          // See SetFlushBufferSize(); protected by writeLock.
+	flushBuf     *flushBuffer // Non-nil while buffering; protected by writeLock.
+	flushSync    bool         // See SetFlushSync(); protected by writeLock.
+	alignment    int64        // See SetAlignment(); protected by writeLock.
+
+	chunkThreshold int // See SetValueChunking(); protected by writeLock.
+	chunkSize      int // See SetValueChunking(); protected by writeLock.
+
+	// Serializes the store-wide writers (Flush(), FlushRevert() and
+	// friends), which also take the writeLocks of all the collections,
+	// in name order, so that they exclude the mutations, which only
+	// take the writeLock of their own collection.  Readers never take
+	// it.
+	writeLock sync.Mutex
+
+	// Serializes the observed mutations, see mutationLock(); taken
+	// after the writeLocks of collections.
+	notifyLock sync.Mutex
+
+	// Held by Snapshot() and by the switch to a compacted file, so that
+	// a snapshot pairs the file and size with roots of that file; see
+	// switchFile().
+	fileLock sync.Mutex
 }
 
 // The StoreFile interface is implemented by os.File.  Application
@@ -42,9 +105,10 @@ type StoreFile interface {
 type StoreCallbacks struct {
 	BeforeItemWrite, AfterItemRead ItemCallback
 
-	// Optional callback to allocate an Item with an Item.Key.  If
-	// your app uses ref-counting, the returned Item should have
-	// logical ref-count of 1.
+	// Optional callback to allocate an Item with an Item.Key, for the
+	// items read from the file.  If your app uses ref-counting, the
+	// returned Item should have logical ref-count of 1, and the Key
+	// must have keyLength, as the key is read into it.
 	ItemAlloc func(c *Collection, keyLength uint16) *Item
 
 	// Optional callback to allow you to track gkvlite's ref-counts on
@@ -54,9 +118,19 @@ type StoreCallbacks struct {
 
 	// Optional callback to allow you to track gkvlite's ref-counts on
 	// an Item.  Apps might use this for buffer management and putting
-	// Item's on a free-list.
+	// Item's on a free-list, such as a sync.Pool.  An Item whose
+	// ref-count drops to 0 is no longer referenced by the tree or by a
+	// reader with a reference of its own, but a visitor that's still
+	// running may use it until it returns, unless the Item was dropped
+	// by EvictSomeItems(), which concurrent readers may keep using
+	// unreferenced, so an app that recycles its Items shouldn't evict
+	// them, see also UsePooledItems(), which handles that.
 	ItemDecRef func(c *Collection, i *Item)
 
+	// Optional pool of the Store's tree nodes, such as a *sync.Pool,
+	// which may be shared by Stores, see NodePool.
+	NodePool NodePool
+
 	// Optional callback to control on-disk size, in bytes, of an item's value.
 	ItemValLength func(c *Collection, i *Item) int
 
@@ -73,13 +147,76 @@ type StoreCallbacks struct {
 	// Invoked when a Store is reloaded (during NewStoreEx()) from
 	// disk, this callback allows the user to optionally supply a key
 	// comparison func for each collection.  Otherwise, the default is
-	// the bytes.Compare func.
+	// the bytes.Compare func.  It's not asked for the collections with
+	// a named KeyCompare, see SetCollectionNamedCompare().
 	KeyCompareForCollection func(collName string) KeyCompare
+
+	// Optional callbacks to encrypt data at rest.  When provided, the
+	// serialized node records and item value bytes are passed through
+	// Encrypt() before being written and through Decrypt() after being
+	// read, along with their file offset so that apps can derive a
+	// per-record nonce or IV.  The ciphertext may be longer than the
+	// plaintext (such as to hold an authentication tag).  Keys and the
+	// root records stay in plaintext, but the root records note that
+	// encryption is in use, so re-opening the file fails without the
+	// callbacks.  Both callbacks must be provided together.  Note that
+	// offsets can repeat after a FlushRevert() truncates the file.
+	Encrypt func(b []byte, offset int64) ([]byte, error)
+	Decrypt func(b []byte, offset int64) ([]byte, error)
+
+	// Optional callback that NewStoreEx() invokes when the last roots
+	// record of the file has an older format version than VERSION,
+	// with both versions, see FormatVersion().  The older records stay
+	// readable, and the first Flush() upgrades the file by writing a
+	// roots record of VERSION, after which older versions of gkvlite
+	// may not read it, so the callback may back up the file first, or
+	// refuse the upgrade by returning an error, which fails the open.
+	Migrate func(old, new int) error
 }
 
 type ItemCallback func(*Collection, *Item) (*Item, error)
 
-const VERSION = uint32(4)
+// Returned by mutations, Flush() and friends once the Store is closed.
+var ErrStoreClosed = errors.New("store is closed")
+
+const VERSION = uint32(12)
+
+// Since VERSION 5, the JSON in a roots record is a rootsRecord
+// object, whereas it was just the map of collections in VERSION 4.
+// Since VERSION 6, the rootsRecord has a CRC32 of the collections JSON.
+// Since VERSION 7, the rootsRecord may have tags, whose JSON follows
+// the collections JSON in the CRC32.
+// Since VERSION 8, item records may be prefix compressed, which the
+// collection notes in its JSON, see SetKeyPrefixCompression().
+// Since VERSION 9, the JSON of a collection may note the record of its
+// bloom filter, see EnableBloomFilter().
+// Since VERSION 10, the JSON of a collection may have its metadata,
+// see SetMeta().
+// Since VERSION 11, item records may have chunked values, which the
+// collection notes in its JSON, see SetValueChunking().
+// Since VERSION 12, item records may have the locations of prior
+// versions of their items, see SetKeepVersions().
+type rootsRecord struct {
+	Collections json.RawMessage `json:"c"`
+	Encrypted   bool            `json:"e,omitempty"`
+	Checksum    uint32          `json:"k,omitempty"`
+	Free        []ploc          `json:"f,omitempty"` // See freeList.
+	Tags        json.RawMessage `json:"t,omitempty"` // See TagSnapshot().
+	Alignment   int64           `json:"a,omitempty"` // See SetAlignment().
+	Generation  uint64          `json:"g,omitempty"` // See Generation().
+	History     []historyJSON   `json:"h,omitempty"` // See SetHistoryDepth().
+
+	version uint32 // The VERSION of the record, which isn't in its JSON.
+}
+
+func (rr *rootsRecord) checksum() uint32 {
+	crc := crc32.Update(crc32.ChecksumIEEE(rr.Collections),
+		crc32.IEEETable, rr.Tags)
+	for _, h := range rr.History {
+		crc = crc32.Update(crc, crc32.IEEETable, h.Collections)
+	}
+	return crc
+}
 
 var MAGIC_BEG []byte = []byte("0g1t2r")
 var MAGIC_END []byte = []byte("3e4a5p")
@@ -92,6 +229,21 @@ func NewStore(file StoreFile) (*Store, error) {
 	return NewStoreEx(file, StoreCallbacks{})
 }
 
+// A RecoveredError is returned along with a usable Store by
+// NewStore() and NewStoreEx() when the file had bytes after its last
+// valid roots record, such as from a crash during a Flush().  The
+// Store is rolled back to that last valid roots record, and the next
+// Flush() will overwrite and truncate away the discarded bytes.  The
+// file itself is not modified by the recovery.
+type RecoveredError struct {
+	DiscardedBytes int64
+}
+
+func (e *RecoveredError) Error() string {
+	return fmt.Sprintf("recovered to last valid roots, discarded bytes: %v",
+		e.DiscardedBytes)
+}
+
 func NewStoreEx(file StoreFile,
 	callbacks StoreCallbacks) (*Store, error) {
 	coll := make(map[string]*Collection)
@@ -99,8 +251,17 @@ func NewStoreEx(file StoreFile,
 	if file == nil || !reflect.ValueOf(file).Elem().IsValid() {
 		return res, nil // Memory-only Store.
 	}
+	if (callbacks.Encrypt == nil) != (callbacks.Decrypt == nil) {
+		return nil, errors.New("Encrypt and Decrypt callbacks must be provided together")
+	}
 	res.file = file
+	res.encrypted = callbacks.Encrypt != nil
+	res.freeList = &freeList{}
+	res.flushBufSize = DefaultFlushBufferSize
 	if err := res.readRoots(); err != nil {
+		if _, ok := err.(*RecoveredError); ok {
+			return res, err
+		}
 		return nil, err
 	}
 	return res, nil
@@ -110,29 +271,73 @@ func NewStoreEx(file StoreFile,
 // the KeyCompare function on an existing Collection.  In either case,
 // a new Collection to use is returned.  A newly created Collection
 // and any mutations on it won't be persisted until you do a Flush().
+// Returns nil when the Store is closed.
 func (s *Store) SetCollection(name string, compare KeyCompare) *Collection {
+	return s.setCollection(name, compare, "", false)
+}
+
+func (s *Store) setCollection(name string, compare KeyCompare,
+	compareName string, multi bool) *Collection {
+	if s.isClosed() {
+		return nil
+	}
 	if compare == nil {
 		compare = bytes.Compare
 	}
 	for {
 		orig := atomic.LoadPointer(&s.coll)
+		if orig == nil {
+			return nil
+		}
 		coll := copyColl(*(*map[string]*Collection)(orig))
 		cnew := s.MakePrivateCollection(compare)
 		cnew.name = name
+		cnew.compareName = compareName
 		cold := coll[name]
+		if multi || cold != nil && cold.multi {
+			cnew.compare = multiKeyCompare(compare)
+			cnew.multi = true
+		}
 		if cold != nil {
-			cnew.rootLock = cold.rootLock
-			cnew.root = cold.rootAddRef()
+			cnew.takeOver(cold)
+		} else {
+			cnew.seq = atomic.AddUint64(&s.collSeq, 1)
 		}
 		coll[name] = cnew
 		if atomic.CompareAndSwapPointer(&s.coll, orig, unsafe.Pointer(&coll)) {
-			cold.closeCollection()
+			cold.closeReplaced()
+			if cold == nil {
+				s.notifyCollectionsChanged([]string{name}, nil)
+			}
 			return cnew
 		}
-		cnew.closeCollection()
+		cnew.closeReplaced()
 	}
 }
 
+// Makes the new collection t share the items and the settings of cold,
+// which it replaces.
+func (t *Collection) takeOver(cold *Collection) {
+	t.seq = cold.seq
+	t.rootLock = cold.rootLock
+	t.writeLock = cold.writeLock
+	t.frees = cold.frees
+	t.root = cold.rootAddRef()
+	t.onMutation = atomic.LoadPointer(&cold.onMutation)
+	t.interning = atomic.LoadPointer(&cold.interning)
+	t.bloom = atomic.LoadPointer(&cold.bloom)
+	t.lookups = atomic.LoadPointer(&cold.lookups)
+	t.setRetries = atomic.LoadPointer(&cold.setRetries)
+	t.meta = atomic.LoadPointer(&cold.meta)
+	t.rebalance = atomic.LoadPointer(&cold.rebalance)
+	t.subs = atomic.LoadPointer(&cold.subs)
+	t.keyPrefixes = atomic.LoadInt32(&cold.keyPrefixes)
+	t.keyPrefixesUsed = atomic.LoadInt32(&cold.keyPrefixesUsed)
+	t.valueChunksUsed = atomic.LoadInt32(&cold.valueChunksUsed)
+	t.keepVersions = atomic.LoadInt32(&cold.keepVersions)
+	t.versionsUsed = atomic.LoadInt32(&cold.versionsUsed)
+}
+
 // Returns a new, unregistered (non-named) collection.  This allows
 // advanced users to manage collections of private collections.
 func (s *Store) MakePrivateCollection(compare KeyCompare) *Collection {
@@ -140,21 +345,102 @@ func (s *Store) MakePrivateCollection(compare KeyCompare) *Collection {
 		compare = bytes.Compare
 	}
 	return &Collection{
-		store:    s,
-		compare:  compare,
-		rootLock: &sync.Mutex{},
-		root:     &rootNodeLoc{refs: 1, root: empty_nodeLoc},
+		store:     s,
+		compare:   compare,
+		rootLock:  &sync.Mutex{},
+		root:      &rootNodeLoc{refs: 1, root: empty_nodeLoc},
+		writeLock: &sync.Mutex{},
+		frees:     &freeLists{},
 	}
 }
 
+// Sets the random source of the Store, which generates the priorities
+// of Collection.Set(), the branches of EvictSomeItems() and the backoff
+// jitter of contended SetItem()s, see SetMaxSetRetries(), where nil
+// (the default) uses the package-level source of math/rand.  As that
+// source is shared by the whole process, concurrent writers to
+// different Stores contend on its lock, which a source per Store
+// avoids; a seeded source also makes the priorities, and so the tree
+// shapes, reproducible.  The Store serializes its use of r, so r must
+// not be used elsewhere, including by other Stores.
+func (s *Store) SetRand(r *rand.Rand) {
+	s.randLock.Lock()
+	s.rand = r
+	s.randLock.Unlock()
+}
+
+func (s *Store) randInt31() int32 {
+	s.randLock.Lock()
+	defer s.randLock.Unlock()
+	if s.rand == nil {
+		return rand.Int31()
+	}
+	return s.rand.Int31()
+}
+
 // Retrieves a named Collection.
 func (s *Store) GetCollection(name string) *Collection {
-	coll := *(*map[string]*Collection)(atomic.LoadPointer(&s.coll))
-	return coll[name]
+	return s.collections()[name]
 }
 
+// Returns the sorted names of the collections, without the hidden
+// collections of the secondary indexes, see AddIndex().
 func (s *Store) GetCollectionNames() []string {
-	return collNames(*(*map[string]*Collection)(atomic.LoadPointer(&s.coll)))
+	names := collNames(s.collections())
+	res := names[:0]
+	for _, name := range names {
+		if !isIndexCollName(name) {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// Returns the Count() of every collection, by name, without the hidden
+// collections of the secondary indexes, like GetCollectionNames().  The
+// counts aren't taken at the same time, so for the counts of one
+// moment, use CountAll() of a Snapshot().
+func (s *Store) CountAll() (map[string]uint64, error) {
+	coll := s.collections()
+	if coll == nil {
+		return nil, ErrStoreClosed
+	}
+	res := make(map[string]uint64, len(coll))
+	for name, c := range coll {
+		if isIndexCollName(name) {
+			continue
+		}
+		n, err := c.Count()
+		if err != nil {
+			return nil, err
+		}
+		res[name] = n
+	}
+	return res, nil
+}
+
+// Returns the current collections, which is nil once Close()'ed.
+func (s *Store) collections() map[string]*Collection {
+	cptr := atomic.LoadPointer(&s.coll)
+	if cptr == nil {
+		return nil
+	}
+	return *(*map[string]*Collection)(cptr)
+}
+
+// Takes the writeLocks of the collections, in name order, which
+// excludes their mutations, and returns a func that releases them.
+// Invoked while the Store's writeLock is held.
+func (s *Store) lockCollections(coll map[string]*Collection) (unlock func()) {
+	names := collNames(coll)
+	for _, name := range names {
+		coll[name].writeLock.Lock()
+	}
+	return func() {
+		for _, name := range names {
+			coll[name].writeLock.Unlock()
+		}
+	}
 }
 
 func collNames(coll map[string]*Collection) []string {
@@ -172,16 +458,171 @@ func collNames(coll map[string]*Collection) []string {
 func (s *Store) RemoveCollection(name string) {
 	for {
 		orig := atomic.LoadPointer(&s.coll)
+		if orig == nil {
+			return
+		}
 		coll := copyColl(*(*map[string]*Collection)(orig))
 		cold := coll[name]
 		delete(coll, name)
 		if atomic.CompareAndSwapPointer(&s.coll, orig, unsafe.Pointer(&coll)) {
 			cold.closeCollection()
+			if cold != nil {
+				s.logWALRemove(name)
+				s.notifyCollectionsChanged(nil, []string{name})
+			}
 			return
 		}
 	}
 }
 
+// Renames the collection of oldName to newName, keeping its items and
+// settings without copying any nodes, and fails if there's no
+// collection of oldName or there's already one of newName.  The
+// Collection of oldName is closed, like one that SetCollection()
+// replaced, so the renamed collection must be retrieved by
+// GetCollection(newName).  Like RemoveCollection(), the rename isn't
+// reflected into persistence until the next Flush(), which persists
+// either the old or the new name, never both.  When the file is
+// reopened, the KeyCompareForCollection callback is asked for the
+// KeyCompare of the new name, unless the collection has a named one,
+// see SetCollectionNamedCompare().  Neither an indexed collection, see
+// AddIndex(), nor the collection of an index can be renamed.  A missing
+// collection fails with ErrCollectionMissing, and an existing one of
+// newName with ErrCollectionExists, see RenameCollectionEx().
+func (s *Store) RenameCollection(oldName, newName string) error {
+	return s.RenameCollectionEx(oldName, newName, false)
+}
+
+// Like RenameCollection(), but when force is true, an existing
+// collection of newName is displaced, in the same single update of the
+// collections of the Store, so that a reader's GetCollection(newName)
+// returns either the displaced or the renamed collection, such as for
+// blue/green swaps of datasets.  The displaced Collection is closed,
+// like by RemoveCollection(), so its tree becomes reclaimable, see
+// SetReuseFreeSpace(), once the rename is persisted, where a
+// FlushRevert() of that Flush() brings back both collections.  An
+// indexed collection can't be displaced.
+func (s *Store) RenameCollectionEx(oldName, newName string, force bool) error {
+	if newName == "" {
+		return errors.New("collection name missing")
+	}
+	return s.moveCollections("RenameCollection",
+		map[string]string{oldName: newName}, force)
+}
+
+// Exchanges the collections of the names a and b, with their items and
+// settings, such as their metadata, without copying any nodes, so that
+// GetCollection(a) returns the former collection of b and the other way
+// around.  Both collections must exist.  The names are swapped with a
+// single update of the collections of the Store, so a reader sees
+// either both old or both new collections, and a Collection retrieved
+// before the swap is closed, like by RenameCollection().  The swap is
+// reflected into persistence by the next Flush(), which persists both
+// collections either before or after the swap.  As a reopened file has
+// the KeyCompare of the KeyCompareForCollection callback for each
+// name, the collections should have the same KeyCompare, unless they
+// have named ones, see SetCollectionNamedCompare().
+func (s *Store) SwapCollections(a, b string) error {
+	return s.moveCollections("SwapCollections", map[string]string{a: b, b: a}, false)
+}
+
+// Moves the collections of the keys of names to their values, where a
+// new name must be free, itself moved, or when force, is displaced.
+// The Store's writeLock and the writeLocks of the moved and displaced
+// collections are held while their Collections are replaced, which
+// excludes Flush() and their mutations, so that neither loses a
+// mutation of a moved root.
+func (s *Store) moveCollections(op string, names map[string]string,
+	force bool) error {
+	if s.readOnly {
+		return fmt.Errorf("%w, so cannot %s()", ErrReadOnly, op)
+	}
+	for oldName, newName := range names {
+		if isIndexCollName(oldName) || isIndexCollName(newName) {
+			return fmt.Errorf("cannot %s() an index collection", op)
+		}
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if err := s.walEnabledErr(op); err != nil {
+		return err
+	}
+	for {
+		orig := atomic.LoadPointer(&s.coll)
+		if orig == nil {
+			return ErrStoreClosed
+		}
+		cur := *(*map[string]*Collection)(orig)
+		colds := map[string]*Collection{}
+		displaced := map[string]*Collection{}
+		for oldName, newName := range names {
+			cold := cur[oldName]
+			if cold == nil {
+				return fmt.Errorf("%w: %s", ErrCollectionMissing, oldName)
+			}
+			if cold.indexes() != nil {
+				return fmt.Errorf("cannot %s() indexed collection: %s", op, oldName)
+			}
+			if _, moved := names[newName]; !moved && cur[newName] != nil {
+				if !force {
+					return fmt.Errorf("%w: %s", ErrCollectionExists, newName)
+				}
+				if cur[newName].indexes() != nil {
+					return fmt.Errorf("cannot %s() onto indexed collection: %s",
+						op, newName)
+				}
+				displaced[newName] = cur[newName]
+			}
+			colds[oldName] = cold
+		}
+		locked := copyColl(colds)
+		for name, c := range displaced {
+			locked[name] = c
+		}
+		unlock := s.lockCollections(locked)
+		coll := copyColl(cur)
+		for oldName := range names {
+			delete(coll, oldName)
+		}
+		var cnews []*Collection
+		for oldName, newName := range names {
+			cold := colds[oldName]
+			cnew := s.MakePrivateCollection(cold.compare)
+			cnew.name = newName
+			cnew.compareName = cold.compareName
+			cnew.multi = cold.multi
+			cnew.takeOver(cold)
+			coll[newName] = cnew
+			cnews = append(cnews, cnew)
+		}
+		swapped := atomic.CompareAndSwapPointer(&s.coll, orig, unsafe.Pointer(&coll))
+		unlock()
+		if swapped {
+			for _, cold := range colds {
+				cold.closeReplaced()
+			}
+			var added, removed []string
+			for oldName, newName := range names {
+				if _, moved := names[newName]; !moved {
+					added = append(added, newName)
+				}
+				if coll[oldName] == nil {
+					removed = append(removed, oldName)
+				}
+			}
+			for name, c := range displaced {
+				c.closeCollection()
+				removed = append(removed, name)
+			}
+			s.notifyCollectionsChanged(added, removed)
+			return nil
+		}
+		for _, cnew := range cnews {
+			cnew.closeReplaced()
+		}
+	}
+}
+
 func copyColl(orig map[string]*Collection) map[string]*Collection {
 	res := make(map[string]*Collection)
 	for name, c := range orig {
@@ -195,15 +636,26 @@ func copyColl(orig map[string]*Collection) map[string]*Collection {
 // consider having many mutations (Set()'s & Delete()'s) and then
 // have a less occasional Flush() instead of Flush()'ing after every
 // mutation.  Users may also wish to file.Sync() after a Flush() for
-// extra data-loss protection.
+// extra data-loss protection.  A Flush() that fails, such as when the
+// file's WriteAt() fails, leaves the data unpersisted as it was, so
+// the next Flush() writes it all again.
 func (s *Store) Flush() error {
+	if s.isClosed() {
+		return ErrStoreClosed
+	}
 	if s.readOnly {
-		return errors.New("readonly, so cannot Flush()")
+		return fmt.Errorf("%w, so cannot Flush()", ErrReadOnly)
 	}
 	if s.file == nil {
 		return errors.New("no file / in-memory only, so cannot Flush()")
 	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.isClosed() {
+		return ErrStoreClosed
+	}
 	coll := *(*map[string]*Collection)(atomic.LoadPointer(&s.coll))
+	defer s.lockCollections(coll)()
 	rnls := map[string]*rootNodeLoc{}
 	cnames := collNames(coll)
 	for _, name := range cnames {
@@ -215,12 +667,62 @@ func (s *Store) Flush() error {
 			coll[name].rootDecRef(rnls[name])
 		}
 	}()
-	for _, name := range cnames {
-		if err := coll[name].write(rnls[name].root); err != nil {
+	var timeBeg time.Time
+	sizeBeg := atomic.LoadInt64(&s.size)
+	if s.metrics != nil {
+		timeBeg = time.Now()
+	}
+	s.freeList.flushBeg()
+	s.flushBufferBeg()
+	defer s.flushBufferStop()
+	s.flushLogBeg()
+	unlockWAL := s.lockWAL()
+	if err := s.writeFlush(coll, cnames, rnls); err != nil {
+		unlockWAL()
+		s.flushRollback()
+		return err
+	}
+	s.flushLogEnd()
+	err := s.checkpointWAL()
+	unlockWAL()
+	if err != nil {
+		return err
+	}
+	if s.discarded > 0 { // Drop any leftovers after a recovery.
+		if err := s.file.Truncate(atomic.LoadInt64(&s.size)); err != nil {
 			return err
 		}
+		s.discarded = 0
 	}
-	return s.writeRoots(rnls)
+	if s.metrics != nil {
+		s.metrics.Counter("flushes", 1)
+		s.metrics.Counter("flushBytes", atomic.LoadInt64(&s.size)-sizeBeg)
+		s.metrics.Gauge("flushDurationNanos", int64(time.Since(timeBeg)))
+	}
+	s.notifyLock.Lock()
+	for _, name := range cnames {
+		coll[name].notifyMutation(MutationFlush, nil, nil, 0)
+	}
+	s.notifyLock.Unlock()
+	return s.maybeAutoCompact(rnls)
+}
+
+// Describes what FlushRevertEx() or FlushRevertCollection() reverted,
+// so that callers can log it.
+type RevertReport struct {
+	// The reverted collections, by name.
+	Collections map[string]RevertedCollection
+
+	// The number of file bytes that FlushRevertEx() truncated away.
+	TruncatedBytes int64
+}
+
+// The totals of a reverted collection before and after a revert, where
+// a collection that didn't exist has zero totals.  As an item that was
+// replaced counts on both sides, the differences are net changes.
+type RevertedCollection struct {
+	NumItemsBefore, NumBytesBefore uint64
+	NumItemsAfter, NumBytesAfter   uint64
 }
 
 // Reverts the last Flush(), bringing the Store back to its state at
@@ -228,27 +730,165 @@ func (s *Store) Flush() error {
 // if there were no next-to-last Flush().  This call will truncate the
 // Store file.
 func (s *Store) FlushRevert() error {
+	_, err := s.FlushRevertEx()
+	return err
+}
+
+// Like FlushRevert(), but also reports what was reverted.
+func (s *Store) FlushRevertEx() (report RevertReport, err error) {
+	if s.isClosed() {
+		return report, ErrStoreClosed
+	}
 	if s.file == nil {
-		return errors.New("no file / in-memory only, so cannot FlushRevert()")
+		return report, errors.New("no file / in-memory only, so cannot FlushRevert()")
 	}
+	var before map[string]*Collection
+	defer func() { // After the locks are released.
+		if before != nil {
+			s.notifyCollectionsChanged(diffCollNames(before, s.collections()))
+		}
+	}()
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.isClosed() {
+		return report, ErrStoreClosed
+	}
+	defer s.lockCollections(s.collections())()
+	if s.freeList.tracking() {
+		return report, errors.New("free space reuse is enabled, so cannot FlushRevert()")
+	}
+	if err = s.walEnabledErr("FlushRevert"); err != nil {
+		return report, err
+	}
+	atomic.AddUint64(&s.rewrites, 1)
+	report.Collections = map[string]RevertedCollection{}
+	for name, c := range s.collections() {
+		report.Collections[name] = revertedBefore(c)
+	}
+	sizeBeg := atomic.LoadInt64(&s.size)
 	orig := atomic.LoadPointer(&s.coll)
 	coll := make(map[string]*Collection)
 	if atomic.CompareAndSwapPointer(&s.coll, orig, unsafe.Pointer(&coll)) {
-		for _, cold := range *(*map[string]*Collection)(orig) {
+		before = *(*map[string]*Collection)(orig)
+		for _, cold := range before {
 			cold.closeCollection()
 		}
 	}
 	if atomic.LoadInt64(&s.size) > rootsLen {
 		atomic.AddInt64(&s.size, -1)
 	}
-	err := s.readRootsScan(true)
-	if err != nil {
-		return err
+	if err = s.readRootsScan(true); err != nil {
+		return report, err
+	}
+	for name, c := range s.collections() {
+		report.Collections[name] = revertedAfter(report.Collections[name], c)
 	}
+	report.TruncatedBytes = sizeBeg - atomic.LoadInt64(&s.size)
 	if s.readOnly {
-		return nil
+		return report, nil
 	}
-	return s.file.Truncate(atomic.LoadInt64(&s.size))
+	return report, s.file.Truncate(atomic.LoadInt64(&s.size))
+}
+
+// Reverts just the named collection to its previous persisted root,
+// which is its root in the latest roots record where it differs from
+// its root in the last roots record, leaving the other collections as
+// they are.  When the collection didn't exist before, it's removed.
+// Any unpersisted mutations of the collection are discarded as well.
+// Unlike FlushRevert(), the file isn't truncated, and the revert is
+// like a mutation, in that it's persisted by the next Flush().
+func (s *Store) FlushRevertCollection(name string) (report RevertReport, err error) {
+	if s.isClosed() {
+		return report, ErrStoreClosed
+	}
+	if s.readOnly {
+		return report, fmt.Errorf("%w, so cannot FlushRevertCollection()", ErrReadOnly)
+	}
+	if s.file == nil {
+		return report, errors.New("no file / in-memory only, so cannot FlushRevertCollection()")
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.isClosed() {
+		return report, ErrStoreClosed
+	}
+	if s.freeList.tracking() {
+		return report, errors.New("free space reuse is enabled, so cannot FlushRevertCollection()")
+	}
+	if err = s.walEnabledErr("FlushRevertCollection"); err != nil {
+		return report, err
+	}
+	rr, rootsLoc, err := s.scanRoots(atomic.LoadInt64(&s.size))
+	if err != nil {
+		return report, err
+	}
+	if rootsLoc == nil {
+		return report, errors.New("no Flush() to revert")
+	}
+	atomic.AddUint64(&s.rewrites, 1)
+	last, lastOk, err := rr.collectionLoc(name)
+	if err != nil {
+		return report, err
+	}
+	var prev ploc
+	var prevOk bool
+	for {
+		rr, rootsLoc, err = s.scanRoots(rootsLoc.Offset)
+		if err != nil {
+			return report, err
+		}
+		if rootsLoc == nil {
+			break // Before the first roots record, there's no collection.
+		}
+		if prev, prevOk, err = rr.collectionLoc(name); err != nil {
+			return report, err
+		}
+		if prevOk != lastOk || prev != last {
+			break
+		}
+	}
+	c := s.GetCollection(name)
+	if c == nil && !lastOk && !prevOk {
+		return report, fmt.Errorf("%w: %s", ErrCollectionMissing, name)
+	}
+	reverted := revertedBefore(c)
+	if !prevOk || rootsLoc == nil {
+		s.RemoveCollection(name)
+	} else {
+		if c == nil {
+			if c, err = s.setLoadedCollection(&rr, name); err != nil {
+				return report, err
+			}
+		}
+		if err = c.setRootLoc(&prev); err != nil {
+			return report, err
+		}
+		reverted = revertedAfter(reverted, c)
+	}
+	report.Collections = map[string]RevertedCollection{name: reverted}
+	return report, nil
+}
+
+func revertedBefore(c *Collection) (res RevertedCollection) {
+	if c != nil {
+		res.NumItemsBefore, res.NumBytesBefore, _ = c.GetTotals()
+	}
+	return res
+}
+
+func revertedAfter(res RevertedCollection, c *Collection) RevertedCollection {
+	res.NumItemsAfter, res.NumBytesAfter, _ = c.GetTotals()
+	return res
+}
+
+// Returns the persisted root location of the named collection.
+func (rr *rootsRecord) collectionLoc(name string) (p ploc, ok bool, err error) {
+	var locs map[string]ploc
+	if err = json.Unmarshal(rr.Collections, &locs); err != nil {
+		return p, false, err
+	}
+	p, ok = locs[name]
+	return p, ok, nil
 }
 
 // Returns a read-only snapshot, including any mutations on the
@@ -256,80 +896,300 @@ func (s *Store) FlushRevert() error {
 // snapshot has its mutations and Flush() operations disabled because
 // the original store "owns" writes to the StoreFile.
 func (s *Store) Snapshot() (snapshot *Store) {
-	coll := copyColl(*(*map[string]*Collection)(atomic.LoadPointer(&s.coll)))
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	coll := copyColl(s.collections())
 	res := &Store{
-		coll:      unsafe.Pointer(&coll),
-		file:      s.file,
-		size:      atomic.LoadInt64(&s.size),
-		readOnly:  true,
-		callbacks: s.callbacks,
+		coll:       unsafe.Pointer(&coll),
+		tags:       atomic.LoadPointer(&s.tags),
+		history:    atomic.LoadPointer(&s.history),
+		indexes:    atomic.LoadPointer(&s.indexes),
+		file:       s.file,
+		size:       atomic.LoadInt64(&s.size),
+		readOnly:   true,
+		callbacks:  s.callbacks,
+		metrics:    s.metrics,
+		logger:     s.logger,
+		debugLevel: s.debugLevel,
+		debugRefs:  s.debugRefs,
+		encrypted:  s.encrypted,
+		maxDepth:   s.maxDepth,
+		rewrites:   atomic.LoadUint64(&s.rewrites),
 	}
 	for _, name := range collNames(coll) {
 		collOrig := coll[name]
 		coll[name] = &Collection{
-			store:    res,
-			compare:  collOrig.compare,
-			rootLock: collOrig.rootLock,
-			root:     collOrig.rootAddRef(),
+			name:            name,
+			store:           res,
+			seq:             collOrig.seq,
+			compare:         collOrig.compare,
+			compareName:     collOrig.compareName,
+			multi:           collOrig.multi,
+			rootLock:        collOrig.rootLock,
+			root:            collOrig.rootAddRef(),
+			writeLock:       &sync.Mutex{},
+			frees:           collOrig.frees,
+			meta:            atomic.LoadPointer(&collOrig.meta),
+			keyPrefixesUsed: atomic.LoadInt32(&collOrig.keyPrefixesUsed),
+			valueChunksUsed: atomic.LoadInt32(&collOrig.valueChunksUsed),
+			versionsUsed:    atomic.LoadInt32(&collOrig.versionsUsed),
 		}
 	}
 	return res
 }
 
-func (s *Store) Close() {
-	s.file = nil
-	cptr := atomic.LoadPointer(&s.coll)
-	if cptr == nil ||
-		!atomic.CompareAndSwapPointer(&s.coll, cptr, unsafe.Pointer(nil)) {
-		return
+// Options for CloseEx().
+type CloseOptions struct {
+	// When true, the Store is Flush()'ed before it's closed, and a
+	// failed Flush() leaves the Store open.  Ignored for read-only
+	// and memory-only stores.
+	Flush bool
+
+	// When true, the StoreFile is closed too, if it's an io.Closer.
+	// Otherwise the StoreFile remains the application's to close.
+	// Don't use this when closing a snapshot, as snapshots share the
+	// StoreFile of their original Store.
+	CloseFile bool
+
+	// When true, the reads that are in flight, such as visits, are
+	// waited for before the StoreFile is closed and CloseEx() returns.
+	// It must not be used from a visitor or callback of the Store, whose
+	// own read would never end.
+	WaitReads bool
+}
+
+// Closes the Store, without flushing and without closing the
+// StoreFile; see CloseEx().
+func (s *Store) Close() error {
+	return s.CloseEx(CloseOptions{})
+}
+
+// Like Close(), but also waits for the reads that are in flight, see
+// CloseOptions.WaitReads.
+func (s *Store) CloseWait() error {
+	return s.CloseEx(CloseOptions{WaitReads: true})
+}
+
+// Closes the Store, releasing its collections, their caches and any
+// file it owns (see SetAutoCompact()).  Close waits for in-progress
+// mutations and Flush()'es, after which mutations, Flush(), FlushRevert()
+// and the copying methods return ErrStoreClosed, SetCollection() and
+// GetCollection() return nil, and reads of the Store's Collections
+// return ErrStoreClosed.  Reads that are already in flight aren't
+// waited for, unless opts.WaitReads, but finish against the items as of
+// their start, and against the StoreFile, unless it's closed by
+// opts.CloseFile.  Snapshots of the Store remain usable, unless the
+// StoreFile was closed.  Closing an already closed Store is a no-op.
+func (s *Store) CloseEx(opts CloseOptions) error {
+	if s.isClosed() {
+		return nil
 	}
-	coll := *(*map[string]*Collection)(cptr)
-	for _, name := range collNames(coll) {
-		coll[name].closeCollection()
+	if opts.Flush && !s.readOnly && s.file != nil {
+		if err := s.Flush(); err != nil {
+			return err
+		}
+	}
+	file, closed := s.closeCollections()
+	if !closed {
+		return nil
 	}
+	if opts.WaitReads {
+		for atomic.LoadInt64(&s.reads) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if c, ok := file.(io.Closer); ok && opts.CloseFile {
+		return c.Close()
+	}
+	return nil
+}
+
+// Marks the Store closed and closes its collections, once the
+// mutations and Flush()'es in progress are done, and returns the
+// StoreFile to close, unless the Store was closed meanwhile.  The
+// StoreFile is kept, as the reads in flight may still read from it.
+func (s *Store) closeCollections() (file StoreFile, closed bool) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if coll := s.collections(); coll != nil {
+		defer s.lockCollections(coll)()
+	}
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return nil, false
+	}
+	if atomic.LoadInt32(&s.wal.active) != 0 {
+		s.disableWAL()
+	}
+	file = s.file
+	if orig := s.autoCompact.close(); orig != nil {
+		file = orig // The compacted file was closed by the autoCompact.
+	}
+	if cptr := atomic.SwapPointer(&s.coll, unsafe.Pointer(nil)); cptr != nil {
+		coll := *(*map[string]*Collection)(cptr)
+		for _, name := range collNames(coll) {
+			if s.readOnly {
+				// Such as of a Snapshot(), whose roots are shared.
+				coll[name].closeReplaced()
+			} else {
+				coll[name].closeCollection()
+			}
+		}
+	}
+	return file, true
+}
+
+// Returns the format version of the file, which is the VERSION of its
+// last roots record when opened, see StoreCallbacks.Migrate, and
+// VERSION once Flush()'ed, or for a new file or a memory-only Store.
+func (s *Store) FormatVersion() int {
+	if v := atomic.LoadUint32(&s.formatVersion); v != 0 {
+		return int(v)
+	}
+	return int(VERSION)
+}
+
+func (s *Store) isClosed() bool {
+	return atomic.LoadInt32(&s.closed) != 0
 }
 
 // Copy all active collections and their items to a different file.
 // If flushEvery > 0, then during the item copying, Flush() will be
-// invoked at every flushEvery'th item and at the end of the item
-// copying.  The copy will not include any old items or nodes so the
-// copy should be more compact if flushEvery is relatively large.
+// invoked at every flushEvery'th item of a collection and at the end
+// of the item copying.  The copy will not include any old items or
+// nodes so the copy should be more compact if flushEvery is relatively
+// large.  The collections are read in parallel, by up to GOMAXPROCS
+// reader goroutines, while the calling goroutine does the writes, in
+// key order per collection.  The first error of a reader or the writer
+// stops the copy.
 func (s *Store) CopyTo(dstFile StoreFile, flushEvery int) (res *Store, err error) {
+	return s.copyTo(dstFile, flushEvery, CopyFilter{})
+}
+
+// Selects what CopyToFiltered() copies.
+type CopyFilter struct {
+	// The collections to copy, by name, where a nil filter copies the
+	// whole collection, and a nil map copies every collection whole.
+	Collections map[string]*CollectionFilter
+
+	// Whether the collections that aren't copied are created empty in
+	// the destination, with their metadata, rather than omitted.
+	KeepEmpty bool
+}
+
+// Selects the items of a collection that CopyToFiltered() copies.
+type CollectionFilter struct {
+	// The range of the keys to copy, where a nil StartKey or EndKey
+	// leaves it unbounded on that side.
+	Range KeyRange
+
+	// Optional; an item of the range is copied only if it returns true.
+	// It's invoked by the reader goroutines, so concurrently for
+	// different collections.  The item must not be modified.
+	Predicate func(i *Item) bool
+}
+
+// Like CopyTo(), but copies just the collections and items that the
+// filter selects, such as to compact the small collections of a Store
+// without copying a large one.  The copied items are set in the
+// destination, so its aggregates are those of the copied items; a
+// copied item keeps its prior versions, see SetKeepVersions().
+func (s *Store) CopyToFiltered(dstFile StoreFile, flushEvery int,
+	filter CopyFilter) (res *Store, err error) {
+	return s.copyTo(dstFile, flushEvery, filter)
+}
+
+func (s *Store) copyTo(dstFile StoreFile, flushEvery int,
+	filter CopyFilter) (res *Store, err error) {
+	if s.isClosed() {
+		return nil, ErrStoreClosed
+	}
 	dstStore, err := NewStore(dstFile)
 	if err != nil {
 		return nil, err
 	}
 	coll := *(*map[string]*Collection)(atomic.LoadPointer(&s.coll))
+	var names []string
+	var filters []*CollectionFilter
 	for _, name := range collNames(coll) {
-		srcColl := coll[name]
-		dstColl := dstStore.SetCollection(name, srcColl.compare)
-		minItem, err := srcColl.MinItem(true)
-		if err != nil {
-			return nil, err
-		}
-		if minItem == nil {
+		cf, ok := filter.Collections[name]
+		if filter.Collections != nil && !ok {
+			if filter.KeepEmpty {
+				c := dstStore.SetCollection(name, coll[name].compare)
+				c.multi = coll[name].multi
+				c.storeMeta(coll[name].metaMap())
+			}
 			continue
 		}
-		defer s.ItemDecRef(srcColl, minItem)
-		numItems := 0
-		var errCopyItem error = nil
-		err = srcColl.VisitItemsAscend(minItem.Key, true, func(i *Item) bool {
-			if errCopyItem = dstColl.SetItem(i); errCopyItem != nil {
-				return false
+		names = append(names, name)
+		filters = append(filters, cf)
+	}
+	dstColls := make([]*Collection, len(names))
+	for i, name := range names {
+		dstColls[i] = dstStore.SetCollection(name, coll[name].compare)
+		dstColls[i].multi = coll[name].multi
+		dstColls[i].storeMeta(coll[name].metaMap())
+		atomic.StoreInt32(&dstColls[i].keepVersions,
+			atomic.LoadInt32(&coll[name].keepVersions))
+	}
+	items := make(chan copyItem, 1024)
+	done := make(chan struct{}) // Closed to stop the readers.
+	defer func() {
+		close(done)
+		for ci := range items { // Waits for the readers.
+			if ci.item != nil {
+				s.ItemDecRef(coll[names[ci.coll]], ci.item)
 			}
-			numItems++
-			if flushEvery > 0 && numItems%flushEvery == 0 {
-				if errCopyItem = dstStore.Flush(); errCopyItem != nil {
-					return false
+		}
+	}()
+	readers := make(chan int, len(names))
+	for i := range names {
+		readers <- i
+	}
+	close(readers)
+	n := runtime.GOMAXPROCS(0)
+	if n > len(names) {
+		n = len(names)
+	}
+	var wg sync.WaitGroup
+	for r := 0; r < n; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range readers {
+				if !copyReadItems(coll[names[i]], i, filters[i], items, done) {
+					return
 				}
 			}
-			return true
-		})
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(items)
+	}()
+	numItems := make([]int, len(names))
+	for ci := range items {
+		srcColl := coll[names[ci.coll]]
+		if ci.err != nil {
+			return nil, ci.err
+		}
+		// The prior versions are set first, so that the destination
+		// keeps them again, see SetKeepVersions().
+		for _, v := range ci.versions {
+			if err = dstColls[ci.coll].SetItem(v); err != nil {
+				s.ItemDecRef(srcColl, ci.item)
+				return nil, err
+			}
+		}
+		err = dstColls[ci.coll].SetItem(ci.item)
+		s.ItemDecRef(srcColl, ci.item)
 		if err != nil {
 			return nil, err
 		}
-		if errCopyItem != nil {
-			return nil, errCopyItem
+		numItems[ci.coll]++
+		if flushEvery > 0 && numItems[ci.coll]%flushEvery == 0 {
+			if err = dstStore.Flush(); err != nil {
+				return nil, err
+			}
 		}
 	}
 	if flushEvery > 0 {
@@ -340,19 +1200,395 @@ func (s *Store) CopyTo(dstFile StoreFile, flushEvery int) (res *Store, err error
 	return dstStore, nil
 }
 
+// An item, ItemAddRef()'ed, or the error of a reader of CopyTo().
+type copyItem struct {
+	coll     int // Index of the collection.
+	item     *Item
+	versions []*Item // Oldest first, see SetKeepVersions().
+	err      error
+}
+
+// Sends the items of the collection that the filter, if any, selects
+// in ascending order, and then any error, until done is closed.
+// Returns false if the copy is stopping.
+func copyReadItems(c *Collection, ci int, cf *CollectionFilter,
+	items chan<- copyItem, done <-chan struct{}) bool {
+	rnl, err := c.openRootAddRef()
+	if err != nil {
+		select {
+		case items <- copyItem{coll: ci, err: err}:
+		case <-done:
+		}
+		return false
+	}
+	defer c.openRootDecRef(rnl)
+	if cf == nil {
+		cf = &CollectionFilter{}
+	}
+	choice := ascendChoice
+	if cf.Range.StartKey == nil {
+		choice = ascendAllChoice
+	}
+	stopped := false
+	var errRead error
+	_, err = c.store.visitItemLocs(c, rnl.root, cf.Range.StartKey,
+		func(iloc *itemLoc, depth uint64) bool {
+			i, err := iloc.read(c, true)
+			if err != nil {
+				errRead = err
+				return false
+			}
+			if cf.Range.EndKey != nil && c.compare(i.Key, cf.Range.EndKey) >= 0 {
+				return false
+			}
+			if cf.Predicate != nil && !cf.Predicate(i) {
+				return true
+			}
+			versions, err := c.versionItems(iloc)
+			if err != nil {
+				errRead = err
+				return false
+			}
+			c.store.ItemAddRef(c, i)
+			select {
+			case items <- copyItem{coll: ci, item: i, versions: versions}:
+				return true
+			case <-done:
+				c.store.ItemDecRef(c, i)
+				stopped = true
+				return false
+			}
+		}, 0, choice)
+	if err == nil {
+		err = errRead
+	}
+	if err != nil && !stopped {
+		select {
+		case items <- copyItem{coll: ci, err: err}:
+		case <-done:
+		}
+		return false
+	}
+	return !stopped
+}
+
+// An IncrementalCopy remembers which persisted source nodes and items
+// were already written to a destination file by earlier copies, so
+// that a later CopyToIncremental() only appends whatever is new or
+// changed since then, reusing the unchanged on-disk destination nodes.
+//
+// Constraints: the remembered lineage is keyed by source file offsets
+// and is only kept in memory, so a new IncrementalCopy always starts
+// with a full copy.  The lineage is discarded (and a full copy is
+// done again) after any FlushRevert() or FlushRevertCollection() of
+// the source, after any reuse of its free space (see
+// SetReuseFreeSpace()) or switch to a compacted file (see
+// SetAutoCompact()), and if the source file shrinks, since the
+// offsets may then be reused by different data, even once the file has
+// grown back past its size as of the last copy.  An IncrementalCopy should
+// only be used with a single source Store, and its destination Store
+// should not be mutated other than by CopyToIncremental().
+// Unpersisted (dirty) source nodes and items are always copied.
+type IncrementalCopy struct {
+	dst         *Store
+	srcSize     int64           // Source file size as of the last copy.
+	srcRewrites uint64          // Source rewrites as of the last copy.
+	nodes       map[int64]*ploc // Source node offset to destination loc.
+	items       map[int64]*ploc // Source item offset to destination loc.
+}
+
+// Returns an IncrementalCopy that will copy into the given file.
+func NewIncrementalCopy(dstFile StoreFile) (*IncrementalCopy, error) {
+	dst, err := NewStore(dstFile)
+	if err != nil {
+		return nil, err
+	}
+	return newIncrementalCopy(dst), nil
+}
+
+func newIncrementalCopy(dst *Store) *IncrementalCopy {
+	return &IncrementalCopy{
+		dst:   dst,
+		nodes: map[int64]*ploc{},
+		items: map[int64]*ploc{},
+	}
+}
+
+// Returns the destination Store of the incremental copy.
+func (ic *IncrementalCopy) Store() *Store {
+	return ic.dst
+}
+
+// Copies all active collections to the destination of the
+// IncrementalCopy, writing only the nodes and items that weren't
+// written by a previous copy, and then Flush()'es the destination so
+// it's a standalone, self-consistent store.  Returns the number of
+// bytes appended to the destination file.
+func (s *Store) CopyToIncremental(ic *IncrementalCopy) (bytesWritten int64, err error) {
+	if s.isClosed() {
+		return 0, ErrStoreClosed
+	}
+	coll := *(*map[string]*Collection)(atomic.LoadPointer(&s.coll))
+	rnls, bytesWritten, err := s.copyToIncremental(ic, coll)
+	for name, rnl := range rnls {
+		coll[name].rootDecRef(rnl)
+	}
+	return bytesWritten, err
+}
+
+// Writes a compacted copy of the Store, as of the moment of the call,
+// to dest, an empty StoreFile, which is then a standalone store of
+// all the collections, including any mutations that weren't Flush()'ed
+// yet.  The roots of the collections are taken at once, like by a
+// Snapshot() while no mutation is in progress, and their nodes and
+// items are kept alive by the snapshot while they're copied, so the
+// Store keeps accepting mutations and flushes during the backup,
+// which don't affect it.  The nodes of the copy keep their tree shape
+// and are written as they're read, so the copy isn't held in memory.
+// Like CopyTo(), the backup doesn't include tags.
+func (s *Store) BackupTo(dest StoreFile) error {
+	if s.isClosed() {
+		return ErrStoreClosed
+	}
+	s.writeLock.Lock()
+	if s.isClosed() {
+		s.writeLock.Unlock()
+		return ErrStoreClosed
+	}
+	coll := *(*map[string]*Collection)(atomic.LoadPointer(&s.coll))
+	unlock := s.lockCollections(coll)
+	snapshot := s.Snapshot()
+	unlock()
+	s.writeLock.Unlock()
+	defer snapshot.Close()
+	ic, err := NewIncrementalCopy(dest)
+	if err != nil {
+		return err
+	}
+	defer ic.dst.Close()
+	if len(ic.dst.GetCollectionNames()) > 0 {
+		return errors.New("backup destination is not empty")
+	}
+	_, err = snapshot.CopyToIncremental(ic)
+	return err
+}
+
+// Returns the copied roots, which the caller must rootDecRef(), even
+// on error.
+func (s *Store) copyToIncremental(ic *IncrementalCopy,
+	coll map[string]*Collection) (
+	rnls map[string]*rootNodeLoc, bytesWritten int64, err error) {
+	srcSize := atomic.LoadInt64(&s.size)
+	srcRewrites := atomic.LoadUint64(&s.rewrites)
+	if srcSize < ic.srcSize || srcRewrites != ic.srcRewrites {
+		ic.nodes = map[int64]*ploc{}
+		ic.items = map[int64]*ploc{}
+	}
+	dstSizeBeg := atomic.LoadInt64(&ic.dst.size)
+	rnls = map[string]*rootNodeLoc{}
+	for _, name := range collNames(coll) {
+		srcColl := coll[name]
+		dstColl := ic.dst.GetCollection(name)
+		if dstColl == nil {
+			dstColl = ic.dst.SetCollection(name, srcColl.compare)
+			dstColl.multi = srcColl.multi
+		}
+		dstColl.storeMeta(srcColl.metaMap())
+		atomic.StoreInt32(&dstColl.keepVersions,
+			atomic.LoadInt32(&srcColl.keepVersions))
+		rnl := srcColl.rootAddRef()
+		rnls[name] = rnl
+		p, err := ic.copyNode(srcColl, dstColl, rnl.root)
+		if err != nil {
+			return rnls, 0, err
+		}
+		if err = dstColl.setRootLoc(p); err != nil {
+			return rnls, 0, err
+		}
+	}
+	for _, name := range ic.dst.GetCollectionNames() {
+		if coll[name] == nil {
+			ic.dst.RemoveCollection(name)
+		}
+	}
+	if err = ic.dst.Flush(); err != nil {
+		return rnls, 0, err
+	}
+	ic.srcSize, ic.srcRewrites = srcSize, srcRewrites
+	return rnls, atomic.LoadInt64(&ic.dst.size) - dstSizeBeg, nil
+}
+
+func (ic *IncrementalCopy) copyNode(src, dst *Collection, nloc *nodeLoc) (
+	*ploc, error) {
+	if nloc.isEmpty() {
+		return nil, nil
+	}
+	loc := nloc.Loc()
+	if !loc.isEmpty() && ic.nodes[loc.Offset] != nil {
+		return ic.nodes[loc.Offset], nil
+	}
+	n, err := nloc.read(src.store)
+	if err != nil || n == nil {
+		return nil, err
+	}
+	// In the order of a Flush(), see writeRecords().
+	left, err := ic.copyNode(src, dst, &n.left)
+	if err != nil {
+		return nil, err
+	}
+	item, err := ic.copyItem(src, dst, &n.item, false)
+	if err != nil {
+		return nil, err
+	}
+	right, err := ic.copyNode(src, dst, &n.right)
+	if err != nil {
+		return nil, err
+	}
+	c := &node{numNodes: n.numNodes, numBytes: n.numBytes}
+	c.item.loc = unsafe.Pointer(item)
+	c.left.loc = unsafe.Pointer(left)
+	c.right.loc = unsafe.Pointer(right)
+	cloc := &nodeLoc{node: unsafe.Pointer(c)}
+	if err = cloc.write(dst.store); err != nil {
+		return nil, err
+	}
+	if !loc.isEmpty() {
+		ic.nodes[loc.Offset] = cloc.Loc()
+	}
+	return cloc.Loc(), nil
+}
+
+// Copies an item, or when version is true, a prior version of an item,
+// along with its prior versions, see SetKeepVersions().
+func (ic *IncrementalCopy) copyItem(src, dst *Collection, iloc *itemLoc,
+	version bool) (*ploc, error) {
+	loc := iloc.Loc()
+	if !loc.isEmpty() && ic.items[loc.Offset] != nil {
+		return ic.items[loc.Offset], nil
+	}
+	var i *Item
+	var err error
+	if version {
+		i, err = src.readVersion(iloc)
+	} else {
+		i, err = iloc.read(src, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if i == nil {
+		return nil, errors.New("missing item during CopyToIncremental()")
+	}
+	c := &itemLoc{item: unsafe.Pointer(i)}
+	if vs := iloc.versionsOf(); len(vs) > 0 {
+		cvs := make(itemVersions, len(vs))
+		for j, v := range vs {
+			p, err := ic.copyItem(src, dst, v, true)
+			if err != nil {
+				return nil, err
+			}
+			cvs[j] = &itemLoc{loc: unsafe.Pointer(p)}
+		}
+		c.versions = unsafe.Pointer(&cvs)
+	}
+	if err = c.write(dst); err != nil {
+		return nil, err
+	}
+	if !loc.isEmpty() {
+		ic.items[loc.Offset] = c.Loc()
+	}
+	return c.Loc(), nil
+}
+
 // Updates the provided map with statistics.
 func (s *Store) Stats(out map[string]uint64) {
 	out["fileSize"] = uint64(atomic.LoadInt64(&s.size))
 	out["nodeAllocs"] = atomic.LoadUint64(&s.nodeAllocs)
+	if s.freeList != nil {
+		s.freeList.stats(out)
+	}
+	if s.autoCompact != nil {
+		s.autoCompact.stats(out)
+	}
 }
 
-func (o *Store) writeRoots(rnls map[string]*rootNodeLoc) error {
-	sJSON, err := json.Marshal(rnls)
+// Writes the records of a Flush(), with the roots record last.
+func (s *Store) writeFlush(coll map[string]*Collection, cnames []string,
+	rnls map[string]*rootNodeLoc) error {
+	for _, name := range cnames {
+		if err := coll[name].write(rnls[name].root); err != nil {
+			return err
+		}
+		if err := coll[name].writeBloomFilter(); err != nil {
+			return err
+		}
+	}
+	if err := s.flushBufferEnd(); err != nil {
+		return err
+	}
+	return s.writeRoots(coll, rnls)
+}
+
+func (o *Store) writeRoots(coll map[string]*Collection,
+	rnls map[string]*rootNodeLoc) error {
+	m := make(map[string]json.RawMessage, len(rnls))
+	for name, rnl := range rnls {
+		b, err := coll[name].marshalRootJSON(rnl)
+		if err != nil {
+			return err
+		}
+		m[name] = b
+	}
+	cJSON, err := json.Marshal(m)
 	if err != nil {
 		return err
 	}
-	offset := atomic.LoadInt64(&o.size)
-	length := 2*len(MAGIC_BEG) + 4 + 4 + len(sJSON) + 8 + 4 + 2*len(MAGIC_END)
+	orig := atomic.LoadPointer(&o.history)
+	o.pushHistory(cJSON)
+	if err = o.writeRootsJSON(cJSON); err != nil {
+		atomic.StorePointer(&o.history, orig)
+		return err
+	}
+	return nil
+}
+
+// Writes a roots record with the given collections JSON and the tags.
+func (o *Store) writeRootsJSON(cJSON []byte) error {
+	tJSON, err := o.tagsJSON()
+	if err != nil {
+		return err
+	}
+	size := atomic.LoadInt64(&o.size)
+	offset, truncate := o.freeList.tail(size)
+	if !truncate {
+		offset = o.appendOffset()
+	}
+	h := o.historyOf()
+	var sJSON []byte
+	var length int
+	for {
+		rr := &rootsRecord{
+			Collections: cJSON,
+			Encrypted:   o.encrypted,
+			Free:        o.freeList.persisted(offset),
+			Tags:        tJSON,
+			Alignment:   o.alignment,
+			Generation:  h.gen,
+			History:     h.prior,
+		}
+		rr.Checksum = rr.checksum()
+		sJSON, err = json.Marshal(rr)
+		if err != nil {
+			return err
+		}
+		length = 2*len(MAGIC_BEG) + 4 + 4 + len(sJSON) + 8 + 4 + 2*len(MAGIC_END)
+		// The last roots record must stay intact until the new roots
+		// record is written, else fall back to appending.
+		if !truncate || offset+int64(length) <= o.freeList.rootsLoc.Offset {
+			break
+		}
+		offset, truncate = o.appendOffset(), false
+	}
 	b := bytes.NewBuffer(make([]byte, length)[:0])
 	b.Write(MAGIC_BEG)
 	b.Write(MAGIC_BEG)
@@ -363,10 +1599,17 @@ func (o *Store) writeRoots(rnls map[string]*rootNodeLoc) error {
 	binary.Write(b, binary.BigEndian, uint32(length))
 	b.Write(MAGIC_END)
 	b.Write(MAGIC_END)
-	if _, err := o.file.WriteAt(b.Bytes()[:length], offset); err != nil {
+	if err := o.writeAt(b.Bytes()[:length], offset); err != nil {
 		return err
 	}
+	if truncate {
+		if err := o.file.Truncate(offset + int64(length)); err != nil {
+			return err
+		}
+	}
 	atomic.StoreInt64(&o.size, offset+int64(length))
+	atomic.StoreUint32(&o.formatVersion, VERSION)
+	o.freeList.flushEnd(&ploc{Offset: offset, Length: uint32(length)}, truncate)
 	return nil
 }
 
@@ -379,29 +1622,93 @@ func (o *Store) readRoots() error {
 	if o.size <= 0 {
 		return nil
 	}
-	return o.readRootsScan(false)
+	if err = o.readRootsScan(false); err != nil {
+		return err
+	}
+	if v := o.FormatVersion(); v < int(VERSION) && o.callbacks.Migrate != nil {
+		if err = o.callbacks.Migrate(v, int(VERSION)); err != nil {
+			return err
+		}
+	}
+	if o.discarded = finfo.Size() - atomic.LoadInt64(&o.size); o.discarded > 0 {
+		return &RecoveredError{DiscardedBytes: o.discarded}
+	}
+	return nil
 }
 
 func (o *Store) readRootsScan(defaultToEmpty bool) (err error) {
+	rr, rootsLoc, err := o.scanRoots(atomic.LoadInt64(&o.size))
+	if err != nil {
+		return err
+	}
+	if rootsLoc == nil {
+		if defaultToEmpty {
+			atomic.StoreInt64(&o.size, 0)
+			atomic.StoreUint32(&o.formatVersion, 0)
+			o.loadHistory(&rootsRecord{})
+			return nil
+		}
+		return &CorruptError{Offset: atomic.LoadInt64(&o.size),
+			Detail: "couldn't find roots; file corrupted or wrong?"}
+	}
+	atomic.StoreInt64(&o.size, rootsLoc.Offset+int64(rootsLoc.Length))
+	atomic.StoreUint32(&o.formatVersion, rr.version)
+	o.alignment = rr.Alignment
+	if rr.Encrypted && o.callbacks.Decrypt == nil {
+		return errors.New("store file is encrypted," +
+			" but no Encrypt/Decrypt callbacks were provided")
+	}
+	if !rr.Encrypted && o.callbacks.Decrypt != nil {
+		return errors.New("store file is not encrypted," +
+			" but Encrypt/Decrypt callbacks were provided")
+	}
+	m := make(map[string]*Collection)
+	if err = json.Unmarshal(rr.Collections, &m); err != nil {
+		return corruptError(rootsLoc, "roots record", err)
+	}
+	for collName, t := range m {
+		t.name = collName
+		t.store = o
+		if err = o.loadCompare(t); err != nil {
+			return err
+		}
+		t.loadBloomFilter()
+	}
+	tags := map[string]json.RawMessage{}
+	if len(rr.Tags) > 0 {
+		if err = json.Unmarshal(rr.Tags, &tags); err != nil {
+			return err
+		}
+	}
+	atomic.StorePointer(&o.coll, unsafe.Pointer(&m))
+	atomic.StorePointer(&o.tags, unsafe.Pointer(&tags))
+	o.loadHistory(&rr)
+	if o.freeList != nil {
+		o.freeList.load(rr.Free, rootsLoc)
+	}
+	return nil
+}
+
+// Scans backwards from the given file size for the last valid roots
+// record that ends at or before it, returning a nil rootsLoc if there
+// is none.  The Store is not modified.
+func (o *Store) scanRoots(size int64) (
+	rr rootsRecord, rootsLoc *ploc, err error) {
 	rootsEnd := make([]byte, rootsEndLen)
 	for {
 		for { // Scan backwards for MAGIC_END.
-			if atomic.LoadInt64(&o.size) <= rootsLen {
-				if defaultToEmpty {
-					atomic.StoreInt64(&o.size, 0)
-					return nil
-				}
-				return errors.New("couldn't find roots; file corrupted or wrong?")
+			if size <= rootsLen {
+				return rr, nil, nil
 			}
-			if _, err := o.file.ReadAt(rootsEnd,
-				atomic.LoadInt64(&o.size)-int64(len(rootsEnd))); err != nil {
-				return err
+			if _, err := readFull(o.file, rootsEnd,
+				size-int64(len(rootsEnd))); err != nil {
+				return rr, nil, err
 			}
 			if bytes.Equal(MAGIC_END, rootsEnd[8+4:8+4+len(MAGIC_END)]) &&
 				bytes.Equal(MAGIC_END, rootsEnd[8+4+len(MAGIC_END):]) {
 				break
 			}
-			atomic.AddInt64(&o.size, -1) // TODO: optimizations to scan backwards faster.
+			size-- // TODO: optimizations to scan backwards faster.
 		}
 		// Read and check the roots.
 		var offset int64
@@ -409,74 +1716,90 @@ func (o *Store) readRootsScan(defaultToEmpty bool) (err error) {
 		endBuf := bytes.NewBuffer(rootsEnd)
 		err = binary.Read(endBuf, binary.BigEndian, &offset)
 		if err != nil {
-			return err
+			return rr, nil, err
 		}
 		if err = binary.Read(endBuf, binary.BigEndian, &length); err != nil {
-			return err
+			return rr, nil, err
 		}
-		if offset >= 0 && offset < atomic.LoadInt64(&o.size)-int64(rootsLen) &&
-			length == uint32(atomic.LoadInt64(&o.size)-offset) {
-			data := make([]byte, atomic.LoadInt64(&o.size)-offset-int64(len(rootsEnd)))
-			if _, err := o.file.ReadAt(data, offset); err != nil {
-				return err
+		if offset >= 0 && offset < size-int64(rootsLen) &&
+			length == uint32(size-offset) {
+			data := make([]byte, size-offset-int64(len(rootsEnd)))
+			if _, err := readFull(o.file, data, offset); err != nil {
+				return rr, nil, err
 			}
 			if bytes.Equal(MAGIC_BEG, data[:len(MAGIC_BEG)]) &&
 				bytes.Equal(MAGIC_BEG, data[len(MAGIC_BEG):2*len(MAGIC_BEG)]) {
 				var version, length0 uint32
 				b := bytes.NewBuffer(data[2*len(MAGIC_BEG):])
 				if err = binary.Read(b, binary.BigEndian, &version); err != nil {
-					return err
+					return rr, nil, err
 				}
 				if err = binary.Read(b, binary.BigEndian, &length0); err != nil {
-					return err
+					return rr, nil, err
 				}
-				if version != VERSION {
-					return fmt.Errorf("version mismatch: "+
-						"current version: %v != found version: %v", VERSION, version)
+				if version < 4 || version > VERSION {
+					return rr, nil, fmt.Errorf("%w, version mismatch: "+
+						"current version: %v != found version: %v",
+						ErrUnsupportedVersion, VERSION, version)
 				}
 				if length0 != length {
-					return fmt.Errorf("length mismatch: "+
-						"wanted length: %v != found length: %v", length0, length)
+					return rr, nil, &CorruptError{Offset: offset,
+						Detail: fmt.Sprintf("roots length mismatch: "+
+							"wanted length: %v != found length: %v", length0, length)}
+				}
+				rr = rootsRecord{Collections: data[2*len(MAGIC_BEG)+4+4:], version: version}
+				valid := true
+				if version >= 5 {
+					valid = json.Unmarshal(rr.Collections, &rr) == nil
 				}
-				m := make(map[string]*Collection)
-				if err = json.Unmarshal(data[2*len(MAGIC_BEG)+4+4:], &m); err != nil {
-					return err
+				if valid && version >= 6 {
+					valid = rr.checksum() == rr.Checksum
 				}
-				for collName, t := range m {
-					t.name = collName
-					t.store = o
-					if o.callbacks.KeyCompareForCollection != nil {
-						t.compare = o.callbacks.KeyCompareForCollection(collName)
-					}
-					if t.compare == nil {
-						t.compare = bytes.Compare
-					}
+				var locs map[string]ploc
+				if valid && json.Unmarshal(rr.Collections, &locs) == nil {
+					return rr, &ploc{Offset: offset, Length: length}, nil
 				}
-				atomic.StorePointer(&o.coll, unsafe.Pointer(&m))
-				return nil
+				// A damaged roots record, so keep scanning.
+				size--
+				continue
 			} // else, perhaps value was unlucky in having MAGIC_END's.
 		} // else, perhaps a gkvlite file was stored as a value.
-		atomic.AddInt64(&o.size, -1) // Roots were wrong, so keep scanning.
+		size-- // Roots were wrong, so keep scanning.
 	}
 }
 
-func (o *Store) ItemAlloc(c *Collection, keyLength uint16) *Item {
+func (o *Store) ItemAlloc(c *Collection, keyLength uint16) (i *Item) {
 	if o.callbacks.ItemAlloc != nil {
-		return o.callbacks.ItemAlloc(c, keyLength)
+		i = o.callbacks.ItemAlloc(c, keyLength)
+	} else if o.itemPool != nil {
+		i = o.itemPool.alloc(keyLength)
+	} else {
+		i = &Item{Key: make([]byte, keyLength)}
 	}
-	return &Item{Key: make([]byte, keyLength)}
+	o.debugRefs.begin(i, true)
+	return i
 }
 
 func (o *Store) ItemAddRef(c *Collection, i *Item) {
+	atomic.AddUint64(&o.itemAddRefs, 1)
+	o.debugRefs.update(o, c, i, 1)
+	if i != nil && i.pooled != nil {
+		i.pooled.addRef()
+	}
 	if o.callbacks.ItemAddRef != nil {
 		o.callbacks.ItemAddRef(c, i)
 	}
 }
 
 func (o *Store) ItemDecRef(c *Collection, i *Item) {
+	atomic.AddUint64(&o.itemDecRefs, 1)
+	o.debugRefs.update(o, c, i, -1)
 	if o.callbacks.ItemDecRef != nil {
 		o.callbacks.ItemDecRef(c, i)
 	}
+	if i != nil && i.pooled != nil {
+		i.pooled.decRef()
+	}
 }
 
 func (o *Store) ItemValRead(c *Collection, i *Item,
@@ -484,8 +1807,15 @@ func (o *Store) ItemValRead(c *Collection, i *Item,
 	if o.callbacks.ItemValRead != nil {
 		return o.callbacks.ItemValRead(c, i, r, offset, valLength)
 	}
-	i.Val = make([]byte, valLength)
-	_, err := r.ReadAt(i.Val, offset)
+	if i.pooled != nil {
+		i.Val = i.pooled.val(valLength)
+	} else {
+		i.Val = make([]byte, valLength) // Non-nil even when empty.
+	}
+	if valLength == 0 {
+		return nil // Some ReaderAt's return io.EOF for empty reads at the end.
+	}
+	_, err := readFull(r, i.Val, offset)
 	return err
 }
 
@@ -493,6 +1823,6 @@ func (o *Store) ItemValWrite(c *Collection, i *Item, w io.WriterAt, offset int64
 	if o.callbacks.ItemValWrite != nil {
 		return o.callbacks.ItemValWrite(c, i, w, offset)
 	}
-	_, err := w.WriteAt(i.Val, offset)
+	_, err := writeFull(w, i.Val, offset)
 	return err
 }
@@ -2,16 +2,30 @@ package gkvlite
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 	"unsafe"
 )
 
@@ -1115,6 +1129,100 @@ func TestStoreConcurrentInsertDuringVisits(t *testing.T) {
 	})
 }
 
+func TestStoreConcurrentReadersWithWriters(t *testing.T) {
+	s, _ := NewStore(&memFile{})
+	x := s.SetCollection("x", nil)
+	var wgWriters, wgReaders sync.WaitGroup
+	done := make(chan struct{})
+	expected := make([]map[string]bool, 2)
+	for w := range expected {
+		expected[w] = map[string]bool{}
+		wgWriters.Add(1)
+		go func(w int, present map[string]bool) { // Writers on disjoint keys.
+			defer wgWriters.Done()
+			for i := 0; i < 2000; i++ {
+				k := fmt.Sprintf("%d-%03d", w, rand.Intn(200))
+				if rand.Intn(3) == 0 {
+					if _, err := x.Delete([]byte(k)); err != nil {
+						t.Errorf("expected concurrent delete to work, got: %v", err)
+					}
+					delete(present, k)
+				} else {
+					if err := x.Set([]byte(k), []byte("v"+k)); err != nil {
+						t.Errorf("expected concurrent set to work, got: %v", err)
+					}
+					present[k] = true
+				}
+				if i%100 == 0 {
+					if err := s.Flush(); err != nil {
+						t.Errorf("expected concurrent flush to work, got: %v", err)
+					}
+				}
+			}
+		}(w, expected[w])
+	}
+	for r := 0; r < 8; r++ {
+		wgReaders.Add(1)
+		go func(r int) {
+			defer wgReaders.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				c := x
+				if r%2 == 0 {
+					c = s.Snapshot().GetCollection("x")
+				}
+				numItems, _, err := c.GetTotals()
+				if err != nil {
+					t.Errorf("expected totals to work, got: %v", err)
+				}
+				var prev []byte
+				n := uint64(0)
+				err = c.VisitItemsAscend([]byte(""), true, func(i *Item) bool {
+					if prev != nil && bytes.Compare(prev, i.Key) >= 0 {
+						t.Errorf("expected ascending keys, got: %q, %q", prev, i.Key)
+					}
+					if string(i.Val) != "v"+string(i.Key) {
+						t.Errorf("expected value for %q, got: %q", i.Key, i.Val)
+					}
+					prev = i.Key
+					n++
+					return true
+				})
+				if err != nil {
+					t.Errorf("expected visit to work, got: %v", err)
+				}
+				if r%2 == 0 && n != numItems { // Snapshots can't change.
+					t.Errorf("expected %v items in snapshot, got: %v", numItems, n)
+				}
+				k := fmt.Sprintf("%d-%03d", r%2, rand.Intn(200))
+				if v, err := x.Get([]byte(k)); err != nil ||
+					(v != nil && string(v) != "v"+k) {
+					t.Errorf("expected get of %q to work, got: %q, %v", k, v, err)
+				}
+			}
+		}(r)
+	}
+	wgWriters.Wait()
+	close(done)
+	wgReaders.Wait()
+	numItems, _, _ := x.GetTotals()
+	if numItems != uint64(len(expected[0])+len(expected[1])) {
+		t.Errorf("expected %v items, got: %v",
+			len(expected[0])+len(expected[1]), numItems)
+	}
+	for _, present := range expected {
+		for k := range present {
+			if v, err := x.Get([]byte(k)); err != nil || string(v) != "v"+k {
+				t.Errorf("expected %q, got: %q, %v", k, v, err)
+			}
+		}
+	}
+}
+
 func TestWasDeleted(t *testing.T) {
 	s, _ := NewStore(nil)
 	x := s.SetCollection("x", bytes.Compare)
@@ -1177,6 +1285,105 @@ func BenchmarkGets(b *testing.B) {
 	}
 }
 
+// Gets from a reopened store, so that most values are read from the file.
+func benchmarkFileGets(b *testing.B, get func(x *Collection, key []byte)) {
+	f := &memFile{}
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(strconv.Itoa(i))
+		x.Set(keys[i], bytes.Repeat(keys[i], 10))
+	}
+	s.Flush()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%len(keys) == 0 {
+			b.StopTimer()
+			s, _ = NewStore(f)
+			x = s.GetCollection("x")
+			for _, key := range keys {
+				x.GetItem(key, false) // Warm up the nodes, but not the values.
+			}
+			b.StartTimer()
+		}
+		get(x, keys[i%len(keys)])
+	}
+}
+
+func BenchmarkFileGets(b *testing.B) {
+	benchmarkFileGets(b, func(x *Collection, key []byte) {
+		x.Get(key)
+	})
+}
+
+func BenchmarkFileGetInto(b *testing.B) {
+	var buf []byte
+	benchmarkFileGets(b, func(x *Collection, key []byte) {
+		buf, _, _ = x.GetInto(key, buf[:0])
+	})
+}
+
+// Sets from parallel goroutines, each into its own Store.
+func benchmarkParallelSets(b *testing.B, ownRand bool) {
+	var seed int64
+	b.RunParallel(func(pb *testing.PB) {
+		s, _ := NewStore(nil)
+		if ownRand {
+			s.SetRand(rand.New(rand.NewSource(atomic.AddInt64(&seed, 1))))
+		}
+		x := s.SetCollection("x", nil)
+		keys := make([][]byte, 100)
+		for i := range keys {
+			keys[i] = []byte(strconv.Itoa(i))
+		}
+		v := []byte("")
+		for i := 0; pb.Next(); i++ {
+			x.Set(keys[i%len(keys)], v)
+		}
+	})
+}
+
+func BenchmarkParallelSets(b *testing.B) {
+	benchmarkParallelSets(b, false)
+}
+
+func BenchmarkParallelSetsOwnRand(b *testing.B) {
+	benchmarkParallelSets(b, true)
+}
+
+// Fills and empties a short-lived, memory-only store per op, like the
+// scratch stores of a server's requests.
+func benchmarkChurn(b *testing.B, pool NodePool) {
+	keys := make([][]byte, 256)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("%08d", rand.Int()))
+	}
+	v := []byte("v")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s, _ := NewStoreEx(nil, StoreCallbacks{NodePool: pool})
+		x := s.SetCollection("x", nil)
+		for _, k := range keys {
+			x.Set(k, v)
+		}
+		for _, k := range keys {
+			x.Delete(k)
+		}
+		s.Close()
+	}
+}
+
+func BenchmarkChurn(b *testing.B) {
+	benchmarkChurn(b, nil)
+}
+
+func BenchmarkChurnNodePool(b *testing.B) {
+	benchmarkChurn(b, &sync.Pool{})
+}
+
 func TestSizeof(t *testing.T) {
 	t.Logf("sizeof various structs and types, in bytes...")
 	t.Logf("  node: %v", unsafe.Sizeof(node{}))
@@ -1229,19 +1436,98 @@ func TestEvictSomeItems(t *testing.T) {
 	for i := 0; i < 1000; i++ {
 		visitExpectCollection(t, x, "a", []string{"a", "b", "c", "d", "e"}, nil)
 		s.Flush()
-		numEvicted += x.EvictSomeItems()
+		numEvicted += x.EvictSomeItems().NumEvicted
 	}
 	for i := 0; i < 1000; i++ {
 		visitExpectCollection(t, x, "a", []string{"a", "b", "c", "d", "e"}, nil)
 		loadCollection(x, []string{"e", "d", "a"})
 		s.Flush()
-		numEvicted += x.EvictSomeItems()
+		numEvicted += x.EvictSomeItems().NumEvicted
 	}
 	if numEvicted == 0 {
 		t.Errorf("expected some evictions")
 	}
 }
 
+func TestEmptyValRoundTrip(t *testing.T) {
+	fname := "tmpEmptyVal.test"
+	fname2 := "tmpEmptyVal2.test"
+	os.Remove(fname)
+	os.Remove(fname2)
+	defer os.Remove(fname)
+	defer os.Remove(fname2)
+	f, _ := os.Create(fname)
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	if err := x.SetItem(&Item{Val: []byte("a")}); err != ErrNilKey {
+		t.Errorf("expected nil key to fail with ErrNilKey, got: %v", err)
+	}
+	if err := x.SetItem(&Item{Key: []byte{}, Val: []byte("a")}); err != ErrNilKey {
+		t.Errorf("expected empty key to fail with ErrNilKey, got: %v", err)
+	}
+	if err := x.SetItem(&Item{Key: []byte("a")}); err == nil {
+		t.Errorf("expected nil val to fail")
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		x.Set([]byte(k), []byte{})
+	}
+	x.Set([]byte("d"), []byte("d"))
+	checkEmpty := func(desc string, x *Collection) {
+		for _, k := range []string{"a", "b", "c"} {
+			v, err := x.Get([]byte(k))
+			if err != nil || v == nil || len(v) != 0 {
+				t.Errorf("%s: expected empty non-nil val for %q, got: %#v, %v",
+					desc, k, v, err)
+			}
+		}
+		n := 0
+		err := x.VisitItemsAscend([]byte("a"), true, func(i *Item) bool {
+			if i.Val == nil || (string(i.Key) != "d" && len(i.Val) != 0) {
+				t.Errorf("%s: expected visited val for %q, got: %#v",
+					desc, i.Key, i.Val)
+			}
+			n++
+			return true
+		})
+		if err != nil || n != 4 {
+			t.Errorf("%s: expected 4 visited items, got: %v, %v", desc, n, err)
+		}
+		numItems, numBytes, err := x.GetTotals()
+		if err != nil || numItems != 4 || numBytes != 5 {
+			t.Errorf("%s: expected totals 4, 5, got: %v, %v, %v",
+				desc, numItems, numBytes, err)
+		}
+	}
+	checkEmpty("dirty", x)
+	if err := s.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+	checkEmpty("flushed", x)
+	for i := 0; i < 20 && x.EvictSomeItems().NumEvicted == 0; i++ {
+	}
+	checkEmpty("evicted", x)
+
+	f2, _ := os.Create(fname2)
+	s2, err := s.CopyTo(f2, 1)
+	if err != nil {
+		t.Errorf("expected CopyTo to work, got: %v", err)
+	}
+	checkEmpty("copied", s2.GetCollection("x"))
+	s.Close()
+	s2.Close()
+	f.Close()
+	f2.Close()
+
+	f, _ = os.Open(fname)
+	s, _ = NewStore(f)
+	checkEmpty("reopened", s.GetCollection("x"))
+	f.Close()
+	f2, _ = os.Open(fname2)
+	s2, _ = NewStore(f2)
+	checkEmpty("reopened copy", s2.GetCollection("x"))
+	f2.Close()
+}
+
 func TestJoinWithFileErrors(t *testing.T) {
 	fname := "tmp.test"
 	os.Remove(fname)
@@ -1389,8 +1675,6 @@ func TestJoinWithFileErrors(t *testing.T) {
 }
 
 func TestStoreStats(t *testing.T) {
-	freeNodes = nil
-
 	m := map[string]uint64{}
 	n := map[string]uint64{}
 
@@ -1468,6 +1752,56 @@ func TestVisitItemsAscendEx(t *testing.T) {
 	}
 }
 
+func TestVisitItemsExDepths(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	// With fixed priorities, the treap is:
+	//
+	//       d
+	//     b   e
+	//    a c
+	for _, kp := range []struct {
+		k string
+		p int32
+	}{{"a", 1}, {"b", 4}, {"c", 2}, {"d", 5}, {"e", 3}} {
+		x.SetItem(&Item{Key: []byte(kp.k), Val: []byte(kp.k), Priority: kp.p})
+	}
+	visit := func(ascend bool, target string) string {
+		res := ""
+		v := func(i *Item, depth uint64) bool {
+			res += fmt.Sprintf("%s%d ", i.Key, depth)
+			return true
+		}
+		var err error
+		if ascend {
+			err = x.VisitItemsAscendEx([]byte(target), true, v)
+		} else {
+			err = x.VisitItemsDescendEx([]byte(target), true, v)
+		}
+		if err != nil {
+			t.Errorf("expected visit ex to work, got: %v", err)
+		}
+		return res
+	}
+	tests := []struct {
+		ascend bool
+		target string
+		exp    string
+	}{
+		{true, "a", "a2 b1 c2 d0 e1 "},
+		{true, "c", "c2 d0 e1 "},
+		{true, "e", "e1 "},
+		{false, "z", "e1 d0 c2 b1 a2 "},
+		{false, "c", "b1 a2 "},
+	}
+	for _, test := range tests {
+		if got := visit(test.ascend, test.target); got != test.exp {
+			t.Errorf("expected %v visit from %q to be %q, got: %q",
+				test.ascend, test.target, test.exp, got)
+		}
+	}
+}
+
 func TestVisitItemsDescend(t *testing.T) {
 	s, err := NewStore(nil)
 	if err != nil || s == nil {
@@ -1483,6 +1817,67 @@ func TestVisitItemsDescend(t *testing.T) {
 	visitDescendExpectCollection(t, x, "", []string{}, nil)
 }
 
+func TestVisitItemsDescendRange(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 200; i += 2 {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), []byte{})
+	}
+	descend := func(start, end []byte) []string {
+		res := []string{}
+		err := x.VisitItemsDescendRange(start, end, false, func(i *Item) bool {
+			res = append(res, string(i.Key))
+			return true
+		})
+		if err != nil {
+			t.Errorf("expected VisitItemsDescendRange to work, got: %v", err)
+		}
+		return res
+	}
+	ascend := func(start, end []byte) []string {
+		res := []string{}
+		x.VisitItemsAscend(end, false, func(i *Item) bool {
+			if bytes.Compare(i.Key, start) > 0 {
+				return false
+			}
+			res = append(res, string(i.Key))
+			return true
+		})
+		return res
+	}
+	for _, r := range [][2]string{
+		{"150", "050"}, {"151", "049"}, {"199", "000"}, {"999", ""},
+		{"100", "100"}, {"101", "101"}, {"000", "000"}, {"050", "150"},
+	} {
+		start, end := []byte(r[0]), []byte(r[1])
+		if r[1] == "" {
+			end = []byte{0}
+		}
+		got := descend(start, end)
+		exp := ascend(start, end)
+		for i, j := 0, len(exp)-1; i < j; i, j = i+1, j-1 {
+			exp[i], exp[j] = exp[j], exp[i]
+		}
+		if fmt.Sprint(got) != fmt.Sprint(exp) {
+			t.Errorf("range %v: expected %v, got: %v", r, exp, got)
+		}
+	}
+	if got := descend([]byte("010"), nil); fmt.Sprint(got) != "[010 008 006 004 002 000]" {
+		t.Errorf("expected a nil endKey to visit to the smallest, got: %v", got)
+	}
+	if got := descend([]byte("100"), []byte("101")); len(got) != 0 {
+		t.Errorf("expected empty range, got: %v", got)
+	}
+	n := 0
+	x.VisitItemsDescendRange([]byte("150"), nil, false, func(i *Item) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Errorf("expected the visitor to stop the visit, got: %v", n)
+	}
+}
+
 func TestKeyCompareForCollectionCallback(t *testing.T) {
 	fname := "tmp.test"
 	os.Remove(fname)
@@ -1635,130 +2030,605 @@ func TestItemCopy(t *testing.T) {
 	}
 }
 
-func TestCurFreeNodes(t *testing.T) {
-	s, err := NewStore(nil)
-	if err != nil || s == nil {
-		t.Errorf("expected memory-only NewStore to work")
+func TestTransientNotPersisted(t *testing.T) {
+	fname := "tmpTransient.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	cached := "derived"
+	x.SetItem(&Item{
+		Key:       []byte("a"),
+		Val:       []byte("A"),
+		Priority:  100,
+		Transient: unsafe.Pointer(&cached),
+	})
+	x.Set([]byte("b"), []byte("B"))
+	if _, numBytes, _ := x.GetTotals(); numBytes != 4 {
+		t.Errorf("expected transient data not counted, got: %v", numBytes)
 	}
-	x := s.SetCollection("x", bytes.Compare)
-	n := x.mkNode(empty_itemLoc, empty_nodeLoc, empty_nodeLoc, 0, 0)
-	f := allocStats
-	x.freeNode_unlocked(n, nil)
-	if f.FreeNodes+1 != allocStats.FreeNodes {
-		t.Errorf("expected freeNodes to increment")
+	s.Flush()
+	i, err := x.GetItem([]byte("a"), true)
+	if err != nil || i == nil || (*string)(i.Transient) != &cached {
+		t.Errorf("expected transient data kept after Flush, got: %v, %v", i, err)
 	}
-	if f.CurFreeNodes+1 != allocStats.CurFreeNodes {
-		t.Errorf("expected CurFreeNodes + 1 == allocStats.CurrFreeNodes, got: %v, %v",
-			f.CurFreeNodes+1, allocStats.CurFreeNodes)
+	for n := 0; n < 100; n++ {
+		x.EvictSomeItems()
+	}
+	if i, _ = x.GetItem([]byte("a"), true); i.Transient != nil {
+		t.Errorf("expected transient data dropped after eviction (and re-read)")
+	}
+	i.Transient = unsafe.Pointer(&cached)
+	s.Close()
+	f.Close()
+
+	f, _ = os.Open(fname)
+	defer f.Close()
+	s, _ = NewStore(f)
+	i, err = s.GetCollection("x").GetItem([]byte("a"), true)
+	if err != nil || i == nil || string(i.Val) != "A" || i.Priority != 100 {
+		t.Errorf("expected persisted item, got: %v, %v", i, err)
+	}
+	if i.Transient != nil {
+		t.Errorf("expected no transient data after reopen, got: %v", i.Transient)
 	}
 }
 
-func TestCollectionStats(t *testing.T) {
-	s, err := NewStore(nil)
-	if err != nil || s == nil {
-		t.Errorf("expected memory-only NewStore to work")
+func TestSetRand(t *testing.T) {
+	shape := func(seed int64) string {
+		s, _ := NewStore(nil)
+		s.SetRand(rand.New(rand.NewSource(seed)))
+		x := s.SetCollection("x", nil)
+		for i := 0; i < 100; i++ {
+			x.Set([]byte(fmt.Sprintf("%03d", i)), []byte{})
+		}
+		var res []string
+		x.VisitItemsAscendEx(nil, true, func(i *Item, depth uint64) bool {
+			res = append(res, fmt.Sprintf("%s:%d:%d", i.Key, i.Priority, depth))
+			return true
+		})
+		return strings.Join(res, ",")
 	}
-	x := s.SetCollection("x", bytes.Compare)
-	g := x.AllocStats()
-	loadCollection(x, []string{"e", "d", "a", "c", "b", "c", "a"})
-	h := x.AllocStats()
-	if h.MkNodes <= g.MkNodes {
-		t.Errorf("expected MkNodes to be more")
+	if shape(1) != shape(1) {
+		t.Errorf("expected the same seed to give the same tree")
 	}
-	if h.MkNodeLocs <= g.MkNodeLocs {
-		t.Errorf("expected MkNodeLocs to be more")
+	if shape(1) == shape(2) {
+		t.Errorf("expected different seeds to give different trees")
 	}
-	if h.MkRootNodeLocs <= g.MkRootNodeLocs {
-		t.Errorf("expected MkRootNodeLocs to be more")
+
+	s, _ := NewStore(nil)
+	s.SetRand(rand.New(rand.NewSource(3)))
+	x := s.SetCollection("x", nil)
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				x.Set([]byte(fmt.Sprintf("%d-%03d", g, i)), []byte{})
+			}
+		}(g)
+	}
+	wg.Wait()
+	if n, _, _ := x.GetTotals(); n != 800 {
+		t.Errorf("expected 800 items from concurrent sets, got: %v", n)
 	}
 }
 
-func TestDump(t *testing.T) {
-	s, err := NewStore(nil)
-	if err != nil || s == nil {
-		t.Errorf("expected memory-only NewStore to work")
+func TestPooledItems(t *testing.T) {
+	f := &memFile{}
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 200; i++ {
+		k := fmt.Sprintf("%03d", i)
+		x.Set([]byte(k), []byte("v"+k))
 	}
-	x := s.SetCollection("x", bytes.Compare)
-	loadCollection(x, []string{"e", "d", "a", "c", "b", "c", "a"})
-	fmt.Printf("testing dump\n")
-	dump(s, x.root.root, 1)
-}
+	s.Flush()
 
-func TestStoreClose(t *testing.T) {
-	s, err := NewStore(nil)
-	if err != nil || s == nil {
-		t.Errorf("expected memory-only NewStore to work")
+	s, _ = NewStoreEx(f, StoreCallbacks{ItemAlloc: func(c *Collection, keyLength uint16) *Item {
+		return &Item{Key: make([]byte, keyLength)}
+	}})
+	if err := s.UsePooledItems(true); err == nil {
+		t.Errorf("expected UsePooledItems with ItemAlloc to fail")
 	}
-	if s.coll == unsafe.Pointer(nil) {
-		t.Errorf("expected coll before Close()")
+	s, _ = NewStore(f)
+	if err := s.UsePooledItems(true); err != nil {
+		t.Errorf("expected UsePooledItems to work, got: %v", err)
 	}
-	s.Close()
-	if s.coll != unsafe.Pointer(nil) {
-		t.Errorf("expected no coll after Close()")
+	x = s.GetCollection("x")
+
+	i, _ := x.GetItem([]byte("007"), true)
+	if i == nil || i.pooled == nil || string(i.Val) != "v007" ||
+		atomic.LoadInt32(&i.pooled.refs) != 2 {
+		t.Errorf("expected a pooled item with 2 refs, got: %+v", i)
 	}
-	s.Close()
-	if s.coll != unsafe.Pointer(nil) {
-		t.Errorf("expected no coll after re-Close()")
+	s.ItemDecRef(x, i)
+
+	// Deleting drops the node's ref, once the next mutation releases
+	// the deleting root, so the item is recycled once the last ref is
+	// released.
+	pi := i.pooled
+	i, _ = x.GetItem([]byte("007"), true)
+	x.Delete([]byte("007"))
+	x.Set([]byte("next"), []byte("vnext"))
+	if string(i.Key) != "007" || string(i.Val) != "v007" {
+		t.Errorf("expected a referenced item to stay intact, got: %+v", i)
 	}
-	s.Close()
-	if s.coll != unsafe.Pointer(nil) {
-		t.Errorf("expected no coll after re-Close()")
+	if atomic.LoadInt32(&pi.refs) != 1 {
+		t.Errorf("expected 1 ref left, got: %v", pi.refs)
 	}
-
-	// Now, with a collection
-	s, _ = NewStore(nil)
-	s.SetCollection("x", bytes.Compare)
-	if s.coll == unsafe.Pointer(nil) {
-		t.Errorf("expected coll before Close()")
+	s.ItemDecRef(x, i)
+	if i.Key != nil || i.pooled != nil {
+		t.Errorf("expected the item to be recycled, got: %+v", i)
 	}
-	s.Close()
-	if s.coll != unsafe.Pointer(nil) {
-		t.Errorf("expected no coll after Close()")
+
+	// Evicted items may still be used by readers, so aren't recycled.
+	i, _ = x.GetItem([]byte("008"), true)
+	s.ItemDecRef(x, i)
+	for n := 0; n < 200; n++ {
+		x.EvictSomeItems()
 	}
-	s.Close()
-	if s.coll != unsafe.Pointer(nil) {
-		t.Errorf("expected no coll after Close()")
+	if string(i.Key) != "008" || string(i.Val) != "v008" {
+		t.Errorf("expected an evicted item to stay intact, got: %+v", i)
 	}
-}
 
-func TestItemNumValBytes(t *testing.T) {
-	var x *Collection
-	var h *Item
-	s, err := NewStoreEx(nil, StoreCallbacks{
-		ItemValLength: func(c *Collection, i *Item) int {
-			if c != x {
-				t.Errorf("expected colls to be the same")
+	// Concurrent visitors, writers and evictions; run with -race.
+	var wg sync.WaitGroup
+	var stop int32
+	errs := make(chan error, 10)
+	for v := 0; v < 4; v++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				err := x.VisitItemsAscend(nil, true, func(i *Item) bool {
+					if string(i.Val) != "v"+string(i.Key) {
+						errs <- fmt.Errorf("recycled item while visited: %q = %q",
+							i.Key, i.Val)
+						return false
+					}
+					if i.pooled != nil && atomic.LoadInt32(&i.pooled.refs) <= 0 &&
+						atomic.LoadInt32(&i.pooled.visible) == 0 {
+						errs <- fmt.Errorf("unreferenced item while visited: %q", i.Key)
+						return false
+					}
+					return true
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
 			}
-			if h != i {
-				t.Errorf("expected items to be the same")
+		}()
+	}
+	for n := 0; n < 2000; n++ {
+		k := fmt.Sprintf("%03d", rand.Intn(200))
+		switch n % 4 {
+		case 0:
+			x.Set([]byte(k), []byte("v"+k))
+		case 1:
+			x.Delete([]byte(k))
+		case 2:
+			x.EvictSomeItems()
+		case 3:
+			if n%40 == 3 {
+				s.Flush()
 			}
-			return 1313
-		},
-	})
-	if err != nil || s == nil {
-		t.Errorf("expected memory-only NewStore to work")
+		}
 	}
-	x = s.SetCollection("x", bytes.Compare)
-	h = &Item{}
-	if 1313 != h.NumValBytes(x) {
-		t.Errorf("expected NumValBytes to be 1313")
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
 	}
 }
 
-func TestReclaimRootChain(t *testing.T) {
-	s, err := NewStore(nil)
-	if err != nil || s == nil {
-		t.Errorf("expected memory-only NewStore to work")
+func TestGetItemRef(t *testing.T) {
+	s, _ := NewStore(&memFile{})
+	x := s.SetCollection("x", nil)
+	val := []byte("value")
+	x.Set([]byte("a"), val)
+	x.Set([]byte("empty"), []byte{})
+	i, err := x.GetItemRef([]byte("a"))
+	if err != nil || i == nil || &i.Val[0] != &val[0] {
+		t.Errorf("expected GetItemRef to alias the set value, got: %v, %v", i, err)
 	}
-	x := s.SetCollection("x", bytes.Compare)
-	x.SetItem(&Item{
-		Key:      []byte("a"),
-		Val:      []byte("aaa"),
-		Priority: 100,
-	})
-	x.SetItem(&Item{
-		Key:      []byte("b"),
-		Val:      []byte("bbb"),
+	if i, err = x.GetItemRef([]byte("empty")); err != nil || i.Val == nil || len(i.Val) != 0 {
+		t.Errorf("expected empty non-nil value, got: %v, %v", i, err)
+	}
+	if i, err = x.GetItemRef([]byte("missing")); err != nil || i != nil {
+		t.Errorf("expected nil for a missing key, got: %v, %v", i, err)
+	}
+	s.Flush()
+	for n := 0; n < 100; n++ {
+		x.EvictSomeItems()
+	}
+	i, err = x.GetItemRef([]byte("a"))
+	if err != nil || string(i.Val) != "value" || &i.Val[0] == &val[0] {
+		t.Errorf("expected re-read value, got: %v, %v", i, err)
+	}
+	j, _ := x.GetItemRef([]byte("a"))
+	if &j.Val[0] != &i.Val[0] {
+		t.Errorf("expected re-read value to be cached and aliased")
+	}
+
+	// The aliased item is ref-counted like one of GetItem().
+	s, _ = NewStore(nil)
+	s.SetDebugValidation(1)
+	x = s.SetCollection("x", nil)
+	x.Set([]byte("a"), val)
+	i, _ = x.GetItemRef([]byte("a"))
+	if &i.Val[0] != &val[0] || s.debugRefs.counts[i].count != 2 {
+		t.Errorf("expected an aliased item with a ref, got: %v", s.debugRefs.counts[i])
+	}
+	s.ItemDecRef(x, i)
+	if s.debugRefs.counts[i].count != 1 {
+		t.Errorf("expected the ref released, got: %v", s.debugRefs.counts[i])
+	}
+
+	// With value buffer callbacks, a copy is returned, which is released
+	// like the collection's own items.
+	counts := map[*Item]int{}
+	f := &memFile{}
+	s, _ = NewStoreEx(f, StoreCallbacks{
+		ItemAlloc: func(c *Collection, keyLength uint16) *Item {
+			i := &Item{Key: make([]byte, keyLength)}
+			counts[i] = 1
+			return i
+		},
+		ItemAddRef: func(c *Collection, i *Item) { counts[i]++ },
+		ItemDecRef: func(c *Collection, i *Item) {
+			counts[i]--
+			if counts[i] < 0 {
+				t.Errorf("expected non-negative ref-count, key: %q", i.Key)
+			}
+		},
+	})
+	x = s.SetCollection("x", nil)
+	x.Set([]byte("a"), val)
+	s.Flush()
+	for n := 0; n < 100; n++ {
+		x.EvictSomeItems()
+	}
+	for _, desc := range []string{"read from file", "cached"} {
+		before := map[*Item]int{}
+		for k, v := range counts {
+			before[k] = v
+		}
+		i, err = x.GetItemRef([]byte("a"))
+		if err != nil || string(i.Val) != "value" || string(i.Key) != "a" ||
+			&i.Val[0] == &val[0] || counts[i] != 1 {
+			t.Errorf("%s: expected an allocated copy with callbacks, got: %v, %v, %v",
+				desc, i, err, counts[i])
+		}
+		s.ItemDecRef(x, i)
+		for k, v := range before {
+			if counts[k] != v {
+				t.Errorf("%s: expected the ref-count of %q unchanged, got: %v vs %v",
+					desc, k.Key, counts[k], v)
+			}
+		}
+		if counts[i] != 0 {
+			t.Errorf("%s: expected the copy released, got: %v", desc, counts[i])
+		}
+	}
+}
+
+func TestGetInto(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		f := &memFile{}
+		var s *Store
+		if encrypted {
+			xor := func(b []byte, offset int64) ([]byte, error) {
+				res := make([]byte, len(b))
+				for i := range b {
+					res[i] = b[i] ^ 0x5a
+				}
+				return res, nil
+			}
+			s, _ = NewStoreEx(f, StoreCallbacks{Encrypt: xor, Decrypt: xor})
+		} else {
+			s, _ = NewStore(f)
+		}
+		x := s.SetCollection("x", nil)
+		x.SetItem(&Item{Key: []byte("a"), Val: []byte("AAA"), Priority: 10})
+		x.Set([]byte("b"), []byte("BBBBBB"))
+		x.Set([]byte("empty"), []byte{})
+		check := func(desc string) {
+			buf := []byte("prefix:")
+			val, found, err := x.GetInto([]byte("a"), buf)
+			if err != nil || !found || string(val) != "prefix:AAA" {
+				t.Errorf("%s: expected prefix:AAA, got: %q, %v, %v", desc, val, found, err)
+			}
+			val, found, err = x.GetInto([]byte("b"), make([]byte, 0, 100))
+			if err != nil || !found || string(val) != "BBBBBB" {
+				t.Errorf("%s: expected BBBBBB, got: %q, %v, %v", desc, val, found, err)
+			}
+			mem, _ := x.GetItemRef([]byte("b"))
+			if mem != nil && mem.Val != nil && &mem.Val[0] == &val[0] {
+				t.Errorf("%s: expected GetInto not to alias the collection", desc)
+			}
+			val, found, err = x.GetInto([]byte("empty"), nil)
+			if err != nil || !found || val == nil || len(val) != 0 {
+				t.Errorf("%s: expected non-nil empty, got: %v, %v, %v", desc, val, found, err)
+			}
+			val, found, err = x.GetInto([]byte("missing"), buf)
+			if err != nil || found || string(val) != "prefix:" {
+				t.Errorf("%s: expected not found, got: %q, %v, %v", desc, val, found, err)
+			}
+			item := &Item{Key: make([]byte, 0, 10), Val: make([]byte, 0, 10),
+				Transient: unsafe.Pointer(&buf)}
+			keyBuf := item.Key[:1]
+			found, err = x.GetItemInto([]byte("a"), item)
+			if err != nil || !found || string(item.Key) != "a" ||
+				string(item.Val) != "AAA" || item.Priority != 10 ||
+				item.Transient != nil || &item.Key[0] != &keyBuf[0] {
+				t.Errorf("%s: expected item a reusing buffers, got: %+v, %v, %v",
+					desc, item, found, err)
+			}
+			if found, err = x.GetItemInto([]byte("missing"), item); err != nil || found {
+				t.Errorf("%s: expected missing, got: %v, %v", desc, found, err)
+			}
+		}
+		check("in memory")
+		s.Flush()
+		s, _ = NewStoreEx(f, s.callbacks)
+		x = s.GetCollection("x")
+		check("reopened")
+		if i, _ := x.GetItemRef([]byte("missing")); i != nil {
+			t.Errorf("expected missing")
+		}
+	}
+}
+
+func TestTransientVal(t *testing.T) {
+	f := NewMemStoreFile()
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	x.SetItem(&Item{Key: []byte("a"), Val: []byte("cached"), Priority: 100,
+		TransientVal: true})
+	x.Set([]byte("b"), []byte("B"))
+	if _, numBytes, _ := x.GetTotals(); numBytes != 3 {
+		t.Errorf("expected the transient Val not counted, got: %v", numBytes)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, got: %v", err)
+	}
+	if v, _ := x.Get([]byte("a")); string(v) != "cached" {
+		t.Errorf("expected the transient Val kept in memory, got: %q", v)
+	}
+	if bytes.Contains(f.Bytes(), []byte("cached")) {
+		t.Errorf("expected the transient Val not written")
+	}
+	cf := NewMemStoreFile()
+	c, err := s.CopyTo(cf, 0)
+	if err != nil {
+		t.Fatalf("expected CopyTo to work, got: %v", err)
+	}
+	c.Close()
+	if bytes.Contains(cf.Bytes(), []byte("cached")) {
+		t.Errorf("expected the transient Val not copied")
+	}
+	for n := 0; n < 100; n++ {
+		x.EvictSomeItems()
+	}
+	if v, _ := x.Get([]byte("a")); v == nil || len(v) != 0 {
+		t.Errorf("expected an empty Val after eviction, got: %q", v)
+	}
+	s.Close()
+
+	s, _ = NewStore(f)
+	defer s.Close()
+	x = s.GetCollection("x")
+	i, err := x.GetItem([]byte("a"), true)
+	if err != nil || i == nil || len(i.Val) != 0 || i.Priority != 100 {
+		t.Errorf("expected the key kept with an empty Val, got: %v, %v", i, err)
+	}
+	if v, _ := x.Get([]byte("b")); string(v) != "B" {
+		t.Errorf("expected the persisted Val of b, got: %q", v)
+	}
+}
+
+func TestCurFreeNodes(t *testing.T) {
+	s, err := NewStore(nil)
+	if err != nil || s == nil {
+		t.Errorf("expected memory-only NewStore to work")
+	}
+	x := s.SetCollection("x", bytes.Compare)
+	n := x.mkNode(empty_itemLoc, empty_nodeLoc, empty_nodeLoc, 0, 0)
+	f := x.AllocStats()
+	x.freeNode_unlocked(n, nil)
+	g := x.AllocStats()
+	if f.FreeNodes+1 != g.FreeNodes {
+		t.Errorf("expected freeNodes to increment")
+	}
+	if f.CurFreeNodes+1 != g.CurFreeNodes {
+		t.Errorf("expected CurFreeNodes + 1 == g.CurrFreeNodes, got: %v, %v",
+			f.CurFreeNodes+1, g.CurFreeNodes)
+	}
+}
+
+func TestCollectionStats(t *testing.T) {
+	s, err := NewStore(nil)
+	if err != nil || s == nil {
+		t.Errorf("expected memory-only NewStore to work")
+	}
+	x := s.SetCollection("x", bytes.Compare)
+	g := x.AllocStats()
+	loadCollection(x, []string{"e", "d", "a", "c", "b", "c", "a"})
+	h := x.AllocStats()
+	if h.MkNodes <= g.MkNodes {
+		t.Errorf("expected MkNodes to be more")
+	}
+	if h.MkNodeLocs <= g.MkNodeLocs {
+		t.Errorf("expected MkNodeLocs to be more")
+	}
+	if h.MkRootNodeLocs <= g.MkRootNodeLocs {
+		t.Errorf("expected MkRootNodeLocs to be more")
+	}
+}
+
+func TestDump(t *testing.T) {
+	s, err := NewStore(nil)
+	if err != nil || s == nil {
+		t.Errorf("expected memory-only NewStore to work")
+	}
+	x := s.SetCollection("x", bytes.Compare)
+	loadCollection(x, []string{"e", "d", "a", "c", "b", "c", "a"})
+	fmt.Printf("testing dump\n")
+	dump(s, x.root.root, 1)
+}
+
+func TestStoreClose(t *testing.T) {
+	s, err := NewStore(nil)
+	if err != nil || s == nil {
+		t.Errorf("expected memory-only NewStore to work")
+	}
+	if s.coll == unsafe.Pointer(nil) {
+		t.Errorf("expected coll before Close()")
+	}
+	s.Close()
+	if s.coll != unsafe.Pointer(nil) {
+		t.Errorf("expected no coll after Close()")
+	}
+	s.Close()
+	if s.coll != unsafe.Pointer(nil) {
+		t.Errorf("expected no coll after re-Close()")
+	}
+	s.Close()
+	if s.coll != unsafe.Pointer(nil) {
+		t.Errorf("expected no coll after re-Close()")
+	}
+
+	// Now, with a collection
+	s, _ = NewStore(nil)
+	s.SetCollection("x", bytes.Compare)
+	if s.coll == unsafe.Pointer(nil) {
+		t.Errorf("expected coll before Close()")
+	}
+	s.Close()
+	if s.coll != unsafe.Pointer(nil) {
+		t.Errorf("expected no coll after Close()")
+	}
+	s.Close()
+	if s.coll != unsafe.Pointer(nil) {
+		t.Errorf("expected no coll after Close()")
+	}
+}
+
+func TestStoreCloseEx(t *testing.T) {
+	fname := "tmpCloseEx.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	numFDs := func() int {
+		fds, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			return -1
+		}
+		return len(fds)
+	}
+	fdsBeg := numFDs()
+	for i := 0; i < 200; i++ {
+		f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			t.Fatalf("expected OpenFile to work, got: %v", err)
+		}
+		s, err := NewStore(f)
+		if err != nil {
+			t.Fatalf("expected NewStore to work, got: %v", err)
+		}
+		x := s.GetCollection("x")
+		if x == nil {
+			x = s.SetCollection("x", nil)
+		}
+		v, err := x.Get([]byte("a"))
+		if err != nil || (i > 0 && string(v) != fmt.Sprintf("%d", i-1)) {
+			t.Errorf("expected flushed close to persist %v, got: %q, %v", i-1, v, err)
+		}
+		x.Set([]byte("a"), []byte(fmt.Sprintf("%d", i)))
+		if err = s.CloseEx(CloseOptions{Flush: true, CloseFile: true}); err != nil {
+			t.Errorf("expected CloseEx to work, got: %v", err)
+		}
+		if err = s.Close(); err != nil {
+			t.Errorf("expected re-Close to be a no-op, got: %v", err)
+		}
+		if err = x.Set([]byte("b"), []byte("b")); err != ErrStoreClosed {
+			t.Errorf("expected Set after Close to fail, got: %v", err)
+		}
+		if _, err = x.Delete([]byte("a")); err != ErrStoreClosed {
+			t.Errorf("expected Delete after Close to fail, got: %v", err)
+		}
+		if err = s.Flush(); err != ErrStoreClosed {
+			t.Errorf("expected Flush after Close to fail, got: %v", err)
+		}
+		if s.GetCollection("x") != nil || s.SetCollection("y", nil) != nil {
+			t.Errorf("expected no collections after Close")
+		}
+		if _, err = f.Stat(); err == nil {
+			t.Errorf("expected CloseFile to close the file")
+		}
+	}
+	if fdsBeg >= 0 && numFDs() > fdsBeg {
+		t.Errorf("expected no fd growth, got: %v to %v", fdsBeg, numFDs())
+	}
+
+	// Without CloseFile, the file remains the application's.
+	f, _ := os.OpenFile(fname, os.O_RDWR, 0666)
+	s, _ := NewStore(f)
+	ss := s.Snapshot()
+	if err := s.Close(); err != nil {
+		t.Errorf("expected Close to work, got: %v", err)
+	}
+	if _, err := f.Stat(); err != nil {
+		t.Errorf("expected Close to leave the file open, got: %v", err)
+	}
+	v, err := ss.GetCollection("x").Get([]byte("a"))
+	if err != nil || string(v) != "199" {
+		t.Errorf("expected snapshot to outlive Close, got: %q, %v", v, err)
+	}
+	f.Close()
+}
+
+func TestItemNumValBytes(t *testing.T) {
+	var x *Collection
+	var h *Item
+	s, err := NewStoreEx(nil, StoreCallbacks{
+		ItemValLength: func(c *Collection, i *Item) int {
+			if c != x {
+				t.Errorf("expected colls to be the same")
+			}
+			if h != i {
+				t.Errorf("expected items to be the same")
+			}
+			return 1313
+		},
+	})
+	if err != nil || s == nil {
+		t.Errorf("expected memory-only NewStore to work")
+	}
+	x = s.SetCollection("x", bytes.Compare)
+	h = &Item{}
+	if 1313 != h.NumValBytes(x) {
+		t.Errorf("expected NumValBytes to be 1313")
+	}
+}
+
+func TestReclaimRootChain(t *testing.T) {
+	s, err := NewStore(nil)
+	if err != nil || s == nil {
+		t.Errorf("expected memory-only NewStore to work")
+	}
+	x := s.SetCollection("x", bytes.Compare)
+	x.SetItem(&Item{
+		Key:      []byte("a"),
+		Val:      []byte("aaa"),
+		Priority: 100,
+	})
+	x.SetItem(&Item{
+		Key:      []byte("b"),
+		Val:      []byte("bbb"),
 		Priority: 200,
 	})
 	s2 := s.Snapshot()
@@ -2012,6 +2882,92 @@ func TestFlushRevert(t *testing.T) {
 	}
 }
 
+func TestFlushRevertCollection(t *testing.T) {
+	fname := "tmpFlushRevertCollection.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	s, _ := NewStore(f)
+	gen := func(c *Collection, g int) {
+		for i := 0; i < 10*g; i++ {
+			c.Set([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprintf("gen-%d", g)))
+		}
+	}
+	expGen := func(desc string, c *Collection, g int) {
+		n := 0
+		err := c.VisitItemsAscend(nil, true, func(i *Item) bool {
+			if string(i.Val) != fmt.Sprintf("gen-%d", g) {
+				t.Errorf("%s: expected gen-%d, got: %q = %q", desc, g, i.Key, i.Val)
+			}
+			n++
+			return true
+		})
+		if err != nil || n != 10*g {
+			t.Errorf("%s: expected %v items, got: %v, %v", desc, 10*g, n, err)
+		}
+	}
+	x, y := s.SetCollection("x", nil), s.SetCollection("y", nil)
+	gen(x, 1)
+	gen(y, 1)
+	s.Flush()
+	gen(x, 2)
+	gen(y, 2)
+	s.SetCollection("z", nil).Set([]byte("z"), []byte("z"))
+	s.Flush()
+
+	report, err := s.FlushRevertCollection("x")
+	if err != nil {
+		t.Errorf("expected FlushRevertCollection to work, got: %v", err)
+	}
+	rc := report.Collections["x"]
+	if len(report.Collections) != 1 || rc.NumItemsBefore != 20 ||
+		rc.NumItemsAfter != 10 || rc.NumBytesBefore != 20*(3+5) ||
+		rc.NumBytesAfter != 10*(3+5) {
+		t.Errorf("expected report of x from 20 to 10 items, got: %#v", report)
+	}
+	expGen("reverted x", s.GetCollection("x"), 1)
+	expGen("unreverted y", s.GetCollection("y"), 2)
+	report, err = s.FlushRevertCollection("z")
+	if err != nil || s.GetCollection("z") != nil ||
+		report.Collections["z"].NumItemsBefore != 1 {
+		t.Errorf("expected reverting new z to remove it, got: %#v, %v", report, err)
+	}
+	if err = s.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+	s.Close()
+	f.Close()
+
+	f, _ = os.OpenFile(fname, os.O_RDWR, 0666)
+	s, _ = NewStore(f)
+	if names := s.GetCollectionNames(); fmt.Sprint(names) != "[x y]" {
+		t.Errorf("expected x, y after reopen, got: %v", names)
+	}
+	expGen("reopened x", s.GetCollection("x"), 1)
+	expGen("reopened y", s.GetCollection("y"), 2)
+
+	// The last change to x was the revert itself, so reverting again
+	// brings back gen-2.
+	if _, err = s.FlushRevertCollection("x"); err != nil {
+		t.Errorf("expected FlushRevertCollection to work, got: %v", err)
+	}
+	expGen("re-reverted x", s.GetCollection("x"), 2)
+
+	// The whole-store revert reports the truncation.
+	report, err = s.FlushRevertEx()
+	if err != nil || report.TruncatedBytes <= 0 {
+		t.Errorf("expected FlushRevertEx to truncate, got: %#v, %v", report, err)
+	}
+	rc = report.Collections["y"]
+	if rc.NumItemsBefore != 20 || rc.NumItemsAfter != 20 {
+		t.Errorf("expected y at 20 items, got: %#v", report)
+	}
+	if report.Collections["x"].NumItemsAfter != 20 || s.GetCollection("z") == nil {
+		t.Errorf("expected the flush with x at gen-2 and z, got: %#v", report)
+	}
+	f.Close()
+}
+
 func TestFlushRevertWithReadError(t *testing.T) {
 	fname := "tmp.test"
 	os.Remove(fname)
@@ -2110,7 +3066,7 @@ func TestDoubleFreeNode(t *testing.T) {
 			t.Errorf("expected c to be 2")
 		}
 	}()
-	withAllocLocks(func() {
+	x.frees.withLocks(func() {
 		x.freeNode_unlocked(nil, nil)
 		c++
 		x.freeNode_unlocked(n, nil)
@@ -2521,6 +3477,7 @@ func TestStoreRefCountRandom(t *testing.T) {
 	if err != nil || s == nil {
 		t.Errorf("expected memory-only NewStoreEx to work")
 	}
+	s.SetDebugValidation(2)
 
 	x := s.SetCollection("x", bytes.Compare)
 
@@ -2609,6 +3566,7 @@ func TestPersistRefCountRandom(t *testing.T) {
 		if err != nil || s == nil {
 			t.Errorf("expected memory-only NewStoreEx to work")
 		}
+		s.SetDebugValidation(1)
 		x := s.SetCollection("x", bytes.Compare)
 		return s, x, counts
 	}
@@ -2727,6 +3685,7 @@ func TestEvictRefCountRandom(t *testing.T) {
 		if err != nil || s == nil {
 			t.Errorf("expected memory-only NewStoreEx to work")
 		}
+		s.SetDebugValidation(2)
 		x = s.SetCollection("x", bytes.Compare)
 		return s, x, counts
 	}
@@ -2859,7 +3818,7 @@ func BenchmarkRandDelete(b *testing.B) {
 	}
 }
 
-func BenchmarkRandGet(b *testing.B) {
+func BenchmarkRandDeleteMulti(b *testing.B) {
 	b.StopTimer()
 	insertP := perm(benchmarkSize)
 	removeP := perm(benchmarkSize)
@@ -2873,12 +3832,7854 @@ func BenchmarkRandGet(b *testing.B) {
 			x.Set(item, item)
 		}
 		b.StartTimer()
-		for _, item := range removeP {
-			x.Get(item)
-			i++
-			if i >= b.N {
-				return
-			}
+		n := len(removeP)
+		if n > b.N-i {
+			n = b.N - i
 		}
+		x.DeleteMulti(removeP[:n])
+		i += n
+	}
+}
+
+func BenchmarkRandGet(b *testing.B) {
+	b.StopTimer()
+	insertP := perm(benchmarkSize)
+	removeP := perm(benchmarkSize)
+	i := 0
+	b.StartTimer()
+	for i < b.N {
+		b.StopTimer()
+		tr, _ := NewStore(nil)
+		x := tr.SetCollection("x", nil)
+		for _, item := range insertP {
+			x.Set(item, item)
+		}
+		b.StartTimer()
+		for _, item := range removeP {
+			x.Get(item)
+			i++
+			if i >= b.N {
+				return
+			}
+		}
+	}
+}
+
+func TestCopyToIncremental(t *testing.T) {
+	fname := "tmpIncrSrc.test"
+	dname := "tmpIncrDst.test"
+	os.Remove(fname)
+	os.Remove(dname)
+	defer os.Remove(fname)
+	defer os.Remove(dname)
+	f, _ := os.Create(fname)
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	y := s.SetCollection("y", nil)
+	for i := 0; i < 200; i++ {
+		k := []byte(fmt.Sprintf("%03d", i))
+		x.Set(k, k)
+		y.Set(k, k)
+	}
+	if err := s.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+	df, _ := os.Create(dname)
+	ic, err := NewIncrementalCopy(df)
+	if err != nil {
+		t.Errorf("expected NewIncrementalCopy to work, got: %v", err)
+	}
+	n1, err := s.CopyToIncremental(ic)
+	if err != nil || n1 <= 0 {
+		t.Errorf("expected first CopyToIncremental to work, got: %v, %v", n1, err)
+	}
+	x.Set([]byte("005"), []byte("five"))
+	x.Delete([]byte("100"))
+	s.RemoveCollection("y")
+	z := s.SetCollection("z", nil)
+	z.Set([]byte("a"), []byte("A")) // Left unflushed so it's dirty.
+	if err = s.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+	z.Set([]byte("b"), []byte("B"))
+	n2, err := s.CopyToIncremental(ic)
+	if err != nil || n2 <= 0 {
+		t.Errorf("expected second CopyToIncremental to work, got: %v, %v", n2, err)
+	}
+	if n2*4 > n1 {
+		t.Errorf("expected incremental copy to write much less, got: %v vs %v",
+			n2, n1)
+	}
+	df.Close()
+
+	df, _ = os.Open(dname)
+	d, err := NewStore(df)
+	if err != nil {
+		t.Errorf("expected reopen of incremental copy to work, got: %v", err)
+	}
+	if names := d.GetCollectionNames(); len(names) != 2 ||
+		names[0] != "x" || names[1] != "z" {
+		t.Errorf("expected collections x and z, got: %v", names)
+	}
+	dx := d.GetCollection("x")
+	for i := 0; i < 200; i++ {
+		k := []byte(fmt.Sprintf("%03d", i))
+		v, err := dx.Get(k)
+		if err != nil {
+			t.Errorf("expected Get to work, got: %v", err)
+		}
+		exp := string(k)
+		if i == 5 {
+			exp = "five"
+		} else if i == 100 {
+			exp = ""
+		}
+		if string(v) != exp {
+			t.Errorf("expected %s to be %q, got: %q", k, exp, v)
+		}
+	}
+	numItems, _, _ := dx.GetTotals()
+	if numItems != 199 {
+		t.Errorf("expected 199 items, got: %v", numItems)
+	}
+	visitExpectCollection(t, d.GetCollection("z"), "a", []string{"a", "b"}, nil)
+	df.Close()
+}
+
+func TestCopyToIncrementalAfterFlushRevert(t *testing.T) {
+	s, _ := NewStore(NewMemStoreFile())
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("000"), []byte("base"))
+	s.Flush()
+	x.Set([]byte("100"), []byte("first"))
+	s.Flush()
+	ic, _ := NewIncrementalCopy(NewMemStoreFile())
+	if _, err := s.CopyToIncremental(ic); err != nil {
+		t.Fatalf("expected CopyToIncremental to work, got: %v", err)
+	}
+	if err := s.FlushRevert(); err != nil {
+		t.Fatalf("expected FlushRevert to work, got: %v", err)
+	}
+	// Grows the file past its size as of the first copy, over the
+	// offsets of the reverted records.
+	x = s.GetCollection("x")
+	x.Set([]byte("100"), []byte("SECOND"))
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(fmt.Sprintf("2%02d", i)), []byte("v"))
+	}
+	s.Flush()
+	if atomic.LoadInt64(&s.size) <= ic.srcSize {
+		t.Fatalf("expected the source file to grow past the first copy")
+	}
+	if _, err := s.CopyToIncremental(ic); err != nil {
+		t.Fatalf("expected CopyToIncremental to work, got: %v", err)
+	}
+	if v, _ := ic.Store().GetCollection("x").Get([]byte("100")); string(v) != "SECOND" {
+		t.Errorf("expected the copy to have the new value, got: %q", v)
+	}
+	if n, _ := ic.Store().GetCollection("x").Count(); n != 102 {
+		t.Errorf("expected 102 copied items, got: %v", n)
+	}
+}
+
+func TestCopyToIncrementalReuseFreeSpace(t *testing.T) {
+	s, _ := NewStore(NewMemStoreFile())
+	if err := s.SetReuseFreeSpace(true); err != nil {
+		t.Fatalf("expected SetReuseFreeSpace to work, got: %v", err)
+	}
+	x := s.SetCollection("x", nil)
+	ic, _ := NewIncrementalCopy(NewMemStoreFile())
+	for round := 0; round < 6; round++ {
+		for i := 0; i < 50; i++ {
+			x.Set([]byte(fmt.Sprintf("%02d", i)), []byte(fmt.Sprintf("v%d", round)))
+		}
+		s.Flush()
+		if _, err := s.CopyToIncremental(ic); err != nil {
+			t.Fatalf("expected CopyToIncremental to work, got: %v", err)
+		}
+		y := ic.Store().GetCollection("x")
+		if n, _ := y.Count(); n != 50 {
+			t.Errorf("expected 50 copied items in round %v, got: %v", round, n)
+		}
+		for i := 0; i < 50; i++ {
+			v, _ := y.Get([]byte(fmt.Sprintf("%02d", i)))
+			if string(v) != fmt.Sprintf("v%d", round) {
+				t.Errorf("expected the value of round %v, got: %q", round, v)
+				break
+			}
+		}
+	}
+	if s.freeList.numReused == 0 {
+		t.Errorf("expected free space to be reused")
+	}
+}
+
+func TestCollectionOpStats(t *testing.T) {
+	fname := "tmpCollOpStats.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	st, err := x.Stats()
+	if err != nil || st.NumItems != 0 || st.NumResidentNodes != 0 {
+		t.Errorf("expected empty stats, got: %#v, %v", st, err)
+	}
+	loadCollection(x, []string{"e", "d", "a", "c", "b", "c", "a"})
+	x.Get([]byte("a"))
+	x.Get([]byte("not-there"))
+	x.Delete([]byte("e"))
+	st, err = x.Stats()
+	if err != nil {
+		t.Errorf("expected stats to work, got: %v", err)
+	}
+	if st.NumItems != 4 || st.NumBytes != 8 {
+		t.Errorf("expected 4 items and 8 bytes, got: %#v", st)
+	}
+	if st.NumSets != 7 || st.NumGets != 2 || st.NumDeletes != 1 {
+		t.Errorf("expected op counts, got: %#v", st)
+	}
+	if st.NumDirtyNodes != 4 || st.NumResidentNodes != 4 ||
+		st.NumPersistedOnlyNodes != 0 || st.ApproxDepth < 2 {
+		t.Errorf("expected all dirty resident nodes, got: %#v", st)
+	}
+	s.Flush()
+	st, _ = x.Stats()
+	if st.NumDirtyNodes != 0 || st.NumResidentNodes != 4 {
+		t.Errorf("expected no dirty nodes after flush, got: %#v", st)
+	}
+	x.EvictSomeItems()
+
+	s2, _ := NewStore(f)
+	x2 := s2.GetCollection("x")
+	st, _ = x2.Stats()
+	if st.NumItems != 4 || st.NumResidentNodes != 1 ||
+		st.NumPersistedOnlyNodes != 3 || st.NumSets != 0 {
+		t.Errorf("expected only root resident after reopen, got: %#v", st)
+	}
+	j, err := json.Marshal(st)
+	if err != nil || !bytes.Contains(j, []byte(`"numPersistedOnlyNodes":3`)) {
+		t.Errorf("expected stats json, got: %s, %v", j, err)
+	}
+	st.LookupCacheHits, st.CompactReclaimedBytes = 5, 6
+	j, err = st.MarshalJSON()
+	if err != nil || !bytes.Contains(j, []byte(`"lookupCacheHits":5`)) {
+		t.Errorf("expected stats MarshalJSON to work, got: %s, %v", j, err)
+	}
+	var st2 CollectionStats
+	if err := json.Unmarshal(j, &st2); err != nil || st2 != st {
+		t.Errorf("expected stats json round trip, got: %#v, %v", st2, err)
+	}
+}
+
+// Returns the keys of the resident nodes of a collection in preorder,
+// with parentheses around subtrees.
+func treeShape(x *Collection) string {
+	var shape func(nloc *nodeLoc) string
+	shape = func(nloc *nodeLoc) string {
+		n := nloc.Node()
+		if n == nil || nloc.isEmpty() {
+			return ""
+		}
+		return fmt.Sprintf("%s(%s,%s)", n.item.Item().Key,
+			shape(&n.left), shape(&n.right))
+	}
+	rnl := x.rootAddRef()
+	defer x.rootDecRef(rnl)
+	return shape(rnl.root)
+}
+
+func TestExportImport(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("%03d", i))
+		x.SetItem(&Item{Key: k, Val: bytes.Repeat(k, i%4), Priority: int32(i * 7)})
+	}
+	var buf bytes.Buffer
+	if err := x.Export(&buf); err != nil {
+		t.Errorf("expected Export to work, got: %v", err)
+	}
+	exported := buf.Bytes()
+	if !bytes.HasPrefix(exported, EXPORT_MAGIC) {
+		t.Errorf("expected export magic")
+	}
+
+	s2, _ := NewStore(nil)
+	y := s2.SetCollection("y", nil)
+	if err := y.Import(bytes.NewReader(exported)); err != nil {
+		t.Errorf("expected Import to work, got: %v", err)
+	}
+	numItems, _, _ := y.GetTotals()
+	if numItems != 100 {
+		t.Errorf("expected 100 imported items, got: %v", numItems)
+	}
+	if xs, ys := treeShape(x), treeShape(y); xs != ys {
+		t.Errorf("expected the imported tree shape, got: %v vs %v", ys, xs)
+	}
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("%03d", i))
+		xi, _ := x.GetItem(k, true)
+		yi, _ := y.GetItem(k, true)
+		if yi == nil || !bytes.Equal(xi.Val, yi.Val) || xi.Priority != yi.Priority {
+			t.Errorf("expected imported item to match, got: %#v vs %#v", xi, yi)
+		}
+	}
+
+	w := s.SetCollection("w", nil)
+	n := 2*jsonReadBatchItems + 10 // Imported in several batches.
+	for i := 0; i < n; i++ {
+		w.Set([]byte(fmt.Sprintf("%05d", i)), []byte("w"))
+	}
+	buf.Reset()
+	w.Export(&buf)
+	v := s2.SetCollection("v", nil)
+	if err := v.Import(&buf); err != nil {
+		t.Errorf("expected Import of batches to work, got: %v", err)
+	}
+	if numItems, _, _ := v.GetTotals(); numItems != uint64(n) {
+		t.Errorf("expected %v imported items, got: %v", n, numItems)
+	}
+	if ws, vs := treeShape(w), treeShape(v); ws != vs {
+		t.Errorf("expected the imported tree shape of batches")
+	}
+
+	z := s2.SetCollection("z", nil)
+	if err := z.Import(bytes.NewReader(exported[:len(exported)-5])); err == nil {
+		t.Errorf("expected truncated Import to fail")
+	}
+	bad := append([]byte(nil), exported...)
+	bad[len(EXPORT_MAGIC)+3] = 99
+	if err := z.Import(bytes.NewReader(bad)); err == nil {
+		t.Errorf("expected Import of unknown version to fail")
+	}
+	if err := z.Import(bytes.NewReader([]byte("not an export"))); err == nil {
+		t.Errorf("expected Import of garbage to fail")
+	}
+
+	var empty bytes.Buffer
+	if err := s2.SetCollection("e", nil).Export(&empty); err != nil {
+		t.Errorf("expected Export of empty collection to work, got: %v", err)
+	}
+	if err := z.Import(&empty); err != nil {
+		t.Errorf("expected Import of empty export to work, got: %v", err)
+	}
+}
+
+func TestExportImportJSONL(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	x.Set([]byte{0xff, 0x00, 0x01}, []byte{0x00, 0xfe, 0x80})
+	x.Set([]byte("b"), []byte{})
+	x.Set([]byte("a\n\"quoted\""), []byte("\x00\x01\x02"))
+	var buf bytes.Buffer
+	if err := x.ExportJSONL(&buf, nil); err != nil {
+		t.Errorf("expected ExportJSONL to work, got: %v", err)
+	}
+	if lines := bytes.Count(buf.Bytes(), []byte("\n")); lines != 3 {
+		t.Errorf("expected 3 lines, got: %v, %s", lines, buf.Bytes())
+	}
+	y := s.SetCollection("y", nil)
+	if err := y.ImportJSONL(bytes.NewReader(buf.Bytes()), nil); err != nil {
+		t.Errorf("expected ImportJSONL to work, got: %v", err)
+	}
+	for _, k := range [][]byte{{0xff, 0x00, 0x01}, []byte("b"), []byte("a\n\"quoted\"")} {
+		xv, _ := x.Get(k)
+		yv, _ := y.Get(k)
+		if yv == nil || !bytes.Equal(xv, yv) {
+			t.Errorf("expected imported value for %q, got: %q vs %q", k, xv, yv)
+		}
+	}
+
+	j := s.SetCollection("j", nil)
+	j.Set([]byte("doc"), []byte(`{"n":1}`))
+	buf.Reset()
+	err := j.ExportJSONL(&buf, func(v []byte) interface{} { return json.RawMessage(v) })
+	if err != nil || !bytes.Contains(buf.Bytes(), []byte(`"val":{"n":1}`)) {
+		t.Errorf("expected raw JSON value, got: %s, %v", buf.Bytes(), err)
+	}
+	k := s.SetCollection("k", nil)
+	err = k.ImportJSONL(bytes.NewReader(buf.Bytes()),
+		func(raw json.RawMessage) ([]byte, error) { return raw, nil })
+	if v, _ := k.Get([]byte("doc")); err != nil || string(v) != `{"n":1}` {
+		t.Errorf("expected raw JSON value import, got: %s, %v", v, err)
+	}
+	if err = k.ImportJSONL(bytes.NewReader([]byte("{\"key\":\"YQ==\",\"val\":1}\n")),
+		nil); err == nil {
+		t.Errorf("expected non-base64 val to fail import")
+	}
+}
+
+func TestWriteReadJSON(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	x.SetItem(&Item{Key: []byte{0xff, 0x00, 0x01}, Val: []byte{0x00, 0xfe, 0x80}, Priority: 7})
+	x.Set([]byte("b"), []byte{})
+	x.Set([]byte("a<\"quoted\">"), []byte("text"))
+	var buf bytes.Buffer
+	if err := x.WriteJSON(&buf, true); err != nil {
+		t.Errorf("expected WriteJSON to work, got: %v", err)
+	}
+	var recs []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &recs); err != nil || len(recs) != 3 {
+		t.Errorf("expected a JSON array of 3 items, got: %s, %v", buf.Bytes(), err)
+	}
+	y := s.SetCollection("y", nil)
+	n, err := y.ReadJSON(bytes.NewReader(buf.Bytes()))
+	if err != nil || n != 3 {
+		t.Errorf("expected ReadJSON to load 3 items, got: %v, %v", n, err)
+	}
+	sameItems := func(a, b *Collection) bool {
+		var ak, bk []string
+		a.VisitItemsAscend([]byte{0}, true, func(i *Item) bool {
+			ak = append(ak, fmt.Sprintf("%q=%q/%v", i.Key, i.Val, i.Priority))
+			return true
+		})
+		b.VisitItemsAscend([]byte{0}, true, func(i *Item) bool {
+			bk = append(bk, fmt.Sprintf("%q=%q/%v", i.Key, i.Val, i.Priority))
+			return true
+		})
+		return strings.Join(ak, ",") == strings.Join(bk, ",")
+	}
+	if !sameItems(x, y) {
+		t.Errorf("expected ReadJSON to round-trip the items")
+	}
+
+	buf.Reset()
+	err = x.WriteJSONEx(&buf, JSONOptions{WithValue: true, KeyStrings: true, ValStrings: true})
+	if err != nil ||
+		!bytes.Contains(buf.Bytes(), []byte(`"keyStr":"a<\"quoted\">","valStr":"text"`)) ||
+		!bytes.Contains(buf.Bytes(), []byte(`"key":"/wAB","val":"AP6A","priority":7`)) {
+		t.Errorf("expected UTF-8 strings and base64 otherwise, got: %s, %v", buf.Bytes(), err)
+	}
+	z := s.SetCollection("z", nil)
+	if n, err = z.ReadJSON(bytes.NewReader(buf.Bytes())); err != nil || n != 3 ||
+		!sameItems(x, z) {
+		t.Errorf("expected ReadJSON of strings to round-trip, got: %v, %v", n, err)
+	}
+
+	buf.Reset()
+	if err = x.WriteJSON(&buf, false); err != nil || bytes.Contains(buf.Bytes(), []byte("val")) {
+		t.Errorf("expected no values, got: %s, %v", buf.Bytes(), err)
+	}
+	k := s.SetCollection("k", nil)
+	if n, err = k.ReadJSON(bytes.NewReader(buf.Bytes())); err != nil || n != 3 {
+		t.Errorf("expected ReadJSON of keys to work, got: %v, %v", n, err)
+	}
+	if v, _ := k.Get([]byte("b")); v == nil || len(v) != 0 {
+		t.Errorf("expected an empty value, got: %q", v)
+	}
+
+	e := s.SetCollection("e", nil)
+	buf.Reset()
+	if err = e.WriteJSON(&buf, true); err != nil || buf.String() != "[]\n" {
+		t.Errorf("expected an empty array, got: %q, %v", buf.String(), err)
+	}
+	if n, err = e.ReadJSON(bytes.NewReader(buf.Bytes())); err != nil || n != 0 {
+		t.Errorf("expected ReadJSON of no items to work, got: %v, %v", n, err)
+	}
+	for _, bad := range []string{``, `{}`, `[{"key":"YQ==","val":1}]`,
+		`[{"key":"YQ==","priority":-1}]`, `[{"val":"YQ=="}]`, `[{"key":"YQ=="}`} {
+		if _, err = e.ReadJSON(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected ReadJSON to fail for: %s", bad)
+		}
+	}
+
+	var mutations int
+	m := s.SetCollection("m", nil)
+	m.OnMutation(func(op MutationOp, key, val []byte) { mutations++ })
+	for i := 0; i < 2500; i++ {
+		x.Set([]byte(fmt.Sprintf("big-%05d", i)), bytes.Repeat([]byte{byte(i)}, 2000))
+	}
+	x.Set([]byte("huge"), bytes.Repeat([]byte("h"), 5*1024*1024))
+	buf.Reset()
+	if err = x.WriteJSON(&buf, true); err != nil || buf.Len() < 10*1024*1024 {
+		t.Errorf("expected a multi-megabyte stream, got: %v, %v", buf.Len(), err)
+	}
+	if n, err = m.ReadJSON(bytes.NewReader(buf.Bytes())); err != nil || n != 2504 {
+		t.Errorf("expected ReadJSON to load 2504 items, got: %v, %v", n, err)
+	}
+	if !sameItems(x, m) || mutations != 2504 {
+		t.Errorf("expected the multi-megabyte round-trip, mutations: %v", mutations)
+	}
+}
+
+func TestMetricsNames(t *testing.T) {
+	re := regexp.MustCompile(`(?:metricsCounter|metrics\.Counter|metrics\.Gauge)\("(\w+)"`)
+	fnames, _ := filepath.Glob("*.go")
+	counters, gauges := map[string]bool{}, map[string]bool{}
+	for _, fname := range fnames {
+		if strings.HasSuffix(fname, "_test.go") {
+			continue
+		}
+		b, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Fatalf("expected ReadFile to work, got: %v", err)
+		}
+		for _, m := range re.FindAllSubmatch(b, -1) {
+			if bytes.HasSuffix(m[0], []byte(`Gauge("`+string(m[1])+`"`)) {
+				gauges[string(m[1])] = true
+			} else {
+				counters[string(m[1])] = true
+			}
+		}
+	}
+	check := func(kind string, names []string, found map[string]bool) {
+		if !sort.StringsAreSorted(names) {
+			t.Errorf("expected sorted %v names, got: %v", kind, names)
+		}
+		for _, name := range names {
+			if !found[name] {
+				t.Errorf("expected %v %v to be reported", kind, name)
+			}
+			delete(found, name)
+		}
+		for name := range found {
+			t.Errorf("expected %v %v to be listed", kind, name)
+		}
+	}
+	check("counter", MetricsCounters, counters)
+	check("gauge", MetricsGauges, gauges)
+}
+
+func TestMetricsSink(t *testing.T) {
+	fname := "tmpMetricsSink.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+	m := NewExpvarMetricsSink("gkvliteTestMetricsSink")
+	s.SetMetricsSink(m)
+	counter := func(name string) int64 {
+		if v, ok := m.Map.Get(name).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("%03d", i))
+		x.Set(k, k)
+	}
+	x.Delete([]byte("050"))
+	if counter("nodesReclaimed") <= 0 {
+		t.Errorf("expected nodesReclaimed, got: %v", counter("nodesReclaimed"))
+	}
+	if err := s.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+	if counter("flushes") != 1 || counter("flushBytes") <= 0 {
+		t.Errorf("expected flush metrics, got: %v", m.Map.String())
+	}
+	if m.Map.Get("flushDurationNanos") == nil {
+		t.Errorf("expected flushDurationNanos gauge")
+	}
+	for i := 0; i < 20; i++ {
+		x.EvictSomeItems()
+	}
+	if counter("evictions") <= 0 {
+		t.Errorf("expected evictions, got: %v", counter("evictions"))
+	}
+
+	s2, _ := NewStore(f)
+	s2.SetMetricsSink(m)
+	hits := counter("nodeCacheHits")
+	x2 := s2.GetCollection("x")
+	x2.Get([]byte("010"))
+	x2.Get([]byte("010"))
+	if counter("nodeReads") <= 0 || counter("nodeCacheMisses") <= 0 ||
+		counter("nodeCacheHits") <= hits {
+		t.Errorf("expected node read metrics, got: %v", m.Map.String())
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	fname := "tmpEncrypted.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	block, _ := aes.NewCipher([]byte("0123456789abcdef"))
+	gcm, _ := cipher.NewGCM(block)
+	nonce := func(offset int64) []byte {
+		n := make([]byte, gcm.NonceSize())
+		binary.BigEndian.PutUint64(n[len(n)-8:], uint64(offset))
+		return n
+	}
+	callbacks := StoreCallbacks{
+		Encrypt: func(b []byte, offset int64) ([]byte, error) {
+			return gcm.Seal(nil, nonce(offset), b, nil), nil
+		},
+		Decrypt: func(b []byte, offset int64) ([]byte, error) {
+			return gcm.Open(nil, nonce(offset), b, nil)
+		},
+	}
+	f, _ := os.Create(fname)
+	s, err := NewStoreEx(f, callbacks)
+	if err != nil {
+		t.Errorf("expected NewStoreEx with encryption to work, got: %v", err)
+	}
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprintf("secret-%03d", i)))
+	}
+	if err = s.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+	f.Close()
+	b, _ := ioutil.ReadFile(fname)
+	if bytes.Contains(b, []byte("secret-")) {
+		t.Errorf("expected no plaintext values in the file")
+	}
+
+	f, _ = os.OpenFile(fname, os.O_RDWR, 0666)
+	defer f.Close()
+	if _, err = NewStore(f); err == nil {
+		t.Errorf("expected NewStore without Decrypt to fail")
+	}
+	s, err = NewStoreEx(f, callbacks)
+	if err != nil {
+		t.Errorf("expected re-open with encryption to work, got: %v", err)
+	}
+	x = s.GetCollection("x")
+	v, err := x.Get([]byte("042"))
+	if err != nil || string(v) != "secret-042" {
+		t.Errorf("expected decrypted value, got: %v, %v", v, err)
+	}
+	n, nb, err := x.GetTotals()
+	if err != nil || n != 100 || nb != 100*(3+10) {
+		t.Errorf("expected plaintext totals, got: %v, %v, %v", n, nb, err)
+	}
+}
+
+func TestRecoverTruncatedFlush(t *testing.T) {
+	fname := "tmpRecover.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("a"), []byte("A"))
+	s.Flush()
+	stat, _ := f.Stat()
+	goodSize := stat.Size()
+	x.Set([]byte("b"), []byte("B"))
+	s.Flush()
+	f.Close()
+
+	// Simulate a crash mid-Flush, where the last roots record was
+	// partially written and followed by junk.
+	stat, _ = os.Stat(fname)
+	os.Truncate(fname, stat.Size()-5)
+	f, _ = os.OpenFile(fname, os.O_RDWR|os.O_APPEND, 0666)
+	f.Write([]byte("junkjunkjunk"))
+	f.Close()
+	stat, _ = os.Stat(fname)
+	junkSize := stat.Size()
+
+	f, _ = os.OpenFile(fname, os.O_RDWR, 0666)
+	defer f.Close()
+	s, err := NewStore(f)
+	rerr, ok := err.(*RecoveredError)
+	if !ok || s == nil {
+		t.Fatalf("expected RecoveredError and a store, got: %v, %v", s, err)
+	}
+	if rerr.DiscardedBytes != junkSize-goodSize {
+		t.Errorf("expected discarded bytes %v, got: %v",
+			junkSize-goodSize, rerr.DiscardedBytes)
+	}
+	x = s.GetCollection("x")
+	if v, err := x.Get([]byte("a")); err != nil || string(v) != "A" {
+		t.Errorf("expected a recovered, got: %v, %v", v, err)
+	}
+	if v, err := x.Get([]byte("b")); err != nil || v != nil {
+		t.Errorf("expected b rolled back, got: %v, %v", v, err)
+	}
+	stat, _ = f.Stat()
+	if stat.Size() != junkSize {
+		t.Errorf("expected file untouched by recovery")
+	}
+	x.Set([]byte("c"), []byte("C"))
+	if err = s.Flush(); err != nil {
+		t.Errorf("expected Flush after recovery to work, got: %v", err)
+	}
+	if s, err = NewStore(f); err != nil {
+		t.Errorf("expected clean reopen after Flush, got: %v", err)
+	}
+	if v, _ := s.GetCollection("x").Get([]byte("c")); string(v) != "C" {
+		t.Errorf("expected c after reopen, got: %v", v)
+	}
+}
+
+func TestRecoverBadRootsChecksum(t *testing.T) {
+	fname := "tmpRecoverChecksum.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("a"), []byte("A"))
+	s.Flush()
+	stat, _ := f.Stat()
+	goodSize := stat.Size()
+	s.SetCollection("y", nil)
+	s.Flush()
+	stat, _ = f.Stat()
+
+	// Corrupt the "y" collection name inside the last roots record.
+	b := make([]byte, stat.Size()-goodSize)
+	f.ReadAt(b, goodSize)
+	i := bytes.Index(b, []byte(`"y"`))
+	if i < 0 {
+		t.Fatalf("expected y in last roots record")
+	}
+	f.WriteAt([]byte(`"z"`), goodSize+int64(i))
+
+	s, err := NewStore(f)
+	if _, ok := err.(*RecoveredError); !ok {
+		t.Errorf("expected RecoveredError, got: %v", err)
+	}
+	if s.GetCollection("x") == nil || s.GetCollection("y") != nil ||
+		s.GetCollection("z") != nil {
+		t.Errorf("expected recovery to previous roots, got: %v",
+			s.GetCollectionNames())
+	}
+}
+
+type captureLogger struct {
+	msgs []string
+}
+
+func (l *captureLogger) Printf(format string, v ...interface{}) {
+	l.msgs = append(l.msgs, fmt.Sprintf(format, v...))
+}
+
+func (l *captureLogger) has(substr string) bool {
+	for _, m := range l.msgs {
+		if strings.Contains(m, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	fname := "tmpLogger.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	m := &mockfile{f: f}
+	s, _ := NewStore(m)
+	l := &captureLogger{}
+	s.SetLogger(l)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("%03d", i))
+		x.Set(k, k)
+	}
+	for i := 0; i < 20; i++ {
+		x.EvictSomeItems()
+	}
+	if !l.has("skipped dirty item") {
+		t.Errorf("expected dirty eviction warning, got: %v", l.msgs)
+	}
+	m.writeat = func(p []byte, off int64) (n int, err error) {
+		return len(p) - 1, nil
+	}
+	if err := s.Flush(); err != io.ErrShortWrite {
+		t.Errorf("expected ErrShortWrite, got: %v", err)
+	}
+	if !l.has("short WriteAt") {
+		t.Errorf("expected short write warning, got: %v", l.msgs)
+	}
+
+}
+
+func TestUnionReplacementPriority(t *testing.T) {
+	s, _ := NewStore(nil)
+	s.SetDebugValidation(2)
+	x := s.SetCollection("x", nil)
+	for i, pri := range []int32{50, 100, 70, 20, 90} {
+		x.SetItem(&Item{Key: []byte{byte('a' + i)}, Val: []byte("v"),
+			Priority: pri})
+	}
+	// Replaces the root "b" by an item of a lower priority than some of
+	// the other nodes, which must then be placed by its own priority.
+	if err := x.SetItem(&Item{Key: []byte("b"), Val: []byte("w"),
+		Priority: 10}); err != nil {
+		t.Errorf("expected valid SetItem, got: %v", err)
+	}
+	i, err := x.GetItem([]byte("b"), true)
+	if err != nil || i == nil || i.Priority != 10 || string(i.Val) != "w" {
+		t.Errorf("expected the replacement with its own priority, got: %v, %v", i, err)
+	}
+	if n, _, _ := x.GetTotals(); n != 5 {
+		t.Errorf("expected 5 items, got: %v", n)
+	}
+}
+
+func TestDebugValidation(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 26; i++ {
+		pri := int32(100 - i)
+		if i == 12 {
+			pri = 1000 // So "m" is the root.
+		}
+		x.SetItem(&Item{Key: []byte{byte('a' + i)}, Val: []byte("v"),
+			Priority: pri})
+	}
+	s.SetDebugValidation(2)
+	if err := x.SetItem(&Item{Key: []byte("zz"), Val: []byte("v")}); err != nil {
+		t.Errorf("expected valid SetItem, got: %v", err)
+	}
+	if _, err := x.Delete([]byte("zz")); err != nil {
+		t.Errorf("expected valid Delete, got: %v", err)
+	}
+
+	// Corrupt the aggregates of a node that's shared with later trees.
+	n := x.root.root.Node().left.Node()
+	n.numBytes++
+	defer func() {
+		r := recover()
+		if r == nil || !strings.Contains(fmt.Sprint(r), "aggregates mismatch") ||
+			!strings.Contains(fmt.Sprint(r), `{key: "a"`) {
+			t.Errorf("expected aggregates mismatch panic, got: %v", r)
+		}
+	}()
+	x.SetItem(&Item{Key: []byte("zzz"), Val: []byte("v")})
+}
+
+type mapMetricsSink map[string]int64
+
+func (m mapMetricsSink) Counter(name string, delta int64) { m[name] += delta }
+func (m mapMetricsSink) Gauge(name string, val int64)     { m[name] = val }
+
+func TestUnionOverlappingKeysWithSnapshot(t *testing.T) {
+	keys := []string{"h", "d", "l", "b", "f", "j", "n", "a", "c", "e", "g"}
+	for _, withSnapshot := range []bool{true, false} {
+		counts := map[*Item]int{}
+		s, _ := NewStoreEx(nil, StoreCallbacks{
+			ItemAddRef: func(c *Collection, i *Item) { counts[i]++ },
+			ItemDecRef: func(c *Collection, i *Item) {
+				counts[i]--
+				if counts[i] < 0 {
+					t.Errorf("expected non-negative ref-count, key: %q", i.Key)
+				}
+			},
+		})
+		s.SetDebugValidation(2)
+		metrics := mapMetricsSink{}
+		s.SetMetricsSink(metrics)
+		x := s.SetCollection("x", nil)
+		for i, k := range keys {
+			x.SetItem(&Item{Key: []byte(k), Val: []byte("orig"),
+				Priority: int32(100 - i*5)})
+		}
+		var snapshot *Store
+		var held *rootNodeLoc // Like a snapshot, but releasable.
+		if withSnapshot {
+			snapshot = s.Snapshot()
+		} else {
+			held = x.rootAddRef()
+		}
+
+		// Replace every key, both with higher priorities, where the new
+		// item wins in union(), and with lower priorities, where the
+		// existing node wins and the new item is placed below it.
+		for round, delta := range []int32{50, -50, 3, -3} {
+			for i, k := range keys {
+				err := x.SetItem(&Item{Key: []byte(k),
+					Val:      []byte(fmt.Sprintf("new-%d", round)),
+					Priority: 100 - int32(i*5) + delta})
+				if err != nil {
+					t.Errorf("expected SetItem to work, got: %v", err)
+				}
+			}
+		}
+		for _, k := range keys {
+			i, err := x.GetItem([]byte(k), true)
+			if err != nil || i == nil || string(i.Val) != "new-3" {
+				t.Errorf("expected new-3 for %q, got: %v, %v", k, i, err)
+			}
+			s.ItemDecRef(x, i) // As Get() keeps the ref.
+		}
+		for i, count := range counts {
+			if string(i.Val) == "orig" && count != 1 {
+				t.Errorf("expected held orig item %q at ref-count 1, got: %v",
+					i.Key, count)
+			}
+		}
+		if withSnapshot {
+			ss := snapshot.GetCollection("x")
+			for _, k := range keys {
+				v, err := ss.Get([]byte(k))
+				if err != nil || string(v) != "orig" {
+					t.Errorf("expected snapshot to see orig for %q, got: %q, %v",
+						k, v, err)
+				}
+			}
+			continue
+		}
+
+		x.rootDecRef(held)
+		x.SetItem(&Item{Key: []byte("z"), Val: []byte("z"), Priority: 1})
+		if metrics["nodesReclaimed"] <= 0 {
+			t.Errorf("expected nodes reclaimed, got: %v", metrics)
+		}
+		for i, count := range counts {
+			exp := 0
+			if string(i.Val) == "new-3" || string(i.Val) == "z" {
+				exp = 1
+			}
+			if count != exp {
+				t.Errorf("expected ref-count %v for %q = %q, got: %v",
+					exp, i.Key, i.Val, count)
+			}
+		}
+	}
+}
+
+func TestUnionBatchReplacedMiddleRefs(t *testing.T) {
+	counts := map[*Item]int{}
+	s, _ := NewStoreEx(nil, StoreCallbacks{
+		ItemAddRef: func(c *Collection, i *Item) { counts[i]++ },
+		ItemDecRef: func(c *Collection, i *Item) {
+			counts[i]--
+			if counts[i] < 0 {
+				t.Errorf("expected non-negative ref-count, key: %q", i.Key)
+			}
+		},
+	})
+	s.SetDebugValidation(2)
+	x := s.SetCollection("x", nil)
+	var orig []*Item
+	for i := 0; i < 64; i++ {
+		item := &Item{Key: []byte(fmt.Sprintf("%02d", i)), Val: []byte("orig"),
+			Priority: int32(1000 + (i*37)%64)}
+		orig = append(orig, item)
+		x.SetItem(item)
+	}
+	// Replaces the keys in a batch with lower priorities, so that each
+	// existing node wins and its replacement is joined by its own
+	// priority into the subtrees that the batch union already rebuilt.
+	var batch []*Item
+	for i := 0; i < 64; i += 2 {
+		batch = append(batch, &Item{Key: []byte(fmt.Sprintf("%02d", i)),
+			Val: []byte("new"), Priority: int32((i * 13) % 64)})
+	}
+	if err := x.setItemsBatch(batch); err != nil {
+		t.Fatalf("expected setItemsBatch to work, got: %v", err)
+	}
+	for i, item := range orig {
+		exp := 1
+		if i%2 == 0 {
+			exp = 0 // The replaced middle node's item.
+		}
+		if counts[item] != exp {
+			t.Errorf("expected ref-count %v for replaced %q, got: %v",
+				exp, item.Key, counts[item])
+		}
+	}
+	for _, item := range batch {
+		if counts[item] != 1 {
+			t.Errorf("expected ref-count 1 for new %q, got: %v", item.Key, counts[item])
+		}
+	}
+	if n, _, _ := x.GetTotals(); n != 64 {
+		t.Errorf("expected 64 items, got: %v", n)
+	}
+}
+
+func TestDeleteMulti(t *testing.T) {
+	for _, persisted := range []bool{false, true} {
+		counts := map[*Item]int{}
+		var f StoreFile
+		if persisted {
+			f = &memFile{}
+		}
+		s, _ := NewStoreEx(f, StoreCallbacks{
+			ItemAlloc: func(c *Collection, keyLength uint16) *Item {
+				i := &Item{Key: make([]byte, keyLength)}
+				counts[i] = 1
+				return i
+			},
+			ItemAddRef: func(c *Collection, i *Item) { counts[i]++ },
+			ItemDecRef: func(c *Collection, i *Item) {
+				counts[i]--
+				if counts[i] < 0 {
+					t.Errorf("expected non-negative ref-count, key: %q", i.Key)
+				}
+			},
+		})
+		s.SetDebugValidation(2)
+		x := s.SetCollection("x", nil)
+		for i := 0; i < 200; i += 2 {
+			k := []byte(fmt.Sprintf("%03d", i))
+			x.SetItem(&Item{Key: k, Val: k, Priority: rand.Int31()})
+		}
+		if persisted {
+			s.Flush()
+			x.EvictSomeItems()
+		}
+		held := x.rootAddRef()
+		snapshot := s.Snapshot()
+
+		var keys [][]byte
+		exp := map[string]bool{}
+		for i := 0; i < 200; i++ {
+			exp[fmt.Sprintf("%03d", i)] = i%2 == 0
+		}
+		for i := 0; i < 120; i++ {
+			k := fmt.Sprintf("%03d", rand.Intn(220))
+			keys = append(keys, []byte(k), []byte(k)) // With repeats.
+		}
+		expDeleted := uint64(0)
+		for _, k := range keys {
+			if exp[string(k)] {
+				exp[string(k)] = false
+				expDeleted++
+			}
+		}
+		deleted, err := x.DeleteMulti(keys)
+		if err != nil || deleted != expDeleted {
+			t.Errorf("expected %v deleted, got: %v, %v", expDeleted, deleted, err)
+		}
+		if deleted, err = x.DeleteMulti(keys); err != nil || deleted != 0 {
+			t.Errorf("expected re-delete to delete nothing, got: %v, %v",
+				deleted, err)
+		}
+		if deleted, err = x.DeleteMulti(nil); err != nil || deleted != 0 {
+			t.Errorf("expected no keys to delete nothing, got: %v, %v",
+				deleted, err)
+		}
+		var expKeys []string
+		for i := 0; i < 200; i++ {
+			if k := fmt.Sprintf("%03d", i); exp[k] {
+				expKeys = append(expKeys, k)
+			}
+		}
+		visitExpectCollection(t, x, "000", expKeys, nil)
+		n, _, err := x.GetTotals()
+		if err != nil || n != uint64(len(expKeys)) {
+			t.Errorf("expected %v items, got: %v, %v", len(expKeys), n, err)
+		}
+		n, _, err = snapshot.GetCollection("x").GetTotals()
+		if err != nil || n != 100 {
+			t.Errorf("expected snapshot to keep 100 items, got: %v, %v", n, err)
+		}
+
+		// Once the old roots are released, the deleted items and any
+		// intermediate nodes are reclaimed.
+		x.rootDecRef(held)
+		snapshot.GetCollection("x").closeCollection()
+		x.SetItem(&Item{Key: []byte("z"), Val: []byte("z"), Priority: 1})
+		for i, count := range counts {
+			expCount := 0
+			if exp[string(i.Key)] || string(i.Key) == "z" {
+				expCount = 1
+			}
+			if persisted && expCount == 1 && count == 0 {
+				continue // An extra copy read from the file, since dropped.
+			}
+			if count != expCount {
+				t.Errorf("expected persisted %v ref-count %v for %q, got: %v",
+					persisted, expCount, i.Key, count)
+			}
+		}
+	}
+}
+
+func TestKeyValLimits(t *testing.T) {
+	fname := "tmpLimits.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	lengths := map[string]int{} // Overrides of value lengths, by key.
+	s, _ := NewStoreEx(f, StoreCallbacks{
+		ItemValLength: func(c *Collection, i *Item) int {
+			if n, ok := lengths[string(i.Key)]; ok {
+				return n
+			}
+			return len(i.Val)
+		},
+	})
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("a"), []byte("a"))
+	maxKey := bytes.Repeat([]byte("k"), MaxKeyLen)
+	if err := x.Set(maxKey, []byte("max")); err != nil {
+		t.Errorf("expected MaxKeyLen key to work, got: %v", err)
+	}
+	err := x.Set(append(maxKey, 'k'), []byte("over"))
+	var le *LimitError
+	if !errors.Is(err, ErrKeyTooLarge) || !errors.As(err, &le) ||
+		le.Limit != MaxKeyLen || le.Size != MaxKeyLen+1 {
+		t.Errorf("expected ErrKeyTooLarge LimitError, got: %v", err)
+	}
+	if ^uint(0)>>32 != 0 { // The value limit doesn't fit a 32-bit int.
+		maxValLen := uint64(MaxValLen)
+		lengths["v"] = int(maxValLen)
+		if err = x.Set([]byte("v"), []byte("v")); err != nil {
+			t.Errorf("expected MaxValLen value to work, got: %v", err)
+		}
+		x.Delete([]byte("v")) // Rather than writing it.
+		lengths["w"] = int(maxValLen + 1)
+		err = x.Set([]byte("w"), []byte("w"))
+		if !errors.Is(err, ErrValTooLarge) || !errors.As(err, &le) ||
+			le.Limit != MaxValLen || le.Size != MaxValLen+1 {
+			t.Errorf("expected ErrValTooLarge LimitError, got: %v", err)
+		}
+	}
+	x.Set([]byte("b"), []byte("b"))
+	if err = s.Flush(); err != nil {
+		t.Errorf("expected Flush after rejected sets to work, got: %v", err)
+	}
+	s.Close()
+	f.Close()
+
+	f, _ = os.Open(fname)
+	defer f.Close()
+	s, err = NewStore(f)
+	if err != nil {
+		t.Fatalf("expected reopen to work, got: %v", err)
+	}
+	x = s.GetCollection("x")
+	visitExpectCollection(t, x, "a", []string{"a", "b", string(maxKey)}, nil)
+	if v, err := x.Get(maxKey); err != nil || string(v) != "max" {
+		t.Errorf("expected MaxKeyLen key to round-trip, got: %q, %v", v, err)
+	}
+}
+
+func TestOnMutation(t *testing.T) {
+	s, _ := NewStore(&memFile{})
+	x := s.SetCollection("x", nil)
+	y := s.SetCollection("y", nil)
+	var events []string
+	record := func(coll string) MutationCallback {
+		return func(op MutationOp, key, val []byte) {
+			events = append(events, fmt.Sprintf("%s %v %s=%s", coll, op, key, val))
+		}
+	}
+	x.OnMutation(record("x"))
+	y.OnMutation(record("y"))
+	x.Set([]byte("a"), []byte("1"))
+	y.Set([]byte("a"), []byte("2"))
+	x.Set([]byte("b"), []byte("3"))
+	x.Set([]byte("c"), []byte("4"))
+	x.Set([]byte("a"), []byte("5"))
+	x.Delete([]byte("a"))
+	x.Delete([]byte("missing"))
+	x.SetItem(&Item{Key: []byte("bad"), Priority: -1}) // Rejected.
+	x.DeleteMulti([][]byte{[]byte("c"), []byte("b"), []byte("missing")})
+	s.Flush()
+	x = s.SetCollection("x", nil) // Keeps the callback.
+	x.Set([]byte("d"), []byte("6"))
+	y.OnMutation(nil)
+	y.Set([]byte("d"), []byte("7"))
+	exp := []string{
+		"x set a=1",
+		"y set a=2",
+		"x set b=3",
+		"x set c=4",
+		"x set a=5",
+		"x delete a=",
+		"x delete b=",
+		"x delete c=",
+		"x flush =",
+		"y flush =",
+		"x set d=6",
+	}
+	if fmt.Sprint(events) != fmt.Sprint(exp) {
+		t.Errorf("expected events %v, got: %v", exp, events)
+	}
+}
+
+// Returns the items of all collections, with their priorities.
+func storeDump(s *Store) string {
+	var res []string
+	for _, name := range s.GetCollectionNames() {
+		s.GetCollection(name).VisitItemsAscend([]byte{0}, true, func(i *Item) bool {
+			res = append(res, fmt.Sprintf("%s/%s=%s/%d", name, i.Key, i.Val, i.Priority))
+			return true
+		})
+	}
+	return strings.Join(res, ",")
+}
+
+func TestReplicationLog(t *testing.T) {
+	s, _ := NewStore(&memFile{})
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("before"), []byte("not logged"))
+	if err := s.StopReplicationLog(); err == nil {
+		t.Errorf("expected StopReplicationLog without a log to fail")
+	}
+	var log bytes.Buffer
+	if err := s.StartReplicationLog(&log); err != nil {
+		t.Errorf("expected StartReplicationLog to work, got: %v", err)
+	}
+	if err := s.StartReplicationLog(&log); err == nil {
+		t.Errorf("expected a second StartReplicationLog to fail")
+	}
+	x.Delete([]byte("before"))
+	y := s.SetCollection("y", nil)
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("%03d", i))
+		x.SetItem(&Item{Key: k, Val: []byte(fmt.Sprintf("x%d", i)), Priority: int32(i % 7)})
+		y.Set(k, []byte{})
+	}
+	x.Set([]byte("010"), []byte("overwritten"))
+	x.Delete([]byte("011"))
+	x.Delete([]byte("missing"))
+	y.DeleteMulti([][]byte{[]byte("050"), []byte("020"), []byte("missing")})
+	s.Flush()
+	if err := s.StopReplicationLog(); err != nil {
+		t.Errorf("expected StopReplicationLog to work, got: %v", err)
+	}
+	x.Set([]byte("after"), []byte("not logged"))
+	x.Delete([]byte("after"))
+	exp := storeDump(s)
+
+	r, _ := NewStore(&memFile{})
+	b := log.Bytes()
+	if err := r.ApplyReplicationLog(bytes.NewReader(b[:len(b)-3])); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected truncated log to fail, got: %v", err)
+	}
+	partial := r.ReplicationApplied()
+	if partial == 0 || partial >= 205 {
+		t.Errorf("expected some applied entries, got: %v", partial)
+	}
+	for i := 0; i < 2; i++ {
+		if err := r.ApplyReplicationLog(bytes.NewReader(b)); err != nil {
+			t.Errorf("expected ApplyReplicationLog to work, got: %v", err)
+		}
+		if r.ReplicationApplied() != 205 {
+			t.Errorf("expected 205 applied entries, got: %v", r.ReplicationApplied())
+		}
+		if got := storeDump(r); got != exp {
+			t.Errorf("expected replica to equal the store, got: %v, expected: %v", got, exp)
+		}
+	}
+	if err := r.ApplyReplicationLog(bytes.NewReader([]byte("not a log"))); err == nil {
+		t.Errorf("expected bad magic to fail")
+	}
+
+	// Sequence numbers continue in a new log, so the replica skips only
+	// what it already has.
+	var log2 bytes.Buffer
+	s.StartReplicationLog(&log2)
+	x.Set([]byte("new"), []byte("logged"))
+	s.StopReplicationLog()
+	if err := r.ApplyReplicationLog(&log2); err != nil {
+		t.Errorf("expected ApplyReplicationLog of new log to work, got: %v", err)
+	}
+	if v, _ := r.GetCollection("x").Get([]byte("new")); string(v) != "logged" {
+		t.Errorf("expected new log entry to be applied, got: %q", v)
+	}
+}
+
+func TestTags(t *testing.T) {
+	fname := "tmpTags.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	s, _ := NewStore(f)
+	if err := s.TagSnapshot("v1"); err == nil {
+		t.Errorf("expected TagSnapshot before any Flush to fail")
+	}
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), []byte("v1"))
+	}
+	s.Flush()
+	x.Set([]byte("unflushed"), []byte("v1"))
+	if err := s.TagSnapshot("v1"); err != nil {
+		t.Errorf("expected TagSnapshot to work, got: %v", err)
+	}
+	if err := s.SetReuseFreeSpace(true); err == nil {
+		t.Errorf("expected SetReuseFreeSpace with tags to fail")
+	}
+	if err := s.SetAutoCompact(0.5); err == nil {
+		t.Errorf("expected SetAutoCompact with tags to fail")
+	}
+	checkV1 := func(desc string, ts *Store) {
+		if names := ts.GetCollectionNames(); fmt.Sprint(names) != "[x]" {
+			t.Errorf("%s: expected collection x, got: %v", desc, names)
+		}
+		n := 0
+		err := ts.GetCollection("x").VisitItemsAscend(nil, true, func(i *Item) bool {
+			if string(i.Val) != "v1" || string(i.Key) != fmt.Sprintf("%03d", n) {
+				t.Errorf("%s: expected %03d = v1, got: %q = %q", desc, n, i.Key, i.Val)
+			}
+			n++
+			return true
+		})
+		if err != nil || n != 100 {
+			t.Errorf("%s: expected 100 items, got: %v, %v", desc, n, err)
+		}
+		if err = ts.Flush(); err == nil {
+			t.Errorf("%s: expected tag store to be read-only", desc)
+		}
+	}
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 100; i++ {
+			k := []byte(fmt.Sprintf("%03d", i))
+			if i%3 == round%3 {
+				x.Delete(k)
+			} else {
+				x.Set(k, []byte(fmt.Sprintf("round-%d", round)))
+			}
+		}
+		s.SetCollection(fmt.Sprintf("y%d", round), nil).Set([]byte("y"), []byte("y"))
+		s.Flush()
+	}
+	ts, err := s.OpenTag("v1")
+	if err != nil {
+		t.Fatalf("expected OpenTag to work, got: %v", err)
+	}
+	checkV1("tag", ts)
+	s.TagSnapshot("v2")
+	if tags := s.ListTags(); fmt.Sprint(tags) != "[v1 v2]" {
+		t.Errorf("expected tags v1, v2, got: %v", tags)
+	}
+	s.Close()
+	f.Close()
+
+	f, _ = os.OpenFile(fname, os.O_RDWR, 0666)
+	s, _ = NewStore(f)
+	if tags := s.ListTags(); fmt.Sprint(tags) != "[v1 v2]" {
+		t.Errorf("expected tags v1, v2 after reopen, got: %v", tags)
+	}
+	ts, err = s.OpenTag("v1")
+	if err != nil {
+		t.Fatalf("expected OpenTag after reopen to work, got: %v", err)
+	}
+	checkV1("reopened tag", ts)
+	ts, _ = s.OpenTag("v2")
+	if len(ts.GetCollectionNames()) != 21 {
+		t.Errorf("expected v2 to have 21 collections, got: %v",
+			ts.GetCollectionNames())
+	}
+	if err = s.DeleteTag("v1"); err != nil {
+		t.Errorf("expected DeleteTag to work, got: %v", err)
+	}
+	if err = s.DeleteTag("v1"); err == nil {
+		t.Errorf("expected DeleteTag of missing tag to fail")
+	}
+	if _, err = s.OpenTag("v1"); err == nil {
+		t.Errorf("expected OpenTag of deleted tag to fail")
+	}
+
+	// Reverting the roots record of the DeleteTag() brings back v1.
+	if err = s.FlushRevert(); err != nil {
+		t.Errorf("expected FlushRevert to work, got: %v", err)
+	}
+	if tags := s.ListTags(); fmt.Sprint(tags) != "[v1 v2]" {
+		t.Errorf("expected tags v1, v2 after revert, got: %v", tags)
+	}
+	s.DeleteTag("v1")
+	s.DeleteTag("v2")
+	if err = s.SetReuseFreeSpace(true); err != nil {
+		t.Errorf("expected SetReuseFreeSpace without tags to work, got: %v", err)
+	}
+	f.Close()
+}
+
+func TestOpenVersion6RootsRecord(t *testing.T) {
+	fname := "tmpVersion6.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	s, _ := NewStore(f)
+	s.SetCollection("x", nil).Set([]byte("a"), []byte("A"))
+	s.Flush()
+	s.Close()
+
+	// Without tags, a roots record differs from VERSION 6 only in its
+	// version field, which follows the two MAGIC_BEG's.
+	fi, _ := f.Stat()
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, 6)
+	f.WriteAt(b, fi.Size()-int64(s.freeList.rootsLoc.Length)+int64(2*len(MAGIC_BEG)))
+	f.Close()
+
+	f, _ = os.Open(fname)
+	defer f.Close()
+	s, err := NewStore(f)
+	if err != nil {
+		t.Fatalf("expected VERSION 6 file to open, got: %v", err)
+	}
+	if v, err := s.GetCollection("x").Get([]byte("a")); err != nil || string(v) != "A" {
+		t.Errorf("expected a = A, got: %q, %v", v, err)
+	}
+}
+
+func TestMisbehavingItemValLength(t *testing.T) {
+	lengths := map[string]int{} // Overrides of value lengths, by key.
+	s, _ := NewStoreEx(nil, StoreCallbacks{
+		ItemValLength: func(c *Collection, i *Item) int {
+			if n, ok := lengths[string(i.Key)]; ok {
+				return n
+			}
+			return len(i.Val)
+		},
+	})
+	s.SetDebugValidation(2)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 50; i++ {
+		k := []byte(fmt.Sprintf("%02d", i))
+		x.SetItem(&Item{Key: k, Val: k, Priority: int32(rand.Intn(1000))})
+	}
+	_, numBytes, _ := x.GetTotals()
+	if numBytes != 200 {
+		t.Errorf("expected 200 bytes, got: %v", numBytes)
+	}
+
+	// A stale length after the set doesn't leak into tree rebuilds.
+	lengths["25"] = 1000
+	for i := 0; i < 50; i += 2 {
+		k := []byte(fmt.Sprintf("%02d", i))
+		x.SetItem(&Item{Key: k, Val: k, Priority: int32(rand.Intn(1000))})
+		if i+1 != 25 {
+			x.Delete([]byte(fmt.Sprintf("%02d", i+1)))
+			x.Set([]byte(fmt.Sprintf("%02d", i+1)), []byte("xx"))
+		}
+	}
+	lengths["25"] = 2
+	_, numBytes, _ = x.GetTotals()
+	if numBytes != 200 {
+		t.Errorf("expected 200 bytes after rebuilds, got: %v", numBytes)
+	}
+
+	// Negative and wrapping lengths are rejected, leaving the tree as is.
+	lengths["neg"] = -10
+	err := x.SetItem(&Item{Key: []byte("neg"), Val: []byte("v"), Priority: 1})
+	if _, ok := err.(*AggregateError); !ok {
+		t.Errorf("expected AggregateError for negative length, got: %v", err)
+	}
+	// Lengths that would wrap the aggregates are beyond MaxValLen.
+	for _, k := range []string{"h1", "h2", "h3"} {
+		lengths[k] = math.MaxInt64 - 10
+		err = x.SetItem(&Item{Key: []byte(k), Val: []byte("v"), Priority: 1})
+		if !errors.Is(err, ErrValTooLarge) {
+			t.Errorf("expected ErrValTooLarge for huge length, got: %v", err)
+		}
+	}
+	if v, _ := x.Get([]byte("h3")); v != nil {
+		t.Errorf("expected rejected item to be absent, got: %q", v)
+	}
+	x.Delete([]byte("h1"))
+	x.Delete([]byte("h2"))
+	numItems, numBytes, _ := x.GetTotals()
+	if numItems != 50 || numBytes != 200 {
+		t.Errorf("expected 50 items, 200 bytes, got: %v, %v", numItems, numBytes)
+	}
+
+	// A drifted aggregate is repaired by RecomputeAggregates().
+	root := x.root.root.Node()
+	root.numBytes += 7
+	root.left.Node().numBytes += 7
+	if _, numBytes, _ = x.GetTotals(); numBytes != 207 {
+		t.Errorf("expected drifted 207 bytes, got: %v", numBytes)
+	}
+	if err = x.RecomputeAggregates(); err != nil {
+		t.Errorf("expected RecomputeAggregates to work, got: %v", err)
+	}
+	if _, numBytes, _ = x.GetTotals(); numBytes != 200 {
+		t.Errorf("expected repaired 200 bytes, got: %v", numBytes)
+	}
+	if err = x.RecomputeAggregates(); err != nil || x.root.root.Node() == root {
+		t.Errorf("expected no-op RecomputeAggregates, got: %v", err)
+	}
+}
+
+func TestReuseFreeSpace(t *testing.T) {
+	fname := "tmpReuseFreeSpace.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	s, _ := NewStore(f)
+	if err := s.SetReuseFreeSpace(true); err != nil {
+		t.Errorf("expected SetReuseFreeSpace to work, got: %v", err)
+	}
+	x := s.SetCollection("x", nil)
+	sizes := []int64{}
+	for round := 0; round < 40; round++ {
+		if round == 20 { // Reopen, which must keep the free list.
+			f.Close()
+			f, _ = os.OpenFile(fname, os.O_RDWR, 0666)
+			s, _ = NewStore(f)
+			s.SetReuseFreeSpace(true)
+			x = s.GetCollection("x")
+		}
+		for i := 0; i < 100; i++ {
+			k := []byte(fmt.Sprintf("%03d", i))
+			if round > 0 && rand.Int()%3 == 0 {
+				x.Delete(k)
+			} else {
+				x.Set(k, []byte(fmt.Sprintf("val-%03d-%03d", round, i)))
+			}
+		}
+		if err := s.Flush(); err != nil {
+			t.Fatalf("expected Flush to work, got: %v", err)
+		}
+		stat, _ := f.Stat()
+		sizes = append(sizes, stat.Size())
+	}
+	maxSize := func(sizes []int64) (max int64) {
+		for _, size := range sizes {
+			if max < size {
+				max = size
+			}
+		}
+		return max
+	}
+	if maxSize(sizes[30:]) > maxSize(sizes[5:15])*3/2 {
+		t.Errorf("expected file size to stabilize, got sizes: %v", sizes)
+	}
+	m := map[string]uint64{}
+	s.Stats(m)
+	if m["freeListReuses"] == 0 || m["freeListReusedBytes"] == 0 {
+		t.Errorf("expected free space reuse, got: %v", m)
+	}
+	if err := s.FlushRevert(); err == nil {
+		t.Errorf("expected FlushRevert with free space reuse to fail")
+	}
+	numItems, _, _ := x.GetTotals()
+	f.Close()
+
+	f, _ = os.OpenFile(fname, os.O_RDWR, 0666)
+	defer f.Close()
+	s, err := NewStore(f)
+	if err != nil {
+		t.Fatalf("expected reopen to work, got: %v", err)
+	}
+	x = s.GetCollection("x")
+	n := uint64(0)
+	err = x.VisitItemsAscend([]byte(""), true, func(i *Item) bool {
+		if !bytes.HasPrefix(i.Val, []byte("val-")) {
+			t.Errorf("expected intact value, got: %q", i.Val)
+		}
+		n++
+		return true
+	})
+	if err != nil || n != numItems {
+		t.Errorf("expected %v items, got: %v, %v", numItems, n, err)
+	}
+
+	if err := s.Snapshot().SetReuseFreeSpace(true); err == nil {
+		t.Errorf("expected SetReuseFreeSpace on a snapshot to fail")
+	}
+}
+
+func TestAutoCompact(t *testing.T) {
+	for _, background := range []bool{false, true} {
+		fname := "tmpAutoCompact.test"
+		os.Remove(fname)
+		f, _ := os.Create(fname)
+		s, _ := NewStore(f)
+		if err := s.SetAutoCompact(0.3); err != nil {
+			t.Errorf("expected SetAutoCompact to work, got: %v", err)
+		}
+		s.SetAutoCompactBackground(background)
+		if err := s.SetReuseFreeSpace(true); err == nil {
+			t.Errorf("expected SetReuseFreeSpace with auto-compaction to fail")
+		}
+		x := s.SetCollection("x", nil)
+		m := map[string]uint64{}
+		prevSize, shrunk := uint64(0), false
+		for round := 0; round < 30; round++ {
+			for i := 0; i < 100; i++ {
+				x.Set([]byte(fmt.Sprintf("%03d", i)),
+					[]byte(fmt.Sprintf("val-%03d-%03d-%0200d", round, i, 0)))
+			}
+			if err := s.Flush(); err != nil {
+				t.Fatalf("expected Flush to work, got: %v", err)
+			}
+			if background {
+				time.Sleep(5 * time.Millisecond)
+			}
+			s.Stats(m)
+			if m["fileSize"] < prevSize {
+				shrunk = true
+			}
+			prevSize = m["fileSize"]
+		}
+		if m["autoCompactions"] == 0 {
+			t.Errorf("expected an auto-compaction, background: %v, got: %v",
+				background, m)
+		}
+		if !shrunk {
+			t.Errorf("expected compaction to shrink the file")
+		}
+		if _, err := os.Stat(fname + ".compact"); err == nil {
+			t.Errorf("expected no leftover compaction file")
+		}
+		stat, _ := os.Stat(fname)
+		if uint64(stat.Size()) != m["fileSize"] {
+			t.Errorf("expected store file to be the compacted file, got: %v, %v",
+				stat.Size(), m["fileSize"])
+		}
+		s.Close()
+		f.Close()
+
+		f, _ = os.Open(fname)
+		s, err := NewStore(f)
+		if err != nil {
+			t.Fatalf("expected reopen to work, got: %v", err)
+		}
+		x = s.GetCollection("x")
+		for i := 0; i < 100; i++ {
+			v, err := x.Get([]byte(fmt.Sprintf("%03d", i)))
+			if err != nil || !bytes.HasPrefix(v, []byte(fmt.Sprintf("val-029-%03d-", i))) {
+				t.Errorf("expected latest value for %v, got: %q, %v", i, v, err)
+			}
+		}
+		f.Close()
+		os.Remove(fname)
+	}
+
+	s, _ := NewStore(nil)
+	if err := s.SetAutoCompact(0.5); err == nil {
+		t.Errorf("expected SetAutoCompact on a memory-only store to fail")
+	}
+}
+
+func TestAutoCompactConcurrentReads(t *testing.T) {
+	fname := "tmpAutoCompactReads.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+	defer s.Close()
+	s.SetAutoCompact(0.3)
+	x := s.SetCollection("x", nil)
+	val := func(i int) []byte { return []byte(fmt.Sprintf("val-%03d-%0200d", i, 0)) }
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), val(i))
+	}
+	s.Flush()
+	rewrites := atomic.LoadUint64(&s.rewrites)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i = (i + 1) % 100 {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				x.EvictSomeItems()
+				v, err := x.Get([]byte(fmt.Sprintf("%03d", i)))
+				if err != nil || !bytes.Equal(v, val(i)) {
+					t.Errorf("expected value during compaction, got: %q, %v", v, err)
+					return
+				}
+				ss := s.Snapshot()
+				v, err = ss.GetCollection("x").Get([]byte(fmt.Sprintf("%03d", i)))
+				if err != nil || !bytes.Equal(v, val(i)) {
+					t.Errorf("expected snapshot value during compaction, got: %q, %v", v, err)
+					return
+				}
+				ss.Close()
+			}
+		}()
+	}
+	m := map[string]uint64{}
+	for round := 0; round < 30 && m["autoCompactions"] < 3; round++ {
+		for i := 0; i < 100; i++ {
+			x.Set([]byte(fmt.Sprintf("%03d", i)), val(i))
+		}
+		if err := s.Flush(); err != nil {
+			t.Fatalf("expected Flush to work, got: %v", err)
+		}
+		s.Stats(m)
+	}
+	close(done)
+	wg.Wait()
+	if m["autoCompactions"] == 0 {
+		t.Errorf("expected auto-compactions, got: %v", m)
+	}
+	if atomic.LoadUint64(&s.rewrites) == rewrites {
+		t.Errorf("expected compactions to count as rewrites")
+	}
+}
+
+func TestAutoCompactReadInFlight(t *testing.T) {
+	fname := "tmpAutoCompactInFlight.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+	defer s.Close()
+	l := &captureLogger{}
+	s.SetLogger(l)
+	s.SetAutoCompact(0.3)
+	defer func(d time.Duration) { autoCompactSwitchWait = d }(autoCompactSwitchWait)
+	autoCompactSwitchWait = 5 * time.Millisecond
+	x := s.SetCollection("x", nil)
+	y := s.SetCollection("y", nil)
+	y.Set([]byte("y"), []byte("y"))
+	visiting, release := make(chan struct{}), make(chan struct{})
+	go y.VisitItemsAscend(nil, true, func(i *Item) bool {
+		close(visiting)
+		<-release
+		return true
+	})
+	<-visiting
+	m := map[string]uint64{}
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 100; i++ {
+			x.Set([]byte(fmt.Sprintf("%03d", i)), bytes.Repeat([]byte{byte(round)}, 200))
+		}
+		if err := s.Flush(); err != nil {
+			t.Fatalf("expected Flush to work, got: %v", err)
+		}
+	}
+	s.Stats(m)
+	if m["autoCompactions"] != 0 || !l.has("compaction dropped") {
+		t.Errorf("expected compactions dropped during a read, got: %v, %v", m, l.msgs)
+	}
+	close(release)
+	for i := 0; i < 100 && atomic.LoadInt64(&s.reads) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	x.Set([]byte("000"), []byte("last"))
+	s.Flush()
+	s.Stats(m)
+	if m["autoCompactions"] != 1 {
+		t.Errorf("expected a compaction once the read ended, got: %v", m)
+	}
+	if v, _ := x.Get([]byte("000")); string(v) != "last" {
+		t.Errorf("expected the last value after the compaction, got: %q", v)
+	}
+}
+
+func TestStoreAllocStatsTrimFreeLists(t *testing.T) {
+	s, _ := NewStore(nil)
+	s.TrimFreeLists(0) // Drop what earlier tests left, so nodes get allocated.
+	x := s.SetCollection("x", nil)
+	keys := make([][]byte, 5000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("%05d", i))
+		x.Set(keys[i], keys[i])
+	}
+	before := s.AllocStats()
+	if before.NodeAllocs == 0 || before.ItemAddRefs == 0 {
+		t.Errorf("expected node allocs and item addrefs, got: %+v", before)
+	}
+	ss := s.Snapshot()
+	x.Delete(keys[0])
+	if got := s.AllocStats(); got.ReclaimPending <= before.ReclaimPending {
+		t.Errorf("expected snapshot to leave a pending reclaim, got: %+v, before: %+v",
+			got, before)
+	}
+	ss.Close()
+	if got := s.AllocStats(); got.ReclaimPending != before.ReclaimPending {
+		t.Errorf("expected no pending reclaims after snapshot close, got: %+v, before: %+v",
+			got, before)
+	}
+	x.DeleteMulti(keys)
+	afterDelete := s.AllocStats()
+	if afterDelete.FreeNodes < 5000 {
+		t.Errorf("expected deleted nodes on the free list, got: %+v", afterDelete)
+	}
+	if afterDelete.ItemDecRefs <= before.ItemDecRefs {
+		t.Errorf("expected item decrefs from deletes, got: %+v", afterDelete)
+	}
+	released := s.TrimFreeLists(10)
+	trimmed := s.AllocStats()
+	if trimmed.FreeNodes != 10 || trimmed.FreeNodeLocs > 10 ||
+		trimmed.FreeRootNodeLocs > 10 {
+		t.Errorf("expected free lists trimmed to 10, got: %+v", trimmed)
+	}
+	if released != afterDelete.FreeNodes+afterDelete.FreeNodeLocs+
+		afterDelete.FreeRootNodeLocs-trimmed.FreeNodes-trimmed.FreeNodeLocs-
+		trimmed.FreeRootNodeLocs {
+		t.Errorf("expected released to match, got: %v, %+v, %+v",
+			released, afterDelete, trimmed)
+	}
+	n := 0
+	x.frees.withLocks(func() {
+		for fn := x.frees.nodes; fn != nil && fn != freeNodesEnd; fn = fn.next {
+			n++
+		}
+	})
+	if n != 10 {
+		t.Errorf("expected 10 nodes on the free list, got: %v", n)
+	}
+	for _, k := range keys[:100] {
+		x.Set(k, k)
+	}
+	if got := s.AllocStats(); got.NodeAllocs <= trimmed.NodeAllocs {
+		t.Errorf("expected new node allocs after trim, got: %+v", got)
+	}
+	if b, err := json.Marshal(trimmed); err != nil ||
+		!strings.Contains(string(b), `"freeNodes":10`) {
+		t.Errorf("expected json freeNodes, got: %s, %v", b, err)
+	}
+}
+
+func TestKeyPrefixCompression(t *testing.T) {
+	keys := make([][]byte, 0, 2000)
+	for tenant := 0; tenant < 4; tenant++ {
+		for day := 1; day <= 20; day++ {
+			for order := 0; order < 25; order++ {
+				keys = append(keys, []byte(fmt.Sprintf(
+					"tenant/%05d/orders/2024-06-%02d/order-%06d",
+					10000+tenant, day, order*7)))
+			}
+		}
+	}
+	fill := func(compress bool) (*memFile, *Store) {
+		f := &memFile{}
+		s, _ := NewStore(f)
+		x := s.SetCollection("x", nil)
+		if compress {
+			if err := x.SetKeyPrefixCompression(true); err != nil {
+				t.Fatalf("expected SetKeyPrefixCompression to work, got: %v", err)
+			}
+		}
+		for i, k := range keys {
+			x.SetItem(&Item{Key: k, Val: []byte(fmt.Sprintf("v%d", i)), Priority: int32(i * 7919 % 10007)})
+			if i%500 == 499 {
+				s.Flush()
+			}
+		}
+		s.Flush()
+		return f, s
+	}
+	plainFile, plain := fill(false)
+	prefixFile, prefixed := fill(true)
+	plainSize, prefixSize := len(plainFile.b), len(prefixFile.b)
+	t.Logf("path-like keys: %v, file size: %v, prefix compressed: %v (%.0f%%)",
+		len(keys), plainSize, prefixSize, 100*float64(prefixSize)/float64(plainSize))
+	if prefixSize > plainSize*17/20 {
+		t.Errorf("expected prefix compression to save at least 15%%, got: %v vs %v",
+			prefixSize, plainSize)
+	}
+	if storeDump(plain) != storeDump(prefixed) {
+		t.Errorf("expected the same items with prefix compression")
+	}
+	pt, pb, _ := plain.GetCollection("x").GetTotals()
+	xt, xb, _ := prefixed.GetCollection("x").GetTotals()
+	if pt != xt || pb != xb {
+		t.Errorf("expected the same totals, got: %v, %v vs %v, %v", pt, pb, xt, xb)
+	}
+	if err := prefixed.SetReuseFreeSpace(true); err == nil {
+		t.Errorf("expected SetReuseFreeSpace with key prefixes to fail")
+	}
+
+	// Reopened, the keys are reconstructed from their base records.
+	s, err := NewStore(prefixFile)
+	if err != nil {
+		t.Fatalf("expected reopen to work, got: %v", err)
+	}
+	exp := storeDump(plain)
+	if got := storeDump(s); got != exp {
+		t.Errorf("expected reopened items to match")
+	}
+	x := s.GetCollection("x")
+	if !x.hasKeyPrefixes() {
+		t.Errorf("expected the key prefix flag to be persisted")
+	}
+	i, err := x.GetItem(keys[777], true)
+	if err != nil || i == nil || string(i.Key) != string(keys[777]) || string(i.Val) != "v777" {
+		t.Errorf("expected Get of %s to work, got: %v, %v", keys[777], i, err)
+	}
+	if val, found, err := x.GetInto(keys[778], nil); err != nil || !found || string(val) != "v778" {
+		t.Errorf("expected GetInto to work, got: %q, %v, %v", val, found, err)
+	}
+	if v, _ := x.Get([]byte("tenant/10000/orders/2024-06-01/order-00000")); v != nil {
+		t.Errorf("expected a missing key, got: %q", v)
+	}
+	x.Set([]byte("tenant/10000/orders/2024-06-01/order-000001"), []byte("new"))
+	x.Delete(keys[5])
+	s.Flush()
+
+	// CopyTo writes whole keys.
+	copyFile := &memFile{}
+	c, err := s.CopyTo(copyFile, 0)
+	if err != nil {
+		t.Fatalf("expected CopyTo to work, got: %v", err)
+	}
+	c.Flush()
+	c, _ = NewStore(copyFile)
+	if c.GetCollection("x").hasKeyPrefixes() || storeDump(c) != storeDump(s) {
+		t.Errorf("expected CopyTo to decompress")
+	}
+
+	// Disabling only affects later writes; the flag stays.
+	s, _ = NewStore(prefixFile)
+	x = s.GetCollection("x")
+	x.SetKeyPrefixCompression(false)
+	x.Set([]byte("tenant/10000/orders/2024-06-01/order-000002"), []byte("plain"))
+	s.Flush()
+	s, _ = NewStore(prefixFile)
+	if !s.GetCollection("x").hasKeyPrefixes() || storeDump(s) == exp {
+		t.Errorf("expected disabled prefix compression to keep old records readable")
+	}
+	if v, _ := s.GetCollection("x").Get([]byte("tenant/10000/orders/2024-06-01/order-000002")); string(v) != "plain" {
+		t.Errorf("expected plain, got: %q", v)
+	}
+
+	xor := func(b []byte, offset int64) ([]byte, error) { return b, nil }
+	e, _ := NewStoreEx(&memFile{}, StoreCallbacks{Encrypt: xor, Decrypt: xor})
+	if err = e.SetCollection("x", nil).SetKeyPrefixCompression(true); err == nil {
+		t.Errorf("expected key prefix compression with encryption to fail")
+	}
+}
+
+func TestKeyInterning(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	if err := x.SetKeyInterning(-1); err == nil {
+		t.Errorf("expected negative maxKeys to fail")
+	}
+	if err := x.SetKeyInterning(2); err != nil {
+		t.Errorf("expected SetKeyInterning to work, got: %v", err)
+	}
+	keyOf := func(k string) *byte {
+		i, err := x.GetItem([]byte(k), false)
+		if err != nil || i == nil {
+			t.Errorf("expected item %q, got: %v, %v", k, i, err)
+			return nil
+		}
+		return &i.Key[0]
+	}
+	x.Set([]byte("a"), []byte("1"))
+	a := keyOf("a")
+	x.Set([]byte("a"), []byte("2"))
+	if keyOf("a") != a {
+		t.Errorf("expected the interned key to be reused")
+	}
+	x.Set([]byte("b"), []byte("1"))
+	x.Set([]byte("c"), []byte("1")) // Drops "a".
+	x.Set([]byte("a"), []byte("3"))
+	if keyOf("a") == a {
+		t.Errorf("expected a dropped key not to be reused")
+	}
+	if v, _ := x.Get([]byte("a")); string(v) != "3" {
+		t.Errorf("expected 3, got: %q", v)
+	}
+	x = s.SetCollection("x", nil)
+	b := keyOf("c")
+	x.Set([]byte("c"), []byte("2"))
+	if keyOf("c") != b {
+		t.Errorf("expected the table to carry over SetCollection")
+	}
+	x.SetKeyInterning(0)
+	x.Set([]byte("c"), []byte("3"))
+	if keyOf("c") == b {
+		t.Errorf("expected disabled interning not to reuse keys")
+	}
+
+	x.SetKeyInterning(10)
+	k := []byte("d")
+	x.Set(k, []byte("1"))
+	k[0] = 'e' // Not allowed.
+	x.Set([]byte("d"), []byte("2"))
+	if v, _ := x.Get([]byte("d")); string(v) != "2" {
+		t.Errorf("expected a modified key to be dropped, got: %q", v)
+	}
+	s.SetDebugValidation(1)
+	k = []byte("f")
+	x.Set(k, []byte("1"))
+	k[0] = 'g'
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("expected debug validation to detect the modified key")
+			}
+		}()
+		x.Set([]byte("f"), []byte("2"))
+	}()
+}
+
+func TestPage(t *testing.T) {
+	f := &memFile{}
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 20; i++ {
+		x.Set([]byte(fmt.Sprintf("%02d", i)), []byte("v"))
+	}
+	s.Flush()
+	valReads := 0
+	s, _ = NewStoreEx(f, StoreCallbacks{
+		ItemValRead: func(c *Collection, i *Item,
+			r io.ReaderAt, offset int64, valLength uint32) error {
+			valReads++
+			i.Val = make([]byte, valLength)
+			_, err := r.ReadAt(i.Val, offset)
+			return err
+		},
+	})
+	x = s.GetCollection("x")
+	page := func(after []byte, limit int) ([]string, []byte) {
+		items, next, err := x.Page(after, limit, true)
+		if err != nil {
+			t.Errorf("expected Page to work, got: %v", err)
+		}
+		res := []string{}
+		for _, i := range items {
+			if string(i.Val) != "v" {
+				t.Errorf("expected a value, got: %q", i.Val)
+			}
+			res = append(res, string(i.Key))
+		}
+		return res, next
+	}
+	if _, _, err := x.Page(nil, 0, false); err == nil {
+		t.Errorf("expected a limit of 0 to fail")
+	}
+	got, next := page(nil, 3)
+	if fmt.Sprint(got) != "[00 01 02]" || string(next) != "02" {
+		t.Errorf("expected the first page, got: %v, %q", got, next)
+	}
+	if valReads != 3 {
+		t.Errorf("expected the visit to stop at the limit, got %v reads", valReads)
+	}
+	got, next = page(next, 3)
+	if fmt.Sprint(got) != "[03 04 05]" || string(next) != "05" {
+		t.Errorf("expected the next page, got: %v, %q", got, next)
+	}
+	got, next = page([]byte("045"), 2)
+	if fmt.Sprint(got) != "[05 06]" || string(next) != "06" {
+		t.Errorf("expected a page after a missing key, got: %v, %q", got, next)
+	}
+	got, next = page([]byte("16"), 3) // Exactly the rest.
+	if fmt.Sprint(got) != "[17 18 19]" || string(next) != "19" {
+		t.Errorf("expected the last full page, got: %v, %q", got, next)
+	}
+	got, next = page(next, 3)
+	if len(got) != 0 || next != nil {
+		t.Errorf("expected an empty last page, got: %v, %q", got, next)
+	}
+	got, next = page([]byte("17"), 3)
+	if fmt.Sprint(got) != "[18 19]" || next != nil {
+		t.Errorf("expected a short last page, got: %v, %q", got, next)
+	}
+	var all []string
+	for next, n := []byte(nil), 0; n < 10; n++ {
+		got, next = page(next, 7)
+		all = append(all, got...)
+		if next == nil {
+			break
+		}
+	}
+	if len(all) != 20 || all[0] != "00" || all[19] != "19" {
+		t.Errorf("expected pages to cover the collection, got: %v", all)
+	}
+	e := s.SetCollection("e", nil)
+	if items, next, err := e.Page(nil, 1, false); len(items) != 0 || next != nil || err != nil {
+		t.Errorf("expected an empty page, got: %v, %q, %v", items, next, err)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	mf := &memFile{}
+	m := &mockfile{readat: mf.ReadAt, writeat: mf.WriteAt, stat: mf.Stat}
+	s, _ := NewStore(m)
+	x := s.SetCollection("x", nil)
+	if err := x.RebuildBloomFilter(); err == nil {
+		t.Errorf("expected RebuildBloomFilter without a filter to fail")
+	}
+	if err := x.EnableBloomFilter(-1); err == nil {
+		t.Errorf("expected negative bitsPerKey to fail")
+	}
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(fmt.Sprintf("a%04d", i)), []byte("v"))
+	}
+	if err := x.EnableBloomFilter(10); err != nil {
+		t.Errorf("expected EnableBloomFilter to work, got: %v", err)
+	}
+	for i := 100; i < 3000; i++ { // Grows the filter.
+		x.Set([]byte(fmt.Sprintf("a%04d", i)), []byte("v"))
+	}
+	x.Delete([]byte("a0000"))
+	check := func(x *Collection, what string) {
+		for i := 1; i < 3000; i++ {
+			if v, err := x.Get([]byte(fmt.Sprintf("a%04d", i))); string(v) != "v" || err != nil {
+				t.Errorf("%s: expected a%04d, got: %q, %v", what, i, v, err)
+				return
+			}
+		}
+		if v, _ := x.Get([]byte("a0000")); v != nil {
+			t.Errorf("%s: expected a deleted key to be missing, got: %q", what, v)
+		}
+		var item Item
+		if found, _ := x.GetItemInto([]byte("a2999"), &item); !found {
+			t.Errorf("%s: expected GetItemInto to find a2999", what)
+		}
+	}
+	check(x, "grown")
+	if f := x.bloomFilter(); f == nil || f.capacity < 3000 {
+		t.Errorf("expected the filter to grow, got: %+v", f)
+	}
+	if err := s.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+
+	s, _ = NewStore(m)
+	x = s.GetCollection("x")
+	if x.bloomFilter() == nil {
+		t.Errorf("expected the persisted filter to be loaded")
+	}
+	check(x, "reopened")
+	numReadAt := m.numReadAt
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if v, _ := x.Get([]byte(fmt.Sprintf("b%04d", i))); v != nil {
+			t.Errorf("expected a missing key, got: %q", v)
+		}
+		if m.numReadAt != numReadAt {
+			falsePositives++
+			numReadAt = m.numReadAt
+		}
+	}
+	if falsePositives > 50 {
+		t.Errorf("expected few misses to read, got: %v", falsePositives)
+	}
+	if ss := s.Snapshot(); ss.GetCollection("x").bloomFilter() != nil {
+		t.Errorf("expected snapshots not to use the filter")
+	}
+
+	x.Set([]byte("c"), []byte("v"))
+	s.Flush()
+	loc := x.bloomFilter().loc
+	s.Flush()
+	if x.bloomFilter().loc != loc {
+		t.Errorf("expected an unchanged filter not to be rewritten")
+	}
+	if _, err := s.FlushRevertCollection("x"); err != nil {
+		t.Errorf("expected FlushRevertCollection to work, got: %v", err)
+	}
+	check(x, "reverted")
+	if v, _ := x.Get([]byte("c")); v != nil {
+		t.Errorf("expected c to be reverted, got: %q", v)
+	}
+	if err := x.RebuildBloomFilter(); err != nil {
+		t.Errorf("expected RebuildBloomFilter to work, got: %v", err)
+	}
+	check(x, "rebuilt")
+
+	x.EnableBloomFilter(0)
+	s.Flush()
+	s, _ = NewStore(m)
+	if x = s.GetCollection("x"); x.bloomFilter() != nil {
+		t.Errorf("expected a disabled filter not to be persisted")
+	}
+	check(x, "disabled")
+}
+
+// Gets of missing keys from a reopened store, reporting the file
+// reads per get.
+func benchmarkFileGetMisses(b *testing.B, bitsPerKey int) {
+	mf := &memFile{}
+	m := &mockfile{readat: mf.ReadAt, writeat: mf.WriteAt, stat: mf.Stat}
+	s, _ := NewStore(m)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 10000; i++ {
+		x.Set([]byte(strconv.Itoa(i*2)), []byte("v"))
+	}
+	x.EnableBloomFilter(bitsPerKey)
+	s.Flush()
+	s, _ = NewStore(m)
+	x = s.GetCollection("x")
+	keys := make([][]byte, 10000)
+	for i := range keys {
+		keys[i] = []byte(strconv.Itoa(i*2 + 1))
+	}
+	numReadAt := m.numReadAt
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%len(keys) == 0 {
+			b.StopTimer()
+			x.EvictSomeItems() // Keep most of the tree cold.
+			b.StartTimer()
+		}
+		x.Get(keys[i%len(keys)])
+	}
+	b.ReportMetric(float64(m.numReadAt-numReadAt)/float64(b.N), "reads/op")
+}
+
+func BenchmarkFileGetMisses(b *testing.B) {
+	benchmarkFileGetMisses(b, 0)
+}
+
+func BenchmarkFileGetMissesBloom(b *testing.B) {
+	benchmarkFileGetMisses(b, 10)
+}
+
+func TestFingerprint(t *testing.T) {
+	fingerprint := func(x *Collection) []byte {
+		fp, err := x.Fingerprint()
+		if err != nil || len(fp) != 32 {
+			t.Errorf("expected Fingerprint to work, got: %x, %v", fp, err)
+		}
+		return fp
+	}
+	s, _ := NewStore(nil)
+	a := s.SetCollection("a", nil)
+	e := fingerprint(a)
+	if !bytes.Equal(e, fingerprint(s.SetCollection("e", nil))) {
+		t.Errorf("expected empty collections to match")
+	}
+	for i := 0; i < 500; i++ {
+		k := []byte(fmt.Sprintf("%03d", i))
+		a.SetItem(&Item{Key: k, Val: bytes.Repeat(k, i%7), Priority: int32(i)})
+	}
+	// Built in another order, with other priorities first, and persisted.
+	f := &memFile{}
+	s2, _ := NewStore(f)
+	b := s2.SetCollection("b", nil)
+	for i := 499; i >= 0; i-- {
+		k := []byte(fmt.Sprintf("%03d", i))
+		b.SetItem(&Item{Key: k, Val: []byte("old"), Priority: rand.Int31()})
+		b.SetItem(&Item{Key: k, Val: bytes.Repeat(k, i%7), Priority: int32(i)})
+	}
+	b.Set([]byte("extra"), []byte{})
+	b.Delete([]byte("extra"))
+	s2.Flush()
+	s2, _ = NewStore(f)
+	b = s2.GetCollection("b")
+	fa := fingerprint(a)
+	if bytes.Equal(fa, e) {
+		t.Errorf("expected a non-empty collection not to match an empty one")
+	}
+	if !bytes.Equal(fa, fingerprint(b)) {
+		t.Errorf("expected the same items to match")
+	}
+	v, _ := b.Get([]byte("123"))
+	v = append([]byte{}, v...)
+	v[0] ^= 1
+	b.SetItem(&Item{Key: []byte("123"), Val: v, Priority: 123})
+	if bytes.Equal(fa, fingerprint(b)) {
+		t.Errorf("expected a flipped value bit not to match")
+	}
+	v[0] ^= 1
+	b.SetItem(&Item{Key: []byte("123"), Val: v, Priority: 124})
+	if bytes.Equal(fa, fingerprint(b)) {
+		t.Errorf("expected another priority not to match")
+	}
+	b.SetItem(&Item{Key: []byte("123"), Val: v, Priority: 123})
+	if !bytes.Equal(fa, fingerprint(b)) {
+		t.Errorf("expected the restored item to match")
+	}
+	// Length prefixes keep key and value boundaries apart.
+	c := s.SetCollection("c", nil)
+	d := s.SetCollection("d", nil)
+	c.SetItem(&Item{Key: []byte("ab"), Val: []byte("c"), Priority: 1})
+	d.SetItem(&Item{Key: []byte("a"), Val: []byte("bc"), Priority: 1})
+	if bytes.Equal(fingerprint(c), fingerprint(d)) {
+		t.Errorf("expected shifted key and value bytes not to match")
+	}
+}
+
+func TestSubtreeDigestDiffRanges(t *testing.T) {
+	s, _ := NewStore(nil)
+	a := s.SetCollection("a", nil)
+	b := s.SetCollection("b", nil)
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("%04d", i))
+		a.SetItem(&Item{Key: k, Val: k, Priority: int32(i)})
+	}
+	for i := 999; i >= 0; i-- {
+		k := []byte(fmt.Sprintf("%04d", i))
+		b.SetItem(&Item{Key: k, Val: k, Priority: int32(i)})
+	}
+	diff := func(what string) []KeyRange {
+		ranges, err := DiffRanges(a, b, 8)
+		if err != nil {
+			t.Errorf("%s: expected DiffRanges to work, got: %v", what, err)
+		}
+		return ranges
+	}
+	if ranges := diff("same"); len(ranges) != 0 {
+		t.Errorf("expected no differences, got: %v", ranges)
+	}
+	if _, err := DiffRanges(a, b, 0); err == nil {
+		t.Errorf("expected maxItems of 0 to fail")
+	}
+	fa, _ := a.Fingerprint()
+	da, _ := a.SubtreeDigest(nil, nil)
+	if !bytes.Equal(fa, da) {
+		t.Errorf("expected the digest of everything to be the fingerprint")
+	}
+
+	b.SetItem(&Item{Key: []byte("0617"), Val: []byte("changed"), Priority: 617})
+	for _, r := range []KeyRange{{nil, []byte("0600")}, {[]byte("0618"), nil},
+		{[]byte("0617x"), []byte("0700")}} {
+		da, _ := a.SubtreeDigest(r.StartKey, r.EndKey)
+		db, _ := b.SubtreeDigest(r.StartKey, r.EndKey)
+		if !bytes.Equal(da, db) {
+			t.Errorf("expected range %q to match", r)
+		}
+	}
+	da, _ = a.SubtreeDigest([]byte("0600"), []byte("0618"))
+	db, _ := b.SubtreeDigest([]byte("0600"), []byte("0618"))
+	if bytes.Equal(da, db) {
+		t.Errorf("expected the range with the changed key not to match")
+	}
+	inRange := func(r KeyRange, key string) bool {
+		return (r.StartKey == nil || string(r.StartKey) <= key) &&
+			(r.EndKey == nil || key < string(r.EndKey))
+	}
+	countIn := func(c *Collection, r KeyRange) (n int) {
+		c.VisitItemsAscend([]byte{0}, false, func(i *Item) bool {
+			if inRange(r, string(i.Key)) {
+				n++
+			}
+			return true
+		})
+		return n
+	}
+	ranges := diff("changed")
+	if len(ranges) != 1 || !inRange(ranges[0], "0617") ||
+		countIn(a, ranges[0]) > 8 || countIn(b, ranges[0]) > 8 {
+		t.Errorf("expected one small range with 0617, got: %q", ranges)
+	}
+
+	b.SetItem(&Item{Key: []byte("0617"), Val: []byte("0617"), Priority: 617})
+	b.SetItem(&Item{Key: []byte("0123x"), Val: []byte{}, Priority: 1})
+	a.Delete([]byte("0900"))
+	ranges = diff("added and deleted")
+	if len(ranges) != 2 || !inRange(ranges[0], "0123x") ||
+		!inRange(ranges[1], "0900") {
+		t.Errorf("expected ranges with 0123x and 0900, got: %q", ranges)
+	}
+	// Syncing the ranges makes the collections equal.
+	for _, r := range ranges {
+		a.VisitItemsAscend([]byte{0}, false, func(i *Item) bool {
+			if inRange(r, string(i.Key)) {
+				a.Delete(i.Key)
+			}
+			return true
+		})
+		b.VisitItemsAscend([]byte{0}, true, func(i *Item) bool {
+			if inRange(r, string(i.Key)) {
+				a.SetItem(&Item{Key: i.Key, Val: i.Val, Priority: i.Priority})
+			}
+			return true
+		})
+	}
+	if ranges := diff("synced"); len(ranges) != 0 {
+		t.Errorf("expected no differences after syncing, got: %q", ranges)
+	}
+}
+
+func TestLookupCache(t *testing.T) {
+	f := &memFile{}
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	if err := x.SetLookupCache(-1); err == nil {
+		t.Errorf("expected negative entries to fail")
+	}
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), []byte("a"))
+	}
+	if err := x.SetLookupCache(32); err != nil {
+		t.Errorf("expected SetLookupCache to work, got: %v", err)
+	}
+	get := func(k, exp string) {
+		v, err := x.Get([]byte(k))
+		if err != nil || string(v) != exp || (exp == "") != (v == nil) {
+			t.Errorf("expected %q = %q, got: %q, %v", k, exp, v, err)
+		}
+	}
+	stats := func() (uint64, uint64) {
+		st, _ := x.Stats()
+		return st.LookupCacheHits, st.LookupCacheMisses
+	}
+	get("001", "a")
+	get("001", "a")
+	get("zzz", "")
+	get("zzz", "")
+	if hits, misses := stats(); hits != 2 || misses != 2 {
+		t.Errorf("expected 2 hits and 2 misses, got: %v, %v", hits, misses)
+	}
+	x.Set([]byte("001"), []byte("b"))
+	get("001", "b")
+	x.Set([]byte("zzz"), []byte("c"))
+	get("zzz", "c")
+	x.Delete([]byte("001"))
+	get("001", "")
+	x.DeleteMulti([][]byte{[]byte("zzz"), []byte("002")})
+	get("zzz", "")
+	get("002", "")
+	if i, _ := x.GetItem([]byte("003"), false); i == nil {
+		t.Errorf("expected 003 without value")
+	}
+	get("003", "a") // A cached Item without value isn't a hit with value.
+
+	for i := 0; i < 100; i++ {
+		x.Get([]byte(fmt.Sprintf("%03d", i)))
+	}
+	n := 0
+	lc := x.lookupCache()
+	for j := range lc.shards {
+		n += len(lc.shards[j].entries)
+	}
+	if n > 32+lookupCacheShards {
+		t.Errorf("expected the cache to be bounded, got: %v entries", n)
+	}
+
+	s.Flush()
+	x.Set([]byte("050"), []byte("d"))
+	s.Flush()
+	get("050", "d")
+	if _, err := s.FlushRevertCollection("x"); err != nil {
+		t.Errorf("expected FlushRevertCollection to work, got: %v", err)
+	}
+	get("050", "a")
+	x = s.SetCollection("x", nil)
+	if x.lookupCache() != lc {
+		t.Errorf("expected the cache to carry over SetCollection")
+	}
+	get("050", "a")
+	x.SetLookupCache(0)
+	for j := range lc.shards {
+		if lc.shards[j].entries != nil {
+			t.Errorf("expected a disabled cache to be dropped")
+		}
+	}
+	get("050", "a")
+
+	// Readers never see a value older than one they saw before.
+	x.SetLookupCache(8)
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := map[string]int{}
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for k := 0; k < 4; k++ {
+					key := fmt.Sprintf("hot%d", k)
+					v, _ := x.Get([]byte(key))
+					if v == nil {
+						continue // While deleted.
+					}
+					n, _ := strconv.Atoi(string(v))
+					if n < last[key] {
+						t.Errorf("expected %v >= %v for %v", n, last[key], key)
+						return
+					}
+					last[key] = n
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 2000; i++ {
+		key := []byte(fmt.Sprintf("hot%d", i%4))
+		if i%7 == 0 {
+			x.Delete(key)
+			x.Set(key, []byte(strconv.Itoa(i)))
+		} else {
+			x.Set(key, []byte(strconv.Itoa(i)))
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func benchmarkZipfGets(b *testing.B, entries int) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	keys := make([][]byte, 100000)
+	for i := range keys {
+		keys[i] = []byte(strconv.Itoa(i))
+		x.Set(keys[i], keys[i])
+	}
+	x.SetLookupCache(entries)
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, uint64(len(keys)-1))
+	order := make([][]byte, 1<<16)
+	for i := range order {
+		order[i] = keys[zipf.Uint64()]
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.Get(order[i%len(order)])
+	}
+}
+
+func BenchmarkZipfGets(b *testing.B) {
+	benchmarkZipfGets(b, 0)
+}
+
+func BenchmarkZipfGetsLookupCache(b *testing.B) {
+	benchmarkZipfGets(b, 4096)
+}
+
+type syncMockfile struct {
+	*mockfile
+	writesAtSync []int
+}
+
+func (f *syncMockfile) Sync() error {
+	f.writesAtSync = append(f.writesAtSync, f.numWriteAt)
+	return nil
+}
+
+func TestFlushBuffer(t *testing.T) {
+	mf := &memFile{}
+	m := &mockfile{readat: mf.ReadAt, writeat: mf.WriteAt, stat: mf.Stat}
+	f := &syncMockfile{mockfile: m}
+	s, _ := NewStore(f)
+	if err := s.SetFlushBufferSize(-1); err == nil {
+		t.Errorf("expected a negative size to fail")
+	}
+	s.SetFlushBufferSize(0)
+	x := s.SetCollection("x", nil)
+	set := func(n int, val string) {
+		for i := 0; i < n; i++ {
+			x.Set([]byte(fmt.Sprintf("%04d", i)), []byte(val))
+		}
+	}
+	set(1000, "a")
+	s.Flush()
+	unbuffered := m.numWriteAt
+
+	s.SetFlushBufferSize(64 * 1024)
+	s.SetFlushSync(true)
+	set(1000, "b")
+	x.Set([]byte("big"), bytes.Repeat([]byte("v"), 100000))
+	m.numWriteAt = 0
+	if err := s.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+	if m.numWriteAt*20 > unbuffered {
+		t.Errorf("expected far fewer writes, got: %v vs %v", m.numWriteAt, unbuffered)
+	}
+	if len(f.writesAtSync) != 1 || f.writesAtSync[0] != m.numWriteAt-1 {
+		t.Errorf("expected a sync before the roots record, got: %v of %v",
+			f.writesAtSync, m.numWriteAt)
+	}
+	if atomic.LoadInt64(&s.bufferedFrom) != 0 || s.flushBuf.active {
+		t.Errorf("expected the buffer to be written")
+	}
+	check := func(s *Store, val string) {
+		x := s.GetCollection("x")
+		for i := 0; i < 1000; i++ {
+			k := fmt.Sprintf("%04d", i)
+			if v, err := x.Get([]byte(k)); string(v) != val || err != nil {
+				t.Errorf("expected %s = %s, got: %q, %v", k, val, v, err)
+				return
+			}
+		}
+		if v, _ := x.Get([]byte("big")); len(v) != 100000 {
+			t.Errorf("expected the big value, got: %v bytes", len(v))
+		}
+	}
+	s2, err := NewStore(f)
+	if err != nil {
+		t.Errorf("expected reopen to work, got: %v", err)
+	}
+	check(s2, "b")
+
+	// A buffer that fails to be written is discarded with the rollback
+	// of the failed Flush, and written again by the next Flush.
+	set(1000, "c")
+	fail := true
+	m.writeat = func(p []byte, off int64) (int, error) {
+		if fail && len(p) > 1000 {
+			return 0, errors.New("write failed")
+		}
+		return mf.WriteAt(p, off)
+	}
+	if err := s.Flush(); err == nil {
+		t.Errorf("expected Flush to fail")
+	}
+	if atomic.LoadInt64(&s.bufferedFrom) != 0 || len(s.flushBuf.buf) != 0 {
+		t.Errorf("expected the failed records to be discarded")
+	}
+	// Only the big item, of the prior Flush, may be evicted.
+	if res := x.EvictSomeItems(); res.NumEvicted > 1 ||
+		(res.NumEvicted == 1 && res.EvictedBytes != 100003) {
+		t.Errorf("expected the rolled back items to stay, got: %+v", res)
+	}
+	check(s, "c")
+	fail = false
+	if err := s.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+	x.EvictSomeItems()
+	check(s, "c")
+	s2, _ = NewStore(f)
+	check(s2, "c")
+
+	s.SetFlushBufferSize(0)
+	set(1000, "d")
+	s.Flush()
+	if s.flushBuf != nil {
+		t.Errorf("expected a disabled buffer to be dropped")
+	}
+	s2, _ = NewStore(f)
+	check(s2, "d")
+
+	// A new store buffers by default, growing the buffer as needed.
+	mf = &memFile{}
+	m = &mockfile{readat: mf.ReadAt, writeat: mf.WriteAt, stat: mf.Stat}
+	s, _ = NewStore(m)
+	x = s.SetCollection("x", nil)
+	set(1000, "e")
+	x.Set([]byte("big"), bytes.Repeat([]byte("v"), 100000))
+	s.Flush()
+	if m.numWriteAt != 2 {
+		t.Errorf("expected the records and the roots written once each, got: %v",
+			m.numWriteAt)
+	}
+	if n := cap(s.flushBuf.buf); n == 0 || n >= DefaultFlushBufferSize {
+		t.Errorf("expected the buffer grown as needed, got: %v", n)
+	}
+	s2, _ = NewStore(m)
+	check(s2, "e")
+}
+
+func benchmarkFlush(b *testing.B, bufSize int) {
+	mf := &memFile{}
+	m := &mockfile{readat: mf.ReadAt, writeat: mf.WriteAt, stat: mf.Stat}
+	s, _ := NewStore(m)
+	s.SetFlushBufferSize(bufSize)
+	x := s.SetCollection("x", nil)
+	v := bytes.Repeat([]byte("v"), 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 1000; j++ {
+			x.Set([]byte(strconv.Itoa(j)), v)
+		}
+		s.Flush()
+	}
+	b.ReportMetric(float64(m.numWriteAt)/float64(b.N), "writes/op")
+}
+
+func BenchmarkFlush(b *testing.B) {
+	benchmarkFlush(b, 0)
+}
+
+func BenchmarkFlushBuffered(b *testing.B) {
+	benchmarkFlush(b, 256*1024)
+}
+
+// Flushes a million new small items per op into a fresh file.
+func benchmarkFlushMillion(b *testing.B, bufSize int) {
+	var numWriteAt int
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		f, _ := ioutil.TempFile("./", "test")
+		m := &mockfile{readat: f.ReadAt, stat: f.Stat,
+			writeat: func(p []byte, off int64) (int, error) {
+				numWriteAt++
+				return f.WriteAt(p, off)
+			},
+		}
+		s, _ := NewStore(m)
+		s.SetFlushBufferSize(bufSize)
+		x := s.SetCollection("x", nil)
+		for j := 0; j < 1000000; j++ {
+			x.Set([]byte(fmt.Sprintf("%07d", j)), []byte("v"))
+		}
+		b.StartTimer()
+		s.Flush()
+		b.StopTimer()
+		s.Close()
+		f.Close()
+		os.Remove(f.Name())
+	}
+	b.ReportMetric(float64(numWriteAt)/float64(b.N), "writes/op")
+}
+
+func BenchmarkFlushMillion(b *testing.B) {
+	benchmarkFlushMillion(b, 0)
+}
+
+func BenchmarkFlushMillionBuffered(b *testing.B) {
+	benchmarkFlushMillion(b, DefaultFlushBufferSize)
+}
+
+func TestCopyToParallel(t *testing.T) {
+	mf := &memFile{}
+	m := &mockfile{readat: mf.ReadAt, writeat: mf.WriteAt, stat: mf.Stat}
+	s, _ := NewStore(m)
+	for c := 0; c < 8; c++ {
+		x := s.SetCollection(fmt.Sprintf("c%d", c), nil)
+		for i := 0; i < 300*c; i++ {
+			x.Set([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("v%d", c)))
+		}
+	}
+	s.Flush()
+	s, _ = NewStore(m) // So that the readers read from the file.
+	for _, flushEvery := range []int{0, 100} {
+		df := &memFile{}
+		d, err := s.CopyTo(df, flushEvery)
+		if err != nil {
+			t.Errorf("expected CopyTo to work, got: %v", err)
+			continue
+		}
+		if flushEvery == 0 {
+			d.Flush()
+		}
+		d, _ = NewStore(df)
+		if len(d.GetCollectionNames()) != 8 {
+			t.Errorf("expected 8 collections, got: %v", d.GetCollectionNames())
+		}
+		for _, name := range s.GetCollectionNames() {
+			exp, _ := s.GetCollection(name).Fingerprint()
+			got, _ := d.GetCollection(name).Fingerprint()
+			if !bytes.Equal(exp, got) {
+				t.Errorf("expected the copy of %v to match", name)
+			}
+		}
+	}
+
+	numGoroutines := runtime.NumGoroutine()
+	s, _ = NewStore(m)
+	numReads := 0
+	m.readat = func(p []byte, off int64) (int, error) {
+		if numReads++; numReads > 500 {
+			return 0, errors.New("read failed")
+		}
+		return mf.ReadAt(p, off)
+	}
+	if _, err := s.CopyTo(&memFile{}, 0); err == nil {
+		t.Errorf("expected a read error to stop CopyTo")
+	}
+	m.readat = mf.ReadAt
+	dm := &mockfile{stat: (&memFile{}).Stat,
+		writeat: func(p []byte, off int64) (int, error) {
+			return 0, errors.New("write failed")
+		}}
+	if _, err := s.CopyTo(dm, 10); err == nil {
+		t.Errorf("expected a write error to stop CopyTo")
+	}
+	if n := runtime.NumGoroutine(); n > numGoroutines {
+		t.Errorf("expected the readers to be done, got: %v > %v goroutines",
+			n, numGoroutines)
+	}
+}
+
+// A StoreFile with a read latency, like a disk.
+type slowReadFile struct {
+	memFile
+	delay time.Duration
+}
+
+func (f *slowReadFile) ReadAt(p []byte, off int64) (int, error) {
+	time.Sleep(f.delay)
+	return f.memFile.ReadAt(p, off)
+}
+
+// Copies a store with 8 collections from a reopened file with a read
+// latency, so that the items are read from the file; use -cpu 1,2,4,8
+// to compare the number of readers.
+func BenchmarkCopyTo(b *testing.B) {
+	f := &slowReadFile{}
+	s, _ := NewStore(f)
+	v := bytes.Repeat([]byte("v"), 100)
+	for c := 0; c < 8; c++ {
+		x := s.SetCollection(strconv.Itoa(c), nil)
+		for i := 0; i < 50; i++ {
+			x.Set([]byte(strconv.Itoa(i)), v)
+		}
+	}
+	s.Flush()
+	f.delay = 100 * time.Microsecond
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		s, _ = NewStore(f)
+		b.StartTimer()
+		if _, err := s.CopyTo(&memFile{}, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestVisitItemsParallel(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), []byte("v"))
+	}
+	visit := func(start, end []byte, workers int) map[string]int {
+		var m sync.Mutex
+		seen := map[string]int{}
+		err := x.VisitItemsParallel(start, end, true, workers,
+			func(i *Item) bool {
+				if string(i.Val) != "v" {
+					t.Errorf("expected a value, got: %q", i.Val)
+				}
+				m.Lock()
+				seen[string(i.Key)]++
+				m.Unlock()
+				return true
+			})
+		if err != nil {
+			t.Errorf("expected VisitItemsParallel to work, got: %v", err)
+		}
+		return seen
+	}
+	if err := x.VisitItemsParallel(nil, nil, false, 0,
+		func(i *Item) bool { return true }); err == nil {
+		t.Errorf("expected 0 workers to fail")
+	}
+	for _, workers := range []int{1, 2, 3, 8, 200} {
+		seen := visit(nil, nil, workers)
+		if len(seen) != 100 {
+			t.Errorf("expected all items, workers: %v, got: %v",
+				workers, len(seen))
+		}
+		for k, n := range seen {
+			if n != 1 {
+				t.Errorf("expected %q once, got: %v", k, n)
+			}
+		}
+		seen = visit([]byte("010"), []byte("020"), workers)
+		if len(seen) != 10 || seen["010"] != 1 || seen["019"] != 1 {
+			t.Errorf("expected the range, workers: %v, got: %v",
+				workers, seen)
+		}
+		if seen = visit([]byte("5"), nil, workers); len(seen) != 0 {
+			t.Errorf("expected an empty range, got: %v", seen)
+		}
+	}
+	var visited int32
+	err := x.VisitItemsParallel(nil, nil, false, 4, func(i *Item) bool {
+		return atomic.AddInt32(&visited, 1) < 5
+	})
+	if err != nil || atomic.LoadInt32(&visited) > 8 {
+		t.Errorf("expected the workers to stop, err: %v, visited: %v",
+			err, visited)
+	}
+}
+
+func BenchmarkVisitItemsParallel(b *testing.B) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 10000; i++ {
+		x.Set([]byte(fmt.Sprintf("%05d", i)), []byte("v"))
+	}
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				x.VisitItemsParallel(nil, nil, true, workers,
+					func(i *Item) bool {
+						h := sha256.Sum256(i.Key) // A CPU-bound visitor.
+						for j := 0; j < 10; j++ {
+							h = sha256.Sum256(h[:])
+						}
+						return true
+					})
+			}
+		})
+	}
+}
+
+func TestShardedStore(t *testing.T) {
+	files := []StoreFile{&memFile{}, &memFile{}, &memFile{}, &memFile{}}
+	if _, err := NewShardedStore(nil); err == nil {
+		t.Errorf("expected no files to fail")
+	}
+	ss, err := NewShardedStore(files)
+	if err != nil || ss.NumShards() != 4 {
+		t.Fatalf("expected NewShardedStore to work, got: %v", err)
+	}
+	x := ss.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("%03d", i))
+		if err = x.Set(k, k); err != nil {
+			t.Errorf("expected Set to work, got: %v", err)
+		}
+	}
+	perShard := 0
+	for i := 0; i < ss.NumShards(); i++ {
+		n, _, _ := x.Shard(i).GetTotals()
+		if n == 0 {
+			t.Errorf("expected shard %d to have items", i)
+		}
+		perShard += int(n)
+		x.Shard(i).VisitItemsAscend(nil, false, func(it *Item) bool {
+			if ss.ShardOf(it.Key) != i {
+				t.Errorf("expected %q in shard %d", it.Key, ss.ShardOf(it.Key))
+			}
+			return true
+		})
+	}
+	if n, _, _ := x.GetTotals(); perShard != 100 || n != 100 {
+		t.Errorf("expected 100 items, got: %v, %v", perShard, n)
+	}
+	if v, err := x.Get([]byte("042")); err != nil || string(v) != "042" {
+		t.Errorf("expected Get to work, got: %q, %v", v, err)
+	}
+	if d, err := x.Delete([]byte("042")); err != nil || !d {
+		t.Errorf("expected Delete to work, got: %v, %v", d, err)
+	}
+	if v, _ := x.Get([]byte("042")); v != nil {
+		t.Errorf("expected the key gone, got: %q", v)
+	}
+	visit := func(target []byte, descend bool, limit int) []string {
+		res := []string{}
+		v := x.VisitItemsAscend
+		if descend {
+			v = x.VisitItemsDescend
+		}
+		err := v(target, true, func(it *Item) bool {
+			if !bytes.Equal(it.Key, it.Val) {
+				t.Errorf("expected a value, got: %q", it.Val)
+			}
+			res = append(res, string(it.Key))
+			return len(res) < limit
+		})
+		if err != nil {
+			t.Errorf("expected the visit to work, got: %v", err)
+		}
+		return res
+	}
+	got := visit(nil, false, 1000)
+	if len(got) != 99 || !sort.StringsAreSorted(got) {
+		t.Errorf("expected ascending keys, got: %v", got)
+	}
+	if got = visit([]byte("040"), false, 3); fmt.Sprint(got) != "[040 041 043]" {
+		t.Errorf("expected ascending keys from the target, got: %v", got)
+	}
+	if got = visit([]byte("044"), true, 3); fmt.Sprint(got) != "[043 041 040]" {
+		t.Errorf("expected descending keys from the target, got: %v", got)
+	}
+	if names := ss.GetCollectionNames(); fmt.Sprint(names) != "[x]" {
+		t.Errorf("expected the reserved collection hidden, got: %v", names)
+	}
+	if ss.Shard(1).Flush() != nil {
+		t.Errorf("expected a shard Flush to work")
+	}
+	s1, _ := NewStore(files[1])
+	if n, _, _ := s1.GetCollection("x").GetTotals(); n == 0 {
+		t.Errorf("expected the flushed shard to have items")
+	}
+	s0, _ := NewStore(files[0])
+	if s0.GetCollection("x") != nil {
+		t.Errorf("expected the unflushed shard to not have x")
+	}
+	if err = ss.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+	ss2, err := NewShardedStore(files)
+	if err != nil {
+		t.Fatalf("expected reopening to work, got: %v", err)
+	}
+	if n, _, _ := ss2.GetCollection("x").GetTotals(); n != 99 {
+		t.Errorf("expected the reopened items, got: %v", n)
+	}
+	if ss2.GetCollection("y") != nil {
+		t.Errorf("expected no y")
+	}
+	if _, err = NewShardedStore(files[:3]); err == nil {
+		t.Errorf("expected a shard count mismatch to fail")
+	}
+	if _, err = NewShardedStore([]StoreFile{files[1], files[0],
+		files[2], files[3]}); err == nil {
+		t.Errorf("expected reordered files to fail")
+	}
+	if _, err = NewShardedStore([]StoreFile{files[0], files[1],
+		files[2], &memFile{}}); err == nil {
+		t.Errorf("expected a missing shard to fail")
+	}
+	other := &memFile{}
+	s, _ := NewStore(other)
+	s.SetCollection("z", nil).Set([]byte("a"), []byte("b"))
+	s.Flush()
+	if _, err = NewShardedStore([]StoreFile{other}); err == nil {
+		t.Errorf("expected a non-shard file to fail")
+	}
+}
+
+func TestConcurrentCollectionWriters(t *testing.T) {
+	f := &memFile{}
+	s, _ := NewStore(f)
+	const writers, n = 8, 300
+	colls := make([]*Collection, writers)
+	for w := range colls {
+		colls[w] = s.SetCollection(fmt.Sprintf("c%d", w), nil)
+	}
+	var wg sync.WaitGroup
+	for w := range colls {
+		wg.Add(1)
+		go func(c *Collection) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				k := []byte(fmt.Sprintf("%04d", i))
+				if err := c.Set(k, k); err != nil {
+					t.Errorf("expected Set to work, got: %v", err)
+				}
+				if i%3 == 0 {
+					if _, err := c.Delete(k); err != nil {
+						t.Errorf("expected Delete to work, got: %v", err)
+					}
+				}
+				c.Get(k)
+			}
+		}(colls[w])
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := s.Flush(); err != nil {
+				t.Errorf("expected Flush to work, got: %v", err)
+			}
+			s.AllocStats()
+		}
+	}()
+	wg.Wait()
+	if err := s.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+	s, _ = NewStore(f)
+	for w := 0; w < writers; w++ {
+		c := s.GetCollection(fmt.Sprintf("c%d", w))
+		if num, _, _ := c.GetTotals(); num != n-n/3 {
+			t.Errorf("expected %v items, got: %v", n-n/3, num)
+		}
+		if v, _ := c.Get([]byte("0001")); string(v) != "0001" {
+			t.Errorf("expected a value, got: %q", v)
+		}
+	}
+}
+
+func BenchmarkConcurrentCollectionWriters(b *testing.B) {
+	for _, writers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("writers=%d", writers), func(b *testing.B) {
+			s, _ := NewStore(nil)
+			colls := make([]*Collection, writers)
+			for w := range colls {
+				colls[w] = s.SetCollection(fmt.Sprintf("c%d", w), nil)
+			}
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for w := range colls {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					r := rand.New(rand.NewSource(int64(w)))
+					k := make([]byte, 8)
+					for i := w; i < b.N; i += writers {
+						binary.BigEndian.PutUint64(k, uint64(r.Int63()))
+						kv := append([]byte(nil), k...)
+						colls[w].SetItem(&Item{Key: kv, Val: kv, Priority: r.Int31()})
+					}
+				}(w)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestCollectionWriter(t *testing.T) {
+	s, _ := NewStore(&memFile{})
+	s.SetDebugValidation(2)
+	x := s.SetCollection("x", nil)
+	if err := x.StartWriter(-1); err == nil {
+		t.Errorf("expected a negative queue depth to fail")
+	}
+	if err := x.StopWriter(); err == nil {
+		t.Errorf("expected StopWriter without a writer to fail")
+	}
+	var events []string
+	x.OnMutation(func(op MutationOp, key, val []byte) {
+		events = append(events, fmt.Sprintf("%v %s=%s", op, key, val))
+	})
+	err := x.StartWriterEx(WriterOptions{QueueDepth: 16, MaxDelay: time.Millisecond})
+	if err != nil {
+		t.Errorf("expected StartWriterEx to work, got: %v", err)
+	}
+	if err = x.StartWriter(16); err == nil {
+		t.Errorf("expected a second writer to fail")
+	}
+	var res []<-chan error
+	for _, kv := range []string{"a1", "b1", "a2", "c1", "a3"} {
+		res = append(res, x.SetItemAsync(&Item{Key: []byte(kv[:1]),
+			Val: []byte(kv[1:]), Priority: int32(len(res))}))
+	}
+	for _, r := range res {
+		if err = <-r; err != nil {
+			t.Errorf("expected SetItemAsync to work, got: %v", err)
+		}
+	}
+	if err = <-x.SetItemAsync(&Item{Key: []byte("bad"), Priority: -1}); err == nil {
+		t.Errorf("expected an invalid item to fail")
+	}
+	if v, _ := x.Get([]byte("a")); string(v) != "3" {
+		t.Errorf("expected the last set to win, got: %q", v)
+	}
+	if ok, err := x.Delete([]byte("a")); !ok || err != nil {
+		t.Errorf("expected Delete to work, got: %v, %v", ok, err)
+	}
+	if ok, err := x.Delete([]byte("a")); ok || err != nil {
+		t.Errorf("expected Delete of a deleted key to not delete, got: %v, %v", ok, err)
+	}
+	exp := []string{"set a=1", "set b=1", "set a=2", "set c=1", "set a=3", "delete a="}
+	if fmt.Sprint(events) != fmt.Sprint(exp) {
+		t.Errorf("expected events in arrival order %v, got: %v", exp, events)
+	}
+	x.OnMutation(nil)
+
+	const writers, n = 16, 100
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				k := []byte(fmt.Sprintf("%02d-%03d", w, i))
+				if err := x.Set(k, k); err != nil {
+					t.Errorf("expected Set to work, got: %v", err)
+				}
+				if i%4 == 0 {
+					if ok, err := x.Delete(k); !ok || err != nil {
+						t.Errorf("expected Delete to work, got: %v, %v", ok, err)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if err = x.StopWriter(); err != nil {
+		t.Errorf("expected StopWriter to work, got: %v", err)
+	}
+	if err = x.Set([]byte("z"), []byte("1")); err != nil {
+		t.Errorf("expected Set without a writer to work, got: %v", err)
+	}
+	num, _, _ := x.GetTotals()
+	if num != writers*(n-n/4)+3 {
+		t.Errorf("expected %v items, got: %v", writers*(n-n/4)+3, num)
+	}
+	// Only the replaced nodes awaiting the release of the root are left
+	// unreclaimed.
+	if a := x.AllocStats(); a.MkNodes-a.FreeNodes > int64(num)+1 {
+		t.Errorf("expected no leaked nodes, items: %v, alloc stats: %+v", num, a)
+	}
+
+	x.StartWriter(16)
+	s.Close()
+	if err = x.Set([]byte("a"), []byte("1")); err != ErrStoreClosed {
+		t.Errorf("expected ErrStoreClosed, got: %v", err)
+	}
+}
+
+func BenchmarkCollectionWriter(b *testing.B) {
+	for _, writer := range []bool{false, true} {
+		b.Run(fmt.Sprintf("writer=%v", writer), func(b *testing.B) {
+			s, _ := NewStore(nil)
+			x := s.SetCollection("x", nil)
+			if writer {
+				x.StartWriter(64)
+				defer x.StopWriter()
+			}
+			const goroutines = 32
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					r := rand.New(rand.NewSource(int64(g)))
+					k := make([]byte, 8)
+					for i := g; i < b.N; i += goroutines {
+						binary.BigEndian.PutUint64(k, uint64(r.Int63()))
+						kv := append([]byte(nil), k...)
+						x.SetItem(&Item{Key: kv, Val: kv, Priority: r.Int31()})
+					}
+				}(g)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestSetMaxSetRetries(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	if err := x.SetMaxSetRetries(-1); err == nil {
+		t.Errorf("expected a negative max to fail")
+	}
+	if err := x.SetSetRetryBackoff(-1, 0); err == nil {
+		t.Errorf("expected a negative threshold to fail")
+	}
+	// Holds the collection's lock like a long mutation would.
+	contend := func(d time.Duration) chan struct{} {
+		held := make(chan struct{})
+		go func() {
+			x.writeLock.Lock()
+			close(held)
+			time.Sleep(d)
+			x.writeLock.Unlock()
+		}()
+		<-held
+		return held
+	}
+	x.SetMaxSetRetries(3)
+	x.SetSetRetryBackoff(1, time.Millisecond)
+	contend(50 * time.Millisecond)
+	if err := x.Set([]byte("a"), []byte("1")); err != ErrContended {
+		t.Errorf("expected ErrContended, got: %v", err)
+	}
+	if st, _ := x.Stats(); st.SetRetries != 3 || st.SetsContended != 1 {
+		t.Errorf("expected 3 retries and 1 contended, got: %+v", st)
+	}
+	x.writeLock.Lock() // Waits for the contender.
+	x.writeLock.Unlock()
+
+	x = s.SetCollection("x", nil) // Keeps the setting.
+	x.SetMaxSetRetries(10000)
+	x.SetSetRetryBackoff(0, 2*time.Millisecond)
+	contend(30 * time.Millisecond)
+	start := time.Now()
+	if err := x.Set([]byte("a"), []byte("1")); err != nil {
+		t.Errorf("expected Set to outlast the contention, got: %v", err)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Errorf("expected Set to wait for the lock")
+	}
+	st, _ := x.Stats()
+	if st.SetRetries == 0 || st.SetRetries > 200 {
+		t.Errorf("expected the backoff to bound the retries, got: %v", st.SetRetries)
+	}
+	if st.SetsContended != 0 {
+		t.Errorf("expected no more contended sets, got: %v", st.SetsContended)
+	}
+
+	x.SetMaxSetRetries(0) // Waits however long.
+	contend(10 * time.Millisecond)
+	if err := x.Set([]byte("b"), []byte("1")); err != nil {
+		t.Errorf("expected Set to work, got: %v", err)
+	}
+	if st2, _ := x.Stats(); st2.SetRetries != st.SetRetries {
+		t.Errorf("expected no retries without a max, got: %v", st2.SetRetries-st.SetRetries)
+	}
+}
+
+// A memFile whose first write waits for release to be closed.
+type pausedWriteFile struct {
+	memFile
+	once    sync.Once
+	paused  chan struct{} // Closed at the first write.
+	release chan struct{}
+}
+
+func (f *pausedWriteFile) WriteAt(p []byte, off int64) (int, error) {
+	f.once.Do(func() {
+		close(f.paused)
+		<-f.release
+	})
+	return f.memFile.WriteAt(p, off)
+}
+
+func TestBackupTo(t *testing.T) {
+	f := &memFile{}
+	s, _ := NewStore(f)
+	for _, name := range []string{"x", "y"} {
+		c := s.SetCollection(name, nil)
+		for i := 0; i < 100; i++ {
+			k := []byte(fmt.Sprintf("%03d", i))
+			c.Set(k, append([]byte(name), k...))
+		}
+	}
+	s.Flush()
+	s, _ = NewStore(f) // So the backup reads the nodes from the file.
+	s.SetReuseFreeSpace(true)
+	x := s.GetCollection("x")
+	x.Set([]byte("unflushed"), []byte("u"))
+
+	dest := &pausedWriteFile{
+		paused:  make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- s.BackupTo(dest) }()
+	<-dest.paused
+	keys := make([][]byte, 0, 100)
+	for i := 0; i < 100; i += 2 {
+		keys = append(keys, []byte(fmt.Sprintf("%03d", i)))
+	}
+	x.DeleteMulti(keys)
+	x.Set([]byte("001"), []byte("changed"))
+	s.SetCollection("z", nil).Set([]byte("a"), []byte("1"))
+	s.RemoveCollection("y")
+	if err := s.Flush(); err != nil {
+		t.Errorf("expected Flush during the backup to work, got: %v", err)
+	}
+	s.SetCollection("y", nil).Set([]byte("000"), []byte("new")) // Reuses some freed space.
+	s.Flush()
+	close(dest.release)
+	if err := <-errc; err != nil {
+		t.Errorf("expected BackupTo to work, got: %v", err)
+	}
+
+	b, err := NewStore(&dest.memFile)
+	if err != nil {
+		t.Errorf("expected the backup to open, got: %v", err)
+	}
+	if names := b.GetCollectionNames(); fmt.Sprint(names) != "[x y]" {
+		t.Errorf("expected the collections as of the backup, got: %v", names)
+	}
+	for _, name := range []string{"x", "y"} {
+		n := 0
+		b.GetCollection(name).VisitItemsAscend(nil, true, func(i *Item) bool {
+			if string(i.Key) == "unflushed" {
+				if string(i.Val) != "u" {
+					t.Errorf("expected the unflushed value, got: %q", i.Val)
+				}
+			} else if string(i.Val) != name+string(i.Key) {
+				t.Errorf("expected the value as of the backup, coll: %v, key: %q, got: %q",
+					name, i.Key, i.Val)
+			}
+			n++
+			return true
+		})
+		exp := 100
+		if name == "x" {
+			exp++
+		}
+		if n != exp {
+			t.Errorf("expected %v items in %v, got: %v", exp, name, n)
+		}
+	}
+	if v, _ := s.GetCollection("x").Get([]byte("001")); string(v) != "changed" {
+		t.Errorf("expected the live store to keep its mutations, got: %q", v)
+	}
+	if err = s.BackupTo(&dest.memFile); err == nil {
+		t.Errorf("expected a backup to a non-empty file to fail")
+	}
+	s.Close()
+	if err = s.BackupTo(&memFile{}); err != ErrStoreClosed {
+		t.Errorf("expected ErrStoreClosed, got: %v", err)
+	}
+}
+
+func TestVisitDecoded(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	type user struct {
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+	}
+	for i, name := range []string{"ann", "bob", "cat", "dan"} {
+		b, _ := json.Marshal(user{Name: name, Age: 20 + i})
+		x.Set([]byte(name), b)
+	}
+	decode := func(key, val []byte) (interface{}, error) {
+		u := &user{}
+		if err := json.Unmarshal(val, u); err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
+	var got []string
+	err := x.VisitDecoded([]byte("b"), decode, func(v interface{}) bool {
+		u := v.(*user)
+		got = append(got, fmt.Sprintf("%s:%d", u.Name, u.Age))
+		return u.Name != "cat"
+	})
+	if err != nil || fmt.Sprint(got) != "[bob:21 cat:22]" {
+		t.Errorf("expected the decoded users until cat, got: %v, %v", got, err)
+	}
+	x.Set([]byte("bad"), []byte("{not json"))
+	got = nil
+	err = x.VisitDecoded(nil, decode, func(v interface{}) bool {
+		got = append(got, v.(*user).Name)
+		return true
+	})
+	var syntaxErr *json.SyntaxError
+	if err == nil || !strings.Contains(err.Error(), `"bad"`) ||
+		!errors.As(err, &syntaxErr) {
+		t.Errorf("expected a wrapped decode error naming the key, got: %v", err)
+	}
+	if fmt.Sprint(got) != "[ann]" {
+		t.Errorf("expected the visit to stop at the malformed value, got: %v", got)
+	}
+}
+
+func TestEvictSkipsDirtyItems(t *testing.T) {
+	valReads := 0
+	s, _ := NewStoreEx(&memFile{}, StoreCallbacks{
+		ItemValRead: func(c *Collection, i *Item,
+			r io.ReaderAt, offset int64, valLength uint32) error {
+			valReads++
+			i.Val = make([]byte, valLength)
+			_, err := r.ReadAt(i.Val, offset)
+			return err
+		},
+	})
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("%03d", i))
+		x.Set(k, append([]byte("v"), k...))
+	}
+	check := func(when string) {
+		for i := 0; i < 100; i++ {
+			k := []byte(fmt.Sprintf("%03d", i))
+			if v, err := x.Get(k); err != nil || string(v) != "v"+string(k) {
+				t.Errorf("expected %s value of %s, got: %q, %v", when, k, v, err)
+			}
+		}
+	}
+	var res EvictResult
+	for i := 0; i < 50; i++ {
+		r := x.EvictSomeItems()
+		res.NumEvicted += r.NumEvicted
+		res.EvictedBytes += r.EvictedBytes
+		res.SkippedDirtyBytes += r.SkippedDirtyBytes
+	}
+	if res.NumEvicted != 0 || res.EvictedBytes != 0 || res.SkippedDirtyBytes == 0 {
+		t.Errorf("expected only skipped dirty items before Flush, got: %+v", res)
+	}
+	check("unflushed")
+	if valReads != 0 {
+		t.Errorf("expected no value reads of dirty items, got: %v", valReads)
+	}
+	s.Flush()
+	res = EvictResult{}
+	for i := 0; i < 50; i++ {
+		r := x.EvictSomeItems()
+		res.NumEvicted += r.NumEvicted
+		res.EvictedBytes += r.EvictedBytes
+		res.SkippedDirtyBytes += r.SkippedDirtyBytes
+	}
+	if res.NumEvicted == 0 || res.EvictedBytes != res.NumEvicted*7 ||
+		res.SkippedDirtyBytes != 0 {
+		t.Errorf("expected evictions of flushed items, got: %+v", res)
+	}
+	check("evicted")
+	if uint64(valReads) != res.NumEvicted {
+		t.Errorf("expected the evicted values to be re-read, got: %v reads for %v evicted",
+			valReads, res.NumEvicted)
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	if err := s.SetLimits(-1, 0); err == nil {
+		t.Errorf("expected a negative limit to fail")
+	}
+	if err := s.SetLimits(8, 16); err != nil {
+		t.Errorf("expected SetLimits to work, got: %v", err)
+	}
+	k := func(n int) []byte { return bytes.Repeat([]byte("k"), n) }
+	v := func(n int) []byte { return bytes.Repeat([]byte("v"), n) }
+	for _, n := range []int{7, 8} {
+		if err := x.Set(k(n), []byte("v")); err != nil {
+			t.Errorf("expected a key of %v bytes to work, got: %v", n, err)
+		}
+	}
+	for _, n := range []int{15, 16} {
+		if err := x.Set([]byte("a"), v(n)); err != nil {
+			t.Errorf("expected a value of %v bytes to work, got: %v", n, err)
+		}
+	}
+	mkNodes := x.AllocStats().MkNodes
+	err := x.Set(k(9), []byte("v"))
+	var le *LimitError
+	if !errors.Is(err, ErrKeyTooLarge) || !errors.As(err, &le) ||
+		le.Limit != 8 || le.Size != 9 {
+		t.Errorf("expected ErrKeyTooLarge LimitError, got: %v", err)
+	}
+	err = <-x.SetItemAsync(&Item{Key: []byte("b"), Val: v(17)})
+	if !errors.Is(err, ErrValTooLarge) || !errors.As(err, &le) ||
+		le.Limit != 16 || le.Size != 17 {
+		t.Errorf("expected ErrValTooLarge LimitError, got: %v", err)
+	}
+	if x.AllocStats().MkNodes != mkNodes {
+		t.Errorf("expected rejected sets to not allocate nodes")
+	}
+	if num, _, _ := x.GetTotals(); num != 3 {
+		t.Errorf("expected 3 items, got: %v", num)
+	}
+	s.SetLimits(0, 0) // Unlimited again.
+	if err = x.Set(k(100), v(1000)); err != nil {
+		t.Errorf("expected no limits, got: %v", err)
+	}
+}
+
+// A StoreFile whose reads fail once failReads is set.
+type faultyReadFile struct {
+	memFile
+	failReads int32
+}
+
+func (f *faultyReadFile) ReadAt(p []byte, off int64) (int, error) {
+	if atomic.LoadInt32(&f.failReads) != 0 {
+		return 0, errors.New("injected read failure")
+	}
+	return f.memFile.ReadAt(p, off)
+}
+
+func TestSentinelErrors(t *testing.T) {
+	f := &faultyReadFile{}
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), []byte("v"))
+	}
+	if err := s.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+	if _, err := s.FlushRevertCollection("unknown"); !errors.Is(err, ErrCollectionMissing) {
+		t.Errorf("expected ErrCollectionMissing, got: %v", err)
+	}
+
+	ss := s.Snapshot()
+	sx := ss.GetCollection("x")
+	if err := sx.Set([]byte("a"), []byte("b")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly from a snapshot Set, got: %v", err)
+	}
+	if _, err := sx.Delete([]byte("000")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly from a snapshot Delete, got: %v", err)
+	}
+	if err := ss.Flush(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly from a snapshot Flush, got: %v", err)
+	}
+	ss.Close()
+
+	// Items that are only in the file, read after the file goes bad.
+	s, _ = NewStore(f)
+	x = s.GetCollection("x")
+	atomic.StoreInt32(&f.failReads, 1)
+	var ce *CorruptError
+	_, err := x.Get([]byte("050"))
+	if !errors.Is(err, ErrCorrupt) || !errors.As(err, &ce) ||
+		ce.Offset <= 0 || ce.Offset >= int64(len(f.b)) || ce.Err == nil {
+		t.Errorf("expected ErrCorrupt with an offset from Get, got: %v", err)
+	}
+	err = x.VisitItemsAscend(nil, true, func(i *Item) bool { return true })
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt from a visit, got: %v", err)
+	}
+	_, err = s.CopyTo(&memFile{}, 0)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt from CopyTo, got: %v", err)
+	}
+	atomic.StoreInt32(&f.failReads, 0)
+	if v, err := x.Get([]byte("050")); err != nil || string(v) != "v" {
+		t.Errorf("expected Get to work again, got: %v, %v", v, err)
+	}
+
+	// A file without a roots record.
+	_, err = NewStore(&memFile{b: bytes.Repeat([]byte("garbage"), 100)})
+	if !errors.Is(err, ErrCorrupt) || !errors.As(err, &ce) {
+		t.Errorf("expected ErrCorrupt from a garbage file, got: %v", err)
+	}
+
+	s.SetLimits(0, 10)
+	if err := x.Set([]byte("a"), bytes.Repeat([]byte("v"), 11)); !errors.Is(err, ErrValTooLarge) {
+		t.Errorf("expected ErrValTooLarge, got: %v", err)
+	}
+
+	y := s.SetCollection("y", nil)
+	s.RemoveCollection("y")
+	if _, err := y.Get([]byte("a")); !errors.Is(err, ErrCollectionMissing) {
+		t.Errorf("expected ErrCollectionMissing from a removed collection, got: %v", err)
+	}
+	if err := y.Set([]byte("a"), []byte("b")); !errors.Is(err, ErrCollectionMissing) {
+		t.Errorf("expected ErrCollectionMissing from a removed collection, got: %v", err)
+	}
+
+	s.Close()
+	if _, err := x.Get([]byte("050")); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("expected ErrStoreClosed from Get, got: %v", err)
+	}
+	if err := x.Set([]byte("a"), []byte("b")); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("expected ErrStoreClosed from Set, got: %v", err)
+	}
+	err = x.VisitItemsAscend(nil, true, func(i *Item) bool { return true })
+	if !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("expected ErrStoreClosed from a visit, got: %v", err)
+	}
+	if err := s.Flush(); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("expected ErrStoreClosed from Flush, got: %v", err)
+	}
+}
+
+// The metadata of a key, or nil, for tests of open stores.
+func getMeta(c *Collection, key string) []byte {
+	v, _ := c.GetMeta(key)
+	return v
+}
+
+func listMeta(c *Collection) []string {
+	keys, _ := c.ListMeta()
+	return keys
+}
+
+func TestCollectionMeta(t *testing.T) {
+	f := &memFile{}
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("a"), []byte("A"))
+	if err := x.SetMeta("", []byte("v")); err == nil {
+		t.Errorf("expected a missing key to fail")
+	}
+	if err := x.SetMeta("schema", []byte("1")); err != nil {
+		t.Errorf("expected SetMeta to work, got: %v", err)
+	}
+	x.SetMeta("created", []byte("2026-10-14"))
+	if string(getMeta(x, "schema")) != "1" || getMeta(x, "nope") != nil {
+		t.Errorf("expected GetMeta to see the metadata")
+	}
+	if names := listMeta(x); strings.Join(names, ",") != "created,schema" {
+		t.Errorf("expected sorted metadata keys, got: %v", names)
+	}
+	n := 0
+	x.VisitItemsAscend(nil, true, func(i *Item) bool { n++; return true })
+	if n != 1 {
+		t.Errorf("expected the metadata to not be items, got: %v", n)
+	}
+	err := x.SetMeta("big", make([]byte, MaxMetaBytes))
+	var le *LimitError
+	if !errors.Is(err, ErrMetaTooLarge) || !errors.As(err, &le) ||
+		le.Limit != MaxMetaBytes {
+		t.Errorf("expected ErrMetaTooLarge, got: %v", err)
+	}
+	if getMeta(x, "big") != nil {
+		t.Errorf("expected a rejected SetMeta to change nothing")
+	}
+	s.Flush()
+	x.SetMeta("schema", []byte("2")) // Not flushed.
+	x.SetMeta("created", nil)
+
+	if x2 := s.SetCollection("x", nil); string(getMeta(x2, "schema")) != "2" {
+		t.Errorf("expected the metadata to carry over")
+	}
+	ss := s.Snapshot()
+	if string(getMeta(ss.GetCollection("x"), "schema")) != "2" {
+		t.Errorf("expected the snapshot to see the metadata")
+	}
+	if err := ss.GetCollection("x").SetMeta("a", nil); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly, got: %v", err)
+	}
+	ss.Close()
+
+	s2, _ := NewStore(f)
+	x2 := s2.GetCollection("x")
+	if string(getMeta(x2, "schema")) != "1" ||
+		string(getMeta(x2, "created")) != "2026-10-14" {
+		t.Errorf("expected only flushed metadata after reopen, got: %v", listMeta(x2))
+	}
+
+	s.Flush()
+	s.FlushRevert()
+	x = s.GetCollection("x")
+	if string(getMeta(x, "schema")) != "1" || getMeta(x, "created") == nil {
+		t.Errorf("expected FlushRevert to revert the metadata")
+	}
+	x.SetMeta("schema", []byte("3"))
+	for _, copyFn := range []func(StoreFile) (*Store, error){
+		func(dst StoreFile) (*Store, error) { return s.CopyTo(dst, 10) },
+		func(dst StoreFile) (*Store, error) {
+			if err := s.BackupTo(dst); err != nil {
+				return nil, err
+			}
+			return NewStore(dst)
+		},
+	} {
+		dst := &memFile{}
+		d, err := copyFn(dst)
+		if err != nil {
+			t.Fatalf("expected copy to work, got: %v", err)
+		}
+		if string(getMeta(d.GetCollection("x"), "schema")) != "3" {
+			t.Errorf("expected the copy to have the metadata")
+		}
+		d, _ = NewStore(dst)
+		if string(getMeta(d.GetCollection("x"), "schema")) != "3" {
+			t.Errorf("expected the reopened copy to have the metadata")
+		}
+	}
+	s.RemoveCollection("x")
+	if err := x.SetMeta("a", []byte("b")); !errors.Is(err, ErrCollectionMissing) {
+		t.Errorf("expected ErrCollectionMissing, got: %v", err)
+	}
+}
+
+func TestInsert(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	if err := x.Insert([]byte("b"), []byte("B"), 10); err != nil {
+		t.Errorf("expected insert on empty to work, got: %v", err)
+	}
+	if err := x.Insert([]byte("a"), []byte("A"), 20); err != nil {
+		t.Errorf("expected insert of an absent key to work, got: %v", err)
+	}
+	mkNodes := x.AllocStats().MkNodes
+	err := x.Insert([]byte("b"), []byte("BB"), 30)
+	if !errors.Is(err, ErrKeyExists) {
+		t.Errorf("expected ErrKeyExists, got: %v", err)
+	}
+	if x.AllocStats().MkNodes != mkNodes {
+		t.Errorf("expected a duplicate insert to not mutate the tree")
+	}
+	if v, _ := x.Get([]byte("b")); string(v) != "B" {
+		t.Errorf("expected the original value, got: %s", v)
+	}
+	if err := x.Insert(nil, []byte("v"), 0); err != ErrNilKey {
+		t.Errorf("expected ErrNilKey, got: %v", err)
+	}
+	if num, _, _ := x.GetTotals(); num != 2 {
+		t.Errorf("expected 2 items, got: %v", num)
+	}
+
+	var wins, dups int32
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				err := x.Insert([]byte(fmt.Sprintf("k%03d", i)),
+					[]byte(strconv.Itoa(g)), rand.Int31())
+				if err == nil {
+					atomic.AddInt32(&wins, 1)
+				} else if errors.Is(err, ErrKeyExists) {
+					atomic.AddInt32(&dups, 1)
+				} else {
+					t.Errorf("expected no other errors, got: %v", err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if wins != 100 || dups != 700 {
+		t.Errorf("expected exactly one insert per key to win, got: %v, %v",
+			wins, dups)
+	}
+	if num, _, _ := x.GetTotals(); num != 102 {
+		t.Errorf("expected 102 items, got: %v", num)
+	}
+}
+
+func TestStringKeys(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	key := strings.Repeat("k", 10)
+	if err := x.SetString(key, []byte("v")); err != nil {
+		t.Errorf("expected SetString to work, got: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		x.SetString(fmt.Sprintf("%d", i), []byte("v"))
+	}
+	if v, err := x.GetString(key); err != nil || string(v) != "v" {
+		t.Errorf("expected GetString to work, got: %s, %v", v, err)
+	}
+	if v, err := x.GetString("nope"); err != nil || v != nil {
+		t.Errorf("expected a missing key, got: %s, %v", v, err)
+	}
+	allocs := testing.AllocsPerRun(100, func() { x.GetString(key) })
+	if allocs != 0 {
+		t.Errorf("expected no allocations for a hit, got: %v", allocs)
+	}
+	var keys []string
+	x.VisitItemsAscendString("5", false, func(i *Item) bool {
+		keys = append(keys, string(i.Key))
+		return true
+	})
+	if strings.Join(keys, ",") != "5,6,7,8,9,"+key {
+		t.Errorf("unexpected ascend, got: %v", keys)
+	}
+	keys = nil
+	x.VisitItemsDescendString("2", false, func(i *Item) bool {
+		keys = append(keys, string(i.Key))
+		return true
+	})
+	if strings.Join(keys, ",") != "1,0" {
+		t.Errorf("unexpected descend, got: %v", keys)
+	}
+	if deleted, err := x.DeleteString(key); err != nil || !deleted {
+		t.Errorf("expected DeleteString to work, got: %v, %v", deleted, err)
+	}
+	if v, _ := x.GetString(key); v != nil {
+		t.Errorf("expected the key to be deleted")
+	}
+}
+
+func BenchmarkGetString(b *testing.B) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 1000; i++ {
+		x.SetString(strconv.Itoa(i), []byte("v"))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.GetString("500")
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	mf := &memFile{}
+	f := &mockfile{readat: mf.ReadAt, writeat: mf.WriteAt, stat: mf.Stat}
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprintf("v%03d", i)))
+	}
+	s.Flush()
+	s, _ = NewStore(f)
+	x = s.GetCollection("x")
+	if err := x.Prefetch([]byte("020"), []byte("040")); err != nil {
+		t.Errorf("expected Prefetch to work, got: %v", err)
+	}
+	numReadAt := f.numReadAt
+	n := 0
+	err := x.VisitItemsAscend([]byte("020"), true, func(i *Item) bool {
+		if string(i.Key) >= "040" {
+			return false
+		}
+		if string(i.Val) != "v"+string(i.Key) {
+			t.Errorf("unexpected val: %s", i.Val)
+		}
+		n++
+		return true
+	})
+	if err != nil || n != 20 {
+		t.Errorf("expected a visit of 20 items, got: %v, %v", n, err)
+	}
+	if f.numReadAt != numReadAt {
+		t.Errorf("expected no reads after Prefetch, got: %v",
+			f.numReadAt-numReadAt)
+	}
+	if v, _ := x.Get([]byte("030")); string(v) != "v030" || f.numReadAt != numReadAt {
+		t.Errorf("expected a Get of the range without reads")
+	}
+	if x.Get([]byte("050")); f.numReadAt == numReadAt {
+		t.Errorf("expected a Get outside the range to read")
+	}
+	if err := x.Prefetch(nil, nil); err != nil {
+		t.Errorf("expected Prefetch of everything to work, got: %v", err)
+	}
+	numReadAt = f.numReadAt
+	n = 0
+	x.VisitItemsAscend(nil, true, func(i *Item) bool { n++; return true })
+	if n != 100 || f.numReadAt != numReadAt {
+		t.Errorf("expected no reads after a full Prefetch")
+	}
+}
+
+func TestExists(t *testing.T) {
+	f := &memFile{}
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	if ok, err := x.Exists([]byte("a")); err != nil || ok {
+		t.Errorf("expected no key in an empty collection, got: %v, %v", ok, err)
+	}
+	for i := 10; i < 90; i += 2 {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), []byte("v"))
+	}
+	check := func(x *Collection) {
+		for i := 0; i < 100; i++ {
+			ok, err := x.Exists([]byte(fmt.Sprintf("%03d", i)))
+			if err != nil || ok != (i >= 10 && i < 90 && i%2 == 0) {
+				t.Errorf("unexpected Exists for %v, got: %v, %v", i, ok, err)
+			}
+		}
+		for _, k := range []string{"", "0", "0100", "088a", "\xff"} {
+			if ok, _ := x.Exists([]byte(k)); ok {
+				t.Errorf("expected no key %q", k)
+			}
+		}
+	}
+	check(x)
+	s.Flush()
+	s, _ = NewStore(f)
+	x = s.GetCollection("x")
+	check(x)
+	valReads := 0
+	s, _ = NewStoreEx(f, StoreCallbacks{
+		ItemValRead: func(c *Collection, i *Item,
+			r io.ReaderAt, offset int64, valLength uint32) error {
+			valReads++
+			i.Val = make([]byte, valLength)
+			_, err := r.ReadAt(i.Val, offset)
+			return err
+		},
+	})
+	check(s.GetCollection("x"))
+	if valReads != 0 {
+		t.Errorf("expected Exists to not read values, got: %v", valReads)
+	}
+}
+
+func BenchmarkExists(b *testing.B) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 1000; i++ {
+		x.Set([]byte(strconv.Itoa(i)), []byte("v"))
+	}
+	key := []byte("500")
+	b.Run("Exists", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			x.Exists(key)
+		}
+	})
+	b.Run("GetItem", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			x.GetItem(key, false)
+		}
+	})
+}
+
+func TestTypedCollection(t *testing.T) {
+	type user struct {
+		Name string
+		Age  int
+	}
+	f := &memFile{}
+	s, _ := NewStore(f)
+	users := NewTypedCollection[uint64, user](s.SetCollection("users", nil),
+		Uint64Codec{}, JSONCodec[user]{})
+	for i := uint64(0); i < 300; i += 3 {
+		if err := users.Set(i, user{Name: fmt.Sprintf("u%v", i), Age: int(i)}); err != nil {
+			t.Errorf("expected Set to work, got: %v", err)
+		}
+	}
+	users.Delete(3)
+	s.Flush()
+	s, _ = NewStore(f)
+	users = NewTypedCollection[uint64, user](s.GetCollection("users"),
+		Uint64Codec{}, JSONCodec[user]{})
+	if u, ok, err := users.Get(6); err != nil || !ok || u.Name != "u6" || u.Age != 6 {
+		t.Errorf("expected Get after reopen to work, got: %v, %v, %v", u, ok, err)
+	}
+	if _, ok, err := users.Get(3); err != nil || ok {
+		t.Errorf("expected a deleted key to be missing, got: %v, %v", ok, err)
+	}
+	var keys []uint64
+	err := users.AscendRange(1, 256, func(k uint64, u user) bool {
+		if u.Age != int(k) {
+			t.Errorf("unexpected value of %v: %v", k, u)
+		}
+		keys = append(keys, k)
+		return true
+	})
+	// Without the big-endian keys, 256 would sort before 6.
+	if err != nil || len(keys) != 84 || keys[0] != 6 || keys[83] != 255 {
+		t.Errorf("unexpected AscendRange, got: %v, %v", keys, err)
+	}
+
+	names := NewTypedCollection[string, string](s.SetCollection("names", nil),
+		StringCodec{}, StringCodec{})
+	names.Set("b", "B")
+	names.Collection().Set([]byte("c"), []byte("C"))
+	if v, ok, _ := names.Get("c"); !ok || v != "C" {
+		t.Errorf("expected the typed view of the collection, got: %v", v)
+	}
+	bad := NewTypedCollection[string, user](names.Collection(),
+		StringCodec{}, JSONCodec[user]{})
+	if _, _, err := bad.Get("b"); err == nil {
+		t.Errorf("expected a decode error")
+	}
+	if err := bad.AscendRange("a", "z", func(string, user) bool { return true }); err == nil {
+		t.Errorf("expected a decode error from AscendRange")
+	}
+
+	x := s.SetCollection("x", nil)
+	err = CheckKeyCodec[uint64](x, Uint64Codec{},
+		func(a, b uint64) bool { return a < b }, 0, 1, 255, 256, 1<<40)
+	if err != nil {
+		t.Errorf("expected Uint64Codec to preserve order, got: %v", err)
+	}
+	err = CheckKeyCodec[string](x, StringCodec{},
+		func(a, b string) bool { return a < b }, "", "a", "ab", "b")
+	if err != nil {
+		t.Errorf("expected StringCodec to preserve order, got: %v", err)
+	}
+	err = CheckKeyCodec[int](x, JSONCodec[int]{},
+		func(a, b int) bool { return a < b }, 9, 10)
+	if err == nil {
+		t.Errorf("expected JSONCodec to not preserve order")
+	}
+}
+
+// The reference order of tuples, part by part, as documented by Tuple.
+func compareTuples(a, b Tuple) int {
+	rank := func(p interface{}) int {
+		switch p.(type) {
+		case []byte:
+			return 0
+		case string:
+			return 1
+		case int64:
+			return 2
+		}
+		return 3
+	}
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if ra, rb := rank(a[i]), rank(b[i]); ra != rb {
+			return ra - rb
+		}
+		c := 0
+		switch va := a[i].(type) {
+		case []byte:
+			c = bytes.Compare(va, b[i].([]byte))
+		case string:
+			c = strings.Compare(va, b[i].(string))
+		case int64:
+			if vb := b[i].(int64); va < vb {
+				c = -1
+			} else if va > vb {
+				c = 1
+			}
+		case uint64:
+			if vb := b[i].(uint64); va < vb {
+				c = -1
+			} else if va > vb {
+				c = 1
+			}
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+func randTuple(r *rand.Rand) Tuple {
+	// Few distinct values, with 0x00 and 0xff, for many ties and prefixes.
+	alphabet := []byte{0x00, 0x01, 'a', 0xfe, 0xff}
+	randBytes := func() []byte {
+		b := make([]byte, r.Intn(4))
+		for i := range b {
+			b[i] = alphabet[r.Intn(len(alphabet))]
+		}
+		return b
+	}
+	ints := []int64{math.MinInt64, -256, -1, 0, 1, 255, 256, math.MaxInt64}
+	t := Tuple{}
+	for n := r.Intn(4); n > 0; n-- {
+		switch r.Intn(4) {
+		case 0:
+			t = append(t, randBytes())
+		case 1:
+			t = append(t, string(randBytes()))
+		case 2:
+			t = append(t, ints[r.Intn(len(ints))])
+		case 3:
+			t = append(t, uint64(ints[r.Intn(len(ints))]))
+		}
+	}
+	return t
+}
+
+func TestKeyEncOrder(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	sign := func(c int) int {
+		if c < 0 {
+			return -1
+		} else if c > 0 {
+			return 1
+		}
+		return 0
+	}
+	for i := 0; i < 20000; i++ {
+		a, b := randTuple(r), randTuple(r)
+		ea, err := a.Encode()
+		if err != nil {
+			t.Fatalf("expected Encode to work, got: %v", err)
+		}
+		eb, _ := b.Encode()
+		if sign(bytes.Compare(ea, eb)) != sign(compareTuples(a, b)) {
+			t.Fatalf("expected encoded order to be tuple order, %#v vs %#v", a, b)
+		}
+		d, err := DecodeTuple(ea)
+		if err != nil || compareTuples(a, d) != 0 || len(d) != len(a) {
+			t.Fatalf("expected %#v to round-trip, got: %#v, %v", a, d, err)
+		}
+	}
+	for _, c := range [][2]string{{"a", "a\x00b"}, {"a", "ab"}, {"", "\x00"},
+		{"a\x00", "a\x01"}, {"a\x00\xff", "a\x01"}} {
+		ea := AppendString(nil, c[0])
+		eb := AppendString(nil, c[1])
+		if bytes.Compare(ea, eb) >= 0 {
+			t.Errorf("expected %q < %q encoded", c[0], c[1])
+		}
+		s, rest, err := DecodeString(append(eb, 'x'))
+		if err != nil || s != c[1] || string(rest) != "x" {
+			t.Errorf("expected %q to decode, got: %q, %q, %v", c[1], s, rest, err)
+		}
+	}
+	ints := []int64{math.MinInt64, -1, 0, 1, math.MaxInt64}
+	for i := 1; i < len(ints); i++ {
+		if bytes.Compare(AppendInt64(nil, ints[i-1]), AppendInt64(nil, ints[i])) >= 0 {
+			t.Errorf("expected %v < %v encoded", ints[i-1], ints[i])
+		}
+		if v, _, _ := DecodeInt64(AppendInt64(nil, ints[i])); v != ints[i] {
+			t.Errorf("expected %v to decode, got: %v", ints[i], v)
+		}
+	}
+	if _, _, err := DecodeUint64([]byte{1, 2}); err == nil {
+		t.Errorf("expected a truncated uint64 to fail")
+	}
+	if _, _, err := DecodeBytes([]byte("abc")); err == nil {
+		t.Errorf("expected unterminated bytes to fail")
+	}
+	if _, err := DecodeTuple([]byte{0x09}); err == nil {
+		t.Errorf("expected an unknown tag to fail")
+	}
+	if _, err := (Tuple{1.5}).Encode(); err == nil {
+		t.Errorf("expected an unsupported part to fail")
+	}
+	if d, _ := DecodeTuple(mustEncode(Tuple{int(-5), uint(5)})); d[0] != int64(-5) || d[1] != uint64(5) {
+		t.Errorf("expected int and uint to decode as int64 and uint64, got: %#v", d)
+	}
+}
+
+func mustEncode(t Tuple) []byte {
+	b, err := t.Encode()
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestVisitTuplePrefix(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	for _, tenant := range []string{"a", "a\x00", "ab", "b"} {
+		for ts := int64(-2); ts <= 2; ts++ {
+			x.Set(mustEncode(Tuple{tenant, ts, uint64(7)}), []byte(tenant))
+		}
+	}
+	x.Set(mustEncode(Tuple{"a"}), []byte("a"))
+	var got []Tuple
+	visitor := func(i *Item) bool {
+		d, err := DecodeTuple(i.Key)
+		if err != nil {
+			t.Errorf("expected keys to decode, got: %v", err)
+		}
+		got = append(got, d)
+		return true
+	}
+	if err := x.VisitTuplePrefix(false, visitor, "a"); err != nil {
+		t.Errorf("expected VisitTuplePrefix to work, got: %v", err)
+	}
+	if len(got) != 6 || len(got[0]) != 1 || got[1][1] != int64(-2) ||
+		got[5][1] != int64(2) {
+		t.Errorf("expected the tuples of tenant a, got: %v", got)
+	}
+	for _, d := range got {
+		if d[0] != "a" {
+			t.Errorf("expected only tenant a, got: %#v", d)
+		}
+	}
+	got = nil
+	x.VisitTuplePrefix(false, visitor, "ab", 0)
+	if len(got) != 1 || got[0][0] != "ab" || got[0][1] != int64(0) {
+		t.Errorf("expected one tuple, got: %v", got)
+	}
+	got = nil
+	x.VisitTuplePrefix(false, visitor)
+	if len(got) != 21 {
+		t.Errorf("expected all the tuples, got: %v", len(got))
+	}
+	if err := x.VisitTuplePrefix(false, visitor, 1.5); err == nil {
+		t.Errorf("expected an unsupported part to fail")
+	}
+}
+
+func TestCount(t *testing.T) {
+	f := &memFile{}
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	s.SetCollection("y", nil)
+	if n, err := x.Count(); err != nil || n != 0 {
+		t.Errorf("expected 0 for an empty collection, got: %v, %v", n, err)
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		k := []byte(strconv.Itoa(r.Intn(300)))
+		if r.Intn(3) == 0 {
+			x.Delete(k)
+		} else {
+			x.Set(k, []byte("v"))
+		}
+		if i%100 == 0 {
+			s.Flush()
+		}
+	}
+	scanned := uint64(0)
+	x.VisitItemsAscend(nil, false, func(i *Item) bool { scanned++; return true })
+	if n, err := x.Count(); err != nil || n != scanned || n == 0 {
+		t.Errorf("expected the count of a scan, %v, got: %v, %v", scanned, n, err)
+	}
+	ss := s.Snapshot()
+	x.Set([]byte("new"), []byte("v"))
+	if n, _ := ss.GetCollection("x").Count(); n != scanned {
+		t.Errorf("expected the count of the snapshot, got: %v", n)
+	}
+	counts, err := s.CountAll()
+	if err != nil || len(counts) != 2 || counts["x"] != scanned+1 || counts["y"] != 0 {
+		t.Errorf("unexpected CountAll, got: %v, %v", counts, err)
+	}
+	s.Flush()
+	s2, _ := NewStore(f)
+	if n, _ := s2.GetCollection("x").Count(); n != scanned+1 {
+		t.Errorf("expected the count after reopen, got: %v", n)
+	}
+	s.Close()
+	if _, err := s.CountAll(); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("expected ErrStoreClosed, got: %v", err)
+	}
+}
+
+func TestSecondaryIndex(t *testing.T) {
+	// Values are comma separated tags, each an index key.
+	byTag := func(i *Item) ([][]byte, error) {
+		if bytes.HasPrefix(i.Val, []byte("!")) {
+			return nil, errors.New("bad value")
+		}
+		var res [][]byte
+		for _, tag := range bytes.Split(i.Val, []byte(",")) {
+			if len(tag) > 0 {
+				res = append(res, tag)
+			}
+		}
+		return res, nil
+	}
+	visitTag := func(x *Collection, tag string) (keys []string) {
+		err := x.VisitIndex("byTag", []byte(tag), func(k []byte, i *Item) bool {
+			if string(k) != tag {
+				return false
+			}
+			keys = append(keys, string(i.Key))
+			return true
+		})
+		if err != nil {
+			t.Errorf("expected VisitIndex to work, got: %v", err)
+		}
+		return keys
+	}
+	f := &memFile{}
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("pre"), []byte("red"))
+	countsBefore, _ := s.CountAll()
+	if err := s.AddIndex(x, "byTag", byTag); err != nil {
+		t.Errorf("expected AddIndex to work, got: %v", err)
+	}
+	if counts, _ := s.CountAll(); len(counts) != len(countsBefore) ||
+		counts["x"] != countsBefore["x"] {
+		t.Errorf("expected CountAll unchanged by AddIndex, got: %v, before: %v",
+			counts, countsBefore)
+	}
+	if err := s.AddIndex(x, "byTag", byTag); err == nil {
+		t.Errorf("expected a repeated index name to fail")
+	}
+	if err := x.StartWriter(1); err == nil {
+		t.Errorf("expected StartWriter of an indexed collection to fail")
+	}
+	if names := s.GetCollectionNames(); len(names) != 1 || names[0] != "x" {
+		t.Errorf("expected the index collection to be hidden, got: %q", names)
+	}
+	if keys := visitTag(x, "red"); len(keys) != 0 {
+		t.Errorf("expected no entries before RebuildIndex, got: %v", keys)
+	}
+	if err := s.RebuildIndex("byTag"); err != nil {
+		t.Errorf("expected RebuildIndex to work, got: %v", err)
+	}
+	if keys := visitTag(x, "red"); strings.Join(keys, ",") != "pre" {
+		t.Errorf("expected the existing item to be indexed, got: %v", keys)
+	}
+	x.Set([]byte("a"), []byte("red,blue"))
+	x.Set([]byte("b"), []byte("blue"))
+	x.Insert([]byte("c"), []byte("green,red"), 1)
+	if keys := visitTag(x, "red"); strings.Join(keys, ",") != "a,c,pre" {
+		t.Errorf("expected red items, got: %v", keys)
+	}
+	if keys := visitTag(x, "blue"); strings.Join(keys, ",") != "a,b" {
+		t.Errorf("expected blue items, got: %v", keys)
+	}
+	x.Set([]byte("a"), []byte("green")) // The indexed field changes.
+	if keys := visitTag(x, "red"); strings.Join(keys, ",") != "c,pre" {
+		t.Errorf("expected a to leave red, got: %v", keys)
+	}
+	if keys := visitTag(x, "green"); strings.Join(keys, ",") != "a,c" {
+		t.Errorf("expected a to join green, got: %v", keys)
+	}
+	ic := s.GetCollection("x\x00index\x00byTag")
+	if n, _ := ic.Count(); n != 5 {
+		t.Errorf("expected 5 index entries, got: %v", n)
+	}
+	if err := x.Set([]byte("b"), []byte("!")); err == nil {
+		t.Errorf("expected a failing key func to fail the set")
+	}
+	if v, _ := x.Get([]byte("b")); string(v) != "blue" {
+		t.Errorf("expected a failed set to change nothing, got: %s", v)
+	}
+	x.Delete([]byte("pre"))
+	x.DeleteMulti([][]byte{[]byte("c"), []byte("nope")})
+	if keys := visitTag(x, "red"); len(keys) != 0 {
+		t.Errorf("expected the deletes to leave red, got: %v", keys)
+	}
+	if n, _ := ic.Count(); n != 2 {
+		t.Errorf("expected 2 index entries, got: %v", n)
+	}
+	var all []string
+	x.VisitIndex("byTag", nil, func(k []byte, i *Item) bool {
+		all = append(all, string(k)+":"+string(i.Key))
+		return true
+	})
+	if strings.Join(all, ",") != "blue:b,green:a" {
+		t.Errorf("expected the items in index key order, got: %v", all)
+	}
+	if err := x.VisitIndex("nope", nil, func(k []byte, i *Item) bool { return true }); err == nil {
+		t.Errorf("expected an unknown index to fail")
+	}
+
+	s.Flush()
+	s2, _ := NewStore(f)
+	x2 := s2.GetCollection("x")
+	if err := s2.AddIndex(x2, "byTag", byTag); err != nil {
+		t.Errorf("expected AddIndex after reopen to work, got: %v", err)
+	}
+	if keys := visitTag(x2, "blue"); strings.Join(keys, ",") != "b" {
+		t.Errorf("expected the persisted index, got: %v", keys)
+	}
+	// A drifted index, such as after a RemoveCollection() of the primary.
+	s2.RemoveCollection("x")
+	x2 = s2.SetCollection("x", nil)
+	x2.Set([]byte("d"), []byte("blue"))
+	if keys := visitTag(x2, "blue"); strings.Join(keys, ",") != "d" {
+		t.Errorf("expected stale entries to be skipped, got: %v", keys)
+	}
+	s2.RebuildIndex("byTag")
+	if n, _ := s2.GetCollection("x\x00index\x00byTag").Count(); n != 1 {
+		t.Errorf("expected RebuildIndex to drop stale entries, got: %v", n)
+	}
+	if err := s2.RemoveIndex("byTag"); err != nil {
+		t.Errorf("expected RemoveIndex to work, got: %v", err)
+	}
+	if s2.GetCollection("x\x00index\x00byTag") != nil {
+		t.Errorf("expected RemoveIndex to remove the index collection")
+	}
+	if err := x2.StartWriter(1); err != nil {
+		t.Errorf("expected StartWriter without indexes to work, got: %v", err)
+	}
+	x2.StopWriter()
+}
+
+func TestSecondaryIndexConcurrent(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	s.AddIndex(x, "byVal", func(i *Item) ([][]byte, error) {
+		return [][]byte{i.Val}, nil
+	})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				k := []byte(strconv.Itoa(i % 20))
+				if i%7 == 0 {
+					x.Delete(k)
+				} else {
+					x.Set(k, []byte(strconv.Itoa(g)))
+				}
+			}
+		}(g)
+	}
+	for i := 0; i < 20; i++ {
+		x.VisitIndex("byVal", nil, func(k []byte, i *Item) bool {
+			if !bytes.Equal(k, i.Val) {
+				t.Errorf("expected only entries of current values")
+			}
+			return true
+		})
+	}
+	wg.Wait()
+	numItems, _ := x.Count()
+	n, _ := s.GetCollection("x\x00index\x00byVal").Count()
+	if n != numItems {
+		t.Errorf("expected an entry per item, got: %v vs %v", n, numItems)
+	}
+}
+
+func TestCollectionMetaBlob(t *testing.T) {
+	f := &memFile{}
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	if b, err := x.GetMetaBlob(); err != nil || b != nil {
+		t.Errorf("expected no blob by default, got: %q, %v", b, err)
+	}
+	blob := []byte(`{"schema":2,"created":"2026-10-14"}`)
+	if err := x.SetMetaBlob(blob); err != nil {
+		t.Errorf("expected SetMetaBlob to work, got: %v", err)
+	}
+	x.SetMeta("k", []byte("v"))
+	if names := listMeta(x); len(names) != 1 || names[0] != "k" {
+		t.Errorf("expected the blob to not be a property, got: %v", names)
+	}
+	err := x.SetMetaBlob(make([]byte, MaxMetaBytes))
+	if !errors.Is(err, ErrMetaTooLarge) {
+		t.Errorf("expected ErrMetaTooLarge, got: %v", err)
+	}
+	s.SetCollection("empty", nil)
+	s.Flush()
+	s, _ = NewStore(f)
+	if b, err := s.GetCollection("x").GetMetaBlob(); err != nil || !bytes.Equal(b, blob) {
+		t.Errorf("expected the blob after reopen, got: %q, %v", b, err)
+	}
+	if b, _ := s.GetCollection("empty").GetMetaBlob(); b != nil {
+		t.Errorf("expected no blob after reopen, got: %q", b)
+	}
+	x = s.GetCollection("x")
+	x.SetMetaBlob(nil)
+	if b, _ := x.GetMetaBlob(); b != nil || string(getMeta(x, "k")) != "v" {
+		t.Errorf("expected SetMetaBlob(nil) to only remove the blob")
+	}
+	s.Close()
+	if _, err := x.GetMetaBlob(); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("expected ErrStoreClosed, got: %v", err)
+	}
+	if _, err := x.GetMeta("k"); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("expected ErrStoreClosed from GetMeta, got: %v", err)
+	}
+	if _, err := x.ListMeta(); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("expected ErrStoreClosed from ListMeta, got: %v", err)
+	}
+}
+
+func TestSetCollectionReplaceUnflushed(t *testing.T) {
+	for j := 0; j < 50; j++ {
+		f := &memFile{}
+		s, _ := NewStore(f)
+		x := s.SetCollection("x", nil)
+		for i := 0; i < 100; i++ {
+			x.Set([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprintf("v%d", i)))
+		}
+		s.Flush()
+		x.Set([]byte("unflushed"), []byte("u"))
+		x = s.SetCollection("x", nil)
+		x.Set([]byte("after"), []byte("r"))
+		if err := s.Flush(); err != nil {
+			t.Fatalf("expected Flush after replacing to work, got: %v", err)
+		}
+		if v, _ := x.Get([]byte("unflushed")); string(v) != "u" {
+			t.Fatalf("expected the unflushed item to survive, got: %q", v)
+		}
+	}
+}
+
+func TestRenameCollection(t *testing.T) {
+	f := &memFile{}
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprintf("v%d", i)))
+	}
+	x.SetMeta("schema", []byte("1"))
+	s.SetCollection("y", nil).Set([]byte("a"), []byte("A"))
+	s.Flush()
+	x.Set([]byte("unflushed"), []byte("u"))
+
+	if err := s.RenameCollection("nope", "z"); !errors.Is(err, ErrCollectionMissing) {
+		t.Errorf("expected ErrCollectionMissing, got: %v", err)
+	}
+	if err := s.RenameCollection("x", "y"); !errors.Is(err, ErrCollectionExists) {
+		t.Errorf("expected a name collision to fail with ErrCollectionExists, got: %v", err)
+	}
+	if err := s.RenameCollection("x", ""); err == nil {
+		t.Errorf("expected a missing name to fail")
+	}
+	if v, _ := s.GetCollection("y").Get([]byte("a")); string(v) != "A" {
+		t.Errorf("expected a failed rename to change nothing, got: %q", v)
+	}
+	if err := s.RenameCollection("x", "z"); err != nil {
+		t.Errorf("expected RenameCollection to work, got: %v", err)
+	}
+	if names := s.GetCollectionNames(); strings.Join(names, ",") != "y,z" {
+		t.Errorf("expected the new name, got: %v", names)
+	}
+	if _, err := x.Get([]byte("001")); !errors.Is(err, ErrCollectionMissing) {
+		t.Errorf("expected the old Collection to be closed, got: %v", err)
+	}
+	z := s.GetCollection("z")
+	if v, _ := z.Get([]byte("unflushed")); string(v) != "u" {
+		t.Errorf("expected the unflushed item under the new name, got: %q", v)
+	}
+	if string(getMeta(z, "schema")) != "1" {
+		t.Errorf("expected the metadata to carry over")
+	}
+	if err := z.Set([]byte("after"), []byte("r")); err != nil {
+		t.Errorf("expected the renamed collection to be writable, got: %v", err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+
+	s2, err := NewStore(f)
+	if err != nil {
+		t.Fatalf("expected reopen to work, got: %v", err)
+	}
+	if names := s2.GetCollectionNames(); strings.Join(names, ",") != "y,z" {
+		t.Errorf("expected the rename to be persisted, got: %v", names)
+	}
+	z2 := s2.GetCollection("z")
+	n := 0
+	z2.VisitItemsAscend([]byte("000"), true, func(i *Item) bool {
+		n++
+		return true
+	})
+	if n != 102 {
+		t.Errorf("expected 102 items after reopen, got: %v", n)
+	}
+	if v, _ := z2.Get([]byte("042")); string(v) != "v42" {
+		t.Errorf("expected the items after reopen, got: %q", v)
+	}
+	if string(getMeta(z2, "schema")) != "1" {
+		t.Errorf("expected the metadata after reopen")
+	}
+
+	// The swap pattern: build into a temp name, then rename over.
+	tmp := s2.SetCollection("z.tmp", nil)
+	tmp.Set([]byte("new"), []byte("N"))
+	s2.RemoveCollection("z")
+	if err = s2.RenameCollection("z.tmp", "z"); err != nil {
+		t.Errorf("expected rename over a removed name to work, got: %v", err)
+	}
+	if v, _ := s2.GetCollection("z").Get([]byte("new")); string(v) != "N" {
+		t.Errorf("expected the swapped collection, got: %q", v)
+	}
+
+	if err = s2.Snapshot().RenameCollection("y", "w"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly, got: %v", err)
+	}
+	s2.Close()
+	if err = s2.RenameCollection("y", "w"); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("expected ErrStoreClosed, got: %v", err)
+	}
+}
+
+func TestSwapCollections(t *testing.T) {
+	f := &memFile{}
+	s, _ := NewStore(f)
+	load := func(name, gen string) {
+		c := s.SetCollection(name, nil)
+		for i := 0; i < 200; i++ {
+			c.Set([]byte(fmt.Sprintf("%03d", i)), []byte(gen))
+		}
+		c.SetMeta("gen", []byte(gen))
+	}
+	load("live", "blue")
+	load("next", "green")
+	s.Flush()
+
+	if err := s.SwapCollections("live", "nope"); !errors.Is(err, ErrCollectionMissing) {
+		t.Errorf("expected ErrCollectionMissing, got: %v", err)
+	}
+
+	// The readers see every item of one generation or the other.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	var errReader atomic.Value
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				live := s.GetCollection("live")
+				gens := map[string]int{}
+				err := live.VisitItemsAscend([]byte("0"), true, func(i *Item) bool {
+					gens[string(i.Val)]++
+					return true
+				})
+				if errors.Is(err, ErrCollectionMissing) {
+					continue // Swapped before the visit began.
+				}
+				if err != nil || len(gens) != 1 || (gens["blue"] != 200 && gens["green"] != 200) {
+					errReader.Store(fmt.Sprintf("%v, %v", gens, err))
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		if err := s.SwapCollections("live", "next"); err != nil {
+			t.Errorf("expected SwapCollections to work, got: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if e := errReader.Load(); e != nil {
+		t.Errorf("expected readers to see one generation, got: %v", e)
+	}
+
+	old := s.GetCollection("live")
+	if err := s.SwapCollections("live", "next"); err != nil {
+		t.Errorf("expected SwapCollections to work, got: %v", err)
+	}
+	if _, err := old.Get([]byte("001")); !errors.Is(err, ErrCollectionMissing) {
+		t.Errorf("expected the old Collection to be closed, got: %v", err)
+	}
+	check := func(s *Store, name, gen string) {
+		c := s.GetCollection(name)
+		if v, _ := c.Get([]byte("123")); string(v) != gen {
+			t.Errorf("expected %s to have %s items, got: %q", name, gen, v)
+		}
+		if string(getMeta(c, "gen")) != gen {
+			t.Errorf("expected %s to have %s metadata, got: %q", name, gen, getMeta(c, "gen"))
+		}
+	}
+	check(s, "live", "green")
+	check(s, "next", "blue")
+	s.GetCollection("live").Set([]byte("new"), []byte("green"))
+	if err := s.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+
+	s2, err := NewStore(f)
+	if err != nil {
+		t.Fatalf("expected reopen to work, got: %v", err)
+	}
+	check(s2, "live", "green")
+	check(s2, "next", "blue")
+	if v, _ := s2.GetCollection("live").Get([]byte("new")); string(v) != "green" {
+		t.Errorf("expected the mutation after the swap, got: %q", v)
+	}
+	if err = s2.Snapshot().SwapCollections("live", "next"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly, got: %v", err)
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	f := &memFile{}
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	data := "id,name,note\n" +
+		"1,alice,\"likes, commas\"\n" +
+		"2,bob,\"two\nlines\"\n" +
+		"3,\"say \"\"hi\"\"\",plain\n" +
+		"4,short\n" + // Too few columns.
+		"5,eve,\"bad \"quote\"\n" +
+		"6,zed,last\n"
+	n, err := s.ImportCSV(x, strings.NewReader(data), CSVImportOptions{
+		Header: true, KeyColumnName: "name", ValColumnName: "note"})
+	var ie *CSVImportError
+	if n != 4 || !errors.As(err, &ie) {
+		t.Fatalf("expected 4 rows and a CSVImportError, got: %v, %v", n, err)
+	}
+	if ie.NumMalformed != 2 || len(ie.Rows) != 2 || ie.Rows[0].Line != 6 {
+		t.Errorf("expected 2 malformed rows from line 6, got: %v, %v", ie.NumMalformed, ie.Rows)
+	}
+	var pe *csv.ParseError
+	if !errors.As(ie.Rows[1], &pe) {
+		t.Errorf("expected a csv.ParseError, got: %v", ie.Rows[1])
+	}
+	for k, v := range map[string]string{"alice": "likes, commas", "bob": "two\nlines",
+		"say \"hi\"": "plain"} {
+		if got, _ := x.Get([]byte(k)); string(got) != v {
+			t.Errorf("expected %q for %q, got: %q", v, k, got)
+		}
+	}
+
+	n, err = s.ImportCSV(x, strings.NewReader(data), CSVImportOptions{
+		Header: true, KeyColumnName: "name", ValColumnName: "note", MaxErrors: 1})
+	if !errors.As(err, &ie) || ie.NumMalformed != 2 || len(ie.Rows) != 1 {
+		t.Errorf("expected 1 reported of 2 malformed rows, got: %v", err)
+	}
+	n, err = s.ImportCSV(x, strings.NewReader(data), CSVImportOptions{
+		Header: true, KeyColumn: 1, ValColumn: 2, StopOnError: true})
+	var re *CSVRowError
+	if n != 0 || !errors.As(err, &re) || re.Line != 6 {
+		t.Errorf("expected StopOnError at line 6, got: %v, %v", n, err)
+	}
+
+	// TSV, with numeric keys and a composed value, in tiny batches.
+	y := s.SetCollection("y", nil)
+	tsv := "10\ta\tb\n-5\tc\td\n200\te\tf\nnan\tg\th\n"
+	n, err = s.ImportCSV(y, strings.NewReader(tsv), CSVImportOptions{
+		Comma: '\t', NumericKey: true, BatchSize: 2, FlushBatches: true,
+		Value: func(row []string) ([]byte, error) {
+			return []byte(row[1] + "+" + row[2]), nil
+		}})
+	if n != 3 || !errors.As(err, &ie) || ie.NumMalformed != 1 {
+		t.Errorf("expected 3 rows and a bad key, got: %v, %v", n, err)
+	}
+	var order []string
+	y.VisitItemsAscend([]byte{0}, true, func(i *Item) bool {
+		k, _, _ := DecodeInt64(i.Key)
+		order = append(order, fmt.Sprintf("%v=%s", k, i.Val))
+		return true
+	})
+	if strings.Join(order, ",") != "-5=c+d,10=a+b,200=e+f" {
+		t.Errorf("expected numeric key order, got: %v", order)
+	}
+	s2, _ := NewStore(f)
+	if v, _ := s2.GetCollection("y").Get(AppendInt64(nil, 200)); string(v) != "e+f" {
+		t.Errorf("expected FlushBatches to persist the rows, got: %q", v)
+	}
+
+	if _, err = s.ImportCSV(y, strings.NewReader(tsv), CSVImportOptions{
+		KeyColumnName: "id"}); err == nil {
+		t.Errorf("expected column names without a header to fail")
+	}
+	if _, err = s.ImportCSV(y, strings.NewReader(data), CSVImportOptions{
+		Header: true, KeyColumnName: "nope", ValColumn: 1}); err == nil {
+		t.Errorf("expected a missing column to fail")
+	}
+	if _, err = s.ImportCSV(s2.GetCollection("y"), strings.NewReader(tsv),
+		CSVImportOptions{ValColumn: 1}); err == nil {
+		t.Errorf("expected a collection of another store to fail")
+	}
+}
+
+func BenchmarkImportCSV(b *testing.B) {
+	var buf bytes.Buffer
+	for i := 0; i < 1000000; i++ {
+		fmt.Fprintf(&buf, "%d,value-%d\n", i, i)
+	}
+	b.SetBytes(int64(buf.Len()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s, _ := NewStore(nil)
+		x := s.SetCollection("x", nil)
+		n, err := s.ImportCSV(x, bytes.NewReader(buf.Bytes()),
+			CSVImportOptions{NumericKey: true, ValColumn: 1, BatchSize: 10000})
+		if err != nil || n != 1000000 {
+			b.Fatalf("expected 1M rows, got: %v, %v", n, err)
+		}
+	}
+}
+
+func TestSnapshotCloseThenMutate(t *testing.T) {
+	for j := 0; j < 20; j++ {
+		s, _ := NewStore(nil)
+		x := s.SetCollection("x", nil)
+		for i := 0; i < 100; i++ {
+			x.Set([]byte(fmt.Sprintf("%03d", i)), []byte("v"))
+		}
+		s.Snapshot().Close()
+		for i := 0; i < 100; i += 3 {
+			x.Delete([]byte(fmt.Sprintf("%03d", i)))
+			x.Set([]byte(fmt.Sprintf("%03d", i+1)), []byte("w"))
+		}
+		n := 0
+		x.VisitItemsAscend([]byte("000"), true, func(i *Item) bool {
+			n++
+			return true
+		})
+		if n != 67 {
+			t.Fatalf("expected the items to survive the snapshot close, got: %v", n)
+		}
+	}
+}
+
+func TestStoreEqual(t *testing.T) {
+	mk := func() *Store {
+		s, _ := NewStore(nil)
+		for _, name := range []string{"x", "y"} {
+			c := s.SetCollection(name, nil)
+			for i := 0; i < 300; i++ {
+				c.SetItem(&Item{Key: []byte(fmt.Sprintf("%03d", i)),
+					Val: []byte(name + strconv.Itoa(i)), Priority: int32(i * 7919 % 1000)})
+			}
+		}
+		s.SetCollection("empty", nil)
+		return s
+	}
+	a, b := mk(), mk()
+	if eq, diff, err := a.Equal(b); !eq || diff != "" || err != nil {
+		t.Errorf("expected equal stores, got: %v, %q, %v", eq, diff, err)
+	}
+	// Other tree shapes of the same items.
+	b.GetCollection("y").Delete([]byte("150"))
+	b.GetCollection("y").SetItem(&Item{Key: []byte("150"), Val: []byte("y150"),
+		Priority: int32(150 * 7919 % 1000)})
+	if eq, _, _ := a.Equal(b); !eq {
+		t.Errorf("expected equal stores after re-setting an item")
+	}
+
+	b.GetCollection("y").Set([]byte("123"), []byte("changed"))
+	eq, diff, err := a.Equal(b)
+	if eq || err != nil || !strings.Contains(diff, "collection y") ||
+		!strings.Contains(diff, `"123"`) || !strings.Contains(diff, "value differs") {
+		t.Errorf("expected a value difference, got: %v, %q, %v", eq, diff, err)
+	}
+	b.GetCollection("y").Set([]byte("123"), []byte("y123"))
+	b.GetCollection("y").SetItem(&Item{Key: []byte("123"), Val: []byte("y123"), Priority: 1})
+	if eq, diff, _ = a.Equal(b); eq || !strings.Contains(diff, "priority differs") {
+		t.Errorf("expected a priority difference, got: %q", diff)
+	}
+	a.GetCollection("y").SetItem(&Item{Key: []byte("123"), Val: []byte("y123"), Priority: 1})
+
+	b.GetCollection("x").Delete([]byte("042"))
+	if eq, diff, _ = a.Equal(b); eq || diff != `collection x, key: "042": missing in other` {
+		t.Errorf("expected a missing key, got: %q", diff)
+	}
+	if eq, diff, _ = b.Equal(a); eq || diff != `collection x, key: "042": missing in store` {
+		t.Errorf("expected a missing key, got: %q", diff)
+	}
+	a.GetCollection("x").Delete([]byte("042"))
+	b.GetCollection("x").Set([]byte("999"), []byte("extra"))
+	if eq, diff, _ = a.Equal(b); eq || diff != `collection x, key: "999": missing in store` {
+		t.Errorf("expected a trailing missing key, got: %q", diff)
+	}
+	b.GetCollection("x").Delete([]byte("999"))
+	if eq, diff, _ = a.Equal(b); !eq {
+		t.Errorf("expected equal stores again, got: %q", diff)
+	}
+
+	b.SetCollection("z", nil)
+	if eq, diff, _ = a.Equal(b); eq || diff != "collection z: missing in store" {
+		t.Errorf("expected a missing collection, got: %q", diff)
+	}
+	b.RemoveCollection("z")
+	b.RemoveCollection("empty")
+	if eq, diff, _ = a.Equal(b); eq || diff != "collection empty: missing in other" {
+		t.Errorf("expected a missing collection, got: %q", diff)
+	}
+	b.SetCollection("empty", nil).Set([]byte("a"), []byte("A"))
+	if eq, diff, _ = a.Equal(b); eq || diff != `collection empty, key: "a": missing in store` {
+		t.Errorf("expected a key of an empty collection, got: %q", diff)
+	}
+
+	b.Close()
+	if _, _, err = a.Equal(b); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("expected ErrStoreClosed, got: %v", err)
+	}
+}
+
+func TestCloseWhileBusy(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		f := &memFile{}
+		s, _ := NewStore(f)
+		x := s.SetCollection("x", nil)
+		for i := 0; i < 500; i++ {
+			x.Set([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("v%d", i)))
+		}
+		s.Flush()
+		var wg sync.WaitGroup
+		var errBad atomic.Value
+		check := func(op string, err error) bool {
+			if err != nil && !errors.Is(err, ErrStoreClosed) {
+				errBad.Store(fmt.Sprintf("%s: %v", op, err))
+			}
+			return err == nil
+		}
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					k := []byte(fmt.Sprintf("%04d", (i*7+g*13)%500))
+					var err error
+					switch i % 6 {
+					case 0:
+						var v []byte
+						v, err = x.Get(k)
+						if err == nil && v == nil {
+							errBad.Store(fmt.Sprintf("missing key: %s", k))
+						}
+					case 1:
+						err = x.Set(k, []byte(fmt.Sprintf("v%d", i)))
+					case 2:
+						err = x.VisitItemsAscend(k, true, func(i *Item) bool {
+							return len(i.Val) > 0
+						})
+					case 3:
+						err = s.Flush()
+					case 4:
+						x.EvictSomeItems()
+						_, err = x.GetItem(k, true)
+					case 5:
+						_, err = x.MinItem(true)
+					}
+					if !check("op "+strconv.Itoa(i%6), err) {
+						return
+					}
+				}
+			}(g)
+		}
+		time.Sleep(time.Millisecond)
+		closeFunc := s.Close
+		if round%2 == 1 {
+			closeFunc = s.CloseWait
+		}
+		if err := closeFunc(); err != nil {
+			t.Errorf("expected Close to work, got: %v", err)
+		}
+		if round%2 == 1 && atomic.LoadInt64(&s.reads) != 0 {
+			t.Errorf("expected CloseWait to wait for the reads")
+		}
+		if err := s.Close(); err != nil {
+			t.Errorf("expected double Close to be a no-op, got: %v", err)
+		}
+		wg.Wait()
+		if e := errBad.Load(); e != nil {
+			t.Fatalf("expected only ErrStoreClosed, got: %v", e)
+		}
+	}
+
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("a"), []byte("A"))
+	x.Set([]byte("b"), []byte("B"))
+	visiting, release := make(chan bool), make(chan bool)
+	var visited []string
+	go func() {
+		x.VisitItemsAscend([]byte("a"), true, func(i *Item) bool {
+			if len(visited) == 0 {
+				visiting <- true
+				<-release
+			}
+			visited = append(visited, string(i.Key))
+			return true
+		})
+	}()
+	<-visiting
+	closed := make(chan error)
+	go func() { closed <- s.CloseWait() }()
+	select {
+	case <-closed:
+		t.Errorf("expected CloseWait to wait for the visit")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if _, err := x.Get([]byte("a")); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("expected a new read to see ErrStoreClosed, got: %v", err)
+	}
+	close(release)
+	if err := <-closed; err != nil {
+		t.Errorf("expected CloseWait to work, got: %v", err)
+	}
+	if strings.Join(visited, ",") != "a,b" {
+		t.Errorf("expected the visit to finish, got: %v", visited)
+	}
+}
+
+func TestAlignment(t *testing.T) {
+	for _, bufSize := range []int{0, 64 * 1024} {
+		f := &memFile{}
+		s, _ := NewStore(f)
+		if err := s.SetAlignment(3000); err == nil {
+			t.Errorf("expected a non power of 2 to fail")
+		}
+		if err := s.SetAlignment(4096); err != nil {
+			t.Errorf("expected SetAlignment to work, got: %v", err)
+		}
+		s.SetFlushBufferSize(bufSize)
+		x := s.SetCollection("x", nil)
+		x.EnableBloomFilter(10)
+		for i := 0; i < 100; i++ {
+			x.Set([]byte(fmt.Sprintf("%03d", i)), bytes.Repeat([]byte{byte(i)}, i*50))
+		}
+		s.Flush()
+		x.Set([]byte("later"), []byte("L"))
+		s.Flush()
+
+		s2, err := NewStore(f)
+		if err != nil {
+			t.Fatalf("expected reopen to work, got: %v", err)
+		}
+		if s2.Alignment() != 4096 {
+			t.Errorf("expected the alignment to be persisted, got: %v", s2.Alignment())
+		}
+		x2 := s2.GetCollection("x")
+		x2.Set([]byte("reopened"), []byte("R"))
+		s2.Flush()
+
+		s3, _ := NewStore(f)
+		x3 := s3.GetCollection("x")
+		var unaligned []string
+		numRecords := 0
+		checkLoc := func(what string, loc *ploc) {
+			if loc.isEmpty() {
+				return
+			}
+			numRecords++
+			if loc.Offset%4096 != 0 {
+				unaligned = append(unaligned, fmt.Sprintf("%s@%d", what, loc.Offset))
+			}
+		}
+		var walk func(nl *nodeLoc)
+		walk = func(nl *nodeLoc) {
+			if nl.isEmpty() {
+				return
+			}
+			checkLoc("node", nl.Loc())
+			n, err := nl.read(s3)
+			if err != nil || n == nil {
+				t.Fatalf("expected to read the node, got: %v", err)
+			}
+			checkLoc("item", n.item.Loc())
+			walk(&n.left)
+			walk(&n.right)
+		}
+		rnl := x3.rootAddRef()
+		walk(rnl.root)
+		x3.rootDecRef(rnl)
+		_, rootsLoc, _ := s3.scanRoots(int64(len(f.b)))
+		checkLoc("roots", rootsLoc)
+		if len(unaligned) > 0 || numRecords < 205 {
+			t.Errorf("expected every record to be aligned, got: %v of %v",
+				unaligned, numRecords)
+		}
+		for i := 0; i < 100; i++ {
+			v, err := x3.Get([]byte(fmt.Sprintf("%03d", i)))
+			if err != nil || !bytes.Equal(v, bytes.Repeat([]byte{byte(i)}, i*50)) {
+				t.Errorf("expected to read back item %v, got: %v, %v", i, len(v), err)
+			}
+		}
+		if v, _ := x3.Get([]byte("reopened")); string(v) != "R" {
+			t.Errorf("expected the item written after reopen, got: %q", v)
+		}
+	}
+	s, _ := NewStore(nil)
+	if err := s.SetAlignment(4096); err == nil {
+		t.Errorf("expected SetAlignment of a memory-only store to fail")
+	}
+}
+
+// A StoreFile whose writes fail once writable more bytes are written,
+// while failing is set, where the failing write is partially written,
+// like on a full disk.  Its Sync() fails while failSync is set, which
+// loses the bytes appended since the last Sync(), like a dropped page
+// cache.
+type faultyWriteFile struct {
+	memFile
+	failing  bool
+	writable int
+	failSync bool
+	synced   int
+}
+
+func (f *faultyWriteFile) Sync() error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.failSync {
+		f.b = f.b[:f.synced]
+		return errors.New("injected sync failure")
+	}
+	f.synced = len(f.b)
+	return nil
+}
+
+func (f *faultyWriteFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.failing && len(p) > f.writable {
+		n, _ := f.memFile.WriteAt(p[:f.writable], off)
+		f.writable = 0
+		return n, errors.New("injected write failure")
+	}
+	if f.failing {
+		f.writable -= len(p)
+	}
+	return f.memFile.WriteAt(p, off)
+}
+
+func TestFlushWriteFailure(t *testing.T) {
+	xor := func(b []byte, offset int64) ([]byte, error) {
+		res := make([]byte, len(b))
+		for i := range b {
+			res[i] = b[i] ^ byte(offset)
+		}
+		return res, nil
+	}
+	for _, config := range []string{"plain", "buffered", "reuse", "prefix", "encrypted", "sync"} {
+		f := &faultyWriteFile{}
+		open := func(f StoreFile) (*Store, error) {
+			if config == "encrypted" {
+				return NewStoreEx(f, StoreCallbacks{Encrypt: xor, Decrypt: xor})
+			}
+			return NewStore(f)
+		}
+		s, _ := open(f)
+		x := s.SetCollection("x", nil)
+		switch config {
+		case "buffered":
+			s.SetFlushBufferSize(4096)
+		case "reuse":
+			s.SetReuseFreeSpace(true)
+			x.EnableBloomFilter(10)
+		case "prefix":
+			x.SetKeyPrefixCompression(true)
+		case "sync":
+			s.SetFlushSync(true)
+		}
+		exp := map[string]string{}
+		set := func(k, v string) {
+			x.Set([]byte(k), []byte(v))
+			exp[k] = v
+		}
+		check := func(s *Store, exp map[string]string, when string) {
+			x := s.GetCollection("x")
+			if num, _, _ := x.GetTotals(); num != uint64(len(exp)) {
+				t.Errorf("%s %s: expected %v items, got: %v", config, when, len(exp), num)
+			}
+			for k, v := range exp {
+				if got, err := x.Get([]byte(k)); string(got) != v || err != nil {
+					t.Errorf("%s %s: expected %s = %s, got: %q, %v", config, when, k, v, got, err)
+					return
+				}
+			}
+		}
+		for i := 0; i < 500; i++ {
+			set(fmt.Sprintf("key-%04d", i), fmt.Sprintf("val-%d", i))
+		}
+		if err := s.Flush(); err != nil {
+			t.Errorf("%s: expected Flush to work, got: %v", config, err)
+		}
+		f.Sync() // Also the roots record.
+		flushed := map[string]string{}
+		for k, v := range exp {
+			flushed[k] = v
+		}
+		for i := 0; i < 500; i += 3 {
+			x.Delete([]byte(fmt.Sprintf("key-%04d", i)))
+			delete(exp, fmt.Sprintf("key-%04d", i))
+		}
+		for i := 250; i < 750; i++ {
+			set(fmt.Sprintf("key-%04d", i), fmt.Sprintf("new-%d", i))
+		}
+
+		// Every Flush fails a bit further into its writes, until one
+		// works, with mutations and evictions in between.
+		failures := 0
+		for writable := 0; ; writable += 1999 {
+			if config == "sync" {
+				f.failSync = failures < 3
+			} else {
+				f.failing, f.writable = true, writable
+			}
+			err := s.Flush()
+			f.failing = false
+			if err == nil {
+				break
+			}
+			failures++
+			for i := 0; i < 20; i++ {
+				x.EvictSomeItems()
+			}
+			check(s, exp, "after failed flush")
+			set(fmt.Sprintf("more-%04d", failures), "v")
+
+			// The file must still open to the state of the last Flush.
+			f.m.Lock()
+			mf := &memFile{b: append([]byte(nil), f.b...)}
+			f.m.Unlock()
+			s2, err := open(mf)
+			if s2 == nil {
+				t.Errorf("%s: expected reopen after a failed flush to work, got: %v", config, err)
+			} else {
+				check(s2, flushed, "reopened after failed flush")
+			}
+		}
+		if failures < 3 {
+			t.Errorf("%s: expected several failed flushes, got: %v", config, failures)
+		}
+		for i := 0; i < 20; i++ {
+			x.EvictSomeItems()
+		}
+		check(s, exp, "after flush")
+		s2, err := open(f)
+		if err != nil {
+			t.Errorf("%s: expected reopen to work without recovery, got: %v", config, err)
+		}
+		check(s2, exp, "reopened")
+		set("last", "v")
+		if err = s.Flush(); err != nil {
+			t.Errorf("%s: expected Flush to work, got: %v", config, err)
+		}
+		s2, _ = open(f)
+		check(s2, exp, "reopened again")
+	}
+}
+
+func TestSnapshotAt(t *testing.T) {
+	f := &memFile{}
+	s, _ := NewStore(f)
+	if err := s.SetHistoryDepth(3); err != nil {
+		t.Errorf("expected SetHistoryDepth to work, got: %v", err)
+	}
+	if s.Generation() != 0 || len(s.Generations()) != 0 {
+		t.Errorf("expected no generations before a Flush, got: %v", s.Generations())
+	}
+	x := s.SetCollection("x", nil)
+	items := func(s *Store) map[string]string {
+		res := map[string]string{}
+		s.GetCollection("x").VisitItemsAscend(nil, true, func(i *Item) bool {
+			res[string(i.Key)] = string(i.Val)
+			return true
+		})
+		return res
+	}
+	exp := map[uint64]map[string]string{}
+	for gen := uint64(1); gen <= 6; gen++ {
+		x.Set([]byte("k"), []byte(fmt.Sprintf("v%d", gen)))
+		x.Set([]byte(fmt.Sprintf("g%d", gen)), []byte("v"))
+		x.Delete([]byte(fmt.Sprintf("g%d", gen-2)))
+		if err := s.Flush(); err != nil {
+			t.Errorf("expected Flush to work, got: %v", err)
+		}
+		if s.Generation() != gen {
+			t.Errorf("expected generation %v, got: %v", gen, s.Generation())
+		}
+		exp[gen] = items(s)
+	}
+	x.Set([]byte("k"), []byte("unflushed"))
+	check := func(s *Store, gens string) {
+		if fmt.Sprint(s.Generations()) != gens {
+			t.Errorf("expected generations %s, got: %v", gens, s.Generations())
+		}
+		for _, gen := range s.Generations() {
+			ss, err := s.SnapshotAt(gen)
+			if err != nil {
+				t.Errorf("expected SnapshotAt %v to work, got: %v", gen, err)
+				continue
+			}
+			if got := items(ss); fmt.Sprint(got) != fmt.Sprint(exp[gen]) {
+				t.Errorf("expected generation %v: %v, got: %v", gen, exp[gen], got)
+			}
+			if err = ss.GetCollection("x").Set([]byte("a"), nil); !errors.Is(err, ErrReadOnly) {
+				t.Errorf("expected a read-only SnapshotAt, got: %v", err)
+			}
+			ss.Close()
+		}
+	}
+	check(s, "[3 4 5 6]")
+	if _, err := s.SnapshotAt(2); err == nil {
+		t.Errorf("expected SnapshotAt of a pruned generation to fail")
+	}
+	if err := s.SetReuseFreeSpace(true); err == nil {
+		t.Errorf("expected free space reuse with a history to fail")
+	}
+
+	s2, err := NewStore(&memFile{b: append([]byte(nil), f.b...)})
+	if err != nil {
+		t.Errorf("expected reopen to work, got: %v", err)
+	}
+	check(s2, "[3 4 5 6]")
+	ss := s2.Snapshot()
+	check(ss, "[3 4 5 6]")
+	ss.Close()
+	if err = s2.FlushRevert(); err != nil {
+		t.Errorf("expected FlushRevert to work, got: %v", err)
+	}
+	check(s2, "[2 3 4 5]")
+	s2.Flush() // Without a depth, as it's not persisted.
+	if fmt.Sprint(s2.Generations()) != "[6]" {
+		t.Errorf("expected the history to be pruned, got: %v", s2.Generations())
+	}
+
+	// Once the history is pruned, it doesn't have to be kept again.
+	s.SetHistoryDepth(1)
+	s.Flush()
+	exp[7] = items(s)
+	check(s, "[6 7]")
+	s.SetHistoryDepth(0)
+	s.Flush()
+	exp[8] = items(s)
+	check(s, "[8]")
+	if err := s.SetReuseFreeSpace(true); err != nil {
+		t.Errorf("expected free space reuse without a history to work, got: %v", err)
+	}
+	if err := s.SetHistoryDepth(1); err == nil {
+		t.Errorf("expected a history with free space reuse to fail")
+	}
+
+	m, _ := NewStore(nil)
+	if err := m.SetHistoryDepth(1); err == nil {
+		t.Errorf("expected a memory-only history to fail")
+	}
+	if _, err := m.SnapshotAt(0); err == nil {
+		t.Errorf("expected a memory-only SnapshotAt to fail")
+	}
+}
+
+func TestShortIO(t *testing.T) {
+	for i, seed := range oracleSeeds {
+		if err := runOracleOps(newShortFile(int64(i)), seed); err != nil {
+			t.Errorf("seed %v: %v", i, err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		data := make([]byte, 400)
+		for j := range data {
+			data[j] = byte(rand.Intn(256))
+		}
+		if err := runOracleOps(newShortFile(int64(i)), data); err != nil {
+			t.Errorf("random ops %x: %v", data, err)
+		}
+	}
+
+	xor := func(b []byte, offset int64) ([]byte, error) {
+		res := make([]byte, len(b))
+		for i := range b {
+			res[i] = b[i] ^ byte(offset)
+		}
+		return res, nil
+	}
+	for _, config := range []string{"plain", "buffered", "encrypted", "prefix", "bloom"} {
+		f := newShortFile(7)
+		open := func() (*Store, error) {
+			if config == "encrypted" {
+				return NewStoreEx(f, StoreCallbacks{Encrypt: xor, Decrypt: xor})
+			}
+			return NewStore(f)
+		}
+		s, _ := open()
+		x := s.SetCollection("x", nil)
+		switch config {
+		case "buffered":
+			s.SetFlushBufferSize(4096)
+		case "prefix":
+			x.SetKeyPrefixCompression(true)
+		case "bloom":
+			x.EnableBloomFilter(10)
+		}
+		exp := map[string]string{"big": strings.Repeat("b", 100000)}
+		x.Set([]byte("big"), []byte(exp["big"]))
+		for round := 0; round < 3; round++ {
+			for i := round * 100; i < round*100+300; i++ {
+				k := fmt.Sprintf("key-%04d", i)
+				exp[k] = fmt.Sprintf("%d-%s", round, strings.Repeat("v", i%50))
+				x.Set([]byte(k), []byte(exp[k]))
+			}
+			if err := s.Flush(); err != nil {
+				t.Errorf("%s: expected Flush to work, got: %v", config, err)
+			}
+		}
+		s2, err := open()
+		if err != nil {
+			t.Errorf("%s: expected reopen to work, got: %v", config, err)
+			continue
+		}
+		x2 := s2.GetCollection("x")
+		for k, v := range exp {
+			if got, err := x2.Get([]byte(k)); string(got) != v || err != nil {
+				t.Errorf("%s: expected %s, got: %.20q, %v", config, k, got, err)
+				break
+			}
+		}
+		if num, _, _ := x2.GetTotals(); num != uint64(len(exp)) {
+			t.Errorf("%s: expected %v items, got: %v", config, len(exp), num)
+		}
+		if f.numShort == 0 {
+			t.Errorf("%s: expected short transfers", config)
+		}
+	}
+
+	// A record that's cut off by the end of the file is corrupt.
+	f := &memFile{}
+	s, _ := NewStore(f)
+	s.SetCollection("x", nil).Set([]byte("a"), bytes.Repeat([]byte("v"), 1000))
+	s.Flush()
+	s, _ = NewStore(f)
+	itemLength := int64(itemLoc_hdrLength + 1 + 1000) // The node follows.
+	f.Truncate(itemLength + 10)
+	_, err := s.GetCollection("x").Get([]byte("a"))
+	var ce *CorruptError
+	if !errors.As(err, &ce) || ce.Offset != itemLength ||
+		ce.Length != uint32(ploc_length*3+8+8) ||
+		!errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected a cut off CorruptError, got: %v", err)
+	}
+}
+
+func TestWalkNodes(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	// A known tree: d at the root, b and f below it, then the leaves.
+	for _, kp := range []struct {
+		k string
+		p int32
+	}{{"a", 1}, {"b", 5}, {"c", 2}, {"d", 9}, {"e", 3}, {"f", 6}, {"g", 4}} {
+		x.SetItem(&Item{Key: []byte(kp.k), Val: []byte("v"), Priority: kp.p})
+	}
+	var got []string
+	err := x.WalkNodes(func(key []byte, priority int,
+		leftCount, rightCount uint64, depth uint64) bool {
+		got = append(got, fmt.Sprintf("%s:%v:%v:%v:%v",
+			key, priority, leftCount, rightCount, depth))
+		return true
+	})
+	exp := "[d:9:3:3:0 b:5:1:1:1 a:1:0:0:2 c:2:0:0:2 f:6:1:1:1 e:3:0:0:2 g:4:0:0:2]"
+	if err != nil || fmt.Sprint(got) != exp {
+		t.Errorf("expected %s, got: %v, %v", exp, got, err)
+	}
+	got = nil
+	x.WalkNodes(func(key []byte, priority int,
+		leftCount, rightCount uint64, depth uint64) bool {
+		got = append(got, string(key))
+		return len(got) < 3
+	})
+	if fmt.Sprint(got) != "[d b a]" {
+		t.Errorf("expected the walk to stop, got: %v", got)
+	}
+
+	// The counts are those of numInfo() for every node, and the walk
+	// reads no values, after a reopen.
+	f := &memFile{}
+	s, _ = NewStore(f)
+	x = s.SetCollection("x", nil)
+	for i := 0; i < 1000; i++ {
+		x.Set([]byte(fmt.Sprintf("%04d", i)), []byte("v"))
+	}
+	s.Flush()
+	valReads := 0
+	s, _ = NewStoreEx(f, StoreCallbacks{
+		ItemValRead: func(c *Collection, i *Item,
+			r io.ReaderAt, offset int64, valLength uint32) error {
+			valReads++
+			i.Val = make([]byte, valLength)
+			_, err := r.ReadAt(i.Val, offset)
+			return err
+		},
+	})
+	x = s.GetCollection("x")
+	var nodes []*node
+	var collect func(nloc *nodeLoc)
+	collect = func(nloc *nodeLoc) {
+		if n, _ := nloc.read(s); n != nil && !nloc.isEmpty() {
+			nodes = append(nodes, n)
+			collect(&n.left)
+			collect(&n.right)
+		}
+	}
+	var walked []string
+	var maxDepth uint64
+	err = x.WalkNodes(func(key []byte, priority int,
+		leftCount, rightCount uint64, depth uint64) bool {
+		walked = append(walked, fmt.Sprintf("%s:%v:%v:%v", key, priority, leftCount, rightCount))
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+		return true
+	})
+	if err != nil || len(walked) != 1000 {
+		t.Errorf("expected 1000 nodes, got: %v, %v", len(walked), err)
+	}
+	if valReads != 0 {
+		t.Errorf("expected no value reads, got: %v", valReads)
+	}
+	rnl := x.rootAddRef()
+	collect(rnl.root)
+	x.rootDecRef(rnl)
+	for i, n := range nodes {
+		leftNum, _, rightNum, _, _ := numInfo(s, &n.left, &n.right)
+		item := n.item.Item()
+		exp := fmt.Sprintf("%s:%v:%v:%v", item.Key, item.Priority, leftNum, rightNum)
+		if i >= len(walked) || walked[i] != exp {
+			t.Errorf("expected node %v: %s, got: %v", i, exp, walked)
+			break
+		}
+		if leftNum+rightNum+1 != n.numNodes {
+			t.Errorf("expected counts of %s to add up to %v", exp, n.numNodes)
+		}
+	}
+	if stats, _ := x.Stats(); stats.ApproxDepth != maxDepth+1 {
+		t.Errorf("expected depth %v, got: %v", stats.ApproxDepth, maxDepth)
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	var written int64
+	m := &mockfile{
+		writeat: func(p []byte, off int64) (int, error) {
+			written += int64(len(p))
+			return len(p), nil
+		},
+		stat: func() (os.FileInfo, error) { return memFileInfo(0), nil },
+	}
+	s, _ := NewStore(m)
+	s.SetFlushBufferSize(0) // So that the item is written before the node fails.
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("a"), bytes.Repeat([]byte("v"), 100))
+	size := int64(MaxFileSize - 150) // The item fits, but not the node.
+	atomic.StoreInt64(&s.size, size)
+	err := s.Flush()
+	var le *LimitError
+	if !errors.Is(err, ErrFileTooLarge) || !errors.As(err, &le) ||
+		le.Limit != MaxFileSize || le.Size <= MaxFileSize {
+		t.Errorf("expected ErrFileTooLarge, got: %v", err)
+
+	}
+	if atomic.LoadInt64(&s.size) != size || written == 0 {
+		t.Errorf("expected the failed Flush to be rolled back, got size: %v, %v",
+			atomic.LoadInt64(&s.size), written)
+	}
+	rnl := x.rootAddRef()
+	if !rnl.root.Loc().isEmpty() {
+		t.Errorf("expected the root to stay unpersisted")
+	}
+	x.rootDecRef(rnl)
+	if s.writeAtFile([]byte("x"), -1) == nil {
+		t.Errorf("expected a negative offset to fail")
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	depth := func(x *Collection) (res uint64) {
+		err := x.WalkNodes(func(key []byte, priority int,
+			leftCount, rightCount uint64, depth uint64) bool {
+			if res < depth {
+				res = depth
+			}
+			return true
+		})
+		if err != nil {
+			t.Errorf("expected WalkNodes to work, err: %v", err)
+		}
+		return res
+	}
+	f, _ := ioutil.TempFile("./", "test")
+	fname := f.Name()
+	defer os.Remove(fname)
+	s, _ := NewStore(f)
+	s.SetRand(rand.New(rand.NewSource(1)))
+	x := s.SetCollection("x", nil)
+	// Ascending priorities of ascending keys degenerate into a list.
+	for i := 0; i < 200; i++ {
+		x.SetItem(&Item{Key: []byte(fmt.Sprintf("%03d", i)),
+			Val: []byte(fmt.Sprintf("v%d", i)), Priority: int32(i)})
+	}
+	if d := depth(x); d != 199 {
+		t.Errorf("expected a degenerate tree, got depth: %v", d)
+	}
+	if err := s.Flush(); err != nil {
+		t.Errorf("expected Flush to work, err: %v", err)
+	}
+	ss := s.Snapshot()
+	defer ss.Close()
+	if err := x.Rebalance(); err != nil {
+		t.Errorf("expected Rebalance to work, err: %v", err)
+	}
+	if d := depth(x); d > 3*8 {
+		t.Errorf("expected Rebalance to reduce the depth, got: %v", d)
+	}
+	if d := depth(ss.GetCollection("x")); d != 199 {
+		t.Errorf("expected the snapshot's tree unchanged, got depth: %v", d)
+	}
+	check := func(x *Collection) {
+		n := 0
+		x.VisitItemsAscend(nil, true, func(i *Item) bool {
+			if string(i.Key) != fmt.Sprintf("%03d", n) ||
+				string(i.Val) != fmt.Sprintf("v%d", n) {
+				t.Errorf("expected item %v, got: %q, %q", n, i.Key, i.Val)
+			}
+			n++
+			return true
+		})
+		if n != 200 {
+			t.Errorf("expected 200 items, got: %v", n)
+		}
+		if c, _ := x.Count(); c != 200 {
+			t.Errorf("expected count 200, got: %v", c)
+		}
+	}
+	check(x)
+	check(ss.GetCollection("x"))
+	if err := s.Flush(); err != nil {
+		t.Errorf("expected Flush to work, err: %v", err)
+	}
+	s.Close()
+	f.Close()
+	f, _ = os.Open(fname)
+	s, _ = NewStore(f)
+	check(s.GetCollection("x"))
+	if d := depth(s.GetCollection("x")); d > 3*8 {
+		t.Errorf("expected the rebalanced tree persisted, got depth: %v", d)
+	}
+	if err := s.Snapshot().GetCollection("x").Rebalance(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected a read-only Rebalance to fail, got: %v", err)
+	}
+	s.Close()
+	f.Close()
+
+	s, _ = NewStore(nil)
+	x = s.SetCollection("x", nil)
+	if x.Rebalance() != nil {
+		t.Errorf("expected Rebalance of an empty collection to work")
+	}
+	if x.SetAutoRebalance(2) == nil || x.SetAutoRebalance(-1) == nil {
+		t.Errorf("expected a depth factor below 3 to fail")
+	}
+	for i := 0; i < 1000; i++ {
+		x.SetItem(&Item{Key: []byte(fmt.Sprintf("%04d", i)),
+			Val: []byte("v"), Priority: int32(i)})
+	}
+	if err := x.SetAutoRebalance(4); err != nil {
+		t.Errorf("expected SetAutoRebalance to work, err: %v", err)
+	}
+	// The first set after enabling checks the depth.
+	x.SetItem(&Item{Key: []byte("1000"), Val: []byte("v"), Priority: 1000})
+	if d := depth(x); float64(d) > 4*math.Log2(1002) {
+		t.Errorf("expected auto-rebalancing to reduce the depth, got: %v", d)
+	}
+	if c, _ := x.Count(); c != 1001 {
+		t.Errorf("expected count 1001, got: %v", c)
+	}
+	// Until the next check, after as many sets as there are items.
+	for i := 1001; i < 1100; i++ {
+		x.SetItem(&Item{Key: []byte(fmt.Sprintf("%04d", i)),
+			Val: []byte("v"), Priority: int32(i)})
+	}
+	if d := depth(x); d < 99 {
+		t.Errorf("expected no depth check before the next one, got depth: %v", d)
+	}
+	if x.SetAutoRebalance(0) != nil {
+		t.Errorf("expected SetAutoRebalance(0) to work")
+	}
+	for i := 1100; i < 3300; i++ {
+		x.SetItem(&Item{Key: []byte(fmt.Sprintf("%04d", i)),
+			Val: []byte("v"), Priority: int32(i)})
+	}
+	if d := depth(x); d < 2200 {
+		t.Errorf("expected no auto-rebalancing once disabled, got depth: %v", d)
+	}
+}
+
+func TestVisitReadahead(t *testing.T) {
+	for _, prefixes := range []bool{false, true} {
+		mf := &memFile{}
+		m := &mockfile{readat: mf.ReadAt, writeat: mf.WriteAt, stat: mf.Stat}
+		s, _ := NewStore(m)
+		x := s.SetCollection("x", nil)
+		x.SetKeyPrefixCompression(prefixes)
+		for i := 0; i < 2000; i++ {
+			x.Set([]byte(fmt.Sprintf("%05d", i)), []byte(fmt.Sprintf("v%d", i)))
+		}
+		s.Flush()
+		scan := func(x *Collection, opts VisitorOptions, descend bool,
+			target string, want func(i int) string) int {
+			var keys []string
+			visit := x.VisitItemsAscendOpts
+			if descend {
+				visit = x.VisitItemsDescendOpts
+			}
+			m.numReadAt = 0
+			err := visit([]byte(target), true, opts, func(i *Item) bool {
+				if want != nil && string(i.Val) != want(len(keys)) {
+					t.Errorf("expected %v, got: %q = %q", want(len(keys)), i.Key, i.Val)
+				}
+				keys = append(keys, string(i.Key))
+				return true
+			})
+			if err != nil {
+				t.Errorf("expected the visit to work, err: %v", err)
+			}
+			return len(keys)
+		}
+		val := func(i int) string { return fmt.Sprintf("v%d", i) }
+		ra := VisitorOptions{Readahead: true, ReadaheadBytes: 64 * 1024}
+
+		s2, _ := NewStore(m)
+		if n := scan(s2.GetCollection("x"), VisitorOptions{}, false, "", val); n != 2000 {
+			t.Errorf("expected 2000 items, got: %v", n)
+		}
+		cold := m.numReadAt
+		s2, _ = NewStore(m)
+		if n := scan(s2.GetCollection("x"), ra, false, "", val); n != 2000 {
+			t.Errorf("expected 2000 items, got: %v", n)
+		}
+		if m.numReadAt*20 > cold {
+			t.Errorf("expected far fewer reads, got: %v vs %v", m.numReadAt, cold)
+		}
+		s2, _ = NewStore(m)
+		if n := scan(s2.GetCollection("x"), ra, false, "01000",
+			func(i int) string { return val(1000 + i) }); n != 1000 {
+			t.Errorf("expected 1000 items from the target, got: %v", n)
+		}
+		s2, _ = NewStore(m)
+		if n := scan(s2.GetCollection("x"), ra, true, "01000", nil); n != 1000 {
+			t.Errorf("expected 1000 items below the target, got: %v", n)
+		}
+
+		// Dirty items among the read ahead records are served from memory.
+		s2, _ = NewStore(m)
+		x2 := s2.GetCollection("x")
+		for i := 0; i < 2000; i += 7 {
+			x2.Set([]byte(fmt.Sprintf("%05d", i)), []byte("dirty"))
+		}
+		dirty := func(i int) string {
+			if i%7 == 0 {
+				return "dirty"
+			}
+			return val(i)
+		}
+		if n := scan(x2, ra, false, "", dirty); n != 2000 {
+			t.Errorf("expected 2000 items, got: %v", n)
+		}
+	}
+
+	// A Flush() during the scan writes the scan's dirty items into
+	// reused file space, and the evicted items are read back from it.
+	mf := &memFile{}
+	m := &mockfile{readat: mf.ReadAt, writeat: mf.WriteAt, stat: mf.Stat}
+	s, _ := NewStore(m)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 2000; i++ {
+		x.Set([]byte(fmt.Sprintf("%05d", i)), []byte(fmt.Sprintf("v%05d", i)))
+	}
+	s.Flush()
+	s.SetReuseFreeSpace(true)
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 1000; i++ {
+			x.Set([]byte(fmt.Sprintf("%05d", i)), []byte(fmt.Sprintf("w%05d", i)))
+		}
+		s.Flush()
+	}
+	for i := 1000; i < 2000; i++ {
+		x.Set([]byte(fmt.Sprintf("%05d", i)), []byte(fmt.Sprintf("u%05d", i)))
+	}
+	numReused := s.freeList.numReused
+	n := 0
+	err := x.VisitItemsAscendOpts(nil, true, VisitorOptions{Readahead: true},
+		func(i *Item) bool {
+			want := fmt.Sprintf("u%05d", n)
+			if n < 1000 {
+				want = fmt.Sprintf("w%05d", n)
+			}
+			if string(i.Val) != want {
+				t.Errorf("expected %v, got: %q = %q", want, i.Key, i.Val)
+			}
+			if n == 500 {
+				s.Flush()
+				for j := 0; j < 100; j++ {
+					x.EvictSomeItems()
+				}
+			}
+			n++
+			return true
+		})
+	if err != nil || n != 2000 {
+		t.Errorf("expected the visit to work, got: %v, %v", n, err)
+	}
+	if s.freeList.numReused == numReused {
+		t.Errorf("expected the Flush to reuse free space")
+	}
+}
+
+func benchmarkColdScan(b *testing.B, opts VisitorOptions) {
+	mf := &memFile{}
+	m := &mockfile{readat: mf.ReadAt, writeat: mf.WriteAt, stat: mf.Stat}
+	s, _ := NewStore(m)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 10000; i++ {
+		x.Set([]byte(fmt.Sprintf("%05d", i)), bytes.Repeat([]byte("v"), 100))
+	}
+	s.Flush()
+	// Like a remote StoreFile, every read takes a while, which is spun
+	// rather than slept, as sleeps are coarser.
+	m.readat = func(p []byte, off int64) (int, error) {
+		for start := time.Now(); time.Since(start) < 20*time.Microsecond; {
+		}
+		return mf.ReadAt(p, off)
+	}
+	m.numReadAt = 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s2, _ := NewStore(m)
+		s2.GetCollection("x").VisitItemsAscendOpts(nil, true, opts,
+			func(i *Item) bool { return true })
+	}
+	b.ReportMetric(float64(m.numReadAt)/float64(b.N), "reads/op")
+}
+
+func BenchmarkColdScan(b *testing.B) {
+	benchmarkColdScan(b, VisitorOptions{})
+}
+
+func BenchmarkColdScanReadahead(b *testing.B) {
+	benchmarkColdScan(b, VisitorOptions{Readahead: true})
+}
+
+func TestMemStoreFile(t *testing.T) {
+	f := NewMemStoreFile()
+	var _ StoreFile = f
+	b := make([]byte, 4)
+	if n, err := f.ReadAt(b, 0); n != 0 || err != io.EOF {
+		t.Errorf("expected an empty file, got: %v, %v", n, err)
+	}
+	if _, err := f.WriteAt([]byte("x"), -1); err == nil {
+		t.Errorf("expected a negative offset to fail")
+	}
+	if _, err := f.ReadAt(b, -1); err == nil {
+		t.Errorf("expected a negative offset to fail")
+	}
+	if n, err := f.WriteAt([]byte("abc"), 2); n != 3 || err != nil {
+		t.Errorf("expected WriteAt to work, got: %v, %v", n, err)
+	}
+	if n, err := f.ReadAt(b, 0); n != 4 || err != nil || string(b) != "\x00\x00ab" {
+		t.Errorf("expected a zero filled gap, got: %v, %v, %q", n, err, b)
+	}
+	if n, err := f.ReadAt(b, 3); n != 2 || err != io.EOF || string(b[:n]) != "bc" {
+		t.Errorf("expected a short read at the end, got: %v, %v, %q", n, err, b[:n])
+	}
+	if fi, _ := f.Stat(); fi.Size() != 5 {
+		t.Errorf("expected size 5, got: %v", fi.Size())
+	}
+	if err := f.Truncate(3); err != nil {
+		t.Errorf("expected Truncate to work, err: %v", err)
+	}
+	if err := f.Truncate(6); err != nil {
+		t.Errorf("expected Truncate to grow, err: %v", err)
+	}
+	if got := f.Bytes(); string(got) != "\x00\x00a\x00\x00\x00" {
+		t.Errorf("expected the truncated bytes to read as zeros, got: %q", got)
+	}
+	if f.Truncate(-1) == nil {
+		t.Errorf("expected a negative size to fail")
+	}
+	f.Truncate(0)
+
+	s, err := NewStore(f)
+	if err != nil {
+		t.Errorf("expected NewStore to work, err: %v", err)
+	}
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 1000; i++ {
+		x.Set([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("v%d", i)))
+	}
+	if err = s.Flush(); err != nil {
+		t.Errorf("expected Flush to work, err: %v", err)
+	}
+	// Concurrent readers of the flushed items, while the writer writes.
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s2, err := NewStore(f)
+			if err != nil {
+				t.Errorf("expected reopen to work, err: %v", err)
+				return
+			}
+			for i := 0; i < 1000; i++ {
+				k := fmt.Sprintf("%04d", i)
+				if v, _ := s2.GetCollection("x").Get([]byte(k)); string(v) != fmt.Sprintf("v%d", i) {
+					t.Errorf("expected %v, got: %q", k, v)
+					return
+				}
+			}
+		}()
+	}
+	for i := 1000; i < 2000; i++ {
+		x.Set([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("v%d", i)))
+	}
+	s.Flush()
+	wg.Wait()
+	s.Close()
+
+	s, err = NewStore(NewMemStoreFileBytes(f.Bytes()))
+	if err != nil {
+		t.Errorf("expected reopen from the bytes to work, err: %v", err)
+	}
+	if n, _ := s.GetCollection("x").Count(); n != 2000 {
+		t.Errorf("expected 2000 items, got: %v", n)
+	}
+	if v, _ := s.GetCollection("x").Get([]byte("1999")); string(v) != "v1999" {
+		t.Errorf("expected the last item, got: %q", v)
+	}
+}
+
+func TestValueChunking(t *testing.T) {
+	f := NewMemStoreFile()
+	s, _ := NewStore(f)
+	for _, args := range [][2]int{{-1, 512}, {4096, 100}, {1000, 2000}} {
+		if err := s.SetValueChunking(args[0], args[1]); err == nil {
+			t.Errorf("expected SetValueChunking(%v) to fail", args)
+		}
+	}
+	if err := s.Snapshot().SetValueChunking(4096, 1000); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected SetValueChunking of a snapshot to fail, got: %v", err)
+	}
+	value := func(n int, seed byte) []byte {
+		v := make([]byte, n)
+		for i := range v {
+			v[i] = seed + byte(i%251)
+		}
+		return v
+	}
+	vals := map[string][]byte{
+		"a-small":   []byte("small"),
+		"b-before":  value(10000, 1), // Written before chunking is enabled.
+		"c-edge":    value(4096, 2),
+		"d-two":     value(4097, 3),
+		"e-big":     value(300001, 4),
+		"f-visible": value(5000, 5),
+	}
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("a-small"), vals["a-small"])
+	x.Set([]byte("b-before"), vals["b-before"])
+	s.Flush()
+	if err := s.SetValueChunking(4096, 1000); err != nil {
+		t.Fatalf("expected SetValueChunking to work, got: %v", err)
+	}
+	m := mapMetricsSink{}
+	s.SetMetricsSink(m)
+	for _, k := range []string{"c-edge", "d-two", "e-big", "f-visible"} {
+		x.Set([]byte(k), vals[k])
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, got: %v", err)
+	}
+	if got := m["valueChunks"]; got != 5+301+5 {
+		t.Errorf("expected 311 value chunks, got: %v", got)
+	}
+	check := func(s *Store, what string) {
+		x := s.GetCollection("x")
+		for k, v := range vals {
+			got, err := x.Get([]byte(k))
+			if err != nil || !bytes.Equal(got, v) {
+				t.Errorf("%v: expected %v of %v bytes, got: %v bytes, err: %v",
+					what, k, len(v), len(got), err)
+			}
+		}
+		var totalBytes uint64
+		for k, v := range vals {
+			totalBytes += uint64(len(k) + len(v))
+		}
+		if _, numBytes, err := x.GetTotals(); err != nil || numBytes != totalBytes {
+			t.Errorf("%v: expected totals of whole values, got: %v, err: %v",
+				what, numBytes, err)
+		}
+		n := 0
+		err := x.VisitItemsAscendOpts(nil, true, VisitorOptions{Readahead: true},
+			func(i *Item) bool {
+				if !bytes.Equal(i.Val, vals[string(i.Key)]) {
+					t.Errorf("%v: expected visited value of %s", what, i.Key)
+				}
+				n++
+				return true
+			})
+		if err != nil || n != len(vals) {
+			t.Errorf("%v: expected visit of %v items, got: %v, err: %v",
+				what, len(vals), n, err)
+		}
+	}
+	check(s, "written")
+	x.EvictSomeItems()
+	check(s, "evicted")
+	s2, err := NewStore(NewMemStoreFileBytes(f.Bytes()))
+	if err != nil {
+		t.Fatalf("expected reopen to work, got: %v", err)
+	}
+	if !s2.GetCollection("x").hasValueChunks() {
+		t.Errorf("expected the roots to note the chunked values")
+	}
+	check(s2, "reopened")
+
+	// A custom ItemValRead() reads a chunked value from offset 0.
+	s3, _ := NewStoreEx(NewMemStoreFileBytes(f.Bytes()), StoreCallbacks{
+		ItemValRead: func(c *Collection, i *Item,
+			r io.ReaderAt, offset int64, valLength uint32) error {
+			i.Val = make([]byte, valLength)
+			_, err := r.ReadAt(i.Val, offset)
+			return err
+		},
+	})
+	check(s3, "custom read")
+
+	// The chunks and the item record of a replaced value are reused.
+	s2.SetReuseFreeSpace(true)
+	s2.SetValueChunking(4096, 1000)
+	x2 := s2.GetCollection("x")
+	var sizes []int64
+	for round := 0; round < 8; round++ {
+		vals["e-big"] = value(300001, byte(10+round))
+		x2.Set([]byte("e-big"), vals["e-big"])
+		if err := s2.Flush(); err != nil {
+			t.Fatalf("expected Flush to work, got: %v", err)
+		}
+		sizes = append(sizes, atomic.LoadInt64(&s2.size))
+	}
+	stats := map[string]uint64{}
+	s2.Stats(stats)
+	if stats["freeListReusedBytes"] < 300001 {
+		t.Errorf("expected chunk reuse, got: %v", stats)
+	}
+	for _, size := range sizes[2:] {
+		if size > sizes[1]+sizes[1]/20 {
+			t.Errorf("expected the file size to stabilize, got sizes: %v", sizes)
+			break
+		}
+	}
+	check(s2, "reused")
+}
+
+func TestFlushScanLocality(t *testing.T) {
+	src, _ := NewStore(NewMemStoreFile())
+	x := src.SetCollection("x", nil)
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 1000; i++ {
+			k := rand.Intn(5000)
+			x.Set([]byte(fmt.Sprintf("%05d", k)), []byte(fmt.Sprintf("v%d-%d", round, k)))
+		}
+		src.Flush()
+	}
+	numItems, _, _ := x.GetTotals()
+	compacted := func(incremental bool) *MemStoreFile {
+		mf := NewMemStoreFile()
+		if incremental {
+			ic, _ := NewIncrementalCopy(mf)
+			if _, err := src.CopyToIncremental(ic); err != nil {
+				t.Fatalf("expected CopyToIncremental to work, got: %v", err)
+			}
+		} else if dst, err := src.CopyTo(mf, 0); err != nil || dst.Flush() != nil {
+			t.Fatalf("expected CopyTo to work, got: %v", err)
+		}
+		return mf
+	}
+	for _, incremental := range []bool{false, true} {
+		mf := compacted(incremental)
+		var offsets []int64
+		m := &mockfile{stat: mf.Stat, writeat: mf.WriteAt,
+			readat: func(p []byte, off int64) (int, error) {
+				offsets = append(offsets, off)
+				return mf.ReadAt(p, off)
+			}}
+		s, err := NewStore(m)
+		if err != nil {
+			t.Fatalf("expected reopen to work, got: %v", err)
+		}
+		offsets = nil
+		n := uint64(0)
+		err = s.GetCollection("x").VisitItemsAscend(nil, true, func(i *Item) bool {
+			n++
+			return true
+		})
+		if err != nil || n != numItems {
+			t.Errorf("expected a scan of %v items, got: %v, err: %v", numItems, n, err)
+		}
+		// The reads of a node's children right before it, within a page,
+		// are served by the page cache like sequential reads.
+		up := 0
+		for j := 1; j < len(offsets); j++ {
+			if offsets[j] >= offsets[j-1]-4096 {
+				up++
+			}
+		}
+		if ratio := float64(up) / float64(len(offsets)-1); ratio < 0.95 {
+			t.Errorf("expected the scan's reads to be sequential, incremental: %v,"+
+				" got ratio: %v of reads: %v", incremental, ratio, len(offsets))
+		}
+	}
+}
+
+func TestValueLen(t *testing.T) {
+	mf := NewMemStoreFile()
+	bytesRead := 0
+	m := &mockfile{stat: mf.Stat, writeat: mf.WriteAt,
+		readat: func(p []byte, off int64) (int, error) {
+			bytesRead += len(p)
+			return mf.ReadAt(p, off)
+		}}
+	s, _ := NewStore(m)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), make([]byte, 10000+i))
+	}
+	x.Set([]byte("empty"), []byte{})
+	if n, found, err := x.ValueLen([]byte("042")); err != nil || !found || n != 10042 {
+		t.Errorf("expected the length of a dirty value, got: %v, %v, %v", n, found, err)
+	}
+	s.Flush()
+	s, _ = NewStore(m)
+	x = s.GetCollection("x")
+	for _, k := range []string{"000", "042", "099", "empty"} {
+		bytesRead = 0
+		n, found, err := x.ValueLen([]byte(k))
+		if err != nil || !found {
+			t.Errorf("expected ValueLen of %v to work, got: %v, %v", k, found, err)
+		}
+		if bytesRead >= 10000 {
+			t.Errorf("expected no value bytes read, got: %v bytes", bytesRead)
+		}
+		val, err := x.Get([]byte(k))
+		if err != nil || n != len(val) {
+			t.Errorf("expected ValueLen of %v to match Get, got: %v vs %v, err: %v",
+				k, n, len(val), err)
+		}
+	}
+	if _, found, err := x.ValueLen([]byte("absent")); err != nil || found {
+		t.Errorf("expected no ValueLen of an absent key, got: %v, %v", found, err)
+	}
+}
+
+func TestKeepVersions(t *testing.T) {
+	f := NewMemStoreFile()
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	for _, n := range []int{-1, MaxKeepVersions + 1} {
+		if err := x.SetKeepVersions(n); err == nil {
+			t.Errorf("expected SetKeepVersions(%v) to fail", n)
+		}
+	}
+	if err := x.SetKeepVersions(2); err != nil {
+		t.Fatalf("expected SetKeepVersions to work, got: %v", err)
+	}
+	if err := x.StartWriter(10); err == nil {
+		t.Errorf("expected StartWriter with kept versions to fail")
+	}
+	if err := s.SetReuseFreeSpace(true); err == nil {
+		t.Errorf("expected SetReuseFreeSpace with kept versions to fail")
+	}
+	x.Set([]byte("other"), []byte("o"))
+	for i := 1; i <= 5; i++ {
+		x.Set([]byte("k"), []byte(fmt.Sprintf("v%v", i)))
+		if i%2 == 0 {
+			s.Flush()
+		}
+	}
+	s.Flush()
+	check := func(x *Collection, what string, exps ...string) {
+		for back, exp := range exps {
+			i, err := x.GetVersion([]byte("k"), back)
+			if err != nil || i == nil || string(i.Val) != exp {
+				t.Errorf("%v: expected version %v to be %v, got: %v, %v",
+					what, back, exp, i, err)
+			}
+		}
+		if i, err := x.GetVersion([]byte("k"), 3); err != nil || i != nil {
+			t.Errorf("%v: expected no version 3, got: %v, %v", what, i, err)
+		}
+		if i, err := x.GetVersion([]byte("other"), 1); err != nil || i != nil {
+			t.Errorf("%v: expected no version of other, got: %v, %v", what, i, err)
+		}
+		var vals []string
+		x.VisitVersions([]byte("k"), func(i *Item) bool {
+			vals = append(vals, string(i.Val))
+			return true
+		})
+		if strings.Join(vals, ",") != strings.Join(exps, ",") {
+			t.Errorf("%v: expected versions %v, got: %v", what, exps, vals)
+		}
+		if v, err := x.Get([]byte("k")); err != nil || string(v) != exps[0] {
+			t.Errorf("%v: expected %v, got: %q, %v", what, exps[0], v, err)
+		}
+	}
+	check(x, "flushed", "v5", "v4", "v3")
+	s2, err := NewStore(NewMemStoreFileBytes(f.Bytes()))
+	if err != nil {
+		t.Fatalf("expected reopen to work, got: %v", err)
+	}
+	x2 := s2.GetCollection("x")
+	if x2.KeepVersions() != 2 {
+		t.Errorf("expected kept versions to be persisted, got: %v", x2.KeepVersions())
+	}
+	check(x2, "reopened", "v5", "v4", "v3")
+	if err := s2.SetReuseFreeSpace(true); err == nil {
+		t.Errorf("expected SetReuseFreeSpace of a reopened store to fail")
+	}
+	x2.Set([]byte("k"), []byte("v6"))
+	check(x2, "set again", "v6", "v5", "v4")
+	x2.Set([]byte("k"), []byte("v7"))
+	x2.Rebalance()
+	check(x2, "rebalanced", "v7", "v6", "v5")
+	dst, err := s2.CopyTo(NewMemStoreFile(), 100)
+	if err != nil {
+		t.Fatalf("expected CopyTo to work, got: %v", err)
+	}
+	if dst.GetCollection("x").KeepVersions() != 2 {
+		t.Errorf("expected CopyTo to keep the setting")
+	}
+	check(dst.GetCollection("x"), "copied", "v7", "v6", "v5")
+	ic, _ := NewIncrementalCopy(NewMemStoreFile())
+	if _, err = s2.CopyToIncremental(ic); err != nil {
+		t.Fatalf("expected CopyToIncremental to work, got: %v", err)
+	}
+	check(ic.Store().GetCollection("x"), "incremental copy", "v7", "v6", "v5")
+	s2.Flush()
+	if _, err = s2.CopyToIncremental(ic); err != nil {
+		t.Fatalf("expected CopyToIncremental to work, got: %v", err)
+	}
+	check(ic.Store().GetCollection("x"), "second incremental copy",
+		"v7", "v6", "v5")
+	x2.Delete([]byte("k"))
+	if i, err := x2.GetVersion([]byte("k"), 1); err != nil || i != nil {
+		t.Errorf("expected no versions after a delete, got: %v, %v", i, err)
+	}
+	x2.Set([]byte("k"), []byte("new"))
+	if i, _ := x2.GetVersion([]byte("k"), 1); i != nil {
+		t.Errorf("expected no versions of a new item, got: %v", i)
+	}
+}
+
+func TestVisitBatch(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	if err := x.VisitBatch(nil, true, 0, nil); err == nil {
+		t.Errorf("expected VisitBatch with no batch size to fail")
+	}
+	for i := 0; i < 10; i++ {
+		x.Set([]byte(fmt.Sprintf("%02d", i)), []byte(fmt.Sprintf("v%v", i)))
+	}
+	batches := func(start string, batchSize, stopAfter int) []string {
+		var res []string
+		err := x.VisitBatch([]byte(start), true, batchSize, func(items []*Item) bool {
+			var keys []string
+			for _, i := range items {
+				if string(i.Val) != "v"+strings.TrimPrefix(string(i.Key), "0") {
+					t.Errorf("expected the value of %q, got: %q", i.Key, i.Val)
+				}
+				keys = append(keys, string(i.Key))
+			}
+			res = append(res, strings.Join(keys, ","))
+			return len(res) < stopAfter
+		})
+		if err != nil {
+			t.Errorf("expected VisitBatch to work, got: %v", err)
+		}
+		return res
+	}
+	tests := []struct {
+		start     string
+		batchSize int
+		stopAfter int
+		exp       string
+	}{
+		{"", 3, 100, "00,01,02|03,04,05|06,07,08|09"},
+		{"", 5, 100, "00,01,02,03,04|05,06,07,08,09"},
+		{"", 20, 100, "00,01,02,03,04,05,06,07,08,09"},
+		{"04", 4, 100, "04,05,06,07|08,09"},
+		{"", 3, 2, "00,01,02|03,04,05"},
+		{"", 5, 1, "00,01,02,03,04"},
+		{"99", 3, 100, ""},
+	}
+	for _, test := range tests {
+		if got := strings.Join(batches(test.start, test.batchSize, test.stopAfter),
+			"|"); got != test.exp {
+			t.Errorf("expected batches of %+v to be %v, got: %v", test, test.exp, got)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	f := NewMemStoreFile()
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	if _, err := x.Subscribe(nil, nil, 0); err == nil {
+		t.Errorf("expected Subscribe without a buffer to fail")
+	}
+	if _, err := x.Subscribe([]byte("b"), []byte("a"), 10); err == nil {
+		t.Errorf("expected Subscribe of an empty range to fail")
+	}
+	all, _ := x.Subscribe(nil, nil, 100)
+	bc, _ := x.Subscribe([]byte("b"), []byte("d"), 100)
+	cz, _ := x.Subscribe([]byte("c"), nil, 100)
+	events := func(sub *Subscription) string {
+		var res []string
+		for {
+			select {
+			case ev, ok := <-sub.Events():
+				if !ok {
+					res = append(res, "closed")
+					return strings.Join(res, " ")
+				}
+				switch ev.Type {
+				case ChangeRange:
+					res = append(res, fmt.Sprintf("%v:%s-%s", ev.Type, ev.Key, ev.LastKey))
+				default:
+					res = append(res, fmt.Sprintf("%v:%s:%v", ev.Type, ev.Key, ev.OldValPresent))
+				}
+			default:
+				return strings.Join(res, " ")
+			}
+		}
+	}
+	x.Set([]byte("a"), []byte("1"))
+	x.Set([]byte("b"), []byte("1"))
+	x.Set([]byte("c"), []byte("1"))
+	x.Set([]byte("c"), []byte("2"))
+	x.Set([]byte("d"), []byte("1"))
+	x.Delete([]byte("b"))
+	x.Delete([]byte("missing"))
+	for _, test := range []struct {
+		sub *Subscription
+		exp string
+	}{
+		{all, "set:a:false set:b:false set:c:false set:c:true set:d:false delete:b:true"},
+		{bc, "set:b:false set:c:false set:c:true delete:b:true"},
+		{cz, "set:c:false set:c:true set:d:false"},
+	} {
+		if got := events(test.sub); got != test.exp {
+			t.Errorf("expected events: %v, got: %v", test.exp, got)
+		}
+	}
+	gen := s.Generation()
+	s.Flush()
+	x.Set([]byte("e"), []byte("1"))
+	if ev := <-all.Events(); ev.FlushGen != gen+1 {
+		t.Errorf("expected the flush generation %v, got: %v", gen+1, ev.FlushGen)
+	}
+	events(cz)
+
+	// The bulk mutations send a single range event.
+	var keys [][]byte
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("m%04d", i)))
+		x.Set(keys[i], []byte("1"))
+	}
+	events(all)
+	events(cz)
+	dels := append([][]byte{[]byte("nope")}, keys[10:20]...)
+	if n, err := x.DeleteMulti(dels); err != nil || n != 10 {
+		t.Fatalf("expected DeleteMulti to work, got: %v, %v", n, err)
+	}
+	// The sets overflowed the channel.
+	if got := events(all); got != "missed::false range:m0010-m0019" {
+		t.Errorf("expected a range event of DeleteMulti, got: %v", got)
+	}
+	if got := events(bc); got != "" {
+		t.Errorf("expected no events outside of the range, got: %v", got)
+	}
+	if got := events(cz); got != "missed::false range:m0010-m0019" {
+		t.Errorf("expected a range event of DeleteMulti, got: %v", got)
+	}
+	n, err := x.ReadJSON(strings.NewReader(
+		`[{"keyStr":"c2"},{"keyStr":"a2"},{"keyStr":"b2"}]`))
+	if err != nil || n != 3 {
+		t.Fatalf("expected ReadJSON to work, got: %v, %v", n, err)
+	}
+	for _, sub := range []*Subscription{all, bc, cz} {
+		if got := events(sub); got != "range:a2-c2" {
+			t.Errorf("expected a range event of ReadJSON, got: %v", got)
+		}
+	}
+	x.StartWriter(100)
+	x.Set([]byte("w"), []byte("1"))
+	x.Delete([]byte("w"))
+	x.StopWriter()
+	if got := events(cz); got != "range:w-w range:w-w" {
+		t.Errorf("expected range events of the writer, got: %v", got)
+	}
+	events(all)
+
+	// A full channel drops events and then reports them missed.
+	small, _ := x.Subscribe(nil, nil, 2)
+	for i := 0; i < 5; i++ {
+		x.Set([]byte("k"), []byte("1"))
+	}
+	if got := events(small); got != "set:k:false set:k:true" {
+		t.Errorf("expected the events that fit, got: %v", got)
+	}
+	if small.Dropped() != 3 {
+		t.Errorf("expected 3 dropped events, got: %v", small.Dropped())
+	}
+	x.Set([]byte("k"), []byte("1"))
+	if got := events(small); got != "missed::false set:k:true" {
+		t.Errorf("expected a missed event first, got: %v", got)
+	}
+	for i := 0; i < 5; i++ {
+		x.Set([]byte("k"), []byte("1"))
+	}
+	done := make(chan error)
+	go func() { done <- small.Close() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected Close to work, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected Close of a full subscription not to block")
+	}
+	if small.Close() == nil {
+		t.Errorf("expected a second Close to fail")
+	}
+	if got := events(small); got != "set:k:true set:k:true closed" {
+		t.Errorf("expected the buffered events and then closed, got: %v", got)
+	}
+	x.Set([]byte("k"), []byte("1"))
+	if len(x.subscriptions()) != 3 {
+		t.Errorf("expected closed subscriptions to be dropped, got: %v",
+			len(x.subscriptions()))
+	}
+	events(all)
+	s.Close()
+	if got := events(all); got != "closed" {
+		t.Errorf("expected Close of the store to close subscriptions, got: %v", got)
+	}
+}
+
+func TestCollectionCompact(t *testing.T) {
+	f := NewMemStoreFile()
+	s, _ := NewStore(f)
+	churn := s.SetCollection("churn", nil)
+	static := s.SetCollection("static", nil)
+	if err := churn.Compact(); err == nil {
+		t.Errorf("expected Compact without free space reuse to fail")
+	}
+	if err := s.SetReuseFreeSpace(true); err != nil {
+		t.Fatalf("expected SetReuseFreeSpace to work, got: %v", err)
+	}
+	snapshot := s.Snapshot()
+	if err := snapshot.GetCollection("churn").Compact(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected Compact of a snapshot to fail, got: %v", err)
+	}
+	snapshot.Close()
+	for i := 0; i < 100; i++ {
+		static.Set([]byte(fmt.Sprintf("s%03d", i)), []byte(fmt.Sprintf("static-%v", i)))
+	}
+	s.Flush()
+	staticRoot := *static.root.root.Loc()
+	staticItems := map[string]string{}
+	static.VisitItemsAscend(nil, true, func(i *Item) bool {
+		staticItems[string(i.Key)] = string(i.Val)
+		return true
+	})
+	exp := map[string]string{}
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 200; i++ {
+			k := fmt.Sprintf("c%03d", (i*7+round*13)%300)
+			v := fmt.Sprintf("churn-%v-%v", round, i)
+			churn.Set([]byte(k), []byte(v))
+			exp[k] = v
+		}
+		s.Flush()
+	}
+	priorities := map[string]int32{}
+	churn.VisitItemsAscend(nil, false, func(i *Item) bool {
+		priorities[string(i.Key)] = i.Priority
+		return true
+	})
+	snapshot = s.Snapshot()
+	if err := churn.Compact(); err != nil {
+		t.Fatalf("expected Compact to work, got: %v", err)
+	}
+	stats, _ := churn.Stats()
+	if stats.NumCompactions != 1 || stats.CompactReclaimedBytes == 0 ||
+		stats.NumDirtyNodes != uint64(len(exp)) {
+		t.Errorf("expected compaction stats, got: %+v", stats)
+	}
+	if st, _ := static.Stats(); st.NumCompactions != 0 {
+		t.Errorf("expected no compaction of the static collection, got: %+v", st)
+	}
+	check := func(what string, c *Collection) {
+		n := 0
+		err := c.VisitItemsAscend(nil, true, func(i *Item) bool {
+			n++
+			if exp[string(i.Key)] != string(i.Val) {
+				t.Errorf("%v: expected %q for %q, got: %q",
+					what, exp[string(i.Key)], i.Key, i.Val)
+			}
+			if priorities[string(i.Key)] != i.Priority {
+				t.Errorf("%v: expected Compact to keep the priorities", what)
+			}
+			return true
+		})
+		if err != nil || n != len(exp) {
+			t.Errorf("%v: expected %v items, got: %v, %v", what, len(exp), n, err)
+		}
+	}
+	check("compacted", churn)
+	check("snapshot", snapshot.GetCollection("churn"))
+	snapshot.Close()
+	before := map[string]uint64{}
+	s.Stats(before)
+	if err := s.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, got: %v", err)
+	}
+	s.Flush()
+	out := map[string]uint64{}
+	s.Stats(out)
+	// The reclaimed bytes are either free or reused by the flushes.
+	if got := out["freeListBytes"] + out["freeListReusedBytes"] -
+		before["freeListReusedBytes"]; got < stats.CompactReclaimedBytes {
+		t.Errorf("expected the reclaimed bytes to be free, got: %v < %v",
+			got, stats.CompactReclaimedBytes)
+	}
+	if loc := static.root.root.Loc(); *loc != staticRoot {
+		t.Errorf("expected the static collection not to be rewritten, got: %v != %v",
+			loc, staticRoot)
+	}
+	s2, err := NewStore(NewMemStoreFileBytes(f.Bytes()))
+	if err != nil {
+		t.Fatalf("expected reopen to work, got: %v", err)
+	}
+	check("reopened", s2.GetCollection("churn"))
+	n := 0
+	s2.GetCollection("static").VisitItemsAscend(nil, true, func(i *Item) bool {
+		n++
+		if staticItems[string(i.Key)] != string(i.Val) {
+			t.Errorf("expected the static item %q to be unchanged, got: %q", i.Key, i.Val)
+		}
+		return true
+	})
+	if n != len(staticItems) {
+		t.Errorf("expected %v static items, got: %v", len(staticItems), n)
+	}
+}
+
+func TestWAL(t *testing.T) {
+	f, wf := NewMemStoreFile(), NewMemStoreFile()
+	s, err := NewStore(f)
+	if err != nil {
+		t.Fatalf("expected NewStore to work, err: %v", err)
+	}
+	if err = s.EnableWAL(wf, 0); err != nil {
+		t.Fatalf("expected EnableWAL to work, err: %v", err)
+	}
+	if err = s.EnableWAL(wf, 0); err == nil {
+		t.Errorf("expected a second EnableWAL to fail")
+	}
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("a"), []byte("A"))
+	walBeforeFlush := wf.Bytes()
+	if err = s.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, err: %v", err)
+	}
+	if len(wf.Bytes()) != wal_hdrLength {
+		t.Errorf("expected Flush to truncate the WAL, got: %v", len(wf.Bytes()))
+	}
+	x.Set([]byte("b"), []byte("B"))
+	x.Set([]byte("c"), []byte("C"))
+	x.Delete([]byte("a"))
+	s.SetCollection("y", nil).Set([]byte("k"), []byte("K"))
+	s.SetCollection("z", nil).Set([]byte("z"), []byte("Z"))
+	s.RemoveCollection("z")
+	if err = s.FlushRevert(); err == nil {
+		t.Errorf("expected FlushRevert to fail with the WAL")
+	}
+	if err = s.RenameCollection("y", "yy"); err == nil {
+		t.Errorf("expected RenameCollection to fail with the WAL")
+	}
+
+	// As if the process were killed after the WAL was synced, but
+	// before a Flush().
+	fb, wb := f.Bytes(), wf.Bytes()
+	reopen := func(wb []byte) (*Store, *MemStoreFile) {
+		s2, err := NewStore(NewMemStoreFileBytes(fb))
+		if err != nil {
+			t.Fatalf("expected reopen to work, err: %v", err)
+		}
+		wf2 := NewMemStoreFileBytes(wb)
+		if err = s2.EnableWAL(wf2, 0); err != nil {
+			t.Fatalf("expected EnableWAL of the reopened store to work, err: %v", err)
+		}
+		return s2, wf2
+	}
+	check := func(s2 *Store, name string, expected string) {
+		got := ""
+		if c := s2.GetCollection(name); c != nil {
+			c.VisitItemsAscend(nil, true, func(i *Item) bool {
+				got += string(i.Key) + "=" + string(i.Val) + " "
+				return true
+			})
+		} else {
+			got = "<none>"
+		}
+		if got != expected {
+			t.Errorf("expected %v to be %q, got: %q", name, expected, got)
+		}
+	}
+	s2, _ := reopen(wb)
+	check(s2, "x", "b=B c=C ")
+	check(s2, "y", "k=K ")
+	check(s2, "z", "<none>")
+	s2.Close()
+
+	// A corrupt last record and everything after it is discarded.
+	lastRecord := wal_recordHdrLength + wal_bodyHdrLength + len("z")
+	yRecord := wal_recordHdrLength + wal_bodyHdrLength + len("y") + len("kK")
+	zRecord := wal_recordHdrLength + wal_bodyHdrLength + len("z") + len("zZ")
+	corrupt := append([]byte(nil), wb...)
+	corrupt[len(corrupt)-lastRecord-zRecord-yRecord+wal_recordHdrLength+10] ^= 0xff
+	s2, wf2 := reopen(corrupt)
+	check(s2, "x", "b=B c=C ")
+	check(s2, "y", "<none>")
+	check(s2, "z", "<none>")
+	if len(wf2.Bytes()) != len(wb)-lastRecord-zRecord-yRecord {
+		t.Errorf("expected the corrupt WAL tail to be truncated, got: %v", len(wf2.Bytes()))
+	}
+	s2.SetCollection("y", nil).Set([]byte("j"), []byte("J"))
+	s2.Close()
+	s3, err := NewStore(NewMemStoreFileBytes(fb))
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+	if err = s3.EnableWAL(NewMemStoreFileBytes(wf2.Bytes()), 0); err != nil {
+		t.Fatalf("expected EnableWAL to work, err: %v", err)
+	}
+	check(s3, "y", "j=J ")
+	s3.Close()
+
+	// A torn last record is discarded.
+	s2, _ = reopen(wb[:len(wb)-3])
+	check(s2, "x", "b=B c=C ")
+	check(s2, "y", "k=K ")
+	check(s2, "z", "z=Z ")
+	s2.Close()
+
+	// The records from before the last Flush() aren't replayed.
+	if err = s.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, err: %v", err)
+	}
+	fb = f.Bytes()
+	s2, _ = reopen(walBeforeFlush)
+	check(s2, "x", "b=B c=C ")
+	s2.Close()
+
+	if err = s.DisableWAL(); err != nil {
+		t.Errorf("expected DisableWAL to work, err: %v", err)
+	}
+	if err = s.DisableWAL(); err == nil {
+		t.Errorf("expected a second DisableWAL to fail")
+	}
+	if err = s.EnableWAL(NewMemStoreFileBytes([]byte("0g1r2l\x00\x00\x00\x01")), 0); err == nil {
+		t.Errorf("expected EnableWAL of a bad WAL to fail")
+	}
+
+	// A periodically synced WAL.
+	wf = NewMemStoreFile()
+	if err = s.EnableWAL(wf, time.Millisecond); err != nil {
+		t.Fatalf("expected EnableWAL to work, err: %v", err)
+	}
+	x.Set([]byte("d"), []byte("D"))
+	s.Close()
+	fb = f.Bytes()
+	s2, _ = reopen(wf.Bytes())
+	check(s2, "x", "b=B c=C d=D ")
+	s2.Close()
+}
+
+func TestFirstNLastN(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	keys := func(items []*Item, err error) string {
+		if err != nil {
+			t.Errorf("expected no err, got: %v", err)
+		}
+		res := ""
+		for _, i := range items {
+			res += string(i.Key)
+		}
+		return res
+	}
+	if got := keys(x.FirstN(3, true)); got != "" {
+		t.Errorf("expected no items of an empty collection, got: %v", got)
+	}
+	for _, k := range []string{"c", "a", "e", "b", "d"} {
+		x.Set([]byte(k), []byte(k))
+	}
+	for _, test := range []struct {
+		n           int
+		first, last string
+	}{
+		{0, "", ""},
+		{1, "a", "e"},
+		{3, "abc", "edc"},
+		{5, "abcde", "edcba"},
+		{10, "abcde", "edcba"},
+	} {
+		if got := keys(x.FirstN(test.n, true)); got != test.first {
+			t.Errorf("expected FirstN(%v) %v, got: %v", test.n, test.first, got)
+		}
+		if got := keys(x.LastN(test.n, false)); got != test.last {
+			t.Errorf("expected LastN(%v) %v, got: %v", test.n, test.last, got)
+		}
+	}
+	items, _ := x.LastN(2, true)
+	if string(items[0].Val) != "e" {
+		t.Errorf("expected LastN with values, got: %v", string(items[0].Val))
+	}
+	if _, err := x.FirstN(-1, true); err == nil {
+		t.Errorf("expected FirstN(-1) to fail")
+	}
+}
+
+func TestNewStoreOpts(t *testing.T) {
+	f := NewMemStoreFile()
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("%04d", i))
+		x.Set(k, k)
+	}
+	s.SetCollection("y", nil).Set([]byte("y"), []byte("Y"))
+	if err := s.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, err: %v", err)
+	}
+	rnl := x.rootAddRef()
+	root, _ := rnl.root.read(s)
+	rootItem, _ := root.item.read(x, false)
+	leftLoc := *root.left.Loc()
+	leftNode, _ := root.left.read(s)
+	numLost := leftNode.numNodes
+	x.rootDecRef(rnl)
+	s.Close()
+
+	_, report, err := NewStoreOpts(NewMemStoreFileBytes(f.Bytes()),
+		StoreCallbacks{}, OpenOptions{Strict: true})
+	if err != nil || len(report.Anomalies) != 0 ||
+		report.Collections["x"].NumItems != 1000 ||
+		report.Collections["y"].NumItems != 1 {
+		t.Errorf("expected a clean strict open, err: %v, report: %#v", err, report)
+	}
+
+	// Corrupts the left child of the root node, so that its item and
+	// children locs are bogus.
+	b := f.Bytes()
+	for j := 0; j < int(leftLoc.Length); j++ {
+		b[leftLoc.Offset+int64(j)] = 0xff
+	}
+	if s, _, err = NewStoreOpts(NewMemStoreFileBytes(b),
+		StoreCallbacks{}, OpenOptions{Strict: true}); err == nil || s != nil {
+		t.Errorf("expected a strict open of a corrupt file to fail")
+	}
+	if _, _, err = NewStoreOpts(NewMemStoreFileBytes(b),
+		StoreCallbacks{}, OpenOptions{}); err == nil {
+		t.Errorf("expected a default open of a corrupt file to fail")
+	}
+	if _, _, err = NewStoreOpts(NewMemStoreFileBytes(b),
+		StoreCallbacks{}, OpenOptions{Strict: true, Salvage: true}); err == nil {
+		t.Errorf("expected strict and salvage to fail")
+	}
+	sf := NewMemStoreFileBytes(b)
+	s, report, err = NewStoreOpts(sf, StoreCallbacks{}, OpenOptions{Salvage: true})
+	if err != nil {
+		t.Fatalf("expected a salvage open to work, err: %v", err)
+	}
+	if report.Collections["x"].NumItems != 1000-numLost ||
+		report.Collections["y"].NumItems != 1 {
+		t.Errorf("expected the reachable items, got: %#v", report.Collections)
+	}
+	if len(report.Anomalies) == 0 {
+		t.Fatalf("expected anomalies")
+	}
+	for _, a := range report.Anomalies {
+		if a.Collection != "x" || a.Err == nil {
+			t.Errorf("expected an anomaly of x, got: %#v", a)
+		}
+	}
+	if a := report.Anomalies[0]; a.Offset != -1 || !errors.Is(a.Err, ErrCorrupt) {
+		t.Errorf("expected the first anomaly at a bogus loc, got: %#v", a)
+	}
+	check := func(s *Store) {
+		x := s.GetCollection("x")
+		numItems := uint64(0)
+		err := x.VisitItemsAscend(nil, true, func(i *Item) bool {
+			if bytes.Compare(i.Key, rootItem.Key) < 0 || !bytes.Equal(i.Key, i.Val) {
+				t.Errorf("expected an unaffected key, got: %s", i.Key)
+			}
+			numItems++
+			return true
+		})
+		if err != nil || numItems != 1000-numLost {
+			t.Errorf("expected the salvaged items, got: %v, err: %v", numItems, err)
+		}
+		if n, _, _ := x.GetTotals(); n != 1000-numLost {
+			t.Errorf("expected the totals of the salvaged items, got: %v", n)
+		}
+	}
+	check(s)
+	if err = s.Flush(); err != nil {
+		t.Fatalf("expected Flush of the salvaged store to work, err: %v", err)
+	}
+	s.Close()
+	s, report, err = NewStoreOpts(NewMemStoreFileBytes(sf.Bytes()),
+		StoreCallbacks{}, OpenOptions{Strict: true})
+	if err != nil || len(report.Anomalies) != 0 {
+		t.Fatalf("expected a strict open of the salvaged file, err: %v", err)
+	}
+	check(s)
+	s.Close()
+
+	// Bytes after the last roots record.
+	b = append(f.Bytes(), "garbage"...)
+	if _, _, err = NewStoreOpts(NewMemStoreFileBytes(b),
+		StoreCallbacks{}, OpenOptions{Strict: true}); err == nil {
+		t.Errorf("expected a strict open with discarded bytes to fail")
+	}
+	s, report, err = NewStoreOpts(NewMemStoreFileBytes(b),
+		StoreCallbacks{}, OpenOptions{})
+	if _, ok := err.(*RecoveredError); !ok || s == nil ||
+		len(report.Anomalies) != 1 || report.Anomalies[0].Length != 7 ||
+		report.Anomalies[0].Offset != int64(len(f.Bytes())) {
+		t.Errorf("expected a RecoveredError and its anomaly, err: %v, report: %#v",
+			err, report)
+	}
+}
+
+func TestCopyToFiltered(t *testing.T) {
+	s, _ := NewStore(nil)
+	for _, name := range []string{"a", "b", "c"} {
+		c := s.SetCollection(name, nil)
+		for i := 0; i < 100; i++ {
+			c.Set([]byte(fmt.Sprintf("p:%03d", i)), []byte(name))
+			c.Set([]byte(fmt.Sprintf("q:%03d", i)), []byte(name))
+		}
+	}
+	s.GetCollection("a").SetMeta("m", []byte("M"))
+	check := func(d *Store, expected map[string]uint64) {
+		names := d.GetCollectionNames()
+		if len(names) != len(expected) {
+			t.Errorf("expected collections %v, got: %v", expected, names)
+		}
+		for name, numItems := range expected {
+			c := d.GetCollection(name)
+			if c == nil {
+				t.Errorf("expected collection %v", name)
+				continue
+			}
+			n, numBytes, err := c.GetTotals()
+			if err != nil || n != numItems || numBytes != numItems*6 {
+				t.Errorf("expected %v totals %v, got: %v %v, err: %v",
+					name, numItems, n, numBytes, err)
+			}
+			got := uint64(0)
+			c.VisitItemsAscend(nil, true, func(i *Item) bool {
+				if !bytes.HasPrefix(i.Key, []byte("p:")) || string(i.Val) != name {
+					t.Errorf("expected a p: item of %v, got: %s=%s", name, i.Key, i.Val)
+				}
+				got++
+				return true
+			})
+			if got != numItems {
+				t.Errorf("expected %v items of %v, got: %v", numItems, name, got)
+			}
+		}
+	}
+	prefix := &CollectionFilter{Range: KeyRange{[]byte("p:"), []byte("p;")}}
+	f := NewMemStoreFile()
+	d, err := s.CopyToFiltered(f, 10, CopyFilter{
+		Collections: map[string]*CollectionFilter{"b": prefix},
+	})
+	if err != nil {
+		t.Fatalf("expected CopyToFiltered to work, err: %v", err)
+	}
+	check(d, map[string]uint64{"b": 100})
+	d, err = NewStore(NewMemStoreFileBytes(f.Bytes()))
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+	check(d, map[string]uint64{"b": 100})
+
+	d, err = s.CopyToFiltered(NewMemStoreFile(), 0, CopyFilter{
+		Collections: map[string]*CollectionFilter{
+			"b": &CollectionFilter{
+				Range:     KeyRange{StartKey: []byte("p:")},
+				Predicate: func(i *Item) bool { return i.Key[0] == 'p' && i.Key[4]%2 == 0 },
+			},
+		},
+		KeepEmpty: true,
+	})
+	if err != nil {
+		t.Fatalf("expected CopyToFiltered to work, err: %v", err)
+	}
+	check(d, map[string]uint64{"a": 0, "b": 50, "c": 0})
+	if m := getMeta(d.GetCollection("a"), "m"); string(m) != "M" {
+		t.Errorf("expected the metadata of an empty collection, got: %s", m)
+	}
+
+	d, err = s.CopyToFiltered(NewMemStoreFile(), 0, CopyFilter{})
+	if err != nil {
+		t.Fatalf("expected CopyToFiltered to work, err: %v", err)
+	}
+	if n, _, _ := d.GetCollection("c").GetTotals(); n != 200 {
+		t.Errorf("expected a nil map to copy all, got: %v", n)
+	}
+}
+
+func TestCollectionAdd(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	if total, err := x.Add([]byte("a"), -5); err != nil || total != -5 {
+		t.Errorf("expected Add of a missing key to set it, got: %v, err: %v", total, err)
+	}
+	if total, err := x.Add([]byte("a"), 7); err != nil || total != 2 {
+		t.Errorf("expected Add to add, got: %v, err: %v", total, err)
+	}
+	if v, _ := x.Get([]byte("a")); len(v) != 8 || binary.LittleEndian.Uint64(v) != 2 {
+		t.Errorf("expected a little-endian int64 value, got: %v", v)
+	}
+	x.Add([]byte("max"), math.MaxInt64)
+	if _, err := x.Add([]byte("max"), 1); !errors.Is(err, ErrAddOverflow) {
+		t.Errorf("expected ErrAddOverflow, got: %v", err)
+	}
+	x.Add([]byte("min"), math.MinInt64+1)
+	if _, err := x.Add([]byte("min"), -2); !errors.Is(err, ErrAddOverflow) {
+		t.Errorf("expected ErrAddOverflow, got: %v", err)
+	}
+	if total, _ := x.Add([]byte("max"), 0); total != math.MaxInt64 {
+		t.Errorf("expected an overflow to leave the value, got: %v", total)
+	}
+	x.Set([]byte("s"), []byte("short"))
+	if _, err := x.Add([]byte("s"), 1); err == nil {
+		t.Errorf("expected Add to a value that's not an int64 to fail")
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 20; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				delta := int64(g + 1)
+				if i%2 == 1 {
+					delta = -1
+				}
+				if _, err := x.Add([]byte("total"), delta); err != nil {
+					t.Errorf("expected Add to work, err: %v", err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	expected := int64(0)
+	for g := 0; g < 20; g++ {
+		expected += 100*int64(g+1) - 100
+	}
+	if total, _ := x.Add([]byte("total"), 0); total != expected {
+		t.Errorf("expected the exact total %v, got: %v", expected, total)
+	}
+}
+
+func TestRenameCollectionForce(t *testing.T) {
+	f := NewMemStoreFile()
+	s, _ := NewStore(f)
+	s.SetCollection("live", nil).Set([]byte("k"), []byte("blue"))
+	s.SetCollection("live.new", nil).Set([]byte("k"), []byte("green"))
+	if err := s.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, err: %v", err)
+	}
+	get := func(name string) string {
+		c := s.GetCollection(name)
+		if c == nil {
+			return "<none>"
+		}
+		v, err := c.Get([]byte("k"))
+		if err != nil {
+			return err.Error()
+		}
+		return string(v)
+	}
+
+	// Readers never find the name missing.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if c := s.GetCollection("live"); c == nil {
+					t.Errorf("expected the live name to stay, got none")
+					return
+				}
+			}
+		}()
+	}
+	live := s.GetCollection("live")
+	if err := s.RenameCollectionEx("live.new", "live", true); err != nil {
+		t.Errorf("expected a forced rename to work, err: %v", err)
+	}
+	close(stop)
+	wg.Wait()
+	if got := get("live"); got != "green" {
+		t.Errorf("expected the renamed collection, got: %v", got)
+	}
+	if got := get("live.new"); got != "<none>" {
+		t.Errorf("expected the old name to be gone, got: %v", got)
+	}
+	if _, err := live.Get([]byte("k")); !errors.Is(err, ErrCollectionMissing) {
+		t.Errorf("expected the displaced Collection to be closed, got: %v", err)
+	}
+	if err := s.RenameCollectionEx("nope", "live", true); !errors.Is(err, ErrCollectionMissing) {
+		t.Errorf("expected ErrCollectionMissing, got: %v", err)
+	}
+
+	// A FlushRevert() of the Flush() of the rename brings back both.
+	if err := s.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, err: %v", err)
+	}
+	if err := s.FlushRevert(); err != nil {
+		t.Fatalf("expected FlushRevert to work, err: %v", err)
+	}
+	if got := get("live") + "," + get("live.new"); got != "blue,green" {
+		t.Errorf("expected the reverted names, got: %v", got)
+	}
+	if err := s.RenameCollectionEx("live.new", "live", true); err != nil {
+		t.Errorf("expected a forced rename to work, err: %v", err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, err: %v", err)
+	}
+	s2, err := NewStore(NewMemStoreFileBytes(f.Bytes()))
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+	if names := s2.GetCollectionNames(); strings.Join(names, ",") != "live" {
+		t.Errorf("expected the persisted rename, got: %v", names)
+	}
+	if v, _ := s2.GetCollection("live").Get([]byte("k")); string(v) != "green" {
+		t.Errorf("expected the persisted renamed collection, got: %s", v)
+	}
+}
+
+func TestFormatVersion(t *testing.T) {
+	f := NewMemStoreFile()
+	s, _ := NewStore(f)
+	if v := s.FormatVersion(); v != int(VERSION) {
+		t.Errorf("expected the VERSION of a new file, got: %v", v)
+	}
+	s.SetCollection("x", nil).Set([]byte("a"), []byte("A"))
+	if err := s.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, err: %v", err)
+	}
+	// Returns the file with the version of its last roots record patched.
+	withVersion := func(version uint32) []byte {
+		b := f.Bytes()
+		offset := binary.BigEndian.Uint64(b[len(b)-rootsEndLen:])
+		binary.BigEndian.PutUint32(b[offset+uint64(2*len(MAGIC_BEG)):], version)
+		return b
+	}
+
+	var migrated []int
+	migrate := func(old, new int) error {
+		migrated = append(migrated, old, new)
+		return nil
+	}
+	s2, err := NewStoreEx(NewMemStoreFileBytes(withVersion(VERSION)),
+		StoreCallbacks{Migrate: migrate})
+	if err != nil || s2.FormatVersion() != int(VERSION) || migrated != nil {
+		t.Errorf("expected a current file to need no migration, err: %v, migrated: %v",
+			err, migrated)
+	}
+
+	old := NewMemStoreFileBytes(withVersion(VERSION - 1))
+	s2, err = NewStoreEx(old, StoreCallbacks{Migrate: migrate})
+	if err != nil {
+		t.Fatalf("expected an older file to open, err: %v", err)
+	}
+	if s2.FormatVersion() != int(VERSION)-1 ||
+		fmt.Sprint(migrated) != fmt.Sprint([]int{int(VERSION) - 1, int(VERSION)}) {
+		t.Errorf("expected the older version and its migration, got: %v, migrated: %v",
+			s2.FormatVersion(), migrated)
+	}
+	if v, _ := s2.GetCollection("x").Get([]byte("a")); string(v) != "A" {
+		t.Errorf("expected the items of an older file, got: %s", v)
+	}
+	if err = s2.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, err: %v", err)
+	}
+	if s2.FormatVersion() != int(VERSION) {
+		t.Errorf("expected Flush to upgrade the version, got: %v", s2.FormatVersion())
+	}
+	s3, err := NewStore(NewMemStoreFileBytes(old.Bytes()))
+	if err != nil || s3.FormatVersion() != int(VERSION) {
+		t.Errorf("expected the upgraded file, err: %v", err)
+	}
+
+	refused := errors.New("refused")
+	if _, err = NewStoreEx(NewMemStoreFileBytes(withVersion(VERSION-1)),
+		StoreCallbacks{Migrate: func(old, new int) error { return refused }}); err != refused {
+		t.Errorf("expected Migrate to refuse the open, got: %v", err)
+	}
+	if _, err = NewStore(NewMemStoreFileBytes(withVersion(VERSION + 1))); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected ErrUnsupportedVersion for a future version, got: %v", err)
+	}
+	if _, err = NewStore(NewMemStoreFileBytes(withVersion(3))); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected ErrUnsupportedVersion for an ancient version, got: %v", err)
+	}
+}
+
+func TestNodePool(t *testing.T) {
+	pool := &sync.Pool{}
+	s0, _ := NewStoreEx(nil, StoreCallbacks{NodePool: pool})
+	x0 := s0.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		x0.Set([]byte(fmt.Sprintf("%03d", i)), []byte("v"))
+	}
+	snap := s0.Snapshot()
+	for i := 0; i < 100; i++ {
+		x0.Delete([]byte(fmt.Sprintf("%03d", i)))
+	}
+	if n, _, _ := snap.GetCollection("x").GetTotals(); n != 100 {
+		t.Errorf("expected the snapshot to keep its 100 items, got: %v", n)
+	}
+	snap.Close()
+	if fs := s0.AllocStats().FreeNodes; fs != 0 {
+		t.Errorf("expected no free list with a NodePool, got: %v", fs)
+	}
+	s1, _ := NewStoreEx(nil, StoreCallbacks{NodePool: pool})
+	x1 := s1.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		x1.Set([]byte(fmt.Sprintf("%03d", i)), []byte(strconv.Itoa(i)))
+	}
+	if s1.AllocStats().NodePoolGets == 0 {
+		t.Errorf("expected nodes from the pool")
+	}
+	for i := 0; i < 100; i++ {
+		v, err := x1.Get([]byte(fmt.Sprintf("%03d", i)))
+		if err != nil || string(v) != strconv.Itoa(i) {
+			t.Errorf("expected %v, got: %q, %v", i, v, err)
+		}
+	}
+	if n, _, _ := x0.GetTotals(); n != 0 {
+		t.Errorf("expected no items, got: %v", n)
+	}
+	s0.Close()
+	s1.Close()
+}
+
+func TestListCollections(t *testing.T) {
+	f := NewMemStoreFile()
+	s, _ := NewStore(f)
+	var changes []string
+	s.OnCollectionsChanged(func(added, removed []string) {
+		changes = append(changes, fmt.Sprintf("+%v-%v", added, removed))
+	})
+	s.SetCollection("b", nil).Set([]byte("k"), []byte("v"))
+	s.SetCollection("a", func(a, b []byte) int { return bytes.Compare(b, a) })
+	s.SetCollection("b", nil)
+	infos, err := s.ListCollections()
+	if err != nil || len(infos) != 2 {
+		t.Fatalf("expected 2 infos, got: %v, %v", infos, err)
+	}
+	if infos[0].Name != "b" || infos[0].NumItems != 1 || infos[0].NumBytes != 2 ||
+		!infos[0].Dirty || infos[0].CustomCompare {
+		t.Errorf("expected dirty b of 1 item, got: %+v", infos[0])
+	}
+	if infos[1].Name != "a" || infos[1].NumItems != 0 || infos[1].Dirty ||
+		!infos[1].CustomCompare {
+		t.Errorf("expected empty a with custom compare, got: %+v", infos[1])
+	}
+	s.Flush()
+	if infos, _ = s.ListCollections(); infos[0].Dirty {
+		t.Errorf("expected flushed b, got: %+v", infos[0])
+	}
+	s.RenameCollection("b", "c")
+	s.RemoveCollection("a")
+	s.RemoveCollection("missing")
+	s.Flush()
+	s.FlushRevert()
+	exp := []string{"+[b]-[]", "+[a]-[]", "+[c]-[b]", "+[]-[a]", "+[a b]-[c]"}
+	if strings.Join(changes, " ") != strings.Join(exp, " ") {
+		t.Errorf("expected changes %v, got: %v", exp, changes)
+	}
+	s.OnCollectionsChanged(nil)
+	s.SetCollection("d", nil)
+	if len(changes) != len(exp) {
+		t.Errorf("expected no changes after unregistering, got: %v", changes)
+	}
+	if infos, _ = s.ListCollections(); len(infos) != 3 || infos[0].Name != "a" ||
+		infos[1].Name != "b" || infos[2].Name != "d" || infos[0].CustomCompare {
+		t.Errorf("expected read collections by name, then d, got: %+v", infos)
+	}
+	s.Close()
+	if _, err = s.ListCollections(); err != ErrStoreClosed {
+		t.Errorf("expected ErrStoreClosed, got: %v", err)
+	}
+}
+
+func keyCompareRegistryRemove(name string) {
+	keyComparesLock.Lock()
+	delete(keyCompares, name)
+	keyComparesLock.Unlock()
+}
+
+func TestNamedKeyCompare(t *testing.T) {
+	caseInsensitive := func(a, b []byte) int {
+		return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b))
+	}
+	f := NewMemStoreFile()
+	s, _ := NewStore(f)
+	if _, err := s.SetCollectionNamedCompare("x", "testCaseInsensitive"); !errors.Is(err, ErrUnknownComparator) {
+		t.Errorf("expected ErrUnknownComparator, got: %v", err)
+	}
+	s.SetCollection("plain", nil).Set([]byte("B"), []byte("v"))
+	s.Flush()
+	s.Close()
+	if err := RegisterKeyCompare("testCaseInsensitive", caseInsensitive); err != nil {
+		t.Fatalf("expected register to work, got: %v", err)
+	}
+	if err := RegisterKeyCompare("testCaseInsensitive", caseInsensitive); err == nil {
+		t.Errorf("expected a second register to fail")
+	}
+	s, _ = NewStore(f)
+	x, err := s.SetCollectionNamedCompare("x", "testCaseInsensitive")
+	if err != nil || x.CompareName() != "testCaseInsensitive" {
+		t.Fatalf("expected a named compare, got: %v, %v", x, err)
+	}
+	for _, k := range []string{"b", "A", "c"} {
+		x.Set([]byte(k), []byte(k))
+	}
+	s.Flush()
+	s.Close()
+
+	keyCompareRegistryRemove("testCaseInsensitive")
+	if _, err = NewStore(f); !errors.Is(err, ErrUnknownComparator) ||
+		!strings.Contains(err.Error(), "testCaseInsensitive") {
+		t.Errorf("expected ErrUnknownComparator with the name, got: %v", err)
+	}
+	RegisterKeyCompare("testCaseInsensitive", caseInsensitive)
+	defer keyCompareRegistryRemove("testCaseInsensitive")
+	s, err = NewStoreEx(f, StoreCallbacks{
+		KeyCompareForCollection: func(collName string) KeyCompare {
+			return func(a, b []byte) int { return -bytes.Compare(a, b) }
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected reopen to work, got: %v", err)
+	}
+	x = s.GetCollection("x")
+	var keys []string
+	x.VisitItemsAscend(nil, true, func(i *Item) bool {
+		keys = append(keys, string(i.Key))
+		return true
+	})
+	if strings.Join(keys, ",") != "A,b,c" || x.CompareName() != "testCaseInsensitive" {
+		t.Errorf("expected case insensitive keys, got: %v", keys)
+	}
+	if v, _ := x.Get([]byte("B")); string(v) != "b" {
+		t.Errorf("expected a case insensitive get, got: %q", v)
+	}
+	if s.GetCollection("plain").CompareName() != "" {
+		t.Errorf("expected an unnamed compare for plain")
+	}
+	s.RenameCollection("x", "y")
+	s.SetCollection("plain", nil)
+	if s.GetCollection("y").CompareName() != "testCaseInsensitive" {
+		t.Errorf("expected the rename to keep the compare name")
+	}
+	s.Close()
+}
+
+func TestMaxTreeDepth(t *testing.T) {
+	s, _ := NewStore(nil)
+	if err := s.SetMaxTreeDepth(-1); err == nil {
+		t.Errorf("expected a negative max depth to fail")
+	}
+	s.SetMaxTreeDepth(50)
+	x := s.SetCollection("x", nil)
+	// Descending priorities for ascending keys make a right spine.
+	set := func(i int) error {
+		return x.SetItem(&Item{Key: []byte(fmt.Sprintf("%05d", i)),
+			Val: []byte("v"), Priority: int32(1000 - i)})
+	}
+	for i := 0; i <= 50; i++ {
+		if err := set(i); err != nil {
+			t.Fatalf("expected set %v to work, got: %v", i, err)
+		}
+	}
+	err := set(51)
+	var le *LimitError
+	if !errors.Is(err, ErrTreeTooDeep) || !errors.As(err, &le) ||
+		le.Limit != 50 || le.Size != 51 {
+		t.Errorf("expected ErrTreeTooDeep at 51, got: %v", err)
+	}
+	if n, _ := x.Count(); n != 51 {
+		t.Errorf("expected the failed set to change nothing, got: %v", n)
+	}
+	if _, err = x.Delete([]byte("00050")); err != nil {
+		t.Errorf("expected delete at the max depth to work, got: %v", err)
+	}
+	set(50)
+	s.SetMaxTreeDepth(10)
+	if _, err = x.Delete([]byte("00011")); !errors.Is(err, ErrTreeTooDeep) {
+		t.Errorf("expected a deep delete to fail, got: %v", err)
+	}
+	visited := 0
+	err = x.VisitItemsAscend(nil, true, func(i *Item) bool {
+		visited++
+		return true
+	})
+	if !errors.Is(err, ErrTreeTooDeep) || visited != 11 {
+		t.Errorf("expected a visit of 11 items and then ErrTreeTooDeep, got: %v, %v",
+			visited, err)
+	}
+	snap := s.Snapshot()
+	if err = snap.GetCollection("x").VisitItemsAscend(nil, false,
+		func(i *Item) bool { return true }); !errors.Is(err, ErrTreeTooDeep) {
+		t.Errorf("expected the snapshot to have the limit, got: %v", err)
+	}
+	snap.Close()
+	s.SetMaxTreeDepth(0)
+	if err = set(51); err != nil {
+		t.Errorf("expected no limit, got: %v", err)
+	}
+	if n, _ := x.Count(); n != 52 {
+		t.Errorf("expected 52 items, got: %v", n)
+	}
+}
+
+func TestBuiltinKeyCompares(t *testing.T) {
+	u64 := func(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+	tests := []struct {
+		name    string
+		compare KeyCompare
+		keys    [][]byte
+	}{
+		{"ignoreCase", CompareIgnoreCase, [][]byte{[]byte("a"), []byte("B"),
+			[]byte("ab"), []byte("Ac"), []byte("b1"), []byte("_"), []byte("Z")}},
+		{"uint64BE", CompareUint64BE, [][]byte{u64(0), {1}, {0, 2}, u64(255),
+			{1, 0}, u64(1 << 40), u64(^uint64(0)), {0xff, 0xff}}},
+		{"reverse", CompareReverse(nil), [][]byte{[]byte("a"), []byte("b"),
+			[]byte("ab"), []byte("zz"), []byte("z")}},
+		{"reverseIgnoreCase", CompareReverse(CompareIgnoreCase), [][]byte{
+			[]byte("a"), []byte("B"), []byte("c"), []byte("Cd")}},
+	}
+	for _, test := range tests {
+		for round := 0; round < 20; round++ {
+			s, _ := NewStore(nil)
+			x := s.SetCollection("x", test.compare)
+			keys := append([][]byte(nil), test.keys...)
+			rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+			for _, k := range keys {
+				x.Set(k, k)
+			}
+			sort.Slice(keys, func(i, j int) bool { return test.compare(keys[i], keys[j]) < 0 })
+			var asc, desc [][]byte
+			x.VisitItemsAscend(nil, false, func(i *Item) bool {
+				asc = append(asc, i.Key)
+				return true
+			})
+			max, _ := x.MaxItem(false)
+			x.VisitItemsDescend(max.Key, false, func(i *Item) bool {
+				desc = append([][]byte{i.Key}, desc...)
+				return true
+			})
+			desc = append(desc, max.Key)
+			if fmt.Sprint(asc) != fmt.Sprint(keys) || fmt.Sprint(desc) != fmt.Sprint(keys) {
+				t.Fatalf("%s: expected order %q, got: %q, %q", test.name, keys, asc, desc)
+			}
+			if min, _ := x.MinItem(false); !bytes.Equal(min.Key, keys[0]) {
+				t.Errorf("%s: expected min %q, got: %q", test.name, keys[0], min.Key)
+			}
+			var from [][]byte
+			x.VisitItemsAscend(keys[2], false, func(i *Item) bool {
+				from = append(from, i.Key)
+				return true
+			})
+			if fmt.Sprint(from) != fmt.Sprint(keys[2:]) {
+				t.Errorf("%s: expected %q from %q, got: %q", test.name, keys[2:], keys[2], from)
+			}
+			if deleted, err := x.Delete(keys[1]); !deleted || err != nil {
+				t.Errorf("%s: expected delete of %q, got: %v, %v", test.name, keys[1], deleted, err)
+			}
+			if v, _ := x.Get(keys[3]); !bytes.Equal(v, keys[3]) {
+				t.Errorf("%s: expected get of %q, got: %q", test.name, keys[3], v)
+			}
+			if n, _ := x.Count(); n != uint64(len(keys)-1) {
+				t.Errorf("%s: expected %v items, got: %v", test.name, len(keys)-1, n)
+			}
+		}
+	}
+	s, _ := NewStore(nil)
+	x, _ := s.SetCollectionNamedCompare("x", "gkvlite.ignoreCase")
+	x.Set([]byte("Key"), []byte("v1"))
+	x.Set([]byte("KEY"), []byte("v2"))
+	if i, _ := x.GetItem([]byte("key"), true); i == nil ||
+		string(i.Key) != "KEY" || string(i.Val) != "v2" {
+		t.Errorf("expected one case insensitive key, got: %v", i)
+	}
+	if n, _ := x.Count(); n != 1 {
+		t.Errorf("expected 1 item, got: %v", n)
+	}
+	y, _ := s.SetCollectionNamedCompare("y", "gkvlite.uint64BE")
+	y.Set([]byte{0, 0, 7}, []byte("v"))
+	if v, _ := y.Get(u64(7)); string(v) != "v" {
+		t.Errorf("expected a numeric key match, got: %q", v)
+	}
+}
+
+// The former, recursive visitItemLocs(), as the reference of the
+// iterative one.
+func visitItemLocsRecursive(o *Store, t *Collection, n *nodeLoc, target []byte,
+	visitor func(iloc *itemLoc, depth uint64) bool, depth uint64,
+	choiceFunc func(int, *node) (bool, *nodeLoc, *nodeLoc)) (bool, error) {
+	nNode, err := n.read(o)
+	if err != nil || n.isEmpty() || nNode == nil {
+		return err == nil, err
+	}
+	nItem, err := nNode.item.read(t, false)
+	if err != nil {
+		return false, err
+	}
+	choice, choiceT, choiceF := choiceFunc(t.compareTarget(target, nItem.Key), nNode)
+	if choice {
+		keepGoing, err := visitItemLocsRecursive(o, t, choiceT, target,
+			visitor, depth+1, choiceFunc)
+		if err != nil || !keepGoing {
+			return false, err
+		}
+		if !visitor(&nNode.item, depth) {
+			return false, nil
+		}
+	}
+	return visitItemLocsRecursive(o, t, choiceF, target, visitor, depth+1, choiceFunc)
+}
+
+// Visits all the items of a collection of 100,000 per op.
+func benchmarkVisitScan(b *testing.B, recursive bool) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 100000; i++ {
+		x.Set([]byte(fmt.Sprintf("%08d", i)), []byte("v"))
+	}
+	root := x.rootAddRef()
+	defer x.rootDecRef(root)
+	n := 0
+	visitor := func(iloc *itemLoc, depth uint64) bool {
+		n++
+		return true
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if recursive {
+			visitItemLocsRecursive(s, x, root.root, nil, visitor, 0, ascendChoice)
+		} else {
+			s.visitItemLocs(x, root.root, nil, visitor, 0, ascendChoice)
+		}
+	}
+	if n != 100000*b.N {
+		b.Fatalf("expected %v visits, got: %v", 100000*b.N, n)
+	}
+}
+
+func BenchmarkVisitScanRecursive(b *testing.B) {
+	benchmarkVisitScan(b, true)
+}
+
+func BenchmarkVisitScanIterative(b *testing.B) {
+	benchmarkVisitScan(b, false)
+}
+
+func TestVisitItemLocsIterative(t *testing.T) {
+	f := NewMemStoreFile()
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 500; i++ {
+		x.Set([]byte(fmt.Sprintf("%04d", rand.Intn(1000))), []byte("v"))
+	}
+	s.Flush()
+	for i := 0; i < 100; i++ { // Some dirty, some evicted.
+		x.Set([]byte(fmt.Sprintf("%04d", rand.Intn(1000))), []byte("v"))
+		x.EvictSomeItems()
+	}
+	choices := map[string]func(int, *node) (bool, *nodeLoc, *nodeLoc){
+		"ascend": ascendChoice, "descend": descendChoice,
+		"descendRange": descendRangeChoice, "ascendAfter": ascendAfterChoice,
+		"ascendAll": ascendAllChoice, "descendAll": descendAllChoice,
+	}
+	root := x.rootAddRef()
+	defer x.rootDecRef(root)
+	for name, choice := range choices {
+		for j := 0; j < 20; j++ {
+			target := []byte(fmt.Sprintf("%04d", rand.Intn(1100)))
+			if j == 0 {
+				target = nil
+			}
+			stopAfter := rand.Intn(600)
+			record := func(res *[]string) func(iloc *itemLoc, depth uint64) bool {
+				return func(iloc *itemLoc, depth uint64) bool {
+					*res = append(*res, fmt.Sprintf("%s@%d", iloc.Item().Key, depth))
+					return len(*res) < stopAfter
+				}
+			}
+			var exp, got []string
+			expOk, expErr := visitItemLocsRecursive(s, x, root.root, target,
+				record(&exp), 0, choice)
+			gotOk, gotErr := s.visitItemLocs(x, root.root, target,
+				record(&got), 0, choice)
+			if strings.Join(exp, " ") != strings.Join(got, " ") ||
+				expOk != gotOk || expErr != nil || gotErr != nil {
+				t.Fatalf("%s from %q: expected %v, %v, %v, got: %v, %v, %v",
+					name, target, exp, expOk, expErr, got, gotOk, gotErr)
+			}
+		}
+	}
+}
+
+func TestMultiCollection(t *testing.T) {
+	visited := func(visit func(v ItemVisitor) error) string {
+		var res []string
+		visit(func(i *Item) bool {
+			res = append(res, fmt.Sprintf("%q=%s", i.Key, i.Val))
+			return true
+		})
+		return strings.Join(res, ",")
+	}
+	joined := func(vals [][]byte) string {
+		return string(bytes.Join(vals, []byte(",")))
+	}
+	f := NewMemStoreFile()
+	s, _ := NewStore(f)
+	s.SetCollection("plain", nil).Set([]byte("b"), []byte("p"))
+	mc := s.SetCollectionMulti("m", nil)
+	// A key that looks like "b" with a sequence suffix.
+	bz := "b\x00\x00\x00\x00\x00\x00\x00\x00"
+	for _, kv := range [][2]string{{"b", "1"}, {"a", "1"}, {"b", "2"},
+		{"b\x00", "1"}, {"b", "3"}, {"ba", "1"}, {bz, "1"}} {
+		if err := mc.Set([]byte(kv[0]), []byte(kv[1])); err != nil {
+			t.Fatalf("expected set to work, got: %v", err)
+		}
+	}
+	if n, _ := mc.Count(); n != 7 {
+		t.Errorf("expected 7 items, got: %v", n)
+	}
+	exp := `"a"=1,"b"=1,"b"=2,"b"=3,"b\x00"=1,` +
+		`"b\x00\x00\x00\x00\x00\x00\x00\x00"=1,"ba"=1`
+	if got := visited(func(v ItemVisitor) error {
+		return mc.VisitItemsAscend(nil, true, v)
+	}); got != exp {
+		t.Errorf("expected duplicates in insertion order, got: %v", got)
+	}
+	if got := visited(func(v ItemVisitor) error {
+		return mc.VisitItemsAscend([]byte("b"), true, v)
+	}); !strings.HasPrefix(got, `"b"=1,"b"=2,"b"=3,"b\x00"=1,`) {
+		t.Errorf("expected ascend from b to include its duplicates, got: %v", got)
+	}
+	if got := visited(func(v ItemVisitor) error {
+		return mc.VisitItemsAscend([]byte("b\x00"), true, v)
+	}); !strings.HasPrefix(got, `"b\x00"=1,"b\x00\x00`) {
+		t.Errorf("expected ascend between duplicates to skip them, got: %v", got)
+	}
+	if got := visited(func(v ItemVisitor) error {
+		return mc.VisitItemsDescend([]byte("b\x00"), true, v)
+	}); got != `"b"=3,"b"=2,"b"=1,"a"=1` {
+		t.Errorf("expected descend in reverse insertion order, got: %v", got)
+	}
+	if got := visited(func(v ItemVisitor) error {
+		return mc.VisitItemsDescend([]byte("b"), true, v)
+	}); got != `"a"=1` {
+		t.Errorf("expected descend from b to exclude its duplicates, got: %v", got)
+	}
+	if vals, _ := mc.GetAll([]byte("b")); joined(vals) != "1,2,3" {
+		t.Errorf("expected all values of b, got: %q", vals)
+	}
+	if v, _ := mc.Get([]byte("b")); string(v) != "1" {
+		t.Errorf("expected the first value of b, got: %q", v)
+	}
+	if v, _ := mc.Get([]byte("c")); v != nil {
+		t.Errorf("expected no value of c, got: %q", v)
+	}
+	if i, _ := mc.MaxItem(true); string(i.Key) != "ba" {
+		t.Errorf("expected max key ba, got: %q", i.Key)
+	}
+	if ok, err := mc.DeleteOne([]byte("b"), 1); !ok || err != nil {
+		t.Errorf("expected DeleteOne to work, got: %v, %v", ok, err)
+	}
+	if ok, _ := mc.DeleteOne([]byte("b"), 5); ok {
+		t.Errorf("expected no sixth occurrence of b")
+	}
+	mc.Set([]byte("b"), []byte("4"))
+	if vals, _ := mc.GetAll([]byte("b")); joined(vals) != "1,3,4" {
+		t.Errorf("expected the append after the last item, got: %q", vals)
+	}
+	if !s.SetCollection("m", nil).IsMulti() || s.GetCollectionMulti("plain") != nil {
+		t.Errorf("expected SetCollection() to keep the multi mode")
+	}
+	s.Flush()
+	s.Close()
+
+	s, err := NewStore(f)
+	if err != nil {
+		t.Fatalf("expected reopen to work, got: %v", err)
+	}
+	defer s.Close()
+	if mc = s.GetCollectionMulti("m"); mc == nil {
+		t.Fatalf("expected a multi collection after reopen")
+	}
+	if vals, _ := mc.GetAll([]byte("b")); joined(vals) != "1,3,4" {
+		t.Errorf("expected the values of b after reopen, got: %q", vals)
+	}
+	d, err := s.CopyTo(NewMemStoreFile(), 0)
+	if err != nil {
+		t.Fatalf("expected CopyTo to work, got: %v", err)
+	}
+	defer d.Close()
+	bf := NewMemStoreFile()
+	if err = s.BackupTo(bf); err != nil {
+		t.Fatalf("expected BackupTo to work, got: %v", err)
+	}
+	b, err := NewStore(bf)
+	if err != nil {
+		t.Fatalf("expected the backup to open, got: %v", err)
+	}
+	defer b.Close()
+	for _, dst := range []*Store{d, b} {
+		dmc := dst.GetCollectionMulti("m")
+		if dmc == nil {
+			t.Fatalf("expected a copied multi collection")
+		}
+		if vals, _ := dmc.GetAll([]byte("b")); joined(vals) != "1,3,4" {
+			t.Errorf("expected the copied values of b, got: %q", vals)
+		}
+		if dst.GetCollectionMulti("plain") != nil {
+			t.Errorf("expected plain to stay plain")
+		}
+	}
+	if n, err := mc.Delete([]byte("b")); n != 3 || err != nil {
+		t.Errorf("expected 3 deletes, got: %v, %v", n, err)
+	}
+	if vals, _ := mc.GetAll([]byte("b")); vals != nil {
+		t.Errorf("expected no values of b, got: %q", vals)
+	}
+	if n, _ := mc.Count(); n != 4 {
+		t.Errorf("expected 4 items left, got: %v", n)
+	}
+}
+
+func TestCollectionsInfo(t *testing.T) {
+	s, _ := NewStore(NewMemStoreFile())
+	for j, name := range []string{"b", "c", "a"} {
+		c := s.SetCollection(name, nil)
+		for k := 0; k < j*10; k++ {
+			c.Set([]byte(strconv.Itoa(k)), []byte("v"))
+		}
+		if name == "c" {
+			s.Flush()
+		}
+	}
+	infos, err := s.CollectionsInfo()
+	if err != nil || len(infos) != 3 {
+		t.Fatalf("expected 3 infos, got: %v, %v", infos, err)
+	}
+	for j, info := range infos {
+		if info.Name != []string{"a", "b", "c"}[j] {
+			t.Errorf("expected infos sorted by name, got: %v", infos)
+		}
+		c := s.GetCollection(info.Name)
+		n, _ := c.Count()
+		_, numBytes, _ := c.GetTotals()
+		var maxPriority int32
+		c.VisitItemsAscend(nil, false, func(i *Item) bool {
+			if i.Priority > maxPriority {
+				maxPriority = i.Priority
+			}
+			return true
+		})
+		if info.NumItems != n || info.NumBytes != numBytes ||
+			info.RootPriority != maxPriority {
+			t.Errorf("expected info of %s to match its totals, got: %+v,"+
+				" count: %v, bytes: %v, max priority: %v",
+				info.Name, info, n, numBytes, maxPriority)
+		}
+	}
+	if infos[1].NumItems != 0 || infos[1].Dirty || !infos[0].Dirty {
+		t.Errorf("expected an empty b and a dirty a, got: %+v", infos)
+	}
+	s.Close()
+	if _, err = s.CollectionsInfo(); err != ErrStoreClosed {
+		t.Errorf("expected ErrStoreClosed, got: %v", err)
+	}
+}
+
+func TestMultiCollectionConcurrentSetItem(t *testing.T) {
+	s, _ := NewStore(nil)
+	mc := s.SetCollectionMulti("m", nil)
+	var wg sync.WaitGroup
+	errs := make(chan error, 16*50)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := mc.Set([]byte("k"), []byte(fmt.Sprintf("%d-%d", g, j))); err != nil {
+					errs <- err
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("expected concurrent appends to work, got: %v", err)
+	}
+	vals, _ := mc.GetAll([]byte("k"))
+	if len(vals) != 16*50 {
+		t.Errorf("expected %v values of k, got: %v", 16*50, len(vals))
+	}
+	seen := map[string]bool{}
+	for _, v := range vals {
+		seen[string(v)] = true
+	}
+	if len(seen) != 16*50 {
+		t.Errorf("expected distinct values, got: %v", len(seen))
+	}
+
+	// An append that loses the race for its sequence number, to a racer
+	// that appends while the loser looks up the last item of the key.
+	var armed int32
+	var rc *MultiCollection
+	rc = s.SetCollectionMulti("r", func(a, b []byte) int {
+		if atomic.CompareAndSwapInt32(&armed, 1, 0) {
+			done := make(chan error)
+			go func() { done <- rc.Set([]byte("k"), []byte("racer")) }()
+			if err := <-done; err != nil {
+				t.Errorf("expected the racer to work, got: %v", err)
+			}
+		}
+		return bytes.Compare(a, b)
+	})
+	rc.Set([]byte("k"), []byte("first"))
+	atomic.StoreInt32(&armed, 1)
+	if err := rc.Set([]byte("k"), []byte("loser")); err != nil {
+		t.Errorf("expected the lost race to be retried, got: %v", err)
+	}
+	if vals, _ = rc.GetAll([]byte("k")); string(bytes.Join(vals, []byte(","))) != "first,racer,loser" {
+		t.Errorf("expected the loser after the racer, got: %q", vals)
+	}
+
+	before := s.AllocStats()
+	for j := 0; j < 10; j++ {
+		mc.MinItem(true)
+		mc.MaxItem(true)
+	}
+	after := s.AllocStats()
+	if after.ItemAddRefs-before.ItemAddRefs != after.ItemDecRefs-before.ItemDecRefs {
+		t.Errorf("expected MinItem and MaxItem to release their items, got: %+v, before: %+v",
+			after, before)
+	}
+}
+
+func TestVisitItemsLazy(t *testing.T) {
+	f := &memFile{}
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprintf("v%03d", i)))
+	}
+	s.Flush()
+	valReads := 0
+	s, _ = NewStoreEx(f, StoreCallbacks{
+		ItemValRead: func(c *Collection, i *Item,
+			r io.ReaderAt, offset int64, valLength uint32) error {
+			valReads++
+			i.Val = make([]byte, valLength)
+			_, err := r.ReadAt(i.Val, offset)
+			return err
+		},
+	})
+	x = s.GetCollection("x")
+	var keys, vals []string
+	var load func() ([]byte, error)
+	err := x.VisitItemsAscendLazy([]byte("010"),
+		func(i *Item, loadVal func() ([]byte, error)) bool {
+			if i.Val != nil {
+				t.Errorf("expected no value, got: %q", i.Val)
+			}
+			keys = append(keys, string(i.Key))
+			if i.Key[2] == '7' {
+				v, err := loadVal()
+				if err != nil {
+					t.Errorf("expected loadVal to work, got: %v", err)
+				}
+				vals = append(vals, string(v))
+			}
+			load = loadVal
+			return true
+		})
+	if err != nil || len(keys) != 90 || keys[0] != "010" {
+		t.Errorf("expected the visit from the target, got: %v, %v", err, keys)
+	}
+	if len(vals) != 9 || vals[0] != "v017" || vals[8] != "v097" {
+		t.Errorf("expected the selected values, got: %v", vals)
+	}
+	if valReads != 9 {
+		t.Errorf("expected only the selected values read, got: %v", valReads)
+	}
+	if _, err = load(); err == nil {
+		t.Errorf("expected loadVal to fail after the visit")
+	}
+	keys = nil
+	err = x.VisitItemsDescendLazy([]byte("003"),
+		func(i *Item, loadVal func() ([]byte, error)) bool {
+			v, _ := loadVal()
+			keys = append(keys, string(i.Key)+"="+string(v))
+			return true
+		})
+	if err != nil || fmt.Sprint(keys) != "[002=v002 001=v001 000=v000]" {
+		t.Errorf("expected descending values, got: %v, %v", err, keys)
+	}
+	if valReads != 12 {
+		t.Errorf("expected 3 more value reads, got: %v", valReads)
+	}
+}
+
+func TestCompareAssertions(t *testing.T) {
+	broken := map[string]KeyCompare{
+		"not antisymmetric": func(a, b []byte) int {
+			if bytes.Equal(a, b) {
+				return 0
+			}
+			return 1
+		},
+		"not reflexive": func(a, b []byte) int {
+			if c := bytes.Compare(a, b); c != 0 {
+				return c
+			}
+			return -1
+		},
+	}
+	for name, compare := range broken {
+		s, _ := NewStore(nil)
+		s.SetCompareAssertions(true)
+		x := s.SetCollection("x", compare)
+		var err error
+		for i := 0; i < 10 && err == nil; i++ {
+			err = x.Set([]byte(fmt.Sprintf("%d", i)), []byte("v"))
+		}
+		var ce *CompareError
+		if !errors.Is(err, ErrInconsistentCompare) || !errors.As(err, &ce) ||
+			ce.Collection != "x" {
+			t.Errorf("expected a compare error, %s, got: %v", name, err)
+		}
+		if name == "not reflexive" {
+			if !strings.Contains(fmt.Sprint(err), "compare(") ||
+				!bytes.Equal(ce.A, ce.B) {
+				t.Errorf("expected a descriptive error, got: %v", err)
+			}
+		}
+	}
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", broken["not antisymmetric"])
+	for i := 0; i < 10; i++ {
+		if err := x.Set([]byte(fmt.Sprintf("%d", i)), []byte("v")); err != nil {
+			t.Errorf("expected no assertions by default, got: %v", err)
+		}
+	}
+	s.SetCompareAssertions(true)
+	y := s.SetCollection("y", nil)
+	for i := 0; i < 100; i++ {
+		if err := y.Set([]byte(fmt.Sprintf("%d", i)), []byte("v")); err != nil {
+			t.Errorf("expected a consistent compare to work, got: %v", err)
+		}
+	}
+	keys := [][]byte{[]byte("1"), []byte("2")}
+	// Keys that are absent, so that the check at the root always fails,
+	// whatever shape the broken compare left the tree in.
+	absent := [][]byte{[]byte("a"), []byte("b")}
+	if _, err := x.DeleteMulti(absent); !errors.Is(err, ErrInconsistentCompare) {
+		t.Errorf("expected DeleteMulti to check compares, got: %v", err)
+	}
+	if n, err := y.DeleteMulti(keys); err != nil || n != 2 {
+		t.Errorf("expected DeleteMulti to work, got: %v, %v", n, err)
 	}
 }
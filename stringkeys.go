@@ -0,0 +1,43 @@
+package gkvlite
+
+import (
+	"unsafe"
+)
+
+// The string keyed wrappers of the []byte keyed methods.  The reads and
+// deletes use the bytes of the string key without copying them, which
+// is safe as the collection only compares and hashes the keys of those
+// calls, or hands them to callbacks that must not modify them, while
+// the setters copy the key, as it's retained in a node.
+
+// Returns the bytes of s, which must not be modified.
+func stringBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
+
+// Like Get(), with a string key.
+func (t *Collection) GetString(key string) (val []byte, err error) {
+	return t.Get(stringBytes(key))
+}
+
+// Like Set(), with a string key.
+func (t *Collection) SetString(key string, val []byte) error {
+	return t.Set([]byte(key), val)
+}
+
+// Like Delete(), with a string key.
+func (t *Collection) DeleteString(key string) (wasDeleted bool, err error) {
+	return t.Delete(stringBytes(key))
+}
+
+// Like VisitItemsAscend(), from a string target key.
+func (t *Collection) VisitItemsAscendString(target string, withValue bool,
+	visitor ItemVisitor) error {
+	return t.VisitItemsAscend(stringBytes(target), withValue, visitor)
+}
+
+// Like VisitItemsDescend(), from a string target key.
+func (t *Collection) VisitItemsDescendString(target string, withValue bool,
+	visitor ItemVisitor) error {
+	return t.VisitItemsDescend(stringBytes(target), withValue, visitor)
+}
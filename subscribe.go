@@ -0,0 +1,251 @@
+package gkvlite
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// The kinds of changes of a ChangeEvent.
+type ChangeType int
+
+const (
+	ChangeSet    ChangeType = iota // The item of Key was set.
+	ChangeDelete                   // The item of Key was deleted.
+	ChangeRange                    // Items from Key to LastKey may have changed.
+	ChangeMissed                   // Events were dropped, see Subscribe().
+)
+
+func (ct ChangeType) String() string {
+	switch ct {
+	case ChangeSet:
+		return "set"
+	case ChangeDelete:
+		return "delete"
+	case ChangeRange:
+		return "range"
+	case ChangeMissed:
+		return "missed"
+	}
+	return "unknown"
+}
+
+// A change of the items of a Collection, see Subscribe().  The keys
+// belong to the Collection, so they must not be modified.
+type ChangeEvent struct {
+	Type ChangeType
+	Key  []byte
+
+	// The last key of a ChangeRange, which is inclusive.
+	LastKey []byte
+
+	// Whether the key had an item before the change, which for a
+	// ChangeRange is always true, as some of its keys may have had.
+	OldValPresent bool
+
+	// The Generation() of the Store when the change became visible,
+	// so the change is persisted by the Flush() of the next one.
+	FlushGen uint64
+}
+
+// A subscription to the changes of a key range of a Collection, see
+// Subscribe().
+type Subscription struct {
+	minKey, maxKey []byte
+	ch             chan ChangeEvent
+
+	m       sync.Mutex // Protects the fields below.
+	closed  bool
+	missed  bool
+	dropped uint64
+}
+
+// Subscribes to the changes of the items of the collection with keys
+// in the range from minKey (inclusive) to maxKey (exclusive), where a
+// nil minKey or maxKey leaves the range unbounded on that side, such as
+// for the invalidation of caches.  The ChangeEvents are sent to the
+// Events() channel of the Subscription, of buffer events, after the
+// root swap that made their change visible to readers, in the order of
+// the changes.  A SetItem() and Delete() send an event of their key.
+// The bulk mutations that swap the root once for many keys, which are
+// DeleteMulti(), ReadJSON(), ImportCSV() and the batches of the writer
+// goroutine of StartWriter(), send a single ChangeRange event per root
+// swap of the range of the keys, to the subscriptions whose ranges
+// overlap it, rather than an event per key.  Replacing roots, such as by
+// FlushRevert() or RemoveCollection(), and rebuilding the tree by
+// Rebalance() aren't reported, like for OnMutation().
+//
+// The events are never waited for, so a subscriber that doesn't keep
+// up doesn't slow down the writers: when the channel is full, the
+// event is dropped and counted by Dropped(), and a ChangeMissed event
+// is sent ahead of the next event that fits, after which the
+// subscriber must assume that anything in its range changed.  A
+// collection without subscriptions pays only an atomic load per
+// mutation.  The channel is closed by Close(), and when the collection
+// is closed, such as by Store.Close() or RemoveCollection().  The
+// subscriptions carry over to the Collection that SetCollection()
+// returns for an existing name.
+func (t *Collection) Subscribe(minKey, maxKey []byte,
+	buffer int) (*Subscription, error) {
+	if buffer < 1 {
+		return nil, errors.New("subscription buffer must be positive")
+	}
+	if minKey != nil && maxKey != nil && t.compare(minKey, maxKey) >= 0 {
+		return nil, errors.New("subscription minKey must be less than its maxKey")
+	}
+	sub := &Subscription{ch: make(chan ChangeEvent, buffer)}
+	if minKey != nil {
+		sub.minKey = append([]byte{}, minKey...)
+	}
+	if maxKey != nil {
+		sub.maxKey = append([]byte{}, maxKey...)
+	}
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	if err := t.writableErr(); err != nil {
+		return nil, err
+	}
+	subs := append([]*Subscription{sub}, t.subscriptions()...)
+	atomic.StorePointer(&t.subs, unsafe.Pointer(&subs))
+	return sub, nil
+}
+
+// Returns the channel of the ChangeEvents of the subscription.
+func (sub *Subscription) Events() <-chan ChangeEvent {
+	return sub.ch
+}
+
+// Returns the number of events that were dropped as the channel was
+// full, see Subscribe().
+func (sub *Subscription) Dropped() uint64 {
+	sub.m.Lock()
+	defer sub.m.Unlock()
+	return sub.dropped
+}
+
+// Ends the subscription and closes its channel, after which no more
+// events are sent.  Never blocks on the channel, which may still have
+// events to receive.
+func (sub *Subscription) Close() error {
+	sub.m.Lock()
+	defer sub.m.Unlock()
+	if sub.closed {
+		return errors.New("subscription already closed")
+	}
+	sub.closed = true
+	close(sub.ch)
+	return nil
+}
+
+// Returns the subscriptions of the collection, or nil if it has none.
+func (t *Collection) subscriptions() []*Subscription {
+	if p := (*[]*Subscription)(atomic.LoadPointer(&t.subs)); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// Closes the subscriptions of a collection that's closed.
+func (t *Collection) closeSubscriptions() {
+	p := (*[]*Subscription)(atomic.SwapPointer(&t.subs, nil))
+	if p == nil {
+		return
+	}
+	for _, sub := range *p {
+		sub.Close()
+	}
+}
+
+// Sends a change of the keys from key to lastKey, which are the same
+// but for a ChangeRange, to the subscriptions of the range, and drops
+// the closed subscriptions.  Invoked while the mutationLock() is held.
+func (t *Collection) publishChange(subs []*Subscription, ct ChangeType,
+	key, lastKey []byte, oldValPresent bool) {
+	if subs == nil {
+		return
+	}
+	ev := ChangeEvent{Type: ct, Key: key, OldValPresent: oldValPresent,
+		FlushGen: t.store.Generation()}
+	if ct == ChangeRange {
+		ev.LastKey = lastKey
+	}
+	numClosed := 0
+	for _, sub := range subs {
+		if (sub.maxKey == nil || t.compare(key, sub.maxKey) < 0) &&
+			(sub.minKey == nil || t.compare(lastKey, sub.minKey) >= 0) {
+			if !sub.send(ev) {
+				numClosed++
+			}
+		} else if sub.isClosed() {
+			numClosed++
+		}
+	}
+	if numClosed > 0 {
+		t.pruneSubscriptions()
+	}
+}
+
+// Like publishChange(), for a ChangeRange from the smallest to the
+// largest of the keys.
+func (t *Collection) publishRange(subs []*Subscription, keys [][]byte) {
+	if subs == nil || len(keys) == 0 {
+		return
+	}
+	first, last := keys[0], keys[0]
+	for _, key := range keys[1:] {
+		if t.compare(key, first) < 0 {
+			first = key
+		} else if t.compare(key, last) > 0 {
+			last = key
+		}
+	}
+	t.publishChange(subs, ChangeRange, first, last, true)
+}
+
+// Invoked while the mutationLock() is held.
+func (t *Collection) pruneSubscriptions() {
+	var open []*Subscription
+	for _, sub := range t.subscriptions() {
+		if !sub.isClosed() {
+			open = append(open, sub)
+		}
+	}
+	if open == nil {
+		atomic.StorePointer(&t.subs, nil)
+		return
+	}
+	atomic.StorePointer(&t.subs, unsafe.Pointer(&open))
+}
+
+// Sends the event, or drops it when the channel is full, and returns
+// false if the subscription is closed.
+func (sub *Subscription) send(ev ChangeEvent) bool {
+	sub.m.Lock()
+	defer sub.m.Unlock()
+	if sub.closed {
+		return false
+	}
+	if sub.missed {
+		select {
+		case sub.ch <- ChangeEvent{Type: ChangeMissed, FlushGen: ev.FlushGen}:
+			sub.missed = false
+		default:
+			sub.dropped++
+			return true
+		}
+	}
+	select {
+	case sub.ch <- ev:
+	default:
+		sub.missed = true
+		sub.dropped++
+	}
+	return true
+}
+
+func (sub *Subscription) isClosed() bool {
+	sub.m.Lock()
+	defer sub.m.Unlock()
+	return sub.closed
+}
@@ -0,0 +1,172 @@
+package gkvlite
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Tags name the persisted roots of an earlier Flush(), so that the
+// state of the Store as of that Flush() remains readable, via
+// OpenTag(), after later mutations and flushes.  The tags are saved
+// in every roots record, as a map of tag names to the collections
+// JSON of the tagged roots record.  As a tag keeps old nodes and
+// items alive by their file offsets, tags cannot be combined with free
+// space reuse or with auto-compaction.  CopyTo() doesn't copy tags.
+
+// Records the roots of the last Flush() under the given name,
+// replacing any existing tag of that name, and persists the tag by
+// writing a new roots record.  Any unflushed mutations are not part
+// of the tag, nor are they persisted.
+func (s *Store) TagSnapshot(name string) error {
+	if name == "" {
+		return errors.New("tag name missing")
+	}
+	return s.updateTags(func(tags map[string]json.RawMessage,
+		rr *rootsRecord) error {
+		tags[name] = rr.Collections
+		return nil
+	})
+}
+
+// Removes the named tag and persists its removal by writing a new
+// roots record.  Stores returned by OpenTag() for the tag remain
+// readable, unless free space reuse is enabled afterwards.
+func (s *Store) DeleteTag(name string) error {
+	return s.updateTags(func(tags map[string]json.RawMessage,
+		rr *rootsRecord) error {
+		if _, ok := tags[name]; !ok {
+			return fmt.Errorf("no tag: %s", name)
+		}
+		delete(tags, name)
+		return nil
+	})
+}
+
+// Returns the sorted names of the tags.
+func (s *Store) ListTags() []string {
+	tags := s.tagsMap()
+	res := make([]string, 0, len(tags))
+	for name := range tags {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Returns a read-only Store of the collections as of the named tag.
+// Like a snapshot, the returned Store shares the StoreFile of this
+// Store, so it's invalid once the StoreFile is closed.
+func (s *Store) OpenTag(name string) (*Store, error) {
+	cJSON, ok := s.tagsMap()[name]
+	if !ok {
+		return nil, fmt.Errorf("no tag: %s", name)
+	}
+	return s.openRoots(cJSON)
+}
+
+// Returns a read-only Store of the collections JSON of a roots record.
+func (s *Store) openRoots(cJSON json.RawMessage) (*Store, error) {
+	res := &Store{
+		file:       s.file,
+		size:       atomic.LoadInt64(&s.size),
+		readOnly:   true,
+		callbacks:  s.callbacks,
+		metrics:    s.metrics,
+		logger:     s.logger,
+		debugLevel: s.debugLevel,
+		debugRefs:  s.debugRefs,
+		encrypted:  s.encrypted,
+		maxDepth:   s.maxDepth,
+	}
+	m := make(map[string]*Collection)
+	if err := json.Unmarshal(cJSON, &m); err != nil {
+		return nil, err
+	}
+	for collName, t := range m {
+		t.name = collName
+		t.store = res
+		if err := res.loadCompare(t); err != nil {
+			return nil, err
+		}
+	}
+	res.coll = unsafe.Pointer(&m)
+	return res, nil
+}
+
+func (s *Store) tagsMap() map[string]json.RawMessage {
+	p := atomic.LoadPointer(&s.tags)
+	if p == nil {
+		return nil
+	}
+	return *(*map[string]json.RawMessage)(p)
+}
+
+// Returns the JSON of the tags for a roots record, or nil if none.
+func (s *Store) tagsJSON() ([]byte, error) {
+	tags := s.tagsMap()
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(tags)
+}
+
+func (s *Store) hasTags() bool {
+	return len(s.tagsMap()) > 0
+}
+
+// Applies a change to a copy of the tags and writes a roots record
+// with them and the collections of the last roots record.
+func (s *Store) updateTags(
+	update func(map[string]json.RawMessage, *rootsRecord) error) error {
+	if s.isClosed() {
+		return ErrStoreClosed
+	}
+	if s.readOnly {
+		return fmt.Errorf("%w, so cannot change tags", ErrReadOnly)
+	}
+	if s.file == nil {
+		return errors.New("no file / in-memory only, so no tags")
+	}
+	if s.freeList.tracking() {
+		return errors.New("free space reuse is enabled, so cannot change tags")
+	}
+	if s.autoCompact.enabled() {
+		return errors.New("auto-compaction is enabled, so cannot change tags")
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.isClosed() {
+		return ErrStoreClosed
+	}
+	rr, rootsLoc, err := s.scanRoots(atomic.LoadInt64(&s.size))
+	if err != nil {
+		return err
+	}
+	if rootsLoc == nil {
+		return errors.New("no Flush() yet, so no roots to tag")
+	}
+	orig := atomic.LoadPointer(&s.tags)
+	tags := map[string]json.RawMessage{}
+	for name, cJSON := range s.tagsMap() {
+		tags[name] = cJSON
+	}
+	if err = update(tags, &rr); err != nil {
+		return err
+	}
+	atomic.StorePointer(&s.tags, unsafe.Pointer(&tags))
+	if err = s.writeRootsJSON(rr.Collections); err != nil {
+		atomic.StorePointer(&s.tags, orig)
+		return err
+	}
+	if s.discarded > 0 { // Drop any leftovers after a recovery.
+		if err = s.file.Truncate(atomic.LoadInt64(&s.size)); err != nil {
+			return err
+		}
+		s.discarded = 0
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package gkvlite
 
 import (
 	"fmt"
+	"sort"
 )
 
 // The core algorithms for treaps are straightforward.  However, that
@@ -64,11 +65,6 @@ func (o *Store) union(t *Collection, this *nodeLoc, that *nodeLoc,
 		if err != nil {
 			return empty_nodeLoc, err
 		}
-		leftNum, leftBytes, rightNum, rightBytes, err :=
-			numInfo(o, newLeft, newRight)
-		if err != nil {
-			return empty_nodeLoc, err
-		}
 		var middleNode *node
 		if !middle.isEmpty() {
 			middleNode, err = middle.read(o)
@@ -76,13 +72,27 @@ func (o *Store) union(t *Collection, this *nodeLoc, that *nodeLoc,
 				return empty_nodeLoc, err
 			}
 			middleItemLoc := &middleNode.item
-			res = t.mkNodeLoc(t.mkNode(middleItemLoc, newLeft, newRight,
-				leftNum+rightNum+1,
-				leftBytes+rightBytes+uint64(middleItemLoc.NumBytes(t))))
+			middleItem, err := middleItemLoc.read(t, false)
+			if err != nil {
+				return empty_nodeLoc, err
+			}
+			// The replacement item has a lower priority than this node,
+			// so it's placed by its own priority under this position.
+			// The new nodes of newLeft and newRight that joinMiddle()
+			// replaces, when that is a batch, are in t.created.
+			res, err = o.joinMiddle(t, newLeft, newRight,
+				middleItemLoc, middleItem.Priority, reclaimMark)
+			if err != nil {
+				return empty_nodeLoc, err
+			}
 		} else {
+			numNodes, numBytes, err :=
+				t.aggregates(newLeft, newRight, thisItemLoc)
+			if err != nil {
+				return empty_nodeLoc, err
+			}
 			res = t.mkNodeLoc(t.mkNode(thisItemLoc, newLeft, newRight,
-				leftNum+rightNum+1,
-				leftBytes+rightBytes+uint64(thisItemLoc.NumBytes(t))))
+				numNodes, numBytes))
 		}
 		t.freeNodeLoc(left)
 		t.freeNodeLoc(right)
@@ -107,14 +117,15 @@ func (o *Store) union(t *Collection, this *nodeLoc, that *nodeLoc,
 	if err != nil {
 		return empty_nodeLoc, err
 	}
-	leftNum, leftBytes, rightNum, rightBytes, err :=
-		numInfo(o, newLeft, newRight)
+	numNodes, numBytes, err := t.aggregates(newLeft, newRight, thatItemLoc)
 	if err != nil {
 		return empty_nodeLoc, err
 	}
 	res = t.mkNodeLoc(t.mkNode(thatItemLoc, newLeft, newRight,
-		leftNum+rightNum+1,
-		leftBytes+rightBytes+uint64(thatItemLoc.NumBytes(t))))
+		numNodes, numBytes))
+	// The middle node, if any, is the displaced node of this treap.  It
+	// may still be reachable from older roots and snapshots, so it's
+	// only marked, and its item ref is released once on reclaim.
 	middleNode := middle.Node()
 	t.freeNodeLoc(left)
 	t.freeNodeLoc(right)
@@ -145,7 +156,10 @@ func (o *Store) split(t *Collection, n *nodeLoc, s []byte,
 		return empty_nodeLoc, empty_nodeLoc, empty_nodeLoc, err
 	}
 
-	c := t.compare(s, nItem.Key)
+	c, err := t.compareChecked(s, nItem.Key)
+	if err != nil {
+		return empty_nodeLoc, empty_nodeLoc, empty_nodeLoc, err
+	}
 	if c == 0 {
 		left := t.mkNodeLoc(nil).Copy(&nNode.left)
 		right := t.mkNodeLoc(nil).Copy(&nNode.right)
@@ -162,13 +176,13 @@ func (o *Store) split(t *Collection, n *nodeLoc, s []byte,
 		if err != nil {
 			return empty_nodeLoc, empty_nodeLoc, empty_nodeLoc, err
 		}
-		leftNum, leftBytes, rightNum, rightBytes, err := numInfo(o, right, &nNode.right)
+		numNodes, numBytes, err :=
+			t.aggregates(right, &nNode.right, nItemLoc)
 		if err != nil {
 			return empty_nodeLoc, empty_nodeLoc, empty_nodeLoc, err
 		}
 		newRight := t.mkNodeLoc(t.mkNode(nItemLoc, right, &nNode.right,
-			leftNum+rightNum+1,
-			leftBytes+rightBytes+uint64(nItemLoc.NumBytes(t))))
+			numNodes, numBytes))
 		t.freeNodeLoc(right)
 		t.markReclaimable(nNode, reclaimMark)
 		return left, middle, newRight, nil
@@ -182,13 +196,12 @@ func (o *Store) split(t *Collection, n *nodeLoc, s []byte,
 	if err != nil {
 		return empty_nodeLoc, empty_nodeLoc, empty_nodeLoc, err
 	}
-	leftNum, leftBytes, rightNum, rightBytes, err := numInfo(o, &nNode.left, left)
+	numNodes, numBytes, err := t.aggregates(&nNode.left, left, nItemLoc)
 	if err != nil {
 		return empty_nodeLoc, empty_nodeLoc, empty_nodeLoc, err
 	}
 	newLeft := t.mkNodeLoc(t.mkNode(nItemLoc, &nNode.left, left,
-		leftNum+rightNum+1,
-		leftBytes+rightBytes+uint64(nItemLoc.NumBytes(t))))
+		numNodes, numBytes))
 	t.freeNodeLoc(left)
 	t.markReclaimable(nNode, reclaimMark)
 	return newLeft, middle, right, nil
@@ -230,14 +243,13 @@ func (o *Store) join(t *Collection, this *nodeLoc, that *nodeLoc,
 		if err != nil {
 			return empty_nodeLoc, err
 		}
-		leftNum, leftBytes, rightNum, rightBytes, err :=
-			numInfo(o, &thisNode.left, newRight)
+		numNodes, numBytes, err :=
+			t.aggregates(&thisNode.left, newRight, thisItemLoc)
 		if err != nil {
 			return empty_nodeLoc, err
 		}
 		res = t.mkNodeLoc(t.mkNode(thisItemLoc, &thisNode.left, newRight,
-			leftNum+rightNum+1,
-			leftBytes+rightBytes+uint64(thisItemLoc.NumBytes(t))))
+			numNodes, numBytes))
 		t.markReclaimable(thisNode, reclaimMark)
 		t.freeNodeLoc(newRight)
 		return res, nil
@@ -247,23 +259,169 @@ func (o *Store) join(t *Collection, this *nodeLoc, that *nodeLoc,
 	if err != nil {
 		return empty_nodeLoc, err
 	}
-	leftNum, leftBytes, rightNum, rightBytes, err :=
-		numInfo(o, newLeft, &thatNode.right)
+	numNodes, numBytes, err :=
+		t.aggregates(newLeft, &thatNode.right, thatItemLoc)
 	if err != nil {
 		return empty_nodeLoc, err
 	}
 	res = t.mkNodeLoc(t.mkNode(thatItemLoc, newLeft, &thatNode.right,
-		leftNum+rightNum+1,
-		leftBytes+rightBytes+uint64(thatItemLoc.NumBytes(t))))
+		numNodes, numBytes))
+	t.markReclaimable(thatNode, reclaimMark)
+	t.freeNodeLoc(newLeft)
+	return res, nil
+}
+
+// Joins this treap and that treap with the item in between them,
+// which is placed by its priority, like join() does for the roots.
+// All keys from this treap should be less than the item's key, which
+// should be less than all keys from that treap.  Like join(), it marks
+// the replaced nodes of both treaps reclaimable, which may be new nodes
+// when union() rebuilt the treaps from a batch of items, so the caller
+// of such a union() must reclaim them, see reclaimUnpublished().
+func (o *Store) joinMiddle(t *Collection, this *nodeLoc, that *nodeLoc,
+	itemLoc *itemLoc, priority int32, reclaimMark *node) (
+	res *nodeLoc, err error) {
+	thisNode, err := this.read(o)
+	if err != nil {
+		return empty_nodeLoc, err
+	}
+	thatNode, err := that.read(o)
+	if err != nil {
+		return empty_nodeLoc, err
+	}
+	var thisItem, thatItem *Item
+	if !this.isEmpty() && thisNode != nil {
+		if thisItem, err = thisNode.item.read(t, false); err != nil {
+			return empty_nodeLoc, err
+		}
+	}
+	if !that.isEmpty() && thatNode != nil {
+		if thatItem, err = thatNode.item.read(t, false); err != nil {
+			return empty_nodeLoc, err
+		}
+	}
+	if (thisItem == nil || thisItem.Priority <= priority) &&
+		(thatItem == nil || thatItem.Priority <= priority) {
+		numNodes, numBytes, err := t.aggregates(this, that, itemLoc)
+		if err != nil {
+			return empty_nodeLoc, err
+		}
+		return t.mkNodeLoc(t.mkNode(itemLoc, this, that,
+			numNodes, numBytes)), nil
+	}
+	if thatItem == nil ||
+		(thisItem != nil && thisItem.Priority > thatItem.Priority) {
+		newRight, err := o.joinMiddle(t, &thisNode.right, that,
+			itemLoc, priority, reclaimMark)
+		if err != nil {
+			return empty_nodeLoc, err
+		}
+		numNodes, numBytes, err :=
+			t.aggregates(&thisNode.left, newRight, &thisNode.item)
+		if err != nil {
+			return empty_nodeLoc, err
+		}
+		res = t.mkNodeLoc(t.mkNode(&thisNode.item, &thisNode.left, newRight,
+			numNodes, numBytes))
+		t.markReclaimable(thisNode, reclaimMark)
+		t.freeNodeLoc(newRight)
+		return res, nil
+	}
+	newLeft, err := o.joinMiddle(t, this, &thatNode.left,
+		itemLoc, priority, reclaimMark)
+	if err != nil {
+		return empty_nodeLoc, err
+	}
+	numNodes, numBytes, err :=
+		t.aggregates(newLeft, &thatNode.right, &thatNode.item)
+	if err != nil {
+		return empty_nodeLoc, err
+	}
+	res = t.mkNodeLoc(t.mkNode(&thatNode.item, newLeft, &thatNode.right,
+		numNodes, numBytes))
 	t.markReclaimable(thatNode, reclaimMark)
 	t.freeNodeLoc(newLeft)
 	return res, nil
 }
 
+// Deletes the sorted, distinct keys from a treap in one pass, which
+// only descends into the subtrees that have keys to delete.  The
+// deleted and rebuilt input nodes are marked reclaimable, and the
+// deleted nodes are appended to deleted.  As join() also marks the
+// nodes of its inputs, which here may be new nodes from deeper in the
+// pass, the tops of those inputs are appended to joined; see
+// reclaimUnpublished().
+func (o *Store) deleteKeys(t *Collection, n *nodeLoc, keys [][]byte,
+	reclaimMark *node, deleted *[]*node, joined *[]*node) (
+	res *nodeLoc, err error) {
+	nNode, err := n.read(o)
+	if err != nil {
+		return empty_nodeLoc, err
+	}
+	if len(keys) == 0 || n.isEmpty() || nNode == nil {
+		return t.mkNodeLoc(nil).Copy(n), nil
+	}
+	nItemLoc := &nNode.item
+	nItem, err := nItemLoc.read(t, false)
+	if err != nil {
+		return empty_nodeLoc, err
+	}
+	lo := sort.Search(len(keys), func(i int) bool {
+		return t.compare(keys[i], nItem.Key) >= 0
+	})
+	hi := lo
+	if hi < len(keys) {
+		c, err := t.compareChecked(keys[hi], nItem.Key)
+		if err != nil {
+			return empty_nodeLoc, err
+		}
+		if c == 0 {
+			hi++
+		}
+	}
+	numDeleted := len(*deleted)
+	newLeft, err := o.deleteKeys(t, &nNode.left, keys[:lo],
+		reclaimMark, deleted, joined)
+	if err != nil {
+		return empty_nodeLoc, err
+	}
+	defer t.freeNodeLoc(newLeft)
+	newRight, err := o.deleteKeys(t, &nNode.right, keys[hi:],
+		reclaimMark, deleted, joined)
+	if err != nil {
+		return empty_nodeLoc, err
+	}
+	defer t.freeNodeLoc(newRight)
+	if hi > lo {
+		res, err = o.join(t, newLeft, newRight, reclaimMark)
+		if err != nil {
+			return empty_nodeLoc, err
+		}
+		*deleted = append(*deleted, nNode)
+		*joined = append(*joined, newLeft.Node(), newRight.Node())
+		t.markReclaimable(nNode, reclaimMark)
+		return res, nil
+	}
+	if len(*deleted) == numDeleted {
+		return t.mkNodeLoc(nil).Copy(n), nil
+	}
+	numNodes, numBytes, err := t.aggregates(newLeft, newRight, nItemLoc)
+	if err != nil {
+		return empty_nodeLoc, err
+	}
+	res = t.mkNodeLoc(t.mkNode(nItemLoc, newLeft, newRight,
+		numNodes, numBytes))
+	t.markReclaimable(nNode, reclaimMark)
+	return res, nil
+}
+
 func (o *Store) walk(t *Collection, withValue bool, cfn func(*node) (*nodeLoc, bool)) (
 	res *Item, err error) {
-	rnl := t.rootAddRef()
-	defer t.rootDecRef(rnl)
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return nil, err
+	}
+	defer t.openRootDecRef(rnl)
 	n := rnl.root
 	nNode, err := n.read(o)
 	if err != nil || n.isEmpty() || nNode == nil {
@@ -279,6 +437,9 @@ func (o *Store) walk(t *Collection, withValue bool, cfn func(*node) (*nodeLoc, b
 			return nil, err
 		}
 		if child.isEmpty() || childNode == nil {
+			if childNode == nil {
+				o.warnNilNode("walk", child)
+			}
 			i, err := nNode.item.read(t, withValue)
 			if err != nil {
 				return nil, err
@@ -293,35 +454,82 @@ func (o *Store) walk(t *Collection, withValue bool, cfn func(*node) (*nodeLoc, b
 func (o *Store) visitNodes(t *Collection, n *nodeLoc, target []byte,
 	withValue bool, visitor ItemVisitorEx, depth uint64,
 	choiceFunc func(int, *node) (bool, *nodeLoc, *nodeLoc)) (bool, error) {
-	nNode, err := n.read(o)
-	if err != nil {
-		return false, err
-	}
-	if n.isEmpty() || nNode == nil {
-		return true, nil
-	}
-	nItemLoc := &nNode.item
-	nItem, err := nItemLoc.read(t, false)
-	if err != nil {
-		return false, err
-	}
-	if nItem == nil {
-		panic(fmt.Sprintf("visitNodes nItem nil: %#v", nNode))
+	var errRead error
+	keepGoing, err := o.visitItemLocs(t, n, target,
+		func(iloc *itemLoc, depth uint64) bool {
+			nItem, err := iloc.read(t, withValue)
+			if err != nil {
+				errRead = err
+				return false
+			}
+			return visitor(nItem, depth)
+		}, depth, choiceFunc)
+	if errRead != nil {
+		return false, errRead
 	}
-	choice, choiceT, choiceF := choiceFunc(t.compare(target, nItem.Key), nNode)
-	if choice {
-		keepGoing, err :=
-			o.visitNodes(t, choiceT, target, withValue, visitor, depth+1, choiceFunc)
-		if err != nil || !keepGoing {
-			return false, err
+	return keepGoing, err
+}
+
+// A node of visitItemLocs() whose item is still to be visited, once the
+// subtree that its choiceFunc chose first is done, and then its other
+// subtree.
+type visitFrame struct {
+	itemLoc *itemLoc
+	next    *nodeLoc
+	depth   uint64
+}
+
+// Like visitNodes(), but visits the itemLocs of the nodes, whose items
+// are already read without their values.  The traversal is iterative,
+// with an explicit stack of the nodes on the path, so it's in the same
+// order as the recursion of the choiceFunc would be, but without a
+// goroutine stack frame per level.
+func (o *Store) visitItemLocs(t *Collection, n *nodeLoc, target []byte,
+	visitor func(iloc *itemLoc, depth uint64) bool, depth uint64,
+	choiceFunc func(int, *node) (bool, *nodeLoc, *nodeLoc)) (bool, error) {
+	var stackBuf [48]visitFrame // Enough for the depths of most trees.
+	stack := stackBuf[:0]
+	for {
+		for {
+			nNode, err := n.read(o)
+			if err != nil {
+				return false, err
+			}
+			if n.isEmpty() || nNode == nil {
+				if nNode == nil {
+					o.warnNilNode("visitNodes", n)
+				}
+				break
+			}
+			if err = o.checkDepth(depth); err != nil {
+				return false, err
+			}
+			nItemLoc := &nNode.item
+			nItem, err := nItemLoc.read(t, false)
+			if err != nil {
+				return false, err
+			}
+			if nItem == nil {
+				o.logf("visitNodes: nil item from node: %#v", nNode)
+				panic(fmt.Sprintf("visitNodes nItem nil: %#v", nNode))
+			}
+			choice, choiceT, choiceF := choiceFunc(t.compareTarget(target, nItem.Key), nNode)
+			if choice {
+				stack = append(stack, visitFrame{nItemLoc, choiceF, depth})
+				n = choiceT
+			} else {
+				n = choiceF
+			}
+			depth++
 		}
-		nItem, err := nItemLoc.read(t, withValue)
-		if err != nil {
-			return false, err
+		if len(stack) == 0 {
+			return true, nil
 		}
-		if !visitor(nItem, depth) {
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !visitor(f.itemLoc, f.depth) {
 			return false, nil
 		}
+		n, depth = f.next, f.depth+1
 	}
-	return o.visitNodes(t, choiceF, target, withValue, visitor, depth+1, choiceFunc)
 }
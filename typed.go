@@ -0,0 +1,177 @@
+package gkvlite
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// A Codec converts the keys or values of a TypedCollection to and from
+// their bytes.
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(b []byte) (T, error)
+}
+
+// A Codec of strings as their bytes, which preserves their order under
+// bytes.Compare.
+type StringCodec struct{}
+
+func (StringCodec) Encode(v string) ([]byte, error) { return []byte(v), nil }
+func (StringCodec) Decode(b []byte) (string, error) { return string(b), nil }
+
+// A Codec of uint64's as 8 big-endian bytes, so that their numeric
+// order is their order under bytes.Compare.
+type Uint64Codec struct{}
+
+func (Uint64Codec) Encode(v uint64) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, v), nil
+}
+
+func (Uint64Codec) Decode(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, fmt.Errorf("uint64 must be 8 bytes, got: %v", len(b))
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// A Codec of values as their JSON.  It's meant for values, as the
+// order of the JSON doesn't generally follow the order of the values.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) { return json.Marshal(v) }
+
+func (JSONCodec[T]) Decode(b []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+// A TypedCollection is a view of a Collection with keys of type K and
+// values of type V, which are converted by the codecs.  The key codec
+// must be order-preserving, in that the order of encoded keys under the
+// KeyCompare of the collection is the order of the keys, so that the
+// ranges of AscendRange() make sense; CheckKeyCodec() checks that for
+// sample keys.
+type TypedCollection[K any, V any] struct {
+	c    *Collection
+	keys Codec[K]
+	vals Codec[V]
+}
+
+// Returns a typed view of the collection, with the given codecs.
+func NewTypedCollection[K any, V any](c *Collection,
+	keyCodec Codec[K], valCodec Codec[V]) *TypedCollection[K, V] {
+	return &TypedCollection[K, V]{c: c, keys: keyCodec, vals: valCodec}
+}
+
+// Returns the underlying Collection.
+func (tc *TypedCollection[K, V]) Collection() *Collection {
+	return tc.c
+}
+
+// Returns the value of the key, and whether the key was found.
+func (tc *TypedCollection[K, V]) Get(key K) (val V, found bool, err error) {
+	k, err := tc.keys.Encode(key)
+	if err != nil {
+		return val, false, err
+	}
+	b, err := tc.c.Get(k)
+	if err != nil || b == nil {
+		return val, false, err
+	}
+	if val, err = tc.vals.Decode(b); err != nil {
+		return val, false, fmt.Errorf("decode failed, key: %q: %w", k, err)
+	}
+	return val, true, nil
+}
+
+// Replaces or inserts the value of the key, see Collection.Set().
+func (tc *TypedCollection[K, V]) Set(key K, val V) error {
+	k, err := tc.keys.Encode(key)
+	if err != nil {
+		return err
+	}
+	v, err := tc.vals.Encode(val)
+	if err != nil {
+		return err
+	}
+	return tc.c.Set(k, v)
+}
+
+// Deletes the key, if it's in the collection.
+func (tc *TypedCollection[K, V]) Delete(key K) error {
+	k, err := tc.keys.Encode(key)
+	if err != nil {
+		return err
+	}
+	_, err = tc.c.Delete(k)
+	return err
+}
+
+// Visits the items with keys from lo (inclusive) to hi (exclusive) in
+// ascending order, until the visitor returns false.
+func (tc *TypedCollection[K, V]) AscendRange(lo, hi K,
+	visitor func(K, V) bool) error {
+	loKey, err := tc.keys.Encode(lo)
+	if err != nil {
+		return err
+	}
+	hiKey, err := tc.keys.Encode(hi)
+	if err != nil {
+		return err
+	}
+	var errDecode error
+	err = tc.c.VisitItemsAscend(loKey, true, func(i *Item) bool {
+		if tc.c.compare(i.Key, hiKey) >= 0 {
+			return false
+		}
+		k, err := tc.keys.Decode(i.Key)
+		if err != nil {
+			errDecode = fmt.Errorf("decode failed, key: %q: %w", i.Key, err)
+			return false
+		}
+		v, err := tc.vals.Decode(i.Val)
+		if err != nil {
+			errDecode = fmt.Errorf("decode failed, key: %q: %w", i.Key, err)
+			return false
+		}
+		return visitor(k, v)
+	})
+	if errDecode != nil {
+		return errDecode
+	}
+	return err
+}
+
+// Checks that the key codec round-trips the sample keys and preserves
+// their order in the collection c, that is, that the KeyCompare of c
+// orders any two encoded samples like less orders the samples.
+func CheckKeyCodec[K any](c *Collection, codec Codec[K],
+	less func(a, b K) bool, samples ...K) error {
+	encoded := make([][]byte, len(samples))
+	for i, s := range samples {
+		b, err := codec.Encode(s)
+		if err != nil {
+			return err
+		}
+		d, err := codec.Decode(b)
+		if err != nil {
+			return err
+		}
+		if less(s, d) || less(d, s) {
+			return fmt.Errorf("key codec doesn't round-trip sample %v", i)
+		}
+		encoded[i] = b
+	}
+	for i := range samples {
+		for j := range samples {
+			cmp := c.compare(encoded[i], encoded[j])
+			if less(samples[i], samples[j]) != (cmp < 0) {
+				return fmt.Errorf("key codec doesn't preserve the order"+
+					" of samples %v and %v", i, j)
+			}
+		}
+	}
+	return nil
+}
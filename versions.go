@@ -0,0 +1,281 @@
+package gkvlite
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"unsafe"
+)
+
+// When versioned, an item record has the high bit of its priority set,
+// like a prefix compressed one, but its base offset is
+// itemLoc_versionsBase, which is -2 as an int64, and in place of the
+// shared length it has the uint16 number of the prior versions of the
+// item, whose ploc's follow, newest first, and then its whole key and
+// its value.  A prior version is a plain item record of its own, which
+// may be prefix compressed or chunked, and the versioned records are
+// never.  As with prefix compression, the ploc.Length of the item and
+// the record's own length field are those of the plain record, so that
+// NumBytes() stays meaningful.
+const itemLoc_versionsBase = ^uint64(1)
+
+// The most prior versions of each item that SetKeepVersions() keeps.
+const MaxKeepVersions = 255
+
+// The prior versions of an item, newest first, which are never modified
+// once they're set on an itemLoc, only replaced.  A dirty version has
+// an Item of its own, and a persisted one just its ploc.
+type itemVersions []*itemLoc
+
+// Enables the keeping of up to n prior versions of each item, where 0
+// (the default) keeps none, such as for audits of what the value of a
+// key was before its last updates, see GetVersion() and
+// VisitVersions().  A SetItem() of a key that's already in the
+// collection adds the item that it replaces as the newest prior version
+// of the item, and drops the versions beyond n.  The versions are kept
+// with the item, so a delete of a key drops them too, and Flush()
+// writes them as item records of their own, which the item record
+// references by their file offsets, so the dropped versions are dead
+// space for CopyTo() to compact away, which carries the kept versions
+// over, like CopyToIncremental() and Rebalance() do.  The setting is
+// persisted with the roots, and a collection that kept versions notes
+// that in the roots records, and such files can't be read by older
+// versions of gkvlite.  Not allowed with encryption or with free space
+// reuse, as the versions are kept alive by their file offsets, nor with
+// the writer goroutine of StartWriter(), whose batches set the items of
+// a key at once.
+func (t *Collection) SetKeepVersions(n int) error {
+	if n < 0 || n > MaxKeepVersions {
+		return fmt.Errorf("kept versions must be from 0 to %v, got: %v",
+			MaxKeepVersions, n)
+	}
+	if t.store.readOnly {
+		return fmt.Errorf("%w, so cannot SetKeepVersions()", ErrReadOnly)
+	}
+	if n > 0 {
+		if t.store.encrypted {
+			return errors.New("cannot keep versions with encryption")
+		}
+		if t.store.freeList.tracking() {
+			return errors.New("free space reuse is enabled, so cannot keep versions")
+		}
+		if atomic.LoadPointer(&t.writer) != nil {
+			return errors.New("collection has a writer, so cannot keep versions")
+		}
+		atomic.StoreInt32(&t.versionsUsed, 1)
+	}
+	atomic.StoreInt32(&t.keepVersions, int32(n))
+	return nil
+}
+
+// Returns the number of prior versions of each item that the collection
+// keeps, see SetKeepVersions().
+func (t *Collection) KeepVersions() int {
+	return int(atomic.LoadInt32(&t.keepVersions))
+}
+
+// Whether the collection may have versioned item records.
+func (t *Collection) hasVersions() bool {
+	return atomic.LoadInt32(&t.versionsUsed) != 0
+}
+
+// Whether any collection may have versioned item records.
+func (s *Store) hasVersions() bool {
+	for _, c := range s.collections() {
+		if c.hasVersions() {
+			return true
+		}
+	}
+	return false
+}
+
+// Retrieves a version of the item of a key, where stepsBack 0 is the
+// item itself, 1 the item that it replaced, and so on, along with its
+// value.  Returns nil if the key is not in the collection, or if it
+// doesn't have that many prior versions.  The returned Item should be
+// treated as immutable.
+func (t *Collection) GetVersion(key []byte, stepsBack int) (*Item, error) {
+	if stepsBack < 0 {
+		return nil, errors.New("stepsBack must be non-negative")
+	}
+	var res *Item
+	err := t.VisitVersions(key, func(i *Item) bool {
+		if stepsBack == 0 {
+			res = i
+			return false
+		}
+		stepsBack--
+		return true
+	})
+	return res, err
+}
+
+// Visits the item of a key and then its prior versions, newest first,
+// along with their values, until the visitor returns false.  Nothing is
+// visited if the key is not in the collection.  The visited Items
+// should be treated as immutable.
+func (t *Collection) VisitVersions(key []byte, visitor ItemVisitor) error {
+	atomic.AddUint64(&t.numGets, 1)
+	rnl, err := t.openRootAddRef()
+	if err != nil {
+		return err
+	}
+	defer t.openRootDecRef(rnl)
+	iloc, iItem, err := t.lookup(rnl.root, key)
+	if err != nil || iItem == nil {
+		return err
+	}
+	if iItem, err = iloc.read(t, true); err != nil {
+		return err
+	}
+	if !visitor(iItem) {
+		return nil
+	}
+	for _, v := range iloc.versionsOf() {
+		vItem, err := t.readVersion(v)
+		if err != nil {
+			return err
+		}
+		if !visitor(vItem) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Returns the prior versions of an item that was read, oldest first,
+// along with their values, or nil if it has none.
+func (t *Collection) versionItems(iloc *itemLoc) ([]*Item, error) {
+	vs := iloc.versionsOf()
+	if len(vs) == 0 {
+		return nil, nil
+	}
+	res := make([]*Item, len(vs))
+	for j, v := range vs {
+		vItem, err := t.readVersion(v)
+		if err != nil {
+			return nil, err
+		}
+		res[len(vs)-1-j] = vItem
+	}
+	return res, nil
+}
+
+// Returns a prior version with its value, where a persisted one is read
+// without caching it, as it's not in the tree to be evicted.
+func (t *Collection) readVersion(v *itemLoc) (*Item, error) {
+	if vItem := v.Item(); vItem != nil && vItem.Val != nil {
+		return vItem, nil
+	}
+	vItem, err := (&itemLoc{loc: unsafe.Pointer(v.Loc())}).read(t, true)
+	if err == nil && vItem == nil {
+		err = errors.New("missing item version")
+	}
+	return vItem, err
+}
+
+func (i *itemLoc) versionsOf() itemVersions {
+	if p := (*itemVersions)(atomic.LoadPointer(&i.versions)); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// Sets the versions of a persisted item record that was read, unless
+// they're already set.
+func (i *itemLoc) loadVersions(locs []ploc) {
+	if atomic.LoadPointer(&i.versions) != nil {
+		return
+	}
+	vs := make(itemVersions, len(locs))
+	for j := range locs {
+		vs[j] = &itemLoc{loc: unsafe.Pointer(&locs[j])}
+	}
+	atomic.CompareAndSwapPointer(&i.versions, nil, unsafe.Pointer(&vs))
+}
+
+// Returns the versions of an item that replaces the item at cur, which
+// becomes the newest of the keep versions.  Invoked while the
+// mutationLock() is held.
+func (t *Collection) replacedVersions(cur *itemLoc, keep int) *itemVersions {
+	prev := &itemLoc{numBytes: cur.numBytes}
+	if loc := cur.Loc(); !loc.isEmpty() {
+		prev.loc = unsafe.Pointer(loc)
+	} else if cItem := cur.Item(); cItem != nil {
+		// Copied, as the collection may recycle the buffers of its items.
+		prev.item = unsafe.Pointer(&Item{
+			Key:      append([]byte(nil), cItem.Key...),
+			Val:      append([]byte{}, cItem.Val...),
+			Priority: cItem.Priority,
+
+			TransientVal: cItem.TransientVal,
+		})
+	}
+	old := cur.versionsOf()
+	if len(old) > keep-1 {
+		old = old[:keep-1]
+	}
+	vs := make(itemVersions, 0, 1+len(old))
+	vs = append(append(vs, prev), old...)
+	return &vs
+}
+
+// Writes the dirty versions of an item and then its versioned item
+// record.
+func (i *itemLoc) writeVersioned(c *Collection, iItem *Item, hdr []byte,
+	vs itemVersions, vlength int, ilength int) error {
+	for _, v := range vs {
+		if err := v.write(c); err != nil {
+			return err
+		}
+	}
+	b := make([]byte, itemLoc_prefixHdrLength+len(vs)*ploc_length+len(iItem.Key))
+	pos := copy(b, hdr[:itemLoc_hdrLength])
+	priority := binary.BigEndian.Uint32(b[pos-4 : pos])
+	binary.BigEndian.PutUint32(b[pos-4:pos], priority|itemLoc_prefixFlag)
+	binary.BigEndian.PutUint64(b[pos:pos+8], itemLoc_versionsBase)
+	pos += 8
+	binary.BigEndian.PutUint16(b[pos:pos+2], uint16(len(vs)))
+	pos += 2
+	for _, v := range vs {
+		pos = v.Loc().write(b, pos)
+	}
+	pos += copy(b[pos:], iItem.Key)
+	offset := c.store.appendOffset()
+	if err := c.store.writeAt(b, offset); err != nil {
+		return err
+	}
+	if err := c.store.ItemValWrite(c, iItem, c.store.recordWriter(),
+		offset+int64(pos)); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&c.store.size, offset+int64(pos+vlength))
+	atomic.StoreInt32(&c.versionsUsed, 1)
+	c.store.flushLogItem(i)
+	atomic.StorePointer(&i.loc,
+		unsafe.Pointer(&ploc{Offset: offset, Length: uint32(ilength)}))
+	return nil
+}
+
+// Reads the key of a versioned item record at loc with n versions from
+// r into key, returning the offset of the value and the versions.
+func readVersionedKey(r io.ReaderAt, loc *ploc, n int,
+	key []byte) (int64, []ploc, error) {
+	b := make([]byte, n*ploc_length+len(key))
+	if _, err := readFull(r, b, loc.Offset+int64(itemLoc_prefixHdrLength)); err != nil {
+		return 0, nil, err
+	}
+	locs := make([]ploc, n)
+	pos := 0
+	for j := range locs {
+		if _, pos = locs[j].read(b, pos); locs[j].isEmpty() ||
+			locs[j].Offset >= loc.Offset {
+			return 0, nil, fmt.Errorf("unexpected item version loc: %v,"+
+				" item loc: %v", locs[j], loc)
+		}
+	}
+	copy(key, b[pos:])
+	return loc.Offset + int64(itemLoc_prefixHdrLength+len(b)), locs, nil
+}
@@ -0,0 +1,413 @@
+package gkvlite
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The WAL format: a header of WAL_MAGIC and a uint32 WAL_VERSION,
+// followed by one record per mutation, each as a uint32 body length and
+// a uint32 CRC-32 (IEEE) of the body, then the body, which is a uint64
+// Generation() of the Store when the mutation took effect, a uint8
+// op, a uint32 priority, a uint32 collection name length, a uint32 key
+// length and a uint32 value length, then the collection name, key and
+// value bytes.  The op is a MutationOp, or walRemoveCollection.  All
+// integers are big-endian.  A record that's cut short or whose CRC
+// doesn't match, such as one that was being appended during a crash,
+// ends the WAL.
+const WAL_VERSION = uint32(1)
+
+var WAL_MAGIC []byte = []byte("0g1w2l")
+
+const wal_hdrLength int = 6 + 4 // len(WAL_MAGIC) + 4.
+
+const wal_recordHdrLength int = 4 + 4
+
+const wal_bodyHdrLength int = 8 + 1 + 4 + 4 + 4 + 4
+
+// The op of a RemoveCollection() record, whose key and value are empty.
+const walRemoveCollection = MutationOp(255)
+
+// WAL state of a Store, see EnableWAL().
+type walState struct {
+	log    *walLog // Protected by Store.notifyLock.
+	active int32   // Atomic protected; non-zero while log is non-nil.
+
+	enableLock sync.Mutex // Serializes EnableWAL().
+}
+
+type walLog struct {
+	f         StoreFile
+	syncEvery time.Duration
+	stop      chan struct{} // Closed to stop the syncer goroutine, if any.
+	done      chan struct{} // Closed once the syncer goroutine is done.
+
+	m      sync.Mutex // Protects the fields below, for the syncer goroutine.
+	offset int64      // Where the next record is appended.
+	dirty  bool       // Whether records were appended since the last sync.
+	err    error      // The first write or sync error, which stops the log.
+}
+
+// Enables a write-ahead log in walFile, which makes each SetItem() and
+// Delete() (including each deleted item of a DeleteMulti()) of the
+// named collections durable on its own, without the cost of a Flush()
+// of the tree.  The mutations are appended to walFile, in the order
+// that they take effect, as checksummed records, like the entries of a
+// replication log, see StartReplicationLog(), along with
+// RemoveCollection() of the named collections.  When syncEvery is 0,
+// walFile is synced after each record, before the mutation returns,
+// if it has a Sync() method like os.File, and otherwise it's synced
+// by a goroutine every syncEvery, so the mutations since the last sync
+// may be lost by a crash.  A Flush() still persists the tree, and then
+// checkpoints the WAL: it syncs the Store file and truncates walFile to
+// its header, so the WAL holds just the mutations since the last
+// Flush().
+//
+// EnableWAL() must be invoked right after opening the Store and
+// setting up its collections, such as their compare funcs, as it first
+// replays the records of walFile that are newer than the last Flush()
+// of the Store into the in-memory tree, with SetItem(), Delete() and
+// RemoveCollection(), creating missing collections with the default
+// compare func.  A torn or corrupt record ends the replay, and it and
+// the records after it are discarded, by truncating walFile, so every
+// mutation up to it is recovered.  An empty walFile is initialized.
+//
+// While the WAL is enabled, the mutations of the named collections are
+// serialized, as they're observed (see OnMutation()), and a Flush()
+// also makes the mutations of the collections that it doesn't flush,
+// such as ones created meanwhile, wait for its checkpoint.
+// RenameCollection(), SwapCollections(), FlushRevert() and
+// FlushRevertCollection(), which the WAL doesn't record, aren't
+// allowed.  A failed write or sync of walFile stops the WAL, after
+// which the mutations are only persisted by the next Flush(), and its
+// error is returned by DisableWAL().  The WAL is disabled by Close(),
+// and isn't persisted, so EnableWAL() must be invoked again after the
+// Store is reopened.
+func (s *Store) EnableWAL(walFile StoreFile, syncEvery time.Duration) error {
+	if s.readOnly {
+		return fmt.Errorf("%w, so cannot EnableWAL()", ErrReadOnly)
+	}
+	if s.file == nil {
+		return errors.New("no file / in-memory only, so cannot EnableWAL()")
+	}
+	if syncEvery < 0 {
+		return fmt.Errorf("WAL sync interval must be non-negative, got: %v", syncEvery)
+	}
+	s.wal.enableLock.Lock()
+	defer s.wal.enableLock.Unlock()
+	if s.isClosed() {
+		return ErrStoreClosed
+	}
+	if atomic.LoadInt32(&s.wal.active) != 0 {
+		return errors.New("WAL already enabled")
+	}
+	end, err := s.replayWAL(walFile)
+	if err != nil {
+		return err
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.lockCollections(s.collections())()
+	s.notifyLock.Lock()
+	defer s.notifyLock.Unlock()
+	if s.isClosed() {
+		return ErrStoreClosed
+	}
+	l := &walLog{f: walFile, syncEvery: syncEvery, offset: end}
+	if syncEvery > 0 {
+		l.stop, l.done = make(chan struct{}), make(chan struct{})
+		go l.syncer()
+	}
+	s.wal.log = l
+	atomic.StoreInt32(&s.wal.active, 1)
+	return nil
+}
+
+// Disables the WAL of EnableWAL(), after a last sync of walFile.
+// Returns the error of a failed write or sync of walFile, after which
+// no further records were written, as mutations never fail due to the
+// WAL.
+func (s *Store) DisableWAL() error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.lockCollections(s.collections())()
+	return s.disableWAL()
+}
+
+// Invoked while the writeLock and the writeLocks of all the collections
+// are held.
+func (s *Store) disableWAL() error {
+	s.notifyLock.Lock()
+	defer s.notifyLock.Unlock()
+	l := s.wal.log
+	if l == nil {
+		return errors.New("WAL not enabled")
+	}
+	s.wal.log = nil
+	atomic.StoreInt32(&s.wal.active, 0)
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.err == nil && l.dirty {
+		l.err = syncWAL(l.f)
+	}
+	return l.err
+}
+
+// Replays the records of walFile that are newer than the last Flush(),
+// and returns the end of the last valid record, after truncating any
+// that aren't valid.
+func (s *Store) replayWAL(walFile StoreFile) (int64, error) {
+	fi, err := walFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	hdr := make([]byte, wal_hdrLength)
+	if fi.Size() < int64(wal_hdrLength) {
+		copy(hdr, WAL_MAGIC)
+		binary.BigEndian.PutUint32(hdr[len(WAL_MAGIC):], WAL_VERSION)
+		if err = walFile.Truncate(0); err != nil {
+			return 0, err
+		}
+		if _, err = writeFull(walFile, hdr, 0); err != nil {
+			return 0, err
+		}
+		return int64(wal_hdrLength), syncWAL(walFile)
+	}
+	if _, err = readFull(walFile, hdr, 0); err != nil {
+		return 0, err
+	}
+	if string(hdr[:len(WAL_MAGIC)]) != string(WAL_MAGIC) {
+		return 0, errors.New("not a WAL, bad magic")
+	}
+	if version := binary.BigEndian.Uint32(hdr[len(WAL_MAGIC):]); version != WAL_VERSION {
+		return 0, fmt.Errorf("WAL version mismatch: "+
+			"current version: %v != found version: %v", WAL_VERSION, version)
+	}
+	gen := s.Generation()
+	end := int64(wal_hdrLength)
+	for {
+		b, err := readWALRecord(walFile, end, fi.Size())
+		if err != nil {
+			return 0, err
+		}
+		if b == nil {
+			break
+		}
+		if binary.BigEndian.Uint64(b[0:8]) >= gen {
+			if err = s.applyWALRecord(b); err != nil {
+				return 0, fmt.Errorf("WAL offset: %v: %v", end, err)
+			}
+		}
+		end += int64(wal_recordHdrLength + len(b))
+	}
+	if end < fi.Size() {
+		s.logf("discarding the %v bytes of the WAL after offset: %v",
+			fi.Size()-end, end)
+		s.metricsCounter("walDiscardedBytes", fi.Size()-end)
+		if err = walFile.Truncate(end); err != nil {
+			return 0, err
+		}
+	}
+	return end, nil
+}
+
+// Returns the body of the record at offset of walFile, or nil at its
+// end or at a torn or corrupt record.
+func readWALRecord(walFile StoreFile, offset int64, size int64) ([]byte, error) {
+	if offset+int64(wal_recordHdrLength+wal_bodyHdrLength) > size {
+		return nil, nil
+	}
+	hdr := make([]byte, wal_recordHdrLength)
+	if _, err := readFull(walFile, hdr, offset); err != nil {
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(hdr[0:4]))
+	if length < int64(wal_bodyHdrLength) ||
+		offset+int64(wal_recordHdrLength)+length > size {
+		return nil, nil
+	}
+	b := make([]byte, length)
+	if _, err := readFull(walFile, b, offset+int64(wal_recordHdrLength)); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(b) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return nil, nil
+	}
+	nameLength := int64(binary.BigEndian.Uint32(b[13:17]))
+	keyLength := int64(binary.BigEndian.Uint32(b[17:21]))
+	valLength := int64(binary.BigEndian.Uint32(b[21:25]))
+	if int64(wal_bodyHdrLength)+nameLength+keyLength+valLength != length {
+		return nil, nil
+	}
+	return b, nil
+}
+
+// Applies the body of a WAL record to the Store.
+func (s *Store) applyWALRecord(b []byte) error {
+	op := MutationOp(b[8])
+	priority := int32(binary.BigEndian.Uint32(b[9:13]))
+	nameLength := binary.BigEndian.Uint32(b[13:17])
+	keyLength := binary.BigEndian.Uint32(b[17:21])
+	b = b[wal_bodyHdrLength:]
+	name := string(b[:nameLength])
+	key := b[nameLength : nameLength+keyLength]
+	if op == walRemoveCollection {
+		s.RemoveCollection(name)
+		return nil
+	}
+	c := s.GetCollection(name)
+	if c == nil {
+		c = s.SetCollection(name, nil)
+	}
+	if c == nil {
+		return ErrStoreClosed
+	}
+	switch op {
+	case MutationSet:
+		return c.SetItem(&Item{
+			Key:      key,
+			Val:      b[nameLength+keyLength:],
+			Priority: priority,
+		})
+	case MutationDelete:
+		_, err := c.Delete(key)
+		return err
+	}
+	return fmt.Errorf("unknown WAL op: %v", op)
+}
+
+// Invoked for every mutation, while the notifyLock is held when the WAL
+// is enabled.
+func (s *Store) logWAL(name string, op MutationOp,
+	key, val []byte, priority int32) {
+	if name == "" || op == MutationFlush || atomic.LoadInt32(&s.wal.active) == 0 {
+		return
+	}
+	if l := s.wal.log; l != nil {
+		l.append(s.Generation(), op, name, key, val, priority)
+	}
+}
+
+// Logs the RemoveCollection() of a named collection, but not of an
+// index collection, whose entries aren't logged either.
+func (s *Store) logWALRemove(name string) {
+	if name == "" || isIndexCollName(name) || atomic.LoadInt32(&s.wal.active) == 0 {
+		return
+	}
+	s.notifyLock.Lock()
+	defer s.notifyLock.Unlock()
+	s.logWAL(name, walRemoveCollection, nil, nil, 0)
+}
+
+func (l *walLog) append(gen uint64, op MutationOp, name string,
+	key, val []byte, priority int32) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.err != nil {
+		return
+	}
+	b := make([]byte, wal_recordHdrLength+wal_bodyHdrLength+
+		len(name)+len(key)+len(val))
+	body := b[wal_recordHdrLength:]
+	binary.BigEndian.PutUint64(body[0:8], gen)
+	body[8] = byte(op)
+	binary.BigEndian.PutUint32(body[9:13], uint32(priority))
+	binary.BigEndian.PutUint32(body[13:17], uint32(len(name)))
+	binary.BigEndian.PutUint32(body[17:21], uint32(len(key)))
+	binary.BigEndian.PutUint32(body[21:25], uint32(len(val)))
+	copy(body[wal_bodyHdrLength+copy(body[wal_bodyHdrLength:], name):], key)
+	copy(body[wal_bodyHdrLength+len(name)+len(key):], val)
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(b[4:8], crc32.ChecksumIEEE(body))
+	if _, l.err = writeFull(l.f, b, l.offset); l.err != nil {
+		return
+	}
+	l.offset += int64(len(b))
+	l.dirty = true
+	if l.syncEvery == 0 {
+		l.err = syncWAL(l.f)
+		l.dirty = false
+	}
+}
+
+// Syncs the WAL every syncEvery until it's stopped.
+func (l *walLog) syncer() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.syncEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		l.m.Lock()
+		if l.err == nil && l.dirty {
+			l.err = syncWAL(l.f)
+			l.dirty = false
+		}
+		l.m.Unlock()
+	}
+}
+
+// Takes the notifyLock for a Flush() while the WAL is enabled, so that
+// the mutations of the collections that the Flush() doesn't flush wait
+// for its checkpoint, and returns the func that releases it.  Invoked
+// while the writeLock is held.
+func (s *Store) lockWAL() func() {
+	if atomic.LoadInt32(&s.wal.active) == 0 {
+		return func() {}
+	}
+	s.notifyLock.Lock()
+	return s.notifyLock.Unlock
+}
+
+// Checkpoints the WAL after a Flush(), by syncing the Store file, so
+// that the Flush() is durable, and then truncating the WAL to its
+// header.  Invoked while the lockWAL() is held.
+func (s *Store) checkpointWAL() error {
+	l := s.wal.log
+	if l == nil {
+		return nil
+	}
+	if err := syncWAL(s.file); err != nil {
+		return err
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.err != nil || l.offset <= int64(wal_hdrLength) {
+		return nil
+	}
+	if l.err = l.f.Truncate(int64(wal_hdrLength)); l.err == nil {
+		l.offset = int64(wal_hdrLength)
+	}
+	s.metricsCounter("walCheckpoints", 1)
+	return nil
+}
+
+// Returns an error when the WAL is enabled, for the op that it
+// doesn't record.
+func (s *Store) walEnabledErr(op string) error {
+	if atomic.LoadInt32(&s.wal.active) != 0 {
+		return fmt.Errorf("the WAL is enabled, so cannot %s()", op)
+	}
+	return nil
+}
+
+// Syncs f, if it has a Sync() method.
+func syncWAL(f io.WriterAt) error {
+	if f, ok := f.(syncer); ok {
+		return f.Sync()
+	}
+	return nil
+}
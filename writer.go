@@ -0,0 +1,428 @@
+package gkvlite
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Options of StartWriterEx().
+type WriterOptions struct {
+	// The number of writes that may be queued for the writer goroutine
+	// before SetItem(), Set() and Delete() block.
+	QueueDepth int
+
+	// The most writes that are applied with a single root swap.  A
+	// MaxBatch of 0 means QueueDepth+1.
+	MaxBatch int
+
+	// How long the writer goroutine waits for more writes to fill a
+	// batch, once it took the first write of the batch.  A MaxDelay of
+	// 0 means no waiting, so a batch is whatever was queued meanwhile.
+	MaxDelay time.Duration
+}
+
+// The writer goroutine of a collection, see StartWriter().
+type collWriter struct {
+	t    *Collection
+	opts WriterOptions
+	ops  chan *writeOp
+	quit chan struct{} // Closed by stop(), to unblock submitters.
+	done chan struct{} // Closed once the goroutine has exited.
+
+	m       sync.RWMutex // Read locked by submitters while they enqueue.
+	stopped bool         // Protected by m; ops is closed once stopped.
+}
+
+// A queued SetItem() or, when item is nil, a Delete() of key.
+type writeOp struct {
+	item    *Item
+	key     []byte
+	deleted bool       // Whether a Delete() found the key, set before err.
+	err     chan error // Buffered, receives the outcome of the write.
+}
+
+// Starts a goroutine that applies the SetItem(), Set() and Delete()
+// calls of the collection in their arrival order, which then enqueue
+// their write and wait for its outcome.  The goroutine applies the
+// consecutive writes that are queued meanwhile as a batch, with a single
+// root swap for a run of sets and another for a run of deletes, so that
+// many concurrent writers publish fewer roots and copy fewer paths than
+// when they take turns on the collection's lock.  The writes of a run
+// become visible to readers all at once.  Mutation callbacks and the
+// replication log still see every write, in arrival order, on the
+// writer goroutine.
+//
+// The other mutations, such as DeleteMulti() and FlushRevertCollection(),
+// don't go through the queue, but are serialized with the batches.  The
+// StopWriter() method drains the queue and stops the goroutine, which
+// also stops when the collection is closed, such as by Store.Close(),
+// after failing the queued writes.  The writer doesn't carry over to the
+// Collection that SetCollection() returns for an existing name.
+func (t *Collection) StartWriter(queueDepth int) error {
+	return t.StartWriterEx(WriterOptions{QueueDepth: queueDepth})
+}
+
+// Like StartWriter(), with options of the batching.
+func (t *Collection) StartWriterEx(opts WriterOptions) error {
+	if opts.QueueDepth < 0 || opts.MaxBatch < 0 || opts.MaxDelay < 0 {
+		return errors.New("writer options must be non-negative")
+	}
+	if t.store.readOnly {
+		return ErrReadOnly
+	}
+	if t.indexes() != nil {
+		return errors.New("collection has secondary indexes, so cannot StartWriter()")
+	}
+	if t.KeepVersions() > 0 {
+		return errors.New("collection keeps item versions, so cannot StartWriter()")
+	}
+	if opts.MaxBatch == 0 {
+		opts.MaxBatch = opts.QueueDepth + 1
+	}
+	w := &collWriter{
+		t:    t,
+		opts: opts,
+		ops:  make(chan *writeOp, opts.QueueDepth),
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if !atomic.CompareAndSwapPointer(&t.writer, nil, unsafe.Pointer(w)) {
+		return errors.New("writer already started")
+	}
+	go w.run()
+	return nil
+}
+
+// Stops the writer goroutine of StartWriter(), once it applied the
+// queued writes, after which the writes are applied by their callers
+// again.  Must not be invoked by a mutation callback, which runs on the
+// writer goroutine.
+func (t *Collection) StopWriter() error {
+	w := (*collWriter)(atomic.SwapPointer(&t.writer, nil))
+	if w == nil {
+		return errors.New("no writer started, see StartWriter()")
+	}
+	w.stop()
+	<-w.done
+	return nil
+}
+
+// Like SetItem(), but returns without waiting for the writer goroutine
+// of StartWriter(), with a channel that receives the outcome of the
+// write.  Without a writer goroutine, the item is set right away.
+func (t *Collection) SetItemAsync(item *Item) <-chan error {
+	res := make(chan error, 1)
+	if err := t.checkItem(item); err != nil {
+		res <- err
+		return res
+	}
+	if w := (*collWriter)(atomic.LoadPointer(&t.writer)); w != nil {
+		op := &writeOp{item: item, err: res}
+		if w.enqueue(op) {
+			return res
+		}
+	}
+	res <- t.setItem(item)
+	return res
+}
+
+// Submits a write and waits for its outcome.  Returns false, without
+// submitting, when the writer has stopped.
+func (w *collWriter) submit(op *writeOp) (ok bool, err error) {
+	op.err = make(chan error, 1)
+	if !w.enqueue(op) {
+		return false, nil
+	}
+	return true, <-op.err
+}
+
+func (w *collWriter) enqueue(op *writeOp) bool {
+	w.m.RLock()
+	defer w.m.RUnlock()
+	if w.stopped {
+		return false
+	}
+	select {
+	case w.ops <- op:
+		return true
+	case <-w.quit:
+		return false
+	}
+}
+
+func (w *collWriter) stop() {
+	close(w.quit)
+	w.m.Lock()
+	w.stopped = true
+	close(w.ops)
+	w.m.Unlock()
+}
+
+func (w *collWriter) run() {
+	defer close(w.done)
+	batch := make([]*writeOp, 0, w.opts.MaxBatch)
+	for op := range w.ops {
+		batch = w.fill(append(batch[:0], op))
+		w.t.applyWrites(batch)
+		for i := range batch {
+			batch[i] = nil
+		}
+	}
+}
+
+// Adds queued writes to the batch, waiting up to MaxDelay for them.
+func (w *collWriter) fill(batch []*writeOp) []*writeOp {
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for len(batch) < w.opts.MaxBatch {
+		select {
+		case op, ok := <-w.ops:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, op)
+			continue
+		default:
+		}
+		if w.opts.MaxDelay <= 0 {
+			return batch
+		}
+		if timer == nil {
+			timer = time.NewTimer(w.opts.MaxDelay)
+		}
+		select {
+		case op, ok := <-w.ops:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, op)
+		case <-timer.C:
+			timer = nil
+			return batch
+		}
+	}
+	return batch
+}
+
+// Applies the batch as runs of consecutive sets and deletes, with a
+// root swap per run, and then notifies and completes the writes of the
+// run in their arrival order.
+func (t *Collection) applyWrites(batch []*writeOp) {
+	defer t.mutationUnlock(t.mutationLock())
+	for len(batch) > 0 {
+		n := 1
+		for n < len(batch) && (batch[n].item == nil) == (batch[0].item == nil) {
+			n++
+		}
+		run := batch[:n]
+		batch = batch[n:]
+		err := t.writableErr()
+		if err == nil {
+			if run[0].item != nil {
+				err = t.setItems(run)
+			} else {
+				err = t.deleteItems(run)
+			}
+		}
+		var keys [][]byte
+		for _, op := range run {
+			if err == nil && op.item != nil {
+				t.notifyMutation(MutationSet, op.item.Key, op.item.persistedVal(),
+					op.item.Priority)
+				keys = append(keys, op.item.Key)
+			} else if err == nil && op.deleted {
+				t.notifyMutation(MutationDelete, op.key, nil, 0)
+				keys = append(keys, op.key)
+			}
+		}
+		// Published before the writes complete, so that their callers
+		// find the events sent.
+		t.publishRange(t.subscriptions(), keys)
+		for _, op := range run {
+			op.err <- err
+		}
+	}
+}
+
+// Returns why the queued writes can't be applied, if so.  Invoked while
+// the mutationLock() is held.
+func (t *Collection) writableErr() error {
+	if t.store.isClosed() {
+		return ErrStoreClosed
+	}
+	t.rootLock.Lock()
+	defer t.rootLock.Unlock()
+	if t.root == nil {
+		return fmt.Errorf("%w, it was removed or replaced", ErrCollectionMissing)
+	}
+	return nil
+}
+
+// Sets the items of a run with a single union of a treap of the items
+// into the root.
+func (t *Collection) setItems(run []*writeOp) error {
+	items := make([]*Item, len(run))
+	for i, op := range run {
+		t.internKey(op.item)
+		items[i] = op.item
+	}
+	// Sorted stably and then deduplicated, so that the last set of a
+	// key wins, as if the sets were applied one by one.
+	sort.Stable(&itemsSorter{items, t.compare})
+	distinct := items[:0]
+	for _, item := range items {
+		if len(distinct) > 0 &&
+			t.compare(distinct[len(distinct)-1].Key, item.Key) == 0 {
+			distinct[len(distinct)-1] = item
+		} else {
+			distinct = append(distinct, item)
+		}
+	}
+	rnl := t.rootAddRef()
+	defer t.rootDecRef(rnl)
+	root := rnl.root
+	var deadLocs []*ploc
+	if t.store.freeList.tracking() {
+		for _, item := range distinct {
+			deadLoc, err := t.itemLocOf(root, item.Key)
+			if err != nil {
+				return err
+			}
+			deadLocs = append(deadLocs, deadLoc)
+		}
+	}
+	// The union replaces nodes that it made itself when the treap of the
+	// items has more than one node, so the nodes it makes are tracked,
+	// to reclaim the ones that aren't in the result.
+	var created []*node
+	t.created = &created
+	batch, err := t.mkTreap(distinct, nil)
+	var r *nodeLoc
+	if err == nil {
+		r, err = t.store.union(t, root, batch, &rnl.reclaimMark)
+		t.freeNodeLoc(batch)
+	}
+	t.created = nil
+	if err != nil {
+		return err
+	}
+	if t.store.debugLevel > 0 {
+		for _, item := range distinct {
+			t.debugValidate(r, item.Key)
+		}
+	}
+	keys := make([][]byte, len(distinct))
+	for i, item := range distinct {
+		t.bloomAdd(item.Key, r)
+		keys[i] = item.Key
+	}
+	t.reclaimUnpublished(root, created, &rnl.reclaimMark)
+	rnlNew := t.mkRootNodeLoc(r)
+	if !t.rootCAS(rnl, rnlNew) {
+		t.store.metricsCounter("rootCASFailures", 1)
+		return errors.New("concurrent mutation attempted")
+	}
+	t.lookupCacheInvalidate(keys...)
+	for _, deadLoc := range deadLocs {
+		t.addDeadLoc(rnl, deadLoc)
+	}
+	t.rootDecRef(rnl)
+	atomic.AddUint64(&t.numSets, uint64(len(run)))
+	return nil
+}
+
+// Returns a treap of the sorted, distinct items, built bottom-up as the
+// Cartesian tree of their priorities, where versions, unless nil, has
+// the versions of each item, see SetKeepVersions().
+func (t *Collection) mkTreap(items []*Item,
+	versions []*itemVersions) (*nodeLoc, error) {
+	left := make([]int, len(items))
+	right := make([]int, len(items))
+	stack := make([]int, 0, 32)
+	for i, item := range items {
+		left[i], right[i] = -1, -1
+		last := -1
+		for len(stack) > 0 && items[stack[len(stack)-1]].Priority < item.Priority {
+			last = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		}
+		left[i] = last
+		if len(stack) > 0 {
+			right[stack[len(stack)-1]] = i
+		}
+		stack = append(stack, i)
+	}
+	var mk func(i int) (*nodeLoc, error)
+	mk = func(i int) (*nodeLoc, error) {
+		if i < 0 {
+			return empty_nodeLoc, nil
+		}
+		l, err := mk(left[i])
+		if err != nil {
+			return empty_nodeLoc, err
+		}
+		defer t.freeNodeLoc(l)
+		r, err := mk(right[i])
+		if err != nil {
+			return empty_nodeLoc, err
+		}
+		defer t.freeNodeLoc(r)
+		item := items[i]
+		n := t.mkNode(nil, l, r, 0, 0)
+		t.store.debugRefs.begin(item, false)
+		t.store.ItemAddRef(t, item)
+		n.item.item = unsafe.Pointer(item)
+		n.item.numBytes = item.NumBytes(t)
+		if versions != nil {
+			n.item.versions = unsafe.Pointer(versions[i])
+		}
+		if n.numNodes, n.numBytes, err = t.aggregates(l, r, &n.item); err != nil {
+			return empty_nodeLoc, err
+		}
+		return t.mkNodeLoc(n), nil
+	}
+	return mk(stack[0])
+}
+
+// Deletes the keys of a run with a single root swap, where only the
+// first delete of a repeated key finds it.
+func (t *Collection) deleteItems(run []*writeOp) error {
+	keys := make([][]byte, len(run))
+	for i, op := range run {
+		keys[i] = op.key
+	}
+	_, err := t.deleteDistinct(t.distinctKeys(keys), func(deletedNodes []*node) {
+		sort.Sort(nodesByKey{deletedNodes, t.compare})
+		found := make([]bool, len(deletedNodes))
+		for _, op := range run {
+			i := sort.Search(len(deletedNodes), func(i int) bool {
+				return t.compare(deletedNodes[i].item.Item().Key, op.key) >= 0
+			})
+			if i < len(deletedNodes) && !found[i] &&
+				t.compare(deletedNodes[i].item.Item().Key, op.key) == 0 {
+				found[i], op.deleted = true, true
+			}
+		}
+	})
+	return err
+}
+
+type itemsSorter struct {
+	items   []*Item
+	compare KeyCompare
+}
+
+func (s *itemsSorter) Len() int      { return len(s.items) }
+func (s *itemsSorter) Swap(i, j int) { s.items[i], s.items[j] = s.items[j], s.items[i] }
+func (s *itemsSorter) Less(i, j int) bool {
+	return s.compare(s.items[i].Key, s.items[j].Key) < 0
+}